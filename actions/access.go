@@ -0,0 +1,137 @@
+/*
+ * access.go - Restricting which users may use a protector.
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package actions
+
+import (
+	"fmt"
+	"os/user"
+	"strconv"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/google/fscrypt/crypto"
+	"github.com/google/fscrypt/metadata"
+	"github.com/google/fscrypt/util"
+)
+
+// ErrProtectorAccessDenied indicates that a protector's access list doesn't
+// allow the user to use it.
+type ErrProtectorAccessDenied struct {
+	Descriptor string
+	User       *user.User
+}
+
+func (err *ErrProtectorAccessDenied) Error() string {
+	return fmt.Sprintf("user %q is not allowed to use protector %s",
+		err.User.Username, err.Descriptor)
+}
+
+// NewProtectorAccess returns an access list which only allows owner and the
+// given users and groups to use a protector.
+func NewProtectorAccess(owner *user.User, users []*user.User,
+	groups []*user.Group) *metadata.ProtectorAccess {
+	access := &metadata.ProtectorAccess{OwnerUid: int64(util.AtoiOrPanic(owner.Uid))}
+	for _, u := range users {
+		access.AllowedUids = append(access.AllowedUids, int64(util.AtoiOrPanic(u.Uid)))
+	}
+	for _, g := range groups {
+		access.AllowedGids = append(access.AllowedGids, int64(util.AtoiOrPanic(g.Gid)))
+	}
+	return access
+}
+
+// accessAllowsUser returns true if the access list allows u to use the
+// protector. A nil access list allows everyone, and root is always allowed.
+func accessAllowsUser(access *metadata.ProtectorAccess, u *user.User) bool {
+	if access == nil || u.Uid == "0" {
+		return true
+	}
+	uid := int64(util.AtoiOrPanic(u.Uid))
+	if uid == access.OwnerUid {
+		return true
+	}
+	for _, allowed := range access.AllowedUids {
+		if uid == allowed {
+			return true
+		}
+	}
+	if len(access.AllowedGids) == 0 {
+		return false
+	}
+	gids, err := u.GroupIds()
+	if err != nil {
+		util.Debugf("getting groups of user %q: %v", u.Username, err)
+		return false
+	}
+	for _, gid := range gids {
+		for _, allowed := range access.AllowedGids {
+			if gid == strconv.FormatInt(allowed, 10) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkProtectorAccess returns ErrProtectorAccessDenied if the Context's
+// TargetUser isn't allowed to use the protector, so that it can't be unlocked
+// (or its passphrase guessed) on behalf of other users.
+func (ctx *Context) checkProtectorAccess(data *metadata.ProtectorData) error {
+	if accessAllowsUser(data.GetAccess(), ctx.TargetUser) {
+		return nil
+	}
+	return &ErrProtectorAccessDenied{data.GetProtectorDescriptor(), ctx.TargetUser}
+}
+
+// OwnsProtector returns true if the protector belongs to the Context's
+// TargetUser: either its access list names them as the owner, or it is their
+// login protector.
+func (ctx *Context) OwnsProtector(info *ProtectorInfo) bool {
+	uid := int64(util.AtoiOrPanic(ctx.TargetUser.Uid))
+	if access := info.Access(); access != nil {
+		return access.OwnerUid == uid
+	}
+	return info.Source() == metadata.SourceType_pam_passphrase && info.UID() == uid
+}
+
+// SetAccess replaces the access list of the Protector. A nil access list lets
+// anyone who can read the protector use it. Requires unlocked Protector, since
+// the access list is covered by the metadata HMAC.
+func (protector *Protector) SetAccess(access *metadata.ProtectorAccess) (err error) {
+	if protector.key == nil {
+		return ErrLocked
+	}
+	newData := proto.Clone(protector.data).(*metadata.ProtectorData)
+	newData.Access = access
+	if newData.MetadataHmac, err = crypto.MetadataHMAC(protector.key, newData); err != nil {
+		return err
+	}
+	err = protector.Context.withMetadataLock(func() error {
+		data, err := sealProtectorName(protector.Context, newData)
+		if err != nil {
+			return err
+		}
+		return protector.Context.Mount.AddProtector(data, protector.ownerIfCreating)
+	})
+	if err != nil {
+		return err
+	}
+	protector.data = newData
+	return nil
+}
@@ -0,0 +1,95 @@
+/*
+ * access_test.go - Tests for restricting which users may use a protector.
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package actions
+
+import (
+	"os/user"
+	"testing"
+)
+
+var (
+	testOwner = &user.User{Uid: "54321", Username: "owner"}
+	testOther = &user.User{Uid: "54322", Username: "other"}
+	testRoot  = &user.User{Uid: "0", Username: "root"}
+)
+
+// Tests which users an access list allows.
+func TestAccessAllowsUser(t *testing.T) {
+	access := NewProtectorAccess(testOwner, nil, nil)
+	if !accessAllowsUser(access, testOwner) {
+		t.Error("owner should be allowed")
+	}
+	if !accessAllowsUser(access, testRoot) {
+		t.Error("root should be allowed")
+	}
+	if accessAllowsUser(access, testOther) {
+		t.Error("other user shouldn't be allowed")
+	}
+	if !accessAllowsUser(nil, testOther) {
+		t.Error("everyone should be allowed without an access list")
+	}
+	access = NewProtectorAccess(testOwner, []*user.User{testOther}, nil)
+	if !accessAllowsUser(access, testOther) {
+		t.Error("allowed user should be allowed")
+	}
+}
+
+// Tests that a protector with an access list can only be used by the users it
+// allows, and that the access list is authenticated.
+func TestProtectorAccess(t *testing.T) {
+	p, err := CreateProtector(testContext, testProtectorName, goodCallback, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Destroy()
+	defer p.Lock()
+	if err = p.SetAccess(NewProtectorAccess(testOwner, nil, nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	ownerCtx := *testContext
+	ownerCtx.TargetUser = testOwner
+	otherCtx := *testContext
+	otherCtx.TargetUser = testOther
+
+	owned, err := GetProtector(&ownerCtx, p.Descriptor())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ownerCtx.OwnsProtector(&ProtectorInfo{data: owned.data}) {
+		t.Error("protector should belong to its owner")
+	}
+	if err = owned.Unlock(goodCallback); err != nil {
+		t.Errorf("access list isn't authenticated correctly: %v", err)
+	}
+	owned.Lock()
+
+	if _, err = GetProtector(&otherCtx, p.Descriptor()); err == nil {
+		t.Error("other user shouldn't be able to get the protector")
+	} else if _, ok := err.(*ErrProtectorAccessDenied); !ok {
+		t.Errorf("unexpected error %v", err)
+	}
+	option := otherCtx.getProtectorOption(p.Descriptor())
+	if _, ok := option.LoadError.(*ErrProtectorAccessDenied); !ok {
+		t.Errorf("option should have an access error, not %v", option.LoadError)
+	}
+	if otherCtx.OwnsProtector(&option.ProtectorInfo) {
+		t.Error("protector shouldn't belong to the other user")
+	}
+}
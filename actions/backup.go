@@ -0,0 +1,154 @@
+/*
+ * backup.go - Saving the metadata of a filesystem to a backup file, and
+ * restoring it, and exporting and importing single protectors
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package actions
+
+import (
+	"fmt"
+	"os/user"
+
+	"github.com/pkg/errors"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/google/fscrypt/filesystem"
+	"github.com/google/fscrypt/metadata"
+)
+
+// ErrNotExportedProtector indicates that a backup given to ImportProtector
+// doesn't hold exactly one protector (and nothing else).
+var ErrNotExportedProtector = errors.New("the file doesn't hold a single exported protector")
+
+// ErrLoginProtectorNotPortable indicates that a login protector can't be
+// exported, as it belongs to a user of this system.
+type ErrLoginProtectorNotPortable struct {
+	Descriptor string
+}
+
+func (err *ErrLoginProtectorNotPortable) Error() string {
+	return fmt.Sprintf(`login protector %s cannot be exported or imported
+	because it belongs to a user of the system it was created on.`, err.Descriptor)
+}
+
+// ErrProtectorExists indicates that an imported protector is already on the
+// filesystem (possibly as a linked protector).
+type ErrProtectorExists struct {
+	Descriptor string
+	Mount      *filesystem.Mount
+}
+
+func (err *ErrProtectorExists) Error() string {
+	return fmt.Sprintf("protector %s is already on %q", err.Descriptor, err.Mount.Path)
+}
+
+// BackupMetadata returns the metadata on the context's filesystem which can be
+// read by its trusted user, ready to be written to a backup file with
+// metadata.MarshalBackup. No keys are unwrapped, so the backup is only as
+// sensitive as the metadata directory itself.
+func BackupMetadata(ctx *Context) (*metadata.MetadataBackup, error) {
+	if err := ctx.checkContext(); err != nil {
+		return nil, err
+	}
+	return ctx.Mount.Backup(ctx.TrustedUser)
+}
+
+// RestoreMetadata adds the metadata in a backup to the context's filesystem,
+// leaving the metadata which is already there alone.
+func RestoreMetadata(ctx *Context, backup *metadata.MetadataBackup) (*filesystem.RestoreResult, error) {
+	if err := ctx.checkContext(); err != nil {
+		return nil, err
+	}
+	var result *filesystem.RestoreResult
+	err := ctx.withMetadataLock(func() error {
+		var err error
+		result, err = ctx.Mount.Restore(backup)
+		return err
+	})
+	return result, err
+}
+
+// ExportProtector returns a backup holding only the Protector, ready to be
+// written to a file with metadata.MarshalBackup and added to a filesystem on
+// this or another system with ImportProtector. Like a backup, it holds the
+// wrapped Protector key and the parameters needed to unwrap it, but not the
+// key itself. The name is saved unencrypted, as the key encrypting protector
+// names belongs to the filesystem.
+func ExportProtector(protector *Protector) (*metadata.MetadataBackup, error) {
+	data := proto.Clone(protector.data).(*metadata.ProtectorData)
+	if data.Source == metadata.SourceType_pam_passphrase {
+		return nil, &ErrLoginProtectorNotPortable{data.ProtectorDescriptor}
+	}
+	if data.Name == "" {
+		return nil, errors.Errorf("the name of protector %s cannot be decrypted",
+			data.ProtectorDescriptor)
+	}
+	data.EncryptedName = nil
+	return &metadata.MetadataBackup{
+		Protectors: []*metadata.BackupProtector{{Data: data}},
+	}, nil
+}
+
+// ImportProtector adds the protector exported by ExportProtector to the
+// Context's filesystem, owned by owner (or the current user if nil). If name
+// isn't empty, the protector is renamed to it. The protector must not already
+// be on the filesystem, and its name must not be used by another protector.
+// The returned Protector is locked.
+func ImportProtector(ctx *Context, backup *metadata.MetadataBackup, name string,
+	owner *user.User) (*Protector, error) {
+	if err := ctx.checkContext(); err != nil {
+		return nil, err
+	}
+	if len(backup.Protectors) != 1 || len(backup.Policies) != 0 ||
+		len(backup.LinkedProtectors) != 0 {
+		return nil, ErrNotExportedProtector
+	}
+	data := proto.Clone(backup.Protectors[0].Data).(*metadata.ProtectorData)
+	if data.Source == metadata.SourceType_pam_passphrase {
+		return nil, &ErrLoginProtectorNotPortable{data.ProtectorDescriptor}
+	}
+	if name != "" {
+		data.Name = name
+	}
+	if data.Name == "" {
+		return nil, &ErrMissingProtectorName{data.Source}
+	}
+
+	err := ctx.withMetadataLock(func() error {
+		descriptors, err := ctx.Mount.ListProtectors(ctx.TrustedUser)
+		if err != nil {
+			return err
+		}
+		for _, descriptor := range descriptors {
+			if descriptor == data.ProtectorDescriptor {
+				return &ErrProtectorExists{descriptor, ctx.Mount}
+			}
+		}
+		if err = checkForProtectorWithName(ctx, data.Name); err != nil {
+			return err
+		}
+		sealed, err := sealProtectorName(ctx, data)
+		if err != nil {
+			return err
+		}
+		return ctx.Mount.AddProtector(sealed, owner)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Protector{Context: ctx, data: data}, nil
+}
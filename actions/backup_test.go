@@ -0,0 +1,119 @@
+/*
+ * backup_test.go - tests for saving and restoring the metadata of a filesystem
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package actions
+
+import (
+	"testing"
+
+	"github.com/google/fscrypt/metadata"
+)
+
+// Tests that a protector and policy survive a round trip through a backup file,
+// and can be unlocked again after being restored.
+func TestBackupRestoreMetadata(t *testing.T) {
+	pro, pol, err := makeBoth()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanupProtector(pro)
+	defer cleanupPolicy(pol)
+
+	backup, err := BackupMetadata(testContext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents, err := metadata.MarshalBackup(backup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if backup, err = metadata.UnmarshalBackup(contents); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = testContext.Mount.RemovePolicy(pol.Descriptor()); err != nil {
+		t.Fatal(err)
+	}
+	if err = testContext.Mount.RemoveProtector(pro.Descriptor()); err != nil {
+		t.Fatal(err)
+	}
+	result, err := RestoreMetadata(testContext, backup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Restored != 2 {
+		t.Errorf("restored %d protectors and policies, expected 2", result.Restored)
+	}
+
+	policy, err := GetPolicy(testContext, pol.Descriptor())
+	if err != nil {
+		t.Fatal(err)
+	}
+	optionFn := func(string, []*ProtectorOption) (int, error) { return 0, nil }
+	if err = policy.Unlock(optionFn, goodCallback); err != nil {
+		t.Fatalf("restored policy can't be unlocked: %v", err)
+	}
+	policy.Lock()
+}
+
+// Tests that an exported protector can be imported again, under a new name, and
+// unlocked with the same passphrase.
+func TestExportImportProtector(t *testing.T) {
+	p, err := CreateProtector(testContext, testProtectorName, goodCallback, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Destroy()
+	defer p.Lock()
+
+	backup, err := ExportProtector(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents, err := metadata.MarshalBackup(backup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if backup, err = metadata.UnmarshalBackup(contents); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ImportProtector(testContext, backup, "", nil); err == nil {
+		t.Error("protector should not be imported twice")
+	} else if _, ok := err.(*ErrProtectorExists); !ok {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	if err = p.Destroy(); err != nil {
+		t.Fatal(err)
+	}
+	imported, err := ImportProtector(testContext, backup, testProtectorName2, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p2, err := GetProtector(testContext, imported.Descriptor())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p2.data.Name != testProtectorName2 {
+		t.Errorf("imported name is %q, expected %q", p2.data.Name, testProtectorName2)
+	}
+	if err = p2.Unlock(goodCallback); err != nil {
+		t.Fatalf("imported protector can't be unlocked: %v", err)
+	}
+	p2.Lock()
+}
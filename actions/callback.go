@@ -21,13 +21,12 @@
 package actions
 
 import (
-	"log"
-
 	"github.com/pkg/errors"
 
 	"github.com/google/fscrypt/crypto"
 	"github.com/google/fscrypt/filesystem"
 	"github.com/google/fscrypt/metadata"
+	"github.com/google/fscrypt/util"
 )
 
 // ProtectorInfo is the information a caller will receive about a Protector
@@ -35,6 +34,9 @@ import (
 // read-only view of metadata.ProtectorData.
 type ProtectorInfo struct {
 	data *metadata.ProtectorData
+	// keyFileFactor is set when the raw key of a passphrase_and_raw_key
+	// protector is asked for, rather than its passphrase.
+	keyFileFactor bool
 }
 
 // Descriptor is the Protector's descriptor used to uniquely identify it.
@@ -43,31 +45,141 @@ func (pi *ProtectorInfo) Descriptor() string { return pi.data.GetProtectorDescri
 // Source indicates the type of the descriptor (how it should be unlocked).
 func (pi *ProtectorInfo) Source() metadata.SourceType { return pi.data.GetSource() }
 
-// Name is used to describe custom passphrase and raw key descriptors.
+// Name is used to describe custom passphrase and raw key descriptors. If the
+// name is encrypted and couldn't be decrypted, this is empty.
 func (pi *ProtectorInfo) Name() string { return pi.data.GetName() }
 
+// NameIsEncrypted indicates that the protector's name is stored encrypted.
+func (pi *ProtectorInfo) NameIsEncrypted() bool { return pi.data.GetEncryptedName() != nil }
+
 // UID is used to identify the user for login passphrases.
 func (pi *ProtectorInfo) UID() int64 { return pi.data.GetUid() }
 
+// Access is the owner of the protector and the other users and groups allowed
+// to use it. It is nil if anyone who can read the protector may use it.
+func (pi *ProtectorInfo) Access() *metadata.ProtectorAccess { return pi.data.GetAccess() }
+
+// HashingCosts is used for passphrase sources: the Argon2id costs of hashing
+// the passphrase. It is nil for other sources.
+func (pi *ProtectorInfo) HashingCosts() *metadata.HashingCosts { return pi.data.GetCosts() }
+
+// FIDO2CredentialID is used for fido2 sources: the security key credential
+// from which the wrapping key is obtained.
+func (pi *ProtectorInfo) FIDO2CredentialID() []byte { return pi.data.GetFido2CredentialId() }
+
+// FIDO2Salt is used for fido2 sources: the salt for which the credential's
+// hmac-secret output is the wrapping key.
+func (pi *ProtectorInfo) FIDO2Salt() []byte { return pi.data.GetFido2Salt() }
+
+// TPM2SealedKey is used for tpm2 sources: the sealed object holding the
+// wrapping key.
+func (pi *ProtectorInfo) TPM2SealedKey() *TPM2SealedKey {
+	return &TPM2SealedKey{
+		Public:  pi.data.GetTpm2Public(),
+		Private: pi.data.GetTpm2Private(),
+		PCRs:    pi.data.GetTpm2Pcrs(),
+	}
+}
+
+// PKCS11Key is used for pkcs11 sources: the key pair on the token which
+// protects the wrapping key.
+func (pi *ProtectorInfo) PKCS11Key() *PKCS11Key {
+	return &PKCS11Key{
+		Module:    pi.data.GetPkcs11Module(),
+		Slot:      pi.data.GetPkcs11Slot(),
+		ID:        pi.data.GetPkcs11KeyId(),
+		PublicKey: pi.data.GetPkcs11PublicKey(),
+	}
+}
+
+// KMSKey is used for kms sources: the name of the cloud KMS key which
+// encrypts the wrapping key.
+func (pi *ProtectorInfo) KMSKey() string { return pi.data.GetKmsKey() }
+
+// KeyFileFactor is used for passphrase_and_raw_key sources: it indicates that
+// the KeyFunc is asked for the raw key rather than the passphrase.
+func (pi *ProtectorInfo) KeyFileFactor() bool { return pi.keyFileFactor }
+
+// TangURL is used for tang sources: the URL of the Tang server which recovers
+// the wrapping key.
+func (pi *ProtectorInfo) TangURL() string { return pi.data.GetTangUrl() }
+
+// GPGRecipient is used for gpg sources: the GPG key which the wrapping key is
+// encrypted to.
+func (pi *ProtectorInfo) GPGRecipient() string { return pi.data.GetGpgRecipient() }
+
+// SSHKeyFingerprint is used for ssh_agent sources: the SHA256 fingerprint of
+// the SSH key whose signature the wrapping key is derived from.
+func (pi *ProtectorInfo) SSHKeyFingerprint() string {
+	return sshKeyFingerprint(pi.data.GetSshPublicKey())
+}
+
+// YubiKeySlot is used for yubikey sources: the YubiKey slot which answers the
+// challenge.
+func (pi *ProtectorInfo) YubiKeySlot() uint32 { return pi.data.GetYubikeySlot() }
+
+// YubiKeyChallenge is used for yubikey sources: the challenge whose response
+// is combined with the passphrase hash.
+func (pi *ProtectorInfo) YubiKeyChallenge() []byte { return pi.data.GetYubikeyChallenge() }
+
 // KeyFunc is passed to a function that will require some type of key.
 // The info parameter is provided so the callback knows which key to provide.
 // The retry parameter indicates that a previous key provided by this callback
 // was incorrect (this allows for user feedback like "incorrect passphrase").
 //
-// For passphrase sources, the returned key should be a passphrase. For raw
-// sources, the returned key should be a 256-bit cryptographic key. Consumers
-// of the callback will wipe the returned key. An error returned by the callback
-// will be propagated back to the caller.
+// For passphrase sources, the returned key should be a passphrase. For pkcs11
+// sources, it should be the token's PIN. For raw sources, the returned key
+// should be a 256-bit cryptographic key. For passphrase_and_raw_key sources,
+// the callback is called twice: for the passphrase, and then for the raw key
+// (see ProtectorInfo.KeyFileFactor). For yubikey sources, it is only called for
+// the passphrase, as the YubiKey gives its response itself. The callback isn't
+// used for fido2, tpm2, kms, tang, gpg, or ssh_agent sources, whose keys come
+// from the FIDO2Authenticator, the TPM2Sealer, the KMSClient, the Tang server,
+// GPG, or the ssh-agent.
+// Consumers of the callback will wipe the returned key. An error returned by the callback will be
+// propagated back to the caller.
 type KeyFunc func(info ProtectorInfo, retry bool) (*crypto.Key, error)
 
 // getWrappingKey uses the provided callback to get the wrapping key
 // corresponding to the ProtectorInfo. This runs the passphrase hash for
-// passphrase sources or just relays the callback for raw sources.
+// passphrase sources, asks the security key for fido2 sources, the TPM for
+// tpm2 sources, the PKCS#11 token for pkcs11 sources, the cloud KMS for kms
+// sources, the Tang server for tang sources, GPG for gpg sources, or the
+// ssh-agent for ssh_agent sources, or just relays the callback for raw sources. For yubikey sources, the YubiKey's response is combined with
+// the passphrase hash.
 func getWrappingKey(info ProtectorInfo, keyFn KeyFunc, retry bool) (*crypto.Key, error) {
 	// For raw key sources, we can just use the key directly.
 	if info.Source() == metadata.SourceType_raw_key {
 		return keyFn(info, retry)
 	}
+	// Security keys provide the key themselves.
+	if info.Source() == metadata.SourceType_fido2 {
+		return getFIDO2WrappingKey(info, retry)
+	}
+	// Keys sealed by a TPM are unsealed by it.
+	if info.Source() == metadata.SourceType_tpm2 {
+		return getTPM2WrappingKey(info, retry)
+	}
+	// PKCS#11 tokens use the callback for their PIN.
+	if info.Source() == metadata.SourceType_pkcs11 {
+		return getPKCS11WrappingKey(info, keyFn, retry)
+	}
+	// Keys encrypted by a cloud KMS are decrypted by it.
+	if info.Source() == metadata.SourceType_kms {
+		return getKMSWrappingKey(info, retry)
+	}
+	// Keys derived from ssh-agent signatures are signed by the agent.
+	if info.Source() == metadata.SourceType_ssh_agent {
+		return getSSHAgentWrappingKey(info, retry)
+	}
+	// Keys encrypted to a GPG key are decrypted by GPG.
+	if info.Source() == metadata.SourceType_gpg {
+		return getGPGWrappingKey(info, retry)
+	}
+	// Keys exchanged with a Tang server are recovered by it.
+	if info.Source() == metadata.SourceType_tang {
+		return getTangWrappingKey(info, retry)
+	}
 
 	// Run the passphrase hash for other sources.
 	passphrase, err := keyFn(info, retry)
@@ -76,15 +188,41 @@ func getWrappingKey(info ProtectorInfo, keyFn KeyFunc, retry bool) (*crypto.Key,
 	}
 	defer passphrase.Wipe()
 
-	log.Printf("running passphrase hash for protector %s", info.Descriptor())
-	return crypto.PassphraseHash(passphrase, info.data.Salt, info.data.Costs)
+	// Two-factor sources also need the raw key or the YubiKey's response,
+	// which is combined with the passphrase hash.
+	var secondFactor *crypto.Key
+	switch info.Source() {
+	case metadata.SourceType_passphrase_and_raw_key:
+		keyInfo := info
+		keyInfo.keyFileFactor = true
+		if secondFactor, err = keyFn(keyInfo, retry); err != nil {
+			return nil, err
+		}
+		defer secondFactor.Wipe()
+		if err = util.CheckValidLength(metadata.InternalKeyLen, secondFactor.Len()); err != nil {
+			return nil, errors.Wrap(err, "raw key")
+		}
+	case metadata.SourceType_yubikey:
+		if secondFactor, err = getYubiKeyResponse(info); err != nil {
+			return nil, err
+		}
+		defer secondFactor.Wipe()
+	}
+
+	util.Debugf("running passphrase hash for protector %s", info.Descriptor())
+	hash, err := crypto.PassphraseHash(passphrase, info.data.Salt, info.data.Costs)
+	if err != nil || secondFactor == nil {
+		return hash, err
+	}
+	defer hash.Wipe()
+	return crypto.CombineKeys(info.data.Salt, hash, secondFactor)
 }
 
 // unwrapProtectorKey uses the provided callback and ProtectorInfo to return
 // the unwrapped protector key. This will repeatedly call keyFn to get the
 // wrapping key until the correct key is returned by the callback or the
-// callback returns an error.
-func unwrapProtectorKey(info ProtectorInfo, keyFn KeyFunc) (*crypto.Key, error) {
+// callback returns an error. The protector's metadata is on mnt.
+func unwrapProtectorKey(info ProtectorInfo, keyFn KeyFunc, mnt *filesystem.Mount) (*crypto.Key, error) {
 	retry := false
 	for {
 		wrappingKey, err := getWrappingKey(info, keyFn, retry)
@@ -97,11 +235,18 @@ func unwrapProtectorKey(info ProtectorInfo, keyFn KeyFunc) (*crypto.Key, error)
 
 		switch errors.Cause(err) {
 		case nil:
-			log.Printf("valid wrapping key for protector %s", info.Descriptor())
+			util.Debugf("valid wrapping key for protector %s", info.Descriptor())
+			err = checkMetadataIntegrity(protectorKey, info.data, "protector",
+				info.Descriptor(), mnt)
+			if err != nil {
+				protectorKey.Wipe()
+				return nil, err
+			}
 			return protectorKey, nil
 		case crypto.ErrBadAuth:
 			// After the first failure, we let the callback know we are retrying.
-			log.Printf("invalid wrapping key for protector %s", info.Descriptor())
+			util.Debugf("invalid wrapping key for protector %s", info.Descriptor())
+			reportEvent(OperationWrongKey, mnt, "", info.Descriptor(), false)
 			retry = true
 			continue
 		default:
@@ -119,6 +264,10 @@ type ProtectorOption struct {
 	// LoadError is non-nil if there was an error in getting the data for
 	// the protector.
 	LoadError error
+	// InKeystore is true if this is a raw_key protector whose key file is
+	// present in the keystore_dir from the config file. Such a protector
+	// can be unlocked without user interaction.
+	InKeystore bool
 }
 
 // OptionFunc is passed to a function that needs to unlock a Policy.
@@ -0,0 +1,378 @@
+/*
+ * check.go - Finding inconsistencies between the metadata on a filesystem and
+ * its encrypted directories
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package actions
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+
+	"github.com/pkg/errors"
+
+	"github.com/google/fscrypt/filesystem"
+	"github.com/google/fscrypt/metadata"
+	"github.com/google/fscrypt/util"
+)
+
+// MetadataProblemKind is a kind of problem found by Context.CheckMetadata.
+type MetadataProblemKind int
+
+// The kinds of problems found by Context.CheckMetadata, in the order they are
+// reported.
+const (
+	// BadProtector is a protector whose metadata can't be read.
+	BadProtector MetadataProblemKind = iota
+	// BadPolicy is a policy whose metadata can't be read.
+	BadPolicy
+	// MissingProtector is a protector used by a policy which isn't stored
+	// on the filesystem, not even as a link to another filesystem.
+	MissingProtector
+	// OrphanedPolicy is a policy none of whose protectors can be found, so
+	// it can't be unlocked.
+	OrphanedPolicy
+	// DanglingLink is a link to a protector on another filesystem which
+	// can't be followed.
+	DanglingLink
+	// UnusedLink is a link to a protector which none of the policies use.
+	UnusedLink
+	// UnusedPolicy is a policy which no directory on the filesystem is
+	// encrypted with.
+	UnusedPolicy
+	// MissingPolicy is an encrypted directory whose policy has no metadata.
+	// It can be repaired if the directory has a copy of the metadata in
+	// metadata.PolicyXattrName.
+	MissingPolicy
+)
+
+// MetadataProblem is an inconsistency in the metadata of a filesystem, or
+// between the metadata and the encrypted directories.
+type MetadataProblem struct {
+	Kind MetadataProblemKind
+	// Descriptor is the protector or policy with the problem. For
+	// MissingPolicy, it is the policy the directory is encrypted with.
+	Descriptor string
+	// PolicyDescriptor is the policy using the protector, for
+	// MissingProtector.
+	PolicyDescriptor string
+	// Path is the encrypted directory, for MissingPolicy.
+	Path string
+	// Err is why the metadata can't be used, for BadProtector, BadPolicy,
+	// and DanglingLink.
+	Err error
+	// RepairAction describes how Repair fixes the problem. It is empty if
+	// the problem can't be fixed safely.
+	RepairAction string
+	repair       func() error
+}
+
+func (problem *MetadataProblem) String() string {
+	switch problem.Kind {
+	case BadProtector:
+		return fmt.Sprintf("protector %s can't be read: %v", problem.Descriptor, problem.Err)
+	case BadPolicy:
+		return fmt.Sprintf("policy %s can't be read: %v", problem.Descriptor, problem.Err)
+	case MissingProtector:
+		return fmt.Sprintf("protector %s of policy %s isn't on this filesystem",
+			problem.Descriptor, problem.PolicyDescriptor)
+	case OrphanedPolicy:
+		return fmt.Sprintf("none of the protectors of policy %s can be found, so it can't be unlocked",
+			problem.Descriptor)
+	case DanglingLink:
+		return fmt.Sprintf("the link to protector %s can't be followed: %v",
+			problem.Descriptor, problem.Err)
+	case UnusedLink:
+		return fmt.Sprintf("the link to protector %s isn't used by any policy", problem.Descriptor)
+	case UnusedPolicy:
+		return fmt.Sprintf("policy %s isn't used by any directory on this filesystem",
+			problem.Descriptor)
+	case MissingPolicy:
+		return fmt.Sprintf("%q is encrypted with policy %s, which has no metadata",
+			problem.Path, problem.Descriptor)
+	default:
+		return fmt.Sprintf("MetadataProblemKind(%d) with %s", int(problem.Kind), problem.Descriptor)
+	}
+}
+
+// Repair fixes the problem as described by RepairAction.
+func (problem *MetadataProblem) Repair() error {
+	if problem.repair == nil {
+		return errors.Errorf("%s can't be repaired safely", problem)
+	}
+	return problem.repair()
+}
+
+// EncryptedDirectories returns the top-level encrypted directories on the
+// Context's mountpoint, by the descriptor of their policy. Everything below
+// such a directory uses the same policy, so it isn't searched. This walks the
+// whole filesystem (without crossing into other mounted filesystems), so it can
+// be slow. Directories which can't be read are skipped.
+func (ctx *Context) EncryptedDirectories() (map[string][]string, error) {
+	rootInfo, err := os.Lstat(ctx.Mount.Path)
+	if err != nil {
+		return nil, err
+	}
+	rootDev := rootInfo.Sys().(*syscall.Stat_t).Dev
+	baseDir := ctx.Mount.BaseDir()
+
+	dirs := make(map[string][]string)
+	err = filepath.Walk(ctx.Mount.Path, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			util.Debugf("not searching %q for encrypted directories: %v", path, err)
+			return nil
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		if path == baseDir || info.Sys().(*syscall.Stat_t).Dev != rootDev {
+			return filepath.SkipDir
+		}
+		pathData, err := metadata.GetPolicy(path)
+		if err != nil {
+			// Not encrypted (or unreadable), so keep looking below.
+			return nil
+		}
+		dirs[pathData.KeyDescriptor] = append(dirs[pathData.KeyDescriptor], path)
+		return filepath.SkipDir
+	})
+	return dirs, err
+}
+
+// uniqueProtectorMount returns the filesystem other than the Context's which
+// stores the regular protector with the given descriptor, or nil if there isn't
+// exactly one.
+func (ctx *Context) uniqueProtectorMount(descriptor string, mounts []*filesystem.Mount) *filesystem.Mount {
+	var found *filesystem.Mount
+	for _, mnt := range mounts {
+		if mnt == ctx.Mount {
+			continue
+		}
+		if _, err := mnt.GetRegularProtector(descriptor, ctx.TrustedUser); err != nil {
+			continue
+		}
+		if found != nil {
+			return nil
+		}
+		found = mnt
+	}
+	return found
+}
+
+// relinkProblem makes the problem repairable by linking the protector to the
+// single filesystem storing it, if there is one.
+func (ctx *Context) relinkProblem(problem *MetadataProblem, mounts []*filesystem.Mount) {
+	dest := ctx.uniqueProtectorMount(problem.Descriptor, mounts)
+	if dest == nil {
+		return
+	}
+	problem.RepairAction = fmt.Sprintf("link to the protector on %q", dest.Path)
+	problem.repair = func() error {
+		return ctx.Mount.RelinkProtector(problem.Descriptor, dest, ctx.TrustedUser)
+	}
+}
+
+// restorePolicyProblem makes a MissingPolicy problem repairable by restoring the
+// policy metadata from the copy stored in the directory, if there is one.
+func (ctx *Context) restorePolicyProblem(problem *MetadataProblem) {
+	data, err := metadata.GetPolicyXattr(problem.Path)
+	if err != nil {
+		util.Debug(err)
+		return
+	}
+	if data.KeyDescriptor != problem.Descriptor {
+		util.Debugf("the copy of the policy metadata in %q is of policy %s",
+			problem.Path, data.KeyDescriptor)
+		return
+	}
+	problem.RepairAction = fmt.Sprintf("restore the policy metadata from the copy in %q", problem.Path)
+	problem.repair = func() error {
+		return ctx.withMetadataLock(func() error {
+			// Another directory may use the same policy.
+			if _, err := ctx.Mount.GetPolicy(data.KeyDescriptor, nil); err == nil {
+				return nil
+			}
+			return ctx.Mount.AddPolicy(data, nil)
+		})
+	}
+}
+
+// isProtectorUsed returns true if any policy on the Context's filesystem uses
+// the protector with the given descriptor, or if that can't be determined.
+func (ctx *Context) isProtectorUsed(descriptor string) (bool, error) {
+	policies, err := ctx.Mount.ListPolicies(nil)
+	if err != nil {
+		return true, err
+	}
+	for _, policyDescriptor := range policies {
+		data, err := ctx.Mount.GetPolicy(policyDescriptor, nil)
+		if err != nil {
+			// The policy might use it.
+			return true, nil
+		}
+		for _, wrappedKey := range data.WrappedPolicyKeys {
+			if wrappedKey.ProtectorDescriptor == descriptor {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// CheckMetadata looks for problems in the metadata on the Context's filesystem
+// which can be read by the trusted user: protectors and policies which can't be
+// read, protectors and links used by policies which can't be found, links no
+// policy uses, policies which can't be unlocked, and policies which no
+// directory uses. It also walks the filesystem to look for encrypted
+// directories whose policy has no metadata. Directories which can't be read by
+// the current user are skipped, so only root can be sure a policy isn't used.
+//
+// Only the problems which have a safe fix are repairable: links are repaired if
+// the protector is found on a single mounted filesystem, and unused links are
+// removed. Nothing is changed until MetadataProblem.Repair is called.
+func (ctx *Context) CheckMetadata() ([]*MetadataProblem, error) {
+	if err := ctx.checkContext(); err != nil {
+		return nil, err
+	}
+	mounts, err := filesystem.AllFilesystems()
+	if err != nil {
+		return nil, err
+	}
+	var problems []*MetadataProblem
+
+	linked, err := ctx.Mount.ListLinkedProtectors()
+	if err != nil {
+		return nil, err
+	}
+	isLinked := make(map[string]bool)
+	for _, descriptor := range linked {
+		isLinked[descriptor] = true
+	}
+	protectors, err := ctx.Mount.ListProtectors(ctx.TrustedUser)
+	if err != nil {
+		return nil, err
+	}
+	for _, descriptor := range protectors {
+		if isLinked[descriptor] {
+			continue
+		}
+		if _, err := ctx.Mount.GetRegularProtector(descriptor, ctx.TrustedUser); err != nil {
+			problems = append(problems, &MetadataProblem{Kind: BadProtector,
+				Descriptor: descriptor, Err: err})
+		}
+	}
+
+	policies, err := ctx.Mount.ListPolicies(ctx.TrustedUser)
+	if err != nil {
+		return nil, err
+	}
+	used := make(map[string]bool)
+	for _, policyDescriptor := range policies {
+		data, err := ctx.Mount.GetPolicy(policyDescriptor, ctx.TrustedUser)
+		if err != nil {
+			problems = append(problems, &MetadataProblem{Kind: BadPolicy,
+				Descriptor: policyDescriptor, Err: err})
+			continue
+		}
+		canUnlock := false
+		for _, wrappedKey := range data.WrappedPolicyKeys {
+			descriptor := wrappedKey.ProtectorDescriptor
+			_, _, err := ctx.Mount.GetProtector(descriptor, ctx.TrustedUser)
+			if err == nil {
+				canUnlock = true
+			} else if _, ok := err.(*filesystem.ErrProtectorNotFound); ok && !used[descriptor] {
+				problem := &MetadataProblem{Kind: MissingProtector,
+					Descriptor: descriptor, PolicyDescriptor: policyDescriptor}
+				ctx.relinkProblem(problem, mounts)
+				problems = append(problems, problem)
+			}
+			used[descriptor] = true
+		}
+		if !canUnlock {
+			problems = append(problems, &MetadataProblem{Kind: OrphanedPolicy,
+				Descriptor: policyDescriptor})
+		}
+	}
+
+	for _, descriptor := range linked {
+		// Links can be used by the policies of other users too.
+		isUsed, err := ctx.isProtectorUsed(descriptor)
+		if err != nil {
+			return nil, err
+		}
+		if !isUsed {
+			descriptor := descriptor
+			problems = append(problems, &MetadataProblem{Kind: UnusedLink,
+				Descriptor: descriptor, RepairAction: "remove the link",
+				repair: func() error {
+					return ctx.withMetadataLock(func() error {
+						// A policy may have started using it since.
+						if isUsed, err := ctx.isProtectorUsed(descriptor); isUsed || err != nil {
+							return err
+						}
+						return ctx.Mount.RemoveProtector(descriptor)
+					})
+				}})
+			continue
+		}
+		if _, _, err := ctx.Mount.GetProtector(descriptor, ctx.TrustedUser); err != nil {
+			problem := &MetadataProblem{Kind: DanglingLink, Descriptor: descriptor, Err: err}
+			ctx.relinkProblem(problem, mounts)
+			problems = append(problems, problem)
+		}
+	}
+
+	dirs, err := ctx.EncryptedDirectories()
+	if err != nil {
+		return nil, err
+	}
+	for _, policyDescriptor := range policies {
+		if len(dirs[policyDescriptor]) == 0 {
+			problems = append(problems, &MetadataProblem{Kind: UnusedPolicy,
+				Descriptor: policyDescriptor})
+		}
+	}
+	// Policies owned by other users still count as metadata.
+	allPolicies, err := ctx.Mount.ListPolicies(nil)
+	if err != nil {
+		return nil, err
+	}
+	hasMetadata := make(map[string]bool)
+	for _, policyDescriptor := range allPolicies {
+		hasMetadata[policyDescriptor] = true
+	}
+	var missing []*MetadataProblem
+	for policyDescriptor, paths := range dirs {
+		if hasMetadata[policyDescriptor] {
+			continue
+		}
+		for _, path := range paths {
+			problem := &MetadataProblem{Kind: MissingPolicy,
+				Descriptor: policyDescriptor, Path: path}
+			ctx.restorePolicyProblem(problem)
+			missing = append(missing, problem)
+		}
+	}
+	sort.Slice(missing, func(i, j int) bool { return missing[i].Path < missing[j].Path })
+	problems = append(problems, missing...)
+
+	sort.SliceStable(problems, func(i, j int) bool { return problems[i].Kind < problems[j].Kind })
+	return problems, nil
+}
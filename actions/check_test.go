@@ -0,0 +1,79 @@
+/*
+ * check_test.go - tests for finding inconsistencies in the metadata of a
+ * filesystem
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package actions
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// findProblem returns the problem of the given kind with the descriptor, or nil.
+func findProblem(problems []*MetadataProblem, kind MetadataProblemKind,
+	descriptor string) *MetadataProblem {
+	for _, problem := range problems {
+		if problem.Kind == kind && problem.Descriptor == descriptor {
+			return problem
+		}
+	}
+	return nil
+}
+
+// Tests that a policy no directory uses is reported but can't be repaired, and
+// that an unused link to a protector is reported and removed by the repair.
+func TestCheckMetadata(t *testing.T) {
+	pro, pol, err := makeBoth()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanupProtector(pro)
+	defer cleanupPolicy(pol)
+
+	const linkDescriptor = "0011223344556677"
+	linkPath := filepath.Join(testContext.Mount.ProtectorDir(), linkDescriptor+".link")
+	if err = os.WriteFile(linkPath, []byte("UUID=00000000-0000-0000-0000-000000000000\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(linkPath)
+
+	problems, err := testContext.CheckMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	unused := findProblem(problems, UnusedPolicy, pol.Descriptor())
+	if unused == nil {
+		t.Errorf("unused policy wasn't reported: %v", problems)
+	} else if unused.RepairAction != "" {
+		t.Errorf("unused policy can be repaired with %q", unused.RepairAction)
+	}
+	link := findProblem(problems, UnusedLink, linkDescriptor)
+	if link == nil {
+		t.Fatalf("unused link wasn't reported: %v", problems)
+	}
+	if err = link.Repair(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(linkPath); !os.IsNotExist(err) {
+		t.Errorf("unused link wasn't removed (err: %v)", err)
+	}
+	if findProblem(problems, OrphanedPolicy, pol.Descriptor()) != nil {
+		t.Error("policy with a protector was reported as orphaned")
+	}
+}
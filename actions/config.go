@@ -23,13 +23,17 @@ package actions
 import (
 	"bytes"
 	"fmt"
-	"log"
 	"os"
+	"path/filepath"
 	"runtime"
+	"sort"
+	"syscall"
 	"time"
 
+	"github.com/pkg/errors"
 	"golang.org/x/sys/unix"
 	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
 
 	"github.com/google/fscrypt/crypto"
 	"github.com/google/fscrypt/filesystem"
@@ -41,6 +45,21 @@ import (
 // overridden by the user of this package.
 var ConfigFileLocation = "/etc/fscrypt.conf"
 
+// UserConfigFileLocation is the location, relative to the home directory of the
+// effective user, of the config file in which that user can override some of
+// the settings from ConfigFileLocation. This can be overridden by the user of
+// this package, and an empty string disables per-user config files.
+var UserConfigFileLocation = ".config/fscrypt/config"
+
+// userOverridableFields are the top-level fields of the global config which may
+// also be set in a per-user config file. The other fields control how fscrypt
+// treats metadata, keys, and other users, so only root may set them.
+var userOverridableFields = map[string]bool{
+	"source":     true,
+	"hash_costs": true,
+	"options":    true,
+}
+
 // ErrBadConfig is an internal error that indicates that the config struct is invalid.
 type ErrBadConfig struct {
 	Config          *metadata.Config
@@ -72,6 +91,16 @@ func (err *ErrConfigFileExists) Error() string {
 	return fmt.Sprintf("%q already exists", err.Path)
 }
 
+// ErrUnknownProfile indicates that a profile isn't defined in the config file.
+type ErrUnknownProfile struct {
+	Name      string
+	Available []string
+}
+
+func (err *ErrUnknownProfile) Error() string {
+	return fmt.Sprintf("profile %q is not defined in %q", err.Name, ConfigFileLocation)
+}
+
 // ErrNoConfigFile indicates that the config file doesn't exist.
 type ErrNoConfigFile struct {
 	Path string
@@ -99,9 +128,10 @@ var (
 
 // CreateConfigFile creates a new config file at the appropriate location with
 // the appropriate hashing costs and encryption parameters. The hashing will be
-// configured to take as long as the specified time target. In addition, the
-// version of encryption policy to use may be overridden from the default of v1.
-func CreateConfigFile(target time.Duration, policyVersion int64) error {
+// configured to take as long as the specified time target, using the given
+// KDF. In addition, the version of encryption policy to use may be overridden
+// from the default of v1.
+func CreateConfigFile(target time.Duration, policyVersion int64, kdf metadata.KDF) error {
 	// Create the config file before computing the hashing costs, so we fail
 	// immediately if the program has insufficient permissions.
 	configFile, err := filesystem.OpenFileOverridingUmask(ConfigFileLocation,
@@ -123,81 +153,418 @@ func CreateConfigFile(target time.Duration, policyVersion int64) error {
 		config.Options.PolicyVersion = policyVersion
 	}
 
-	if config.HashCosts, err = getHashingCosts(target); err != nil {
+	if config.HashCosts, err = getHashingCosts(target, kdf); err != nil {
 		return err
 	}
 
-	log.Printf("Creating config at %q with %v\n", ConfigFileLocation, config)
+	util.Infof("Creating config at %q with %v\n", ConfigFileLocation, config)
 	return metadata.WriteConfig(config, configFile)
 }
 
-// getConfig returns the current configuration struct. Any fields not specified
-// in the config file use the system defaults. An error is returned if the
-// config file hasn't been setup with CreateConfigFile yet or the config
-// contains invalid data.
+// getConfig returns the current configuration struct, with the settings from
+// the effective user's config file (if any) overriding the global ones. Any
+// fields not specified in either config file use the system defaults. An error
+// is returned if the config file hasn't been setup with CreateConfigFile yet or
+// the config contains invalid data.
 func getConfig() (*metadata.Config, error) {
-	configFile, err := os.Open(ConfigFileLocation)
+	util.Debugf("Reading config from %q\n", ConfigFileLocation)
+	config, err := readGlobalConfig()
 	switch {
 	case os.IsNotExist(err):
 		return nil, &ErrNoConfigFile{ConfigFileLocation}
 	case err != nil:
 		return nil, err
 	}
-	defer configFile.Close()
-
-	log.Printf("Reading config from %q\n", ConfigFileLocation)
-	config, err := metadata.ReadConfig(configFile)
-	if err != nil {
-		return nil, &ErrBadConfigFile{ConfigFileLocation, err}
+	if err = overlayUserConfig(config); err != nil {
+		return nil, err
 	}
 
 	// Use system defaults if not specified
 	if config.Source == metadata.SourceType_default {
 		config.Source = metadata.DefaultSource
-		log.Printf("Falling back to source of %q", config.Source.String())
+		util.Debugf("Falling back to source of %q", config.Source.String())
 	}
 	if config.Options.Padding == 0 {
 		config.Options.Padding = metadata.DefaultOptions.Padding
-		log.Printf("Falling back to padding of %d", config.Options.Padding)
+		util.Debugf("Falling back to padding of %d", config.Options.Padding)
 	}
 	if config.Options.Contents == metadata.EncryptionOptions_default {
 		config.Options.Contents = metadata.DefaultOptions.Contents
-		log.Printf("Falling back to contents mode of %q", config.Options.Contents)
+		util.Debugf("Falling back to contents mode of %q", config.Options.Contents)
 	}
 	if config.Options.Filenames == metadata.EncryptionOptions_default {
 		config.Options.Filenames = metadata.DefaultOptions.Filenames
-		log.Printf("Falling back to filenames mode of %q", config.Options.Filenames)
+		util.Debugf("Falling back to filenames mode of %q", config.Options.Filenames)
 	}
 	if config.Options.PolicyVersion == 0 {
 		config.Options.PolicyVersion = metadata.DefaultOptions.PolicyVersion
-		log.Printf("Falling back to policy version of %d", config.Options.PolicyVersion)
+		util.Debugf("Falling back to policy version of %d", config.Options.PolicyVersion)
 	}
 
 	if err := config.CheckValidity(); err != nil {
 		return nil, &ErrBadConfigFile{ConfigFileLocation, err}
 	}
+	for _, name := range profileNames(config) {
+		if err := checkProfile(config, name); err != nil {
+			return nil, &ErrBadConfigFile{ConfigFileLocation, err}
+		}
+	}
+	if err := registerMetadataDirs(config); err != nil {
+		return nil, &ErrBadConfigFile{ConfigFileLocation, err}
+	}
+
+	return config, nil
+}
+
+// registerMetadataDirs tells the filesystem package where the filesystems set
+// with "metadata_dirs" keep their metadata.
+func registerMetadataDirs(config *metadata.Config) error {
+	for mountpoint, dir := range config.GetMetadataDirs() {
+		if err := filesystem.SetMetadataDir(mountpoint, dir); err != nil {
+			return err
+		}
+		util.Debugf("metadata of %q is in %q", mountpoint, dir)
+	}
+	return nil
+}
+
+// readGlobalConfig reads the global config file only, without applying the
+// effective user's config file or the defaults.
+func readGlobalConfig() (*metadata.Config, error) {
+	configFile, err := os.Open(ConfigFileLocation)
+	if err != nil {
+		return nil, err
+	}
+	defer configFile.Close()
+	config, err := metadata.ReadConfig(configFile)
+	if err != nil {
+		return nil, &ErrBadConfigFile{ConfigFileLocation, err}
+	}
+	return config, nil
+}
+
+// LoadMetadataDirs makes the metadata directories set with "metadata_dirs" in
+// the global config file be used, for the callers which look at filesystems
+// without creating a Context. It does nothing if there is no config file yet.
+func LoadMetadataDirs() error {
+	config, err := readGlobalConfig()
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err = registerMetadataDirs(config); err != nil {
+		return &ErrBadConfigFile{ConfigFileLocation, err}
+	}
+	return nil
+}
+
+// AddMetadataDir records in the global config file that the metadata of the
+// filesystem mounted at mountpoint is kept in dir, and starts using it. The
+// config file is replaced atomically.
+func AddMetadataDir(mountpoint, dir string) error {
+	config, err := readGlobalConfig()
+	if os.IsNotExist(err) {
+		return &ErrNoConfigFile{ConfigFileLocation}
+	}
+	if err != nil {
+		return err
+	}
+	if config.MetadataDirs == nil {
+		config.MetadataDirs = make(map[string]string)
+	}
+	config.MetadataDirs[mountpoint] = dir
+	if err = config.CheckValidity(); err != nil {
+		return &ErrBadConfigFile{ConfigFileLocation, err}
+	}
+
+	var contents bytes.Buffer
+	if err = metadata.WriteConfig(config, &contents); err != nil {
+		return err
+	}
+	tempPath := ConfigFileLocation + ".new"
+	os.Remove(tempPath) // left behind by a crash
+	tempFile, err := filesystem.OpenFileOverridingUmask(tempPath, createFlags, configPermissions)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempPath)
+	if _, err = tempFile.Write(contents.Bytes()); err == nil {
+		err = tempFile.Sync()
+	}
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	util.Infof("recording in %q that the metadata of %q is in %q", ConfigFileLocation, mountpoint, dir)
+	if err = os.Rename(tempPath, ConfigFileLocation); err != nil {
+		return err
+	}
+	return filesystem.SetMetadataDir(mountpoint, dir)
+}
+
+// userConfigPath returns the path of the effective user's config file, or an
+// empty string if per-user config files are disabled. The home directory comes
+// from the user database rather than $HOME, as the environment isn't trusted.
+func userConfigPath() (string, error) {
+	if UserConfigFileLocation == "" {
+		return "", nil
+	}
+	if filepath.IsAbs(UserConfigFileLocation) {
+		return UserConfigFileLocation, nil
+	}
+	user, err := util.EffectiveUser()
+	if err != nil {
+		return "", err
+	}
+	if user.HomeDir == "" {
+		return "", nil
+	}
+	return filepath.Join(user.HomeDir, UserConfigFileLocation), nil
+}
+
+// overlayUserConfig merges the effective user's config file, if there is one,
+// into config. The file must be owned by that user or by root and must not be
+// writable by anyone else.
+func overlayUserConfig(config *metadata.Config) error {
+	path, err := userConfigPath()
+	if err != nil || path == "" {
+		return err
+	}
+	userConfig, err := readUserConfig(path)
+	if err != nil || userConfig == nil {
+		return err
+	}
+	if err = mergeUserConfig(config, userConfig); err != nil {
+		return &ErrBadConfigFile{path, err}
+	}
+	return nil
+}
+
+// readUserConfig reads the per-user config file at path, returning nil if it
+// doesn't exist.
+func readUserConfig(path string) (*metadata.Config, error) {
+	file, err := os.Open(path)
+	switch {
+	case os.IsNotExist(err):
+		return nil, nil
+	case err != nil:
+		return nil, err
+	}
+	defer file.Close()
 
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	owner := info.Sys().(*syscall.Stat_t).Uid
+	if owner != 0 && int(owner) != os.Geteuid() {
+		return nil, &ErrBadConfigFile{path, fmt.Errorf("it is owned by uid %d", owner)}
+	}
+	if info.Mode().Perm()&0022 != 0 {
+		return nil, &ErrBadConfigFile{path,
+			errors.New("it is writable by users other than its owner")}
+	}
+
+	util.Debugf("Reading user config from %q\n", path)
+	config, err := metadata.ReadConfig(file)
+	if err != nil {
+		return nil, &ErrBadConfigFile{path, err}
+	}
 	return config, nil
 }
 
-// getHashingCosts returns hashing costs so that hashing a password will take
-// approximately the target time. This is done using the total amount of RAM,
-// the number of CPUs present, and by running the passphrase hash many times.
-func getHashingCosts(target time.Duration) (*metadata.HashingCosts, error) {
-	log.Printf("Finding hashing costs that take %v\n", target)
+// mergeUserConfig overrides the settings in config with those which are set in
+// userConfig. It fails if userConfig sets anything which only the global config
+// may set, or if it asks for passphrase hashing that is cheaper than the global
+// hash_costs, since that would weaken new protectors.
+func mergeUserConfig(config, userConfig *metadata.Config) error {
+	var err error
+	userConfig.ProtoReflect().Range(func(field protoreflect.FieldDescriptor, _ protoreflect.Value) bool {
+		if !userOverridableFields[string(field.Name())] {
+			err = fmt.Errorf("%q can only be set in %q", field.Name(), ConfigFileLocation)
+			return false
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	if userConfig.Source != metadata.SourceType_default {
+		config.Source = userConfig.Source
+	}
+	if costs := userConfig.HashCosts; costs != nil {
+		// Costs of different KDFs can't be compared, so users can't
+		// change the KDF.
+		if global := config.HashCosts; global != nil && (costs.Kdf != global.Kdf ||
+			costs.Time < global.Time || costs.Memory < global.Memory ||
+			costs.Parallelism < global.Parallelism ||
+			(global.TruncationFixed && !costs.TruncationFixed)) {
+			return fmt.Errorf("hash_costs {%v} are weaker than {%v} in %q",
+				costs, global, ConfigFileLocation)
+		}
+		config.HashCosts = costs
+	}
+	if userConfig.Options != nil {
+		mergeOptions(config, userConfig.Options)
+	}
+	return nil
+}
+
+// mergeOptions overrides the encryption options in config with those which are
+// set in options.
+func mergeOptions(config *metadata.Config, options *metadata.EncryptionOptions) {
+	if config.Options == nil {
+		config.Options = &metadata.EncryptionOptions{}
+	}
+	if options.Padding != 0 {
+		config.Options.Padding = options.Padding
+	}
+	if options.Contents != metadata.EncryptionOptions_default {
+		config.Options.Contents = options.Contents
+	}
+	if options.Filenames != metadata.EncryptionOptions_default {
+		config.Options.Filenames = options.Filenames
+	}
+	if options.PolicyVersion != 0 {
+		config.Options.PolicyVersion = options.PolicyVersion
+	}
+	if options.DataUnitSize != 0 {
+		config.Options.DataUnitSize = options.DataUnitSize
+	}
+	if options.NoDirectKey {
+		config.Options.NoDirectKey = true
+	}
+	// The IV_INO_LBLK_* flags are exclusive, so setting one replaces the
+	// other.
+	if options.IvInoLblk_64 {
+		config.Options.IvInoLblk_64 = true
+		config.Options.IvInoLblk_32 = false
+	}
+	if options.IvInoLblk_32 {
+		config.Options.IvInoLblk_32 = true
+		config.Options.IvInoLblk_64 = false
+	}
+}
+
+// profileNames returns the names of the profiles defined in config, sorted.
+func profileNames(config *metadata.Config) []string {
+	names := make([]string, 0, len(config.Profiles))
+	for name := range config.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
 
-	// Start out with the minimal possible costs that use all the CPUs.
-	parallelism := int64(runtime.NumCPU())
-	// golang.org/x/crypto/argon2 only supports parallelism up to 255.
-	// For compatibility, don't use more than that amount.
-	if parallelism > metadata.MaxParallelism {
-		parallelism = metadata.MaxParallelism
+// applyProfile overrides the settings in config with those which are set in
+// profile. Unlike the per-user config, a profile may ask for cheaper passphrase
+// hashing, as only root can define profiles.
+func applyProfile(config *metadata.Config, profile *metadata.Profile) {
+	if options := profile.GetOptions(); options != nil {
+		mergeOptions(config, options)
 	}
-	costs := &metadata.HashingCosts{
-		Time:            1,
-		Memory:          8 * parallelism,
-		Parallelism:     parallelism,
-		TruncationFixed: true,
+	if costs := profile.GetHashCosts(); costs != nil {
+		config.HashCosts = costs
+	}
+}
+
+// checkProfile checks that applying the named profile to config gives a valid
+// config.
+func checkProfile(config *metadata.Config, name string) error {
+	if name == "" {
+		return errors.New("profile names must not be empty")
+	}
+	profile := config.Profiles[name]
+	if costs := profile.GetHashCosts(); costs != nil {
+		if err := costs.CheckValidity(); err != nil {
+			return errors.Wrapf(err, "profile %q hashing costs", name)
+		}
+	}
+	resolved := proto.Clone(config).(*metadata.Config)
+	applyProfile(resolved, profile)
+	return errors.Wrapf(resolved.CheckValidity(), "profile %q", name)
+}
+
+// ProfileNames returns the names of the profiles defined in the config file,
+// sorted.
+func (ctx *Context) ProfileNames() []string {
+	return profileNames(ctx.Config)
+}
+
+// ListProfiles returns the names of the profiles defined in the config file,
+// sorted, without needing a Context.
+func ListProfiles() ([]string, error) {
+	config, err := getConfig()
+	if err != nil {
+		return nil, err
+	}
+	return profileNames(config), nil
+}
+
+// SuspendLockPolicies returns the policies (as MOUNTPOINT:ID) which the config
+// file lists to be locked before suspending, or nil if all the unlocked
+// policies should be.
+func SuspendLockPolicies() ([]string, error) {
+	config, err := getConfig()
+	if err != nil {
+		return nil, err
+	}
+	return config.GetSuspendLockPolicies(), nil
+}
+
+// UseProfile applies the named profile from the config file to the Context, so
+// that the policies and protectors created with it use the profile's settings.
+func (ctx *Context) UseProfile(name string) error {
+	profile, ok := ctx.Config.GetProfiles()[name]
+	if !ok {
+		return &ErrUnknownProfile{name, ctx.ProfileNames()}
+	}
+	util.Debugf("using profile %q: %v", name, profile)
+	applyProfile(ctx.Config, profile)
+	return nil
+}
+
+// getHashingCosts returns hashing costs for the KDF so that hashing a password
+// will take approximately the target time. This is done using the total amount
+// of RAM, the number of CPUs present, and by running the passphrase hash many
+// times.
+func getHashingCosts(target time.Duration, kdf metadata.KDF) (*metadata.HashingCosts, error) {
+	util.Debugf("Finding %v hashing costs that take %v\n", kdf, target)
+
+	var costs *metadata.HashingCosts
+	switch kdf {
+	case metadata.KDF_argon2id:
+		// Start out with the minimal possible costs that use all the CPUs.
+		parallelism := int64(runtime.NumCPU())
+		// golang.org/x/crypto/argon2 only supports parallelism up to
+		// 255. For compatibility, don't use more than that amount.
+		if parallelism > metadata.MaxParallelism {
+			parallelism = metadata.MaxParallelism
+		}
+		costs = &metadata.HashingCosts{
+			Time:            1,
+			Memory:          8 * parallelism,
+			Parallelism:     parallelism,
+			TruncationFixed: true,
+		}
+	case metadata.KDF_scrypt:
+		// scrypt's parallelization is only a cost multiplier (the
+		// implementation is sequential), so only the memory and time
+		// costs are increased, and the memory cost must be a power of 2.
+		costs = &metadata.HashingCosts{
+			Time:            1,
+			Memory:          16,
+			Parallelism:     1,
+			TruncationFixed: true,
+			Kdf:             kdf,
+		}
+	default:
+		return nil, errors.Errorf("unknown KDF %v", kdf)
 	}
 
 	// If even the minimal costs are not fast enough, just return the
@@ -206,15 +573,18 @@ func getHashingCosts(target time.Duration) (*metadata.HashingCosts, error) {
 	if err != nil {
 		return nil, err
 	}
-	log.Printf("Min Costs={%v}\t-> %v\n", costs, t)
+	util.Debugf("Min Costs={%v}\t-> %v\n", costs, t)
 
 	if t > target {
-		log.Printf("time exceeded the target of %v.\n", target)
+		util.Debugf("time exceeded the target of %v.\n", target)
 		return costs, nil
 	}
 
 	// Now we start doubling the costs until we reach the target.
 	memoryKiBLimit := memoryBytesLimit() / 1024
+	if kdf == metadata.KDF_scrypt {
+		memoryKiBLimit = roundDownToPowerOf2(memoryKiBLimit)
+	}
 	for {
 		// Store a copy of the previous costs
 		costsPrev := proto.Clone(costs).(*metadata.HashingCosts)
@@ -229,21 +599,26 @@ func getHashingCosts(target time.Duration) (*metadata.HashingCosts, error) {
 
 		// If our hashing failed, return the last good set of costs.
 		if t, err = timeHashingCosts(costs); err != nil {
-			log.Printf("Hashing with costs={%v} failed: %v\n", costs, err)
+			util.Debugf("Hashing with costs={%v} failed: %v\n", costs, err)
 			return costsPrev, nil
 		}
-		log.Printf("Costs={%v}\t-> %v\n", costs, t)
+		util.Debugf("Costs={%v}\t-> %v\n", costs, t)
 
 		// If we have reached the target time, we return a set of costs
 		// based on the linear interpolation between the last two times.
 		if t >= target {
 			f := float64(target-tPrev) / float64(t-tPrev)
-			return &metadata.HashingCosts{
+			costs = &metadata.HashingCosts{
 				Time:            betweenCosts(costsPrev.Time, costs.Time, f),
 				Memory:          betweenCosts(costsPrev.Memory, costs.Memory, f),
 				Parallelism:     costs.Parallelism,
 				TruncationFixed: costs.TruncationFixed,
-			}, nil
+				Kdf:             costs.Kdf,
+			}
+			if kdf == metadata.KDF_scrypt {
+				costs.Memory = roundDownToPowerOf2(costs.Memory)
+			}
+			return costs, nil
 		}
 	}
 }
@@ -267,6 +642,16 @@ func betweenCosts(a, b int64, f float64) int64 {
 	return a + int64(f*float64(b-a))
 }
 
+// roundDownToPowerOf2 returns the largest power of 2 which is at most n, where
+// n is positive.
+func roundDownToPowerOf2(n int64) int64 {
+	p := int64(1)
+	for p <= n/2 {
+		p *= 2
+	}
+	return p
+}
+
 // timeHashingCosts runs the passphrase hash with the specified costs and
 // returns the time it takes to hash the passphrase.
 func timeHashingCosts(costs *metadata.HashingCosts) (time.Duration, error) {
@@ -279,9 +664,10 @@ func timeHashingCosts(costs *metadata.HashingCosts) (time.Duration, error) {
 	// Be sure to measure CPU time, not wall time (time.Now)
 	begin := cpuTimeInNanoseconds()
 	hash, err := crypto.PassphraseHash(passphrase, timingSalt, costs)
-	if err == nil {
-		hash.Wipe()
+	if err != nil {
+		return 0, err
 	}
+	hash.Wipe()
 	end := cpuTimeInNanoseconds()
 
 	// This uses a lot of memory, run the garbage collector
@@ -43,7 +43,7 @@ func TestConfigFileIsCreatedWithCorrectMode(t *testing.T) {
 	defer os.RemoveAll(tempDir)
 	ConfigFileLocation = filepath.Join(tempDir, "test.conf")
 
-	if err = CreateConfigFile(time.Millisecond, 0); err != nil {
+	if err = CreateConfigFile(time.Millisecond, 0, metadata.KDF_argon2id); err != nil {
 		t.Fatal(err)
 	}
 	fileInfo, err := os.Stat(ConfigFileLocation)
@@ -63,7 +63,7 @@ func TestCreateConfigFileV2Policy(t *testing.T) {
 	defer os.RemoveAll(tempDir)
 	ConfigFileLocation = filepath.Join(tempDir, "test.conf")
 
-	if err = CreateConfigFile(time.Millisecond, 2); err != nil {
+	if err = CreateConfigFile(time.Millisecond, 2, metadata.KDF_argon2id); err != nil {
 		t.Fatal(err)
 	}
 
@@ -76,3 +76,160 @@ func TestCreateConfigFileV2Policy(t *testing.T) {
 		t.Error("Expected PolicyVersion 2")
 	}
 }
+
+// Tests that the settings which users may override are merged into the global
+// config, and that the others are refused.
+func TestMergeUserConfig(t *testing.T) {
+	newGlobal := func() *metadata.Config {
+		return &metadata.Config{
+			Source:    metadata.SourceType_pam_passphrase,
+			HashCosts: &metadata.HashingCosts{Time: 4, Memory: 1024, Parallelism: 2, TruncationFixed: true},
+			Options: &metadata.EncryptionOptions{
+				Padding:       32,
+				Contents:      metadata.EncryptionOptions_AES_256_XTS,
+				Filenames:     metadata.EncryptionOptions_AES_256_CTS,
+				PolicyVersion: 2,
+			},
+			PostUnlockHook: "true",
+		}
+	}
+
+	config := newGlobal()
+	userConfig := &metadata.Config{
+		Source:    metadata.SourceType_custom_passphrase,
+		HashCosts: &metadata.HashingCosts{Time: 8, Memory: 2048, Parallelism: 2, TruncationFixed: true},
+		Options: &metadata.EncryptionOptions{
+			Contents:  metadata.EncryptionOptions_Adiantum,
+			Filenames: metadata.EncryptionOptions_Adiantum,
+		},
+	}
+	if err := mergeUserConfig(config, userConfig); err != nil {
+		t.Fatal(err)
+	}
+	if config.Source != metadata.SourceType_custom_passphrase {
+		t.Errorf("source wasn't overridden: %v", config.Source)
+	}
+	if config.HashCosts.Time != 8 {
+		t.Errorf("hash costs weren't overridden: %v", config.HashCosts)
+	}
+	if config.Options.Contents != metadata.EncryptionOptions_Adiantum ||
+		config.Options.Padding != 32 || config.Options.PolicyVersion != 2 {
+		t.Errorf("options weren't merged correctly: %v", config.Options)
+	}
+	if config.PostUnlockHook != "true" {
+		t.Errorf("global hook was lost: %q", config.PostUnlockHook)
+	}
+
+	for _, userConfig := range []*metadata.Config{
+		{AllowCrossUserMetadata: true},
+		{UseFsKeyringForV1Policies: true},
+		{PostLockHook: "rm -rf /"},
+		{KeystoreDir: "/tmp"},
+		{HashCosts: &metadata.HashingCosts{Time: 1, Memory: 1024, Parallelism: 2, TruncationFixed: true}},
+		{HashCosts: &metadata.HashingCosts{Time: 4, Memory: 1024, Parallelism: 2}},
+		{Profiles: map[string]*metadata.Profile{"fast": {}}},
+	} {
+		if err := mergeUserConfig(newGlobal(), userConfig); err == nil {
+			t.Errorf("user config {%v} should have been refused", userConfig)
+		}
+	}
+}
+
+// Tests that getConfig reads the user config file, but only if it can't have
+// been written by another user.
+func TestGetConfigWithUserConfig(t *testing.T) {
+	tempDir := t.TempDir()
+	ConfigFileLocation = filepath.Join(tempDir, "test.conf")
+	UserConfigFileLocation = filepath.Join(tempDir, "user.conf")
+	defer func() { UserConfigFileLocation = ".config/fscrypt/config" }()
+
+	if err := CreateConfigFile(time.Millisecond, 1, metadata.KDF_argon2id); err != nil {
+		t.Fatal(err)
+	}
+	userConfig := `{"options": {"policy_version": "2", "contents": "Adiantum", "filenames": "Adiantum"}}`
+	if err := os.WriteFile(UserConfigFileLocation, []byte(userConfig), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := getConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Options.PolicyVersion != 2 || config.Options.Contents != metadata.EncryptionOptions_Adiantum {
+		t.Errorf("user config wasn't applied: %v", config.Options)
+	}
+	if config.Options.Padding != metadata.DefaultOptions.Padding {
+		t.Errorf("global padding wasn't kept: %d", config.Options.Padding)
+	}
+
+	if err = os.Chmod(UserConfigFileLocation, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = getConfig(); err == nil {
+		t.Error("world-writable user config should have been refused")
+	}
+	if err = os.Remove(UserConfigFileLocation); err != nil {
+		t.Fatal(err)
+	}
+	if config, err = getConfig(); err != nil {
+		t.Fatal(err)
+	} else if config.Options.PolicyVersion != 1 {
+		t.Errorf("expected the global policy version, got %d", config.Options.PolicyVersion)
+	}
+}
+
+// Tests that profiles from the config file override the global settings, and
+// that invalid profiles and unknown profile names are refused.
+func TestProfiles(t *testing.T) {
+	tempDir := t.TempDir()
+	ConfigFileLocation = filepath.Join(tempDir, "test.conf")
+	UserConfigFileLocation = ""
+	defer func() { UserConfigFileLocation = ".config/fscrypt/config" }()
+
+	writeConfig := func(profiles string) {
+		config := `{"source": "custom_passphrase",
+			"hash_costs": {"time": "4", "memory": "1024", "parallelism": "2", "truncation_fixed": true},
+			"options": {"policy_version": "2"},
+			"profiles": ` + profiles + `}`
+		if err := os.WriteFile(ConfigFileLocation, []byte(config), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeConfig(`{
+		"fast": {"options": {"contents": "Adiantum", "filenames": "Adiantum"},
+			"hash_costs": {"time": "1", "memory": "256", "parallelism": "1", "truncation_fixed": true}},
+		"paranoid": {"options": {"padding": "32"}}}`)
+	config, err := getConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := &Context{Config: config}
+	if names := ctx.ProfileNames(); len(names) != 2 || names[0] != "fast" || names[1] != "paranoid" {
+		t.Errorf("unexpected profile names %v", names)
+	}
+	if err = ctx.UseProfile("fast"); err != nil {
+		t.Fatal(err)
+	}
+	if ctx.Config.Options.Contents != metadata.EncryptionOptions_Adiantum ||
+		ctx.Config.Options.PolicyVersion != 2 ||
+		ctx.Config.Options.Padding != metadata.DefaultOptions.Padding {
+		t.Errorf("profile options weren't merged correctly: %v", ctx.Config.Options)
+	}
+	if ctx.Config.HashCosts.Time != 1 {
+		t.Errorf("profile hash costs weren't used: %v", ctx.Config.HashCosts)
+	}
+	if _, ok := ctx.UseProfile("slow").(*ErrUnknownProfile); !ok {
+		t.Error("unknown profile should have been refused")
+	}
+
+	for _, profiles := range []string{
+		`{"bad": {"options": {"padding": "7"}}}`,
+		`{"bad": {"hash_costs": {"time": "0", "memory": "256", "parallelism": "1"}}}`,
+		`{"": {}}`,
+	} {
+		writeConfig(profiles)
+		if _, err = getConfig(); err == nil {
+			t.Errorf("profiles %s should have been refused", profiles)
+		}
+	}
+}
@@ -26,10 +26,11 @@
 //	- Creating a context on which to perform actions
 //	- Creating, unlocking, and modifying Protectors
 //	- Creating, unlocking, and modifying Policies
+//	- Reporting key lifecycle events to a metrics Observer
+//	- Checking early that fscrypt can operate on a filesystem
 package actions
 
 import (
-	"log"
 	"os/user"
 
 	"github.com/pkg/errors"
@@ -79,7 +80,7 @@ func NewContextFromPath(path string, targetUser *user.User) (*Context, error) {
 		return nil, err
 	}
 
-	log.Printf("%s is on %s filesystem %q (%s)", path,
+	util.Debugf("%s is on %s filesystem %q (%s)", path,
 		ctx.Mount.FilesystemType, ctx.Mount.Path, ctx.Mount.Device)
 	return ctx, nil
 }
@@ -97,7 +98,7 @@ func NewContextFromMountpoint(mountpoint string, targetUser *user.User) (*Contex
 		return nil, err
 	}
 
-	log.Printf("found %s filesystem %q (%s)", ctx.Mount.FilesystemType,
+	util.Debugf("found %s filesystem %q (%s)", ctx.Mount.FilesystemType,
 		ctx.Mount.Path, ctx.Mount.Device)
 	return ctx, nil
 }
@@ -128,7 +129,7 @@ func newContextFromUser(targetUser *user.User) (*Context, error) {
 		}
 	}
 
-	log.Printf("creating context for user %q", targetUser.Username)
+	util.Debugf("creating context for user %q", targetUser.Username)
 	return ctx, nil
 }
 
@@ -141,6 +142,18 @@ func (ctx *Context) checkContext() error {
 	return ctx.Mount.CheckSetup(ctx.TrustedUser)
 }
 
+// withMetadataLock runs fn while holding the lock on the metadata of the
+// context's filesystem, so that concurrent fscrypt processes don't lose each
+// other's changes. fn must not prompt the user or take the lock again.
+func (ctx *Context) withMetadataLock(fn func() error) error {
+	lock, err := ctx.Mount.LockMetadata()
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+	return fn()
+}
+
 func (ctx *Context) getKeyringOptions() *keyring.Options {
 	return &keyring.Options{
 		Mount:                     ctx.Mount,
@@ -154,15 +167,21 @@ func (ctx *Context) getKeyringOptions() *keyring.Options {
 func (ctx *Context) getProtectorOption(protectorDescriptor string) *ProtectorOption {
 	mnt, data, err := ctx.Mount.GetProtector(protectorDescriptor, ctx.TrustedUser)
 	if err != nil {
-		return &ProtectorOption{ProtectorInfo{}, nil, err}
+		err = checkDowngraded(err, "protector", protectorDescriptor, ctx.Mount)
+		return &ProtectorOption{ProtectorInfo{}, nil, err, false}
 	}
 
-	info := ProtectorInfo{data}
+	unsealProtectorName(mnt, ctx.TrustedUser, data)
+	info := ProtectorInfo{data: data}
+	if err = ctx.checkProtectorAccess(data); err != nil {
+		return &ProtectorOption{info, nil, err, false}
+	}
+	inKeystore := ctx.keystoreKeyPath(info) != ""
 	// No linked path if on the same mountpoint
 	if mnt == ctx.Mount {
-		return &ProtectorOption{info, nil, nil}
+		return &ProtectorOption{info, nil, nil, inKeystore}
 	}
-	return &ProtectorOption{info, mnt, nil}
+	return &ProtectorOption{info, mnt, nil, inKeystore}
 }
 
 // ProtectorOptions creates a slice of all the options for all of the Protectors
@@ -182,3 +201,20 @@ func (ctx *Context) ProtectorOptions() ([]*ProtectorOption, error) {
 	}
 	return options, nil
 }
+
+// ProtectorDescriptorsWithName returns the descriptors of all the Protectors on
+// the Context's mountpoint (including linked Protectors) which have the given
+// name. Protectors which couldn't be loaded are skipped.
+func (ctx *Context) ProtectorDescriptorsWithName(name string) ([]string, error) {
+	options, err := ctx.ProtectorOptions()
+	if err != nil {
+		return nil, err
+	}
+	var descriptors []string
+	for _, option := range options {
+		if option.LoadError == nil && option.Name() == name {
+			descriptors = append(descriptors, option.Descriptor())
+		}
+	}
+	return descriptors, nil
+}
@@ -28,6 +28,7 @@ import (
 	"time"
 
 	"github.com/google/fscrypt/filesystem"
+	"github.com/google/fscrypt/metadata"
 	"github.com/google/fscrypt/util"
 	"github.com/pkg/errors"
 )
@@ -54,7 +55,7 @@ func setupContext() (ctx *Context, err error) {
 		return nil, fmt.Errorf("created context at %q without config file", badCtx.Mount.Path)
 	}
 
-	if err = CreateConfigFile(testTime, 0); err != nil {
+	if err = CreateConfigFile(testTime, 0, metadata.KDF_argon2id); err != nil {
 		return nil, err
 	}
 	defer func() {
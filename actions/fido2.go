@@ -0,0 +1,106 @@
+/*
+ * fido2.go - Protectors whose wrapping key comes from a FIDO2 security key
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package actions
+
+import (
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/google/fscrypt/crypto"
+	"github.com/google/fscrypt/metadata"
+	"github.com/google/fscrypt/util"
+)
+
+// ErrNoFIDO2Authenticator indicates that a fido2 protector was used without a
+// FIDO2Authenticator having been set.
+var ErrNoFIDO2Authenticator = errors.New("FIDO2 security keys are not supported by this program")
+
+// FIDO2Authenticator talks to FIDO2 security keys (e.g. YubiKeys) which support
+// the hmac-secret extension. The wrapping key of a fido2 protector is the
+// hmac-secret output of a credential made for the protector, for a random salt
+// stored in the protector's metadata. If no security key is present, or the
+// user declines the request, the methods should return an error which says so.
+type FIDO2Authenticator interface {
+	// MakeCredential makes a new credential with the hmac-secret extension
+	// for the protector called name, and returns the credential ID.
+	MakeCredential(name string) ([]byte, error)
+	// HMACSecret returns the hmac-secret output of the protector's
+	// credential for the protector's salt (see ProtectorInfo.FIDO2Salt).
+	// The retry parameter indicates that the previous output was incorrect,
+	// e.g. because it came from another security key.
+	HMACSecret(info ProtectorInfo, retry bool) (*crypto.Key, error)
+}
+
+var (
+	fido2Authenticator      FIDO2Authenticator
+	fido2AuthenticatorMutex sync.RWMutex
+)
+
+// SetFIDO2Authenticator makes fido2 protectors use authenticator from now on.
+// Passing nil disables fido2 protectors, which is the default.
+func SetFIDO2Authenticator(authenticator FIDO2Authenticator) {
+	fido2AuthenticatorMutex.Lock()
+	defer fido2AuthenticatorMutex.Unlock()
+	fido2Authenticator = authenticator
+}
+
+func getFIDO2Authenticator() (FIDO2Authenticator, error) {
+	fido2AuthenticatorMutex.RLock()
+	defer fido2AuthenticatorMutex.RUnlock()
+	if fido2Authenticator == nil {
+		return nil, ErrNoFIDO2Authenticator
+	}
+	return fido2Authenticator, nil
+}
+
+// makeFIDO2Credential makes the credential for a new fido2 protector.
+func makeFIDO2Credential(name string) ([]byte, error) {
+	authenticator, err := getFIDO2Authenticator()
+	if err != nil {
+		return nil, err
+	}
+	credentialID, err := authenticator.MakeCredential(name)
+	if err != nil {
+		return nil, err
+	}
+	if len(credentialID) == 0 {
+		return nil, errors.New("security key returned an empty credential ID")
+	}
+	return credentialID, nil
+}
+
+// getFIDO2WrappingKey gets the wrapping key of a fido2 protector from the
+// security key.
+func getFIDO2WrappingKey(info ProtectorInfo, retry bool) (*crypto.Key, error) {
+	authenticator, err := getFIDO2Authenticator()
+	if err != nil {
+		return nil, err
+	}
+	util.Debugf("getting hmac-secret for protector %s", info.Descriptor())
+	key, err := authenticator.HMACSecret(info, retry)
+	if err != nil {
+		return nil, err
+	}
+	if err = util.CheckValidLength(metadata.InternalKeyLen, key.Len()); err != nil {
+		key.Wipe()
+		return nil, errors.Wrap(err, "hmac-secret output")
+	}
+	return key, nil
+}
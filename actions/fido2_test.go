@@ -0,0 +1,102 @@
+/*
+ * fido2_test.go - tests for protectors unlocked with FIDO2 security keys
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package actions
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"testing"
+
+	"github.com/pkg/errors"
+
+	"github.com/google/fscrypt/crypto"
+	"github.com/google/fscrypt/metadata"
+)
+
+var errNoSecurityKey = errors.New("no security key")
+
+// fakeAuthenticator computes the hmac-secret output as an HMAC of the salt
+// keyed by its secret and the credential ID, like a real security key would
+// with a secret it never reveals.
+type fakeAuthenticator struct {
+	secret  []byte
+	absent  bool
+	retries int
+}
+
+func (a *fakeAuthenticator) MakeCredential(name string) ([]byte, error) {
+	if a.absent {
+		return nil, errNoSecurityKey
+	}
+	return []byte("credential for " + name), nil
+}
+
+func (a *fakeAuthenticator) HMACSecret(info ProtectorInfo, retry bool) (*crypto.Key, error) {
+	if a.absent {
+		return nil, errNoSecurityKey
+	}
+	if retry {
+		a.retries++
+		return nil, errCallback
+	}
+	mac := hmac.New(sha256.New, append(a.secret, info.FIDO2CredentialID()...))
+	mac.Write(info.FIDO2Salt())
+	output := mac.Sum(nil)
+	return crypto.NewFixedLengthKeyFromReader(bytes.NewReader(output), len(output))
+}
+
+func useFIDO2Source(t *testing.T, authenticator FIDO2Authenticator) {
+	useProtectorSource(t, metadata.SourceType_fido2, func(installed bool) {
+		if installed {
+			SetFIDO2Authenticator(authenticator)
+		} else {
+			SetFIDO2Authenticator(nil)
+		}
+	})
+}
+
+// Tests that a fido2 protector is unlocked by the security key it was created
+// with, without using the callback, and not by another one.
+func TestFIDO2Protector(t *testing.T) {
+	authenticator := &fakeAuthenticator{secret: []byte("secret")}
+	useFIDO2Source(t, authenticator)
+	// The other security key gives the wrong output, so it's asked again.
+	testProtectorSource(t, testProtectorName, badCallback,
+		func(data *metadata.ProtectorData) bool {
+			return len(data.Fido2Salt) == metadata.FIDO2SaltLen && len(data.Fido2CredentialId) != 0
+		},
+		func() { authenticator.secret = []byte("another security key") }, errCallback)
+	if authenticator.retries != 1 {
+		t.Errorf("retried %d times, expected 1", authenticator.retries)
+	}
+}
+
+// Tests that the errors of the security key are passed on.
+func TestFIDO2ProtectorAbsent(t *testing.T) {
+	useFIDO2Source(t, &fakeAuthenticator{absent: true})
+	if _, err := CreateProtector(testContext, testProtectorName, goodCallback, nil); err != errNoSecurityKey {
+		t.Errorf("expected %v, got %v", errNoSecurityKey, err)
+	}
+
+	SetFIDO2Authenticator(nil)
+	if _, err := CreateProtector(testContext, testProtectorName, goodCallback, nil); err != ErrNoFIDO2Authenticator {
+		t.Errorf("expected %v, got %v", ErrNoFIDO2Authenticator, err)
+	}
+}
@@ -0,0 +1,115 @@
+/*
+ * gpg.go - Protectors whose wrapping key is encrypted to a GPG key
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package actions
+
+import (
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/google/fscrypt/crypto"
+	"github.com/google/fscrypt/metadata"
+	"github.com/google/fscrypt/util"
+)
+
+// GPG errors
+var (
+	ErrNoGPG          = errors.New("GPG keys are not supported by this program")
+	ErrNoGPGRecipient = errors.New(`no GPG key is set in the config file's "gpg_recipient"`)
+	ErrGPGWrongKey    = errors.New("the key decrypted by GPG is incorrect")
+)
+
+// GPG encrypts keys to GPG public keys and decrypts them. The wrapping key of a
+// gpg protector is a random key which is encrypted to a GPG key when the
+// protector is created, and decrypted with its secret key (e.g. by gpg-agent,
+// which may use a smartcard) each time it is used.
+type GPG interface {
+	// Encrypt encrypts key to the GPG key given by recipient.
+	Encrypt(recipient string, key *crypto.Key) ([]byte, error)
+	// Decrypt decrypts ciphertext, which names the key it was encrypted
+	// to.
+	Decrypt(ciphertext []byte) (*crypto.Key, error)
+}
+
+var (
+	gpg      GPG
+	gpgMutex sync.RWMutex
+)
+
+// SetGPG makes gpg protectors use g from now on. Passing nil disables gpg
+// protectors, which is the default.
+func SetGPG(g GPG) {
+	gpgMutex.Lock()
+	defer gpgMutex.Unlock()
+	gpg = g
+}
+
+func getGPG() (GPG, error) {
+	gpgMutex.RLock()
+	defer gpgMutex.RUnlock()
+	if gpg == nil {
+		return nil, ErrNoGPG
+	}
+	return gpg, nil
+}
+
+// wrapGPGWrappingKey encrypts a new random wrapping key for a gpg protector to
+// the GPG key set in config, and stores it in data.
+func wrapGPGWrappingKey(config *metadata.Config, data *metadata.ProtectorData) error {
+	g, err := getGPG()
+	if err != nil {
+		return err
+	}
+	if config.GetGpgRecipient() == "" {
+		return ErrNoGPGRecipient
+	}
+	key, err := crypto.NewRandomKey(metadata.InternalKeyLen)
+	if err != nil {
+		return err
+	}
+	defer key.Wipe()
+	if data.GpgWrappedKey, err = g.Encrypt(config.GetGpgRecipient(), key); err != nil {
+		return err
+	}
+	data.GpgRecipient = config.GetGpgRecipient()
+	return nil
+}
+
+// getGPGWrappingKey gets the wrapping key of a gpg protector from GPG.
+func getGPGWrappingKey(info ProtectorInfo, retry bool) (*crypto.Key, error) {
+	// GPG always decrypts the same key, so a wrong key can't be fixed by
+	// asking it again.
+	if retry {
+		return nil, ErrGPGWrongKey
+	}
+	g, err := getGPG()
+	if err != nil {
+		return nil, err
+	}
+	util.Debugf("decrypting key of protector %s with GPG", info.Descriptor())
+	key, err := g.Decrypt(info.data.GpgWrappedKey)
+	if err != nil {
+		return nil, err
+	}
+	if err = util.CheckValidLength(metadata.InternalKeyLen, key.Len()); err != nil {
+		key.Wipe()
+		return nil, errors.Wrap(err, "GPG decrypted key")
+	}
+	return key, nil
+}
@@ -0,0 +1,88 @@
+/*
+ * gpg_test.go - tests for protectors whose key is encrypted to a GPG key
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package actions
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/pkg/errors"
+
+	"github.com/google/fscrypt/crypto"
+	"github.com/google/fscrypt/metadata"
+)
+
+const testGPGRecipient = "alice@example.com"
+
+var errNoSecretKey = errors.New("no secret key")
+
+// fakeGPG "encrypts" keys by prefixing them with the recipient, and only
+// decrypts those whose recipient's secret key it has.
+type fakeGPG struct {
+	secretKeys map[string]bool
+}
+
+func (g *fakeGPG) Encrypt(recipient string, key *crypto.Key) ([]byte, error) {
+	return append([]byte(recipient+"\n"), key.Data()...), nil
+}
+
+func (g *fakeGPG) Decrypt(ciphertext []byte) (*crypto.Key, error) {
+	i := bytes.IndexByte(ciphertext, '\n')
+	if i < 0 || !g.secretKeys[string(ciphertext[:i])] {
+		return nil, errNoSecretKey
+	}
+	data := ciphertext[i+1:]
+	return crypto.NewFixedLengthKeyFromReader(bytes.NewReader(data), len(data))
+}
+
+func useGPGSource(t *testing.T, g GPG) {
+	useProtectorSource(t, metadata.SourceType_gpg, func(installed bool) {
+		if installed {
+			SetGPG(g)
+		} else {
+			SetGPG(nil)
+		}
+	})
+	testContext.Config.GpgRecipient = testGPGRecipient
+}
+
+// Tests that a gpg protector is unlocked by GPG without using the callback, and
+// not without the recipient's secret key.
+func TestGPGProtector(t *testing.T) {
+	g := &fakeGPG{secretKeys: map[string]bool{testGPGRecipient: true}}
+	useGPGSource(t, g)
+	testProtectorSource(t, testProtectorName, badCallback,
+		func(data *metadata.ProtectorData) bool {
+			return data.GpgRecipient == testGPGRecipient && len(data.GpgWrappedKey) != 0
+		},
+		func() { delete(g.secretKeys, testGPGRecipient) }, errNoSecretKey)
+}
+
+// Tests that gpg protectors need a recipient and a GPG.
+func TestGPGProtectorErrors(t *testing.T) {
+	useGPGSource(t, &fakeGPG{})
+	testContext.Config.GpgRecipient = ""
+	if _, err := CreateProtector(testContext, testProtectorName, badCallback, nil); err != ErrNoGPGRecipient {
+		t.Errorf("expected %v, got %v", ErrNoGPGRecipient, err)
+	}
+	SetGPG(nil)
+	if _, err := CreateProtector(testContext, testProtectorName, badCallback, nil); err != ErrNoGPG {
+		t.Errorf("expected %v, got %v", ErrNoGPG, err)
+	}
+}
@@ -24,6 +24,8 @@ import (
 	"log"
 	"testing"
 	"time"
+
+	"github.com/google/fscrypt/metadata"
 )
 
 // Tests that we can find valid hashing costs for various time targets and the
@@ -34,21 +36,30 @@ func TestCostsSearch(t *testing.T) {
 		200 * time.Millisecond,
 		500 * time.Millisecond,
 	} {
-		costs, err := getHashingCosts(target)
-		if err != nil {
-			t.Error(err)
-		}
-		actual, err := timeHashingCosts(costs)
-		if err != nil {
-			t.Error(err)
+		for _, kdf := range []metadata.KDF{metadata.KDF_argon2id, metadata.KDF_scrypt} {
+			testCostsSearch(t, target, kdf)
 		}
+	}
+}
 
-		if actual*3 < target {
-			t.Errorf("actual=%v is too small (target=%v)", actual, target)
-		}
-		if target*3 < actual {
-			t.Errorf("actual=%v is too big (target=%v)", actual, target)
-		}
+func testCostsSearch(t *testing.T, target time.Duration, kdf metadata.KDF) {
+	costs, err := getHashingCosts(target, kdf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = costs.CheckValidity(); err != nil {
+		t.Errorf("%v costs {%v} are invalid: %v", kdf, costs, err)
+	}
+	actual, err := timeHashingCosts(costs)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if actual*3 < target {
+		t.Errorf("%v: actual=%v is too small (target=%v)", kdf, actual, target)
+	}
+	if target*3 < actual {
+		t.Errorf("%v: actual=%v is too big (target=%v)", kdf, actual, target)
 	}
 }
 
@@ -56,7 +67,7 @@ func benchmarkCostsSearch(b *testing.B, target time.Duration) {
 	// Disable logging for benchmarks
 	log.SetOutput(io.Discard)
 	for i := 0; i < b.N; i++ {
-		_, err := getHashingCosts(target)
+		_, err := getHashingCosts(target, metadata.KDF_argon2id)
 		if err != nil {
 			b.Fatal(err)
 		}
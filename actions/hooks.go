@@ -0,0 +1,80 @@
+/*
+ * hooks.go - running the commands configured to run after unlocking or
+ * locking a directory
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package actions
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+
+	"github.com/google/fscrypt/util"
+)
+
+// ErrHookFailed indicates that a post_unlock_hook or post_lock_hook command
+// from the config file failed. The unlock or lock operation itself succeeded.
+type ErrHookFailed struct {
+	Hook    string
+	Command string
+	Err     error
+}
+
+func (err *ErrHookFailed) Error() string {
+	return fmt.Sprintf("%s %q failed: %v", err.Hook, err.Command, err.Err)
+}
+
+// RunPostUnlockHook runs the post_unlock_hook command from the config file (if
+// any), after dirPath has been unlocked with this Policy. It should only be
+// called if the directory was actually unlocked, not if it was already
+// unlocked.
+func (policy *Policy) RunPostUnlockHook(dirPath string) error {
+	return policy.runHook("post_unlock_hook",
+		policy.Context.Config.GetPostUnlockHook(), dirPath)
+}
+
+// RunPostLockHook runs the post_lock_hook command from the config file (if any),
+// after dirPath has been locked. It should only be called if the directory was
+// actually locked, not if it was already locked.
+func (policy *Policy) RunPostLockHook(dirPath string) error {
+	return policy.runHook("post_lock_hook",
+		policy.Context.Config.GetPostLockHook(), dirPath)
+}
+
+// runHook runs command with /bin/sh, passing along information about the
+// directory and policy in the environment. The hook's output goes to our
+// stdout and stderr.
+func (policy *Policy) runHook(hook, command, dirPath string) error {
+	if command == "" {
+		return nil
+	}
+	cmd := exec.Command("/bin/sh", "-c", command)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(),
+		"FSCRYPT_HOOK="+hook,
+		"FSCRYPT_DIRECTORY="+dirPath,
+		"FSCRYPT_POLICY="+policy.Descriptor(),
+		"FSCRYPT_MOUNTPOINT="+policy.Context.Mount.Path)
+
+	util.Infof("running %s %q for %q", hook, command, dirPath)
+	if err := cmd.Run(); err != nil {
+		return &ErrHookFailed{hook, command, err}
+	}
+	return nil
+}
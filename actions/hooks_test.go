@@ -0,0 +1,57 @@
+/*
+ * hooks_test.go - tests for running post-unlock and post-lock hooks
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package actions
+
+import (
+	"testing"
+)
+
+// Tests that the hooks are run with the expected environment, and that their
+// failures are reported.
+func TestRunHooks(t *testing.T) {
+	pro, pol, err := makeBoth()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanupProtector(pro)
+	defer cleanupPolicy(pol)
+	defer func() {
+		testContext.Config.PostUnlockHook = ""
+		testContext.Config.PostLockHook = ""
+	}()
+
+	// No hooks configured
+	if err = pol.RunPostUnlockHook("dir"); err != nil {
+		t.Error(err)
+	}
+
+	testContext.Config.PostUnlockHook = `test "$FSCRYPT_HOOK" = post_unlock_hook &&
+		test "$FSCRYPT_DIRECTORY" = dir &&
+		test "$FSCRYPT_POLICY" = ` + pol.Descriptor() + ` &&
+		test "$FSCRYPT_MOUNTPOINT" = ` + testContext.Mount.Path
+	if err = pol.RunPostUnlockHook("dir"); err != nil {
+		t.Error(err)
+	}
+
+	testContext.Config.PostLockHook = "exit 1"
+	err = pol.RunPostLockHook("dir")
+	if _, ok := err.(*ErrHookFailed); !ok {
+		t.Errorf("expected ErrHookFailed, got %v", err)
+	}
+}
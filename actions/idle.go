@@ -0,0 +1,119 @@
+/*
+ * idle.go - Locking policies which haven't been used for a while
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package actions
+
+import (
+	"sync"
+	"time"
+
+	"github.com/google/fscrypt/keyring"
+	"github.com/google/fscrypt/util"
+)
+
+// IdleTracker keeps track of when the policies which are unlocked on a
+// filesystem were last used, so that those which have been idle for longer
+// than a timeout can be locked. A policy's timer starts when it is first seen
+// unlocked by LockIdle, and is restarted by each use given to MarkUsed.
+type IdleTracker struct {
+	ctx      *Context
+	timeout  time.Duration
+	allUsers bool
+
+	mu       sync.Mutex
+	lastUsed map[string]time.Time
+}
+
+// NewIdleTracker creates an IdleTracker for the policies on the context's
+// filesystem. Unless allUsers is true, only the policies which the target user
+// has unlocked are tracked, and only their claims to v2 policy keys are
+// removed.
+func NewIdleTracker(ctx *Context, timeout time.Duration, allUsers bool) (*IdleTracker, error) {
+	if err := ctx.checkContext(); err != nil {
+		return nil, err
+	}
+	return &IdleTracker{
+		ctx:      ctx,
+		timeout:  timeout,
+		allUsers: allUsers,
+		lastUsed: make(map[string]time.Time),
+	}, nil
+}
+
+// MarkUsed records that the policy was used at the given time. Uses of policies
+// which aren't being tracked as unlocked are ignored, so that the timer of a
+// policy which is unlocked later starts from when it is unlocked.
+func (tracker *IdleTracker) MarkUsed(policyDescriptor string, when time.Time) {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+	if lastUsed, ok := tracker.lastUsed[policyDescriptor]; ok && when.After(lastUsed) {
+		tracker.lastUsed[policyDescriptor] = when
+	}
+}
+
+// LockIdle locks the unlocked policies which haven't been used for the timeout
+// as of now, and reports what happened to each of them. Policies which stay
+// unlocked because some of their files are still open are tried again the next
+// time.
+func (tracker *IdleTracker) LockIdle(now time.Time) ([]*LockResult, error) {
+	policies, err := tracker.ctx.Mount.ListPolicies(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+	options := tracker.ctx.getKeyringOptions()
+	unlocked := make(map[string]bool)
+	var results []*LockResult
+	for _, policyDescriptor := range policies {
+		status, err := keyring.GetEncryptionKeyStatus(policyDescriptor, options)
+		if err != nil {
+			return nil, err
+		}
+		if !needsLocking(status, tracker.allUsers) {
+			continue
+		}
+		lastUsed, ok := tracker.lastUsed[policyDescriptor]
+		if !ok {
+			util.Debugf("policy %s is unlocked, locking it after %v", policyDescriptor, tracker.timeout)
+			tracker.lastUsed[policyDescriptor] = now
+			unlocked[policyDescriptor] = true
+			continue
+		}
+		if now.Sub(lastUsed) < tracker.timeout {
+			unlocked[policyDescriptor] = true
+			continue
+		}
+		result, err := lockPolicyKey(tracker.ctx, policyDescriptor, tracker.allUsers)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+		if !result.FullyLocked() && needsLocking(result.Status, tracker.allUsers) {
+			unlocked[policyDescriptor] = true
+		}
+	}
+	// Forget the policies which have been locked, by us or anyone else.
+	for policyDescriptor := range tracker.lastUsed {
+		if !unlocked[policyDescriptor] {
+			delete(tracker.lastUsed, policyDescriptor)
+		}
+	}
+	return results, nil
+}
@@ -0,0 +1,73 @@
+/*
+ * idle_test.go - tests for locking policies which haven't been used for a while
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package actions
+
+import (
+	"testing"
+	"time"
+)
+
+// Tests that an unlocked policy is only locked once it hasn't been used for the
+// timeout, counting from when it was first seen unlocked or last used.
+func TestIdleTracker(t *testing.T) {
+	pro, pol, err := makeBoth()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanupProtector(pro)
+	defer cleanupPolicy(pol)
+	if err = pol.Provision(); err != nil {
+		t.Skip(err)
+	}
+	defer pol.Deprovision(false)
+
+	const timeout = time.Minute
+	tracker, err := NewIdleTracker(testContext, timeout, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	// Uses of policies which aren't tracked yet don't count.
+	tracker.MarkUsed(pol.Descriptor(), start.Add(-time.Hour))
+	lockIdle := func(now time.Time) []*LockResult {
+		results, err := tracker.LockIdle(now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return results
+	}
+
+	if results := lockIdle(start); len(results) != 0 {
+		t.Fatalf("policy locked when first seen: %+v", results)
+	}
+	tracker.MarkUsed(pol.Descriptor(), start.Add(timeout/2))
+	if results := lockIdle(start.Add(timeout)); len(results) != 0 {
+		t.Fatalf("policy locked before being idle for the timeout: %+v", results)
+	}
+	results := lockIdle(start.Add(timeout/2 + timeout))
+	if len(results) != 1 || results[0].PolicyDescriptor != pol.Descriptor() {
+		t.Fatalf("expected the idle policy to be locked, got %+v", results)
+	}
+	if !results[0].FullyLocked() || pol.IsProvisionedByTargetUser() {
+		t.Errorf("idle policy wasn't locked: %+v", results[0])
+	}
+	if len(tracker.lastUsed) != 0 {
+		t.Errorf("locked policy is still tracked: %v", tracker.lastUsed)
+	}
+}
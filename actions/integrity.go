@@ -0,0 +1,67 @@
+/*
+ * integrity.go - Detecting changes made to protectors and policies by someone
+ * without their keys
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package actions
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+
+	"github.com/google/fscrypt/crypto"
+	"github.com/google/fscrypt/filesystem"
+	"github.com/google/fscrypt/metadata"
+)
+
+// ErrMetadataTampered indicates that the metadata of a protector or policy
+// doesn't match its HMAC, so it was either corrupted or changed by someone who
+// didn't have its key.
+type ErrMetadataTampered struct {
+	Kind       string // "protector" or "policy"
+	Descriptor string
+	Mount      *filesystem.Mount
+}
+
+func (err *ErrMetadataTampered) Error() string {
+	return fmt.Sprintf(`the metadata of %s %s on %q failed its integrity
+	check. It was either corrupted, or modified by someone who didn't have
+	the %s's key.`, err.Kind, err.Descriptor, err.Mount.Path, err.Kind)
+}
+
+// checkMetadataIntegrity checks the HMAC of a protector or policy with the key
+// which was just unwrapped from it.
+func checkMetadataIntegrity(key *crypto.Key, data metadata.AuthenticatedMetadata,
+	kind, descriptor string, mnt *filesystem.Mount) error {
+	err := crypto.CheckMetadataHMAC(key, data)
+	if errors.Cause(err) == crypto.ErrMetadataHMAC {
+		return &ErrMetadataTampered{kind, descriptor, mnt}
+	}
+	return err
+}
+
+// checkDowngraded turns the error for a protector or policy whose metadata was
+// read without the HMAC its schema version requires, or with a schema version
+// older than the rest of the filesystem's metadata, into an
+// ErrMetadataTampered, as it must have been changed to get around the HMAC.
+func checkDowngraded(err error, kind, descriptor string, mnt *filesystem.Mount) error {
+	if _, ok := errors.Cause(err).(*filesystem.ErrMetadataDowngraded); ok {
+		return &ErrMetadataTampered{kind, descriptor, mnt}
+	}
+	return err
+}
@@ -0,0 +1,165 @@
+/*
+ * integrity_test.go - tests for detecting changes to protectors and policies
+ * made without their keys
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package actions
+
+import (
+	"os"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/google/fscrypt/metadata"
+)
+
+func firstOption(string, []*ProtectorOption) (int, error) { return 0, nil }
+
+// Tests that a protector whose metadata was changed on disk can't be unlocked.
+func TestTamperedProtector(t *testing.T) {
+	pro, pol, err := makeBoth()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanupProtector(pro)
+	defer cleanupPolicy(pol)
+
+	data, err := testContext.Mount.GetRegularProtector(pro.Descriptor(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data.MetadataHmac) == 0 {
+		t.Fatal("new protector has no metadata HMAC")
+	}
+	data.Uid = 1234
+	if err = testContext.Mount.AddProtector(data, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	tampered, err := GetProtector(testContext, pro.Descriptor())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tampered.Unlock(goodCallback)
+	if _, ok := err.(*ErrMetadataTampered); !ok {
+		t.Errorf("unlocking tampered protector gave %v, expected ErrMetadataTampered", err)
+	}
+	tampered.Lock()
+}
+
+// Tests that a policy whose options were changed on disk can't be unlocked,
+// and that policies without an HMAC get one when they are next written.
+func TestTamperedPolicy(t *testing.T) {
+	pro, pol, err := makeBoth()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanupProtector(pro)
+	defer cleanupPolicy(pol)
+
+	data, err := testContext.Mount.GetPolicy(pol.Descriptor(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	original := data.MetadataHmac
+	if len(original) == 0 {
+		t.Fatal("new policy has no metadata HMAC")
+	}
+	data.Options.Padding = 4
+	if data.Options.Padding == pol.data.Options.Padding {
+		data.Options.Padding = 8
+	}
+	if err = testContext.Mount.AddPolicy(data, nil); err != nil {
+		t.Fatal(err)
+	}
+	tampered, err := GetPolicy(testContext, pol.Descriptor())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tampered.Unlock(firstOption, goodCallback)
+	if _, ok := err.(*ErrMetadataTampered); !ok {
+		t.Errorf("unlocking tampered policy gave %v, expected ErrMetadataTampered", err)
+	}
+
+	// Policies written by older versions have no HMAC. They are only
+	// accepted on filesystems set up by older versions, which have no
+	// schema floor until all their metadata has been upgraded.
+	if err = os.Remove(testContext.Mount.SchemaFloorPath()); err != nil {
+		t.Fatal(err)
+	}
+	data.Options.Padding = pol.data.Options.Padding
+	data.MetadataHmac = nil
+	if err = testContext.Mount.AddPolicy(data, nil); err != nil {
+		t.Fatal(err)
+	}
+	legacy, err := GetPolicy(testContext, pol.Descriptor())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = legacy.Unlock(firstOption, goodCallback); err != nil {
+		t.Fatal(err)
+	}
+	defer legacy.Lock()
+	if err = legacy.commitData(); err != nil {
+		t.Fatal(err)
+	}
+	if data, err = testContext.Mount.GetPolicy(pol.Descriptor(), nil); err != nil {
+		t.Fatal(err)
+	}
+	if string(data.MetadataHmac) != string(original) {
+		t.Error("rewriting an unlocked policy didn't restore its HMAC")
+	}
+	if data.SchemaVersion != metadata.SchemaVersion {
+		t.Errorf("policy with a restored HMAC has schema version %d", data.SchemaVersion)
+	}
+	if _, err = os.Stat(testContext.Mount.SchemaFloorPath()); err != nil {
+		t.Errorf("schema floor wasn't raised once all the metadata was upgraded: %v", err)
+	}
+}
+
+// Tests that a policy whose HMAC was stripped is rejected when it's read, even
+// if its schema version was lowered to one which predates the HMAC.
+func TestStrippedHMAC(t *testing.T) {
+	pro, pol, err := makeBoth()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanupProtector(pro)
+	defer cleanupPolicy(pol)
+
+	data, err := testContext.Mount.GetPolicy(pol.Descriptor(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data.MetadataHmac = nil
+	for _, version := range []int64{metadata.SchemaVersion, metadata.HMACSchemaVersion - 1} {
+		data.SchemaVersion = version
+		raw, err := proto.Marshal(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = os.WriteFile(testContext.Mount.PolicyPath(pol.Descriptor()), raw, 0600); err != nil {
+			t.Fatal(err)
+		}
+		_, err = GetPolicy(testContext, pol.Descriptor())
+		if _, ok := err.(*ErrMetadataTampered); !ok {
+			t.Errorf("reading policy without an HMAC at schema version %d gave %v, expected ErrMetadataTampered",
+				version, err)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+/*
+ * keystore.go - unlocking raw_key protectors with key files from a keystore
+ * directory (such as a mounted hardware token)
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package actions
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+
+	"github.com/google/fscrypt/crypto"
+	"github.com/google/fscrypt/metadata"
+	"github.com/google/fscrypt/util"
+)
+
+// ErrBadKeystoreKey indicates that a key file in the keystore directory exists
+// but can't be used as a raw key.
+type ErrBadKeystoreKey struct {
+	Path            string
+	UnderlyingError error
+}
+
+func (err *ErrBadKeystoreKey) Error() string {
+	return fmt.Sprintf("invalid keystore key file %q: %v", err.Path, err.UnderlyingError)
+}
+
+// keystoreKeyPath returns the path to the key file for the raw_key protector
+// described by info in the keystore_dir from the config file, or "" if there
+// is no keystore or it doesn't contain a key file for this protector.
+func (ctx *Context) keystoreKeyPath(info ProtectorInfo) string {
+	dir := ctx.Config.GetKeystoreDir()
+	if dir == "" || info.Source() != metadata.SourceType_raw_key {
+		return ""
+	}
+	path := filepath.Join(dir, info.Descriptor()+".key")
+	if _, err := os.Stat(path); err != nil {
+		return ""
+	}
+	return path
+}
+
+// readKeystoreKey reads a raw key from a keystore key file, which must be a
+// regular file containing exactly metadata.InternalKeyLen bytes.
+func readKeystoreKey(path string) (*crypto.Key, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, &ErrBadKeystoreKey{path, errors.New("not a regular file")}
+	}
+	if err = util.CheckValidLength(metadata.InternalKeyLen, int(info.Size())); err != nil {
+		return nil, &ErrBadKeystoreKey{path, err}
+	}
+	return crypto.NewFixedLengthKeyFromReader(file, metadata.InternalKeyLen)
+}
+
+// withKeystore returns a KeyFunc which gets the keys for raw_key protectors from
+// the keystore, if possible. If the protector isn't in the keystore, or its key
+// file turns out to be unusable or incorrect, keyFn is used instead.
+func (ctx *Context) withKeystore(keyFn KeyFunc) KeyFunc {
+	triedKeystore := false
+	return func(info ProtectorInfo, retry bool) (*crypto.Key, error) {
+		if triedKeystore {
+			// The keystore key was wrong, so don't tell keyFn that
+			// this is a retry on its first call.
+			triedKeystore = false
+			retry = false
+		} else if path := ctx.keystoreKeyPath(info); path != "" && !retry {
+			key, err := readKeystoreKey(path)
+			if err == nil {
+				util.Debugf("using keystore key %q for protector %s",
+					path, info.Descriptor())
+				triedKeystore = true
+				return key, nil
+			}
+			util.Debug(err)
+		}
+		return keyFn(info, retry)
+	}
+}
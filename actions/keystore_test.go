@@ -0,0 +1,85 @@
+/*
+ * keystore_test.go - tests for unlocking raw_key protectors from a keystore
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package actions
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/fscrypt/crypto"
+	"github.com/google/fscrypt/metadata"
+)
+
+var testRawKey = bytes.Repeat([]byte{0x42}, metadata.InternalKeyLen)
+
+func rawKeyCallback(info ProtectorInfo, retry bool) (*crypto.Key, error) {
+	return crypto.NewFixedLengthKeyFromReader(bytes.NewReader(testRawKey), len(testRawKey))
+}
+
+// Tests that raw_key protectors are unlocked with the key file from the
+// keystore when there is one, and that a bad key file is ignored.
+func TestKeystoreUnlock(t *testing.T) {
+	oldSource := testContext.Config.Source
+	testContext.Config.Source = metadata.SourceType_raw_key
+	testContext.Config.KeystoreDir = t.TempDir()
+	defer func() {
+		testContext.Config.Source = oldSource
+		testContext.Config.KeystoreDir = ""
+	}()
+
+	p, err := CreateProtector(testContext, testProtectorName, rawKeyCallback, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Destroy()
+	p.Lock()
+
+	// No key file, so the callback is used.
+	if err = p.Unlock(badCallback); err != errCallback {
+		t.Fatalf("expected callback error, got %v", err)
+	}
+
+	keyPath := filepath.Join(testContext.Config.KeystoreDir, p.Descriptor()+".key")
+	if err = os.WriteFile(keyPath, testRawKey, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = p.Unlock(badCallback); err != nil {
+		t.Fatal(err)
+	}
+	p.Lock()
+
+	// A wrong key in the keystore falls back to the callback.
+	if err = os.WriteFile(keyPath, bytes.Repeat([]byte{1}, metadata.InternalKeyLen), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = p.Unlock(rawKeyCallback); err != nil {
+		t.Fatal(err)
+	}
+	p.Lock()
+
+	// So does a key file of the wrong length.
+	if err = os.WriteFile(keyPath, []byte("short"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = p.Unlock(badCallback); err != errCallback {
+		t.Errorf("expected callback error, got %v", err)
+	}
+}
@@ -0,0 +1,118 @@
+/*
+ * kms.go - Protectors whose wrapping key is encrypted by a key in a cloud key
+ * management service (AWS KMS, GCP Cloud KMS, or Azure Key Vault)
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package actions
+
+import (
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/google/fscrypt/crypto"
+	"github.com/google/fscrypt/metadata"
+	"github.com/google/fscrypt/util"
+)
+
+// Cloud KMS errors
+var (
+	ErrNoKMSClient = errors.New("cloud KMS keys are not supported by this program")
+	ErrNoKMSKey    = errors.New(`no cloud KMS key is set in the config file's "kms_key"`)
+	ErrKMSWrongKey = errors.New("the key decrypted by the cloud KMS is incorrect")
+)
+
+// KMSClient encrypts and decrypts keys with a cloud KMS. The wrapping key of a
+// kms protector is a random key which is encrypted with a KMS key when the
+// protector is created, and decrypted by the KMS each time it is used. This
+// lets servers unlock directories with their instance credentials, and access
+// to all of them can be revoked centrally by disabling the KMS key or the
+// credentials' permission to use it.
+type KMSClient interface {
+	// Encrypt encrypts key with the KMS key called keyName.
+	Encrypt(keyName string, key *crypto.Key) ([]byte, error)
+	// Decrypt decrypts ciphertext, which was encrypted with the KMS key
+	// called keyName.
+	Decrypt(keyName string, ciphertext []byte) (*crypto.Key, error)
+}
+
+var (
+	kmsClient      KMSClient
+	kmsClientMutex sync.RWMutex
+)
+
+// SetKMSClient makes kms protectors use client from now on. Passing nil
+// disables kms protectors, which is the default.
+func SetKMSClient(client KMSClient) {
+	kmsClientMutex.Lock()
+	defer kmsClientMutex.Unlock()
+	kmsClient = client
+}
+
+func getKMSClient() (KMSClient, error) {
+	kmsClientMutex.RLock()
+	defer kmsClientMutex.RUnlock()
+	if kmsClient == nil {
+		return nil, ErrNoKMSClient
+	}
+	return kmsClient, nil
+}
+
+// wrapKMSWrappingKey encrypts a new random wrapping key for a kms protector
+// with the KMS key set in config, and stores it in data.
+func wrapKMSWrappingKey(config *metadata.Config, data *metadata.ProtectorData) error {
+	client, err := getKMSClient()
+	if err != nil {
+		return err
+	}
+	if config.GetKmsKey() == "" {
+		return ErrNoKMSKey
+	}
+	key, err := crypto.NewRandomKey(metadata.InternalKeyLen)
+	if err != nil {
+		return err
+	}
+	defer key.Wipe()
+	if data.KmsWrappedKey, err = client.Encrypt(config.GetKmsKey(), key); err != nil {
+		return err
+	}
+	data.KmsKey = config.GetKmsKey()
+	return nil
+}
+
+// getKMSWrappingKey gets the wrapping key of a kms protector from the KMS.
+func getKMSWrappingKey(info ProtectorInfo, retry bool) (*crypto.Key, error) {
+	// The KMS always decrypts the same key, so a wrong key can't be fixed
+	// by asking it again.
+	if retry {
+		return nil, ErrKMSWrongKey
+	}
+	client, err := getKMSClient()
+	if err != nil {
+		return nil, err
+	}
+	util.Debugf("decrypting key of protector %s with %s", info.Descriptor(), info.KMSKey())
+	key, err := client.Decrypt(info.KMSKey(), info.data.KmsWrappedKey)
+	if err != nil {
+		return nil, err
+	}
+	if err = util.CheckValidLength(metadata.InternalKeyLen, key.Len()); err != nil {
+		key.Wipe()
+		return nil, errors.Wrap(err, "KMS decrypted key")
+	}
+	return key, nil
+}
@@ -0,0 +1,92 @@
+/*
+ * kms_test.go - tests for protectors using keys in a cloud KMS
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package actions
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/pkg/errors"
+
+	"github.com/google/fscrypt/crypto"
+	"github.com/google/fscrypt/metadata"
+)
+
+const testKMSKey = "arn:aws:kms:us-east-1:111122223333:key/1234abcd-12ab-34cd-56ef-1234567890ab"
+
+var errKMSRevoked = errors.New("access to the KMS key was revoked")
+
+// fakeKMS "encrypts" keys by prefixing them with the name of the KMS key, and
+// refuses to decrypt them once revoked.
+type fakeKMS struct {
+	revoked bool
+}
+
+func (kms *fakeKMS) Encrypt(keyName string, key *crypto.Key) ([]byte, error) {
+	return append([]byte(keyName), key.Data()...), nil
+}
+
+func (kms *fakeKMS) Decrypt(keyName string, ciphertext []byte) (*crypto.Key, error) {
+	if kms.revoked {
+		return nil, errKMSRevoked
+	}
+	if !bytes.HasPrefix(ciphertext, []byte(keyName)) {
+		return nil, errors.New("wrong KMS key")
+	}
+	data := ciphertext[len(keyName):]
+	return crypto.NewFixedLengthKeyFromReader(bytes.NewReader(data), len(data))
+}
+
+func useKMSSource(t *testing.T, client KMSClient) {
+	useProtectorSource(t, metadata.SourceType_kms, func(installed bool) {
+		if installed {
+			SetKMSClient(client)
+		} else {
+			SetKMSClient(nil)
+		}
+	})
+	testContext.Config.KmsKey = testKMSKey
+}
+
+// Tests that a kms protector is unlocked by the KMS without using the callback,
+// and not once access to the KMS key is revoked.
+func TestKMSProtector(t *testing.T) {
+	kms := &fakeKMS{}
+	useKMSSource(t, kms)
+	testProtectorSource(t, testProtectorName, badCallback,
+		func(data *metadata.ProtectorData) bool {
+			return data.KmsKey == testKMSKey && len(data.KmsWrappedKey) != 0
+		},
+		func() { kms.revoked = true }, errKMSRevoked)
+}
+
+// Tests that a KMS key and client are needed for new kms protectors.
+func TestKMSProtectorErrors(t *testing.T) {
+	useKMSSource(t, &fakeKMS{})
+	testContext.Config.KmsKey = ""
+	if _, err := CreateProtector(testContext, testProtectorName, badCallback, nil); err != ErrNoKMSKey {
+		t.Errorf("expected %v, got %v", ErrNoKMSKey, err)
+	}
+
+	testContext.Config.KmsKey = testKMSKey
+	SetKMSClient(nil)
+	if _, err := CreateProtector(testContext, testProtectorName, badCallback, nil); err != ErrNoKMSClient {
+		t.Errorf("expected %v, got %v", ErrNoKMSClient, err)
+	}
+}
@@ -0,0 +1,128 @@
+/*
+ * metrics.go - Reporting key lifecycle events to an observer, e.g. for
+ * exporting counters to a monitoring system.
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package actions
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/google/fscrypt/filesystem"
+)
+
+// Operation is a kind of key lifecycle event reported to an Observer.
+type Operation int
+
+// The operations reported to an Observer.
+const (
+	// OperationUnlockPolicy is unwrapping a policy's key (Policy.Unlock or
+	// Policy.UnlockWithProtector).
+	OperationUnlockPolicy Operation = iota
+	// OperationUnlockProtector is unwrapping a protector's key on its own
+	// (Protector.Unlock).
+	OperationUnlockProtector
+	// OperationWrongKey is an incorrect passphrase or raw key being given
+	// for a protector. It is reported for every incorrect attempt.
+	OperationWrongKey
+	// OperationProvision is adding a policy's key to the keyring, which
+	// unlocks the directories using the policy.
+	OperationProvision
+	// OperationDeprovision is removing a policy's key from the keyring,
+	// which locks the directories using the policy.
+	OperationDeprovision
+)
+
+func (op Operation) String() string {
+	switch op {
+	case OperationUnlockPolicy:
+		return "unlock_policy"
+	case OperationUnlockProtector:
+		return "unlock_protector"
+	case OperationWrongKey:
+		return "wrong_key"
+	case OperationProvision:
+		return "provision"
+	case OperationDeprovision:
+		return "deprovision"
+	default:
+		return fmt.Sprintf("Operation(%d)", int(op))
+	}
+}
+
+// MetricsEvent describes one key lifecycle event. It deliberately contains no
+// keys, passphrases, or error messages, only what the event was about.
+type MetricsEvent struct {
+	Operation Operation
+	// Mountpoint is the path of the filesystem holding the metadata the
+	// event is about.
+	Mountpoint string
+	// PolicyDescriptor is empty for events not about a policy.
+	PolicyDescriptor string
+	// ProtectorDescriptor is empty for events not about a single protector.
+	ProtectorDescriptor string
+	// Succeeded is false if the operation failed. It is always false for
+	// OperationWrongKey.
+	Succeeded bool
+}
+
+// Observer receives the key lifecycle events of this package, e.g. to count
+// them. Observe is called synchronously from the operation, possibly from
+// several goroutines at once, so it should return quickly.
+type Observer interface {
+	Observe(event MetricsEvent)
+}
+
+type noopObserver struct{}
+
+func (noopObserver) Observe(MetricsEvent) {}
+
+var (
+	metricsObserver      Observer = noopObserver{}
+	metricsObserverMutex sync.RWMutex
+)
+
+// SetMetricsObserver makes observer receive the key lifecycle events of this
+// package from now on. Passing nil stops reporting the events, which is the
+// default.
+func SetMetricsObserver(observer Observer) {
+	if observer == nil {
+		observer = noopObserver{}
+	}
+	metricsObserverMutex.Lock()
+	defer metricsObserverMutex.Unlock()
+	metricsObserver = observer
+}
+
+// reportEvent passes an event about metadata on mnt to the observer.
+func reportEvent(op Operation, mnt *filesystem.Mount, policyDescriptor,
+	protectorDescriptor string, succeeded bool) {
+	event := MetricsEvent{
+		Operation:           op,
+		PolicyDescriptor:    policyDescriptor,
+		ProtectorDescriptor: protectorDescriptor,
+		Succeeded:           succeeded,
+	}
+	if mnt != nil {
+		event.Mountpoint = mnt.Path
+	}
+	metricsObserverMutex.RLock()
+	observer := metricsObserver
+	metricsObserverMutex.RUnlock()
+	observer.Observe(event)
+}
@@ -0,0 +1,97 @@
+/*
+ * metrics_test.go - Tests for reporting key lifecycle events.
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package actions
+
+import (
+	"bytes"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/google/fscrypt/crypto"
+)
+
+type recordingObserver struct {
+	mutex  sync.Mutex
+	events []MetricsEvent
+}
+
+func (o *recordingObserver) Observe(event MetricsEvent) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.events = append(o.events, event)
+}
+
+// Tests that unlocking a policy with a wrong and then a correct passphrase, and
+// failing to unlock it, are reported.
+func TestMetricsObserver(t *testing.T) {
+	pro, pol, err := makeBoth()
+	defer cleanupProtector(pro)
+	defer cleanupPolicy(pol)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = pol.Lock(); err != nil {
+		t.Fatal(err)
+	}
+
+	observer := &recordingObserver{}
+	SetMetricsObserver(observer)
+	defer SetMetricsObserver(nil)
+
+	optionFn := func(policyDescriptor string, options []*ProtectorOption) (int, error) {
+		return 0, nil
+	}
+	wrongOnceCallback := func(info ProtectorInfo, retry bool) (*crypto.Key, error) {
+		if !retry {
+			wrong := []byte("wrong passphrase")
+			return crypto.NewFixedLengthKeyFromReader(bytes.NewReader(wrong), len(wrong))
+		}
+		return goodCallback(info, retry)
+	}
+	if err = pol.Unlock(optionFn, wrongOnceCallback); err != nil {
+		t.Fatal(err)
+	}
+	if err = pol.Lock(); err != nil {
+		t.Fatal(err)
+	}
+	if err = pol.Unlock(optionFn, badCallback); err != errCallback {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	mountpoint := testContext.Mount.Path
+	expected := []MetricsEvent{
+		{OperationWrongKey, mountpoint, "", pro.Descriptor(), false},
+		{OperationUnlockPolicy, mountpoint, pol.Descriptor(), "", true},
+		{OperationUnlockPolicy, mountpoint, pol.Descriptor(), "", false},
+	}
+	if !reflect.DeepEqual(observer.events, expected) {
+		t.Errorf("reported events %+v, expected %+v", observer.events, expected)
+	}
+
+	// Nothing is reported once the observer is removed.
+	SetMetricsObserver(nil)
+	if err = pol.Unlock(optionFn, goodCallback); err != nil {
+		t.Fatal(err)
+	}
+	if len(observer.events) != len(expected) {
+		t.Errorf("events were reported after removing the observer: %+v",
+			observer.events[len(expected):])
+	}
+}
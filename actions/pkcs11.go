@@ -0,0 +1,224 @@
+/*
+ * pkcs11.go - Protectors whose wrapping key is protected by a key pair on a
+ * PKCS#11 token, such as a smartcard or HSM
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package actions
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"fmt"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/google/fscrypt/crypto"
+	"github.com/google/fscrypt/metadata"
+	"github.com/google/fscrypt/util"
+)
+
+// PKCS#11 errors
+var (
+	ErrNoPKCS11Token  = errors.New("PKCS#11 tokens are not supported by this program")
+	ErrNoPKCS11Module = errors.New(`no PKCS#11 module is set in the config file's "pkcs11_module"`)
+	ErrIncorrectPIN   = errors.New("incorrect PIN")
+)
+
+// ErrPKCS11KeyType indicates that the key pair on a PKCS#11 token is neither
+// an RSA nor an EC key pair.
+type ErrPKCS11KeyType struct {
+	KeyID []byte
+}
+
+func (err *ErrPKCS11KeyType) Error() string {
+	return fmt.Sprintf("PKCS#11 key %x is neither an RSA nor an EC key", err.KeyID)
+}
+
+// PKCS11Key is a key pair on a PKCS#11 token, as stored in the metadata of a
+// pkcs11 protector.
+type PKCS11Key struct {
+	// Module is the path of the PKCS#11 module (shared library) which
+	// accesses the token, and Slot the token's slot, or "" for the first
+	// slot with a token.
+	Module, Slot string
+	// ID is the CKA_ID of the key pair.
+	ID []byte
+	// PublicKey is the DER-encoded (PKIX) public key of the key pair.
+	PublicKey []byte
+}
+
+// PKCS11Token uses key pairs on PKCS#11 tokens. The wrapping key of a pkcs11
+// protector is a random key encrypted with the RSA public key of a key pair on
+// the token, or derived from an ECDH shared secret of the EC key pair and an
+// ephemeral key pair, so that the token's private key (and its PIN) is needed
+// to get it. The PIN is obtained with the KeyFunc, like a passphrase.
+type PKCS11Token interface {
+	// FindKey returns the key pair with the given ID (in hex) on the token
+	// in slot of module, or the first key pair on it if keyID is empty.
+	FindKey(module, slot, keyID string) (*PKCS11Key, error)
+	// Decrypt decrypts data with the RSA private key of the protector's
+	// key pair, using RSA-OAEP with SHA-256. If the PIN is incorrect,
+	// ErrIncorrectPIN is returned.
+	Decrypt(info ProtectorInfo, pin *crypto.Key, data []byte) (*crypto.Key, error)
+	// Derive returns the ECDH shared secret of the EC private key of the
+	// protector's key pair and peer, a DER-encoded (PKIX) public key. If
+	// the PIN is incorrect, ErrIncorrectPIN is returned.
+	Derive(info ProtectorInfo, pin *crypto.Key, peer []byte) (*crypto.Key, error)
+}
+
+var (
+	pkcs11Token      PKCS11Token
+	pkcs11TokenMutex sync.RWMutex
+)
+
+// SetPKCS11Token makes pkcs11 protectors use token from now on. Passing nil
+// disables pkcs11 protectors, which is the default.
+func SetPKCS11Token(token PKCS11Token) {
+	pkcs11TokenMutex.Lock()
+	defer pkcs11TokenMutex.Unlock()
+	pkcs11Token = token
+}
+
+func getPKCS11Token() (PKCS11Token, error) {
+	pkcs11TokenMutex.RLock()
+	defer pkcs11TokenMutex.RUnlock()
+	if pkcs11Token == nil {
+		return nil, ErrNoPKCS11Token
+	}
+	return pkcs11Token, nil
+}
+
+// wrapPKCS11WrappingKey finds the key pair for a new pkcs11 protector as set in
+// config, and stores it in data along with a new wrapping key which only the
+// key pair's private key can recover.
+func wrapPKCS11WrappingKey(config *metadata.Config, data *metadata.ProtectorData) error {
+	token, err := getPKCS11Token()
+	if err != nil {
+		return err
+	}
+	if config.GetPkcs11Module() == "" {
+		return ErrNoPKCS11Module
+	}
+	key, err := token.FindKey(config.GetPkcs11Module(), config.GetPkcs11Slot(),
+		config.GetPkcs11KeyId())
+	if err != nil {
+		return err
+	}
+	publicKey, err := x509.ParsePKIXPublicKey(key.PublicKey)
+	if err != nil {
+		return errors.Wrap(err, "PKCS#11 public key")
+	}
+
+	switch publicKey := publicKey.(type) {
+	case *rsa.PublicKey:
+		wrappingKey, err := crypto.NewRandomKey(metadata.InternalKeyLen)
+		if err != nil {
+			return err
+		}
+		defer wrappingKey.Wipe()
+		data.Pkcs11WrappedKey, err = rsa.EncryptOAEP(sha256.New(), rand.Reader,
+			publicKey, wrappingKey.Data(), nil)
+		if err != nil {
+			return err
+		}
+	case *ecdsa.PublicKey:
+		// The ephemeral private key is discarded; the shared secret can
+		// then only be computed again with the token's private key.
+		_, x, y, err := elliptic.GenerateKey(publicKey.Curve, rand.Reader)
+		if err != nil {
+			return err
+		}
+		data.Pkcs11WrappedKey, err = x509.MarshalPKIXPublicKey(
+			&ecdsa.PublicKey{Curve: publicKey.Curve, X: x, Y: y})
+		if err != nil {
+			return err
+		}
+	default:
+		return &ErrPKCS11KeyType{key.ID}
+	}
+	data.Pkcs11Module = key.Module
+	data.Pkcs11Slot = key.Slot
+	data.Pkcs11KeyId = key.ID
+	data.Pkcs11PublicKey = key.PublicKey
+	return nil
+}
+
+// getPKCS11WrappingKey gets the wrapping key of a pkcs11 protector with the
+// private key on the token, getting the PIN from keyFn. An incorrect PIN is
+// asked for again.
+func getPKCS11WrappingKey(info ProtectorInfo, keyFn KeyFunc, retry bool) (*crypto.Key, error) {
+	token, err := getPKCS11Token()
+	if err != nil {
+		return nil, err
+	}
+	publicKey, err := x509.ParsePKIXPublicKey(info.data.Pkcs11PublicKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "PKCS#11 public key")
+	}
+	for {
+		pin, err := keyFn(info, retry)
+		if err != nil {
+			return nil, err
+		}
+		util.Debugf("using PKCS#11 key %x for protector %s", info.data.Pkcs11KeyId,
+			info.Descriptor())
+		var key *crypto.Key
+		switch publicKey.(type) {
+		case *rsa.PublicKey:
+			key, err = token.Decrypt(info, pin, info.data.Pkcs11WrappedKey)
+		case *ecdsa.PublicKey:
+			var secret *crypto.Key
+			if secret, err = token.Derive(info, pin, info.data.Pkcs11WrappedKey); err == nil {
+				key, err = deriveECDHWrappingKey(secret)
+				secret.Wipe()
+			}
+		default:
+			err = &ErrPKCS11KeyType{info.data.Pkcs11KeyId}
+		}
+		pin.Wipe()
+
+		if err == ErrIncorrectPIN {
+			retry = true
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err = util.CheckValidLength(metadata.InternalKeyLen, key.Len()); err != nil {
+			key.Wipe()
+			return nil, errors.Wrap(err, "PKCS#11 wrapping key")
+		}
+		return key, nil
+	}
+}
+
+// deriveECDHWrappingKey derives a wrapping key from an ECDH shared secret.
+func deriveECDHWrappingKey(secret *crypto.Key) (*crypto.Key, error) {
+	hash := sha256.Sum256(secret.Data())
+	defer func() {
+		for i := range hash {
+			hash[i] = 0
+		}
+	}()
+	return crypto.NewFixedLengthKeyFromReader(bytes.NewReader(hash[:]), len(hash))
+}
@@ -0,0 +1,148 @@
+/*
+ * pkcs11_test.go - tests for protectors using key pairs on PKCS#11 tokens
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package actions
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"testing"
+
+	"github.com/google/fscrypt/crypto"
+	"github.com/google/fscrypt/metadata"
+)
+
+var testPIN = []byte("123456")
+
+// fakeToken does the private key operations of a PKCS#11 token in software.
+type fakeToken struct {
+	privateKey interface{}
+	pinTries   int
+}
+
+func (token *fakeToken) FindKey(module, slot, keyID string) (*PKCS11Key, error) {
+	var publicKey interface{}
+	switch privateKey := token.privateKey.(type) {
+	case *rsa.PrivateKey:
+		publicKey = &privateKey.PublicKey
+	case *ecdsa.PrivateKey:
+		publicKey = &privateKey.PublicKey
+	}
+	der, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	return &PKCS11Key{Module: module, Slot: slot, ID: []byte{1}, PublicKey: der}, nil
+}
+
+func (token *fakeToken) checkPIN(pin *crypto.Key) error {
+	token.pinTries++
+	if !bytes.Equal(pin.Data(), testPIN) {
+		return ErrIncorrectPIN
+	}
+	return nil
+}
+
+func (token *fakeToken) Decrypt(info ProtectorInfo, pin *crypto.Key, data []byte) (*crypto.Key, error) {
+	if err := token.checkPIN(pin); err != nil {
+		return nil, err
+	}
+	output, err := rsa.DecryptOAEP(sha256.New(), rand.Reader,
+		token.privateKey.(*rsa.PrivateKey), data, nil)
+	if err != nil {
+		return nil, err
+	}
+	return crypto.NewFixedLengthKeyFromReader(bytes.NewReader(output), len(output))
+}
+
+func (token *fakeToken) Derive(info ProtectorInfo, pin *crypto.Key, peer []byte) (*crypto.Key, error) {
+	if err := token.checkPIN(pin); err != nil {
+		return nil, err
+	}
+	peerKey, err := x509.ParsePKIXPublicKey(peer)
+	if err != nil {
+		return nil, err
+	}
+	privateKey := token.privateKey.(*ecdsa.PrivateKey)
+	x, _ := privateKey.Curve.ScalarMult(peerKey.(*ecdsa.PublicKey).X,
+		peerKey.(*ecdsa.PublicKey).Y, privateKey.D.Bytes())
+	secret := make([]byte, (privateKey.Curve.Params().BitSize+7)/8)
+	x.FillBytes(secret)
+	return crypto.NewFixedLengthKeyFromReader(bytes.NewReader(secret), len(secret))
+}
+
+// pinCallback returns a wrong PIN the first time, then the right one.
+func pinCallback(info ProtectorInfo, retry bool) (*crypto.Key, error) {
+	pin := testPIN
+	if !retry {
+		pin = []byte("000000")
+	}
+	return crypto.NewFixedLengthKeyFromReader(bytes.NewReader(pin), len(pin))
+}
+
+func usePKCS11Source(t *testing.T, token PKCS11Token) {
+	useProtectorSource(t, metadata.SourceType_pkcs11, func(installed bool) {
+		if installed {
+			SetPKCS11Token(token)
+		} else {
+			SetPKCS11Token(nil)
+		}
+	})
+	testContext.Config.Pkcs11Module = "/usr/lib/fake-pkcs11.so"
+}
+
+// Tests that pkcs11 protectors with RSA and EC key pairs can be unlocked with
+// the token, after an incorrect PIN is asked for again.
+func TestPKCS11Protector(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, privateKey := range map[string]interface{}{"RSA": rsaKey, "EC": ecKey} {
+		t.Run(name, func(t *testing.T) {
+			token := &fakeToken{privateKey: privateKey}
+			usePKCS11Source(t, token)
+			testProtectorSource(t, testProtectorName, pinCallback,
+				func(data *metadata.ProtectorData) bool {
+					return data.Pkcs11Module == "/usr/lib/fake-pkcs11.so" && len(data.Pkcs11WrappedKey) != 0
+				}, nil, nil)
+			// Both creating and unlocking try the wrong PIN first.
+			if token.pinTries != 4 {
+				t.Errorf("PIN was tried %d times, expected 4", token.pinTries)
+			}
+		})
+	}
+}
+
+// Tests that a module must be configured for new pkcs11 protectors.
+func TestPKCS11ProtectorNoModule(t *testing.T) {
+	usePKCS11Source(t, &fakeToken{})
+	testContext.Config.Pkcs11Module = ""
+	if _, err := CreateProtector(testContext, testProtectorName, pinCallback, nil); err != ErrNoPKCS11Module {
+		t.Errorf("expected %v, got %v", ErrNoPKCS11Module, err)
+	}
+}
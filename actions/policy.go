@@ -21,7 +21,6 @@ package actions
 
 import (
 	"fmt"
-	"log"
 	"os"
 	"os/user"
 
@@ -66,6 +65,18 @@ func (err *ErrAlreadyProtected) Error() string {
 		err.Policy.Descriptor(), err.Protector.Descriptor())
 }
 
+// ErrBelowThreshold indicates that a protector can't be removed from a policy,
+// since too few protectors would be left to unlock it.
+type ErrBelowThreshold struct {
+	Policy *Policy
+}
+
+func (err *ErrBelowThreshold) Error() string {
+	return fmt.Sprintf(`cannot remove a protector from policy %s, which
+	needs %d of its %d protectors to unlock.`, err.Policy.Descriptor(),
+		err.Policy.Threshold(), len(err.Policy.data.WrappedPolicyKeys))
+}
+
 // ErrDifferentFilesystem indicates that a policy can't be applied to a
 // directory on a different filesystem.
 type ErrDifferentFilesystem struct {
@@ -79,6 +90,18 @@ func (err *ErrDifferentFilesystem) Error() string {
 	filesystem.`, err.PolicyMount.Path, err.PathMount.Path)
 }
 
+// ErrFixedProtectors indicates that a protector can't be added to a policy
+// whose key is split across its protectors.
+type ErrFixedProtectors struct {
+	Policy *Policy
+}
+
+func (err *ErrFixedProtectors) Error() string {
+	return fmt.Sprintf(`cannot add a protector to policy %s, which needs %d
+	of its %d protectors to unlock.`, err.Policy.Descriptor(),
+		err.Policy.Threshold(), len(err.Policy.data.WrappedPolicyKeys))
+}
+
 // ErrMissingPolicyMetadata indicates that a directory is encrypted but its
 // policy metadata cannot be found.
 type ErrMissingPolicyMetadata struct {
@@ -95,6 +118,18 @@ func (err *ErrMissingPolicyMetadata) Error() string {
 		err.Mount.PolicyPath(err.Descriptor))
 }
 
+// ErrNeedsMoreProtectors indicates that a policy can't be unlocked with a single
+// protector.
+type ErrNeedsMoreProtectors struct {
+	Policy *Policy
+}
+
+func (err *ErrNeedsMoreProtectors) Error() string {
+	return fmt.Sprintf("policy %s needs %d of its %d protectors to unlock",
+		err.Policy.Descriptor(), err.Policy.Threshold(),
+		len(err.Policy.data.WrappedPolicyKeys))
+}
+
 // ErrNotProtected indicates that the given policy is not protected by the given
 // protector.
 type ErrNotProtected struct {
@@ -152,23 +187,312 @@ func PurgeAllPolicies(ctx *Context) error {
 	}
 
 	for _, policyDescriptor := range policies {
-		err = keyring.RemoveEncryptionKey(policyDescriptor, ctx.getKeyringOptions(), false)
-		switch errors.Cause(err) {
-		case nil, keyring.ErrKeyNotPresent:
-			// We don't care if the key has already been removed
-		case keyring.ErrKeyFilesOpen:
-			log.Printf("Key for policy %s couldn't be fully removed because some files are still in-use",
-				policyDescriptor)
-		case keyring.ErrKeyAddedByOtherUsers:
-			log.Printf("Key for policy %s couldn't be fully removed because other user(s) have added it too",
-				policyDescriptor)
-		default:
+		if err = ctx.purgePolicyKey(policyDescriptor); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
+// purgePolicyKey removes the key of the policy with the given descriptor from
+// the kernel keyring, ignoring keys which are already gone or which couldn't be
+// fully removed.
+func (ctx *Context) purgePolicyKey(policyDescriptor string) error {
+	err := keyring.RemoveEncryptionKey(policyDescriptor, ctx.getKeyringOptions(), false)
+	if errors.Cause(err) != keyring.ErrKeyNotPresent {
+		reportEvent(OperationDeprovision, ctx.Mount, policyDescriptor, "", err == nil)
+	}
+	switch errors.Cause(err) {
+	case nil, keyring.ErrKeyNotPresent:
+		// We don't care if the key has already been removed
+	case keyring.ErrKeyFilesOpen:
+		util.Debugf("Key for policy %s couldn't be fully removed because some files are still in-use",
+			policyDescriptor)
+	case keyring.ErrKeyAddedByOtherUsers:
+		util.Debugf("Key for policy %s couldn't be fully removed because other user(s) have added it too",
+			policyDescriptor)
+	default:
+		return err
+	}
+	return nil
+}
+
+// PoliciesToPurge returns the descriptors of the policies on the Context's
+// filesystem whose keys would be removed by PurgeAllPolicies, or by
+// PurgeUserPolicies if userOnly is true, without removing them.
+func PoliciesToPurge(ctx *Context, userOnly bool) ([]string, error) {
+	if err := ctx.checkContext(); err != nil {
+		return nil, err
+	}
+	policies, err := ctx.Mount.ListPolicies(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	options := ctx.getKeyringOptions()
+	var toPurge []string
+	for _, policyDescriptor := range policies {
+		if userOnly && len(policyDescriptor) == metadata.PolicyDescriptorLenV1 &&
+			options.UseFsKeyringForV1Policies {
+			continue
+		}
+		status, err := keyring.GetEncryptionKeyStatus(policyDescriptor, options)
+		if err != nil {
+			return nil, err
+		}
+		if status == keyring.KeyPresent ||
+			(!userOnly && status == keyring.KeyAbsentButFilesBusy) {
+			toPurge = append(toPurge, policyDescriptor)
+		}
+	}
+	return toPurge, nil
+}
+
+// PurgeResult describes what purging the target user's claims to policy keys
+// did to one policy's key.
+type PurgeResult struct {
+	PolicyDescriptor string
+	// HadClaim is true if the target user had added the key, so their
+	// claim to it was removed.
+	HadClaim bool
+	// Status is the status of the key after the purge, as seen by the
+	// target user.
+	Status keyring.KeyStatus
+	// Skipped is true for v1 policy keys in the filesystem keyring, since
+	// they can only be removed for all users at once.
+	Skipped bool
+}
+
+// FullyLocked returns true if removing the target user's claim to the key
+// locked the policy's directories for everyone.
+func (result *PurgeResult) FullyLocked() bool {
+	return result.HadClaim && result.Status == keyring.KeyAbsent
+}
+
+// PurgeUserPolicies removes only the target user's claims to the policy keys on
+// the filesystem, leaving the keys added by other users in place, and reports
+// what happened to each policy's key. As with PurgeAllPolicies, the filesystem
+// may also need to be unmounted or caches dropped for this to fully take
+// effect.
+func PurgeUserPolicies(ctx *Context) ([]*PurgeResult, error) {
+	if err := ctx.checkContext(); err != nil {
+		return nil, err
+	}
+	policies, err := ctx.Mount.ListPolicies(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]*PurgeResult, len(policies))
+	for i, policyDescriptor := range policies {
+		if results[i], err = ctx.purgeUserClaim(policyDescriptor); err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
+
+// purgeUserClaim removes the target user's claim to the key of the policy with
+// the given descriptor, if they have one, and reports what happened to the key.
+func (ctx *Context) purgeUserClaim(policyDescriptor string) (*PurgeResult, error) {
+	options := ctx.getKeyringOptions()
+	result := &PurgeResult{PolicyDescriptor: policyDescriptor}
+	if len(policyDescriptor) == metadata.PolicyDescriptorLenV1 &&
+		options.UseFsKeyringForV1Policies {
+		result.Skipped = true
+		return result, nil
+	}
+	status, err := keyring.GetEncryptionKeyStatus(policyDescriptor, options)
+	if err != nil {
+		return nil, err
+	}
+	result.Status = status
+	if status != keyring.KeyPresent {
+		return result, nil
+	}
+	result.HadClaim = true
+
+	err = keyring.RemoveEncryptionKey(policyDescriptor, options, false)
+	reportEvent(OperationDeprovision, ctx.Mount, policyDescriptor, "", err == nil)
+	switch errors.Cause(err) {
+	case nil, keyring.ErrKeyFilesOpen, keyring.ErrKeyAddedByOtherUsers:
+	default:
+		return nil, err
+	}
+	if result.Status, err = keyring.GetEncryptionKeyStatus(policyDescriptor, options); err != nil {
+		return nil, err
+	}
+	util.Infof("purged claim of %s to policy %s, key status is now %v",
+		ctx.TargetUser.Username, policyDescriptor, result.Status)
+	return result, nil
+}
+
+// PurgePolicy removes the key of a single policy from the kernel keyring, the
+// way PurgeAllPolicies does for every policy on the filesystem, or only the
+// target user's claim to it if userOnly is true, the way PurgeUserPolicies
+// does. The keys of all other policies are left alone. For a purge of the key
+// itself, HadClaim in the result is true if the key was present at all. As
+// with PurgeAllPolicies, caches may also need to be dropped for this to fully
+// take effect if the policy uses a user keyring.
+func PurgePolicy(policy *Policy, userOnly bool) (*PurgeResult, error) {
+	ctx := policy.Context
+	if err := ctx.checkContext(); err != nil {
+		return nil, err
+	}
+	if userOnly {
+		return ctx.purgeUserClaim(policy.Descriptor())
+	}
+	result := &PurgeResult{PolicyDescriptor: policy.Descriptor()}
+	options := ctx.getKeyringOptions()
+	status, err := keyring.GetEncryptionKeyStatus(policy.Descriptor(), options)
+	if err != nil {
+		return nil, err
+	}
+	result.HadClaim = status != keyring.KeyAbsent
+	if err = ctx.purgePolicyKey(policy.Descriptor()); err != nil {
+		return nil, err
+	}
+	if result.Status, err = keyring.GetEncryptionKeyStatus(policy.Descriptor(), options); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// LockResult describes what locking one of the policies which were unlocked on
+// a filesystem did to its key.
+type LockResult struct {
+	PolicyDescriptor string
+	// Status is the status of the key after removing it, as seen by the
+	// target user.
+	Status keyring.KeyStatus
+	// Err is set if the key couldn't be removed at all.
+	Err error
+}
+
+// FullyLocked returns true if the policy's directories are now locked for
+// everyone.
+func (result *LockResult) FullyLocked() bool {
+	return result.Err == nil && result.Status == keyring.KeyAbsent
+}
+
+// LockAllPolicies removes the keys of all the policies on the filesystem which
+// are unlocked, or were incompletely locked, and reports what happened to each
+// of them. Unless allUsers is true, only the target user's claims to v2 policy
+// keys are removed, and keys only added by other users are left alone. As with
+// PurgeAllPolicies, the caches may also need to be dropped for v1 policies to
+// be fully locked.
+func LockAllPolicies(ctx *Context, allUsers bool) ([]*LockResult, error) {
+	if err := ctx.checkContext(); err != nil {
+		return nil, err
+	}
+	policies, err := ctx.Mount.ListPolicies(nil)
+	if err != nil {
+		return nil, err
+	}
+	return LockPolicies(ctx, policies, allUsers)
+}
+
+// LockPolicies is like LockAllPolicies, but only for the given policies on the
+// filesystem.
+func LockPolicies(ctx *Context, policies []string, allUsers bool) ([]*LockResult, error) {
+	if err := ctx.checkContext(); err != nil {
+		return nil, err
+	}
+	options := ctx.getKeyringOptions()
+	var results []*LockResult
+	for _, policyDescriptor := range policies {
+		status, err := keyring.GetEncryptionKeyStatus(policyDescriptor, options)
+		if err != nil {
+			return nil, err
+		}
+		if !needsLocking(status, allUsers) {
+			continue
+		}
+		result, err := lockPolicyKey(ctx, policyDescriptor, allUsers)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// needsLocking returns true if a policy whose key has the given status is
+// unlocked, or was incompletely locked, as far as locking it with allUsers is
+// concerned.
+func needsLocking(status keyring.KeyStatus, allUsers bool) bool {
+	switch status {
+	case keyring.KeyPresent, keyring.KeyAbsentButFilesBusy:
+		return true
+	case keyring.KeyPresentButOnlyOtherUsers:
+		return allUsers
+	default:
+		return false
+	}
+}
+
+// lockPolicyKey removes the key of the policy on the context's filesystem, and
+// reports what happened to it. Failing to remove the key is reported in the
+// result, while the error is only set if the key's status can't be checked.
+func lockPolicyKey(ctx *Context, policyDescriptor string, allUsers bool) (*LockResult, error) {
+	options := ctx.getKeyringOptions()
+	result := &LockResult{PolicyDescriptor: policyDescriptor}
+	err := keyring.RemoveEncryptionKey(policyDescriptor, options, allUsers)
+	reportEvent(OperationDeprovision, ctx.Mount, policyDescriptor, "", err == nil)
+	switch errors.Cause(err) {
+	case nil, keyring.ErrKeyFilesOpen, keyring.ErrKeyAddedByOtherUsers, keyring.ErrKeyNotPresent:
+	default:
+		result.Err = err
+		return result, nil
+	}
+	if result.Status, err = keyring.GetEncryptionKeyStatus(policyDescriptor, options); err != nil {
+		return nil, err
+	}
+	util.Infof("locked policy %s, key status is now %v", policyDescriptor, result.Status)
+	return result, nil
+}
+
+// FindOrphanedKeys returns the fscrypt keys in the target user's user keyring
+// which don't belong to any policy on a filesystem that is currently set up for
+// use with fscrypt, e.g. because the filesystem was unmounted or the policy's
+// metadata was deleted while the key was still added. If the policies of some
+// set up filesystem can't be listed, an error is returned, since any key could
+// belong to them. Keys in filesystem keyrings can't be enumerated, so they are
+// never reported.
+func FindOrphanedKeys(targetUser *user.User) ([]keyring.UserKey, error) {
+	keys, err := keyring.ListUserKeys(targetUser)
+	if err != nil || len(keys) == 0 {
+		return nil, err
+	}
+	mounts, err := filesystem.AllFilesystems()
+	if err != nil {
+		return nil, err
+	}
+
+	knownPolicies := make(map[string]bool)
+	for _, mount := range mounts {
+		descriptors, err := mount.ListPolicies(nil)
+		if _, ok := err.(*filesystem.ErrNotSetup); ok {
+			continue
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "listing policies on %s", mount.Path)
+		}
+		for _, descriptor := range descriptors {
+			knownPolicies[descriptor] = true
+		}
+	}
+
+	var orphaned []keyring.UserKey
+	for _, key := range keys {
+		if !knownPolicies[key.PolicyDescriptor] {
+			util.Debugf("key %s (ID %d) has no policy", key.Description, key.ID)
+			orphaned = append(orphaned, key)
+		}
+	}
+	return orphaned, nil
+}
+
 // Policy represents an unlocked policy, so it contains the PolicyData as well
 // as the actual protector key. These unlocked Polices can then be applied to a
 // directory, or have their key material inserted into the keyring (which will
@@ -181,6 +505,9 @@ type Policy struct {
 	created             bool
 	ownerIfCreating     *user.User
 	newLinkedProtectors []string
+	// The FSCRYPT_POLICY_FLAG_* flags, if the policy was loaded from an
+	// encrypted directory.
+	flags uint8
 }
 
 // CreatePolicy creates a Policy protected by given Protector and stores the
@@ -226,6 +553,133 @@ func CreatePolicy(ctx *Context, protector *Protector) (*Policy, error) {
 	return policy, nil
 }
 
+// CreateThresholdPolicy creates a Policy which needs any threshold of the given
+// protectors to unlock. The policy key is split into a share for each
+// protector with crypto.SplitKey, and each protector wraps its share. The
+// protectors must be unlocked. Protectors can't be added to such a policy
+// later, so all of them must be given here. A threshold of 1 creates a normal
+// policy, protected by each of the protectors. On error, no data is changed on
+// the filesystem.
+func CreateThresholdPolicy(ctx *Context, threshold int, protectors []*Protector) (*Policy, error) {
+	if err := ctx.checkContext(); err != nil {
+		return nil, err
+	}
+	if threshold < 1 || threshold > len(protectors) || len(protectors) > crypto.MaxKeyShares {
+		return nil, errors.Errorf("cannot require %d of %d protectors to unlock a policy",
+			threshold, len(protectors))
+	}
+	seen := make(map[string]bool)
+	for _, protector := range protectors {
+		if protector.key == nil {
+			return nil, ErrLocked
+		}
+		if seen[protector.Descriptor()] {
+			return nil, errors.Errorf("protector %s is given more than once",
+				protector.Descriptor())
+		}
+		seen[protector.Descriptor()] = true
+	}
+	if threshold == 1 {
+		return createPolicyWithProtectors(ctx, protectors)
+	}
+
+	key, err := crypto.NewRandomKey(metadata.PolicyKeyLen)
+	if err != nil {
+		return nil, err
+	}
+	keyDescriptor, err := crypto.ComputeKeyDescriptor(key, ctx.Config.Options.PolicyVersion)
+	if err != nil {
+		key.Wipe()
+		return nil, err
+	}
+	policy := &Policy{
+		Context: ctx,
+		data: &metadata.PolicyData{
+			Options:       ctx.Config.Options,
+			KeyDescriptor: keyDescriptor,
+			Threshold:     int64(threshold),
+		},
+		key:     key,
+		created: true,
+	}
+	if policy.ownerIfCreating, err = getOwnerOfMetadataForProtector(protectors[0]); err != nil {
+		policy.Lock()
+		return nil, err
+	}
+
+	shares, err := crypto.SplitKey(key, threshold, len(protectors))
+	if err != nil {
+		policy.Lock()
+		return nil, err
+	}
+	defer crypto.WipeKeyShares(shares)
+
+	err = ctx.withMetadataLock(func() error {
+		for i, protector := range protectors {
+			if err := policy.linkProtector(protector); err != nil {
+				return err
+			}
+			wrappedShare, err := crypto.Wrap(protector.key, shares[i].Key)
+			if err != nil {
+				return err
+			}
+			policy.addKey(&metadata.WrappedPolicyKey{
+				ProtectorDescriptor: protector.Descriptor(),
+				WrappedShare:        wrappedShare,
+				ShareIndex:          int64(shares[i].Index),
+			})
+		}
+		return policy.commitData()
+	})
+	if err != nil {
+		for _, protectorDescriptor := range policy.newLinkedProtectors {
+			ctx.Mount.RemoveProtector(protectorDescriptor)
+		}
+		policy.Lock()
+		return nil, err
+	}
+	return policy, nil
+}
+
+// createPolicyWithProtectors creates a Policy protected by each of the given
+// protectors. On error, no data is changed on the filesystem.
+func createPolicyWithProtectors(ctx *Context, protectors []*Protector) (*Policy, error) {
+	policy, err := CreatePolicy(ctx, protectors[0])
+	if err != nil {
+		return nil, err
+	}
+	for _, protector := range protectors[1:] {
+		if err = policy.AddProtector(protector); err != nil {
+			policy.Destroy()
+			policy.Lock()
+			return nil, err
+		}
+	}
+	return policy, nil
+}
+
+// CreateRekeyedPolicy creates a Policy with a new, randomly generated key, but
+// otherwise like oldPolicy: it has the same encryption options and threshold,
+// and is protected by the same protectors, which must all be given unlocked.
+// The key of a directory can't be changed in place, so the files using
+// oldPolicy must then be copied into a directory using the new policy. On
+// error, no data is changed on the filesystem.
+func CreateRekeyedPolicy(oldPolicy *Policy, protectors []*Protector) (*Policy, error) {
+	if len(protectors) != len(oldPolicy.data.WrappedPolicyKeys) {
+		return nil, errors.Errorf("policy %s has %d protectors, but %d were given",
+			oldPolicy.Descriptor(), len(oldPolicy.data.WrappedPolicyKeys), len(protectors))
+	}
+	for _, protector := range protectors {
+		if !oldPolicy.UsesProtector(protector) {
+			return nil, &ErrNotProtected{oldPolicy.Descriptor(), protector.Descriptor()}
+		}
+	}
+	ctx := *oldPolicy.Context
+	ctx.Config = proto.Clone(ctx.Config).(*metadata.Config)
+	ctx.Config.Options = proto.Clone(oldPolicy.data.Options).(*metadata.EncryptionOptions)
+	return CreateThresholdPolicy(&ctx, oldPolicy.Threshold(), protectors)
+}
+
 // GetPolicy retrieves a locked policy with a specific descriptor. The Policy is
 // still locked in this case, so it must be unlocked before using certain
 // methods.
@@ -235,9 +689,9 @@ func GetPolicy(ctx *Context, descriptor string) (*Policy, error) {
 	}
 	data, err := ctx.Mount.GetPolicy(descriptor, ctx.TrustedUser)
 	if err != nil {
-		return nil, err
+		return nil, checkDowngraded(err, "policy", descriptor, ctx.Mount)
 	}
-	log.Printf("got data for %s from %q", descriptor, ctx.Mount.Path)
+	util.Debugf("got data for %s from %q", descriptor, ctx.Mount.Path)
 
 	return &Policy{Context: ctx, data: data}, nil
 }
@@ -253,7 +707,7 @@ func GetPolicyFromPath(ctx *Context, path string) (*Policy, error) {
 
 	// We double check that the options agree for both the data we get from
 	// the path, and the data we get from the mountpoint.
-	pathData, err := metadata.GetPolicy(path)
+	pathData, flags, err := metadata.GetPolicyWithFlags(path)
 	err = ctx.Mount.EncryptionSupportError(err)
 	if err != nil {
 		// On kernels that don't support v2 encryption policies, trying
@@ -268,25 +722,44 @@ func GetPolicyFromPath(ctx *Context, path string) (*Policy, error) {
 		return nil, err
 	}
 	descriptor := pathData.KeyDescriptor
-	log.Printf("found policy %s for %q", descriptor, path)
+	util.Debugf("found policy %s for %q", descriptor, path)
 
 	mountData, err := ctx.Mount.GetPolicy(descriptor, ctx.TrustedUser)
 	if err != nil {
-		log.Printf("getting policy metadata: %v", err)
-		if _, ok := err.(*filesystem.ErrPolicyNotFound); ok {
+		util.Debugf("getting policy metadata: %v", err)
+		if _, ok := err.(*filesystem.ErrPolicyNotFound); !ok {
+			return nil, checkDowngraded(err, "policy", descriptor, ctx.Mount)
+		}
+		// Fall back to the copy stored in the directory, if any.
+		if mountData, err = metadata.GetPolicyXattr(path); err != nil {
+			util.Debug(err)
 			return nil, &ErrMissingPolicyMetadata{ctx.Mount, path, descriptor}
 		}
-		return nil, err
+		util.Debugf("using the copy of policy %s stored in %q", descriptor, path)
+	} else {
+		util.Debugf("found data for policy %s on %q", descriptor, ctx.Mount.Path)
 	}
-	log.Printf("found data for policy %s on %q", descriptor, ctx.Mount.Path)
 
 	if !proto.Equal(pathData.Options, mountData.Options) ||
 		pathData.KeyDescriptor != mountData.KeyDescriptor {
 		return nil, &ErrPolicyMetadataMismatch{path, ctx.Mount, pathData, mountData}
 	}
-	log.Print("data from filesystem and path agree")
+	util.Debug("data from filesystem and path agree")
+
+	return &Policy{Context: ctx, data: mountData, flags: flags}, nil
+}
 
-	return &Policy{Context: ctx, data: mountData}, nil
+// PathsForPolicy returns the directories on the Context's mountpoint which were
+// recorded to use the policy with the given descriptor, and still do. The
+// filesystem isn't searched, so this is fast, but directories encrypted by
+// older versions of fscrypt aren't found. The returned bool is true if the
+// policy was created with its list of directories, so that no other directory
+// can use it.
+func (ctx *Context) PathsForPolicy(descriptor string) ([]string, bool, error) {
+	if err := ctx.checkContext(); err != nil {
+		return nil, false, err
+	}
+	return ctx.Mount.PolicyDirectories(descriptor)
 }
 
 // ProtectorOptions creates a slice of ProtectorOptions for the protectors
@@ -324,14 +797,51 @@ func (policy *Policy) Version() int64 {
 	return policy.data.Options.PolicyVersion
 }
 
+// Threshold returns how many of the policy's protectors are needed to unlock
+// it. This is 1 unless the policy was created by CreateThresholdPolicy.
+func (policy *Policy) Threshold() int {
+	if policy.data.Threshold > 1 {
+		return int(policy.data.Threshold)
+	}
+	return 1
+}
+
+// HasStableInodeFlags returns true if the policy has the IV_INO_LBLK_64 or
+// IV_INO_LBLK_32 flag set, so the encryption of its files depends on their
+// inode numbers. These flags are stored in the policy's options when fscrypt
+// set them, but flags set by other tools are only known for policies loaded
+// with GetPolicyFromPath.
+func (policy *Policy) HasStableInodeFlags() bool {
+	options := policy.data.GetOptions()
+	return policy.flags&metadata.StableInodeFlags != 0 ||
+		options.GetIvInoLblk_64() || options.GetIvInoLblk_32()
+}
+
+// Label returns the human-readable label recorded for this policy, or the empty
+// string if it has none. Labels are only for display and are never used when
+// unlocking the policy.
+func (policy *Policy) Label() (string, error) {
+	return policy.Context.Mount.GetPolicyLabel(policy.Descriptor(), policy.Context.TrustedUser)
+}
+
+// SetLabel records a human-readable label for this policy, replacing any
+// existing label. An empty label removes it.
+func (policy *Policy) SetLabel(label string) error {
+	return policy.Context.withMetadataLock(func() error {
+		return policy.Context.Mount.SetPolicyLabel(policy.Descriptor(), label, policy.ownerIfCreating)
+	})
+}
+
 // Destroy removes a policy from the filesystem. It also removes any new
 // protector links that were created for the policy. This does *not* wipe the
 // policy's internal key from memory; use Lock() to do that.
 func (policy *Policy) Destroy() error {
-	for _, protectorDescriptor := range policy.newLinkedProtectors {
-		policy.Context.Mount.RemoveProtector(protectorDescriptor)
-	}
-	return policy.Context.Mount.RemovePolicy(policy.Descriptor())
+	return policy.Context.withMetadataLock(func() error {
+		for _, protectorDescriptor := range policy.newLinkedProtectors {
+			policy.Context.Mount.RemoveProtector(protectorDescriptor)
+		}
+		return policy.Context.Mount.RemovePolicy(policy.Descriptor())
+	})
 }
 
 // Revert destroys a policy if it was created, but does nothing if it was just
@@ -353,10 +863,17 @@ func (policy *Policy) String() string {
 // the Policy, callbacks to select the Policy and get the key are needed. This
 // method will retry the keyFn as necessary to get the correct key for the
 // selected protector. Does nothing if policy is already unlocked.
-func (policy *Policy) Unlock(optionFn OptionFunc, keyFn KeyFunc) error {
+func (policy *Policy) Unlock(optionFn OptionFunc, keyFn KeyFunc) (err error) {
 	if policy.key != nil {
 		return nil
 	}
+	defer func() {
+		reportEvent(OperationUnlockPolicy, policy.Context.Mount,
+			policy.Descriptor(), "", err == nil)
+	}()
+	if policy.Threshold() > 1 {
+		return policy.unlockWithShares(optionFn, keyFn)
+	}
 	options := policy.ProtectorOptions()
 
 	// The OptionFunc indicates which option and wrapped key we should use.
@@ -369,26 +886,102 @@ func (policy *Policy) Unlock(optionFn OptionFunc, keyFn KeyFunc) error {
 		return option.LoadError
 	}
 
-	log.Printf("protector %s selected in callback", option.Descriptor())
-	protectorKey, err := unwrapProtectorKey(option.ProtectorInfo, keyFn)
+	util.Debugf("protector %s selected in callback", option.Descriptor())
+	protectorKey, err := unwrapProtectorKey(option.ProtectorInfo,
+		policy.Context.withKeystore(keyFn), policy.protectorMount(option))
 	if err != nil {
 		return err
 	}
 	defer protectorKey.Wipe()
 
-	log.Printf("unwrapping policy %s with protector", policy.Descriptor())
+	util.Debugf("unwrapping policy %s with protector", policy.Descriptor())
 	wrappedPolicyKey := policy.data.WrappedPolicyKeys[idx].WrappedKey
-	policy.key, err = crypto.Unwrap(protectorKey, wrappedPolicyKey)
-	return err
+	key, err := crypto.Unwrap(protectorKey, wrappedPolicyKey)
+	if err != nil {
+		return err
+	}
+	return policy.setKey(key)
+}
+
+// unlockWithShares unlocks a policy whose key is split across its protectors.
+// The OptionFunc is called repeatedly, each time with the protectors which
+// haven't been used yet, until enough shares of the key have been unwrapped to
+// combine them.
+func (policy *Policy) unlockWithShares(optionFn OptionFunc, keyFn KeyFunc) error {
+	options := policy.ProtectorOptions()
+	used := make([]bool, len(options))
+	var shares []crypto.KeyShare
+	defer func() { crypto.WipeKeyShares(shares) }()
+
+	for len(shares) < policy.Threshold() {
+		var remaining []*ProtectorOption
+		var indices []int
+		for idx, option := range options {
+			if !used[idx] {
+				remaining = append(remaining, option)
+				indices = append(indices, idx)
+			}
+		}
+		choice, err := optionFn(policy.Descriptor(), remaining)
+		if err != nil {
+			return err
+		}
+		idx := indices[choice]
+		used[idx] = true
+		option := options[idx]
+		if option.LoadError != nil {
+			return option.LoadError
+		}
+
+		util.Debugf("protector %s selected in callback (%d of %d)",
+			option.Descriptor(), len(shares)+1, policy.Threshold())
+		protectorKey, err := unwrapProtectorKey(option.ProtectorInfo,
+			policy.Context.withKeystore(keyFn), policy.protectorMount(option))
+		if err != nil {
+			return err
+		}
+		wrappedPolicyKey := policy.data.WrappedPolicyKeys[idx]
+		share, err := crypto.Unwrap(protectorKey, wrappedPolicyKey.WrappedShare)
+		protectorKey.Wipe()
+		if err != nil {
+			return err
+		}
+		shares = append(shares, crypto.KeyShare{
+			Index: int(wrappedPolicyKey.ShareIndex),
+			Key:   share,
+		})
+	}
+
+	util.Debugf("combining %d shares of policy %s", len(shares), policy.Descriptor())
+	key, err := crypto.CombineKeyShares(shares)
+	if err != nil {
+		return err
+	}
+	// Each share is authenticated, so this only fails if the metadata was
+	// made inconsistently.
+	descriptor, err := crypto.ComputeKeyDescriptor(key, policy.Version())
+	if err == nil && descriptor != policy.Descriptor() {
+		err = errors.Errorf("the key shares of policy %s don't combine to its key",
+			policy.Descriptor())
+	}
+	if err != nil {
+		key.Wipe()
+		return err
+	}
+	return policy.setKey(key)
 }
 
 // UnlockWithProtector uses an unlocked Protector to unlock a policy. An error
 // is returned if the Protector is not yet unlocked or does not protect the
 // policy. Does nothing if policy is already unlocked.
-func (policy *Policy) UnlockWithProtector(protector *Protector) error {
+func (policy *Policy) UnlockWithProtector(protector *Protector) (err error) {
 	if policy.key != nil {
 		return nil
 	}
+	defer func() {
+		reportEvent(OperationUnlockPolicy, policy.Context.Mount,
+			policy.Descriptor(), protector.Descriptor(), err == nil)
+	}()
 	if protector.key == nil {
 		return ErrLocked
 	}
@@ -396,11 +989,37 @@ func (policy *Policy) UnlockWithProtector(protector *Protector) error {
 	if !ok {
 		return &ErrNotProtected{policy.Descriptor(), protector.Descriptor()}
 	}
+	if policy.Threshold() > 1 {
+		return &ErrNeedsMoreProtectors{policy}
+	}
 
-	var err error
 	wrappedPolicyKey := policy.data.WrappedPolicyKeys[idx].WrappedKey
-	policy.key, err = crypto.Unwrap(protector.key, wrappedPolicyKey)
-	return err
+	key, err := crypto.Unwrap(protector.key, wrappedPolicyKey)
+	if err != nil {
+		return err
+	}
+	return policy.setKey(key)
+}
+
+// setKey checks the policy's metadata with its newly unwrapped key, and keeps
+// the key if the metadata is intact. Otherwise the key is wiped.
+func (policy *Policy) setKey(key *crypto.Key) error {
+	err := checkMetadataIntegrity(key, policy.data, "policy",
+		policy.Descriptor(), policy.Context.Mount)
+	if err != nil {
+		key.Wipe()
+		return err
+	}
+	policy.key = key
+	return nil
+}
+
+// protectorMount returns the filesystem holding the metadata of the protector.
+func (policy *Policy) protectorMount(option *ProtectorOption) *filesystem.Mount {
+	if option.LinkedMount != nil {
+		return option.LinkedMount
+	}
+	return policy.Context.Mount
 }
 
 // Lock wipes a Policy's internal Key. It should always be called after using a
@@ -422,11 +1041,17 @@ func (policy *Policy) UsesProtector(protector *Protector) bool {
 // policies or protector links for the given protector should be set.
 //
 // This will return a non-nil value only when the protector is a login protector
-// and the process is running as root.  In this scenario, root is setting up
+// and the process is running as root, or when the protector is being created
+// with an explicit owner.  In this scenario, root is setting up
 // encryption on the user's behalf, so we need to make new policies and
 // protector links owned by the user (rather than root) to allow them to be read
 // by the user, just like the login protector itself which is handled elsewhere.
 func getOwnerOfMetadataForProtector(protector *Protector) (*user.User, error) {
+	// A protector that is being created on behalf of another user (e.g.
+	// "fscrypt encrypt --owner") should have its metadata owned by them.
+	if protector.created && protector.ownerIfCreating != nil {
+		return protector.ownerIfCreating, nil
+	}
 	if protector.data.Source == metadata.SourceType_pam_passphrase && util.IsUserRoot() {
 		owner, err := util.UserFromUID(protector.data.Uid)
 		if err != nil {
@@ -441,35 +1066,33 @@ func getOwnerOfMetadataForProtector(protector *Protector) (*user.User, error) {
 // provided Protector is now protecting the specified Policy. If an error is
 // returned, no data has been changed. If the policy and protector are on
 // different filesystems, a link will be created between them. The policy and
-// protector must both be unlocked.
+// protector must both be unlocked. Protectors can't be added to a policy which
+// needs more than one protector to unlock.
 func (policy *Policy) AddProtector(protector *Protector) error {
 	if policy.UsesProtector(protector) {
 		return &ErrAlreadyProtected{policy, protector}
 	}
+	if policy.Threshold() > 1 {
+		return &ErrFixedProtectors{policy}
+	}
 	if policy.key == nil || protector.key == nil {
 		return ErrLocked
 	}
-
-	// If the protector is on a different filesystem, we need to add a link
-	// to it on the policy's filesystem.
-	if policy.Context.Mount != protector.Context.Mount {
-		log.Printf("policy on %s\n protector on %s\n", policy.Context.Mount, protector.Context.Mount)
-		ownerIfCreating, err := getOwnerOfMetadataForProtector(protector)
-		if err != nil {
+	return policy.Context.withMetadataLock(func() error {
+		if err := policy.refreshData(); err != nil {
 			return err
 		}
-		isNewLink, err := policy.Context.Mount.AddLinkedProtector(
-			protector.Descriptor(), protector.Context.Mount,
-			protector.Context.TrustedUser, ownerIfCreating)
-		if err != nil {
-			return err
+		if policy.UsesProtector(protector) {
+			return &ErrAlreadyProtected{policy, protector}
 		}
-		if isNewLink {
-			policy.newLinkedProtectors = append(policy.newLinkedProtectors,
-				protector.Descriptor())
-		}
-	} else {
-		log.Printf("policy and protector both on %q", policy.Context.Mount)
+		return policy.addProtectorLocked(protector)
+	})
+}
+
+// addProtectorLocked is AddProtector with the metadata lock held.
+func (policy *Policy) addProtectorLocked(protector *Protector) error {
+	if err := policy.linkProtector(protector); err != nil {
+		return err
 	}
 
 	// Create the wrapped policy key
@@ -492,6 +1115,47 @@ func (policy *Policy) AddProtector(protector *Protector) error {
 	return nil
 }
 
+// linkProtector adds a link to the protector on the policy's filesystem if the
+// protector is on a different filesystem. The metadata lock must be held.
+func (policy *Policy) linkProtector(protector *Protector) error {
+	if policy.Context.Mount != protector.Context.Mount {
+		util.Debugf("policy on %s\n protector on %s\n", policy.Context.Mount, protector.Context.Mount)
+		ownerIfCreating, err := getOwnerOfMetadataForProtector(protector)
+		if err != nil {
+			return err
+		}
+		isNewLink, err := policy.Context.Mount.AddLinkedProtector(
+			protector.Descriptor(), protector.Context.Mount,
+			protector.Context.TrustedUser, ownerIfCreating)
+		if err != nil {
+			return err
+		}
+		if isNewLink {
+			policy.newLinkedProtectors = append(policy.newLinkedProtectors,
+				protector.Descriptor())
+		}
+	} else {
+		util.Debugf("policy and protector both on %q", policy.Context.Mount)
+	}
+	return nil
+}
+
+// CheckRemoveProtector returns the error RemoveProtector would fail with if the
+// protector with the given descriptor was removed from the Policy, without
+// removing it.
+func (policy *Policy) CheckRemoveProtector(protectorDescriptor string) error {
+	if _, ok := policy.findWrappedKeyIndex(protectorDescriptor); !ok {
+		return &ErrNotProtected{policy.Descriptor(), protectorDescriptor}
+	}
+	if len(policy.data.WrappedPolicyKeys) == 1 {
+		return &ErrOnlyProtector{policy}
+	}
+	if len(policy.data.WrappedPolicyKeys) <= policy.Threshold() {
+		return &ErrBelowThreshold{policy}
+	}
+	return nil
+}
+
 // RemoveProtector updates the data that is wrapping the Policy Key so that the
 // protector with the given descriptor is no longer protecting the specified
 // Policy.  If an error is returned, no data has been changed.  Note that the
@@ -499,24 +1163,25 @@ func (policy *Policy) AddProtector(protector *Protector) error {
 // removed (in the case where the protector and policy are on different
 // filesystems).  The policy can be locked or unlocked.
 func (policy *Policy) RemoveProtector(protectorDescriptor string) error {
-	idx, ok := policy.findWrappedKeyIndex(protectorDescriptor)
-	if !ok {
-		return &ErrNotProtected{policy.Descriptor(), protectorDescriptor}
-	}
-
-	if len(policy.data.WrappedPolicyKeys) == 1 {
-		return &ErrOnlyProtector{policy}
-	}
+	return policy.Context.withMetadataLock(func() error {
+		if err := policy.refreshData(); err != nil {
+			return err
+		}
+		if err := policy.CheckRemoveProtector(protectorDescriptor); err != nil {
+			return err
+		}
 
-	// Remove the wrapped key from the data
-	toRemove := policy.removeKey(idx)
+		// Remove the wrapped key from the data
+		idx, _ := policy.findWrappedKeyIndex(protectorDescriptor)
+		toRemove := policy.removeKey(idx)
 
-	if err := policy.commitData(); err != nil {
-		// revert the removal on failure (order is irrelevant)
-		policy.addKey(toRemove)
-		return err
-	}
-	return nil
+		if err := policy.commitData(); err != nil {
+			// revert the removal on failure (order is irrelevant)
+			policy.addKey(toRemove)
+			return err
+		}
+		return nil
+	})
 }
 
 // Apply sets the Policy on a specified directory. Currently we impose the
@@ -529,8 +1194,33 @@ func (policy *Policy) Apply(path string) error {
 		return &ErrDifferentFilesystem{policy.Context.Mount, pathMount}
 	}
 
+	if err := policy.AddDirectory(path); err != nil {
+		return err
+	}
 	err := metadata.SetPolicy(path, policy.data)
-	return policy.Context.Mount.EncryptionSupportError(err)
+	if err = policy.Context.Mount.EncryptionSupportError(err); err != nil {
+		return err
+	}
+	if policy.Context.Config.GetStorePoliciesInXattrs() {
+		// The copy is only a fallback, so the directory is usable
+		// without it.
+		if err = metadata.SetPolicyXattr(path, policy.data); err != nil {
+			util.Warnf("cannot store a copy of the policy metadata in %q: %v", path, err)
+		}
+	}
+	return nil
+}
+
+// AddDirectory records that the directory at path uses the Policy, so that
+// PathsForPolicy finds it. Apply does this itself; it's only needed for a
+// directory which gets the Policy some other way, such as by being exchanged
+// with a directory it was applied to. It must be called before the directory
+// gets the Policy, but after the Policy is applied to the other directory, or
+// else recording that directory forgets this one, which doesn't use it yet.
+func (policy *Policy) AddDirectory(path string) error {
+	return policy.Context.withMetadataLock(func() error {
+		return policy.Context.Mount.AddPolicyDirectory(policy.Descriptor(), path)
+	})
 }
 
 // GetProvisioningStatus returns the status of this policy's key in the keyring.
@@ -540,6 +1230,37 @@ func (policy *Policy) GetProvisioningStatus() keyring.KeyStatus {
 	return status
 }
 
+// OtherUsersWithKey returns the number of users other than the target user who
+// have added the policy's key to the filesystem keyring, i.e. for whom the
+// directories using the policy stay unlocked even if the target user locks
+// them. The kernel only tracks this for v2 policies, so it is 0 for v1
+// policies.
+func (policy *Policy) OtherUsersWithKey() (int, error) {
+	if policy.Version() == 1 {
+		return 0, nil
+	}
+	count, addedBySelf, err := keyring.GetEncryptionKeyUsers(policy.Descriptor(),
+		policy.Context.getKeyringOptions())
+	if err != nil {
+		return 0, err
+	}
+	if addedBySelf {
+		count--
+	}
+	return count, nil
+}
+
+// KeyClaimants returns the UIDs of the users who have added the policy's key to
+// the filesystem keyring, in increasing order. Only root can find them, and
+// the kernel only tracks this for v2 policies, so it is nil for v1 policies.
+func (policy *Policy) KeyClaimants() ([]int, error) {
+	if policy.Version() == 1 {
+		return nil, nil
+	}
+	return keyring.GetEncryptionKeyClaimants(policy.Descriptor(),
+		policy.Context.getKeyringOptions())
+}
+
 // IsProvisionedByTargetUser returns true if the policy's key is present in the
 // target kernel keyring, but not if that keyring is a filesystem keyring and
 // the key only been added by users other than Context.TargetUser.
@@ -549,7 +1270,11 @@ func (policy *Policy) IsProvisionedByTargetUser() bool {
 
 // Provision inserts the Policy key into the kernel keyring. This allows reading
 // and writing of files encrypted with this directory. Requires unlocked Policy.
-func (policy *Policy) Provision() error {
+func (policy *Policy) Provision() (err error) {
+	defer func() {
+		reportEvent(OperationProvision, policy.Context.Mount,
+			policy.Descriptor(), "", err == nil)
+	}()
 	if policy.key == nil {
 		return ErrLocked
 	}
@@ -562,8 +1287,11 @@ func (policy *Policy) Provision() error {
 // keyring, in which case caches must be dropped too. If the Policy key was
 // already removed, returns keyring.ErrKeyNotPresent.
 func (policy *Policy) Deprovision(allUsers bool) error {
-	return keyring.RemoveEncryptionKey(policy.Descriptor(),
+	err := keyring.RemoveEncryptionKey(policy.Descriptor(),
 		policy.Context.getKeyringOptions(), allUsers)
+	reportEvent(OperationDeprovision, policy.Context.Mount,
+		policy.Descriptor(), "", err == nil)
+	return err
 }
 
 // NeedsUserKeyring returns true if Provision and Deprovision for this policy
@@ -584,9 +1312,41 @@ func (policy *Policy) CanBeAppliedWithoutProvisioning() bool {
 	return policy.Version() == 1 || util.IsUserRoot()
 }
 
-// commitData writes the Policy's current data to the filesystem.
+// refreshData re-reads the wrapped keys of a policy which was queried from the
+// filesystem, so that protectors added or removed by other processes since then
+// are kept when the policy is written back. The metadata lock must be held.
+func (policy *Policy) refreshData() error {
+	if policy.created {
+		return nil
+	}
+	data, err := policy.Context.Mount.GetPolicy(policy.Descriptor(), policy.Context.TrustedUser)
+	if err != nil {
+		return err
+	}
+	policy.data.WrappedPolicyKeys = data.WrappedPolicyKeys
+	return nil
+}
+
+// commitData writes the Policy's current data to the filesystem. If the policy
+// is unlocked, its metadata HMAC is updated too, which adds one to policies
+// written by older versions.
 func (policy *Policy) commitData() error {
-	return policy.Context.Mount.AddPolicy(policy.data, policy.ownerIfCreating)
+	if policy.key != nil {
+		hmac, err := crypto.MetadataHMAC(policy.key, policy.data)
+		if err != nil {
+			return err
+		}
+		policy.data.MetadataHmac = hmac
+	}
+	if err := policy.Context.Mount.AddPolicy(policy.data, policy.ownerIfCreating); err != nil {
+		return err
+	}
+	if policy.created {
+		// Every directory which gets a new policy is recorded, so
+		// PathsForPolicy can rely on its list.
+		return policy.Context.Mount.StartPolicyDirectories(policy.Descriptor())
+	}
+	return nil
 }
 
 // findWrappedPolicyKey returns the index of the wrapped policy key
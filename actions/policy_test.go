@@ -20,9 +20,18 @@
 package actions
 
 import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
 	"testing"
 
 	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/google/fscrypt/metadata"
 )
 
 // Makes a protector and policy
@@ -120,6 +129,68 @@ func TestPolicyGoodRemoveProtector(t *testing.T) {
 	}
 }
 
+// Tests that protectors added to the same policy by two goroutines at once,
+// each with its own copy of the policy, are both kept.
+func TestConcurrentAddProtector(t *testing.T) {
+	pro1, pol, err := makeBoth()
+	defer cleanupProtector(pro1)
+	defer cleanupPolicy(pol)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var protectors []*Protector
+	for _, name := range []string{testProtectorName2, testProtectorName2 + "3"} {
+		pro, err := CreateProtector(testContext, name, goodCallback, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cleanupProtector(pro)
+		protectors = append(protectors, pro)
+	}
+
+	// Load both copies before either protector is added.
+	var copies []*Policy
+	for range protectors {
+		loaded, err := GetPolicy(testContext, pol.Descriptor())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = loaded.UnlockWithProtector(pro1); err != nil {
+			t.Fatal(err)
+		}
+		defer loaded.Lock()
+		copies = append(copies, loaded)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(protectors))
+	for i := range protectors {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- copies[i].AddProtector(protectors[i])
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	result, err := GetPolicy(testContext, pol.Descriptor())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, pro := range append(protectors, pro1) {
+		if !result.UsesProtector(pro) {
+			t.Errorf("policy lost protector %s", pro.Descriptor())
+		}
+	}
+}
+
 // Tests various bad ways to remove protectors
 func TestPolicyBadRemoveProtector(t *testing.T) {
 	pro1, pol, err := makeBoth()
@@ -135,6 +206,12 @@ func TestPolicyBadRemoveProtector(t *testing.T) {
 	}
 	defer cleanupProtector(pro2)
 
+	if _, ok := pol.CheckRemoveProtector(pro2.Descriptor()).(*ErrNotProtected); !ok {
+		t.Error("checking should report that the protector was not added")
+	}
+	if _, ok := pol.CheckRemoveProtector(pro1.Descriptor()).(*ErrOnlyProtector); !ok {
+		t.Error("checking should report that the protector is the only one")
+	}
 	if pol.RemoveProtector(pro2.Descriptor()) == nil {
 		t.Error("we should not be able to remove a protector we did not add")
 	}
@@ -212,3 +289,352 @@ func TestPolicyUnlockWithLockedProtector(t *testing.T) {
 		}
 	}
 }
+
+// Tests finding the directories which use a policy.
+func TestPathsForPolicy(t *testing.T) {
+	pro, pol, err := makeBoth()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanupProtector(pro)
+	defer cleanupPolicy(pol)
+	if !pol.CanBeAppliedWithoutProvisioning() {
+		t.Skip("can't apply the policy without provisioning it")
+	}
+
+	testDir, err := os.MkdirTemp(testContext.Mount.Path, "paths-for-policy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(testDir)
+	encrypted := []string{
+		filepath.Join(testDir, "a"),
+		filepath.Join(testDir, "nested", "b"),
+	}
+	for _, dir := range append(encrypted, filepath.Join(testDir, "unencrypted")) {
+		if err = os.MkdirAll(dir, 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, dir := range encrypted {
+		if err = pol.Apply(dir); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	paths, complete, err := testContext.PathsForPolicy(pol.Descriptor())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(paths, encrypted) {
+		t.Errorf("found %v, expected %v", paths, encrypted)
+	}
+	if !complete {
+		t.Error("the directories of a new policy should all be known")
+	}
+
+	// A removed directory is no longer found.
+	if err = os.RemoveAll(encrypted[0]); err != nil {
+		t.Fatal(err)
+	}
+	if paths, _, err = testContext.PathsForPolicy(pol.Descriptor()); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(paths, encrypted[1:]) {
+		t.Errorf("found %v, expected %v", paths, encrypted[1:])
+	}
+
+	if paths, complete, err = testContext.PathsForPolicy("0123456789abcdef"); err != nil {
+		t.Fatal(err)
+	} else if len(paths) != 0 || complete {
+		t.Errorf("found %v (complete: %v) for an unknown policy", paths, complete)
+	}
+}
+
+// Tests that purging the target user's claims locks a policy only they had
+// unlocked, and leaves alone a policy they hadn't unlocked.
+func TestPurgeUserPolicies(t *testing.T) {
+	pro, pol, err := makeBoth()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanupProtector(pro)
+	defer cleanupPolicy(pol)
+	pol2, err := CreatePolicy(testContext, pro)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanupPolicy(pol2)
+
+	if err = pol.Provision(); err != nil {
+		t.Skip(err)
+	}
+	defer pol.Deprovision(false)
+
+	results, err := PurgeUserPolicies(testContext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := 0
+	for _, result := range results {
+		switch result.PolicyDescriptor {
+		case pol.Descriptor():
+			found++
+			if !result.FullyLocked() {
+				t.Errorf("provisioned policy wasn't locked: %+v", result)
+			}
+		case pol2.Descriptor():
+			found++
+			if result.HadClaim || result.FullyLocked() {
+				t.Errorf("unprovisioned policy was purged: %+v", result)
+			}
+		}
+	}
+	if found != 2 {
+		t.Errorf("expected results for both policies, got %d", found)
+	}
+	if pol.IsProvisionedByTargetUser() {
+		t.Error("policy is still provisioned after purging")
+	}
+}
+
+// Tests that purging a single policy removes only its key.
+func TestPurgePolicy(t *testing.T) {
+	pro, pol, err := makeBoth()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanupProtector(pro)
+	defer cleanupPolicy(pol)
+	pol2, err := CreatePolicy(testContext, pro)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanupPolicy(pol2)
+
+	if err = pol.Provision(); err != nil {
+		t.Skip(err)
+	}
+	defer pol.Deprovision(false)
+	if err = pol2.Provision(); err != nil {
+		t.Fatal(err)
+	}
+	defer pol2.Deprovision(false)
+
+	result, err := PurgePolicy(pol, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.FullyLocked() {
+		t.Errorf("policy wasn't locked: %+v", result)
+	}
+	if pol.IsProvisionedByTargetUser() {
+		t.Error("policy is still provisioned after purging")
+	}
+	if !pol2.IsProvisionedByTargetUser() {
+		t.Error("other policy was purged too")
+	}
+}
+
+// Tests that locking all policies only reports and locks the unlocked ones.
+func TestLockAllPolicies(t *testing.T) {
+	pro, pol, err := makeBoth()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanupProtector(pro)
+	defer cleanupPolicy(pol)
+	pol2, err := CreatePolicy(testContext, pro)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanupPolicy(pol2)
+
+	if err = pol.Provision(); err != nil {
+		t.Skip(err)
+	}
+	defer pol.Deprovision(false)
+
+	results, err := LockAllPolicies(testContext, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].PolicyDescriptor != pol.Descriptor() {
+		t.Fatalf("expected a result for only the unlocked policy, got %+v", results)
+	}
+	if !results[0].FullyLocked() {
+		t.Errorf("unlocked policy wasn't locked: %+v", results[0])
+	}
+	if pol.IsProvisionedByTargetUser() {
+		t.Error("policy is still provisioned after locking all policies")
+	}
+}
+
+// Tests that the stable inode flags are detected, but the other flags aren't
+// mistaken for them.
+func TestHasStableInodeFlags(t *testing.T) {
+	testCases := []struct {
+		flags    uint8
+		expected bool
+	}{
+		{0, false},
+		{unix.FSCRYPT_POLICY_FLAGS_PAD_32 | unix.FSCRYPT_POLICY_FLAG_DIRECT_KEY, false},
+		{unix.FSCRYPT_POLICY_FLAG_IV_INO_LBLK_64, true},
+		{unix.FSCRYPT_POLICY_FLAGS_PAD_32 | unix.FSCRYPT_POLICY_FLAG_IV_INO_LBLK_32, true},
+	}
+	for _, testCase := range testCases {
+		policy := &Policy{
+			data:  &metadata.PolicyData{KeyDescriptor: "0123456789abcdef"},
+			flags: testCase.flags,
+		}
+		if got := policy.HasStableInodeFlags(); got != testCase.expected {
+			t.Errorf("flags %#x: got %v, expected %v", testCase.flags, got, testCase.expected)
+		}
+	}
+}
+
+// Makes n protectors with different names.
+func makeProtectors(t *testing.T, n int) []*Protector {
+	var protectors []*Protector
+	for i := 0; i < n; i++ {
+		protector, err := CreateProtector(testContext,
+			fmt.Sprintf("%s %d", testProtectorName, i), goodCallback, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { cleanupProtector(protector) })
+		protectors = append(protectors, protector)
+	}
+	return protectors
+}
+
+// Tests that a policy needing 2 of 3 protectors is unlocked with any two of
+// them, but not with a single protector.
+func TestThresholdPolicyUnlock(t *testing.T) {
+	pros := makeProtectors(t, 3)
+	pol, err := CreateThresholdPolicy(testContext, 2, pros)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanupPolicy(pol)
+	key, err := pol.key.Clone()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer key.Wipe()
+
+	loaded, err := GetPolicy(testContext, pol.Descriptor())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Threshold() != 2 {
+		t.Errorf("threshold is %d, expected 2", loaded.Threshold())
+	}
+	if _, ok := loaded.UnlockWithProtector(pros[0]).(*ErrNeedsMoreProtectors); !ok {
+		t.Error("a single protector shouldn't unlock the policy")
+	}
+
+	// Select the last of the offered protectors each time, so the shares
+	// of the third and second protectors are combined.
+	var offered []int
+	optionFn := func(policyDescriptor string, options []*ProtectorOption) (int, error) {
+		offered = append(offered, len(options))
+		return len(options) - 1, nil
+	}
+	if err = loaded.Unlock(optionFn, goodCallback); err != nil {
+		t.Fatal(err)
+	}
+	defer loaded.Lock()
+	if !reflect.DeepEqual(offered, []int{3, 2}) {
+		t.Errorf("offered %v protectors, expected [3 2]", offered)
+	}
+	if !loaded.key.Equals(key) {
+		t.Error("combined shares don't match the policy key")
+	}
+}
+
+// Tests that protectors can't be added to a policy needing several protectors,
+// and can only be removed while enough are left to unlock it.
+func TestThresholdPolicyChangeProtectors(t *testing.T) {
+	pros := makeProtectors(t, 4)
+	pol, err := CreateThresholdPolicy(testContext, 2, pros[:3])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanupPolicy(pol)
+
+	if _, ok := pol.AddProtector(pros[3]).(*ErrFixedProtectors); !ok {
+		t.Error("a protector shouldn't be added to the policy")
+	}
+	if err = pol.RemoveProtector(pros[2].Descriptor()); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := pol.RemoveProtector(pros[1].Descriptor()).(*ErrBelowThreshold); !ok {
+		t.Error("a protector shouldn't be removed from the policy")
+	}
+
+	pol.Lock()
+	optionFn := func(policyDescriptor string, options []*ProtectorOption) (int, error) {
+		return 0, nil
+	}
+	if err = pol.Unlock(optionFn, goodCallback); err != nil {
+		t.Error(err)
+	}
+}
+
+// Tests that a threshold of 1 makes a normal policy, and invalid thresholds
+// are rejected.
+func TestThresholdPolicyBadThreshold(t *testing.T) {
+	pros := makeProtectors(t, 2)
+	pol, err := CreateThresholdPolicy(testContext, 1, pros)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanupPolicy(pol)
+	if pol.Threshold() != 1 || len(pol.ProtectorDescriptors()) != 2 {
+		t.Errorf("policy has threshold %d and protectors %v",
+			pol.Threshold(), pol.ProtectorDescriptors())
+	}
+	if err = pol.UnlockWithProtector(pros[1]); err != nil {
+		t.Error(err)
+	}
+
+	for _, threshold := range []int{0, 3} {
+		if pol, err := CreateThresholdPolicy(testContext, threshold, pros); err == nil {
+			cleanupPolicy(pol)
+			t.Errorf("threshold of %d should be rejected", threshold)
+		}
+	}
+}
+
+// Tests that a rekeyed policy has a new key, but the same options, threshold,
+// and protectors, and that all the protectors must be given.
+func TestCreateRekeyedPolicy(t *testing.T) {
+	pros := makeProtectors(t, 3)
+	pol, err := CreateThresholdPolicy(testContext, 2, pros)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanupPolicy(pol)
+
+	if _, err = CreateRekeyedPolicy(pol, pros[:2]); err == nil {
+		t.Error("a rekeyed policy shouldn't drop a protector")
+	}
+	rekeyed, err := CreateRekeyedPolicy(pol, pros)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanupPolicy(rekeyed)
+	if rekeyed.Descriptor() == pol.Descriptor() || rekeyed.key.Equals(pol.key) {
+		t.Error("rekeyed policy has the same key")
+	}
+	if !proto.Equal(rekeyed.Options(), pol.Options()) {
+		t.Errorf("rekeyed policy has options %v, expected %v", rekeyed.Options(), pol.Options())
+	}
+	if rekeyed.Threshold() != 2 {
+		t.Errorf("threshold is %d, expected 2", rekeyed.Threshold())
+	}
+	if !reflect.DeepEqual(rekeyed.ProtectorDescriptors(), pol.ProtectorDescriptors()) {
+		t.Errorf("rekeyed policy is protected by %v, expected %v",
+			rekeyed.ProtectorDescriptors(), pol.ProtectorDescriptors())
+	}
+}
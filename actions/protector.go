@@ -21,10 +21,14 @@ package actions
 
 import (
 	"fmt"
-	"log"
+	"os"
 	"os/user"
+	"strings"
+
+	"google.golang.org/protobuf/proto"
 
 	"github.com/google/fscrypt/crypto"
+	"github.com/google/fscrypt/filesystem"
 	"github.com/google/fscrypt/metadata"
 	"github.com/google/fscrypt/util"
 )
@@ -54,6 +58,16 @@ func (err *ErrLoginProtectorName) Error() string {
 		err.Name, err.User.Username)
 }
 
+// ErrRenameLoginProtector indicates that a login protector can't be renamed.
+type ErrRenameLoginProtector struct {
+	Descriptor string
+}
+
+func (err *ErrRenameLoginProtector) Error() string {
+	return fmt.Sprintf(`cannot rename login protector %s because login
+	protectors are identified by user, not by name.`, err.Descriptor)
+}
+
 // ErrMissingProtectorName indicates that a protector name is needed.
 type ErrMissingProtectorName struct {
 	Source metadata.SourceType
@@ -72,6 +86,31 @@ func (err *ErrProtectorNameExists) Error() string {
 	return fmt.Sprintf("there is already a protector named %q", err.Name)
 }
 
+// ErrNotPassphraseProtector indicates that an operation which only makes sense
+// for passphrase protectors was attempted on some other kind of protector.
+type ErrNotPassphraseProtector struct {
+	Descriptor string
+	Source     metadata.SourceType
+}
+
+func (err *ErrNotPassphraseProtector) Error() string {
+	return fmt.Sprintf("protector %s has source %s, not a passphrase source",
+		err.Descriptor, err.Source)
+}
+
+// ErrCannotConvertProtector indicates that a protector can't be converted to
+// the requested source, e.g. because it already has that source.
+type ErrCannotConvertProtector struct {
+	Descriptor string
+	From       metadata.SourceType
+	To         metadata.SourceType
+}
+
+func (err *ErrCannotConvertProtector) Error() string {
+	return fmt.Sprintf("cannot convert protector %s from %s to %s",
+		err.Descriptor, err.From, err.To)
+}
+
 // checkForProtectorWithName returns an error if there is already a protector
 // on the filesystem with a specific name (or if we cannot read the necessary
 // data).
@@ -104,6 +143,84 @@ func checkIfUserHasLoginProtector(ctx *Context, uid int64) error {
 	return nil
 }
 
+// CreateNameKey creates the key used to encrypt protector names on the
+// Context's filesystem, if it doesn't already exist. This is done when setting
+// up a filesystem if the encrypt_protector_names config option is set, but it
+// is also done on demand when a protector name needs to be encrypted.
+func CreateNameKey(ctx *Context) error {
+	return ctx.withMetadataLock(func() error {
+		key, err := getOrCreateNameKey(ctx)
+		key.Wipe()
+		return err
+	})
+}
+
+// getOrCreateNameKey must be called with the metadata lock held, so that two
+// processes don't each create a different name key.
+func getOrCreateNameKey(ctx *Context) (*crypto.Key, error) {
+	key, err := ctx.Mount.GetNameKey(ctx.TrustedUser)
+	if !os.IsNotExist(err) {
+		return key, err
+	}
+	util.Debugf("creating protector name key on %q", ctx.Mount.Path)
+	if key, err = crypto.NewRandomKey(metadata.InternalKeyLen); err != nil {
+		return nil, err
+	}
+	if err = ctx.Mount.AddNameKey(key, nil); err != nil {
+		key.Wipe()
+		return nil, err
+	}
+	return key, nil
+}
+
+// sealProtectorName returns the ProtectorData that should actually be written
+// to the filesystem. If protector names are being encrypted (because of the
+// config option, or because this protector's name was already encrypted), the
+// name is replaced with the name encrypted under the filesystem's name key.
+// Otherwise, data is returned unchanged. The metadata lock must be held.
+func sealProtectorName(ctx *Context, data *metadata.ProtectorData) (*metadata.ProtectorData, error) {
+	if data.Name == "" || (!ctx.Config.GetEncryptProtectorNames() && data.EncryptedName == nil) {
+		return data, nil
+	}
+	nameKey, err := getOrCreateNameKey(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer nameKey.Wipe()
+	name, err := crypto.NewKeyFromReader(strings.NewReader(data.Name))
+	if err != nil {
+		return nil, err
+	}
+	defer name.Wipe()
+
+	sealed := proto.Clone(data).(*metadata.ProtectorData)
+	sealed.Name = ""
+	sealed.EncryptedName, err = crypto.Wrap(nameKey, name)
+	return sealed, err
+}
+
+// unsealProtectorName decrypts the name of a protector stored on mnt if the
+// name is encrypted. If the filesystem's name key can't be read, e.g. because
+// the user isn't allowed to read it, the name is just left empty.
+func unsealProtectorName(mnt *filesystem.Mount, trustedUser *user.User, data *metadata.ProtectorData) {
+	if data.GetEncryptedName() == nil || data.Name != "" {
+		return
+	}
+	nameKey, err := mnt.GetNameKey(trustedUser)
+	if err != nil {
+		util.Debugf("cannot decrypt name of protector %s: %v", data.ProtectorDescriptor, err)
+		return
+	}
+	defer nameKey.Wipe()
+	name, err := crypto.Unwrap(nameKey, data.EncryptedName)
+	if err != nil {
+		util.Debugf("cannot decrypt name of protector %s: %v", data.ProtectorDescriptor, err)
+		return
+	}
+	defer name.Wipe()
+	data.Name = string(name.Data())
+}
+
 // Protector represents an unlocked protector, so it contains the ProtectorData
 // as well as the actual protector key. These unlocked Protectors are necessary
 // to unlock policies and create new polices. As with the key struct, a
@@ -163,13 +280,61 @@ func CreateProtector(ctx *Context, name string, keyFn KeyFunc, owner *user.User)
 			return nil, err
 		}
 		fallthrough
-	case metadata.SourceType_custom_passphrase:
+	case metadata.SourceType_custom_passphrase, metadata.SourceType_passphrase_and_raw_key,
+		metadata.SourceType_yubikey:
 		// Our passphrase sources need costs and a random salt.
 		if protector.data.Salt, err = crypto.NewRandomBuffer(metadata.SaltLen); err != nil {
 			return nil, err
 		}
 
 		protector.data.Costs = ctx.Config.HashCosts
+		// The YubiKey is also asked to answer a random challenge.
+		if protector.data.Source == metadata.SourceType_yubikey {
+			if err = setupYubiKeyProtector(ctx.Config, protector.data); err != nil {
+				return nil, err
+			}
+		}
+	case metadata.SourceType_fido2:
+		// The wrapping key is the security key's response to a random
+		// salt, using a credential made for this protector.
+		if protector.data.Fido2Salt, err = crypto.NewRandomBuffer(metadata.FIDO2SaltLen); err != nil {
+			return nil, err
+		}
+		if protector.data.Fido2CredentialId, err = makeFIDO2Credential(name); err != nil {
+			return nil, err
+		}
+	case metadata.SourceType_tpm2:
+		// The wrapping key is a random key sealed by the TPM.
+		if err = sealTPM2WrappingKey(name, protector.data); err != nil {
+			return nil, err
+		}
+	case metadata.SourceType_pkcs11:
+		// The wrapping key is protected by a key pair on the token.
+		if err = wrapPKCS11WrappingKey(ctx.Config, protector.data); err != nil {
+			return nil, err
+		}
+	case metadata.SourceType_kms:
+		// The wrapping key is a random key encrypted by the cloud KMS.
+		if err = wrapKMSWrappingKey(ctx.Config, protector.data); err != nil {
+			return nil, err
+		}
+	case metadata.SourceType_ssh_agent:
+		// The wrapping key is derived from the ssh-agent's signature
+		// of a random challenge.
+		if err = setupSSHAgentProtector(ctx.Config, protector.data); err != nil {
+			return nil, err
+		}
+	case metadata.SourceType_gpg:
+		// The wrapping key is a random key encrypted to the GPG key.
+		if err = wrapGPGWrappingKey(ctx.Config, protector.data); err != nil {
+			return nil, err
+		}
+	case metadata.SourceType_tang:
+		// The wrapping key is recovered by exchanging a key with the
+		// Tang server.
+		if err = setupTangProtector(ctx.Config, protector.data); err != nil {
+			return nil, err
+		}
 	}
 
 	// Randomly create the underlying protector key (and wipe if we fail)
@@ -194,7 +359,7 @@ func CreateProtector(ctx *Context, name string, keyFn KeyFunc, owner *user.User)
 // is still locked in this case, so it must be unlocked before using certain
 // methods.
 func GetProtector(ctx *Context, descriptor string) (*Protector, error) {
-	log.Printf("Getting protector %s", descriptor)
+	util.Debugf("Getting protector %s", descriptor)
 	err := ctx.checkContext()
 	if err != nil {
 		return nil, err
@@ -202,7 +367,11 @@ func GetProtector(ctx *Context, descriptor string) (*Protector, error) {
 
 	protector := &Protector{Context: ctx}
 	protector.data, err = ctx.Mount.GetRegularProtector(descriptor, ctx.TrustedUser)
-	return protector, err
+	if err != nil {
+		return protector, checkDowngraded(err, "protector", descriptor, ctx.Mount)
+	}
+	unsealProtectorName(ctx.Mount, ctx.TrustedUser, protector.data)
+	return protector, ctx.checkProtectorAccess(protector.data)
 }
 
 // GetProtectorFromOption retrieves a protector based on a protector option.
@@ -210,7 +379,7 @@ func GetProtector(ctx *Context, descriptor string) (*Protector, error) {
 // Protector is still locked in this case, so it must be unlocked before using
 // certain methods.
 func GetProtectorFromOption(ctx *Context, option *ProtectorOption) (*Protector, error) {
-	log.Printf("Getting protector %s from option", option.Descriptor())
+	util.Debugf("Getting protector %s from option", option.Descriptor())
 	if err := ctx.checkContext(); err != nil {
 		return nil, err
 	}
@@ -230,10 +399,17 @@ func (protector *Protector) Descriptor() string {
 	return protector.data.ProtectorDescriptor
 }
 
+// Name returns the name of the protector, which is empty for login protectors.
+func (protector *Protector) Name() string {
+	return protector.data.Name
+}
+
 // Destroy removes a protector from the filesystem. The internal key should
 // still be wiped with Lock().
 func (protector *Protector) Destroy() error {
-	return protector.Context.Mount.RemoveProtector(protector.Descriptor())
+	return protector.Context.withMetadataLock(func() error {
+		return protector.Context.Mount.RemoveProtector(protector.Descriptor())
+	})
 }
 
 // Revert destroys a protector if it was created, but does nothing if it was
@@ -258,7 +434,10 @@ func (protector *Protector) Unlock(keyFn KeyFunc) (err error) {
 	if protector.key != nil {
 		return
 	}
-	protector.key, err = unwrapProtectorKey(ProtectorInfo{protector.data}, keyFn)
+	protector.key, err = unwrapProtectorKey(ProtectorInfo{data: protector.data},
+		protector.Context.withKeystore(keyFn), protector.Context.Mount)
+	reportEvent(OperationUnlockProtector, protector.Context.Mount, "",
+		protector.Descriptor(), err == nil)
 	return
 }
 
@@ -271,6 +450,37 @@ func (protector *Protector) Lock() error {
 	return err
 }
 
+// Rename changes the name of a Protector which isn't a login protector. The new
+// name must not be used by any other protector on the filesystem. The name
+// isn't covered by the metadata HMAC, so the Protector needn't be unlocked, and
+// the policies it protects are unaffected.
+func (protector *Protector) Rename(name string) error {
+	ctx := protector.Context
+	if protector.data.Source == metadata.SourceType_pam_passphrase {
+		return &ErrRenameLoginProtector{protector.Descriptor()}
+	}
+	if name == "" {
+		return &ErrMissingProtectorName{protector.data.Source}
+	}
+	newData := proto.Clone(protector.data).(*metadata.ProtectorData)
+	newData.Name = name
+	err := ctx.withMetadataLock(func() error {
+		if err := checkForProtectorWithName(ctx, name); err != nil {
+			return err
+		}
+		data, err := sealProtectorName(ctx, newData)
+		if err != nil {
+			return err
+		}
+		return ctx.Mount.AddProtector(data, protector.ownerIfCreating)
+	})
+	if err != nil {
+		return err
+	}
+	protector.data = newData
+	return nil
+}
+
 // Rewrap updates the data that is wrapping the Protector Key. This is useful if
 // a user's password has changed, for example. The keyFn provided to rewrap
 // the Protector key will only be called once. Requires unlocked Protector.
@@ -278,23 +488,183 @@ func (protector *Protector) Rewrap(keyFn KeyFunc) error {
 	if protector.key == nil {
 		return ErrLocked
 	}
-	wrappingKey, err := getWrappingKey(ProtectorInfo{protector.data}, keyFn, false)
+	wrappingKey, err := getWrappingKey(ProtectorInfo{data: protector.data}, keyFn, false)
 	if err != nil {
 		return err
 	}
 
 	// Revert change to wrapped key on failure
-	oldWrappedKey := protector.data.WrappedKey
+	oldWrappedKey, oldHMAC := protector.data.WrappedKey, protector.data.MetadataHmac
 	defer func() {
 		wrappingKey.Wipe()
 		if err != nil {
 			protector.data.WrappedKey = oldWrappedKey
+			protector.data.MetadataHmac = oldHMAC
 		}
 	}()
 
 	if protector.data.WrappedKey, err = crypto.Wrap(wrappingKey, protector.key); err != nil {
 		return err
 	}
+	if protector.data.MetadataHmac, err = crypto.MetadataHMAC(protector.key, protector.data); err != nil {
+		return err
+	}
+
+	err = protector.Context.withMetadataLock(func() error {
+		data, err := sealProtectorName(protector.Context, protector.data)
+		if err != nil {
+			return err
+		}
+		return protector.Context.Mount.AddProtector(data, protector.ownerIfCreating)
+	})
+	return err
+}
+
+// Resalt unlocks a passphrase Protector using keyFn and then rewraps the
+// Protector key using the same passphrase but a newly generated salt. The
+// Protector key itself is unchanged, so any policies protected by this
+// Protector remain valid. The Protector is left unlocked on success.
+func (protector *Protector) Resalt(keyFn KeyFunc) error {
+	return protector.rehash(keyFn, protector.data.Costs)
+}
+
+// Rehash is like Resalt, but the passphrase is also hashed with the KDF and
+// hashing costs in the Context's Config instead of the Protector's own. This
+// migrates old Protectors to a new KDF or to stronger hashing costs.
+func (protector *Protector) Rehash(keyFn KeyFunc) error {
+	return protector.rehash(keyFn, protector.Context.Config.HashCosts)
+}
+
+// rehash rewraps the Protector key of a passphrase Protector using a new salt
+// and the given hashing costs.
+func (protector *Protector) rehash(keyFn KeyFunc, costs *metadata.HashingCosts) (err error) {
+	switch protector.data.Source {
+	case metadata.SourceType_pam_passphrase, metadata.SourceType_custom_passphrase:
+	default:
+		return &ErrNotPassphraseProtector{protector.Descriptor(), protector.data.Source}
+	}
+
+	// Hold on to a copy of the correct passphrase, so the user doesn't need
+	// to enter it a second time when rewrapping.
+	var passphrase *crypto.Key
+	defer func() { passphrase.Wipe() }()
+	savingKeyFn := func(info ProtectorInfo, retry bool) (*crypto.Key, error) {
+		key, err := keyFn(info, retry)
+		if err != nil {
+			return nil, err
+		}
+		passphrase.Wipe()
+		if passphrase, err = key.Clone(); err != nil {
+			key.Wipe()
+			return nil, err
+		}
+		return key, nil
+	}
+	protector.Lock()
+	if err = protector.Unlock(savingKeyFn); err != nil {
+		return err
+	}
 
-	return protector.Context.Mount.AddProtector(protector.data, protector.ownerIfCreating)
+	oldSalt, oldCosts := protector.data.Salt, protector.data.Costs
+	defer func() {
+		if err != nil {
+			protector.data.Salt, protector.data.Costs = oldSalt, oldCosts
+		}
+	}()
+	if protector.data.Salt, err = crypto.NewRandomBuffer(metadata.SaltLen); err != nil {
+		return err
+	}
+	protector.data.Costs = costs
+	return protector.Rewrap(func(info ProtectorInfo, retry bool) (*crypto.Key, error) {
+		return passphrase.Clone()
+	})
+}
+
+// ConvertSource changes a passphrase Protector between being a login protector
+// (pam_passphrase) and a custom_passphrase protector. Both kinds of protector
+// wrap the Protector key with a hash of the passphrase in the same way, so only
+// the classification in the metadata changes, and any policies protected by
+// this Protector remain valid. When converting to a login protector, the
+// Protector becomes the login protector of the Context's TargetUser, who must
+// not already have one, and name must be empty. When converting to a
+// custom_passphrase protector, name must be a new protector name. keyFn is used
+// to unlock the Protector as if it already had the new source, which checks
+// that the passphrase is the right one for the new source. The Protector is
+// left unlocked on success.
+func (protector *Protector) ConvertSource(source metadata.SourceType, name string,
+	keyFn KeyFunc) (err error) {
+	ctx := protector.Context
+	oldData := protector.data
+	switch oldData.Source {
+	case metadata.SourceType_pam_passphrase, metadata.SourceType_custom_passphrase:
+	default:
+		return &ErrNotPassphraseProtector{protector.Descriptor(), oldData.Source}
+	}
+	if source == oldData.Source {
+		return &ErrCannotConvertProtector{protector.Descriptor(), oldData.Source, source}
+	}
+
+	newData := proto.Clone(oldData).(*metadata.ProtectorData)
+	newData.Source = source
+	newData.Name = ""
+	newData.EncryptedName = nil
+	// The old HMAC is checked below, and a new one made for the new source.
+	newData.MetadataHmac = nil
+	switch source {
+	case metadata.SourceType_pam_passphrase:
+		if name != "" {
+			return &ErrLoginProtectorName{name, ctx.TargetUser}
+		}
+		newData.Uid = int64(util.AtoiOrPanic(ctx.TargetUser.Uid))
+		if err = checkIfUserHasLoginProtector(ctx, newData.Uid); err != nil {
+			return err
+		}
+	case metadata.SourceType_custom_passphrase:
+		if name == "" {
+			return &ErrMissingProtectorName{source}
+		}
+		if err = checkForProtectorWithName(ctx, name); err != nil {
+			return err
+		}
+		newData.Uid = 0
+		newData.Name = name
+	default:
+		return &ErrCannotConvertProtector{protector.Descriptor(), oldData.Source, source}
+	}
+
+	protector.Lock()
+	protector.data = newData
+	defer func() {
+		if err != nil {
+			protector.Lock()
+			protector.data = oldData
+		}
+	}()
+	if err = protector.Unlock(keyFn); err != nil {
+		return err
+	}
+	err = checkMetadataIntegrity(protector.key, oldData, "protector",
+		protector.Descriptor(), ctx.Mount)
+	if err != nil {
+		return err
+	}
+	if newData.MetadataHmac, err = crypto.MetadataHMAC(protector.key, newData); err != nil {
+		return err
+	}
+	return ctx.withMetadataLock(func() error {
+		// Check again, in case another process made a conflicting
+		// change while the passphrase was being entered.
+		if source == metadata.SourceType_pam_passphrase {
+			if err := checkIfUserHasLoginProtector(ctx, newData.Uid); err != nil {
+				return err
+			}
+		} else if err := checkForProtectorWithName(ctx, name); err != nil {
+			return err
+		}
+		data, err := sealProtectorName(ctx, newData)
+		if err != nil {
+			return err
+		}
+		return ctx.Mount.AddProtector(data, nil)
+	})
 }
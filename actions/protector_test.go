@@ -21,11 +21,15 @@ package actions
 
 import (
 	"bytes"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/pkg/errors"
+	"google.golang.org/protobuf/proto"
 
 	"github.com/google/fscrypt/crypto"
+	"github.com/google/fscrypt/metadata"
 )
 
 const testProtectorName = "my favorite protector"
@@ -41,6 +45,58 @@ func badCallback(info ProtectorInfo, retry bool) (*crypto.Key, error) {
 	return nil, errCallback
 }
 
+// useProtectorSource makes testContext create protectors with the given source
+// until the test ends. setBackend installs the fake backend of the source, and
+// removes it again when called with false. Other changes the test makes to the
+// config are undone as well.
+func useProtectorSource(t *testing.T, source metadata.SourceType, setBackend func(installed bool)) {
+	oldConfig := proto.Clone(testContext.Config)
+	testContext.Config.Source = source
+	setBackend(true)
+	t.Cleanup(func() {
+		setBackend(false)
+		proto.Reset(testContext.Config)
+		proto.Merge(testContext.Config, oldConfig)
+	})
+}
+
+// testProtectorSource creates a protector with the source of testContext,
+// checks its metadata with checkData, and checks that the metadata written to
+// disk can be unlocked with keyFn. If revoke is given, unlocking must then fail
+// with revokedErr once revoke has taken away the backend's access to the key.
+// The protector is destroyed when the test ends.
+func testProtectorSource(t *testing.T, name string, keyFn KeyFunc,
+	checkData func(data *metadata.ProtectorData) bool, revoke func(), revokedErr error) {
+	p, err := CreateProtector(testContext, name, keyFn, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { p.Destroy() })
+	p.Lock()
+	source := testContext.Config.Source
+	if checkData != nil && !checkData(p.data) {
+		t.Fatalf("bad %s metadata: %v", source, p.data)
+	}
+
+	// Check that the metadata written to disk can be unlocked.
+	p, err = GetProtector(testContext, p.Descriptor())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = p.Unlock(keyFn); err != nil {
+		t.Fatal(err)
+	}
+	p.Lock()
+
+	if revoke == nil {
+		return
+	}
+	revoke()
+	if err = p.Unlock(keyFn); err != revokedErr {
+		t.Errorf("%s protector with its key revoked: expected %v, got %v", source, revokedErr, err)
+	}
+}
+
 // Tests that we can create a valid protector.
 func TestCreateProtector(t *testing.T) {
 	p, err := CreateProtector(testContext, testProtectorName, goodCallback, nil)
@@ -63,3 +119,391 @@ func TestBadCallback(t *testing.T) {
 		t.Error("callback error was not relayed back to caller")
 	}
 }
+
+// Tests that resalting a protector changes its salt but not its key.
+func TestResaltProtector(t *testing.T) {
+	p, err := CreateProtector(testContext, testProtectorName, goodCallback, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Destroy()
+	defer p.Lock()
+
+	oldSalt := p.data.Salt
+	oldKey, err := p.key.Clone()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer oldKey.Wipe()
+
+	if err = p.Resalt(goodCallback); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(oldSalt, p.data.Salt) {
+		t.Error("salt was not changed")
+	}
+
+	p2, err := GetProtector(testContext, p.Descriptor())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = p2.Unlock(goodCallback); err != nil {
+		t.Fatal(err)
+	}
+	defer p2.Lock()
+	if !p2.key.Equals(oldKey) {
+		t.Error("protector key changed after resalting")
+	}
+}
+
+// Tests that rehashing a protector switches it to the KDF and costs of the
+// config, without changing its key.
+func TestRehashProtector(t *testing.T) {
+	p, err := CreateProtector(testContext, testProtectorName, goodCallback, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Destroy()
+	defer p.Lock()
+	oldKey, err := p.key.Clone()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer oldKey.Wipe()
+
+	oldCosts := testContext.Config.HashCosts
+	defer func() { testContext.Config.HashCosts = oldCosts }()
+	testContext.Config.HashCosts = &metadata.HashingCosts{
+		Time: 1, Memory: 1 << 10, Parallelism: 1, Kdf: metadata.KDF_scrypt,
+	}
+	if err = p.Rehash(goodCallback); err != nil {
+		t.Fatal(err)
+	}
+
+	p2, err := GetProtector(testContext, p.Descriptor())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p2.data.Costs.Kdf != metadata.KDF_scrypt {
+		t.Errorf("protector wasn't rehashed with scrypt: %v", p2.data.Costs)
+	}
+	if err = p2.Unlock(goodCallback); err != nil {
+		t.Fatal(err)
+	}
+	defer p2.Lock()
+	if !p2.key.Equals(oldKey) {
+		t.Error("protector key changed after rehashing")
+	}
+}
+
+// Tests that rewraps of the same protector are serialized by the metadata lock,
+// even when done concurrently, and that the protector is left intact.
+func TestConcurrentRewrap(t *testing.T) {
+	p, err := CreateProtector(testContext, testProtectorName, goodCallback, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Destroy()
+	defer p.Lock()
+
+	// A rewrap can't finish while another process holds the lock.
+	lock, err := testContext.Mount.LockMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- p.Rewrap(goodCallback) }()
+	select {
+	case err = <-done:
+		lock.Unlock()
+		t.Fatalf("rewrap finished while the metadata was locked: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	lock.Unlock()
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	// Rewrap the protector from two goroutines at once, each with its own
+	// copy of the protector.
+	const workers = 2
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p2, err := GetProtector(testContext, p.Descriptor())
+			if err == nil {
+				err = p2.Unlock(goodCallback)
+			}
+			for j := 0; err == nil && j < 5; j++ {
+				err = p2.Rewrap(goodCallback)
+			}
+			if p2 != nil {
+				p2.Lock()
+			}
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	p3, err := GetProtector(testContext, p.Descriptor())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = p3.Unlock(goodCallback); err != nil {
+		t.Fatal(err)
+	}
+	defer p3.Lock()
+	if !p3.key.Equals(p.key) {
+		t.Error("protector key changed after concurrent rewraps")
+	}
+}
+
+// Tests that protector names are stored encrypted when configured to, and that
+// they are decrypted again when the protector is loaded.
+func TestEncryptedProtectorName(t *testing.T) {
+	testContext.Config.EncryptProtectorNames = true
+	defer func() { testContext.Config.EncryptProtectorNames = false }()
+
+	p, err := CreateProtector(testContext, testProtectorName, goodCallback, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Destroy()
+	defer p.Lock()
+
+	data, err := testContext.Mount.GetRegularProtector(p.Descriptor(), testContext.TrustedUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data.Name != "" || data.EncryptedName == nil {
+		t.Fatalf("protector name was not encrypted on disk: %v", data)
+	}
+
+	p2, err := GetProtector(testContext, p.Descriptor())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := p2.data.Name; name != testProtectorName {
+		t.Errorf("decrypted name is %q, expected %q", name, testProtectorName)
+	}
+	option := testContext.getProtectorOption(p.Descriptor())
+	if option.LoadError != nil {
+		t.Fatal(option.LoadError)
+	}
+	if name := option.Name(); name != testProtectorName {
+		t.Errorf("option name is %q, expected %q", name, testProtectorName)
+	}
+}
+
+// Tests that renaming a protector changes its name on disk (encrypting the new
+// name if the old one was encrypted) without changing its key.
+func TestRenameProtector(t *testing.T) {
+	testContext.Config.EncryptProtectorNames = true
+	p, err := CreateProtector(testContext, testProtectorName, goodCallback, nil)
+	testContext.Config.EncryptProtectorNames = false
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Destroy()
+	defer p.Lock()
+	p2, err := CreateProtector(testContext, testProtectorName2, goodCallback, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p2.Destroy()
+	defer p2.Lock()
+
+	if err = p.Rename(testProtectorName2); err == nil {
+		t.Error("should not be able to reuse an existing protector name")
+	}
+	if _, ok := p.Rename("").(*ErrMissingProtectorName); !ok {
+		t.Error("protector should need a name")
+	}
+	loaded, err := GetProtector(testContext, p.Descriptor())
+	if err != nil {
+		t.Fatal(err)
+	}
+	const newName = "renamed"
+	if err = loaded.Rename(newName); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := testContext.Mount.GetRegularProtector(p.Descriptor(), testContext.TrustedUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data.Name != "" || data.EncryptedName == nil {
+		t.Errorf("new protector name was not encrypted on disk: %v", data)
+	}
+	p3, err := GetProtector(testContext, p.Descriptor())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p3.data.Name != newName {
+		t.Errorf("name is %q, expected %q", p3.data.Name, newName)
+	}
+	if err = p3.Unlock(goodCallback); err != nil {
+		t.Errorf("renamed protector can't be unlocked: %v", err)
+	}
+	p3.Lock()
+}
+
+// Tests that a custom_passphrase protector can be converted to a login
+// protector and back, without changing its key.
+func TestConvertProtectorSource(t *testing.T) {
+	p, err := CreateProtector(testContext, testProtectorName, goodCallback, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Destroy()
+	defer p.Lock()
+	oldKey, err := p.key.Clone()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer oldKey.Wipe()
+
+	if err = p.ConvertSource(metadata.SourceType_pam_passphrase, testProtectorName,
+		goodCallback); err == nil {
+		t.Error("login protector should not be allowed a name")
+	}
+	if err = p.ConvertSource(metadata.SourceType_custom_passphrase, testProtectorName2,
+		goodCallback); err == nil {
+		t.Error("protector should not be converted to its own source")
+	}
+	if err = p.ConvertSource(metadata.SourceType_pam_passphrase, "", badCallback); err != errCallback {
+		t.Errorf("callback error was not relayed back to caller: %v", err)
+	}
+	if p.data.Source != metadata.SourceType_custom_passphrase || p.data.Name != testProtectorName {
+		t.Error("failed conversion changed the protector")
+	}
+
+	if err = p.ConvertSource(metadata.SourceType_pam_passphrase, "", goodCallback); err != nil {
+		t.Fatal(err)
+	}
+	p2, err := GetProtector(testContext, p.Descriptor())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p2.data.Source != metadata.SourceType_pam_passphrase || p2.data.Name != "" {
+		t.Errorf("protector was not converted to a login protector: %v", p2.data)
+	}
+	if err = p2.Unlock(goodCallback); err != nil {
+		t.Fatal(err)
+	}
+	defer p2.Lock()
+	if !p2.key.Equals(oldKey) {
+		t.Error("protector key changed after conversion")
+	}
+
+	// The user now has a login protector, so can't get another one.
+	p3, err := CreateProtector(testContext, testProtectorName2, goodCallback, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p3.Destroy()
+	defer p3.Lock()
+	err = p3.ConvertSource(metadata.SourceType_pam_passphrase, "", goodCallback)
+	if _, ok := err.(*ErrLoginProtectorExists); !ok {
+		t.Errorf("expected ErrLoginProtectorExists, got %v", err)
+	}
+
+	if err = p2.ConvertSource(metadata.SourceType_custom_passphrase, testProtectorName2,
+		goodCallback); err == nil {
+		t.Error("should not be able to reuse an existing protector name")
+	}
+	if err = p2.ConvertSource(metadata.SourceType_custom_passphrase, testProtectorName,
+		goodCallback); err != nil {
+		t.Fatal(err)
+	}
+	if p2.data.Source != metadata.SourceType_custom_passphrase || p2.data.Uid != 0 {
+		t.Errorf("protector was not converted to a custom protector: %v", p2.data)
+	}
+}
+
+// Tests looking up protectors by name, including when the name is ambiguous.
+func TestProtectorDescriptorsWithName(t *testing.T) {
+	p, err := CreateProtector(testContext, testProtectorName, goodCallback, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Destroy()
+	defer p.Lock()
+
+	descriptors, err := testContext.ProtectorDescriptorsWithName(testProtectorName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(descriptors) != 1 || descriptors[0] != p.Descriptor() {
+		t.Errorf("found %v, expected [%s]", descriptors, p.Descriptor())
+	}
+	if descriptors, err = testContext.ProtectorDescriptorsWithName(testProtectorName2); err != nil {
+		t.Fatal(err)
+	} else if len(descriptors) != 0 {
+		t.Errorf("found %v for a name no protector has", descriptors)
+	}
+
+	// CreateProtector() refuses duplicate names, so write a copy of the
+	// protector with a different descriptor directly.
+	duplicate := proto.Clone(p.data).(*metadata.ProtectorData)
+	duplicate.ProtectorDescriptor = "0123456789abcdef"
+	if err = testContext.Mount.AddProtector(duplicate, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer testContext.Mount.RemoveProtector(duplicate.ProtectorDescriptor)
+
+	if descriptors, err = testContext.ProtectorDescriptorsWithName(testProtectorName); err != nil {
+		t.Fatal(err)
+	} else if len(descriptors) != 2 {
+		t.Errorf("found %v, expected two protectors", descriptors)
+	}
+}
+
+// twoFactorCallback returns the passphrase, and keyByte repeated as the raw key.
+func twoFactorCallback(keyByte byte) KeyFunc {
+	return func(info ProtectorInfo, retry bool) (*crypto.Key, error) {
+		if retry {
+			return nil, errCallback
+		}
+		if !info.KeyFileFactor() {
+			return goodCallback(info, retry)
+		}
+		rawKey := bytes.Repeat([]byte{keyByte}, metadata.InternalKeyLen)
+		return crypto.NewFixedLengthKeyFromReader(bytes.NewReader(rawKey), len(rawKey))
+	}
+}
+
+// Tests that a passphrase_and_raw_key protector needs both its passphrase and
+// its raw key to be unlocked.
+func TestTwoFactorProtector(t *testing.T) {
+	oldSource := testContext.Config.Source
+	testContext.Config.Source = metadata.SourceType_passphrase_and_raw_key
+	defer func() { testContext.Config.Source = oldSource }()
+
+	p, err := CreateProtector(testContext, testProtectorName, twoFactorCallback(1), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Destroy()
+	p.Lock()
+
+	if err = p.Unlock(twoFactorCallback(1)); err != nil {
+		t.Fatal(err)
+	}
+	p.Lock()
+	if err = p.Unlock(twoFactorCallback(2)); err != errCallback {
+		t.Errorf("unlocking with the wrong raw key: expected %v, got %v", errCallback, err)
+	}
+	if err = p.Unlock(goodCallback); err == nil {
+		t.Error("unlocking with the passphrase as the raw key should fail")
+	}
+}
@@ -0,0 +1,128 @@
+/*
+ * rollback.go - undoing the metadata changes of an operation which fails
+ * partway through
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package actions
+
+import (
+	"github.com/google/fscrypt/filesystem"
+	"github.com/google/fscrypt/util"
+)
+
+// Rollback tracks the metadata created during an operation which consists of
+// several steps, such as creating a protector and policy and then encrypting a
+// directory with them. The typical usage is:
+//
+//	rollback := &Rollback{}
+//	defer rollback.Run()
+//	err := rollback.Begin(mounts...)
+//	... create metadata, calling rollback.AddProtector() and friends ...
+//	rollback.Commit()
+//
+// so that if the operation fails before Commit() is called, everything it
+// created is removed again. Begin() journals the changes to the metadata, so
+// that they are also rolled back if the process dies before Commit() is called.
+// The zero value is an empty Rollback.
+type Rollback struct {
+	reverts      []func() error
+	transactions []*filesystem.Transaction
+}
+
+// Begin starts a metadata transaction on each of the given filesystems which is
+// set up for use with fscrypt. A filesystem which is given more than once gets a
+// single transaction.
+func (rollback *Rollback) Begin(mounts ...*filesystem.Mount) error {
+	for i, mount := range mounts {
+		if containsMount(mounts[:i], mount) || mount.CheckSetup(nil) != nil {
+			continue
+		}
+		txn, err := mount.BeginTransaction()
+		if err != nil {
+			return err
+		}
+		rollback.transactions = append(rollback.transactions, txn)
+	}
+	return nil
+}
+
+// containsMount returns true if mounts contains mount.
+func containsMount(mounts []*filesystem.Mount, mount *filesystem.Mount) bool {
+	for _, m := range mounts {
+		if m == mount {
+			return true
+		}
+	}
+	return false
+}
+
+// Applying records that policy is about to be applied to the directory at path,
+// so that if the process dies after that, the metadata is kept if the directory
+// uses the policy.
+func (rollback *Rollback) Applying(policy *Policy, path string) error {
+	for _, txn := range rollback.transactions {
+		if err := txn.Applying(path, policy.Descriptor()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AddProtector arranges for protector to be reverted if the operation fails.
+// This does nothing to a protector which wasn't created by the operation.
+func (rollback *Rollback) AddProtector(protector *Protector) {
+	rollback.reverts = append(rollback.reverts, protector.Revert)
+}
+
+// AddPolicy arranges for policy to be reverted if the operation fails. This
+// removes the policy's metadata (and any links to protectors on other
+// filesystems that were added for it), but does nothing to a policy which
+// wasn't created by the operation.
+func (rollback *Rollback) AddPolicy(policy *Policy) {
+	rollback.reverts = append(rollback.reverts, policy.Revert)
+}
+
+// Commit marks the operation as successful, so Run() won't remove anything.
+func (rollback *Rollback) Commit() {
+	rollback.reverts = nil
+	for _, txn := range rollback.transactions {
+		if err := txn.Commit(); err != nil {
+			util.Errorf("committing metadata transaction: %v", err)
+		}
+	}
+	rollback.transactions = nil
+}
+
+// Run reverts everything that was added, in the reverse order of creation,
+// unless Commit() was called. Then the transactions are aborted, restoring any
+// other metadata which was changed. Errors are logged rather than returned,
+// since the error which caused the rollback is the one that matters to the
+// caller.
+func (rollback *Rollback) Run() {
+	for i := len(rollback.reverts) - 1; i >= 0; i-- {
+		if err := rollback.reverts[i](); err != nil {
+			util.Errorf("rollback: %v", err)
+		}
+	}
+	rollback.reverts = nil
+	for _, txn := range rollback.transactions {
+		if err := txn.Abort(); err != nil {
+			util.Errorf("rollback: %v", err)
+		}
+	}
+	rollback.transactions = nil
+}
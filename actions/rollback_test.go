@@ -0,0 +1,117 @@
+/*
+ * rollback_test.go - tests for undoing the metadata changes of a failed
+ * operation
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package actions
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// countMetadata returns the number of protectors and policies on the test
+// filesystem.
+func countMetadata(t *testing.T) (int, int) {
+	protectors, err := testContext.Mount.ListProtectors(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	policies, err := testContext.Mount.ListPolicies(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(protectors), len(policies)
+}
+
+// Tests that when applying a newly created policy fails, running the rollback
+// leaves no orphaned protectors or policies behind.
+func TestRollbackAfterApplyFailure(t *testing.T) {
+	numProtectors, numPolicies := countMetadata(t)
+
+	// Setting a policy on a regular file always fails.
+	file, err := os.CreateTemp(testContext.Mount.Path, "fscrypt-rollback")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	defer os.Remove(file.Name())
+
+	err = func() error {
+		rollback := &Rollback{}
+		defer rollback.Run()
+
+		protector, err := CreateProtector(testContext, testProtectorName, goodCallback, nil)
+		if err != nil {
+			return err
+		}
+		defer protector.Lock()
+		rollback.AddProtector(protector)
+
+		policy, err := CreatePolicy(testContext, protector)
+		if err != nil {
+			return err
+		}
+		defer policy.Lock()
+		rollback.AddPolicy(policy)
+
+		_, recoveryProtector, err := AddRecoveryPassphrase(policy, filepath.Base(file.Name()))
+		if err != nil {
+			return err
+		}
+		defer recoveryProtector.Lock()
+		rollback.AddProtector(recoveryProtector)
+
+		if err := policy.Apply(file.Name()); err != nil {
+			return err
+		}
+		rollback.Commit()
+		return nil
+	}()
+	if err == nil {
+		t.Fatal("applying a policy to a regular file should fail")
+	}
+
+	if p, q := countMetadata(t); p != numProtectors || q != numPolicies {
+		t.Errorf("rollback left %d protectors and %d policies behind",
+			p-numProtectors, q-numPolicies)
+	}
+}
+
+// Tests that nothing is removed once the operation has been committed.
+func TestRollbackCommit(t *testing.T) {
+	protector, policy, err := makeBoth()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanupProtector(protector)
+	defer cleanupPolicy(policy)
+
+	rollback := &Rollback{}
+	rollback.AddProtector(protector)
+	rollback.AddPolicy(policy)
+	rollback.Commit()
+	rollback.Run()
+
+	if _, err := GetProtector(testContext, protector.Descriptor()); err != nil {
+		t.Errorf("protector was removed after commit: %v", err)
+	}
+	if _, err := GetPolicy(testContext, policy.Descriptor()); err != nil {
+		t.Errorf("policy was removed after commit: %v", err)
+	}
+}
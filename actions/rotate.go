@@ -0,0 +1,158 @@
+/*
+ * rotate.go - Replacing a protector in all the policies it protects.
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package actions
+
+import (
+	"github.com/pkg/errors"
+
+	"github.com/google/fscrypt/filesystem"
+	"github.com/google/fscrypt/util"
+)
+
+// PoliciesProtectedBy returns the policies on all the filesystems set up for use
+// with fscrypt which are protected by protector, either directly or through a
+// link. The policies are read as the trusted user of the protector's Context,
+// and are still locked. Policies which can't be read are skipped.
+func PoliciesProtectedBy(protector *Protector) ([]*Policy, error) {
+	mounts, err := filesystem.AllFilesystems()
+	if err != nil {
+		return nil, err
+	}
+	var policies []*Policy
+	for _, mount := range mounts {
+		if mount.CheckSetup(nil) != nil {
+			continue
+		}
+		ctx := *protector.Context
+		ctx.Mount = mount
+		descriptors, err := mount.ListPolicies(ctx.TrustedUser)
+		if err != nil {
+			return nil, errors.Wrapf(err, "listing policies on %s", mount.Path)
+		}
+		for _, descriptor := range descriptors {
+			policy, err := GetPolicy(&ctx, descriptor)
+			if err != nil {
+				util.Debugf("skipping policy %s: %v", descriptor, err)
+				continue
+			}
+			if policy.UsesProtector(protector) {
+				policies = append(policies, policy)
+			}
+		}
+	}
+	return policies, nil
+}
+
+// RotateProtector replaces oldProtector with newProtector in each of the given
+// policies, and then destroys oldProtector. Both protectors must be unlocked.
+// Every policy is first unlocked with oldProtector and protected with
+// newProtector, and the rewrap is verified by reading the policy back and
+// unlocking it with newProtector. Only then is oldProtector removed from the
+// policies (along with the links to it which are no longer used) and
+// destroyed. If any step fails, the metadata of the policies and protectors is
+// restored, and newProtector is destroyed if it was newly created.
+func RotateProtector(oldProtector, newProtector *Protector, policies []*Policy) (err error) {
+	if oldProtector.key == nil || newProtector.key == nil {
+		return ErrLocked
+	}
+	mounts := []*filesystem.Mount{oldProtector.Context.Mount, newProtector.Context.Mount}
+	for _, policy := range policies {
+		mounts = append(mounts, policy.Context.Mount)
+	}
+
+	// newProtector exists before the transactions begin, so aborting them
+	// would restore it. It is reverted only once they have been aborted.
+	defer func() {
+		if err != nil {
+			if revertErr := newProtector.Revert(); revertErr != nil {
+				util.Errorf("rollback: %v", revertErr)
+			}
+		}
+	}()
+	rollback := &Rollback{}
+	defer rollback.Run()
+	if err := rollback.Begin(mounts...); err != nil {
+		return err
+	}
+
+	for _, policy := range policies {
+		if err := policy.UnlockWithProtector(oldProtector); err != nil {
+			return errors.Wrapf(err, "policy %s", policy.Descriptor())
+		}
+		defer policy.Lock()
+		if err := policy.AddProtector(newProtector); err != nil {
+			return errors.Wrapf(err, "policy %s", policy.Descriptor())
+		}
+		if err := verifyRewrap(policy, newProtector); err != nil {
+			return errors.Wrapf(err, "verifying policy %s", policy.Descriptor())
+		}
+	}
+
+	for _, policy := range policies {
+		if err := policy.RemoveProtector(oldProtector.Descriptor()); err != nil {
+			return errors.Wrapf(err, "policy %s", policy.Descriptor())
+		}
+		if policy.Context.Mount == oldProtector.Context.Mount {
+			continue
+		}
+		if err := policy.Context.removeUnusedLink(oldProtector.Descriptor()); err != nil {
+			return err
+		}
+	}
+	if err := oldProtector.Destroy(); err != nil {
+		return err
+	}
+	rollback.Commit()
+	return nil
+}
+
+// verifyRewrap checks that the policy, as now stored on the filesystem, can be
+// unlocked with protector.
+func verifyRewrap(policy *Policy, protector *Protector) error {
+	stored, err := GetPolicy(policy.Context, policy.Descriptor())
+	if err != nil {
+		return err
+	}
+	defer stored.Lock()
+	return stored.UnlockWithProtector(protector)
+}
+
+// removeUnusedLink removes the link to the protector with the given descriptor
+// from the Context's filesystem, unless there is no such link or some policy
+// there still uses it. A regular protector with the descriptor is never
+// removed.
+func (ctx *Context) removeUnusedLink(descriptor string) error {
+	return ctx.withMetadataLock(func() error {
+		linked, err := ctx.Mount.ListLinkedProtectors()
+		if err != nil {
+			return err
+		}
+		for _, linkedDescriptor := range linked {
+			if linkedDescriptor != descriptor {
+				continue
+			}
+			isUsed, err := ctx.isProtectorUsed(descriptor)
+			if isUsed || err != nil {
+				return err
+			}
+			return ctx.Mount.RemoveProtector(descriptor)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,114 @@
+/*
+ * rotate_test.go - Tests for replacing a protector in all the policies it
+ * protects.
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package actions
+
+import (
+	"testing"
+)
+
+// Tests that rotating a protector moves every policy over to the new protector
+// and destroys the old one.
+func TestRotateProtector(t *testing.T) {
+	oldProtector, policy, err := makeBoth()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanupPolicy(policy)
+	defer cleanupProtector(oldProtector)
+	newProtector, err := CreateProtector(testContext, testProtectorName2, goodCallback, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanupProtector(newProtector)
+
+	policies, err := PoliciesProtectedBy(oldProtector)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(policies) != 1 || policies[0].Descriptor() != policy.Descriptor() {
+		t.Fatalf("expected policy %s to be protected by the protector", policy.Descriptor())
+	}
+	if err = RotateProtector(oldProtector, newProtector, policies); err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err := GetPolicy(testContext, policy.Descriptor())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.UsesProtector(oldProtector) {
+		t.Error("policy is still protected by the old protector")
+	}
+	if err = stored.UnlockWithProtector(newProtector); err != nil {
+		t.Errorf("policy can't be unlocked with the new protector: %v", err)
+	}
+	stored.Lock()
+	if _, err = GetProtector(testContext, oldProtector.Descriptor()); err == nil {
+		t.Error("old protector wasn't destroyed")
+	}
+}
+
+// Tests that if rotating a protector fails for one policy, none of the policies
+// are changed and the new protector is removed again.
+func TestRotateProtectorRollback(t *testing.T) {
+	oldProtector, policy, err := makeBoth()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanupPolicy(policy)
+	defer cleanupProtector(oldProtector)
+	otherProtector, err := CreateProtector(testContext, testProtectorName2, goodCallback, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanupProtector(otherProtector)
+	otherPolicy, err := CreatePolicy(testContext, otherProtector)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanupPolicy(otherPolicy)
+	newProtector, err := CreateProtector(testContext, testProtectorName+"3", goodCallback, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanupProtector(newProtector)
+
+	// otherPolicy isn't protected by oldProtector, so it can't be unlocked.
+	policies := []*Policy{policy, otherPolicy}
+	policy.Lock()
+	otherPolicy.Lock()
+	if err = RotateProtector(oldProtector, newProtector, policies); err == nil {
+		t.Fatal("rotating a protector should fail for a policy it doesn't protect")
+	}
+
+	stored, err := GetPolicy(testContext, policy.Descriptor())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stored.UsesProtector(oldProtector) || stored.UsesProtector(newProtector) {
+		t.Error("policy wasn't restored")
+	}
+	if _, err = GetProtector(testContext, oldProtector.Descriptor()); err != nil {
+		t.Errorf("old protector was removed: %v", err)
+	}
+	if _, err = GetProtector(testContext, newProtector.Descriptor()); err == nil {
+		t.Error("new protector wasn't removed")
+	}
+}
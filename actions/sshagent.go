@@ -0,0 +1,171 @@
+/*
+ * sshagent.go - Protectors whose wrapping key is derived from an ssh-agent
+ * signature
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package actions
+
+import (
+	"bytes"
+	"net"
+	"os"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+
+	"github.com/google/fscrypt/crypto"
+	"github.com/google/fscrypt/metadata"
+	"github.com/google/fscrypt/util"
+)
+
+// ssh-agent errors
+var (
+	ErrNoSSHAgent       = errors.New("no ssh-agent is available (SSH_AUTH_SOCK is not set)")
+	ErrNoSSHKey         = errors.New("the ssh-agent has no suitable Ed25519 or RSA key")
+	ErrSSHAgentLacksKey = errors.New("the ssh-agent doesn't have the protector's SSH key")
+	ErrSSHWrongKey      = errors.New("the key derived from the ssh-agent's signature is incorrect")
+)
+
+// The wrapping key of an ssh_agent protector is derived from the ssh-agent's
+// signature of a random challenge, so only keys whose signatures are
+// deterministic can be used: Ed25519 keys, and RSA keys (with PKCS #1 v1.5
+// signatures). ECDSA signatures are randomized, and security key ("sk-") keys
+// sign a counter.
+var sshDeterministicKeyTypes = map[string]bool{ssh.KeyAlgoED25519: true, ssh.KeyAlgoRSA: true}
+
+// sshKeyFingerprint returns the SHA256 fingerprint of an SSH public key in the
+// wire format, or "" if it is invalid.
+func sshKeyFingerprint(publicKey []byte) string {
+	key, err := ssh.ParsePublicKey(publicKey)
+	if err != nil {
+		return ""
+	}
+	return ssh.FingerprintSHA256(key)
+}
+
+// dialSSHAgent connects to the ssh-agent given by SSH_AUTH_SOCK. Close the
+// returned connection when done.
+func dialSSHAgent() (agent.ExtendedAgent, net.Conn, error) {
+	socket := os.Getenv("SSH_AUTH_SOCK")
+	if socket == "" {
+		return nil, nil, ErrNoSSHAgent
+	}
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "connecting to ssh-agent")
+	}
+	return agent.NewClient(conn), conn, nil
+}
+
+// findSSHKey returns the agent's key whose SHA256 fingerprint or comment is
+// name, or its first suitable key if name is empty.
+func findSSHKey(client agent.Agent, name string) (*agent.Key, error) {
+	keys, err := client.List()
+	if err != nil {
+		return nil, errors.Wrap(err, "listing ssh-agent keys")
+	}
+	for _, key := range keys {
+		if !sshDeterministicKeyTypes[key.Type()] {
+			util.Debugf("skipping %s key %q", key.Type(), key.Comment)
+			continue
+		}
+		if name == "" || name == key.Comment || name == ssh.FingerprintSHA256(key) {
+			return key, nil
+		}
+	}
+	if name != "" {
+		return nil, errors.Wrapf(ErrNoSSHKey, "no key matches %q", name)
+	}
+	return nil, ErrNoSSHKey
+}
+
+// setupSSHAgentProtector stores the public key from the agent set in config,
+// and a new random challenge, for an ssh_agent protector in data.
+func setupSSHAgentProtector(config *metadata.Config, data *metadata.ProtectorData) error {
+	client, conn, err := dialSSHAgent()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	key, err := findSSHKey(client, config.GetSshKey())
+	if err != nil {
+		return err
+	}
+	util.Debugf("using SSH key %s %q", ssh.FingerprintSHA256(key), key.Comment)
+	data.SshPublicKey = key.Marshal()
+	data.SshChallenge, err = crypto.NewRandomBuffer(metadata.SSHChallengeLen)
+	return err
+}
+
+// getSSHAgentWrappingKey gets the wrapping key of an ssh_agent protector by
+// having the ssh-agent sign its challenge.
+func getSSHAgentWrappingKey(info ProtectorInfo, retry bool) (*crypto.Key, error) {
+	// The agent always gives the same signature, so a wrong key can't be
+	// fixed by asking it again.
+	if retry {
+		return nil, ErrSSHWrongKey
+	}
+	publicKey, err := ssh.ParsePublicKey(info.data.SshPublicKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "protector's SSH public key")
+	}
+	client, conn, err := dialSSHAgent()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	// Check that the agent has the key first, so that its absence isn't
+	// reported as a signing failure.
+	keys, err := client.List()
+	if err != nil {
+		return nil, errors.Wrap(err, "listing ssh-agent keys")
+	}
+	found := false
+	for _, key := range keys {
+		if bytes.Equal(key.Marshal(), info.data.SshPublicKey) {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil, ErrSSHAgentLacksKey
+	}
+
+	var flags agent.SignatureFlags
+	if publicKey.Type() == ssh.KeyAlgoRSA {
+		flags = agent.SignatureFlagRsaSha256
+	}
+	util.Debugf("signing challenge of protector %s with SSH key %s",
+		info.Descriptor(), ssh.FingerprintSHA256(publicKey))
+	signature, err := client.SignWithFlags(publicKey, info.data.SshChallenge, flags)
+	if err != nil {
+		return nil, errors.Wrap(err, "ssh-agent signature")
+	}
+	if err = publicKey.Verify(info.data.SshChallenge, signature); err != nil {
+		return nil, errors.Wrap(err, "ssh-agent signature")
+	}
+	defer wipeBuffer(signature.Blob)
+	signatureKey, err := crypto.NewFixedLengthKeyFromReader(
+		bytes.NewReader(signature.Blob), len(signature.Blob))
+	if err != nil {
+		return nil, err
+	}
+	defer signatureKey.Wipe()
+	return crypto.CombineKeys(info.data.SshChallenge, signatureKey)
+}
@@ -0,0 +1,131 @@
+/*
+ * sshagent_test.go - tests for protectors derived from ssh-agent signatures
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package actions
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+
+	"github.com/google/fscrypt/metadata"
+)
+
+// startSSHAgent serves an in-memory ssh-agent on a socket given by
+// SSH_AUTH_SOCK, and uses the ssh_agent source.
+func startSSHAgent(t *testing.T) agent.Agent {
+	keyring := agent.NewKeyring()
+	socket := filepath.Join(t.TempDir(), "agent.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				agent.ServeAgent(keyring, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	oldSocket := os.Getenv("SSH_AUTH_SOCK")
+	useProtectorSource(t, metadata.SourceType_ssh_agent, func(installed bool) {
+		if installed {
+			os.Setenv("SSH_AUTH_SOCK", socket)
+		} else {
+			listener.Close()
+			os.Setenv("SSH_AUTH_SOCK", oldSocket)
+		}
+	})
+	return keyring
+}
+
+func addSSHKey(t *testing.T, keyring agent.Agent, key interface{}, comment string) {
+	if err := keyring.Add(agent.AddedKey{PrivateKey: key, Comment: comment}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Tests that ssh_agent protectors are unlocked by the agent without using the
+// callback, with Ed25519 and RSA keys, and not once the key is removed.
+func TestSSHAgentProtector(t *testing.T) {
+	keyring := startSSHAgent(t)
+	_, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addSSHKey(t, keyring, ed25519Key, "ed25519")
+	addSSHKey(t, keyring, rsaKey, "rsa")
+
+	for name, key := range map[string]interface{}{"ed25519": ed25519Key, "rsa": rsaKey} {
+		signer, err := ssh.NewSignerFromKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Run(name, func(t *testing.T) {
+			testContext.Config.SshKey = name
+			testProtectorSource(t, name, badCallback, nil, func() {
+				if err := keyring.Remove(signer.PublicKey()); err != nil {
+					t.Fatal(err)
+				}
+			}, ErrSSHAgentLacksKey)
+		})
+	}
+}
+
+// Tests that keys with randomized signatures aren't used, and that a missing
+// agent is reported.
+func TestSSHAgentProtectorErrors(t *testing.T) {
+	keyring := startSSHAgent(t)
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addSSHKey(t, keyring, ecdsaKey, "ecdsa")
+	if _, err = CreateProtector(testContext, testProtectorName, badCallback, nil); err != ErrNoSSHKey {
+		t.Errorf("expected %v, got %v", ErrNoSSHKey, err)
+	}
+	testContext.Config.SshKey = "ecdsa"
+	if _, err = CreateProtector(testContext, testProtectorName, badCallback, nil); errors.Cause(err) != ErrNoSSHKey {
+		t.Errorf("expected %v, got %v", ErrNoSSHKey, err)
+	}
+
+	os.Setenv("SSH_AUTH_SOCK", "")
+	if _, err = CreateProtector(testContext, testProtectorName, badCallback, nil); err != ErrNoSSHAgent {
+		t.Errorf("expected %v, got %v", ErrNoSSHAgent, err)
+	}
+}
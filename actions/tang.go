@@ -0,0 +1,456 @@
+/*
+ * tang.go - Protectors whose wrapping key is recovered by a Tang server, so that
+ * they can only be unlocked while the server is reachable
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package actions
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/google/fscrypt/crypto"
+	"github.com/google/fscrypt/metadata"
+	"github.com/google/fscrypt/util"
+)
+
+// Tang errors
+var (
+	ErrNoTangURL     = errors.New(`no Tang server is set in the config file's "tang_url"`)
+	ErrTangUntrusted = errors.New("the Tang server's keys are not trusted")
+	ErrTangWrongKey  = errors.New("the key recovered by the Tang server is incorrect")
+)
+
+// ErrTangUnreachable indicates that a Tang server couldn't be reached, even
+// after retrying.
+type ErrTangUnreachable struct {
+	URL string
+	Err error
+}
+
+func (err *ErrTangUnreachable) Error() string {
+	return fmt.Sprintf("Tang server %s is unreachable: %v", err.URL, err.Err)
+}
+
+// Requests to Tang servers time out after tangTimeout, and are made up to
+// tangAttempts times, waiting tangRetryDelay (doubled each time) in between.
+var (
+	tangTimeout    = 10 * time.Second
+	tangAttempts   = 3
+	tangRetryDelay = time.Second
+)
+
+// tangMaxResponseLen limits how much of a Tang server's response is read.
+const tangMaxResponseLen = 1 << 20
+
+// TangTrustFunc is called with the thumbprints (SHA-256, base64url) of the
+// signing keys of a Tang server which isn't trusted through the config file's
+// "tang_thumbprint", and returns whether to trust them.
+type TangTrustFunc func(url string, thumbprints []string) (bool, error)
+
+var (
+	tangTrustFn      TangTrustFunc
+	tangTrustFnMutex sync.RWMutex
+)
+
+// SetTangTrustFunc makes new tang protectors use trustFn to decide whether to
+// trust Tang servers from now on. Passing nil only trusts the servers whose
+// thumbprint is in the config file, which is the default.
+func SetTangTrustFunc(trustFn TangTrustFunc) {
+	tangTrustFnMutex.Lock()
+	defer tangTrustFnMutex.Unlock()
+	tangTrustFn = trustFn
+}
+
+func getTangTrustFunc() TangTrustFunc {
+	tangTrustFnMutex.RLock()
+	defer tangTrustFnMutex.RUnlock()
+	return tangTrustFn
+}
+
+// tangJWK is an EC public key in the JSON Web Key format used by Tang.
+type tangJWK struct {
+	Kty    string   `json:"kty"`
+	Crv    string   `json:"crv"`
+	X      string   `json:"x"`
+	Y      string   `json:"y"`
+	Alg    string   `json:"alg,omitempty"`
+	KeyOps []string `json:"key_ops,omitempty"`
+}
+
+func newTangJWK(curve elliptic.Curve, x, y *big.Int) *tangJWK {
+	size := (curve.Params().BitSize + 7) / 8
+	return &tangJWK{
+		Kty:    "EC",
+		Crv:    curve.Params().Name,
+		X:      base64.RawURLEncoding.EncodeToString(x.FillBytes(make([]byte, size))),
+		Y:      base64.RawURLEncoding.EncodeToString(y.FillBytes(make([]byte, size))),
+		Alg:    "ECMR",
+		KeyOps: []string{"deriveKey"},
+	}
+}
+
+func (jwk *tangJWK) curve() (elliptic.Curve, error) {
+	if jwk.Kty == "EC" {
+		switch jwk.Crv {
+		case "P-256":
+			return elliptic.P256(), nil
+		case "P-384":
+			return elliptic.P384(), nil
+		case "P-521":
+			return elliptic.P521(), nil
+		}
+	}
+	return nil, errors.Errorf("unsupported Tang key type %s %s", jwk.Kty, jwk.Crv)
+}
+
+// point returns the curve and coordinates of the key, which are checked to be
+// on the curve.
+func (jwk *tangJWK) point() (elliptic.Curve, *big.Int, *big.Int, error) {
+	curve, err := jwk.curve()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	x, errX := base64.RawURLEncoding.DecodeString(jwk.X)
+	y, errY := base64.RawURLEncoding.DecodeString(jwk.Y)
+	if errX != nil || errY != nil {
+		return nil, nil, nil, errors.New("invalid Tang key coordinates")
+	}
+	px, py := new(big.Int).SetBytes(x), new(big.Int).SetBytes(y)
+	if !curve.IsOnCurve(px, py) {
+		return nil, nil, nil, errors.New("Tang key is not on its curve")
+	}
+	return curve, px, py, nil
+}
+
+func (jwk *tangJWK) hasKeyOp(op string) bool {
+	for _, keyOp := range jwk.KeyOps {
+		if keyOp == op {
+			return true
+		}
+	}
+	return false
+}
+
+// thumbprint returns the RFC 7638 thumbprint of the key with SHA-256, which
+// Tang uses to identify its keys.
+func (jwk *tangJWK) thumbprint() string {
+	members := fmt.Sprintf(`{"crv":%q,"kty":%q,"x":%q,"y":%q}`, jwk.Crv, jwk.Kty, jwk.X, jwk.Y)
+	digest := sha256.Sum256([]byte(members))
+	return base64.RawURLEncoding.EncodeToString(digest[:])
+}
+
+// parseTangAdvertisement returns the keys in a Tang server's advertisement (a
+// JWS of its key set), and the thumbprints of those which signed it.
+func parseTangAdvertisement(adv []byte) ([]*tangJWK, []string, error) {
+	var jws struct {
+		Payload    string `json:"payload"`
+		Protected  string `json:"protected"`
+		Signature  string `json:"signature"`
+		Signatures []struct {
+			Protected string `json:"protected"`
+			Signature string `json:"signature"`
+		} `json:"signatures"`
+	}
+	if err := json.Unmarshal(adv, &jws); err != nil {
+		return nil, nil, errors.Wrap(err, "Tang advertisement")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(jws.Payload)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "Tang advertisement payload")
+	}
+	var keySet struct {
+		Keys []*tangJWK `json:"keys"`
+	}
+	if err = json.Unmarshal(payload, &keySet); err != nil {
+		return nil, nil, errors.Wrap(err, "Tang advertisement payload")
+	}
+	if jws.Signature != "" {
+		jws.Signatures = append(jws.Signatures, struct {
+			Protected string `json:"protected"`
+			Signature string `json:"signature"`
+		}{jws.Protected, jws.Signature})
+	}
+
+	var signers []string
+	for _, signature := range jws.Signatures {
+		for _, key := range keySet.Keys {
+			if key.hasKeyOp("verify") &&
+				verifyTangSignature(key, signature.Protected, jws.Payload, signature.Signature) {
+				signers = append(signers, key.thumbprint())
+			}
+		}
+	}
+	if len(signers) == 0 {
+		return nil, nil, errors.New("Tang advertisement isn't signed by any of its keys")
+	}
+	return keySet.Keys, signers, nil
+}
+
+// The JWS algorithms with which Tang servers sign their advertisements, and the
+// curves and hashes they use
+var tangSignatureAlgorithms = map[string]struct {
+	crv  string
+	hash func() hash.Hash
+}{
+	"ES256": {"P-256", sha256.New},
+	"ES384": {"P-384", sha512.New384},
+	"ES512": {"P-521", sha512.New},
+}
+
+// verifyTangSignature checks an ES256, ES384, or ES512 signature of a JWS.
+func verifyTangSignature(key *tangJWK, protected, payload, signature string) bool {
+	curve, x, y, err := key.point()
+	if err != nil {
+		return false
+	}
+	header, err := base64.RawURLEncoding.DecodeString(protected)
+	if err != nil {
+		return false
+	}
+	var params struct {
+		Alg string `json:"alg"`
+	}
+	if err = json.Unmarshal(header, &params); err != nil {
+		return false
+	}
+	algorithm, ok := tangSignatureAlgorithms[params.Alg]
+	if !ok || algorithm.crv != key.Crv {
+		return false
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || len(sig)%2 != 0 {
+		return false
+	}
+	digest := algorithm.hash()
+	digest.Write([]byte(protected + "." + payload))
+	r := new(big.Int).SetBytes(sig[:len(sig)/2])
+	s := new(big.Int).SetBytes(sig[len(sig)/2:])
+	return ecdsa.Verify(&ecdsa.PublicKey{Curve: curve, X: x, Y: y}, digest.Sum(nil), r, s)
+}
+
+// setupTangProtector gets the exchange key of the Tang server set in config,
+// after checking that the server is trusted, and stores it in data along with
+// a new client public key. The matching private key is discarded, so that only
+// the server can recover the wrapping key (see getTangWrappingKey).
+func setupTangProtector(config *metadata.Config, data *metadata.ProtectorData) error {
+	url := strings.TrimSuffix(config.GetTangUrl(), "/")
+	if url == "" {
+		return ErrNoTangURL
+	}
+	adv, err := tangRequest(url, http.MethodGet, "/adv", nil)
+	if err != nil {
+		return err
+	}
+	keys, signers, err := parseTangAdvertisement(adv)
+	if err != nil {
+		return err
+	}
+	if err = checkTangTrust(config, url, signers); err != nil {
+		return err
+	}
+
+	var serverKey *tangJWK
+	for _, key := range keys {
+		if key.hasKeyOp("deriveKey") && key.Alg == "ECMR" {
+			serverKey = key
+			break
+		}
+	}
+	if serverKey == nil {
+		return errors.Errorf("Tang server %s advertises no exchange key", url)
+	}
+	curve, _, _, err := serverKey.point()
+	if err != nil {
+		return err
+	}
+	_, x, y, err := elliptic.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		return err
+	}
+	serverKeyJSON, err := json.Marshal(serverKey)
+	if err != nil {
+		return err
+	}
+	data.TangUrl = url
+	data.TangServerKey = string(serverKeyJSON)
+	data.TangClientKey = elliptic.Marshal(curve, x, y)
+	return nil
+}
+
+// checkTangTrust checks that the advertisement of the Tang server was signed by
+// the key whose thumbprint is in config, or else asks the TangTrustFunc.
+func checkTangTrust(config *metadata.Config, url string, signers []string) error {
+	if thumbprint := config.GetTangThumbprint(); thumbprint != "" {
+		for _, signer := range signers {
+			if signer == thumbprint {
+				return nil
+			}
+		}
+		return ErrTangUntrusted
+	}
+	trustFn := getTangTrustFunc()
+	if trustFn == nil {
+		return ErrTangUntrusted
+	}
+	trusted, err := trustFn(url, signers)
+	if err != nil {
+		return err
+	}
+	if !trusted {
+		return ErrTangUntrusted
+	}
+	return nil
+}
+
+// getTangWrappingKey recovers the wrapping key of a tang protector with the
+// McCallum-Relyea exchange. The wrapping key is derived from s*C, where s is
+// the server's private key and C the client public key. The server is sent
+// X = C + E for an ephemeral key pair (e, E), so that it learns nothing from
+// the request, and the response s*X = s*C + e*S gives s*C.
+func getTangWrappingKey(info ProtectorInfo, retry bool) (*crypto.Key, error) {
+	// The server always recovers the same key, so a wrong key can't be
+	// fixed by asking it again.
+	if retry {
+		return nil, ErrTangWrongKey
+	}
+	var serverKey tangJWK
+	if err := json.Unmarshal([]byte(info.data.TangServerKey), &serverKey); err != nil {
+		return nil, errors.Wrap(err, "Tang server key")
+	}
+	curve, sx, sy, err := serverKey.point()
+	if err != nil {
+		return nil, err
+	}
+	cx, cy := elliptic.Unmarshal(curve, info.data.TangClientKey)
+	if cx == nil {
+		return nil, errors.New("invalid Tang client key")
+	}
+	e, ex, ey, err := elliptic.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	defer wipeBuffer(e)
+	xx, xy := curve.Add(cx, cy, ex, ey)
+
+	request, err := json.Marshal(newTangJWK(curve, xx, xy))
+	if err != nil {
+		return nil, err
+	}
+	util.Debugf("recovering key of protector %s with %s", info.Descriptor(), info.TangURL())
+	response, err := tangRequest(info.TangURL(), http.MethodPost,
+		"/rec/"+serverKey.thumbprint(), request)
+	if err != nil {
+		return nil, err
+	}
+	var responseKey tangJWK
+	if err = json.Unmarshal(response, &responseKey); err != nil {
+		return nil, errors.Wrap(err, "Tang response")
+	}
+	responseCurve, yx, yy, err := responseKey.point()
+	if err != nil {
+		return nil, err
+	}
+	if responseCurve != curve {
+		return nil, errors.New("Tang response is on the wrong curve")
+	}
+
+	// s*C = s*X - e*S, where -(x, y) = (x, p - y).
+	tx, ty := curve.ScalarMult(sx, sy, e)
+	ty.Sub(curve.Params().P, ty)
+	kx, _ := curve.Add(yx, yy, tx, ty)
+	secret := kx.FillBytes(make([]byte, (curve.Params().BitSize+7)/8))
+	defer wipeBuffer(secret)
+	secretKey, err := crypto.NewFixedLengthKeyFromReader(bytes.NewReader(secret), len(secret))
+	if err != nil {
+		return nil, err
+	}
+	defer secretKey.Wipe()
+	return deriveECDHWrappingKey(secretKey)
+}
+
+// tangRequest makes a request to the Tang server at url, retrying if the
+// server can't be reached or has an internal error.
+func tangRequest(url, method, path string, body []byte) ([]byte, error) {
+	client := &http.Client{Timeout: tangTimeout}
+	delay := tangRetryDelay
+	for attempt := 1; ; attempt++ {
+		response, retry, err := tangRequestOnce(client, method, url+path, body)
+		if err == nil {
+			return response, nil
+		}
+		util.Debugf("Tang request %s %s (attempt %d of %d): %v",
+			method, url+path, attempt, tangAttempts, err)
+		if !retry {
+			return nil, err
+		}
+		if attempt >= tangAttempts {
+			return nil, &ErrTangUnreachable{URL: url, Err: err}
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// tangRequestOnce makes a request to a Tang server, and returns its response,
+// or an error and whether the request should be retried.
+func tangRequestOnce(client *http.Client, method, url string, body []byte) ([]byte, bool, error) {
+	request, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, false, err
+	}
+	if body != nil {
+		request.Header.Set("Content-Type", "application/jwk+json")
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, true, err
+	}
+	defer response.Body.Close()
+	output, err := io.ReadAll(io.LimitReader(response.Body, tangMaxResponseLen))
+	if err != nil {
+		return nil, true, err
+	}
+	if response.StatusCode != http.StatusOK {
+		err = errors.Errorf("%s %s: %s", method, url, response.Status)
+		return nil, response.StatusCode >= 500, err
+	}
+	return output, false, nil
+}
+
+// wipeBuffer zeroes a buffer which held key material.
+func wipeBuffer(buf []byte) {
+	for i := range buf {
+		buf[i] = 0
+	}
+}
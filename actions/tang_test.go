@@ -0,0 +1,189 @@
+/*
+ * tang_test.go - tests for protectors recovered by Tang servers
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package actions
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/google/fscrypt/metadata"
+)
+
+// fakeTang is a Tang server with one signing key and one exchange key on P-521.
+// It answers with an internal error until failures reaches zero.
+type fakeTang struct {
+	signingKey, exchangeKey *ecdsa.PrivateKey
+	failures                int32
+}
+
+func newFakeTang(t *testing.T) *fakeTang {
+	signingKey, err := ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exchangeKey, err := ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &fakeTang{signingKey: signingKey, exchangeKey: exchangeKey}
+}
+
+func (tang *fakeTang) signingJWK() *tangJWK {
+	jwk := newTangJWK(elliptic.P521(), tang.signingKey.X, tang.signingKey.Y)
+	jwk.Alg, jwk.KeyOps = "ES512", []string{"sign", "verify"}
+	return jwk
+}
+
+func (tang *fakeTang) advertisement() []byte {
+	keys, _ := json.Marshal(map[string]interface{}{"keys": []*tangJWK{tang.signingJWK(),
+		newTangJWK(elliptic.P521(), tang.exchangeKey.X, tang.exchangeKey.Y)}})
+	payload := base64.RawURLEncoding.EncodeToString(keys)
+	protected := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"ES512","cty":"jwk-set+json"}`))
+	digest := sha512.Sum512([]byte(protected + "." + payload))
+	r, s, _ := ecdsa.Sign(rand.Reader, tang.signingKey, digest[:])
+	signature := append(r.FillBytes(make([]byte, 66)), s.FillBytes(make([]byte, 66))...)
+	adv, _ := json.Marshal(map[string]interface{}{"payload": payload, "signatures": []interface{}{
+		map[string]string{"protected": protected,
+			"signature": base64.RawURLEncoding.EncodeToString(signature)}}})
+	return adv
+}
+
+func (tang *fakeTang) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if atomic.AddInt32(&tang.failures, -1) >= 0 {
+		http.Error(w, "try again", http.StatusInternalServerError)
+		return
+	}
+	exchangeJWK := newTangJWK(elliptic.P521(), tang.exchangeKey.X, tang.exchangeKey.Y)
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/adv":
+		w.Write(tang.advertisement())
+	case r.Method == http.MethodPost && r.URL.Path == "/rec/"+exchangeJWK.thumbprint():
+		body, _ := io.ReadAll(r.Body)
+		var request tangJWK
+		json.Unmarshal(body, &request)
+		curve, x, y, err := request.point()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		rx, ry := curve.ScalarMult(x, y, tang.exchangeKey.D.Bytes())
+		response, _ := json.Marshal(newTangJWK(curve, rx, ry))
+		w.Write(response)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func useTangSource(t *testing.T, url string, trustFn TangTrustFunc) {
+	oldSource, oldURL := testContext.Config.Source, testContext.Config.TangUrl
+	oldAttempts, oldDelay := tangAttempts, tangRetryDelay
+	testContext.Config.Source = metadata.SourceType_tang
+	testContext.Config.TangUrl = url
+	tangAttempts, tangRetryDelay = 3, time.Millisecond
+	SetTangTrustFunc(trustFn)
+	t.Cleanup(func() {
+		testContext.Config.Source, testContext.Config.TangUrl = oldSource, oldURL
+		testContext.Config.TangThumbprint = ""
+		tangAttempts, tangRetryDelay = oldAttempts, oldDelay
+		SetTangTrustFunc(nil)
+	})
+}
+
+// Tests that a tang protector is unlocked by the server it was created with,
+// after retrying an internal error, and not once the server is unreachable.
+func TestTangProtector(t *testing.T) {
+	tang := newFakeTang(t)
+	server := httptest.NewServer(tang)
+	defer server.Close()
+	var trusted []string
+	useTangSource(t, server.URL, func(url string, thumbprints []string) (bool, error) {
+		trusted = thumbprints
+		return true, nil
+	})
+
+	p, err := CreateProtector(testContext, testProtectorName, badCallback, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Destroy()
+	p.Lock()
+	if len(trusted) != 1 || trusted[0] != tang.signingJWK().thumbprint() {
+		t.Errorf("asked to trust %v", trusted)
+	}
+
+	p, err = GetProtector(testContext, p.Descriptor())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tang.failures = 2
+	if err = p.Unlock(badCallback); err != nil {
+		t.Fatal(err)
+	}
+	p.Lock()
+
+	server.Close()
+	err = p.Unlock(badCallback)
+	if _, ok := err.(*ErrTangUnreachable); !ok {
+		t.Errorf("expected the server to be unreachable, got %v", err)
+	}
+}
+
+// Tests that the server's signing key must be trusted.
+func TestTangProtectorTrust(t *testing.T) {
+	tang := newFakeTang(t)
+	server := httptest.NewServer(tang)
+	defer server.Close()
+
+	useTangSource(t, server.URL, nil)
+	if _, err := CreateProtector(testContext, testProtectorName, badCallback, nil); err != ErrTangUntrusted {
+		t.Errorf("expected %v, got %v", ErrTangUntrusted, err)
+	}
+	testContext.Config.TangThumbprint = strings.Repeat("A", 43)
+	if _, err := CreateProtector(testContext, testProtectorName, badCallback, nil); err != ErrTangUntrusted {
+		t.Errorf("expected %v, got %v", ErrTangUntrusted, err)
+	}
+
+	testContext.Config.TangThumbprint = tang.signingJWK().thumbprint()
+	p, err := CreateProtector(testContext, testProtectorName, badCallback, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Lock()
+	p.Destroy()
+
+	errDeclined := errors.New("declined")
+	testContext.Config.TangThumbprint = ""
+	SetTangTrustFunc(func(string, []string) (bool, error) { return false, errDeclined })
+	if _, err = CreateProtector(testContext, testProtectorName, badCallback, nil); err != errDeclined {
+		t.Errorf("expected %v, got %v", errDeclined, err)
+	}
+}
@@ -0,0 +1,122 @@
+/*
+ * tpm2.go - Protectors whose wrapping key is sealed by a TPM 2.0 device
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package actions
+
+import (
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/google/fscrypt/crypto"
+	"github.com/google/fscrypt/metadata"
+	"github.com/google/fscrypt/util"
+)
+
+// ErrNoTPM2Sealer indicates that a tpm2 protector was used without a TPM2Sealer
+// having been set.
+var ErrNoTPM2Sealer = errors.New("TPM 2.0 devices are not supported by this program")
+
+// TPM2SealedKey is a key sealed by a TPM 2.0 device, as stored in the metadata
+// of a tpm2 protector.
+type TPM2SealedKey struct {
+	// Public and Private are the public and (encrypted) private parts of
+	// the sealed object, which can only be loaded by the TPM which made
+	// them.
+	Public, Private []byte
+	// PCRs are the PCRs in the SHA-256 bank whose current values are
+	// needed to unseal the key. If empty, the key can always be unsealed
+	// on this TPM.
+	PCRs []uint32
+}
+
+// TPM2Sealer seals keys to a TPM 2.0 device. The wrapping key of a tpm2
+// protector is a random key which is sealed when the protector is created, and
+// unsealed each time it is used. This lets a machine unlock directories without
+// user interaction, while the metadata alone is useless on another machine (or,
+// if PCRs are used, when booted into another system).
+type TPM2Sealer interface {
+	// Seal seals key for the protector called name.
+	Seal(name string, key *crypto.Key) (*TPM2SealedKey, error)
+	// Unseal returns the key sealed in the protector's metadata (see
+	// ProtectorInfo.TPM2SealedKey). The retry parameter indicates that
+	// the previous key was incorrect.
+	Unseal(info ProtectorInfo, retry bool) (*crypto.Key, error)
+}
+
+var (
+	tpm2Sealer      TPM2Sealer
+	tpm2SealerMutex sync.RWMutex
+)
+
+// SetTPM2Sealer makes tpm2 protectors use sealer from now on. Passing nil
+// disables tpm2 protectors, which is the default.
+func SetTPM2Sealer(sealer TPM2Sealer) {
+	tpm2SealerMutex.Lock()
+	defer tpm2SealerMutex.Unlock()
+	tpm2Sealer = sealer
+}
+
+func getTPM2Sealer() (TPM2Sealer, error) {
+	tpm2SealerMutex.RLock()
+	defer tpm2SealerMutex.RUnlock()
+	if tpm2Sealer == nil {
+		return nil, ErrNoTPM2Sealer
+	}
+	return tpm2Sealer, nil
+}
+
+// sealTPM2WrappingKey seals a new random wrapping key for a tpm2 protector, and
+// stores the sealed object in data.
+func sealTPM2WrappingKey(name string, data *metadata.ProtectorData) error {
+	sealer, err := getTPM2Sealer()
+	if err != nil {
+		return err
+	}
+	key, err := crypto.NewRandomKey(metadata.InternalKeyLen)
+	if err != nil {
+		return err
+	}
+	defer key.Wipe()
+	sealed, err := sealer.Seal(name, key)
+	if err != nil {
+		return err
+	}
+	data.Tpm2Public = sealed.Public
+	data.Tpm2Private = sealed.Private
+	data.Tpm2Pcrs = sealed.PCRs
+	return nil
+}
+
+// getTPM2WrappingKey gets the wrapping key of a tpm2 protector from the TPM.
+func getTPM2WrappingKey(info ProtectorInfo, retry bool) (*crypto.Key, error) {
+	sealer, err := getTPM2Sealer()
+	if err != nil {
+		return nil, err
+	}
+	util.Debugf("unsealing key of protector %s", info.Descriptor())
+	key, err := sealer.Unseal(info, retry)
+	if err != nil {
+		return nil, err
+	}
+	if err = util.CheckValidLength(metadata.InternalKeyLen, key.Len()); err != nil {
+		key.Wipe()
+		return nil, errors.Wrap(err, "unsealed key")
+	}
+	return key, nil
+}
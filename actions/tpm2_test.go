@@ -0,0 +1,105 @@
+/*
+ * tpm2_test.go - tests for protectors whose keys are sealed by a TPM 2.0 device
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package actions
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/pkg/errors"
+
+	"github.com/google/fscrypt/crypto"
+	"github.com/google/fscrypt/metadata"
+)
+
+var errPCRMismatch = errors.New("PCR values don't match")
+
+// fakeSealer "seals" keys by XORing them with its secret, so only a sealer with
+// the same secret (i.e. the same TPM) can unseal them. Unsealing fails if the
+// PCRs aren't those it was given.
+type fakeSealer struct {
+	secret byte
+	pcrs   []uint32
+}
+
+func (s *fakeSealer) xor(data []byte) []byte {
+	output := make([]byte, len(data))
+	for i := range data {
+		output[i] = data[i] ^ s.secret
+	}
+	return output
+}
+
+func (s *fakeSealer) Seal(name string, key *crypto.Key) (*TPM2SealedKey, error) {
+	return &TPM2SealedKey{
+		Public:  []byte(name),
+		Private: s.xor(key.Data()),
+		PCRs:    s.pcrs,
+	}, nil
+}
+
+func (s *fakeSealer) Unseal(info ProtectorInfo, retry bool) (*crypto.Key, error) {
+	if retry {
+		return nil, errCallback
+	}
+	sealed := info.TPM2SealedKey()
+	for _, pcr := range sealed.PCRs {
+		if pcr == 7 {
+			return nil, errPCRMismatch
+		}
+	}
+	data := s.xor(sealed.Private)
+	return crypto.NewFixedLengthKeyFromReader(bytes.NewReader(data), len(data))
+}
+
+func useTPM2Source(t *testing.T, sealer TPM2Sealer) {
+	useProtectorSource(t, metadata.SourceType_tpm2, func(installed bool) {
+		if installed {
+			SetTPM2Sealer(sealer)
+		} else {
+			SetTPM2Sealer(nil)
+		}
+	})
+}
+
+// Tests that a tpm2 protector is unlocked by the TPM it was created with,
+// without using the callback, and not by another one.
+func TestTPM2Protector(t *testing.T) {
+	sealer := &fakeSealer{secret: 1, pcrs: []uint32{0, 2}}
+	useTPM2Source(t, sealer)
+	// The other TPM fails, so the callback is used to retry.
+	testProtectorSource(t, testProtectorName, badCallback,
+		func(data *metadata.ProtectorData) bool {
+			return len(data.Tpm2Private) == metadata.InternalKeyLen && len(data.Tpm2Pcrs) == 2
+		},
+		func() { sealer.secret = 2 }, errCallback)
+}
+
+// Tests that unsealing errors (e.g. from changed PCR values) are passed on.
+func TestTPM2ProtectorErrors(t *testing.T) {
+	useTPM2Source(t, &fakeSealer{secret: 1, pcrs: []uint32{7}})
+	if _, err := CreateProtector(testContext, testProtectorName, goodCallback, nil); err != errPCRMismatch {
+		t.Errorf("expected %v, got %v", errPCRMismatch, err)
+	}
+
+	SetTPM2Sealer(nil)
+	if _, err := CreateProtector(testContext, testProtectorName, goodCallback, nil); err != ErrNoTPM2Sealer {
+		t.Errorf("expected %v, got %v", ErrNoTPM2Sealer, err)
+	}
+}
@@ -0,0 +1,134 @@
+/*
+ * validate.go - Checking early that fscrypt can operate on a filesystem
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package actions
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/google/fscrypt/util"
+)
+
+// ValidationCheck is one of the checks run by Context.Validate.
+type ValidationCheck int
+
+// The checks run by Context.Validate, in the order they are run.
+const (
+	// CheckConfig checks that the Context's config is valid.
+	CheckConfig ValidationCheck = iota
+	// CheckEncryptionSupport checks that the kernel and the filesystem
+	// support encryption.
+	CheckEncryptionSupport
+	// CheckMetadataSetup checks that the filesystem is set up for fscrypt,
+	// with metadata directories which can be trusted.
+	CheckMetadataSetup
+	// CheckMetadataWritable checks that the current user can add and remove
+	// metadata on the filesystem. It is only run if CheckMetadataSetup
+	// passed.
+	CheckMetadataWritable
+)
+
+// ValidationChecks lists all of the checks, in the order they are run.
+var ValidationChecks = []ValidationCheck{CheckConfig, CheckEncryptionSupport,
+	CheckMetadataSetup, CheckMetadataWritable}
+
+func (check ValidationCheck) String() string {
+	switch check {
+	case CheckConfig:
+		return "config is valid"
+	case CheckEncryptionSupport:
+		return "kernel and filesystem support encryption"
+	case CheckMetadataSetup:
+		return "filesystem is set up for fscrypt"
+	case CheckMetadataWritable:
+		return "fscrypt metadata can be modified"
+	default:
+		return fmt.Sprintf("ValidationCheck(%d)", int(check))
+	}
+}
+
+// ValidationResult is the outcome of one check.
+type ValidationResult struct {
+	Check ValidationCheck
+	// Err is nil if the check passed.
+	Err error
+}
+
+// ErrValidation indicates that Context.Validate found problems. It contains
+// the result of each check which failed.
+type ErrValidation struct {
+	Failures []ValidationResult
+}
+
+func (err *ErrValidation) Error() string {
+	problems := make([]string, len(err.Failures))
+	for i, failure := range err.Failures {
+		problems[i] = fmt.Sprintf("%s: %s", failure.Check, failure.Err)
+	}
+	if len(problems) == 1 {
+		return "fscrypt cannot operate: " + problems[0]
+	}
+	return fmt.Sprintf("fscrypt cannot operate (%d problems): %s",
+		len(problems), strings.Join(problems, "; "))
+}
+
+// RunValidationChecks runs the checks of Validate, and returns the result of
+// each check which was run, including the ones which passed. Checks which
+// depend on a failed check aren't run.
+func (ctx *Context) RunValidationChecks() []ValidationResult {
+	var results []ValidationResult
+	run := func(check ValidationCheck, fn func() error) error {
+		err := fn()
+		util.Debugf("validation check %q on %q: %v", check, ctx.Mount.Path, err)
+		results = append(results, ValidationResult{check, err})
+		return err
+	}
+
+	run(CheckConfig, func() error {
+		if err := ctx.Config.CheckValidity(); err != nil {
+			return &ErrBadConfig{ctx.Config, err}
+		}
+		return nil
+	})
+	run(CheckEncryptionSupport, ctx.Mount.CheckSupport)
+	if run(CheckMetadataSetup, func() error {
+		return ctx.Mount.CheckSetup(ctx.TrustedUser)
+	}) == nil {
+		run(CheckMetadataWritable, ctx.Mount.CheckWritable)
+	}
+	return results
+}
+
+// Validate checks that fscrypt can operate on the Context's filesystem: that
+// the config is valid, that the kernel and the filesystem support encryption,
+// and that the filesystem's fscrypt metadata is set up and can be modified.
+// This allows failing early, rather than partway through an operation. If
+// any check fails, an *ErrValidation describing every problem is returned.
+func (ctx *Context) Validate() error {
+	var failures []ValidationResult
+	for _, result := range ctx.RunValidationChecks() {
+		if result.Err != nil {
+			failures = append(failures, result)
+		}
+	}
+	if len(failures) > 0 {
+		return &ErrValidation{failures}
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+/*
+ * validate_test.go - Tests for checking early that fscrypt can operate
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package actions
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/google/fscrypt/filesystem"
+	"github.com/google/fscrypt/metadata"
+)
+
+func TestValidate(t *testing.T) {
+	if err := testContext.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	results := testContext.RunValidationChecks()
+	if len(results) != len(ValidationChecks) {
+		t.Errorf("ran %d checks, expected %d", len(results), len(ValidationChecks))
+	}
+}
+
+// Tests that every problem is reported, and that the checks which depend on
+// the filesystem being set up aren't run if it isn't.
+func TestValidateReportsAllProblems(t *testing.T) {
+	mountpoint := filepath.Join(testContext.Mount.Path, "not-setup")
+	if err := os.Mkdir(mountpoint, 0700); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(mountpoint)
+
+	badConfig := proto.Clone(testContext.Config).(*metadata.Config)
+	badConfig.HashCosts = nil
+	ctx := &Context{
+		Config:     badConfig,
+		Mount:      &filesystem.Mount{Path: mountpoint, FilesystemType: testContext.Mount.FilesystemType},
+		TargetUser: testContext.TargetUser,
+	}
+
+	err := ctx.Validate()
+	validationErr, ok := err.(*ErrValidation)
+	if !ok {
+		t.Fatalf("got error %v, expected *ErrValidation", err)
+	}
+	var failed []ValidationCheck
+	for _, failure := range validationErr.Failures {
+		failed = append(failed, failure.Check)
+	}
+	if len(failed) != 2 || failed[0] != CheckConfig || failed[1] != CheckMetadataSetup {
+		t.Errorf("checks %v failed, expected %v and %v", failed, CheckConfig, CheckMetadataSetup)
+	}
+	if _, ok := validationErr.Failures[1].Err.(*filesystem.ErrNotSetup); !ok {
+		t.Errorf("unexpected setup error %v", validationErr.Failures[1].Err)
+	}
+	if len(ctx.RunValidationChecks()) != len(ValidationChecks)-1 {
+		t.Errorf("the writability of metadata which isn't set up was checked")
+	}
+}
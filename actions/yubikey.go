@@ -0,0 +1,108 @@
+/*
+ * yubikey.go - Protectors which mix a YubiKey's challenge-response into the
+ * passphrase hash
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package actions
+
+import (
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/google/fscrypt/crypto"
+	"github.com/google/fscrypt/metadata"
+	"github.com/google/fscrypt/util"
+)
+
+// ErrNoYubiKey indicates that a yubikey protector was used without a YubiKey
+// having been set.
+var ErrNoYubiKey = errors.New("YubiKeys are not supported by this program")
+
+// defaultYubiKeySlot is the slot used when the config doesn't give one. Slot 2
+// is the one normally configured for challenge-response, as slot 1 holds the
+// YubiKey's factory OTP credential.
+const defaultYubiKeySlot = 2
+
+// YubiKey answers HMAC-SHA1 challenges with a slot of a YubiKey. The wrapping
+// key of a yubikey protector is derived from both the hash of its passphrase
+// and the YubiKey's response to a random challenge stored in the protector's
+// metadata, so the passphrase alone can't unlock it. If no YubiKey is present,
+// or the slot isn't configured for challenge-response, ChallengeResponse should
+// return an error which says so.
+type YubiKey interface {
+	// ChallengeResponse returns the response of the protector's slot to
+	// its challenge (see ProtectorInfo.YubiKeySlot and
+	// ProtectorInfo.YubiKeyChallenge).
+	ChallengeResponse(info ProtectorInfo) (*crypto.Key, error)
+}
+
+var (
+	yubiKey      YubiKey
+	yubiKeyMutex sync.RWMutex
+)
+
+// SetYubiKey makes yubikey protectors use yk from now on. Passing nil disables
+// yubikey protectors, which is the default.
+func SetYubiKey(yk YubiKey) {
+	yubiKeyMutex.Lock()
+	defer yubiKeyMutex.Unlock()
+	yubiKey = yk
+}
+
+func getYubiKey() (YubiKey, error) {
+	yubiKeyMutex.RLock()
+	defer yubiKeyMutex.RUnlock()
+	if yubiKey == nil {
+		return nil, ErrNoYubiKey
+	}
+	return yubiKey, nil
+}
+
+// setupYubiKeyProtector stores the slot and a new random challenge for a
+// yubikey protector in data.
+func setupYubiKeyProtector(config *metadata.Config, data *metadata.ProtectorData) error {
+	if _, err := getYubiKey(); err != nil {
+		return err
+	}
+	data.YubikeySlot = config.GetYubikeySlot()
+	if data.YubikeySlot == 0 {
+		data.YubikeySlot = defaultYubiKeySlot
+	}
+	var err error
+	data.YubikeyChallenge, err = crypto.NewRandomBuffer(metadata.YubiKeyChallengeLen)
+	return err
+}
+
+// getYubiKeyResponse gets the response to the challenge of a yubikey protector
+// from the YubiKey.
+func getYubiKeyResponse(info ProtectorInfo) (*crypto.Key, error) {
+	yk, err := getYubiKey()
+	if err != nil {
+		return nil, err
+	}
+	util.Debugf("getting YubiKey response for protector %s", info.Descriptor())
+	response, err := yk.ChallengeResponse(info)
+	if err != nil {
+		return nil, err
+	}
+	if err = util.CheckValidLength(metadata.YubiKeyResponseLen, response.Len()); err != nil {
+		response.Wipe()
+		return nil, errors.Wrap(err, "YubiKey response")
+	}
+	return response, nil
+}
@@ -0,0 +1,114 @@
+/*
+ * yubikey_test.go - tests for protectors using YubiKey challenge-response
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package actions
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"testing"
+
+	"github.com/pkg/errors"
+
+	"github.com/google/fscrypt/crypto"
+	"github.com/google/fscrypt/metadata"
+)
+
+var errNoYubiKey = errors.New("no YubiKey")
+
+// fakeYubiKey answers challenges with an HMAC-SHA1 keyed by its secret, like a
+// YubiKey slot configured for challenge-response.
+type fakeYubiKey struct {
+	secret []byte
+	absent bool
+	slots  []uint32
+}
+
+func (yk *fakeYubiKey) ChallengeResponse(info ProtectorInfo) (*crypto.Key, error) {
+	if yk.absent {
+		return nil, errNoYubiKey
+	}
+	yk.slots = append(yk.slots, info.YubiKeySlot())
+	mac := hmac.New(sha1.New, yk.secret)
+	mac.Write(info.YubiKeyChallenge())
+	response := mac.Sum(nil)
+	return crypto.NewFixedLengthKeyFromReader(bytes.NewReader(response), len(response))
+}
+
+func useYubiKeySource(t *testing.T, yk YubiKey) {
+	useProtectorSource(t, metadata.SourceType_yubikey, func(installed bool) {
+		if installed {
+			SetYubiKey(yk)
+		} else {
+			SetYubiKey(nil)
+		}
+	})
+}
+
+// passphraseOnceCallback gives the passphrase, but fails when retrying.
+func passphraseOnceCallback(info ProtectorInfo, retry bool) (*crypto.Key, error) {
+	if retry {
+		return nil, errCallback
+	}
+	return goodCallback(info, retry)
+}
+
+// Tests that a yubikey protector needs both its passphrase and the YubiKey it
+// was created with to be unlocked.
+func TestYubiKeyProtector(t *testing.T) {
+	yk := &fakeYubiKey{secret: []byte("secret")}
+	useYubiKeySource(t, yk)
+	testProtectorSource(t, testProtectorName, passphraseOnceCallback,
+		func(data *metadata.ProtectorData) bool {
+			return data.YubikeySlot == defaultYubiKeySlot &&
+				len(data.YubikeyChallenge) == metadata.YubiKeyChallengeLen
+		},
+		func() { yk.secret = []byte("another YubiKey") }, errCallback)
+	for _, slot := range yk.slots {
+		if slot != defaultYubiKeySlot {
+			t.Errorf("challenged slot %d, expected %d", slot, defaultYubiKeySlot)
+		}
+	}
+}
+
+// Tests that the slot comes from the config, and that the errors of the
+// YubiKey are passed on.
+func TestYubiKeyProtectorAbsent(t *testing.T) {
+	yk := &fakeYubiKey{secret: []byte("secret")}
+	useYubiKeySource(t, yk)
+	testContext.Config.YubikeySlot = 1
+	p, err := CreateProtector(testContext, testProtectorName, goodCallback, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Destroy()
+	p.Lock()
+	if p.data.YubikeySlot != 1 {
+		t.Errorf("protector uses slot %d, expected 1", p.data.YubikeySlot)
+	}
+
+	yk.absent = true
+	if err = p.Unlock(goodCallback); err != errNoYubiKey {
+		t.Errorf("expected %v, got %v", errNoYubiKey, err)
+	}
+	SetYubiKey(nil)
+	if err = p.Unlock(goodCallback); err != ErrNoYubiKey {
+		t.Errorf("expected %v, got %v", ErrNoYubiKey, err)
+	}
+}
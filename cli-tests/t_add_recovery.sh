@@ -0,0 +1,25 @@
+#!/bin/bash
+
+# Test adding a recovery passphrase to an encrypted directory.
+
+cd "$(dirname "$0")"
+. common.sh
+
+dir="$MNT/dir"
+mkdir "$dir"
+echo hunter2 | fscrypt encrypt --quiet --name=prot "$dir"
+
+_print_header "Add a recovery passphrase with --quiet"
+recovery_passphrase=$(echo hunter2 | fscrypt policy add-recovery --quiet "$dir")
+if [[ ! $recovery_passphrase =~ ^[a-z]{20}$ ]]; then
+	echo "Recovery passphrase wasn't printed: \"$recovery_passphrase\""
+fi
+recovery_protector=$(_get_protector_descriptor "$MNT" custom \
+		     'Recovery passphrase for dir')
+fscrypt status "$dir"
+
+_print_header "Lock, then unlock with the recovery passphrase"
+fscrypt lock "$dir"
+echo "$recovery_passphrase" | fscrypt unlock --quiet \
+	--unlock-with="$MNT:$recovery_protector" "$dir"
+fscrypt status "$dir"
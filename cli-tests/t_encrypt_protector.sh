@@ -0,0 +1,21 @@
+#!/bin/bash
+
+# Test encrypting a directory with an existing protector named by --protector.
+
+cd "$(dirname "$0")"
+. common.sh
+
+echo hunter2 | fscrypt metadata create protector "$MNT" \
+	--quiet --name=prot --source=custom_passphrase
+prot=$MNT:$(_get_protector_descriptor "$MNT" custom prot)
+dir="$MNT/dir"
+mkdir "$dir"
+
+_print_header "Encrypt with a wrong passphrase from a pipe"
+# This must fail at once, rather than asking for the passphrase again.
+_expect_failure "echo wrong | fscrypt encrypt --protector='$prot' '$dir'"
+_expect_failure "fscrypt status '$dir'"
+
+_print_header "Encrypt with the right passphrase from a pipe"
+echo hunter2 | fscrypt encrypt --protector="$prot" "$dir"
+fscrypt status "$dir"
@@ -0,0 +1,153 @@
+/*
+ * after.go - Unmounting or remounting a filesystem after locking a directory.
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/urfave/cli"
+	"golang.org/x/sys/unix"
+
+	"github.com/google/fscrypt/filesystem"
+	"github.com/google/fscrypt/util"
+)
+
+// The actions which can be given with --after
+const (
+	afterUnmount       = "unmount"
+	afterRemountNoexec = "remount-noexec"
+)
+
+// afterLockAction is an action to run on a mountpoint once a directory has
+// been locked, as given by --after=ACTION:PATH.
+type afterLockAction struct {
+	action string
+	path   string
+}
+
+func (a *afterLockAction) String() string {
+	return a.action + ":" + a.path
+}
+
+// parseAfterFlag parses and validates the value of afterFlag, returning nil if
+// it wasn't given. This is done before locking, so that a bad value doesn't
+// leave the directory locked without the action having run. The returned
+// error is ready to be returned from the command.
+func parseAfterFlag(c *cli.Context) (*afterLockAction, error) {
+	if afterFlag.Value == "" {
+		return nil, nil
+	}
+	i := strings.Index(afterFlag.Value, ":")
+	if i < 0 || afterFlag.Value[i+1:] == "" {
+		return nil, &usageError{c, fmt.Sprintf("invalid value %q for %s",
+			afterFlag.Value, shortDisplay(afterFlag))}
+	}
+	action, path := afterFlag.Value[:i], afterFlag.Value[i+1:]
+	switch action {
+	case afterUnmount, afterRemountNoexec:
+	default:
+		return nil, &usageError{c, fmt.Sprintf("invalid action %q for %s (must be %q or %q)",
+			action, shortDisplay(afterFlag), afterUnmount, afterRemountNoexec)}
+	}
+	if !util.IsUserRoot() {
+		return nil, newExitError(c, ErrAfterLockPerm)
+	}
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, newExitError(c, err)
+	}
+	if err = checkIsMountpoint(path); err != nil {
+		return nil, newExitError(c, err)
+	}
+	return &afterLockAction{action, path}, nil
+}
+
+// checkIsMountpoint returns an error if path isn't the root of a mount. Kernels
+// older than v5.8 can't tell, in which case the mount syscalls will report it.
+func checkIsMountpoint(path string) error {
+	var stat unix.Statx_t
+	if err := unix.Statx(unix.AT_FDCWD, path, unix.AT_SYMLINK_NOFOLLOW,
+		unix.STATX_BASIC_STATS, &stat); err != nil {
+		return &os.PathError{Op: "statx", Path: path, Err: err}
+	}
+	if stat.Attributes_mask&unix.STATX_ATTR_MOUNT_ROOT != 0 &&
+		stat.Attributes&unix.STATX_ATTR_MOUNT_ROOT == 0 {
+		return &filesystem.ErrNotAMountpoint{Path: path}
+	}
+	return nil
+}
+
+// Flags of a mount which need to be passed again to remount it, by their statfs
+// flag
+var mountFlagsByStatfsFlag = map[int64]uintptr{
+	unix.ST_RDONLY:     unix.MS_RDONLY,
+	unix.ST_NOSUID:     unix.MS_NOSUID,
+	unix.ST_NODEV:      unix.MS_NODEV,
+	unix.ST_NOEXEC:     unix.MS_NOEXEC,
+	unix.ST_NOATIME:    unix.MS_NOATIME,
+	unix.ST_NODIRATIME: unix.MS_NODIRATIME,
+	unix.ST_RELATIME:   unix.MS_RELATIME,
+}
+
+// run runs the action. Unmounting fails if files are still open on the mount.
+// Remounting only changes the flags of this mount, not of the filesystem, and
+// keeps its other flags.
+func (a *afterLockAction) run() error {
+	switch a.action {
+	case afterUnmount:
+		return unix.Unmount(a.path, 0)
+	case afterRemountNoexec:
+		var statfs unix.Statfs_t
+		if err := unix.Statfs(a.path, &statfs); err != nil {
+			return err
+		}
+		flags := uintptr(unix.MS_REMOUNT | unix.MS_BIND | unix.MS_NOEXEC)
+		for statfsFlag, mountFlag := range mountFlagsByStatfsFlag {
+			if int64(statfs.Flags)&statfsFlag != 0 {
+				flags |= mountFlag
+			}
+		}
+		return unix.Mount("", a.path, "", flags, "")
+	default:
+		panic(a.action)
+	}
+}
+
+// runAfterLockAction runs the action given with --after, if any, once the
+// directory has been locked. A failure is reported as an ErrAfterLockFailed,
+// which makes clear that the directory was still locked.
+func runAfterLockAction(c *cli.Context, a *afterLockAction) error {
+	if a == nil {
+		return nil
+	}
+	util.Debugf("running %s after locking", a)
+	if err := a.run(); err != nil {
+		return newExitError(c, &ErrAfterLockFailed{a.action, a.path, err})
+	}
+	switch a.action {
+	case afterUnmount:
+		fmt.Fprintf(c.App.Writer, "Unmounted %q.\n", a.path)
+	case afterRemountNoexec:
+		fmt.Fprintf(c.App.Writer, "Remounted %q with noexec.\n", a.path)
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+/*
+ * after_test.go - Tests for the actions run after locking
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/google/fscrypt/filesystem"
+)
+
+func TestCheckIsMountpoint(t *testing.T) {
+	if err := checkIsMountpoint("/"); err != nil {
+		t.Errorf("the root directory isn't a mountpoint: %v", err)
+	}
+	dir := t.TempDir()
+	if err := checkIsMountpoint(dir); err != nil {
+		if _, ok := err.(*filesystem.ErrNotAMountpoint); !ok {
+			t.Errorf("unexpected error for %q: %v", dir, err)
+		}
+	} else {
+		t.Logf("kernel can't tell whether %q is a mountpoint", dir)
+	}
+	if err := checkIsMountpoint(dir + "/missing"); !os.IsNotExist(err) {
+		t.Errorf("expected a nonexistent path to fail, got %v", err)
+	}
+}
@@ -0,0 +1,155 @@
+/*
+ * agent.go - Locking the policies on a filesystem once they have been idle,
+ * watching for uses of their files with fanotify.
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"time"
+	"unsafe"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/sys/unix"
+
+	"github.com/google/fscrypt/actions"
+	"github.com/google/fscrypt/metadata"
+	"github.com/google/fscrypt/util"
+)
+
+// The fanotify events which count as uses of a policy: opening, reading, or
+// writing any file or directory which uses it.
+const agentEventMask = unix.FAN_OPEN | unix.FAN_ACCESS | unix.FAN_MODIFY | unix.FAN_ONDIR
+
+// Bounds on how often the agent checks for idle policies
+const (
+	minAgentCheckInterval = time.Second
+	maxAgentCheckInterval = time.Minute
+)
+
+// agentCheckInterval returns how often to check for policies which have been
+// idle for the timeout, so that they are locked soon after it has passed.
+func agentCheckInterval(timeout time.Duration) time.Duration {
+	interval := timeout / 10
+	if interval < minAgentCheckInterval {
+		return minAgentCheckInterval
+	}
+	if interval > maxAgentCheckInterval {
+		return maxAgentCheckInterval
+	}
+	return interval
+}
+
+// watchPolicyUses marks each use of the files on the filesystem mounted at
+// mountpoint as a use of their policy, until the process exits. This requires
+// root privileges.
+func watchPolicyUses(mountpoint string, tracker *actions.IdleTracker) error {
+	fd, err := unix.FanotifyInit(unix.FAN_CLASS_NOTIF|unix.FAN_CLOEXEC,
+		unix.O_RDONLY|unix.O_LARGEFILE|unix.O_CLOEXEC)
+	if err != nil {
+		return errors.Wrap(err, "fanotify_init")
+	}
+	err = unix.FanotifyMark(fd, unix.FAN_MARK_ADD|unix.FAN_MARK_MOUNT,
+		agentEventMask, unix.AT_FDCWD, mountpoint)
+	if err != nil {
+		unix.Close(fd)
+		return errors.Wrapf(err, "fanotify_mark %q", mountpoint)
+	}
+	go readFanotifyEvents(os.NewFile(uintptr(fd), "fanotify"), tracker)
+	return nil
+}
+
+// readFanotifyEvents marks the file of each event read from the fanotify group
+// as used.
+func readFanotifyEvents(group *os.File, tracker *actions.IdleTracker) {
+	buf := make([]byte, 4096*unsafe.Sizeof(unix.FanotifyEventMetadata{}))
+	for {
+		n, err := group.Read(buf)
+		if err != nil {
+			util.Debugf("reading fanotify events: %v", err)
+			return
+		}
+		now := time.Now()
+		for offset := 0; offset+int(unsafe.Sizeof(unix.FanotifyEventMetadata{})) <= n; {
+			event := (*unix.FanotifyEventMetadata)(unsafe.Pointer(&buf[offset]))
+			if event.Vers != unix.FANOTIFY_METADATA_VERSION {
+				util.Debugf("unsupported fanotify metadata version %d", event.Vers)
+				return
+			}
+			if event.Fd >= 0 {
+				markFileUsed(int(event.Fd), tracker, now)
+			} else if event.Mask&unix.FAN_Q_OVERFLOW != 0 {
+				util.Debugf("fanotify event queue overflowed")
+			}
+			offset += int(event.Event_len)
+		}
+	}
+}
+
+// markFileUsed marks the policy of the file opened as fd (if it is encrypted)
+// as used, and closes fd.
+func markFileUsed(fd int, tracker *actions.IdleTracker, now time.Time) {
+	file := os.NewFile(uintptr(fd), fmt.Sprintf("/proc/self/fd/%d", fd))
+	defer file.Close()
+	data, _, err := metadata.GetPolicyFromFile(file)
+	if err != nil {
+		return
+	}
+	tracker.MarkUsed(data.KeyDescriptor, now)
+}
+
+// runAgent locks the policies which have been idle for the timeout every
+// interval, until the agent is told to exit with SIGINT or SIGTERM.
+func runAgent(c *cli.Context, ctx *actions.Context, tracker *actions.IdleTracker,
+	interval time.Duration, needsDropCaches bool) error {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, unix.SIGINT, unix.SIGTERM)
+	defer signal.Stop(signals)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		results, err := tracker.LockIdle(time.Now())
+		if err != nil {
+			return err
+		}
+		if len(results) > 0 {
+			fmt.Fprintf(c.App.Writer, "%s: locking idle policies on %q\n",
+				time.Now().Format(time.RFC3339), ctx.Mount.Path)
+			notLocked, err := writeLockResults(c.App.Writer, results)
+			if err != nil {
+				return err
+			}
+			if len(results) > notLocked && needsDropCaches {
+				if err = dropCachesIfRequested(c, ctx); err != nil {
+					return err
+				}
+			}
+		}
+
+		select {
+		case sig := <-signals:
+			util.Debugf("received %v, exiting", sig)
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,42 @@
+/*
+ * agent_test.go - tests for locking idle policies
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// Tests that idle policies are checked for often enough to lock them soon after
+// the timeout, but not too often.
+func TestAgentCheckInterval(t *testing.T) {
+	testCases := []struct {
+		timeout, expected time.Duration
+	}{
+		{time.Second, time.Second},
+		{30 * time.Second, 3 * time.Second},
+		{5 * time.Minute, 30 * time.Second},
+		{time.Hour, time.Minute},
+	}
+	for _, testCase := range testCases {
+		if got := agentCheckInterval(testCase.timeout); got != testCase.expected {
+			t.Errorf("timeout %v: got %v, expected %v", testCase.timeout, got, testCase.expected)
+		}
+	}
+}
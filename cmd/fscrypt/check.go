@@ -0,0 +1,62 @@
+/*
+ * check.go - Reporting and repairing inconsistencies in the metadata of a
+ * filesystem.
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/google/fscrypt/actions"
+)
+
+// writeMetadataProblems lists the problems found on the filesystem mounted at
+// mountpoint, repairing those which can be repaired if repair is set. It returns
+// the number of problems which are left.
+func writeMetadataProblems(w io.Writer, mountpoint string,
+	problems []*actions.MetadataProblem, repair bool) (int, error) {
+	if len(problems) == 0 {
+		fmt.Fprintf(w, "No problems found with the metadata on %q.\n", mountpoint)
+		return 0, nil
+	}
+	fmt.Fprintf(w, "Found %s with the metadata on %q:\n",
+		pluralize(len(problems), "problem"), mountpoint)
+	left, repairable := 0, 0
+	for _, problem := range problems {
+		fmt.Fprintf(w, "  %s\n", problem)
+		switch {
+		case problem.RepairAction == "":
+			left++
+		case !repair:
+			fmt.Fprintf(w, "      can be repaired: %s\n", problem.RepairAction)
+			left++
+			repairable++
+		default:
+			if err := problem.Repair(); err != nil {
+				return 0, err
+			}
+			fmt.Fprintf(w, "      repaired: %s\n", problem.RepairAction)
+		}
+	}
+	if repairable > 0 {
+		fmt.Fprintf(w, "%s can be repaired with %s.\n",
+			pluralize(repairable, "problem"), shortDisplay(repairFlag))
+	}
+	return left, nil
+}
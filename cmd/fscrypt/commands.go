@@ -22,13 +22,19 @@ package main
 
 import (
 	"fmt"
-	"log"
+	"io"
 	"os"
+	"os/exec"
+	"os/signal"
+	"os/user"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"syscall"
 
 	"github.com/pkg/errors"
 	"github.com/urfave/cli"
+	"golang.org/x/sys/unix"
 
 	"github.com/google/fscrypt/actions"
 	"github.com/google/fscrypt/crypto"
@@ -51,7 +57,8 @@ var Setup = cli.Command{
 		config file %[2]s and the fscrypt metadata directory for the
 		root filesystem (i.e. /.fscrypt). This requires root privileges.
 		The passphrase hashing parameters in %[2]s are automatically set
-		to an appropriate hardness, as determined by %[3]s. The root
+		to an appropriate hardness, as determined by %[3]s, for the KDF
+		chosen with %[6]s. The root
 		filesystem's metadata directory is created even if the root
 		filesystem doesn't support encryption itself, since it's where
 		login passphrase protectors are stored.
@@ -60,14 +67,56 @@ var Setup = cli.Command{
 		metadata directory for the filesystem mounted at %[1]s. This
 		allows fscrypt to be used on that filesystem, provided that any
 		kernel and filesystem-specific prerequisites are also met (see
-		the README). This may require root privileges.`,
+		the README). This may require root privileges.
+
+		By default, each policy and protector is stored in a file of
+		its own. With %[5]s=packed, they are all stored in a single
+		file instead, which saves space and makes listing them faster
+		on filesystems with very many of them. This requires that only
+		the calling user can create metadata on the filesystem.
+
+		With %[7]s, the metadata directory is created at DIR instead
+		of %[1]s/.fscrypt, and this is recorded in %[2]s, so this
+		requires root privileges. This is useful for read-only
+		filesystems, or shared storage whose root directory isn't
+		writable.
+
+		With %[4]s, anything that is already set up is left alone and
+		reported as "already configured", and the command still exits
+		successfully. This is useful for configuration management
+		tools which run this command repeatedly.`,
 		mountpointArg, actions.ConfigFileLocation,
-		shortDisplay(timeTargetFlag)),
-	Flags:  []cli.Flag{timeTargetFlag, forceFlag, allUsersSetupFlag},
+		shortDisplay(timeTargetFlag), shortDisplay(idempotentFlag),
+		"--"+metadataStoreFlag.GetName(), shortDisplay(kdfFlag),
+		shortDisplay(metadataDirFlag)),
+	Flags: []cli.Flag{timeTargetFlag, forceFlag, allUsersSetupFlag, idempotentFlag,
+		metadataStoreFlag, kdfFlag, metadataDirFlag},
 	Action: setupAction,
 }
 
 func setupAction(c *cli.Context) error {
+	switch metadataStoreFlag.Value {
+	case "", filesystem.PerFileStore.String():
+	case filesystem.PackedStore.String():
+		if allUsersSetupFlag.Value {
+			return &usageError{c, fmt.Sprintf("%s=%s can't be used with %s",
+				"--"+metadataStoreFlag.GetName(), filesystem.PackedStore,
+				shortDisplay(allUsersSetupFlag))}
+		}
+	default:
+		return &usageError{c, fmt.Sprintf("invalid value %q for %s",
+			metadataStoreFlag.Value, shortDisplay(metadataStoreFlag))}
+	}
+	if _, ok := metadata.KDF_value[kdfFlag.Value]; !ok {
+		return &usageError{c, fmt.Sprintf("invalid value %q for %s",
+			kdfFlag.Value, shortDisplay(kdfFlag))}
+	}
+
+	if metadataDirFlag.Value != "" && c.NArg() != 1 {
+		return &usageError{c, fmt.Sprintf("%s can only be used with %s",
+			shortDisplay(metadataDirFlag), mountpointArg)}
+	}
+
 	switch c.NArg() {
 	case 0:
 		// Case (1) - global setup
@@ -84,8 +133,26 @@ func setupAction(c *cli.Context) error {
 		}
 	case 1:
 		// Case (2) - filesystem setup
-		if err := setupFilesystem(c.App.Writer, c.Args().Get(0)); err != nil {
-			return newExitError(c, err)
+		mountpoint := c.Args().Get(0)
+		if metadataDirFlag.Value != "" {
+			mnt, err := useMetadataDirFlag(mountpoint)
+			if err != nil {
+				return newExitError(c, err)
+			}
+			mountpoint = mnt.Path
+		}
+		if err := setupFilesystem(c.App.Writer, mountpoint); err != nil {
+			setupErr, ok := err.(*filesystem.ErrAlreadySetup)
+			if !ok || !idempotentFlag.Value {
+				return newExitError(c, err)
+			}
+			fmt.Fprintf(c.App.Writer, "Filesystem %q already configured.\n",
+				setupErr.Mount.Path)
+		}
+		if metadataDirFlag.Value != "" {
+			if err := actions.AddMetadataDir(mountpoint, metadataDirFlag.Value); err != nil {
+				return newExitError(c, err)
+			}
 		}
 	default:
 		return expectedArgsErr(c, 1, true)
@@ -101,26 +168,207 @@ var Encrypt = cli.Command{
 	Description: fmt.Sprintf(`This command enables filesystem encryption on
 		%[1]s. This may involve creating a new policy (if one is not
 		specified with %[2]s) or a new protector (if one is not
-		specified with %[3]s). This command requires that the
+		specified with %[3]s). When %[3]s is given, no protector is
+		created or prompted for: the new policy is protected by the
+		specified protector, which must be unlocked with its existing
+		passphrase or key. This command requires that the
 		corresponding filesystem has been setup with "fscrypt setup
 		%[4]s". By default, after %[1]s is setup, it is unlocked and can
-		immediately be used.`, directoryArg, shortDisplay(policyFlag),
-		shortDisplay(protectorFlag), mountpointArg),
+		immediately be used.
+
+		When run as root, %[5]s can be used to set up %[1]s on behalf of
+		another user: the directory and any new fscrypt metadata are
+		made owned by that user, and new protectors default to being
+		login protectors for that user.
+
+		When creating a new policy, %[6]s can be used to encrypt file
+		contents in units smaller than the filesystem block size, as
+		needed by some inline encryption hardware. Similarly, %[12]s
+		and %[13]s choose the encryption modes, e.g. AES_128_CBC and
+		AES_128_CTS for low-power devices which lack AES-256
+		acceleration. Only the combinations which the kernel accepts
+		can be used. %[14]s=64 lets inline encryption hardware encrypt
+		the file contents with a single key for the whole policy, and
+		%[14]s=32 does so for eMMC hardware limited to 32-bit IVs.
+
+		Existing files can't be encrypted in place. Instead, %[7]s can
+		be used to move the contents of an unencrypted directory into
+		%[1]s, which is created if it doesn't exist yet. The files are
+		copied (preserving their ownership, permissions, timestamps,
+		extended attributes, and holes) and compared against the
+		originals, and only then are the originals overwritten with
+		random data and deleted. If anything goes wrong before that, no
+		originals are deleted. "fscrypt encrypt %[7]s DIR" migrates DIR
+		in place: its contents are copied into a new encrypted
+		directory next to it, which then atomically takes its name.
+		Note that due to the nature of modern storage devices and
+		filesystems, the original data may still be recoverable from
+		disk afterwards.
+
+		For auditing, %[8]s records each directory once it has been
+		fully set up, as one line of JSON appended to FILE. The line
+		gives the directory's absolute path, its mountpoint, the policy
+		descriptor, version, and encryption options, the descriptors of
+		the protectors, and the time. It never contains keys or
+		passphrases.
+
+		When testing kernels with experimental encryption support,
+		%[9]s skips checking whether the kernel supports encryption on
+		the filesystem, so only the kernel's own checks apply when the
+		encryption policy is set. The options are still checked for
+		consistency. Misuse can create directories which no released
+		kernel can decrypt.
+
+		With Adiantum, new policies use the DIRECT_KEY flag, so that
+		the file contents are encrypted with the policy key directly
+		rather than with a key derived for each file. %[10]s=off
+		disables this.
+
+		With %[11]s, a new policy uses the encryption options of a
+		profile from the "profiles" section of the config file, and a
+		new protector uses its passphrase hashing costs. Settings which
+		the profile leaves unset come from the rest of the config file.
+		The available profiles are listed below.
+
+		With %[15]s, nothing is created or changed: the metadata files
+		which would be written, the key which would be added, and the
+		files which would be migrated are only printed. No passphrase
+		or key is asked for.`, directoryArg,
+		shortDisplay(policyFlag), shortDisplay(protectorFlag),
+		mountpointArg, shortDisplay(ownerFlag),
+		shortDisplay(dataUnitSizeFlag), shortDisplay(migrateFlag),
+		shortDisplay(manifestFlag), shortDisplay(skipKernelCheckFlag),
+		"--"+directKeyFlag.GetName(), shortDisplay(profileFlag),
+		shortDisplay(contentsFlag), shortDisplay(filenamesFlag),
+		"--"+ivInoLblkFlag.GetName(), shortDisplay(dryRunFlag)),
 	Flags: []cli.Flag{policyFlag, unlockWithFlag, protectorFlag, sourceFlag,
-		userFlag, nameFlag, keyFileFlag, skipUnlockFlag, noRecoveryFlag},
+		userFlag, nameFlag, keyFileFlag, skipUnlockFlag, noRecoveryFlag,
+		ownerFlag, dataUnitSizeFlag, contentsFlag, filenamesFlag,
+		ivInoLblkFlag, migrateFlag, manifestFlag, skipKernelCheckFlag, directKeyFlag,
+		fromStdinKeyBase64Flag, profileFlag, tpm2PCRsFlag,
+		restrictAccessFlag, allowUsersFlag, allowGroupsFlag, dryRunFlag},
 	Action: encryptAction,
 }
 
 func encryptAction(c *cli.Context) error {
-	if c.NArg() != 1 {
+	// "fscrypt encrypt --migrate DIR" migrates DIR in place.
+	inPlace := migrateFlag.Value != "" && (c.NArg() == 0 ||
+		(c.NArg() == 1 && filepath.Clean(c.Args().Get(0)) == filepath.Clean(migrateFlag.Value)))
+	if c.NArg() != 1 && !inPlace {
 		return expectedArgsErr(c, 1, false)
 	}
+	if protectorFlag.Value != "" && (nameFlag.Value != "" || sourceFlag.Value != "") {
+		return &usageError{c, fmt.Sprintf("%s cannot be used with %s or %s",
+			shortDisplay(protectorFlag), shortDisplay(nameFlag),
+			shortDisplay(sourceFlag))}
+	}
+	if dataUnitSizeFlag.Value != 0 && policyFlag.Value != "" {
+		return &usageError{c, fmt.Sprintf("%s cannot be used with %s",
+			shortDisplay(dataUnitSizeFlag), shortDisplay(policyFlag))}
+	}
+	for _, flag := range []*stringFlag{contentsFlag, filenamesFlag} {
+		if flag.Value == "" {
+			continue
+		}
+		if metadata.EncryptionOptions_Mode_value[flag.Value] == 0 {
+			return &usageError{c, fmt.Sprintf("invalid value %q for %s",
+				flag.Value, shortDisplay(flag))}
+		}
+		if policyFlag.Value != "" {
+			return &usageError{c, fmt.Sprintf("%s cannot be used with %s",
+				shortDisplay(flag), shortDisplay(policyFlag))}
+		}
+	}
+	switch ivInoLblkFlag.Value {
+	case "", ivInoLblk64, ivInoLblk32:
+	default:
+		return &usageError{c, fmt.Sprintf("invalid value %q for %s",
+			ivInoLblkFlag.Value, shortDisplay(ivInoLblkFlag))}
+	}
+	if ivInoLblkFlag.Value != "" && policyFlag.Value != "" {
+		return &usageError{c, fmt.Sprintf("%s cannot be used with %s",
+			shortDisplay(ivInoLblkFlag), shortDisplay(policyFlag))}
+	}
+	switch directKeyFlag.Value {
+	case "", directKeyOn, directKeyOff:
+	default:
+		return &usageError{c, fmt.Sprintf("invalid value %q for %s",
+			directKeyFlag.Value, shortDisplay(directKeyFlag))}
+	}
+	if directKeyFlag.Value != "" && policyFlag.Value != "" {
+		return &usageError{c, fmt.Sprintf("%s cannot be used with %s",
+			shortDisplay(directKeyFlag), shortDisplay(policyFlag))}
+	}
+	if profileFlag.Value != "" && policyFlag.Value != "" {
+		return &usageError{c, fmt.Sprintf("%s cannot be used with %s",
+			shortDisplay(profileFlag), shortDisplay(policyFlag))}
+	}
+	if migrateFlag.Value != "" && skipUnlockFlag.Value {
+		return &usageError{c, fmt.Sprintf("%s cannot be used with %s",
+			shortDisplay(migrateFlag), shortDisplay(skipUnlockFlag))}
+	}
+
+	owner, err := parseOwnerFlag()
+	if err != nil {
+		return newExitError(c, err)
+	}
+	if owner != nil && userFlag.Value == "" {
+		// The directory is for the owner, so use their login
+		// passphrase and keyring by default.
+		userFlag.Value = owner.Username
+	}
+	if dryRunFlag.Value {
+		if err := writeEncryptPlan(c.App.Writer, c.Args().Get(0), inPlace); err != nil {
+			return newExitError(c, err)
+		}
+		return nil
+	}
 
 	path := c.Args().Get(0)
-	if err := encryptPath(path); err != nil {
+	finalPath := path
+	createdDir := false
+	if inPlace {
+		// The contents are copied into a new encrypted sibling, which
+		// then takes the directory's place.
+		finalPath = migrateFlag.Value
+		path = migrationSibling(migrateFlag.Value)
+		if err := checkMigrateSource(migrateFlag.Value, path); err != nil {
+			return newExitError(c, err)
+		}
+		if err := os.Mkdir(path, 0700); os.IsExist(err) {
+			return newExitError(c, &ErrMigrateSource{migrateFlag.Value,
+				fmt.Sprintf("%q already exists; remove it if it was left behind by an interrupted migration", path)})
+		} else if err != nil {
+			return newExitError(c, err)
+		}
+		createdDir = true
+	} else if migrateFlag.Value != "" {
+		if err := checkMigrateSource(migrateFlag.Value, path); err != nil {
+			return newExitError(c, err)
+		}
+		if err := os.Mkdir(path, 0700); err == nil {
+			createdDir = true
+		} else if !os.IsExist(err) {
+			return newExitError(c, err)
+		}
+	}
+	if err := encryptPath(c.App.Writer, path, finalPath); err != nil {
+		if createdDir {
+			os.Remove(path)
+		}
 		return newExitError(c, err)
 	}
 
+	if owner != nil {
+		if err := setOwner(path, owner); err != nil {
+			return newExitError(c, err)
+		}
+	} else if inPlace {
+		if err := copyOwner(migrateFlag.Value, path); err != nil {
+			return newExitError(c, err)
+		}
+	}
+
 	// Most people expect that other users can't see their encrypted files
 	// while they're unlocked, so change the directory's mode to 0700.
 	if err := os.Chmod(path, 0700); err != nil {
@@ -128,6 +376,25 @@ func encryptAction(c *cli.Context) error {
 		// Continue on; don't consider this a fatal error.
 	}
 
+	if inPlace {
+		if err := migrateInPlace(migrateFlag.Value, path); err != nil {
+			return newExitError(c, err)
+		}
+		path = migrateFlag.Value
+	} else if migrateFlag.Value != "" {
+		if err := migrateFiles(migrateFlag.Value, path); err != nil {
+			return newExitError(c, err)
+		}
+		fmt.Fprintf(c.App.Writer, "The contents of %q have been moved into %q.\n",
+			migrateFlag.Value, path)
+	}
+
+	if manifestFlag.Value != "" {
+		if err := writeManifest(manifestFlag.Value, path); err != nil {
+			return newExitError(c, err)
+		}
+	}
+
 	if !skipUnlockFlag.Value {
 		fmt.Fprintf(c.App.Writer,
 			"%q is now encrypted, unlocked, and ready for use.\n", path)
@@ -195,10 +462,58 @@ func writeRecoveryInstructions(recoveryPassphrase *crypto.Key, recoveryProtector
 	return nil
 }
 
+// The values of ivInoLblkFlag.
+const (
+	ivInoLblk64 = "64"
+	ivInoLblk32 = "32"
+)
+
+// The values of directKeyFlag.
+const (
+	directKeyOn  = "on"
+	directKeyOff = "off"
+)
+
+// applyDirectKeyFlag overrides whether options use the DIRECT_KEY flag. Both
+// settings are rejected for encryption modes which don't support the flag, as
+// the kernel would otherwise reject the policy with just EINVAL.
+func applyDirectKeyFlag(options *metadata.EncryptionOptions) error {
+	if !options.SupportsDirectKey() {
+		return metadata.ErrDirectKeyUnsupported
+	}
+	options.NoDirectKey = directKeyFlag.Value == directKeyOff
+	return nil
+}
+
+// writeProfiles writes the profiles defined in the config file after the help
+// of commands which take profileFlag. Nothing is written if there are none, or
+// the config file can't be read.
+func writeProfiles(w io.Writer, command cli.Command) {
+	takesProfile := false
+	for _, flag := range command.Flags {
+		takesProfile = takesProfile || flag == cli.Flag(profileFlag)
+	}
+	if !takesProfile {
+		return
+	}
+	names, err := actions.ListProfiles()
+	if err != nil || len(names) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "Profiles (from %s):\n", actions.ConfigFileLocation)
+	for _, name := range names {
+		fmt.Fprintf(w, "%s%s\n", strings.Repeat(" ", indentLength), name)
+	}
+	fmt.Fprintln(w)
+}
+
 // encryptPath sets up encryption on path and provisions the policy to the
-// keyring unless --skip-unlock is used. On failure, an error is returned, any
-// metadata creation is reverted, and the directory is unmodified.
-func encryptPath(path string) (err error) {
+// keyring unless --skip-unlock is used. If path will take the place of another
+// directory, finalPath names that directory, so that it is recorded as using the
+// policy; otherwise it is path. On failure, an error is returned, any metadata
+// creation is rolled back, and the directory is unmodified. Warnings are
+// written to w.
+func encryptPath(w io.Writer, path, finalPath string) (err error) {
 	targetUser, err := parseUserFlag()
 	if err != nil {
 		return
@@ -210,12 +525,72 @@ func encryptPath(path string) (err error) {
 	if err = checkEncryptable(ctx, path); err != nil {
 		return
 	}
+	if ownerFlag.Value != "" && sourceFlag.Value == "" {
+		ctx.Config.Source = metadata.SourceType_pam_passphrase
+	}
+	if profileFlag.Value != "" {
+		if err = ctx.UseProfile(profileFlag.Value); err != nil {
+			return
+		}
+	}
+	if dataUnitSizeFlag.Value != 0 {
+		ctx.Config.Options.DataUnitSize = dataUnitSizeFlag.Value
+	}
+	if contentsFlag.Value != "" {
+		ctx.Config.Options.Contents = metadata.EncryptionOptions_Mode(
+			metadata.EncryptionOptions_Mode_value[contentsFlag.Value])
+	}
+	if filenamesFlag.Value != "" {
+		ctx.Config.Options.Filenames = metadata.EncryptionOptions_Mode(
+			metadata.EncryptionOptions_Mode_value[filenamesFlag.Value])
+	}
+	// A no_direct_key setting for Adiantum doesn't apply to other modes.
+	if !ctx.Config.Options.SupportsDirectKey() {
+		ctx.Config.Options.NoDirectKey = false
+	}
+	switch ivInoLblkFlag.Value {
+	case ivInoLblk64:
+		ctx.Config.Options.IvInoLblk_64 = true
+		ctx.Config.Options.IvInoLblk_32 = false
+	case ivInoLblk32:
+		ctx.Config.Options.IvInoLblk_32 = true
+		ctx.Config.Options.IvInoLblk_64 = false
+	}
+	if dataUnitSizeFlag.Value != 0 || contentsFlag.Value != "" || filenamesFlag.Value != "" ||
+		ivInoLblkFlag.Value != "" {
+		if err = ctx.Config.Options.CheckValidity(); err != nil {
+			return
+		}
+	}
+	if directKeyFlag.Value != "" {
+		if err = applyDirectKeyFlag(ctx.Config.Options); err != nil {
+			return
+		}
+	}
+	if policyFlag.Value == "" && !skipKernelCheckFlag.Value {
+		if err = checkOptionsSupported(ctx.Config.Options, path); err != nil {
+			return
+		}
+	}
+
+	// Everything created from here on is removed again if we fail before
+	// the policy has been applied.
+	rollback := &actions.Rollback{}
+	defer rollback.Run()
+	mounts := []*filesystem.Mount{ctx.Mount}
+	// New login protectors are stored on the root filesystem.
+	if loginMount, mountErr := filesystem.GetMount(actions.LoginProtectorMountpoint); mountErr == nil {
+		mounts = append(mounts, loginMount)
+	}
+	if err = rollback.Begin(mounts...); err != nil {
+		return
+	}
 
 	var policy *actions.Policy
 	var recoveryPassphrase *crypto.Key
 	var recoveryProtector *actions.Protector
 	if policyFlag.Value != "" {
-		log.Printf("getting policy for %q", path)
+		util.Debugf("getting policy for %q", path)
 
 		if policy, err = getPolicyFromFlag(policyFlag.Value, ctx.TargetUser); err != nil {
 			return
@@ -228,7 +603,7 @@ func encryptPath(path string) (err error) {
 			}
 		}
 	} else {
-		log.Printf("creating policy for %q", path)
+		util.Debugf("creating policy for %q", path)
 
 		if !skipUnlockFlag.Value {
 			if err = validateKeyringPrereqs(ctx, nil); err != nil {
@@ -236,17 +611,12 @@ func encryptPath(path string) (err error) {
 			}
 		}
 
-		protector, created, protErr := selectOrCreateProtector(ctx)
+		protector, protErr := selectOrCreateProtector(ctx)
 		if protErr != nil {
 			return protErr
 		}
-		defer func() {
-			protector.Lock()
-			// Successfully created protector should be reverted on failure.
-			if err != nil && created {
-				protector.Revert()
-			}
-		}()
+		defer protector.Lock()
+		rollback.AddProtector(protector)
 
 		if err = protector.Unlock(existingKeyFn); err != nil {
 			return
@@ -254,13 +624,8 @@ func encryptPath(path string) (err error) {
 		if policy, err = actions.CreatePolicy(ctx, protector); err != nil {
 			return
 		}
-		defer func() {
-			policy.Lock()
-			// Successfully created policy should be reverted on failure.
-			if err != nil {
-				policy.Revert()
-			}
-		}()
+		defer policy.Lock()
+		rollback.AddPolicy(policy)
 
 		// Generate a recovery passphrase if needed.
 		if ctx.Mount != protector.Context.Mount && !noRecoveryFlag.Value {
@@ -268,14 +633,9 @@ func encryptPath(path string) (err error) {
 				policy, filepath.Base(path)); err != nil {
 				return
 			}
-			defer func() {
-				recoveryPassphrase.Wipe()
-				recoveryProtector.Lock()
-				// Successfully created protector should be reverted on failure.
-				if err != nil {
-					recoveryProtector.Revert()
-				}
-			}()
+			defer recoveryPassphrase.Wipe()
+			defer recoveryProtector.Lock()
+			rollback.AddProtector(recoveryProtector)
 		}
 	}
 
@@ -295,26 +655,73 @@ func encryptPath(path string) (err error) {
 			}
 		}()
 	}
+	if err = rollback.Applying(policy, path); err != nil {
+		return
+	}
 	if err = policy.Apply(path); err != nil {
 		return
 	}
+	if finalPath != path {
+		if err = policy.AddDirectory(finalPath); err != nil {
+			return
+		}
+	}
+	// The directory now depends on the metadata, so keep it even if
+	// writing the recovery instructions fails.
+	rollback.Commit()
+	warnIfFilenamesLimited(w, path, policy.Options())
 	return writeRecoveryInstructions(recoveryPassphrase, recoveryProtector, policy, path)
 }
 
+// warnIfFilenamesLimited warns if the encryption options used for path make
+// the longest filename that can be created in it shorter than NAME_MAX, since
+// otherwise creating such files would later fail with a confusing error.
+func warnIfFilenamesLimited(w io.Writer, path string, options *metadata.EncryptionOptions) {
+	maxLen := metadata.MaxFilenameLength(options)
+	util.Debugf("filenames in %q can be at most %d bytes long", path, maxLen)
+	if maxLen < unix.NAME_MAX && !quietFlag.Value {
+		fmt.Fprintf(w, "Warning: filenames in %q will be limited to %d bytes.\n",
+			path, maxLen)
+	}
+}
+
+// setOwner gives owner ownership of the newly encrypted directory at path,
+// along with anything fscrypt created in it (such as recovery instructions).
+func setOwner(path string, owner *user.User) error {
+	uid := util.AtoiOrPanic(owner.Uid)
+	gid := util.AtoiOrPanic(owner.Gid)
+	util.Debugf("changing owner of %q to %s", path, owner.Username)
+	return filepath.Walk(path, func(subpath string, _ os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Lchown(subpath, uid, gid)
+	})
+}
+
 // checkEncryptable returns an error if the path cannot be encrypted.
 func checkEncryptable(ctx *actions.Context, path string) error {
 
-	log.Printf("checking whether %q is already encrypted", path)
+	util.Debugf("checking whether %q is already encrypted", path)
 	if _, err := metadata.GetPolicy(path); err == nil {
 		return &metadata.ErrAlreadyEncrypted{Path: path}
 	}
 
-	log.Printf("checking whether filesystem %s supports encryption", ctx.Mount.Path)
-	if err := ctx.Mount.CheckSupport(); err != nil {
+	util.Debugf("checking whether %q is reserved by fscrypt", path)
+	if err := ctx.Mount.CheckNotReserved(path); err != nil {
 		return err
 	}
 
-	log.Printf("checking whether %q is an empty and readable directory", path)
+	if skipKernelCheckFlag.Value {
+		warnSkippingKernelCheck(ctx.Mount)
+	} else {
+		util.Debugf("checking whether filesystem %s supports encryption", ctx.Mount.Path)
+		if err := ctx.Mount.CheckSupport(); err != nil {
+			return err
+		}
+	}
+
+	util.Debugf("checking whether %q is an empty and readable directory", path)
 	f, err := os.Open(path)
 	if err != nil {
 		return err
@@ -325,7 +732,7 @@ func checkEncryptable(ctx *actions.Context, path string) error {
 	case err != nil:
 		// Could not read directory (might not be a directory)
 		err = errors.Wrap(err, path)
-		log.Print(err)
+		util.Debug(err)
 		return err
 	case len(names) > 0:
 		return &ErrDirNotEmpty{path}
@@ -333,45 +740,70 @@ func checkEncryptable(ctx *actions.Context, path string) error {
 	return err
 }
 
+// checkOptionsSupported checks that the kernel accepts the encryption options
+// of a new policy by probing them in path, so that e.g. Adiantum and the
+// DIRECT_KEY flag on kernels older than v5.0 are rejected before any metadata is
+// created. If the probe itself fails, the options are only checked once the
+// policy is set.
+func checkOptionsSupported(options *metadata.EncryptionOptions, path string) error {
+	util.Debugf("checking whether the kernel supports the options %v", options)
+	supported, err := metadata.ProbeOptions(path, options)
+	if err != nil {
+		util.Debugf("could not probe the encryption options: %v", err)
+		return nil
+	}
+	if !supported {
+		return &metadata.ErrBadEncryptionOptions{Path: path, Options: options}
+	}
+	return nil
+}
+
+// warnSkippingKernelCheck warns that --skip-kernel-check is used. The warning is
+// written to stderr, so it is shown even with --quiet.
+func warnSkippingKernelCheck(mount *filesystem.Mount) {
+	util.Warnf("skipping the check for encryption support on %s", mount.Path)
+	msg := fmt.Sprintf(`Not checking whether the kernel supports encryption
+	on %q. If this kernel accepts encryption options which other kernels
+	don't support, the directory can only be decrypted on this kernel.`,
+		mount.Path)
+	hdr := "WARNING: "
+	fmt.Fprint(os.Stderr, "\n"+hdr+wrapText(msg, len(hdr))+"\n\n")
+}
+
 // selectOrCreateProtector uses user input (or flags) to either create a new
-// protector or select an existing one. The boolean return value is true if we
-// created a new protector.
-func selectOrCreateProtector(ctx *actions.Context) (*actions.Protector, bool, error) {
+// protector or select an existing one.
+func selectOrCreateProtector(ctx *actions.Context) (*actions.Protector, error) {
 	if protectorFlag.Value != "" {
-		protector, err := getProtectorFromFlag(protectorFlag.Value, ctx.TargetUser)
-		return protector, false, err
+		return getProtectorFromFlag(protectorFlag.Value, ctx.TargetUser)
 	}
 
 	options, err := expandedProtectorOptions(ctx)
 	if err != nil {
-		return nil, false, err
+		return nil, err
 	}
 
 	// Having no existing options to choose from or using creation-only
 	// flags indicates we should make a new protector.
 	if len(options) == 0 || nameFlag.Value != "" || sourceFlag.Value != "" {
-		protector, err := createProtectorFromContext(ctx)
-		return protector, true, err
+		return createProtectorFromContext(ctx)
 	}
 
 	shouldCreate, err := askQuestion("Should we create a new protector?", false)
 	if err != nil {
-		return nil, false, err
+		return nil, err
 	}
 	if shouldCreate {
-		protector, err := createProtectorFromContext(ctx)
-		return protector, true, err
+		return createProtectorFromContext(ctx)
 	}
 
-	log.Print("finding an existing protector to use")
-	protector, err := selectExistingProtector(ctx, options)
-	return protector, false, err
+	util.Debug("finding an existing protector to use")
+	return selectExistingProtector(ctx, options)
 }
 
 // Unlock takes an encrypted directory and unlocks it for reading and writing.
 var Unlock = cli.Command{
 	Name:      "unlock",
-	ArgsUsage: directoryArg,
+	ArgsUsage: fmt.Sprintf("[%s | %s]", directoryArg, shortDisplay(afterSuspendFlag)),
 	Usage:     "unlock an encrypted directory",
 	Description: fmt.Sprintf(`This command takes %s, a directory setup for
 		use with fscrypt, and unlocks the directory by passing the
@@ -379,14 +811,53 @@ var Unlock = cli.Command{
 		the protectors protecting this directory (either by selecting a
 		protector or specifying one with %s). This directory will be
 		locked again upon reboot, or after running "fscrypt lock" or
-		"fscrypt purge".`, directoryArg,
-		shortDisplay(unlockWithFlag)),
-	Flags:  []cli.Flag{unlockWithFlag, keyFileFlag, userFlag},
+		"fscrypt purge".
+
+		With %s, the arguments following "--" are run as a command
+		once the directory has been unlocked, and the directory is
+		locked again as soon as the command exits, whether or not it
+		succeeded. The exit status of the command becomes the exit
+		status of fscrypt. If the directory was already unlocked, the
+		command is still run, but the directory is left unlocked
+		afterwards.
+
+		With %s, passphrases are taken from the desktop's Secret
+		Service (e.g. the GNOME or KDE keyring) when stored there, and
+		otherwise prompted for and offered to be stored there once the
+		directory has been unlocked. This requires libsecret's
+		"secret-tool"; if it is missing or the service is unavailable,
+		the passphrases are prompted for as usual.
+
+		With %[5]s instead of %[1]s, each of the policies which were
+		locked by "fscrypt lock %[6]s" before the system suspended is
+		offered to be unlocked again, unless it already has been.`,
+		directoryArg, shortDisplay(unlockWithFlag), shortDisplay(andRunFlag),
+		shortDisplay(secretServiceFlag), shortDisplay(afterSuspendFlag),
+		shortDisplay(forSuspendFlag)),
+	Flags: []cli.Flag{unlockWithFlag, keyFileFlag, userFlag, andRunFlag,
+		failOnHookErrorFlag, secretServiceFlag, fromStdinKeyBase64Flag,
+		afterSuspendFlag},
 	Action: unlockAction,
 }
 
 func unlockAction(c *cli.Context) error {
-	if c.NArg() != 1 {
+	if afterSuspendFlag.Value {
+		if andRunFlag.Value {
+			return &usageError{c, fmt.Sprintf("%s cannot be used with %s",
+				shortDisplay(afterSuspendFlag), shortDisplay(andRunFlag))}
+		}
+		return unlockAfterSuspendAction(c)
+	}
+	var command []string
+	if andRunFlag.Value {
+		command = c.Args().Tail()
+		if len(command) > 0 && command[0] == "--" {
+			command = command[1:]
+		}
+		if len(command) == 0 {
+			return &usageError{c, "no command given to run"}
+		}
+	} else if c.NArg() != 1 {
 		return expectedArgsErr(c, 1, false)
 	}
 
@@ -400,7 +871,7 @@ func unlockAction(c *cli.Context) error {
 		return newExitError(c, err)
 	}
 
-	log.Printf("performing sanity checks")
+	util.Debugf("performing sanity checks")
 	// Ensure path is encrypted and filesystem is using fscrypt.
 	policy, err := actions.GetPolicyFromPath(ctx, path)
 	if err != nil {
@@ -412,11 +883,18 @@ func unlockAction(c *cli.Context) error {
 	}
 	// Check if directory is already unlocked
 	if policy.IsProvisionedByTargetUser() {
-		log.Printf("policy %s is already provisioned by %v",
+		util.Debugf("policy %s is already provisioned by %v",
 			policy.Descriptor(), ctx.TargetUser.Username)
-		return newExitError(c, errors.Wrapf(ErrDirAlreadyUnlocked, path))
+		if command == nil {
+			return newExitError(c, errors.Wrapf(ErrDirAlreadyUnlocked, path))
+		}
+		// Someone else is relying on the directory being unlocked, so
+		// don't lock it once the command exits.
+		util.Debugf("running command without relocking %q afterwards", path)
+		return runCommand(c, command)
 	}
 
+	defer wipeEnteredPassphrases()
 	if err := policy.Unlock(optionFn, existingKeyFn); err != nil {
 		return newExitError(c, err)
 	}
@@ -427,6 +905,118 @@ func unlockAction(c *cli.Context) error {
 	}
 
 	fmt.Fprintf(c.App.Writer, "%q is now unlocked and ready for use.\n", path)
+	storeEnteredPassphrases()
+	hookErr := handleHookError(c, policy.RunPostUnlockHook(path))
+	if command == nil {
+		return hookErr
+	}
+	// The key is in the keyring now, so there's no need to keep our copy
+	// of it around while the command runs.
+	policy.Lock()
+
+	runErr := hookErr
+	if runErr == nil {
+		runErr = runCommand(c, command)
+	}
+	if err := relockAfterCommand(c, policy, path); err != nil {
+		if runErr != nil {
+			fmt.Fprintln(os.Stderr, newExitError(c, err))
+			return runErr
+		}
+		return newExitError(c, err)
+	}
+	fmt.Fprintf(c.App.Writer, "%q is now locked.\n", path)
+	if hookErr = handleHookError(c, policy.RunPostLockHook(path)); runErr == nil {
+		return hookErr
+	}
+	return runErr
+}
+
+// handleHookError reports the failure of a post_unlock_hook or post_lock_hook.
+// The failure is only fatal if requested with --fail-on-hook-error; otherwise
+// it's just a warning, since the directory was still unlocked or locked.
+func handleHookError(c *cli.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+	if failOnHookErrorFlag.Value {
+		return newExitError(c, err)
+	}
+	util.Debug(err)
+	fmt.Fprintf(c.App.Writer, "Warning: %v\n", err)
+	return nil
+}
+
+// runCommand runs the command given to "fscrypt unlock --and-run", connected
+// to our stdin, stdout, and stderr. Termination signals received while the
+// command is running are passed on to it, so that we are still around to lock
+// the directory afterwards. If the command fails, the returned error exits
+// with the command's exit status.
+func runCommand(c *cli.Context, command []string) error {
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, unix.SIGINT, unix.SIGTERM, unix.SIGHUP)
+	defer signal.Stop(signals)
+
+	util.Debugf("running %q", command)
+	if err := cmd.Start(); err != nil {
+		return newExitError(c, err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	for {
+		select {
+		case sig := <-signals:
+			util.Debugf("passing %v on to %q", sig, command[0])
+			cmd.Process.Signal(sig)
+		case err := <-done:
+			exitErr, ok := err.(*exec.ExitError)
+			if !ok {
+				if err != nil {
+					return newExitError(c, err)
+				}
+				return nil
+			}
+			code := exitErr.ExitCode()
+			if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+				// Follow the shell convention for commands
+				// which were killed by a signal.
+				code = 128 + int(status.Signal())
+			}
+			util.Debugf("%q exited with status %d", command[0], code)
+			return cli.NewExitError("", code)
+		}
+	}
+}
+
+// relockAfterCommand locks the directory again after "fscrypt unlock
+// --and-run", like "fscrypt lock" does (but without the --all-users option).
+func relockAfterCommand(c *cli.Context, policy *actions.Policy, path string) error {
+	err := policy.Deprovision(false)
+	switch err {
+	case nil, keyring.ErrKeyNotPresent:
+		break
+	case keyring.ErrKeyAddedByOtherUsers:
+		return &ErrDirUnlockedByOtherUsers{path}
+	case keyring.ErrKeyFilesOpen:
+		return &ErrDirFilesOpen{path}
+	default:
+		return err
+	}
+	if policy.NeedsUserKeyring() {
+		if util.IsUserRoot() {
+			if err = security.DropFilesystemCache(); err != nil {
+				return err
+			}
+		}
+		if isDirUnlockedHeuristic(path) {
+			return &ErrDirFilesOpen{path}
+		}
+	}
 	return nil
 }
 
@@ -444,9 +1034,11 @@ func dropCachesIfRequested(c *cli.Context, ctx *actions.Context) error {
 
 // Lock takes an encrypted directory and locks it, undoing Unlock.
 var Lock = cli.Command{
-	Name:      "lock",
-	ArgsUsage: directoryArg,
-	Usage:     "lock an encrypted directory",
+	Name: "lock",
+	ArgsUsage: fmt.Sprintf("[%s | %s | %s %s | %s]", directoryArg,
+		shortDisplay(policyFlag), shortDisplay(allPoliciesFlag), mountpointArg,
+		shortDisplay(forSuspendFlag)),
+	Usage: "lock an encrypted directory",
 	Description: fmt.Sprintf(`This command takes %s, an encrypted directory
 		which has been unlocked by fscrypt, and locks the directory by
 		removing the encryption key from the kernel. I.e., it undoes the
@@ -461,18 +1053,78 @@ var Lock = cli.Command{
 
 		If the directory uses a v2 encryption policy, then a non-root
 		user can lock it, but only if it's the same user who unlocked it
-		originally and if no other users have unlocked it too.
+		originally and if no other users have unlocked it too. Root can
+		use %[6]s to remove the claim of one of the users who unlocked
+		it, as listed by "fscrypt status %[1]s".
+
+		Locking a directory locks all directories that use the same
+		encryption policy. If there are any such directories, this
+		command refuses to lock them unless %[3]s is given.
+
+		Instead of %[1]s, the policy can be given with %[4]s, e.g. if
+		the directory's path isn't known. Then the policy's key is
+		removed without looking for the directories which use it, so
+		all of them are locked. The post_lock_hook isn't run in this
+		case, since there is no directory to pass to it.
+
+		With %[7]s %[8]s, all the policies which are unlocked on the
+		filesystem %[8]s are locked at once, e.g. before unmounting it
+		or suspending the system, and the result for each of them is
+		listed, including those which stay unlocked because some of
+		their files are still open. Policies which only other users
+		have unlocked are left alone, unless %[9]s is given.
+
+		With %[10]s, the policies set with "suspend_lock_policies" in
+		the config file (or, if none are set, all the unlocked policies
+		on all filesystems) are locked for all users before the system
+		suspends, and recorded for "fscrypt unlock %[11]s". This is
+		meant to be run as root by a systemd-sleep hook.
+
+		With %[5]s, a mount can be tightened once the lock has
+		succeeded, e.g. unmounting a filesystem which depends on the
+		directory, or remounting one with noexec so that binaries
+		cached from the directory can't be run. If this fails, the
+		directory still stays locked.
 
 		WARNING: even after the key has been removed, decrypted data may
 		still be present in freed memory, where it may still be
 		recoverable by an attacker who compromises system memory. To be
 		fully safe, you must reboot with a power cycle.`,
-		directoryArg, shortDisplay(dropCachesFlag)),
-	Flags:  []cli.Flag{dropCachesFlag, userFlag, allUsersLockFlag},
+		directoryArg, shortDisplay(dropCachesFlag), shortDisplay(forceFlag),
+		shortDisplay(policyFlag), shortDisplay(afterFlag),
+		shortDisplay(userFlag), shortDisplay(allPoliciesFlag), mountpointArg,
+		shortDisplay(allUsersLockFlag), shortDisplay(forSuspendFlag),
+		shortDisplay(afterSuspendFlag)),
+	Flags: []cli.Flag{dropCachesFlag, userFlag, allUsersLockFlag,
+		failOnHookErrorFlag, forceFlag, policyFlag, allPoliciesFlag, afterFlag,
+		forSuspendFlag},
 	Action: lockAction,
 }
 
 func lockAction(c *cli.Context) error {
+	if forSuspendFlag.Value {
+		return lockForSuspendAction(c)
+	}
+	after, err := parseAfterFlag(c)
+	if err != nil {
+		return err
+	}
+	if allPoliciesFlag.Value {
+		if policyFlag.Value != "" {
+			return &usageError{c, fmt.Sprintf("%s cannot be used with %s",
+				shortDisplay(allPoliciesFlag), shortDisplay(policyFlag))}
+		}
+		if c.NArg() != 1 {
+			return expectedArgsErr(c, 1, false)
+		}
+		return lockAllPoliciesAction(c, after)
+	}
+	if policyFlag.Value != "" {
+		if c.NArg() != 0 {
+			return expectedArgsErr(c, 0, false)
+		}
+		return lockPolicyAction(c, after)
+	}
 	if c.NArg() != 1 {
 		return expectedArgsErr(c, 1, false)
 	}
@@ -487,7 +1139,7 @@ func lockAction(c *cli.Context) error {
 		return newExitError(c, err)
 	}
 
-	log.Printf("performing sanity checks")
+	util.Debugf("performing sanity checks")
 	// Ensure path is encrypted and filesystem is using fscrypt.
 	policy, err := actions.GetPolicyFromPath(ctx, path)
 	if err != nil {
@@ -501,12 +1153,20 @@ func lockAction(c *cli.Context) error {
 	if policy.NeedsUserKeyring() && dropCachesFlag.Value && !util.IsUserRoot() {
 		return newExitError(c, ErrDropCachesPerm)
 	}
+	if err = checkLockAffectsOtherDirs(c.App.Writer, ctx, policy, path); err != nil {
+		return newExitError(c, err)
+	}
 
+	hadClaim := policy.GetProvisioningStatus() == keyring.KeyPresent
 	if err = policy.Deprovision(allUsersLockFlag.Value); err != nil {
 		switch err {
 		case keyring.ErrKeyNotPresent:
 			break
 		case keyring.ErrKeyAddedByOtherUsers:
+			if hadClaim {
+				// Our own claim to the key was still removed.
+				writeOtherUsersNotice(c.App.Writer, policy, path)
+			}
 			return newExitError(c, &ErrDirUnlockedByOtherUsers{path})
 		case keyring.ErrKeyFilesOpen:
 			return newExitError(c, &ErrDirFilesOpen{path})
@@ -520,7 +1180,7 @@ func lockAction(c *cli.Context) error {
 		// due to open files.  Try to detect that case and finish
 		// locking the directory by dropping caches again.
 		if !policy.NeedsUserKeyring() || !isDirUnlockedHeuristic(path) {
-			log.Printf("policy %s is already fully deprovisioned", policy.Descriptor())
+			util.Debugf("policy %s is already fully deprovisioned", policy.Descriptor())
 			return newExitError(c, errors.Wrapf(ErrDirAlreadyLocked, path))
 		}
 	}
@@ -535,63 +1195,254 @@ func lockAction(c *cli.Context) error {
 	}
 
 	fmt.Fprintf(c.App.Writer, "%q is now locked.\n", path)
-	return nil
-}
-
-func isPossibleNoKeyName(filename string) bool {
-	// No-key names are at least 22 bytes long, since they are
-	// base64-encoded and ciphertext filenames are at least 16 bytes.
-	if len(filename) < 22 {
-		return false
-	}
-	// On the latest kernels, no-key names contain only base64url characters
-	// (A-Z, a-z, 0-9, -, and _).  On older kernels, the + and , characters
-	// were used too.  Allow all of these characters.
-	validChars := "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_+,"
-	for _, char := range filename {
-		if !strings.ContainsRune(validChars, char) {
-			return false
-		}
+	hookErr := handleHookError(c, policy.RunPostLockHook(path))
+	if err = runAfterLockAction(c, after); err != nil {
+		return err
 	}
-	return true
+	return hookErr
 }
 
-// isDirUnlockedHeuristic returns true if the directory is definitely still
-// unlocked.  This is the case if we can create a subdirectory or if the
-// directory contains filenames that aren't valid no-key names.  It returns
-// false if the directory is probably locked (though it could also be unlocked).
-//
-// This is only useful if the directory's policy uses the user keyring, since
-// otherwise the status can be easily found via the filesystem keyring.
-func isDirUnlockedHeuristic(dirPath string) bool {
-	subdirPath := filepath.Join(dirPath, "fscrypt-is-dir-unlocked")
-	if err := os.Mkdir(subdirPath, 0700); err == nil {
-		os.Remove(subdirPath)
-		return true
-	}
-	dir, err := os.Open(dirPath)
+// lockPolicyAction locks the policy given by policyFlag, for when the lock
+// command isn't given a directory, then runs the action after (if non-nil).
+func lockPolicyAction(c *cli.Context, after *afterLockAction) error {
+	targetUser, err := parseUserFlag()
 	if err != nil {
-		return false
+		return newExitError(c, err)
 	}
-	defer dir.Close()
-
-	names, err := dir.Readdirnames(-1)
+	// This validates the filesystem's setup and that the policy exists.
+	policy, err := getPolicyFromFlag(policyFlag.Value, targetUser)
 	if err != nil {
-		return false
+		return newExitError(c, err)
 	}
-	for _, name := range names {
-		if !isPossibleNoKeyName(name) {
-			return true
-		}
+	ctx := policy.Context
+	if err = validateKeyringPrereqs(ctx, policy); err != nil {
+		return newExitError(c, err)
+	}
+	if policy.NeedsUserKeyring() && dropCachesFlag.Value && !util.IsUserRoot() {
+		return newExitError(c, ErrDropCachesPerm)
 	}
-	return false
-}
 
-// Purge removes all the policy keys from the keyring (also need unmount).
+	hadClaim := policy.GetProvisioningStatus() == keyring.KeyPresent
+	if err = policy.Deprovision(allUsersLockFlag.Value); err != nil {
+		switch err {
+		case keyring.ErrKeyNotPresent:
+			return newExitError(c, errors.Wrapf(ErrPolicyAlreadyLocked,
+				"policy %s", policy.Descriptor()))
+		case keyring.ErrKeyAddedByOtherUsers:
+			if hadClaim && !quietFlag.Value {
+				fmt.Fprintf(c.App.Writer, "Removed your claim to policy %s.\n",
+					policy.Descriptor())
+			}
+			return newExitError(c, &ErrPolicyUnlockedByOtherUsers{policy.Descriptor()})
+		default:
+			// This includes keyring.ErrKeyFilesOpen, for which
+			// there is no directory to suggest checking.
+			return newExitError(c, err)
+		}
+	}
+	if policy.NeedsUserKeyring() {
+		if err = dropCachesIfRequested(c, ctx); err != nil {
+			return newExitError(c, err)
+		}
+	}
+
+	fmt.Fprintf(c.App.Writer, "Policy %s on %q is now locked.\n",
+		policy.Descriptor(), ctx.Mount.Path)
+	return runAfterLockAction(c, after)
+}
+
+// lockAllPoliciesAction locks all the policies which are unlocked on the
+// filesystem given as the argument, then runs the action after (if non-nil).
+func lockAllPoliciesAction(c *cli.Context, after *afterLockAction) error {
+	targetUser, err := parseUserFlag()
+	if err != nil {
+		return newExitError(c, err)
+	}
+	ctx, err := actions.NewContextFromMountpoint(c.Args().Get(0), targetUser)
+	if err != nil {
+		return newExitError(c, err)
+	}
+	if err = validateKeyringPrereqs(ctx, nil); err != nil {
+		return newExitError(c, err)
+	}
+	// As when locking a single directory, check for permission to drop
+	// caches up front if there are v1 policies whose keys are in user
+	// keyrings.
+	needsDropCaches, err := hasUserKeyringPolicies(ctx)
+	if err != nil {
+		return newExitError(c, err)
+	}
+	if needsDropCaches && dropCachesFlag.Value && !util.IsUserRoot() {
+		return newExitError(c, ErrDropCachesPerm)
+	}
+
+	results, err := actions.LockAllPolicies(ctx, allUsersLockFlag.Value)
+	if err != nil {
+		return newExitError(c, err)
+	}
+	notLocked, err := writeLockResults(c.App.Writer, results)
+	if err != nil {
+		return newExitError(c, err)
+	}
+	if len(results) > notLocked && needsDropCaches {
+		if err = dropCachesIfRequested(c, ctx); err != nil {
+			return newExitError(c, err)
+		}
+	}
+	if len(results) == 0 {
+		fmt.Fprintf(c.App.Writer, "No policies are unlocked on %q.\n", ctx.Mount.Path)
+	} else {
+		fmt.Fprintf(c.App.Writer, "Locked %d of %s unlocked on %q.\n",
+			len(results)-notLocked, pluralize(len(results), "policy"), ctx.Mount.Path)
+	}
+	if notLocked > 0 {
+		return newExitError(c, &ErrPoliciesNotFullyLocked{ctx.Mount.Path, notLocked})
+	}
+	return runAfterLockAction(c, after)
+}
+
+// hasUserKeyringPolicies returns true if the filesystem has v1 policies whose
+// keys are added to user keyrings.
+func hasUserKeyringPolicies(ctx *actions.Context) (bool, error) {
+	if ctx.Config.GetUseFsKeyringForV1Policies() {
+		return false, nil
+	}
+	policies, err := ctx.Mount.ListPolicies(nil)
+	if err != nil {
+		return false, err
+	}
+	for _, descriptor := range policies {
+		if len(descriptor) == metadata.PolicyDescriptorLenV1 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// writeLockResults lists what locking each policy did, and returns how many
+// policies weren't fully locked.
+func writeLockResults(w io.Writer, results []*actions.LockResult) (int, error) {
+	if len(results) == 0 {
+		return 0, nil
+	}
+	notLocked := 0
+	t := makeTableWriter(w, "POLICY\tRESULT")
+	for _, result := range results {
+		var description string
+		switch {
+		case result.Err != nil:
+			description = "Failed: " + result.Err.Error()
+		case result.FullyLocked():
+			description = "Locked"
+		case result.Status == keyring.KeyAbsentButFilesBusy:
+			description = "Incompletely locked, as some files are still open"
+		default:
+			description = "Still unlocked by other users"
+		}
+		if !result.FullyLocked() {
+			notLocked++
+		}
+		fmt.Fprintf(t, "%s\t%s\n", result.PolicyDescriptor, description)
+	}
+	if err := t.Flush(); err != nil {
+		return 0, err
+	}
+	fmt.Fprintln(w)
+	return notLocked, nil
+}
+
+// checkLockAffectsOtherDirs returns an error if locking path would also lock
+// other directories which use the same policy, unless --force was given, in
+// which case it just warns about them. Only the directories which fscrypt
+// recorded are checked, so that locking doesn't search the whole filesystem.
+func checkLockAffectsOtherDirs(w io.Writer, ctx *actions.Context,
+	policy *actions.Policy, path string) error {
+	if policy.GetProvisioningStatus() == keyring.KeyAbsent {
+		// Nothing will be locked.
+		return nil
+	}
+	realPath, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return err
+	}
+	paths, _, err := ctx.PathsForPolicy(policy.Descriptor())
+	if err != nil {
+		return err
+	}
+	var otherDirs []string
+	for _, dir := range paths {
+		if realPath != dir && !strings.HasPrefix(realPath, dir+"/") {
+			otherDirs = append(otherDirs, dir)
+		}
+	}
+	if len(otherDirs) == 0 {
+		return nil
+	}
+	if !forceFlag.Value {
+		return &ErrDirSharesPolicy{path, otherDirs}
+	}
+	if !quietFlag.Value {
+		fmt.Fprintf(w, "Warning: also locking other directories with the same policy: %s\n",
+			quoteList(otherDirs))
+	}
+	return nil
+}
+
+func isPossibleNoKeyName(filename string) bool {
+	// No-key names are at least 22 bytes long, since they are
+	// base64-encoded and ciphertext filenames are at least 16 bytes.
+	if len(filename) < 22 {
+		return false
+	}
+	// On the latest kernels, no-key names contain only base64url characters
+	// (A-Z, a-z, 0-9, -, and _).  On older kernels, the + and , characters
+	// were used too.  Allow all of these characters.
+	validChars := "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_+,"
+	for _, char := range filename {
+		if !strings.ContainsRune(validChars, char) {
+			return false
+		}
+	}
+	return true
+}
+
+// isDirUnlockedHeuristic returns true if the directory is definitely still
+// unlocked.  This is the case if we can create a subdirectory or if the
+// directory contains filenames that aren't valid no-key names.  It returns
+// false if the directory is probably locked (though it could also be unlocked).
+//
+// This is only useful if the directory's policy uses the user keyring, since
+// otherwise the status can be easily found via the filesystem keyring.
+func isDirUnlockedHeuristic(dirPath string) bool {
+	subdirPath := filepath.Join(dirPath, "fscrypt-is-dir-unlocked")
+	if err := os.Mkdir(subdirPath, 0700); err == nil {
+		os.Remove(subdirPath)
+		return true
+	}
+	dir, err := os.Open(dirPath)
+	if err != nil {
+		return false
+	}
+	defer dir.Close()
+
+	names, err := dir.Readdirnames(-1)
+	if err != nil {
+		return false
+	}
+	for _, name := range names {
+		if !isPossibleNoKeyName(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Purge removes all the policy keys from the keyring (also need unmount).
 var Purge = cli.Command{
-	Name:      "purge",
-	ArgsUsage: mountpointArg,
-	Usage:     "Remove a filesystem's keys",
+	Name: "purge",
+	ArgsUsage: fmt.Sprintf("[%s | %s | %s]", mountpointArg, directoryArg,
+		shortDisplay(policyFlag)),
+	Usage: "Remove a filesystem's keys",
 	Description: fmt.Sprintf(`This command removes a user's policy keys for
 		directories on %[1]s. This is intended to lock all files and
 		directories encrypted by the user on %[1]s, in that unlocking
@@ -619,37 +1470,93 @@ var Purge = cli.Command{
 		means direct memory access (either though physical compromise or
 		a kernel exploit) could compromise encrypted data. This weakness
 		can be eliminated by cycling the power or mitigated by using
-		page cache and slab cache poisoning.`, mountpointArg,
-		shortDisplay(dropCachesFlag)),
-	Flags:  []cli.Flag{forceFlag, dropCachesFlag, userFlag},
+		page cache and slab cache poisoning.
+
+		With %[3]s, only the claims of that user to the policy keys are
+		removed, so directories which other users have unlocked stay
+		unlocked for them. The result for each policy is listed,
+		including which policies became fully locked. v1 policy keys in
+		the filesystem keyring are skipped, as they can only be removed
+		for all users at once. Using %[3]s for another user requires
+		root privileges.
+
+		With %[4]s, the policies whose keys would be removed are only
+		listed.
+
+		Instead of %[1]s, an encrypted directory %[5]s, or a policy
+		given with %[6]s, can be purged on its own. Then only the key
+		of its policy is removed, so the directories of other policies
+		and users aren't disturbed. The caches are only dropped if the
+		policy is a v1 policy using a user keyring, as the kernel
+		evicts the files of other policies itself once their key is
+		removed.`, mountpointArg,
+		shortDisplay(dropCachesFlag), shortDisplay(userFlag),
+		shortDisplay(dryRunFlag), directoryArg, shortDisplay(policyFlag)),
+	Flags:  []cli.Flag{forceFlag, dropCachesFlag, userFlag, dryRunFlag, policyFlag},
 	Action: purgeAction,
 }
 
 func purgeAction(c *cli.Context) error {
-	if c.NArg() != 1 {
-		return expectedArgsErr(c, 1, false)
-	}
-
-	if dropCachesFlag.Value {
-		if !util.IsUserRoot() {
-			return newExitError(c, ErrDropCachesPerm)
+	if policyFlag.Value != "" {
+		if c.NArg() != 0 {
+			return expectedArgsErr(c, 0, false)
 		}
+	} else if c.NArg() != 1 {
+		return expectedArgsErr(c, 1, false)
 	}
 
 	targetUser, err := parseUserFlag()
 	if err != nil {
+		if userFlag.Value != "" {
+			err = errors.Wrapf(ErrUnknownUser, "%q", userFlag.Value)
+		}
 		return newExitError(c, err)
 	}
-	mountpoint := c.Args().Get(0)
-	ctx, err := actions.NewContextFromMountpoint(mountpoint, targetUser)
+	userOnly := userFlag.Value != ""
+	if userOnly && !util.IsUserRoot() && targetUser.Uid != strconv.Itoa(os.Geteuid()) {
+		return newExitError(c, ErrMustBeRoot)
+	}
+	if policyFlag.Value != "" {
+		policy, err := getPolicyFromFlag(policyFlag.Value, targetUser)
+		if err != nil {
+			return newExitError(c, err)
+		}
+		return purgePolicyAction(c, policy, "", targetUser, userOnly)
+	}
+	path := c.Args().Get(0)
+	ctx, err := actions.NewContextFromMountpoint(path, targetUser)
+	if _, ok := err.(*filesystem.ErrNotAMountpoint); ok && isExistingDir(path) {
+		// Only the policy of the given directory is purged.
+		if ctx, err = actions.NewContextFromPath(path, targetUser); err != nil {
+			return newExitError(c, err)
+		}
+		policy, err := actions.GetPolicyFromPath(ctx, path)
+		if err != nil {
+			return newExitError(c, err)
+		}
+		return purgePolicyAction(c, policy, path, targetUser, userOnly)
+	}
 	if err != nil {
 		return newExitError(c, err)
 	}
+	if dropCachesFlag.Value && !util.IsUserRoot() {
+		return newExitError(c, ErrDropCachesPerm)
+	}
 	if err = validateKeyringPrereqs(ctx, nil); err != nil {
 		return newExitError(c, err)
 	}
+	if dryRunFlag.Value {
+		if err = writePurgePlan(c.App.Writer, ctx, userOnly); err != nil {
+			return newExitError(c, err)
+		}
+		return nil
+	}
 
 	question := fmt.Sprintf("Purge all policy keys from %q", ctx.Mount.Path)
+	if userOnly {
+		question = fmt.Sprintf("Purge %s's policy keys from %q",
+			targetUser.Username, ctx.Mount.Path)
+	}
 	if dropCachesFlag.Value {
 		question += " and drop global inode cache"
 	}
@@ -658,10 +1565,20 @@ func purgeAction(c *cli.Context) error {
 		return newExitError(c, err)
 	}
 
-	if err = actions.PurgeAllPolicies(ctx); err != nil {
-		return newExitError(c, err)
+	if userOnly {
+		results, err := actions.PurgeUserPolicies(ctx)
+		if err != nil {
+			return newExitError(c, err)
+		}
+		if err = writePurgeResults(c.App.Writer, targetUser, results); err != nil {
+			return newExitError(c, err)
+		}
+	} else {
+		if err = actions.PurgeAllPolicies(ctx); err != nil {
+			return newExitError(c, err)
+		}
+		fmt.Fprintf(c.App.Writer, "Policies purged for %q.\n", ctx.Mount.Path)
 	}
-	fmt.Fprintf(c.App.Writer, "Policies purged for %q.\n", ctx.Mount.Path)
 
 	if err = dropCachesIfRequested(c, ctx); err != nil {
 		return newExitError(c, err)
@@ -669,6 +1586,126 @@ func purgeAction(c *cli.Context) error {
 	return nil
 }
 
+// isExistingDir returns true if path names an existing directory.
+func isExistingDir(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
+
+// purgePolicyAction removes the key of a single policy, used by the directory
+// path (or given by policyFlag, if path is empty), instead of the keys of all
+// the policies on its filesystem. The caches are only dropped if the policy
+// uses a user keyring, since removing a key from a filesystem keyring already
+// evicts the inodes which use it, and then only its filesystem is synced.
+func purgePolicyAction(c *cli.Context, policy *actions.Policy, path string,
+	targetUser *user.User, userOnly bool) error {
+	ctx := policy.Context
+	if err := validateKeyringPrereqs(ctx, policy); err != nil {
+		return newExitError(c, err)
+	}
+	dropCaches := dropCachesFlag.Value && policy.NeedsUserKeyring()
+	if dropCaches && !util.IsUserRoot() {
+		return newExitError(c, ErrDropCachesPerm)
+	}
+	target := fmt.Sprintf("policy %s", policy.Descriptor())
+	if path != "" {
+		target = fmt.Sprintf("%q (policy %s)", path, policy.Descriptor())
+	}
+	if dryRunFlag.Value {
+		if userOnly {
+			fmt.Fprintf(c.App.Writer, "Would remove %s's claim to the key of %s.\n",
+				targetUser.Username, target)
+		} else {
+			fmt.Fprintf(c.App.Writer, "Would remove the key of %s from the keyring.\n", target)
+		}
+		if dropCaches {
+			fmt.Fprintln(c.App.Writer, "Would drop the global inode cache.")
+		}
+		return nil
+	}
+
+	question := fmt.Sprintf("Purge the key of %s", target)
+	if userOnly {
+		question = fmt.Sprintf("Purge %s's claim to the key of %s", targetUser.Username, target)
+	}
+	if dropCaches {
+		question += " and drop global inode cache"
+	}
+	warning := "Directories using this policy will be inaccessible until unlocked again!!"
+	if err := askConfirmation(question+"?", false, warning); err != nil {
+		return newExitError(c, err)
+	}
+
+	result, err := actions.PurgePolicy(policy, userOnly)
+	if err != nil {
+		return newExitError(c, err)
+	}
+	switch {
+	case result.Skipped:
+		fmt.Fprintf(c.App.Writer, "Skipped %s, as v1 policy keys in the filesystem keyring can only be removed for all users.\n",
+			target)
+		return nil
+	case !result.HadClaim:
+		fmt.Fprintf(c.App.Writer, "The key of %s wasn't in the keyring.\n", target)
+		return nil
+	case result.FullyLocked():
+		fmt.Fprintf(c.App.Writer, "Purged the key of %s.\n", target)
+	case result.Status == keyring.KeyAbsentButFilesBusy:
+		fmt.Fprintf(c.App.Writer, "Purged the key of %s, but some files are still in use.\n", target)
+	default:
+		fmt.Fprintf(c.App.Writer, "Purged the key of %s, but it is still unlocked by other users.\n", target)
+	}
+
+	if dropCaches {
+		if err = security.DropFilesystemCacheOf(ctx.Mount.Path); err != nil {
+			return newExitError(c, err)
+		}
+		fmt.Fprintf(c.App.Writer, "Encrypted data removed from filesystem cache.\n")
+	} else if policy.NeedsUserKeyring() {
+		fmt.Fprintf(c.App.Writer, "Filesystem %q should now be unmounted.\n", ctx.Mount.Path)
+	}
+	return nil
+}
+
+// writePurgeResults lists what purging the claims of targetUser did to each
+// policy's key, followed by a summary.
+func writePurgeResults(w io.Writer, targetUser *user.User, results []*actions.PurgeResult) error {
+	purged := 0
+	locked := 0
+	if len(results) > 0 {
+		t := makeTableWriter(w, "POLICY\tRESULT")
+		for _, result := range results {
+			var description string
+			switch {
+			case result.Skipped:
+				description = "Skipped (v1 policy key in the filesystem keyring)"
+			case !result.HadClaim:
+				description = "Not unlocked by " + targetUser.Username
+			case result.FullyLocked():
+				description = "Locked"
+			case result.Status == keyring.KeyAbsentButFilesBusy:
+				description = "Claim removed, but some files are still in use"
+			default:
+				description = "Claim removed, but still unlocked by other users"
+			}
+			if result.HadClaim {
+				purged++
+			}
+			if result.FullyLocked() {
+				locked++
+			}
+			fmt.Fprintf(t, "%s\t%s\n", result.PolicyDescriptor, description)
+		}
+		if err := t.Flush(); err != nil {
+			return err
+		}
+		fmt.Fprintln(w)
+	}
+	fmt.Fprintf(w, "Removed %s's claims to %s (%d now fully locked).\n",
+		targetUser.Username, pluralize(purged, "policy"), locked)
+	return nil
+}
+
 // Status is a command with three subcommands relating to printing out status.
 var Status = cli.Command{
 	Name:      "status",
@@ -691,40 +1728,1140 @@ var Status = cli.Command{
 
 		(3) When %[1]s is just a normal path, print information about
 		the policy being used on %[1]s and the protectors protecting
-		this file or directory. This command will fail if %[1]s is not
-		setup for encryption with fscrypt.`, pathArg),
+		this file or directory. Immediate subdirectories encrypted with
+		other policies (e.g. on other filesystems mounted there) are
+		listed with their own unlock state, as unlocking %[1]s doesn't
+		unlock them. If %[1]s is not encrypted, its encrypted
+		subdirectories are listed instead, and this command fails if
+		there are none.
+
+		(4) When %[2]s is used instead of %[1]s, print the information
+		from (2) for every filesystem which is being used by fscrypt.
+		Filesystems whose metadata cannot be read are noted in the
+		output rather than causing the command to fail.
+
+		(5) When %[4]s is used instead of %[1]s, list the fscrypt keys
+		in the user keyring of the current user (or the user given
+		with %[5]s) which have no policy on any filesystem set up for
+		use with fscrypt. Such keys may be left behind if a filesystem
+		was unmounted or a policy was destroyed while its key was
+		still added. With %[6]s, these keys are also removed. Only v1
+		policy keys in user keyrings can be found this way.
+
+		In cases (2) and (4), %[3]s can be used to only list the
+		policies which are currently locked or unlocked.
+
+		In cases (2), (3), and (4), %[7]s also lists the passphrase
+		hashing costs of each passphrase protector, with a rough
+		estimate of how long unlocking it takes on this system. The
+		estimate comes from the costs alone; the hash is not run.
+
+		In all cases, %[8]s prints the same information as JSON
+		instead of tables, for use by configuration management and
+		monitoring tools. Passphrase hashing costs are always
+		included, and %[6]s cannot be used.
+
+		With %[9]s, the whole directory tree at %[1]s is scanned
+		instead, and every directory whose policy differs from that
+		of its parent is listed with its unlock state. Unencrypted
+		directories inside encrypted ones, and directories encrypted
+		with a different policy than the directory containing them,
+		are reported with a warning, as the kernel refuses to access
+		them. Other filesystems mounted beneath %[1]s are not
+		scanned.
+
+		With %[10]s, %[1]s must be a mountpoint, and the whole
+		filesystem is searched for its top-level encrypted
+		directories, which are listed with the policies and
+		protectors they use and their unlock state. Policies in the
+		filesystem's metadata which no directory was found for are
+		listed as well. As this walks the whole filesystem (without
+		looking inside encrypted directories), it can take a while.`,
+		pathArg, shortDisplay(allFilesystemsFlag),
+		shortDisplay(filterFlag), shortDisplay(orphanedKeysFlag),
+		shortDisplay(userFlag), shortDisplay(removeFlag),
+		shortDisplay(verboseFlag), shortDisplay(jsonFlag),
+		shortDisplay(recursiveFlag), shortDisplay(findFlag)),
+	Flags: []cli.Flag{allFilesystemsFlag, filterFlag, orphanedKeysFlag,
+		removeFlag, userFlag, forceFlag, jsonFlag, recursiveFlag, findFlag},
 	Action: statusAction,
 }
 
 func statusAction(c *cli.Context) error {
 	var err error
 
-	switch c.NArg() {
-	case 0:
-		// Case (1) - global status
-		err = writeGlobalStatus(c.App.Writer)
-	case 1:
-		path := c.Args().Get(0)
+	switch filterFlag.Value {
+	case "", filterLocked, filterUnlocked:
+	default:
+		return &usageError{c, fmt.Sprintf("invalid value %q for %s",
+			filterFlag.Value, shortDisplay(filterFlag))}
+	}
+
+	if removeFlag.Value && !orphanedKeysFlag.Value {
+		return &usageError{c, fmt.Sprintf("%s can only be used with %s",
+			shortDisplay(removeFlag), shortDisplay(orphanedKeysFlag))}
+	}
+	if removeFlag.Value && jsonFlag.Value {
+		return &usageError{c, fmt.Sprintf("%s cannot be used with %s",
+			shortDisplay(removeFlag), shortDisplay(jsonFlag))}
+	}
+	if orphanedKeysFlag.Value {
+		// Case (5) - orphaned keys in the user keyring
+		if c.NArg() != 0 {
+			return expectedArgsErr(c, 0, false)
+		}
+		if allFilesystemsFlag.Value || filterFlag.Value != "" {
+			return &usageError{c, fmt.Sprintf("%s cannot be used with %s or %s",
+				shortDisplay(orphanedKeysFlag), shortDisplay(allFilesystemsFlag),
+				shortDisplay(filterFlag))}
+		}
+		targetUser, err := parseUserFlag()
+		if err != nil {
+			return newExitError(c, err)
+		}
+		if jsonFlag.Value {
+			err = writeOrphanedKeysJSON(c.App.Writer, targetUser)
+		} else {
+			err = writeOrphanedKeys(c.App.Writer, targetUser, removeFlag.Value)
+		}
+		if err != nil {
+			return newExitError(c, err)
+		}
+		return nil
+	}
+
+	if recursiveFlag.Value {
+		if c.NArg() != 1 {
+			return expectedArgsErr(c, 1, false)
+		}
+		if allFilesystemsFlag.Value || filterFlag.Value != "" {
+			return &usageError{c, fmt.Sprintf("%s cannot be used with %s or %s",
+				shortDisplay(recursiveFlag), shortDisplay(allFilesystemsFlag),
+				shortDisplay(filterFlag))}
+		}
+		if jsonFlag.Value {
+			err = writeRecursiveStatusJSON(c.App.Writer, c.Args().Get(0))
+		} else {
+			err = writeRecursiveStatus(c.App.Writer, c.Args().Get(0))
+		}
+		if err != nil {
+			return newExitError(c, err)
+		}
+		return nil
+	}
+
+	if findFlag.Value {
+		if c.NArg() != 1 {
+			return expectedArgsErr(c, 1, false)
+		}
+		if allFilesystemsFlag.Value || filterFlag.Value != "" || recursiveFlag.Value {
+			return &usageError{c, fmt.Sprintf("%s cannot be used with %s, %s, or %s",
+				shortDisplay(findFlag), shortDisplay(allFilesystemsFlag),
+				shortDisplay(filterFlag), shortDisplay(recursiveFlag))}
+		}
+		ctx, err := actions.NewContextFromMountpoint(c.Args().Get(0), nil)
+		if err != nil {
+			return newExitError(c, err)
+		}
+		if jsonFlag.Value {
+			err = writeFindStatusJSON(c.App.Writer, ctx)
+		} else {
+			err = writeFindStatus(c.App.Writer, ctx)
+		}
+		if err != nil {
+			return newExitError(c, err)
+		}
+		return nil
+	}
+
+	if allFilesystemsFlag.Value {
+		// Case (4) - status of all filesystems
+		if c.NArg() != 0 {
+			return expectedArgsErr(c, 0, false)
+		}
+		if jsonFlag.Value {
+			err = writeAllFilesystemsStatusJSON(c.App.Writer, filterFlag.Value)
+		} else {
+			err = writeAllFilesystemsStatus(c.App.Writer, filterFlag.Value)
+		}
+		if err != nil {
+			return newExitError(c, err)
+		}
+		return nil
+	}
+
+	switch c.NArg() {
+	case 0:
+		// Case (1) - global status
+		if filterFlag.Value != "" {
+			return &usageError{c, fmt.Sprintf("%s can only be used with a mountpoint",
+				shortDisplay(filterFlag))}
+		}
+		if jsonFlag.Value {
+			err = writeGlobalStatusJSON(c.App.Writer)
+		} else {
+			err = writeGlobalStatus(c.App.Writer)
+		}
+	case 1:
+		path := c.Args().Get(0)
+
+		var ctx *actions.Context
+		ctx, err = actions.NewContextFromMountpoint(path, nil)
+		if err == nil {
+			// Case (2) - mountpoint status
+			if jsonFlag.Value {
+				err = writeFilesystemStatusJSON(c.App.Writer, ctx, filterFlag.Value)
+			} else {
+				err = writeFilesystemStatus(c.App.Writer, ctx, filterFlag.Value)
+			}
+		} else if _, ok := err.(*filesystem.ErrNotAMountpoint); ok {
+			if filterFlag.Value != "" {
+				return &usageError{c, fmt.Sprintf("%s can only be used with a mountpoint",
+					shortDisplay(filterFlag))}
+			}
+			// Case (3) - file or directory status
+			if jsonFlag.Value {
+				err = writePathStatusJSON(c.App.Writer, path)
+			} else {
+				err = writePathStatus(c.App.Writer, path)
+			}
+		}
+	default:
+		return expectedArgsErr(c, 1, true)
+	}
+
+	if err != nil {
+		return newExitError(c, err)
+	}
+	return nil
+}
+
+// VerifyAccess is a command for checking that the files in an unlocked
+// directory can be decrypted.
+var VerifyAccess = cli.Command{
+	Name:      "verify-access",
+	ArgsUsage: directoryArg,
+	Usage:     "check that an unlocked directory's files can be read",
+	Description: fmt.Sprintf(`This command checks that the files in the
+		unlocked directory %[1]s actually decrypt, e.g. after
+		unlocking it or when filesystem corruption is suspected.
+		Unlike "fscrypt status", it reads the files themselves rather
+		than the fscrypt metadata.
+
+		Every directory in %[1]s is listed and every name in it is
+		looked up, which fails if the names can't be decrypted. A
+		directory whose names all look like encrypted names is also
+		reported, since that means it is still locked. The targets of
+		all symlinks are read, as are the first %[2]d bytes of a
+		sample of the regular files, whose size is set by %[3]s.
+		Subdirectories which use a different encryption policy are
+		skipped. The files which couldn't be read are listed, followed
+		by a summary, and the command fails if there were any.`,
+		directoryArg, verifyReadSize, shortDisplay(sampleFlag)),
+	Flags:  []cli.Flag{sampleFlag, userFlag},
+	Action: verifyAccessAction,
+}
+
+func verifyAccessAction(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return expectedArgsErr(c, 1, false)
+	}
+	if sampleFlag.Value < 0 {
+		return &usageError{c, fmt.Sprintf("%s must not be negative",
+			shortDisplay(sampleFlag))}
+	}
+
+	targetUser, err := parseUserFlag()
+	if err != nil {
+		return newExitError(c, err)
+	}
+	path := c.Args().Get(0)
+	ctx, err := actions.NewContextFromPath(path, targetUser)
+	if err != nil {
+		return newExitError(c, err)
+	}
+	policy, err := actions.GetPolicyFromPath(ctx, path)
+	if err != nil {
+		return newExitError(c, err)
+	}
+	// With the user keyring, another session may have unlocked the
+	// directory without the key being visible to us.
+	if policy.GetProvisioningStatus() == keyring.KeyAbsent &&
+		(!policy.NeedsUserKeyring() || !isDirUnlockedHeuristic(path)) {
+		return newExitError(c, errors.Wrapf(ErrDirNotUnlocked, path))
+	}
+
+	report, err := verifyAccess(path, int(sampleFlag.Value))
+	if err != nil {
+		return newExitError(c, err)
+	}
+	if err = writeAccessReport(c.App.Writer, path, report); err != nil {
+		return newExitError(c, err)
+	}
+	return nil
+}
+
+// Info is a command for reporting which encryption features are supported.
+var Info = cli.Command{
+	Name:      "info",
+	ArgsUsage: fmt.Sprintf("[%s]", mountpointArg),
+	Usage:     "print the encryption features supported by the kernel",
+	Description: fmt.Sprintf(`This command reports which encryption
+		features the running kernel supports. Unlike "fscrypt status",
+		it says nothing about the directories and metadata which have
+		been set up.
+
+		When used without %[1]s, list the filesystems which support
+		encryption, noting whether v2 encryption policies and inline
+		encryption are available.
+
+		When %[1]s is given, also check which combinations of
+		encryption modes and which policy flags the kernel accepts on
+		%[1]s. This is done by setting encryption policies on temporary
+		directories in %[1]s, so %[1]s must be writable. Checking v2
+		policies normally requires root. Features which could not be
+		checked are reported as unknown.
+
+		With %[2]s, the information is printed as JSON.`, mountpointArg,
+		shortDisplay(jsonFlag)),
+	Flags:  []cli.Flag{jsonFlag},
+	Action: infoAction,
+}
+
+func infoAction(c *cli.Context) error {
+	var mount *filesystem.Mount
+	switch c.NArg() {
+	case 0:
+	case 1:
+		var err error
+		if mount, err = filesystem.GetMount(c.Args().Get(0)); err != nil {
+			return newExitError(c, err)
+		}
+	default:
+		return expectedArgsErr(c, 1, true)
+	}
+
+	if err := writeKernelInfo(c.App.Writer, mount, jsonFlag.Value); err != nil {
+		return newExitError(c, err)
+	}
+	return nil
+}
+
+// Doctor is a command for checking whether fscrypt can be used on a filesystem.
+var Doctor = cli.Command{
+	Name:      "doctor",
+	ArgsUsage: fmt.Sprintf("[%s]", pathArg),
+	Usage:     "check whether fscrypt can operate on a filesystem",
+	Description: fmt.Sprintf(`This command checks whether fscrypt can
+		operate on the filesystem containing %[1]s, which defaults to
+		the root filesystem. It checks that the config file %[2]s is
+		valid, that the kernel and the filesystem support encryption,
+		and that the filesystem's fscrypt metadata is set up and can be
+		modified by the current user. The result of each check is
+		printed, along with how to fix the problems found. Nothing is
+		changed.`, pathArg, actions.ConfigFileLocation),
+	Action: doctorAction,
+}
+
+func doctorAction(c *cli.Context) error {
+	path := actions.LoginProtectorMountpoint
+	switch c.NArg() {
+	case 0:
+	case 1:
+		path = c.Args().Get(0)
+	default:
+		return expectedArgsErr(c, 1, true)
+	}
+
+	// The config file must be usable to run any of the checks.
+	ctx, err := actions.NewContextFromPath(path, nil)
+	if err != nil {
+		return newExitError(c, err)
+	}
+	results := ctx.RunValidationChecks()
+	if err = writeChecklist(c.App.Writer, ctx.Mount.Path, results); err != nil {
+		return newExitError(c, err)
+	}
+	return nil
+}
+
+// Check is a command for finding inconsistencies in the metadata of a
+// filesystem.
+var Check = cli.Command{
+	Name:      "check",
+	ArgsUsage: mountpointArg,
+	Usage:     "check the metadata on a filesystem for problems",
+	Description: fmt.Sprintf(`This command checks the fscrypt metadata on
+		%[1]s and the encrypted directories on it, like fsck. It reports
+		protectors and policies whose metadata can't be read, protectors
+		used by policies which can't be found, links to protectors on
+		other filesystems which can't be followed or aren't used,
+		policies which can't be unlocked because none of their
+		protectors can be found, policies which no directory is
+		encrypted with, and encrypted directories whose policy has no
+		metadata. The whole filesystem is searched for encrypted
+		directories, which can be slow; directories the current user
+		can't read are skipped, so run this command as root for a
+		complete check.
+
+		With %[2]s, the problems which can be fixed safely are
+		repaired: links to protectors are pointed at the filesystem
+		storing the protector (if there is exactly one), unused links
+		are removed, and missing policy metadata is restored from the
+		copy stored in the directory (see "store_policies_in_xattrs" in
+		the config file). Nothing else is changed; in particular,
+		unused policies are only reported, as removing them loses the
+		keys of any directories which couldn't be searched.`,
+		mountpointArg, shortDisplay(repairFlag)),
+	Flags:  []cli.Flag{repairFlag, userFlag},
+	Action: checkAction,
+}
+
+func checkAction(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return expectedArgsErr(c, 1, false)
+	}
+	targetUser, err := parseUserFlag()
+	if err != nil {
+		return newExitError(c, err)
+	}
+	ctx, err := actions.NewContextFromMountpoint(c.Args().Get(0), targetUser)
+	if err != nil {
+		return newExitError(c, err)
+	}
+	problems, err := ctx.CheckMetadata()
+	if err != nil {
+		return newExitError(c, err)
+	}
+	left, err := writeMetadataProblems(c.App.Writer, ctx.Mount.Path, problems, repairFlag.Value)
+	if err != nil {
+		return newExitError(c, err)
+	}
+	if !util.IsUserRoot() {
+		fmt.Fprintln(c.App.Writer, "Directories which can't be read by the current user were not searched.")
+	}
+	if left > 0 {
+		return newExitError(c, &ErrProblemsFound{ctx.Mount.Path, left})
+	}
+	return nil
+}
+
+// Agent is a command for locking the policies on a filesystem once they haven't
+// been used for a while.
+var Agent = cli.Command{
+	Name:      "agent",
+	ArgsUsage: mountpointArg,
+	Usage:     "lock idle encrypted directories automatically",
+	Description: fmt.Sprintf(`This command keeps running to watch the
+		policies which are unlocked on the filesystem %[1]s, and locks
+		each of them once none of the files or directories which use it
+		have been opened, read, or written for %[2]s (15 minutes by
+		default). This keeps the keys out of the kernel while they
+		aren't being used. The agent exits on SIGINT or SIGTERM, e.g.
+		when run as a systemd service.
+
+		Policies are locked as with "fscrypt lock %[3]s %[1]s": those
+		which only other users have unlocked are left alone unless %[4]s
+		is given, and those which stay unlocked because some of their
+		files are still open are locked again later.
+
+		Watching for uses of the files requires root privileges, as
+		fanotify is used. Otherwise, policies are locked %[2]s after
+		they are first seen unlocked, no matter whether they are being
+		used.`, mountpointArg, shortDisplay(idleTimeoutFlag),
+		shortDisplay(allPoliciesFlag), shortDisplay(allUsersLockFlag)),
+	Flags: []cli.Flag{idleTimeoutFlag, dropCachesFlag, userFlag,
+		allUsersLockFlag},
+	Action: agentAction,
+}
+
+func agentAction(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return expectedArgsErr(c, 1, false)
+	}
+	if idleTimeoutFlag.Value <= 0 {
+		return &usageError{c, fmt.Sprintf("%s must be positive",
+			shortDisplay(idleTimeoutFlag))}
+	}
+	targetUser, err := parseUserFlag()
+	if err != nil {
+		return newExitError(c, err)
+	}
+	ctx, err := actions.NewContextFromMountpoint(c.Args().Get(0), targetUser)
+	if err != nil {
+		return newExitError(c, err)
+	}
+	if err = validateKeyringPrereqs(ctx, nil); err != nil {
+		return newExitError(c, err)
+	}
+	needsDropCaches, err := hasUserKeyringPolicies(ctx)
+	if err != nil {
+		return newExitError(c, err)
+	}
+	if needsDropCaches && dropCachesFlag.Value && !util.IsUserRoot() {
+		return newExitError(c, ErrDropCachesPerm)
+	}
+
+	tracker, err := actions.NewIdleTracker(ctx, idleTimeoutFlag.Value, allUsersLockFlag.Value)
+	if err != nil {
+		return newExitError(c, err)
+	}
+	if err = watchPolicyUses(ctx.Mount.Path, tracker); err != nil {
+		util.Debug(err)
+		fmt.Fprintf(c.App.Writer, "Warning: can't watch for uses of the files on %q, "+
+			"so policies will be locked %v after they are unlocked.\n",
+			ctx.Mount.Path, idleTimeoutFlag.Value)
+	}
+	interval := agentCheckInterval(idleTimeoutFlag.Value)
+	util.Debugf("checking for idle policies every %v", interval)
+	if err = runAgent(c, ctx, tracker, interval, needsDropCaches); err != nil {
+		return newExitError(c, err)
+	}
+	return nil
+}
+
+// Key is a collection of commands for managing raw keys in the filesystem
+// keyrings, without any fscrypt metadata.
+var Key = cli.Command{
+	Name:  "key",
+	Usage: "[ADVANCED] manage raw keys in a filesystem's keyring",
+	Description: `These commands directly add keys for v2 encryption
+		policies to the keyring of a filesystem, remove them, and get
+		their status, like the fscryptctl tool. The keys are given by
+		their key identifier, which the kernel calculates from the key,
+		and aren't protected by any protector or recorded in the
+		fscrypt metadata, so the filesystem doesn't need to be set up
+		with "fscrypt setup". This is useful for directories whose
+		policies are managed by other tools.`,
+	Subcommands: []cli.Command{addKey, removeKey, keyStatus},
+}
+
+var addKey = cli.Command{
+	Name:      "add",
+	ArgsUsage: mountpointArg,
+	Usage:     "add a raw key to a filesystem's keyring",
+	Description: fmt.Sprintf(`This command adds a raw key for v2
+		encryption policies to the keyring of the filesystem %[1]s, and
+		prints its key identifier. The key is read from the file given
+		by %[2]s, or else from standard input, as raw binary, and must
+		be %[3]d to %[4]d bytes long.
+
+		For non-root users, the key is added on their behalf, so that
+		they can later remove it. As root, %[5]s can be used to add it
+		on behalf of another user.`, mountpointArg,
+		shortDisplay(keyFileFlag), keyring.MinRawKeyLen,
+		keyring.MaxRawKeyLen, shortDisplay(userFlag)),
+	Flags:  []cli.Flag{keyFileFlag, userFlag},
+	Action: addKeyAction,
+}
+
+func addKeyAction(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return expectedArgsErr(c, 1, false)
+	}
+	options, err := getRawKeyOptions(c.Args().Get(0))
+	if err != nil {
+		return newExitError(c, err)
+	}
+	key, err := readRawKey()
+	if err != nil {
+		return newExitError(c, err)
+	}
+	defer key.Wipe()
+
+	identifier, err := keyring.AddRawEncryptionKey(key, options)
+	if err != nil {
+		return newExitError(c, err)
+	}
+	fmt.Fprintf(c.App.Writer, "Added key %s to filesystem %q.\n",
+		identifier, options.Mount.Path)
+	return nil
+}
+
+var removeKey = cli.Command{
+	Name:      "remove",
+	ArgsUsage: fmt.Sprintf("%s %s", mountpointArg, keyIdentifierArg),
+	Usage:     "remove a raw key from a filesystem's keyring",
+	Description: fmt.Sprintf(`This command removes the key with the key
+		identifier %[1]s from the keyring of the filesystem %[2]s,
+		locking the directories which use it. If other users have added
+		the key too, only the current user's claim to it is removed,
+		unless %[3]s is given.
+
+		For this to be effective, all files using the key must first be
+		closed.`, keyIdentifierArg, mountpointArg,
+		shortDisplay(allUsersKeyFlag)),
+	Flags:  []cli.Flag{userFlag, allUsersKeyFlag},
+	Action: removeKeyAction,
+}
+
+func removeKeyAction(c *cli.Context) error {
+	if c.NArg() != 2 {
+		return expectedArgsErr(c, 2, false)
+	}
+	options, err := getRawKeyOptions(c.Args().Get(0))
+	if err != nil {
+		return newExitError(c, err)
+	}
+	identifier, err := parseKeyIdentifier(c.Args().Get(1))
+	if err != nil {
+		return newExitError(c, err)
+	}
+
+	err = keyring.RemoveEncryptionKey(identifier, options, allUsersKeyFlag.Value)
+	if err != nil {
+		return newExitError(c, errors.Wrapf(err, "key %s", identifier))
+	}
+	fmt.Fprintf(c.App.Writer, "Removed key %s from filesystem %q.\n",
+		identifier, options.Mount.Path)
+	return nil
+}
+
+var keyStatus = cli.Command{
+	Name:      "status",
+	ArgsUsage: fmt.Sprintf("%s %s", mountpointArg, keyIdentifierArg),
+	Usage:     "get the status of a raw key in a filesystem's keyring",
+	Description: fmt.Sprintf(`This command prints whether the key with
+		the key identifier %[1]s is in the keyring of the filesystem
+		%[2]s, and how many users have added it.`, keyIdentifierArg,
+		mountpointArg),
+	Flags:  []cli.Flag{userFlag},
+	Action: keyStatusAction,
+}
+
+func keyStatusAction(c *cli.Context) error {
+	if c.NArg() != 2 {
+		return expectedArgsErr(c, 2, false)
+	}
+	options, err := getRawKeyOptions(c.Args().Get(0))
+	if err != nil {
+		return newExitError(c, err)
+	}
+	identifier, err := parseKeyIdentifier(c.Args().Get(1))
+	if err != nil {
+		return newExitError(c, err)
+	}
+
+	status, err := keyring.GetEncryptionKeyStatus(identifier, options)
+	if err != nil {
+		return newExitError(c, err)
+	}
+	users, addedBySelf, err := keyring.GetEncryptionKeyUsers(identifier, options)
+	if err != nil {
+		return newExitError(c, err)
+	}
+	fmt.Fprintf(c.App.Writer, "Key %s on filesystem %q: %s\n", identifier,
+		options.Mount.Path, rawKeyStatusString(status, users, addedBySelf))
+	return nil
+}
+
+// Protector is a collection of commands for managing protectors.
+var Protector = cli.Command{
+	Name:  "protector",
+	Usage: "manage the protectors on a filesystem",
+	Description: fmt.Sprintf(`These commands inspect and manage the
+		protectors on a filesystem. Protectors created with %s can only
+		be used by their owner, root, and the users and groups they
+		allow.`,
+		shortDisplay(restrictAccessFlag)),
+	Subcommands: []cli.Command{listProtectors, renameProtector, rotateProtector,
+		exportProtector, importProtector},
+}
+
+// Completion is a command for printing shell completion scripts.
+var Completion = cli.Command{
+	Name:      "completion",
+	ArgsUsage: "bash | zsh | fish",
+	Usage:     "print a shell completion script",
+	Description: `This command prints a script which completes the commands,
+		flags, mountpoints, protectors, and policies of fscrypt in the
+		given shell. For example, for zsh:
+
+		fscrypt completion zsh > ~/.zfunc/_fscrypt
+
+		The zsh and fish scripts are generated from the commands of
+		this version of fscrypt, and get the mountpoints, protectors,
+		and policies by running "fscrypt completion mountpoints" and
+		"fscrypt completion protectors|policies MOUNTPOINT", which
+		print them one per line.`,
+	Action: completionAction,
+}
+
+func completionAction(c *cli.Context) error {
+	if c.NArg() == 0 {
+		return expectedArgsErr(c, 1, false)
+	}
+	var err error
+	switch shell := c.Args().Get(0); shell {
+	case "bash", "zsh", "fish":
+		if c.NArg() != 1 {
+			return expectedArgsErr(c, 1, false)
+		}
+		switch shell {
+		case "bash":
+			fmt.Fprint(c.App.Writer, bashCompletion)
+		case "zsh":
+			writeZshCompletion(c.App.Writer, c.App.Commands)
+		case "fish":
+			writeFishCompletion(c.App.Writer, c.App.Commands)
+		}
+	case "mountpoints":
+		if c.NArg() != 1 {
+			return expectedArgsErr(c, 1, false)
+		}
+		err = writeCompletionMountpoints(c.App.Writer)
+	case "protectors", "policies":
+		if c.NArg() != 2 {
+			return expectedArgsErr(c, 2, false)
+		}
+		err = writeCompletionIDs(c.App.Writer, shell, c.Args().Get(1))
+	default:
+		return &usageError{c, fmt.Sprintf("unsupported shell %q", shell)}
+	}
+	if err != nil {
+		return newExitError(c, err)
+	}
+	return nil
+}
+
+var listProtectors = cli.Command{
+	Name:      "list",
+	ArgsUsage: mountpointArg,
+	Usage:     "list the protectors on a filesystem and who may use them",
+	Description: fmt.Sprintf(`This command lists the protectors on %[1]s
+		(including linked protectors), along with the users and groups
+		allowed to use them. With %[2]s, only the protectors which
+		belong to the user are listed: their login protector, and the
+		protectors they own. As root, %[3]s selects the user.`,
+		mountpointArg, shortDisplay(mineFlag), shortDisplay(userFlag)),
+	Flags:  []cli.Flag{mineFlag, userFlag},
+	Action: listProtectorsAction,
+}
+
+func listProtectorsAction(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return expectedArgsErr(c, 1, false)
+	}
+	targetUser, err := parseUserFlag()
+	if err != nil {
+		return newExitError(c, err)
+	}
+	ctx, err := actions.NewContextFromMountpoint(c.Args().Get(0), targetUser)
+	if err != nil {
+		return newExitError(c, err)
+	}
+	options, err := ctx.ProtectorOptions()
+	if err != nil {
+		return newExitError(c, err)
+	}
+	if mineFlag.Value {
+		var mine []*actions.ProtectorOption
+		for _, option := range options {
+			if ctx.OwnsProtector(&option.ProtectorInfo) {
+				mine = append(mine, option)
+			}
+		}
+		options = mine
+	}
+	writeProtectorAccess(c.App.Writer, options)
+	return nil
+}
+
+var renameProtector = cli.Command{
+	Name:      "rename",
+	ArgsUsage: fmt.Sprintf("%s %s", shortDisplay(protectorFlag), shortDisplay(nameFlag)),
+	Usage:     "change the name of a protector",
+	Description: `This command changes the name of the specified protector in
+		place. Its key is unchanged, so all policies protected by it
+		remain valid. Login protectors can't be renamed, as they are
+		identified by their user. The new name must not be used by
+		another protector on the filesystem.`,
+	Flags:  []cli.Flag{protectorFlag, nameFlag},
+	Action: renameProtectorAction,
+}
+
+func renameProtectorAction(c *cli.Context) error {
+	if c.NArg() != 0 {
+		return expectedArgsErr(c, 0, false)
+	}
+	if err := checkRequiredFlags(c, []*stringFlag{protectorFlag, nameFlag}); err != nil {
+		return err
+	}
+
+	// We don't need to unlock the protector for this operation.
+	protector, err := getProtectorFromFlag(protectorFlag.Value, nil)
+	if err != nil {
+		return newExitError(c, err)
+	}
+	if err := protector.Rename(nameFlag.Value); err != nil {
+		return newExitError(c, err)
+	}
+
+	fmt.Fprintf(c.App.Writer, "Protector %s is now named %q.\n",
+		protector.Descriptor(), nameFlag.Value)
+	return nil
+}
+
+var rotateProtector = cli.Command{
+	Name:      "rotate",
+	ArgsUsage: shortDisplay(protectorFlag),
+	Usage:     "replace a protector with a new one in every policy",
+	Description: fmt.Sprintf(`This command creates a new protector on the
+		filesystem of the specified protector, and then replaces the
+		specified protector with it in every policy it protects, on all
+		filesystems. The new protector is created as with "fscrypt
+		metadata create protector", so its prompts can be disabled with
+		%[1]s and %[2]s.
+
+		Each policy is unlocked with the old protector, protected with
+		the new one, and read back to verify that the new protector
+		unlocks it. Only once this has succeeded for every policy is
+		the old protector removed from the policies and destroyed. If
+		any step fails, all the policies are left protected by the old
+		protector, and the new protector is removed.`,
+		shortDisplay(sourceFlag), shortDisplay(nameFlag)),
+	Flags:  []cli.Flag{protectorFlag, sourceFlag, nameFlag, userFlag},
+	Action: rotateProtectorAction,
+}
+
+func rotateProtectorAction(c *cli.Context) error {
+	if c.NArg() != 0 {
+		return expectedArgsErr(c, 0, false)
+	}
+	if err := checkRequiredFlags(c, []*stringFlag{protectorFlag}); err != nil {
+		return err
+	}
+
+	targetUser, err := parseUserFlag()
+	if err != nil {
+		return newExitError(c, err)
+	}
+	oldProtector, err := getProtectorFromFlag(protectorFlag.Value, targetUser)
+	if err != nil {
+		return newExitError(c, err)
+	}
+	policies, err := actions.PoliciesProtectedBy(oldProtector)
+	if err != nil {
+		return newExitError(c, err)
+	}
+
+	prompt := fmt.Sprintf("Replace protector %s with a new protector in %s?",
+		oldProtector.Descriptor(), pluralize(len(policies), "policy"))
+	warning := "The old protector will be destroyed, so it will NO LONGER unlock any files!!"
+	if err = askConfirmation(prompt, true, warning); err != nil {
+		return newExitError(c, err)
+	}
+
+	if err = oldProtector.Unlock(existingKeyFn); err != nil {
+		return newExitError(c, err)
+	}
+	defer oldProtector.Lock()
+	ctx, err := actions.NewContextFromMountpoint(oldProtector.Context.Mount.Path, targetUser)
+	if err != nil {
+		return newExitError(c, err)
+	}
+	newProtector, err := createProtectorFromContext(ctx)
+	if err != nil {
+		return newExitError(c, err)
+	}
+	defer newProtector.Lock()
+
+	if err = actions.RotateProtector(oldProtector, newProtector, policies); err != nil {
+		return newExitError(c, err)
+	}
+	for _, policy := range policies {
+		fmt.Fprintf(c.App.Writer, "Protector %s now protecting policy %s.\n",
+			newProtector.Descriptor(), policy.Descriptor())
+	}
+	fmt.Fprintf(c.App.Writer, "Protector %s replaced by protector %s in %s, and destroyed.\n",
+		oldProtector.Descriptor(), newProtector.Descriptor(),
+		pluralize(len(policies), "policy"))
+	return nil
+}
+
+var exportProtector = cli.Command{
+	Name:      "export",
+	ArgsUsage: fmt.Sprintf("%s %s", shortDisplay(protectorFlag), backupFileArg),
+	Usage:     "save a protector to a file, to import it elsewhere",
+	Description: fmt.Sprintf(`This command saves the specified protector
+		to %[1]s, which "fscrypt protector import" can add to a
+		filesystem on this or another system. There, it unlocks with
+		the same passphrase or key, and can protect new or existing
+		policies, e.g. as a recovery protector shared by many systems.
+
+		Like a backup made with "fscrypt metadata dump", %[1]s holds the
+		wrapped protector key rather than the key itself, but
+		passphrase protectors can be attacked offline with it, so it
+		must be kept private. Login protectors can't be exported.`,
+		backupFileArg),
+	Flags:  []cli.Flag{protectorFlag},
+	Action: exportProtectorAction,
+}
+
+func exportProtectorAction(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return expectedArgsErr(c, 1, false)
+	}
+	if err := checkRequiredFlags(c, []*stringFlag{protectorFlag}); err != nil {
+		return err
+	}
+
+	protector, err := getProtectorFromFlag(protectorFlag.Value, nil)
+	if err != nil {
+		return newExitError(c, err)
+	}
+	backup, err := actions.ExportProtector(protector)
+	if err != nil {
+		return newExitError(c, err)
+	}
+	contents, err := metadata.MarshalBackup(backup)
+	if err != nil {
+		return newExitError(c, err)
+	}
+	path := c.Args().Get(0)
+	if err = os.WriteFile(path, contents, 0600); err != nil {
+		return newExitError(c, err)
+	}
+	fmt.Fprintf(c.App.Writer, "Exported protector %s to %q.\n", protector.Descriptor(), path)
+	return nil
+}
+
+var importProtector = cli.Command{
+	Name:      "import",
+	ArgsUsage: fmt.Sprintf("%s %s", mountpointArg, backupFileArg),
+	Usage:     "add a protector saved by \"fscrypt protector export\"",
+	Description: fmt.Sprintf(`This command adds the protector saved in
+		%[2]s by "fscrypt protector export" to %[1]s, keeping its
+		descriptor, key, and name (or using the name given with %[3]s).
+		The file is checked for corruption first. Other filesystems can
+		use the protector through links, as with protectors created on
+		%[1]s; for instance, %[4]s can then add it to a policy.`,
+		mountpointArg, backupFileArg, shortDisplay(nameFlag),
+		"\"fscrypt metadata add-protector-to-policy\""),
+	Flags:  []cli.Flag{nameFlag},
+	Action: importProtectorAction,
+}
+
+func importProtectorAction(c *cli.Context) error {
+	if c.NArg() != 2 {
+		return expectedArgsErr(c, 2, false)
+	}
+	ctx, err := actions.NewContextFromMountpoint(c.Args().Get(0), nil)
+	if err != nil {
+		return newExitError(c, err)
+	}
+	contents, err := os.ReadFile(c.Args().Get(1))
+	if err != nil {
+		return newExitError(c, err)
+	}
+	backup, err := metadata.UnmarshalBackup(contents)
+	if err != nil {
+		return newExitError(c, err)
+	}
+	protector, err := actions.ImportProtector(ctx, backup, nameFlag.Value, nil)
+	if err != nil {
+		return newExitError(c, err)
+	}
+	fmt.Fprintf(c.App.Writer, "Imported protector %s to filesystem %q.\n",
+		protector.Descriptor(), ctx.Mount.Path)
+	return nil
+}
+
+// Policy is a collection of commands for managing the encryption policies of
+// directories.
+var Policy = cli.Command{
+	Name:  "policy",
+	Usage: "manage the encryption policies of directories",
+	Description: `These commands change the encryption policy of an existing
+		encrypted directory, e.g. to add protectors to it. The other
+		directories using the same policy are affected too.`,
+	Subcommands: []cli.Command{addRecovery, rekeyPolicy},
+}
+
+var addRecovery = cli.Command{
+	Name:      "add-recovery",
+	ArgsUsage: directoryArg,
+	Usage:     "protect an encrypted directory with a new recovery passphrase",
+	Description: fmt.Sprintf(`This command generates a high-entropy recovery
+		passphrase, creates a custom passphrase protector for it on the
+		filesystem of %[1]s, and adds the protector to the policy of
+		%[1]s, like "fscrypt encrypt" does for new directories protected
+		by a login passphrase on other filesystems. One of the existing
+		protectors of the policy must be unlocked first (see %[2]s).
+
+		The recovery passphrase is printed once and is not stored
+		anywhere else, so it must be recorded in a secure location. With
+		%[3]s, only the passphrase is printed.`,
+		directoryArg, shortDisplay(unlockWithFlag), shortDisplay(quietFlag)),
+	Flags:  []cli.Flag{unlockWithFlag, keyFileFlag, userFlag},
+	Action: addRecoveryAction,
+}
+
+func addRecoveryAction(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return expectedArgsErr(c, 1, false)
+	}
+
+	targetUser, err := parseUserFlag()
+	if err != nil {
+		return newExitError(c, err)
+	}
+	path := c.Args().Get(0)
+	ctx, err := actions.NewContextFromPath(path, targetUser)
+	if err != nil {
+		return newExitError(c, err)
+	}
+	policy, err := actions.GetPolicyFromPath(ctx, path)
+	if err != nil {
+		return newExitError(c, err)
+	}
+	if err = policy.Unlock(optionFn, existingKeyFn); err != nil {
+		return newExitError(c, err)
+	}
+	defer policy.Lock()
+
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return newExitError(c, err)
+	}
+	passphrase, protector, err := actions.AddRecoveryPassphrase(policy, filepath.Base(absPath))
+	if err != nil {
+		return newExitError(c, err)
+	}
+	defer passphrase.Wipe()
+	defer protector.Lock()
+
+	if quietFlag.Value {
+		fmt.Println(string(passphrase.Data()))
+		return nil
+	}
+	fmt.Fprintf(c.App.Writer, "Recovery protector %s now protecting policy %s.\n\n",
+		protector.Descriptor(), policy.Descriptor())
+	fmt.Fprintf(c.App.Writer, "Recovery passphrase: %s\n\n", passphrase.Data())
+	msg := fmt.Sprintf(`Record the recovery passphrase in a secure location
+	now, as it isn't stored anywhere else. To unlock %q with it, run "fscrypt
+	unlock" and select the protector named %q.`, path, protector.Name())
+	hdr := "IMPORTANT: "
+	fmt.Fprintln(c.App.Writer, hdr+wrapText(msg, len(hdr)))
+	return nil
+}
+
+var rekeyPolicy = cli.Command{
+	Name:      "rekey",
+	ArgsUsage: directoryArg,
+	Usage:     "give an encrypted directory a new policy with a fresh key",
+	Description: fmt.Sprintf(`This command rotates the key of %[1]s, which
+		must be unlocked. As the key of an encrypted directory can't be
+		changed in place, a new policy is created with a fresh key, the
+		same encryption options, and the same protectors (which are all
+		unlocked for this). The contents of %[1]s are copied into a new
+		hidden directory next to it which uses the new policy, and the
+		copy is verified. Then the two directories are atomically
+		exchanged, and the originals are securely deleted. Finally, the
+		old policy is removed from the keyring and destroyed, unless
+		other directories still use it.
+
+		If this command is interrupted, running it again resumes the
+		copy, keeping the files which were already copied completely.
+		The progress of the copy is shown on a terminal unless %[2]s is
+		given.`,
+		directoryArg, shortDisplay(quietFlag)),
+	Flags:  []cli.Flag{userFlag},
+	Action: rekeyPolicyAction,
+}
+
+func rekeyPolicyAction(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return expectedArgsErr(c, 1, false)
+	}
+
+	targetUser, err := parseUserFlag()
+	if err != nil {
+		return newExitError(c, err)
+	}
+	dir := filepath.Clean(c.Args().Get(0))
+	ctx, err := actions.NewContextFromPath(dir, targetUser)
+	if err != nil {
+		return newExitError(c, err)
+	}
+	if err = checkRekeyable(ctx.Mount, dir); err != nil {
+		return newExitError(c, err)
+	}
+	policy, err := actions.GetPolicyFromPath(ctx, dir)
+	if err != nil {
+		return newExitError(c, err)
+	}
+	rekeyedDir := rekeySibling(dir)
 
-		var ctx *actions.Context
-		ctx, err = actions.NewContextFromMountpoint(path, nil)
-		if err == nil {
-			// Case (2) - mountpoint status
-			err = writeFilesystemStatus(c.App.Writer, ctx)
-		} else if _, ok := err.(*filesystem.ErrNotAMountpoint); ok {
-			// Case (3) - file or directory status
-			err = writePathStatus(c.App.Writer, path)
+	oldPolicy, err := interruptedRekey(ctx, policy, dir)
+	if err != nil {
+		return newExitError(c, err)
+	}
+	if oldPolicy != nil {
+		if err = finishRekey(dir, rekeyedDir); err != nil {
+			return newExitError(c, err)
 		}
-	default:
-		return expectedArgsErr(c, 1, true)
+	} else {
+		if err = rekeyDirectory(ctx, policy, dir, rekeyedDir); err != nil {
+			return newExitError(c, err)
+		}
+		oldPolicy = policy
 	}
 
+	newPolicy, err := actions.GetPolicyFromPath(ctx, dir)
 	if err != nil {
 		return newExitError(c, err)
 	}
+	fmt.Fprintf(c.App.Writer, "%q now uses policy %s with a new key.\n",
+		dir, newPolicy.Descriptor())
+	destroyed, err := removeOldPolicy(ctx, oldPolicy)
+	if err != nil {
+		return newExitError(c, errors.Wrapf(err, "removing the old policy %s",
+			oldPolicy.Descriptor()))
+	}
+	if destroyed {
+		fmt.Fprintf(c.App.Writer, "Old policy %s has been destroyed.\n",
+			oldPolicy.Descriptor())
+	} else {
+		fmt.Fprintf(c.App.Writer, "Old policy %s may still be used by other directories, so it was kept.\n",
+			oldPolicy.Descriptor())
+	}
 	return nil
 }
 
+// rekeyDirectory copies the contents of the directory dir, which uses policy,
+// into rekeyedDir with a new policy (resuming an interrupted copy if rekeyedDir
+// exists already), and exchanges the two directories.
+func rekeyDirectory(ctx *actions.Context, policy *actions.Policy, dir, rekeyedDir string) error {
+	// With the user keyring, another session may have unlocked the
+	// directory without the key being visible to us.
+	if policy.GetProvisioningStatus() == keyring.KeyAbsent &&
+		(!policy.NeedsUserKeyring() || !isDirUnlockedHeuristic(dir)) {
+		return errors.Wrapf(ErrDirNotUnlocked, dir)
+	}
+	if err := checkNestedPolicies(dir, policy.Descriptor()); err != nil {
+		return err
+	}
+	prompt := fmt.Sprintf("Copy the contents of %q into a new directory with a new key, and replace it?",
+		dir)
+	if err := askConfirmation(prompt, true, ""); err != nil {
+		return err
+	}
+
+	newPolicy, err := resumeRekey(ctx, policy, dir, rekeyedDir)
+	if err != nil {
+		return err
+	}
+	resume := newPolicy != nil
+	if !resume {
+		if newPolicy, err = startRekey(ctx, policy, dir, rekeyedDir); err != nil {
+			return err
+		}
+	}
+	defer newPolicy.Lock()
+	return rekeyFiles(dir, rekeyedDir, policy, newPolicy, resume)
+}
+
 // Metadata is a collection of commands for manipulating the metadata files.
 var Metadata = cli.Command{
 	Name:  "metadata",
@@ -747,9 +2884,13 @@ var Metadata = cli.Command{
 
 		(4) Changing the protector protecting a policy using the
 		"add-protector-to-policy" and "remove-protector-from-policy"
-		subcommands.`,
+		subcommands.
+
+		(5) Backing up all the metadata on a filesystem to a file, and
+		restoring it, using the "dump" and "restore" subcommands.`,
 	Subcommands: []cli.Command{createMetadata, destroyMetadata, changePassphrase,
-		addProtectorToPolicy, removeProtectorFromPolicy, dumpMetadata},
+		addProtectorToPolicy, removeProtectorFromPolicy, labelPolicy, dumpMetadata,
+		restoreMetadata, resaltAll, relinkMetadata, convertProtector},
 }
 
 var createMetadata = cli.Command{
@@ -773,7 +2914,8 @@ var createProtector = cli.Command{
 		applicable). As with "fscrypt encrypt", these prompts can be
 		disabled with the appropriate flags.`, mountpointArg,
 		shortDisplay(protectorFlag)),
-	Flags:  []cli.Flag{sourceFlag, nameFlag, keyFileFlag, userFlag},
+	Flags: []cli.Flag{sourceFlag, nameFlag, keyFileFlag, fromStdinKeyBase64Flag,
+		userFlag, tpm2PCRsFlag, restrictAccessFlag, allowUsersFlag, allowGroupsFlag},
 	Action: createProtectorAction,
 }
 
@@ -819,9 +2961,15 @@ var createPolicy = cli.Command{
 		protected with at least one protector, this command requires
 		specifying one with %s. To create a policy protected by many
 		protectors, use this command and "fscrypt metadata
-		add-protector-to-policy".`, mountpointArg,
-		shortDisplay(policyFlag), shortDisplay(protectorFlag)),
-	Flags:  []cli.Flag{protectorFlag, keyFileFlag},
+		add-protector-to-policy".
+
+		With %s, several protectors are given with %s, separated by
+		commas, and the policy's key is split so that any M of them
+		are needed to unlock it. Unlocking such a policy prompts for
+		each of the M protectors in turn.`, mountpointArg,
+		shortDisplay(policyFlag), shortDisplay(protectorFlag),
+		shortDisplay(thresholdFlag), shortDisplay(protectorFlag)),
+	Flags:  []cli.Flag{protectorFlag, thresholdFlag, keyFileFlag, fromStdinKeyBase64Flag},
 	Action: createPolicyAction,
 }
 
@@ -838,21 +2986,38 @@ func createPolicyAction(c *cli.Context) error {
 	if err = checkRequiredFlags(c, []*stringFlag{protectorFlag}); err != nil {
 		return err
 	}
-	protector, err := getProtectorFromFlag(protectorFlag.Value, ctx.TargetUser)
-	if err != nil {
-		return newExitError(c, err)
+	if thresholdFlag.Value < 0 {
+		return &usageError{c, fmt.Sprintf("%s must not be negative",
+			shortDisplay(thresholdFlag))}
 	}
-	if err = protector.Unlock(existingKeyFn); err != nil {
-		return newExitError(c, err)
+	protectorValues := []string{protectorFlag.Value}
+	if thresholdFlag.Value != 0 {
+		protectorValues = strings.Split(protectorFlag.Value, ",")
+	}
+	var protectors []*actions.Protector
+	for _, value := range protectorValues {
+		protector, err := getProtectorFromFlag(value, ctx.TargetUser)
+		if err != nil {
+			return newExitError(c, err)
+		}
+		if err = protector.Unlock(existingKeyFn); err != nil {
+			return newExitError(c, err)
+		}
+		defer protector.Lock()
+		protectors = append(protectors, protector)
 	}
-	defer protector.Lock()
 
 	prompt := fmt.Sprintf("Create new policy on %q", ctx.Mount.Path)
 	if err = askConfirmation(prompt, true, ""); err != nil {
 		return newExitError(c, err)
 	}
 
-	policy, err := actions.CreatePolicy(ctx, protector)
+	var policy *actions.Policy
+	if thresholdFlag.Value != 0 {
+		policy, err = actions.CreateThresholdPolicy(ctx, int(thresholdFlag.Value), protectors)
+	} else {
+		policy, err = actions.CreatePolicy(ctx, protectors[0])
+	}
 	if err != nil {
 		return newExitError(c, err)
 	}
@@ -886,10 +3051,13 @@ var destroyMetadata = cli.Command{
 		(3) If used with %[3]s, all the metadata on that filesystem will
 		be deleted, causing all directories on that filesystem using
 		fscrypt to become PERMANENTLY inaccessible. To start using this
-		directory again, "fscrypt setup %[3]s" will need to be rerun.`,
+		directory again, "fscrypt setup %[3]s" will need to be rerun.
+
+		With %[4]s, the metadata which would be deleted is only
+		printed.`,
 		shortDisplay(protectorFlag), shortDisplay(policyFlag),
-		mountpointArg),
-	Flags:  []cli.Flag{protectorFlag, policyFlag, forceFlag},
+		mountpointArg, shortDisplay(dryRunFlag)),
+	Flags:  []cli.Flag{protectorFlag, policyFlag, forceFlag, dryRunFlag},
 	Action: destroyMetadataAction,
 }
 
@@ -904,6 +3072,12 @@ func destroyMetadataAction(c *cli.Context) error {
 				return newExitError(c, err)
 			}
 
+			if dryRunFlag.Value {
+				fmt.Fprintf(c.App.Writer, "Would remove protector %s from %s.\n",
+					protector.Descriptor(),
+					protector.Context.Mount.ProtectorLocation(protector.Descriptor()))
+				return nil
+			}
 			prompt := fmt.Sprintf("Destroy protector %s on %q?",
 				protector.Descriptor(), protector.Context.Mount.Path)
 			warning := "All files protected only with this protector will be lost!!"
@@ -923,6 +3097,12 @@ func destroyMetadataAction(c *cli.Context) error {
 				return newExitError(c, err)
 			}
 
+			if dryRunFlag.Value {
+				fmt.Fprintf(c.App.Writer, "Would remove policy %s from %s.\n",
+					policy.Descriptor(),
+					policy.Context.Mount.PolicyLocation(policy.Descriptor()))
+				return nil
+			}
 			prompt := fmt.Sprintf("Destroy policy %s on %q?",
 				policy.Descriptor(), policy.Context.Mount.Path)
 			warning := "All files using this policy will be lost!!"
@@ -950,6 +3130,11 @@ func destroyMetadataAction(c *cli.Context) error {
 			return newExitError(c, err)
 		}
 
+		if dryRunFlag.Value {
+			fmt.Fprintf(c.App.Writer, "Would remove all the metadata in %q.\n",
+				ctx.Mount.BaseDir())
+			return nil
+		}
 		prompt := fmt.Sprintf("Destroy all the metadata on %q?", ctx.Mount.Path)
 		warning := "All the encrypted files on this filesystem will be lost!!"
 		if err := askConfirmation(prompt, false, warning); err != nil {
@@ -1002,6 +3187,88 @@ func changePassphraseAction(c *cli.Context) error {
 	return nil
 }
 
+var convertProtector = cli.Command{
+	Name: "convert-protector",
+	ArgsUsage: fmt.Sprintf("%s %s", shortDisplay(protectorFlag),
+		shortDisplay(convertToFlag)),
+	Usage: "convert a passphrase protector to or from a login protector",
+	Description: fmt.Sprintf(`This command changes whether the specified
+		passphrase protector is a login protector or a custom
+		passphrase protector. Only the type of the protector is changed,
+		not its key, so all policies protected by it remain valid.
+
+		If TYPE is "login", the protector becomes the login protector
+		of the user (see %[1]s), so that pam_fscrypt can unlock it
+		automatically. Its passphrase must be the user's login
+		passphrase, and the user must not already have a login
+		protector on the filesystem. Login protectors must be stored on
+		the root filesystem.
+
+		If TYPE is "custom", the protector becomes a custom passphrase
+		protector named by %[2]s, or by a name which is prompted for.`,
+		shortDisplay(userFlag), shortDisplay(nameFlag)),
+	Flags:  []cli.Flag{protectorFlag, convertToFlag, userFlag, nameFlag},
+	Action: convertProtectorAction,
+}
+
+func convertProtectorAction(c *cli.Context) error {
+	if c.NArg() != 0 {
+		return expectedArgsErr(c, 0, false)
+	}
+	if err := checkRequiredFlags(c, []*stringFlag{protectorFlag, convertToFlag}); err != nil {
+		return err
+	}
+	var source metadata.SourceType
+	switch convertToFlag.Value {
+	case "login":
+		source = metadata.SourceType_pam_passphrase
+	case "custom":
+		source = metadata.SourceType_custom_passphrase
+	default:
+		return &usageError{c, fmt.Sprintf("invalid value %q for %s",
+			convertToFlag.Value, shortDisplay(convertToFlag))}
+	}
+
+	targetUser, err := parseUserFlag()
+	if err != nil {
+		return newExitError(c, err)
+	}
+	protector, err := getProtectorFromFlag(protectorFlag.Value, targetUser)
+	if err != nil {
+		return newExitError(c, err)
+	}
+	ctx := protector.Context
+
+	// For login protectors, check the passphrase against the user's
+	// login passphrase as well as against the protector.
+	keyFn := makeKeyFunc(true, true, "")
+	name := ""
+	if source == metadata.SourceType_custom_passphrase {
+		keyFn = existingKeyFn
+		ctx.Config.Source = source
+		if name, err = promptForName(ctx); err != nil {
+			return newExitError(c, err)
+		}
+	} else if ctx.Mount.Path != actions.LoginProtectorMountpoint {
+		return newExitError(c, errors.Errorf("login protectors must be stored on %q, not %q",
+			actions.LoginProtectorMountpoint, ctx.Mount.Path))
+	}
+
+	if err = protector.ConvertSource(source, name, keyFn); err != nil {
+		return newExitError(c, err)
+	}
+	defer protector.Lock()
+
+	if source == metadata.SourceType_pam_passphrase {
+		fmt.Fprintf(c.App.Writer, "Protector %s is now the login protector for %s.\n",
+			protector.Descriptor(), ctx.TargetUser.Username)
+	} else {
+		fmt.Fprintf(c.App.Writer, "Protector %s is now custom protector %q.\n",
+			protector.Descriptor(), name)
+	}
+	return nil
+}
+
 var addProtectorToPolicy = cli.Command{
 	Name:      "add-protector-to-policy",
 	ArgsUsage: fmt.Sprintf("%s %s", shortDisplay(protectorFlag), shortDisplay(policyFlag)),
@@ -1011,7 +3278,8 @@ var addProtectorToPolicy = cli.Command{
 		directories using this policy will now be accessible with this
 		protector. This command will fail if the policy is already
 		protected with this protector.`,
-	Flags:  []cli.Flag{protectorFlag, policyFlag, unlockWithFlag, keyFileFlag},
+	Flags: []cli.Flag{protectorFlag, policyFlag, unlockWithFlag, keyFileFlag,
+		fromStdinKeyBase64Flag},
 	Action: addProtectorAction,
 }
 
@@ -1065,13 +3333,14 @@ var removeProtectorFromPolicy = cli.Command{
 	Name:      "remove-protector-from-policy",
 	ArgsUsage: fmt.Sprintf("%s %s", shortDisplay(protectorFlag), shortDisplay(policyFlag)),
 	Usage:     "stop protecting a policy with some protector",
-	Description: `This command changes the specified policy to no longer be
-		protected with the specified protector. This means that any
-		directories using this policy will cannot be accessed with this
-		protector. This command will fail if the policy not already
-		protected with this protector or if it is the policy's only
-		protector.`,
-	Flags:  []cli.Flag{protectorFlag, policyFlag, forceFlag},
+	Description: fmt.Sprintf(`This command changes the specified policy to
+		no longer be protected with the specified protector. This means
+		that any directories using this policy will cannot be accessed
+		with this protector. This command will fail if the policy not
+		already protected with this protector or if it is the policy's
+		only protector. With %s, the policy metadata which would be
+		rewritten is only printed.`, shortDisplay(dryRunFlag)),
+	Flags:  []cli.Flag{protectorFlag, policyFlag, forceFlag, dryRunFlag},
 	Action: removeProtectorAction,
 }
 
@@ -1084,7 +3353,7 @@ func removeProtectorAction(c *cli.Context) error {
 	}
 
 	// We only need the protector descriptor, not the protector itself.
-	ctx, protectorDescriptor, err := parseMetadataFlag(protectorFlag.Value, nil)
+	ctx, protectorDescriptor, err := parseProtectorFlag(protectorFlag.Value, nil)
 	if err != nil {
 		return newExitError(c, err)
 	}
@@ -1094,6 +3363,15 @@ func removeProtectorAction(c *cli.Context) error {
 		return newExitError(c, err)
 	}
 
+	if dryRunFlag.Value {
+		if err := policy.CheckRemoveProtector(protectorDescriptor); err != nil {
+			return newExitError(c, err)
+		}
+		fmt.Fprintf(c.App.Writer, "Would rewrite %s without the key wrapped by protector %s.\n",
+			policy.Context.Mount.PolicyLocation(policy.Descriptor()), protectorDescriptor)
+		return nil
+	}
+
 	prompt := fmt.Sprintf("Stop protecting policy %s with protector %s?",
 		policy.Descriptor(), protectorDescriptor)
 	warning := "All files using this policy will NO LONGER be accessible with this protector!!"
@@ -1110,17 +3388,72 @@ func removeProtectorAction(c *cli.Context) error {
 	return nil
 }
 
+var labelPolicy = cli.Command{
+	Name:      "label-policy",
+	ArgsUsage: fmt.Sprintf("%s %s", shortDisplay(policyFlag), shortDisplay(labelFlag)),
+	Usage:     "give a policy a human-readable label",
+	Description: fmt.Sprintf(`This command records a label for the specified
+		policy, which "fscrypt status" shows alongside the policy's
+		descriptor. The label is only for display; it is never used
+		to unlock anything. Use --%s="" to remove the label.`,
+		labelFlag.Name),
+	Flags:  []cli.Flag{policyFlag, labelFlag},
+	Action: labelPolicyAction,
+}
+
+func labelPolicyAction(c *cli.Context) error {
+	if c.NArg() != 0 {
+		return expectedArgsErr(c, 0, false)
+	}
+	if err := checkRequiredFlags(c, []*stringFlag{policyFlag}); err != nil {
+		return err
+	}
+	// An empty label is allowed, so the flag must be checked separately.
+	if !c.IsSet(labelFlag.Name) {
+		message := fmt.Sprintf("required flag %s not provided", shortDisplay(labelFlag))
+		return &usageError{c, message}
+	}
+
+	// We don't need to unlock the policy for this operation.
+	policy, err := getPolicyFromFlag(policyFlag.Value, nil)
+	if err != nil {
+		return newExitError(c, err)
+	}
+	if err := policy.SetLabel(labelFlag.Value); err != nil {
+		return newExitError(c, err)
+	}
+
+	if labelFlag.Value == "" {
+		fmt.Fprintf(c.App.Writer, "Removed the label of policy %s.\n", policy.Descriptor())
+	} else {
+		fmt.Fprintf(c.App.Writer, "Policy %s is now labeled %q.\n",
+			policy.Descriptor(), labelFlag.Value)
+	}
+	return nil
+}
+
 var dumpMetadata = cli.Command{
-	Name:      "dump",
-	ArgsUsage: fmt.Sprintf("[%s | %s]", shortDisplay(protectorFlag), shortDisplay(policyFlag)),
-	Usage:     "print debug data for a policy or protector",
+	Name: "dump",
+	ArgsUsage: fmt.Sprintf("[%s | %s | %s %s]", shortDisplay(protectorFlag),
+		shortDisplay(policyFlag), mountpointArg, backupFileArg),
+	Usage: "print debug data for a policy or protector, or back up the metadata",
 	Description: fmt.Sprintf(`This commands dumps all of the debug data for
-		a protector (if %s is used) or policy (if %s is used). This data
-		includes the data pulled from the %q config file, the
+		a protector (if %[1]s is used) or policy (if %[2]s is used). This
+		data includes the data pulled from the %[3]q config file, the
 		appropriate mountpoint data, and any options for the policy or
 		hashing costs for the protector. Any cryptographic keys are
-		wiped and are not printed out.`, shortDisplay(protectorFlag),
-		shortDisplay(policyFlag), actions.ConfigFileLocation),
+		wiped and are not printed out.
+
+		If %[4]s and %[5]s are given instead, all the protectors and
+		policies on %[4]s (along with their owners, labels, and links to
+		protectors on other filesystems) are saved to the backup file
+		%[5]s, which can be restored with "fscrypt metadata restore".
+		The backup contains the wrapped keys, not the keys themselves,
+		but passphrase protectors can be attacked offline with it, so it
+		must be kept as private as the metadata directory itself. Only
+		root can back up the metadata of other users.`, shortDisplay(protectorFlag),
+		shortDisplay(policyFlag), actions.ConfigFileLocation, mountpointArg,
+		backupFileArg),
 	Flags:  []cli.Flag{protectorFlag, policyFlag},
 	Action: dumpMetadataAction,
 }
@@ -1141,11 +3474,359 @@ func dumpMetadataAction(c *cli.Context) error {
 			return newExitError(c, err)
 		}
 		fmt.Fprintln(c.App.Writer, policy)
+	case c.NArg() == 2:
+		// Case (3) - backup of a whole filesystem
+		return backupMetadataAction(c)
 	default:
-		message := fmt.Sprintf("Must specify one of: %s or %s",
+		message := fmt.Sprintf("Must specify one of: %s, %s, or %s %s",
 			shortDisplay(protectorFlag),
-			shortDisplay(policyFlag))
+			shortDisplay(policyFlag), mountpointArg, backupFileArg)
 		return &usageError{c, message}
 	}
 	return nil
 }
+
+func backupMetadataAction(c *cli.Context) error {
+	ctx, err := actions.NewContextFromMountpoint(c.Args().Get(0), nil)
+	if err != nil {
+		return newExitError(c, err)
+	}
+	backup, err := actions.BackupMetadata(ctx)
+	if err != nil {
+		return newExitError(c, err)
+	}
+	contents, err := metadata.MarshalBackup(backup)
+	if err != nil {
+		return newExitError(c, err)
+	}
+	path := c.Args().Get(1)
+	if err = os.WriteFile(path, contents, 0600); err != nil {
+		return newExitError(c, err)
+	}
+	fmt.Fprintf(c.App.Writer, "Saved %s, %s, and %s of %q to %q.\n",
+		pluralize(len(backup.Protectors), "protector"),
+		pluralize(len(backup.Policies), "policy"),
+		pluralize(len(backup.LinkedProtectors), "linked protector"),
+		ctx.Mount.Path, path)
+	if _, err = os.Stat(ctx.Mount.NameKeyPath()); err == nil && len(backup.NameKey) == 0 {
+		fmt.Fprintln(c.App.Writer, "The key encrypting the protector names can only be saved by root.")
+	}
+	return nil
+}
+
+var restoreMetadata = cli.Command{
+	Name:      "restore",
+	ArgsUsage: fmt.Sprintf("%s %s", mountpointArg, backupFileArg),
+	Usage:     "restore the metadata saved by \"fscrypt metadata dump\"",
+	Description: fmt.Sprintf(`This command adds the protectors and policies
+		saved in the backup file %[2]s by "fscrypt metadata dump" to
+		%[1]s, e.g. after its metadata directory was lost and recreated
+		with "fscrypt setup". The backup is checked for corruption
+		before anything is restored. Protectors and policies which are
+		already on %[1]s are left alone, so restoring the same backup
+		twice is harmless.
+
+		Links to protectors on other filesystems are recreated if the
+		protector is found on exactly one mounted filesystem. The other
+		links can be repaired with "fscrypt metadata relink" once the
+		filesystem storing the protector is mounted. Only root can
+		restore the metadata of other users as theirs; otherwise it is
+		owned by the current user.`, mountpointArg, backupFileArg),
+	Action: restoreMetadataAction,
+}
+
+func restoreMetadataAction(c *cli.Context) error {
+	if c.NArg() != 2 {
+		return expectedArgsErr(c, 2, false)
+	}
+	ctx, err := actions.NewContextFromMountpoint(c.Args().Get(0), nil)
+	if err != nil {
+		return newExitError(c, err)
+	}
+	contents, err := os.ReadFile(c.Args().Get(1))
+	if err != nil {
+		return newExitError(c, err)
+	}
+	backup, err := metadata.UnmarshalBackup(contents)
+	if err != nil {
+		return newExitError(c, err)
+	}
+	result, err := actions.RestoreMetadata(ctx, backup)
+	if err != nil {
+		return newExitError(c, err)
+	}
+	fmt.Fprintf(c.App.Writer,
+		"Restored %d protectors, policies, and links to %q (%d were already present).\n",
+		result.Restored, ctx.Mount.Path, result.Existing)
+	if len(result.UnresolvedLinks) > 0 {
+		fmt.Fprintf(c.App.Writer, "These linked protectors are not on any mounted filesystem: %s\n",
+			strings.Join(result.UnresolvedLinks, ", "))
+		fmt.Fprintf(c.App.Writer, "Once they are mounted, run \"fscrypt metadata relink %s\".\n",
+			ctx.Mount.Path)
+	}
+	return nil
+}
+
+var resaltAll = cli.Command{
+	Name:      "resalt-all",
+	ArgsUsage: mountpointArg,
+	Usage:     "rewrap all passphrase protectors on a filesystem with new salts",
+	Description: fmt.Sprintf(`This command goes through each passphrase
+		protector stored on %[1]s, prompts for its passphrase, and
+		rewraps the protector key using a newly generated salt. The
+		passphrases and protector keys are not changed, so all policies
+		remain protected by the same protectors. Protectors that do not
+		use a passphrase, and protectors linked from other filesystems,
+		are skipped. By default, this command stops at the first
+		protector that cannot be unlocked; with %[2]s, such protectors
+		are skipped instead. A summary is printed at the end.
+
+		With %[3]s, the passphrases are also hashed with the KDF and
+		hashing costs currently set in %[4]s. This migrates protectors
+		to a new KDF (e.g. after "fscrypt setup %[5]s=scrypt") or to
+		stronger hashing costs.`,
+		mountpointArg, shortDisplay(continueOnErrorFlag),
+		shortDisplay(rehashFlag), actions.ConfigFileLocation,
+		"--"+kdfFlag.GetName()),
+	Flags:  []cli.Flag{continueOnErrorFlag, rehashFlag, userFlag},
+	Action: resaltAllAction,
+}
+
+func resaltAllAction(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return expectedArgsErr(c, 1, false)
+	}
+
+	targetUser, err := parseUserFlag()
+	if err != nil {
+		return newExitError(c, err)
+	}
+	ctx, err := actions.NewContextFromMountpoint(c.Args().Get(0), targetUser)
+	if err != nil {
+		return newExitError(c, err)
+	}
+	options, err := ctx.ProtectorOptions()
+	if err != nil {
+		return newExitError(c, err)
+	}
+
+	prompt := fmt.Sprintf("Rewrap all passphrase protectors on %q with new salts?",
+		ctx.Mount.Path)
+	if rehashFlag.Value {
+		prompt = fmt.Sprintf("Rewrap all passphrase protectors on %q with new salts and %v hashing?",
+			ctx.Mount.Path, ctx.Config.HashCosts.Kdf)
+	}
+	if err = askConfirmation(prompt, true, ""); err != nil {
+		return newExitError(c, err)
+	}
+
+	// When continuing on errors, a wrong passphrase should skip the
+	// protector instead of prompting again.
+	keyFn := existingKeyFn
+	if continueOnErrorFlag.Value {
+		keyFn = func(info actions.ProtectorInfo, retry bool) (*crypto.Key, error) {
+			if retry {
+				return nil, ErrWrongKey
+			}
+			return existingKeyFn(info, retry)
+		}
+	}
+
+	var succeeded, failed int
+	for _, option := range options {
+		if option.LoadError != nil || option.LinkedMount != nil {
+			continue
+		}
+		source := option.Source()
+		if source != metadata.SourceType_pam_passphrase &&
+			source != metadata.SourceType_custom_passphrase {
+			continue
+		}
+		protector, err := actions.GetProtectorFromOption(ctx, option)
+		if err == nil {
+			if rehashFlag.Value {
+				err = protector.Rehash(keyFn)
+			} else {
+				err = protector.Resalt(keyFn)
+			}
+			protector.Lock()
+		}
+		if err != nil {
+			if !continueOnErrorFlag.Value {
+				return newExitError(c, errors.Wrapf(err, "protector %s",
+					option.Descriptor()))
+			}
+			fmt.Fprintf(c.App.Writer, "Skipping protector %s: %v\n",
+				option.Descriptor(), err)
+			failed++
+			continue
+		}
+		fmt.Fprintf(c.App.Writer, "Protector %s rewrapped with a new salt.\n",
+			option.Descriptor())
+		succeeded++
+	}
+
+	fmt.Fprintf(c.App.Writer, "Resalted %s on %q (%d failed).\n",
+		pluralize(succeeded, "protector"), ctx.Mount.Path, failed)
+	if failed > 0 {
+		return newExitError(c, fmt.Errorf("failed to resalt %s",
+			pluralize(failed, "protector")))
+	}
+	return nil
+}
+
+var relinkMetadata = cli.Command{
+	Name:      "relink",
+	ArgsUsage: mountpointArg,
+	Usage:     "repair links to protectors on other filesystems",
+	Description: fmt.Sprintf(`This command checks the links from %[1]s to
+		protectors stored on other filesystems, including the protectors
+		used by the policies on %[1]s which can't be found at all. Links
+		which no longer resolve, e.g. because a backup was restored or a
+		filesystem was reformatted, are repaired by searching all the
+		currently mounted filesystems for the protector. If the
+		protector is found on more than one filesystem, you are asked
+		which one to use. With %[2]s, the repairs are only printed.`,
+		mountpointArg, shortDisplay(dryRunFlag)),
+	Flags:  []cli.Flag{dryRunFlag, userFlag},
+	Action: relinkAction,
+}
+
+func relinkAction(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return expectedArgsErr(c, 1, false)
+	}
+
+	targetUser, err := parseUserFlag()
+	if err != nil {
+		return newExitError(c, err)
+	}
+	ctx, err := actions.NewContextFromMountpoint(c.Args().Get(0), targetUser)
+	if err != nil {
+		return newExitError(c, err)
+	}
+	descriptors, err := protectorsToRelink(ctx)
+	if err != nil {
+		return newExitError(c, err)
+	}
+	mounts, err := filesystem.AllFilesystems()
+	if err != nil {
+		return newExitError(c, err)
+	}
+
+	var repaired, unresolved int
+	for _, descriptor := range descriptors {
+		_, _, err := ctx.Mount.GetProtector(descriptor, ctx.TrustedUser)
+		if err == nil {
+			util.Debugf("protector %s can be found, not relinking it", descriptor)
+			continue
+		}
+		util.Debugf("protector %s can't be found: %v", descriptor, err)
+
+		dest, err := findProtectorMount(ctx, descriptor, mounts)
+		if err != nil {
+			return newExitError(c, err)
+		}
+		if dest == nil {
+			fmt.Fprintf(c.App.Writer,
+				"Protector %s: not found on any mounted filesystem.\n", descriptor)
+			unresolved++
+			continue
+		}
+		if dryRunFlag.Value {
+			fmt.Fprintf(c.App.Writer, "Protector %s: would link to %q.\n",
+				descriptor, dest.Path)
+		} else {
+			if err = ctx.Mount.RelinkProtector(descriptor, dest, ctx.TrustedUser); err != nil {
+				return newExitError(c, err)
+			}
+			fmt.Fprintf(c.App.Writer, "Protector %s: linked to %q.\n",
+				descriptor, dest.Path)
+		}
+		repaired++
+	}
+
+	verb := "Repaired"
+	if dryRunFlag.Value {
+		verb = "Would repair"
+	}
+	fmt.Fprintf(c.App.Writer, "%s %s on %q (%d could not be repaired).\n",
+		verb, pluralize(repaired, "protector link"), ctx.Mount.Path, unresolved)
+	if unresolved > 0 {
+		return newExitError(c, fmt.Errorf("could not find %s",
+			pluralize(unresolved, "linked protector")))
+	}
+	return nil
+}
+
+// protectorsToRelink returns the descriptors of the protector links on the
+// Context's filesystem, along with any protectors used by its policies which
+// aren't stored on the filesystem at all (as would happen if the link files
+// themselves were lost).
+func protectorsToRelink(ctx *actions.Context) ([]string, error) {
+	descriptors, err := ctx.Mount.ListLinkedProtectors()
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	for _, descriptor := range descriptors {
+		seen[descriptor] = true
+	}
+	policyDescriptors, err := ctx.Mount.ListPolicies(ctx.TrustedUser)
+	if err != nil {
+		return nil, err
+	}
+	for _, policyDescriptor := range policyDescriptors {
+		data, err := ctx.Mount.GetPolicy(policyDescriptor, ctx.TrustedUser)
+		if err != nil {
+			util.Debugf("skipping policy %s: %v", policyDescriptor, err)
+			continue
+		}
+		for _, wrappedKey := range data.WrappedPolicyKeys {
+			descriptor := wrappedKey.ProtectorDescriptor
+			if seen[descriptor] {
+				continue
+			}
+			_, _, err := ctx.Mount.GetProtector(descriptor, ctx.TrustedUser)
+			if _, ok := err.(*filesystem.ErrProtectorNotFound); ok {
+				descriptors = append(descriptors, descriptor)
+				seen[descriptor] = true
+			}
+		}
+	}
+	return descriptors, nil
+}
+
+// findProtectorMount returns the filesystem (other than the Context's) which
+// stores the regular protector with the given descriptor, or nil if there is
+// none. If there are several, the user is asked which one to use.
+func findProtectorMount(ctx *actions.Context, descriptor string,
+	mounts []*filesystem.Mount) (*filesystem.Mount, error) {
+	var candidates []*filesystem.Mount
+	for _, mnt := range mounts {
+		if mnt == ctx.Mount {
+			continue
+		}
+		if _, err := mnt.GetRegularProtector(descriptor, ctx.TrustedUser); err == nil {
+			candidates = append(candidates, mnt)
+		}
+	}
+	switch len(candidates) {
+	case 0:
+		return nil, nil
+	case 1:
+		return candidates[0], nil
+	}
+	for _, mnt := range candidates {
+		question := fmt.Sprintf("Protector %s was found on %q. Link to it?",
+			descriptor, mnt.Path)
+		ok, err := askQuestion(question, false)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return mnt, nil
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,444 @@
+/*
+ * completion.go - Printing shell completion scripts for fscrypt.
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package main
+
+import (
+	_ "embed" // for the bash completion script
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+
+	"github.com/urfave/cli"
+
+	"github.com/google/fscrypt/actions"
+	"github.com/google/fscrypt/filesystem"
+	"github.com/google/fscrypt/util"
+)
+
+// bashCompletion is the hand-written bash completion script, which is also
+// installed by "make install-completion".
+//
+//go:embed fscrypt_bash_completion
+var bashCompletion string
+
+// The ways a flag value or a positional argument can be completed.
+const (
+	completeNothing = iota
+	completeFiles
+	completeDirectories
+	completeMountpoints
+	completeProtectors
+	completePolicies
+	completeUsers
+	completeGroups
+	completeKeywords
+)
+
+// completionKeywords are the fixed values of the flags which take one. These
+// match the lists in fscrypt_bash_completion.
+var completionKeywords = map[string][]string{
+	"source": {"pam_passphrase", "custom_passphrase", "raw_key", "fido2", "tpm2",
+		"pkcs11", "kms", "tang", "passphrase_and_raw_key", "yubikey", "gpg", "ssh_agent"},
+	"filter":         {filterLocked, filterUnlocked},
+	"metadata-store": {"per-file", "packed"},
+	"contents":       {"AES_256_XTS", "AES_128_CBC", "Adiantum", "LEA_256_XTS"},
+	"filenames": {"AES_256_CTS", "AES_256_HCTR2", "AES_128_CTS", "Adiantum",
+		"LEA_256_CTS"},
+	"iv-ino-lblk": {"64", "32"},
+	"kdf":         {"argon2id", "scrypt"},
+	"log-level":   {"error", "warn", "info", "debug"},
+	"direct-key":  {"on", "off"},
+	"to":          {"login", "custom"},
+}
+
+// flagCompletion returns how the value of the flag is completed.
+func flagCompletion(f prettyFlag) int {
+	if _, ok := completionKeywords[f.GetName()]; ok {
+		return completeKeywords
+	}
+	switch f.GetArgName() {
+	case mountpointIDArg:
+		if f.GetName() == policyFlag.GetName() {
+			return completePolicies
+		}
+		return completeProtectors
+	case "FILE":
+		return completeFiles
+	case "DIR", "SRCDIR":
+		return completeDirectories
+	case "USERNAME", "USERS":
+		return completeUsers
+	case "GROUPS":
+		return completeGroups
+	}
+	return completeNothing
+}
+
+// argsCompletion returns how the positional arguments described by argsUsage
+// are completed. Paths of any kind are completed as files.
+func argsCompletion(argsUsage string) int {
+	kind := completeNothing
+	for _, arg := range strings.FieldsFunc(argsUsage, func(r rune) bool {
+		return strings.ContainsRune(" []|", r)
+	}) {
+		switch arg {
+		case directoryArg, pathArg, backupFileArg:
+			return completeFiles
+		case mountpointArg:
+			kind = completeMountpoints
+		}
+	}
+	return kind
+}
+
+// completionCommand is a command (or subcommand) of fscrypt as seen by the
+// completion scripts.
+type completionCommand struct {
+	path        []string
+	subcommands []cli.Command
+	flags       []prettyFlag
+	args        int
+}
+
+// completionCommands returns the visible commands and all their subcommands,
+// with each command before its subcommands.
+func completionCommands(commands []cli.Command, parent []string) []*completionCommand {
+	var all []*completionCommand
+	for _, command := range commands {
+		if command.Hidden {
+			continue
+		}
+		path := append(append([]string{}, parent...), command.Name)
+		cmd := &completionCommand{
+			path:        path,
+			subcommands: command.Subcommands,
+			args:        argsCompletion(command.ArgsUsage),
+		}
+		for _, flag := range command.Flags {
+			if f, ok := flag.(prettyFlag); ok {
+				cmd.flags = append(cmd.flags, f)
+			}
+		}
+		all = append(all, cmd)
+		all = append(all, completionCommands(command.Subcommands, path)...)
+	}
+	return all
+}
+
+var whitespace = regexp.MustCompile(`\s+`)
+
+// completionDescription shortens a usage string to its first sentence, on a
+// single line.
+func completionDescription(usage string) string {
+	usage = whitespace.ReplaceAllString(strings.TrimSpace(usage), " ")
+	for i := 0; ; {
+		end := strings.Index(usage[i:], ". ")
+		if end < 0 {
+			break
+		}
+		i += end
+		if !strings.HasSuffix(usage[:i], "e.g") && !strings.HasSuffix(usage[:i], "i.e") {
+			usage = usage[:i]
+			break
+		}
+		i += 2
+	}
+	return strings.TrimSuffix(usage, ".")
+}
+
+// shellQuote single-quotes s for zsh.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// fishQuote single-quotes s for fish.
+func fishQuote(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	return "'" + strings.ReplaceAll(s, "'", `\'`) + "'"
+}
+
+const zshCompletionHeader = `#compdef fscrypt
+# zsh completion for fscrypt, generated by "fscrypt completion zsh".
+
+# Complete with the mountpoints of the filesystems set up for fscrypt.
+_fscrypt_mountpoints() {
+  local -a mountpoints
+  mountpoints=(${(f)"$(_call_program mountpoints fscrypt completion mountpoints 2>/dev/null)"})
+  compadd "$@" -a mountpoints
+}
+
+# Complete with MOUNTPOINT:ID, where ID is a protector or policy ($1).
+_fscrypt_ids() {
+  local kind=$1 mountpoint line
+  local -a ids
+  if [[ $PREFIX != *:* ]]; then
+    _fscrypt_mountpoints -S :
+    return
+  fi
+  mountpoint=${PREFIX%:*}
+  compset -P '*:'
+  for line in ${(f)"$(_call_program $kind fscrypt completion $kind ${(q)mountpoint} 2>/dev/null)"}; do
+    line=${line#"$mountpoint":}
+    ids+=("${${line%%$'\t'*}//:/\\:}:${line#*$'\t'}")
+  done
+  _describe -t $kind ${kind%s} ids
+}
+
+_fscrypt() {
+  local word
+  local -a cmd subcommands bools values
+  for word in ${words[2,CURRENT-1]}; do
+    [[ $word == -* ]] || cmd+=($word)
+  done
+  case "${cmd[*]}" in
+`
+
+const zshCompletionFooter = `  esac
+}
+
+_fscrypt "$@"
+`
+
+// writeZshCompletion writes a zsh completion script for the given commands.
+func writeZshCompletion(w io.Writer, commands []cli.Command) {
+	io.WriteString(w, zshCompletionHeader)
+	writeZshSubcommands(w, "''", commands)
+	for _, cmd := range completionCommands(commands, nil) {
+		path := shellQuote(strings.Join(cmd.path, " "))
+		if len(cmd.subcommands) > 0 {
+			writeZshSubcommands(w, path, cmd.subcommands)
+			continue
+		}
+		fmt.Fprintf(w, "    (%s|%s*)\n", path, shellQuote(strings.Join(cmd.path, " ")+" "))
+		fmt.Fprintln(w, "      case $PREFIX in")
+		var bools, values []string
+		for _, f := range cmd.flags {
+			entry := shellQuote("--" + f.GetName() + ":" + completionDescription(f.GetUsage()))
+			if f.GetArgName() == "" {
+				bools = append(bools, entry)
+				continue
+			}
+			values = append(values, entry)
+			if action := zshCompletionAction(flagCompletion(f), f.GetName()); action != "" {
+				fmt.Fprintf(w, "        (--%s=*) compset -P '*='; %s ;;\n", f.GetName(), action)
+			}
+		}
+		fmt.Fprintln(w, "        (-*)")
+		fmt.Fprintf(w, "          bools=(%s)\n", strings.Join(bools, " "))
+		fmt.Fprintf(w, "          values=(%s)\n", strings.Join(values, " "))
+		fmt.Fprintln(w, "          _describe -t options option bools -- values -S '=' ;;")
+		if action := zshCompletionAction(cmd.args, ""); action != "" {
+			fmt.Fprintf(w, "        (*) %s ;;\n", action)
+		}
+		fmt.Fprintln(w, "      esac ;;")
+	}
+	io.WriteString(w, zshCompletionFooter)
+}
+
+// writeZshSubcommands writes the case which completes the subcommands of the
+// command at path.
+func writeZshSubcommands(w io.Writer, path string, subcommands []cli.Command) {
+	var entries []string
+	for _, sub := range subcommands {
+		if !sub.Hidden {
+			entries = append(entries, shellQuote(sub.Name+":"+completionDescription(sub.Usage)))
+		}
+	}
+	fmt.Fprintf(w, "    (%s)\n", path)
+	fmt.Fprintf(w, "      subcommands=(%s)\n", strings.Join(entries, " "))
+	fmt.Fprintln(w, "      _describe -t commands command subcommands ;;")
+}
+
+// zshCompletionAction returns the zsh code which completes a value of the
+// given kind, or "" if it can't be completed.
+func zshCompletionAction(kind int, flagName string) string {
+	switch kind {
+	case completeFiles:
+		return "_files"
+	case completeDirectories:
+		return "_files -/"
+	case completeMountpoints:
+		return "_fscrypt_mountpoints"
+	case completeProtectors:
+		return "_fscrypt_ids protectors"
+	case completePolicies:
+		return "_fscrypt_ids policies"
+	case completeUsers:
+		if flagName == allowUsersFlag.GetName() {
+			return "_sequence _users"
+		}
+		return "_users"
+	case completeGroups:
+		return "_sequence _groups"
+	case completeKeywords:
+		return "compadd " + strings.Join(completionKeywords[flagName], " ")
+	}
+	return ""
+}
+
+const fishCompletionHeader = `# fish completion for fscrypt, generated by "fscrypt completion fish".
+
+# Print the words of the command line which aren't options.
+function __fscrypt_words
+    set -l words (commandline -opc)
+    for word in $words[2..-1]
+        string match -q -- '-*' $word; or echo $word
+    end
+end
+
+# Check if the command line is exactly the given command.
+function __fscrypt_is
+    set -l words (__fscrypt_words)
+    test "$words" = "$argv"
+end
+
+# Check if the command line starts with the given command.
+function __fscrypt_in
+    set -l words (__fscrypt_words)
+    test (count $words) -ge (count $argv)
+    and test "$words[1..(count $argv)]" = "$argv"
+end
+
+# Complete with MOUNTPOINT:ID, where ID is a protector or policy ($argv[1]).
+function __fscrypt_ids
+    set -l token (string replace -r -- '^--[^=]*=' '' (commandline -ct))
+    if string match -q -- '*:*' $token
+        fscrypt completion $argv[1] (string replace -r -- ':[^:]*$' '' $token) 2>/dev/null
+    else
+        fscrypt completion mountpoints 2>/dev/null | string replace -r -- '$' ':'
+    end
+end
+
+complete -c fscrypt -f
+`
+
+// writeFishCompletion writes a fish completion script for the given commands.
+func writeFishCompletion(w io.Writer, commands []cli.Command) {
+	io.WriteString(w, fishCompletionHeader)
+	writeFishSubcommands(w, nil, commands)
+	for _, cmd := range completionCommands(commands, nil) {
+		if len(cmd.subcommands) > 0 {
+			writeFishSubcommands(w, cmd.path, cmd.subcommands)
+			continue
+		}
+		condition := fishQuote("__fscrypt_in " + strings.Join(cmd.path, " "))
+		fmt.Fprintln(w)
+		for _, f := range cmd.flags {
+			fmt.Fprintf(w, "complete -c fscrypt -n %s -l %s", condition, f.GetName())
+			if f.GetArgName() != "" {
+				fmt.Fprint(w, " -r")
+				if action := fishCompletionAction(flagCompletion(f), f.GetName()); action != "" {
+					fmt.Fprint(w, " "+action)
+				}
+			}
+			fmt.Fprintf(w, " -d %s\n", fishQuote(completionDescription(f.GetUsage())))
+		}
+		if action := fishCompletionAction(cmd.args, ""); action != "" {
+			fmt.Fprintf(w, "complete -c fscrypt -n %s %s\n", condition, action)
+		}
+	}
+}
+
+// writeFishSubcommands writes the completions of the subcommands of the
+// command at path.
+func writeFishSubcommands(w io.Writer, path []string, subcommands []cli.Command) {
+	condition := fishQuote(strings.TrimSpace("__fscrypt_is " + strings.Join(path, " ")))
+	fmt.Fprintln(w)
+	for _, sub := range subcommands {
+		if !sub.Hidden {
+			fmt.Fprintf(w, "complete -c fscrypt -n %s -a %s -d %s\n", condition,
+				fishQuote(sub.Name), fishQuote(completionDescription(sub.Usage)))
+		}
+	}
+}
+
+// fishCompletionAction returns the fish options which complete a value of the
+// given kind, or "" if it can't be completed.
+func fishCompletionAction(kind int, flagName string) string {
+	switch kind {
+	case completeFiles:
+		return "-F"
+	case completeDirectories:
+		return "-a '(__fish_complete_directories)'"
+	case completeMountpoints:
+		return "-a '(fscrypt completion mountpoints 2>/dev/null)'"
+	case completeProtectors:
+		return "-a '(__fscrypt_ids protectors)'"
+	case completePolicies:
+		return "-a '(__fscrypt_ids policies)'"
+	case completeUsers:
+		return "-a '(__fish_complete_users)'"
+	case completeGroups:
+		return "-a '(__fish_complete_groups)'"
+	case completeKeywords:
+		return "-a " + fishQuote(strings.Join(completionKeywords[flagName], " "))
+	}
+	return ""
+}
+
+// writeCompletionMountpoints prints the mountpoints of the filesystems set up
+// for use with fscrypt, one per line.
+func writeCompletionMountpoints(w io.Writer) error {
+	mounts, err := filesystem.AllFilesystems()
+	if err != nil {
+		return err
+	}
+	for _, mount := range mounts {
+		if mount.CheckSetup(nil) == nil {
+			fmt.Fprintln(w, mount.Path)
+		}
+	}
+	return nil
+}
+
+// writeCompletionIDs prints the protectors or policies on the filesystem at
+// mountpoint in the MOUNTPOINT:ID form, each followed by a tab and a
+// description.
+func writeCompletionIDs(w io.Writer, kind, mountpoint string) error {
+	ctx, err := actions.NewContextFromMountpoint(mountpoint, nil)
+	if err != nil {
+		return err
+	}
+	if kind == "protectors" {
+		options, err := ctx.ProtectorOptions()
+		if err != nil {
+			return err
+		}
+		for _, option := range options {
+			fmt.Fprintf(w, "%s:%s\t%s\n", mountpoint, option.Descriptor(),
+				formatInfo(option.ProtectorInfo))
+		}
+		return nil
+	}
+	descriptors, err := ctx.Mount.ListPolicies(ctx.TrustedUser)
+	if err != nil {
+		return err
+	}
+	for _, descriptor := range descriptors {
+		label := ""
+		if policy, err := actions.GetPolicy(ctx, descriptor); err == nil {
+			label = policyLabel(policy)
+		} else {
+			util.Debug(err)
+		}
+		fmt.Fprintf(w, "%s:%s\t%s\n", mountpoint, descriptor, label)
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+/*
+ * completion_test.go - tests for printing shell completion scripts
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/urfave/cli"
+)
+
+func TestCompletionDescription(t *testing.T) {
+	tests := map[string]string{
+		"Lock the directory.":                          "Lock the directory",
+		"Use MODE, e.g.\n\t\t\"Adiantum\". By default": `Use MODE, e.g. "Adiantum"`,
+		"First sentence. Second sentence.":             "First sentence",
+	}
+	for usage, expected := range tests {
+		if description := completionDescription(usage); description != expected {
+			t.Errorf("description of %q is %q, expected %q", usage, description, expected)
+		}
+	}
+}
+
+func TestArgsCompletion(t *testing.T) {
+	tests := map[string]int{
+		mountpointArg:                          completeMountpoints,
+		"[" + pathArg + "]":                    completeFiles,
+		mountpointArg + " " + backupFileArg:    completeFiles,
+		shortDisplay(protectorFlag):            completeNothing,
+		mountpointArg + " " + keyIdentifierArg: completeMountpoints,
+	}
+	for argsUsage, expected := range tests {
+		if kind := argsCompletion(argsUsage); kind != expected {
+			t.Errorf("arguments %q are completed as %d, expected %d", argsUsage, kind, expected)
+		}
+	}
+}
+
+// Tests that the generated scripts cover every visible command and the values
+// of flags like --protector.
+func TestCompletionScripts(t *testing.T) {
+	commands := []cli.Command{Setup, Encrypt, Status, Metadata}
+	var zsh, fish strings.Builder
+	writeZshCompletion(&zsh, commands)
+	writeFishCompletion(&fish, commands)
+	for _, cmd := range completionCommands(commands, nil) {
+		path := strings.Join(cmd.path, " ")
+		if !strings.Contains(zsh.String(), "('"+path+"'") {
+			t.Errorf("zsh script doesn't complete %q", path)
+		}
+		if !strings.Contains(fish.String(), "'"+cmd.path[len(cmd.path)-1]+"'") {
+			t.Errorf("fish script doesn't complete %q", path)
+		}
+	}
+	if !strings.Contains(zsh.String(), "(--protector=*) compset -P '*='; _fscrypt_ids protectors ;;") {
+		t.Error("zsh script doesn't complete protectors")
+	}
+	if !strings.Contains(fish.String(), "-l policy -r -a '(__fscrypt_ids policies)'") {
+		t.Error("fish script doesn't complete policies")
+	}
+}
@@ -0,0 +1,74 @@
+/*
+ * doctor.go - Reporting whether fscrypt can operate on a filesystem.
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/google/fscrypt/actions"
+)
+
+// Status labels of the checklist, padded to the same width
+const (
+	checkPassed  = "[PASS]"
+	checkFailed  = "[FAIL]"
+	checkSkipped = "[SKIP]"
+)
+
+// writeChecklist writes the result of each of actions.ValidationChecks for the
+// filesystem mounted at mountpoint, with suggestions for fixing the failures.
+// Checks which weren't run are listed as skipped. An ErrProblemsFound is
+// returned if any check failed.
+func writeChecklist(w io.Writer, mountpoint string, results []actions.ValidationResult) error {
+	byCheck := make(map[actions.ValidationCheck]error)
+	for _, result := range results {
+		byCheck[result.Check] = result.Err
+	}
+
+	fmt.Fprintf(w, "Checking fscrypt on %q:\n", mountpoint)
+	// Details are lined up with the description of the check.
+	padding := indentLength + len(checkPassed) + 1
+	failures := 0
+	for _, check := range actions.ValidationChecks {
+		err, ran := byCheck[check]
+		switch {
+		case !ran:
+			fmt.Fprintf(w, "  %s %s\n", checkSkipped, check)
+		case err == nil:
+			fmt.Fprintf(w, "  %s %s\n", checkPassed, check)
+		default:
+			failures++
+			fmt.Fprintf(w, "  %s %s\n", checkFailed, check)
+			details := err.Error()
+			if suggestion := getErrorSuggestions(err); suggestion != "" {
+				details += "\n\n" + suggestion
+			}
+			fmt.Fprintf(w, "%s%s\n", strings.Repeat(" ", padding),
+				wrapText(details, padding))
+		}
+	}
+	fmt.Fprintln(w)
+	if failures > 0 {
+		return &ErrProblemsFound{mountpoint, failures}
+	}
+	fmt.Fprintln(w, "No problems found.")
+	return nil
+}
@@ -0,0 +1,184 @@
+/*
+ * dryrun.go - Printing what destructive commands would do with --dry-run.
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/google/fscrypt/actions"
+	"github.com/google/fscrypt/filesystem"
+	"github.com/google/fscrypt/metadata"
+)
+
+// writeEncryptPlan prints what "fscrypt encrypt" would do to path (migrating
+// migrateFlag's directory in place if inPlace is set), without creating any
+// metadata, adding any keys, or changing any files. Nothing is prompted for, so
+// choices which would be made interactively are only described.
+func writeEncryptPlan(w io.Writer, path string, inPlace bool) error {
+	if inPlace {
+		path = migrationSibling(migrateFlag.Value)
+	}
+	if migrateFlag.Value != "" {
+		if err := checkMigrateSource(migrateFlag.Value, path); err != nil {
+			return err
+		}
+	}
+	_, statErr := os.Stat(path)
+	exists := statErr == nil
+	if !exists && migrateFlag.Value == "" {
+		return statErr
+	}
+
+	targetUser, err := parseUserFlag()
+	if err != nil {
+		return err
+	}
+	// A directory created for --migrate doesn't exist yet.
+	ctxPath := path
+	if !exists {
+		ctxPath = filepath.Dir(path)
+	}
+	ctx, err := actions.NewContextFromPath(ctxPath, targetUser)
+	if err != nil {
+		return err
+	}
+	if exists {
+		if err = checkEncryptable(ctx, path); err != nil {
+			return err
+		}
+	} else {
+		fmt.Fprintf(w, "Would create the directory %q.\n", path)
+	}
+
+	policyDescriptor := "the new policy"
+	if policyFlag.Value != "" {
+		policy, err := getPolicyFromFlag(policyFlag.Value, ctx.TargetUser)
+		if err != nil {
+			return err
+		}
+		policyDescriptor = "policy " + policy.Descriptor()
+		fmt.Fprintf(w, "Would use the existing policy %s from %s.\n",
+			policy.Descriptor(), policy.Context.Mount.PolicyLocation(policy.Descriptor()))
+	} else {
+		protectorMount, err := writeProtectorPlan(w, ctx)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "Would write a new policy to %s.\n", ctx.Mount.PolicyLocation("*"))
+		if protectorMount != nil && protectorMount != ctx.Mount {
+			fmt.Fprintf(w, "Would link the protector into %s.\n",
+				ctx.Mount.ProtectorLocation("*"))
+			if !noRecoveryFlag.Value {
+				fmt.Fprintf(w, "Would write a new recovery passphrase protector to %s, and recovery instructions to %q.\n",
+					ctx.Mount.ProtectorLocation("*"),
+					filepath.Join(path, "fscrypt_recovery_readme.txt"))
+			}
+		}
+	}
+
+	if skipUnlockFlag.Value {
+		fmt.Fprintf(w, "Would not add the key of %s to the keyring.\n", policyDescriptor)
+	} else {
+		fmt.Fprintf(w, "Would add the key of %s to the keyring on behalf of user %q.\n",
+			policyDescriptor, ctx.TargetUser.Username)
+	}
+	fmt.Fprintf(w, "Would set %s on %q.\n", policyDescriptor, path)
+	if ownerFlag.Value != "" {
+		fmt.Fprintf(w, "Would make %q the owner of %q.\n", ownerFlag.Value, path)
+	}
+
+	switch {
+	case inPlace:
+		fmt.Fprintf(w, "Would copy the contents of %q into %q, swap the two directories, and overwrite and delete the originals.\n",
+			migrateFlag.Value, path)
+	case migrateFlag.Value != "":
+		fmt.Fprintf(w, "Would copy the contents of %q into %q, and overwrite and delete the originals.\n",
+			migrateFlag.Value, path)
+	}
+	if manifestFlag.Value != "" {
+		fmt.Fprintf(w, "Would append a line describing the directory to %q.\n", manifestFlag.Value)
+	}
+	return nil
+}
+
+// writeProtectorPlan prints which protector a new policy for ctx would be
+// protected with, and returns the filesystem it is (or would be) stored on, or
+// nil if that would only be decided by a prompt.
+func writeProtectorPlan(w io.Writer, ctx *actions.Context) (*filesystem.Mount, error) {
+	if protectorFlag.Value != "" {
+		protector, err := getProtectorFromFlag(protectorFlag.Value, ctx.TargetUser)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(w, "Would protect the new policy with the existing protector %s from %s.\n",
+			protector.Descriptor(), protector.Context.Mount.ProtectorLocation(protector.Descriptor()))
+		return protector.Context.Mount, nil
+	}
+	options, err := expandedProtectorOptions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(options) > 0 && nameFlag.Value == "" && sourceFlag.Value == "" {
+		fmt.Fprintf(w, "Would ask whether to create a new protector or to use one of the %s on %q.\n",
+			pluralize(len(options), "protector"), ctx.Mount.Path)
+		return nil, nil
+	}
+
+	source := ctx.Config.Source
+	if sourceFlag.Value != "" {
+		source = metadata.SourceType(metadata.SourceType_value[sourceFlag.Value])
+	} else if ownerFlag.Value != "" {
+		source = metadata.SourceType_pam_passphrase
+	}
+	mount := ctx.Mount
+	if source == metadata.SourceType_pam_passphrase {
+		// New login protectors are stored on the root filesystem.
+		if mount, err = filesystem.GetMount(actions.LoginProtectorMountpoint); err != nil {
+			return nil, err
+		}
+	}
+	if source == metadata.SourceType_default {
+		fmt.Fprintf(w, "Would ask for the type of a new protector, and write it to %s.\n",
+			mount.ProtectorLocation("*"))
+	} else {
+		fmt.Fprintf(w, "Would write a new %s protector to %s.\n", source, mount.ProtectorLocation("*"))
+	}
+	return mount, nil
+}
+
+// writePurgePlan prints the policies whose keys "fscrypt purge" would remove
+// from the keyring.
+func writePurgePlan(w io.Writer, ctx *actions.Context, userOnly bool) error {
+	descriptors, err := actions.PoliciesToPurge(ctx, userOnly)
+	if err != nil {
+		return err
+	}
+	for _, descriptor := range descriptors {
+		fmt.Fprintf(w, "Would remove the key of policy %s from the keyring.\n", descriptor)
+	}
+	fmt.Fprintf(w, "Would purge %s from %q.\n",
+		pluralize(len(descriptors), "policy"), ctx.Mount.Path)
+	if dropCachesFlag.Value {
+		fmt.Fprintln(w, "Would drop the global inode cache.")
+	}
+	return nil
+}
@@ -0,0 +1,257 @@
+/*
+ * errorids.go - Stable identifiers for the errors fscrypt reports, and the exit
+ * codes which go with them.
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/google/fscrypt/actions"
+	"github.com/google/fscrypt/crypto"
+	"github.com/google/fscrypt/filesystem"
+	"github.com/google/fscrypt/keyring"
+	"github.com/google/fscrypt/metadata"
+)
+
+// Error identifiers, which name the cause of a failure independently of the
+// (possibly reworded or translated) message. These values are documented in
+// the README and must not change.
+const (
+	errIDFailed                 = "ERR_FAILED"
+	errIDUsage                  = "ERR_USAGE"
+	errIDWrongKey               = "ERR_WRONG_KEY"
+	errIDWrongPIN               = "ERR_WRONG_PIN"
+	errIDWrongRecoveryCode      = "ERR_WRONG_RECOVERY_CODE"
+	errIDWrongDevice            = "ERR_WRONG_DEVICE"
+	errIDEncryptionNotEnabled   = "ERR_ENCRYPTION_NOT_ENABLED"
+	errIDEncryptionNotSupported = "ERR_ENCRYPTION_NOT_SUPPORTED"
+	errIDOptionsNotSupported    = "ERR_OPTIONS_NOT_SUPPORTED"
+	errIDNotSetup               = "ERR_NOT_SETUP"
+	errIDNoConfigFile           = "ERR_NO_CONFIG_FILE"
+	errIDMustBeRoot             = "ERR_MUST_BE_ROOT"
+	errIDProtectorAccessDenied  = "ERR_PROTECTOR_ACCESS_DENIED"
+	errIDPermissionDenied       = "ERR_PERMISSION_DENIED"
+	errIDFilesOpen              = "ERR_FILES_OPEN"
+	errIDUnlockedByOtherUsers   = "ERR_UNLOCKED_BY_OTHER_USERS"
+	errIDNotFullyLocked         = "ERR_NOT_FULLY_LOCKED"
+	errIDMetadataLocked         = "ERR_METADATA_LOCKED"
+	errIDNotEncrypted           = "ERR_NOT_ENCRYPTED"
+	errIDAlreadyEncrypted       = "ERR_ALREADY_ENCRYPTED"
+	errIDAlreadySetup           = "ERR_ALREADY_SETUP"
+	errIDAlreadyUnlocked        = "ERR_ALREADY_UNLOCKED"
+	errIDAlreadyLocked          = "ERR_ALREADY_LOCKED"
+	errIDCanceled               = "ERR_CANCELED"
+	errIDNeedsConfirmation      = "ERR_NEEDS_CONFIRMATION"
+	errIDProblemsFound          = "ERR_PROBLEMS_FOUND"
+	errIDAccessFailures         = "ERR_ACCESS_FAILURES"
+	errIDPolicyNotFound         = "ERR_POLICY_NOT_FOUND"
+	errIDProtectorNotFound      = "ERR_PROTECTOR_NOT_FOUND"
+	errIDDirNotEmpty            = "ERR_DIR_NOT_EMPTY"
+	errIDCorruptMetadata        = "ERR_CORRUPT_METADATA"
+	errIDKeyQuotaExceeded       = "ERR_KEY_QUOTA_EXCEEDED"
+	errIDNotFound               = "ERR_NOT_FOUND"
+	errIDMissingTool            = "ERR_MISSING_TOOL"
+	errIDDeviceNotPresent       = "ERR_DEVICE_NOT_PRESENT"
+)
+
+// errorIDExitCodes maps the error identifiers to the exit codes fscrypt returns
+// for them. Identifiers which aren't listed return failureExitCode.
+var errorIDExitCodes = map[string]int{
+	errIDUsage:                  usageExitCode,
+	errIDWrongKey:               wrongKeyExitCode,
+	errIDWrongPIN:               wrongKeyExitCode,
+	errIDWrongRecoveryCode:      wrongKeyExitCode,
+	errIDWrongDevice:            wrongKeyExitCode,
+	errIDEncryptionNotEnabled:   unsupportedExitCode,
+	errIDEncryptionNotSupported: unsupportedExitCode,
+	errIDOptionsNotSupported:    unsupportedExitCode,
+	errIDNotSetup:               notSetupExitCode,
+	errIDNoConfigFile:           notSetupExitCode,
+	errIDMustBeRoot:             permissionExitCode,
+	errIDProtectorAccessDenied:  permissionExitCode,
+	errIDPermissionDenied:       permissionExitCode,
+	errIDFilesOpen:              busyExitCode,
+	errIDUnlockedByOtherUsers:   busyExitCode,
+	errIDNotFullyLocked:         busyExitCode,
+	errIDMetadataLocked:         busyExitCode,
+	errIDNotEncrypted:           notEncryptedExitCode,
+	errIDAlreadyEncrypted:       alreadyDoneExitCode,
+	errIDAlreadySetup:           alreadyDoneExitCode,
+	errIDAlreadyUnlocked:        alreadyDoneExitCode,
+	errIDAlreadyLocked:          alreadyDoneExitCode,
+	errIDCanceled:               canceledExitCode,
+	errIDNeedsConfirmation:      canceledExitCode,
+	errIDProblemsFound:          problemsExitCode,
+	errIDAccessFailures:         problemsExitCode,
+}
+
+// errorIDsEnabled is true if $FSCRYPT_ERROR_IDS is "1", in which case the
+// identifier of an error is included in its tag, e.g. "[ERROR ERR_WRONG_KEY]".
+var errorIDsEnabled bool
+
+// getErrorID returns the identifier for an error, based on its underlying
+// cause.
+func getErrorID(err error) string {
+	if _, ok := err.(*usageError); ok {
+		return errIDUsage
+	}
+	cause := errors.Cause(err)
+	switch cause.(type) {
+	case *filesystem.ErrEncryptionNotEnabled:
+		return errIDEncryptionNotEnabled
+	case *filesystem.ErrEncryptionNotSupported, *filesystem.ErrSetupNotSupported:
+		return errIDEncryptionNotSupported
+	case *metadata.ErrBadEncryptionOptions, *metadata.ErrDataUnitSizeTooLarge:
+		return errIDOptionsNotSupported
+	case *filesystem.ErrNotSetup:
+		return errIDNotSetup
+	case *actions.ErrNoConfigFile:
+		return errIDNoConfigFile
+	case *actions.ErrProtectorAccessDenied:
+		return errIDProtectorAccessDenied
+	case *actions.ErrAccessDeniedPossiblyV2, *filesystem.ErrNoCreatePermission,
+		*keyring.ErrAccessUserKeyring, *metadata.ErrDirectoryNotOwned:
+		return errIDPermissionDenied
+	case *ErrDirFilesOpen:
+		return errIDFilesOpen
+	case *ErrDirUnlockedByOtherUsers, *ErrPolicyUnlockedByOtherUsers:
+		return errIDUnlockedByOtherUsers
+	case *ErrPoliciesNotFullyLocked:
+		return errIDNotFullyLocked
+	case *filesystem.ErrMetadataLocked:
+		return errIDMetadataLocked
+	case *metadata.ErrNotEncrypted:
+		return errIDNotEncrypted
+	case *metadata.ErrAlreadyEncrypted:
+		return errIDAlreadyEncrypted
+	case *filesystem.ErrAlreadySetup:
+		return errIDAlreadySetup
+	case *ErrProblemsFound:
+		return errIDProblemsFound
+	case *ErrAccessFailures:
+		return errIDAccessFailures
+	case *filesystem.ErrPolicyNotFound:
+		return errIDPolicyNotFound
+	case *filesystem.ErrProtectorNotFound, *ErrNoProtectorWithName:
+		return errIDProtectorNotFound
+	case *ErrDirNotEmpty:
+		return errIDDirNotEmpty
+	case *filesystem.ErrCorruptMetadata, *filesystem.ErrMetadataDowngraded,
+		*actions.ErrMetadataTampered:
+		return errIDCorruptMetadata
+	case *keyring.ErrKeyQuotaExceeded:
+		return errIDKeyQuotaExceeded
+	}
+	switch cause {
+	case ErrWrongKey, crypto.ErrBadAuth, actions.ErrGPGWrongKey,
+		actions.ErrKMSWrongKey, actions.ErrSSHWrongKey, actions.ErrTangWrongKey:
+		return errIDWrongKey
+	case actions.ErrIncorrectPIN:
+		return errIDWrongPIN
+	case crypto.ErrRecoveryCode:
+		return errIDWrongRecoveryCode
+	case ErrWrongSecurityKey, ErrWrongTPM:
+		return errIDWrongDevice
+	case metadata.ErrEncryptionNotEnabled:
+		return errIDEncryptionNotEnabled
+	case metadata.ErrEncryptionNotSupported, keyring.ErrV2PoliciesUnsupported:
+		return errIDEncryptionNotSupported
+	case metadata.ErrDirectKeyUnsupported:
+		return errIDOptionsNotSupported
+	case ErrMustBeRoot, ErrDropCachesPerm, ErrFsKeyringPerm, ErrAfterLockPerm:
+		return errIDMustBeRoot
+	case ErrKMSAccessDenied:
+		return errIDPermissionDenied
+	case keyring.ErrKeyFilesOpen:
+		return errIDFilesOpen
+	case keyring.ErrKeyAddedByOtherUsers:
+		return errIDUnlockedByOtherUsers
+	case ErrNotLockedForSuspend:
+		return errIDNotFullyLocked
+	case ErrDirAlreadyUnlocked:
+		return errIDAlreadyUnlocked
+	case ErrDirAlreadyLocked, ErrPolicyAlreadyLocked:
+		return errIDAlreadyLocked
+	case ErrCanceled:
+		return errIDCanceled
+	case ErrNoDestructiveOps:
+		return errIDNeedsConfirmation
+	case ErrNoFIDO2Tools, ErrNoTPM2Tools, ErrNoPKCS11Tool, ErrNoKMSTool,
+		ErrNoYubiKeyTool, ErrNoGPG:
+		return errIDMissingTool
+	case ErrPKCS11TokenAbsent, ErrYubiKeyAbsent:
+		return errIDDeviceNotPresent
+	}
+	switch {
+	case os.IsPermission(cause):
+		return errIDPermissionDenied
+	case os.IsNotExist(cause):
+		return errIDNotFound
+	}
+	return errIDFailed
+}
+
+// getExitCode returns the exit code fscrypt should return for an error.
+func getExitCode(err error) int {
+	if code, ok := errorIDExitCodes[getErrorID(err)]; ok {
+		return code
+	}
+	return failureExitCode
+}
+
+// errorTag returns the tag which starts the message of an error.
+func errorTag(err error) string {
+	if errorIDsEnabled {
+		return "[ERROR " + getErrorID(err) + "]"
+	}
+	return "[ERROR]"
+}
+
+// errorJSON describes a failure in JSON output mode. The message and suggestion
+// are the same as in the normal output, but on a single line.
+type errorJSON struct {
+	ID         string `json:"id"`
+	ExitCode   int    `json:"exit_code"`
+	Command    string `json:"command"`
+	Message    string `json:"message"`
+	Suggestion string `json:"suggestion,omitempty"`
+}
+
+// jsonErrorMessage returns the JSON object which is printed to stderr instead
+// of the normal error message when a command fails with --json.
+func jsonErrorMessage(command string, message string, err error) string {
+	output := struct {
+		Error errorJSON `json:"error"`
+	}{errorJSON{
+		ID:         getErrorID(err),
+		ExitCode:   getExitCode(err),
+		Command:    command,
+		Message:    strings.Join(strings.Fields(message), " "),
+		Suggestion: strings.Join(strings.Fields(getErrorSuggestions(err)), " "),
+	}}
+	data, err := json.Marshal(output)
+	if err != nil {
+		return message
+	}
+	return string(data)
+}
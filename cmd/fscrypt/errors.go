@@ -26,6 +26,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"unicode/utf8"
 
 	"github.com/pkg/errors"
@@ -40,28 +41,85 @@ import (
 	"github.com/google/fscrypt/util"
 )
 
-// failureExitCode is the value fscrypt will return on failure.
-const failureExitCode = 1
+// Exit codes fscrypt returns on failure, so that scripts can tell classes of
+// errors apart without parsing the messages. These values are documented in the
+// README and must not change.
+const (
+	// failureExitCode is returned for errors not in any of the classes below.
+	failureExitCode = 1
+	// usageExitCode is returned when a command is used incorrectly.
+	usageExitCode = 2
+	// wrongKeyExitCode is returned when a passphrase, PIN, or key is wrong.
+	wrongKeyExitCode = 3
+	// unsupportedExitCode is returned when the kernel or filesystem doesn't
+	// support (or hasn't enabled) encryption or the needed feature.
+	unsupportedExitCode = 4
+	// notSetupExitCode is returned when fscrypt or a filesystem hasn't been
+	// set up yet.
+	notSetupExitCode = 5
+	// permissionExitCode is returned when the user isn't allowed to do the
+	// operation, e.g. because it requires root.
+	permissionExitCode = 6
+	// busyExitCode is returned when a directory couldn't be fully locked
+	// because files are still open or other users have unlocked it.
+	busyExitCode = 7
+	// notEncryptedExitCode is returned when a path isn't encrypted.
+	notEncryptedExitCode = 8
+	// alreadyDoneExitCode is returned when a path is already encrypted,
+	// unlocked, or locked, or a filesystem is already set up.
+	alreadyDoneExitCode = 9
+	// canceledExitCode is returned when the user declined a prompt, or a
+	// destructive operation needed confirmation which couldn't be given.
+	canceledExitCode = 10
+	// problemsExitCode is returned when "fscrypt doctor", "fscrypt check",
+	// or "fscrypt verify-access" found problems.
+	problemsExitCode = 11
+)
 
 // Various errors used for the top level user interface
 var (
-	ErrCanceled           = errors.New("operation canceled")
-	ErrNoDestructiveOps   = errors.New("operation would be destructive")
-	ErrInvalidSource      = errors.New("invalid source type")
-	ErrPassphraseMismatch = errors.New("entered passphrases do not match")
-	ErrSpecifyProtector   = errors.New("multiple protectors available")
-	ErrWrongKey           = errors.New("incorrect key provided")
-	ErrSpecifyKeyFile     = errors.New("no key file specified")
-	ErrKeyFileLength      = errors.Errorf("key file must be %d bytes", metadata.InternalKeyLen)
-	ErrAllLoadsFailed     = errors.New("could not load any protectors")
-	ErrMustBeRoot         = errors.New("this command must be run as root")
-	ErrDirAlreadyUnlocked = errors.New("this file or directory is already unlocked")
-	ErrDirAlreadyLocked   = errors.New("this file or directory is already locked")
-	ErrNotPassphrase      = errors.New("protector does not use a passphrase")
-	ErrUnknownUser        = errors.New("unknown user")
-	ErrDropCachesPerm     = errors.New("inode cache can only be dropped as root")
-	ErrSpecifyUser        = errors.New("user must be specified when run as root")
-	ErrFsKeyringPerm      = errors.New("root is required to add/remove v1 encryption policy keys to/from filesystem")
+	ErrCanceled            = errors.New("operation canceled")
+	ErrNoDestructiveOps    = errors.New("operation would be destructive")
+	ErrInvalidSource       = errors.New("invalid source type")
+	ErrPassphraseMismatch  = errors.New("entered passphrases do not match")
+	ErrSpecifyProtector    = errors.New("multiple protectors available")
+	ErrWrongKey            = errors.New("incorrect key provided")
+	ErrSpecifyKeyFile      = errors.New("no key file specified")
+	ErrKeyFileLength       = errors.Errorf("key file must be %d bytes", metadata.InternalKeyLen)
+	ErrTwoKeySources       = errors.New("a key file and a key from stdin cannot both be used")
+	ErrAllLoadsFailed      = errors.New("could not load any protectors")
+	ErrMustBeRoot          = errors.New("this command must be run as root")
+	ErrDirAlreadyUnlocked  = errors.New("this file or directory is already unlocked")
+	ErrDirAlreadyLocked    = errors.New("this file or directory is already locked")
+	ErrDirNotUnlocked      = errors.New("this file or directory is not unlocked")
+	ErrPolicyAlreadyLocked = errors.New("this policy is already locked")
+	ErrNotPassphrase       = errors.New("protector does not use a passphrase")
+	ErrUnknownUser         = errors.New("unknown user")
+	ErrUnknownGroup        = errors.New("unknown group")
+	ErrDropCachesPerm      = errors.New("inode cache can only be dropped as root")
+	ErrSpecifyUser         = errors.New("user must be specified when run as root")
+	ErrFsKeyringPerm       = errors.New("root is required to add/remove v1 encryption policy keys to/from filesystem")
+	ErrNoFIDO2Tools        = errors.New("libfido2's command line tools are not installed")
+	ErrWrongSecurityKey    = errors.New("the security key doesn't hold the protector's credential")
+	ErrAfterLockPerm       = errors.New("filesystems can only be unmounted or remounted as root")
+	ErrNoTPM2Tools         = errors.New("the tpm2-tools programs are not installed")
+	ErrTPM2PCRMismatch     = errors.New("the TPM's PCR values don't match the ones the protector is bound to")
+	ErrWrongTPM            = errors.New("the protector was sealed by another TPM")
+	ErrNoPKCS11Tool        = errors.New("OpenSC's pkcs11-tool is not installed")
+	ErrNoPKCS11Key         = errors.New("the PKCS#11 token has no key pairs")
+	ErrPKCS11TokenAbsent   = errors.New("no PKCS#11 token was found")
+	ErrPKCS11PINLocked     = errors.New("the PIN of the PKCS#11 token is locked")
+	ErrNoKMSTool           = errors.New("the cloud provider's command line tool is not installed")
+	ErrUnknownKMSKey       = errors.New("not an AWS KMS, GCP Cloud KMS, or Azure Key Vault key")
+	ErrKMSAccessDenied     = errors.New("the cloud KMS refused to use the key")
+	ErrNoYubiKeyTool       = errors.New("ykchalresp is not installed")
+	ErrYubiKeyAbsent       = errors.New("no YubiKey was found")
+	ErrYubiKeyTimeout      = errors.New("the YubiKey didn't answer the challenge")
+	ErrNoGPG               = errors.New("gpg is not installed")
+	ErrGPGNoPublicKey      = errors.New("GPG has no usable public key for the recipient")
+	ErrGPGNoSecretKey      = errors.New("GPG doesn't have the secret key the protector is encrypted to")
+	ErrBadKeyIdentifier    = errors.New("key identifiers must be 32 hex characters")
+	ErrNotLockedForSuspend = errors.New("some policies couldn't be fully locked for suspend")
 )
 
 // ErrDirFilesOpen indicates that a directory can't be fully locked because
@@ -86,6 +144,54 @@ func (err *ErrDirUnlockedByOtherUsers) Error() string {
 	user(s) have unlocked it.`, err.DirPath)
 }
 
+// ErrPolicyUnlockedByOtherUsers indicates that a policy given by descriptor
+// can't be locked because it is still provisioned by other users.
+type ErrPolicyUnlockedByOtherUsers struct {
+	Descriptor string
+}
+
+func (err *ErrPolicyUnlockedByOtherUsers) Error() string {
+	return fmt.Sprintf(`Policy %s couldn't be fully locked because other
+	user(s) have unlocked it.`, err.Descriptor)
+}
+
+// ErrPoliciesNotFullyLocked indicates that some of the policies unlocked on a
+// filesystem couldn't be fully locked.
+type ErrPoliciesNotFullyLocked struct {
+	Mountpoint string
+	Count      int
+}
+
+func (err *ErrPoliciesNotFullyLocked) Error() string {
+	return fmt.Sprintf("%s on %q couldn't be fully locked.",
+		pluralize(err.Count, "policy"), err.Mountpoint)
+}
+
+// ErrAfterLockFailed indicates that the action given with --after failed, after
+// the directory or policy was locked.
+type ErrAfterLockFailed struct {
+	Action          string
+	Path            string
+	UnderlyingError error
+}
+
+func (err *ErrAfterLockFailed) Error() string {
+	return fmt.Sprintf("locked successfully, but the %s of %q failed: %v",
+		err.Action, err.Path, err.UnderlyingError)
+}
+
+// ErrDirSharesPolicy indicates that a directory can't be locked without also
+// locking other directories which use the same policy.
+type ErrDirSharesPolicy struct {
+	DirPath   string
+	OtherDirs []string
+}
+
+func (err *ErrDirSharesPolicy) Error() string {
+	return fmt.Sprintf(`Directory %q uses the same encryption policy as %s,
+	which would be locked too.`, err.DirPath, quoteList(err.OtherDirs))
+}
+
 // ErrDirNotEmpty indicates that a directory can't be encrypted because it's not
 // empty.
 type ErrDirNotEmpty struct {
@@ -96,6 +202,85 @@ func (err *ErrDirNotEmpty) Error() string {
 	return fmt.Sprintf("Directory %q cannot be encrypted because it is non-empty.", err.DirPath)
 }
 
+// ErrNoProtectorWithName indicates that a protector given by name in a flag
+// doesn't exist on the specified filesystem.
+type ErrNoProtectorWithName struct {
+	Name       string
+	Mountpoint string
+}
+
+func (err *ErrNoProtectorWithName) Error() string {
+	return fmt.Sprintf("no protector named %q on %q", err.Name, err.Mountpoint)
+}
+
+// ErrMigrateSource indicates that the directory given with --migrate can't be
+// migrated into the directory being encrypted.
+type ErrMigrateSource struct {
+	SrcDir string
+	Reason string
+}
+
+func (err *ErrMigrateSource) Error() string {
+	return fmt.Sprintf("cannot migrate %q: %s", err.SrcDir, err.Reason)
+}
+
+// ErrMigrateFailed indicates that copying the files from the directory given
+// with --migrate failed, so the originals were left in place.
+type ErrMigrateFailed struct {
+	SrcDir string
+	DstDir string
+	Err    error
+}
+
+func (err *ErrMigrateFailed) Error() string {
+	return fmt.Sprintf("migrating %q into %q failed: %v", err.SrcDir, err.DstDir, err.Err)
+}
+
+// ErrRekeySource indicates that a directory can't be rekeyed.
+type ErrRekeySource struct {
+	Dir    string
+	Reason string
+}
+
+func (err *ErrRekeySource) Error() string {
+	return fmt.Sprintf("cannot rekey %q: %s", err.Dir, err.Reason)
+}
+
+// ErrRekeyFailed indicates that copying the files of a directory being rekeyed
+// failed, so the originals were left in place.
+type ErrRekeyFailed struct {
+	Dir        string
+	RekeyedDir string
+	Err        error
+}
+
+func (err *ErrRekeyFailed) Error() string {
+	return fmt.Sprintf("rekeying %q into %q failed: %v", err.Dir, err.RekeyedDir, err.Err)
+}
+
+// ErrAccessFailures indicates that some of the files in an unlocked directory
+// couldn't be read.
+type ErrAccessFailures struct {
+	DirPath string
+	Count   int
+}
+
+func (err *ErrAccessFailures) Error() string {
+	return fmt.Sprintf("%d file(s) or directories in %q could not be read", err.Count, err.DirPath)
+}
+
+// ErrProblemsFound indicates that "fscrypt doctor" or "fscrypt check" found
+// problems.
+type ErrProblemsFound struct {
+	Mountpoint string
+	Count      int
+}
+
+func (err *ErrProblemsFound) Error() string {
+	return fmt.Sprintf("found %s with fscrypt on %q", pluralize(err.Count, "problem"),
+		err.Mountpoint)
+}
+
 var loadHelpText = fmt.Sprintf("You may need to mount a linked filesystem. Run with %s for more information.", shortDisplay(verboseFlag))
 
 // getFullName returns the full name of the application or command being used.
@@ -175,6 +360,11 @@ func suggestEnablingEncryption(mnt *filesystem.Mount) string {
 // an error. If no suggestion is necessary or available, return empty string.
 func getErrorSuggestions(err error) string {
 	switch e := err.(type) {
+	case *ErrAccessFailures:
+		return fmt.Sprintf(`If %q was unlocked with the right key, these
+		files are probably corrupted; check the filesystem with fsck and
+		restore them from a backup. Run with %s for more information.`,
+			e.DirPath, shortDisplay(verboseFlag))
 	case *ErrDirFilesOpen:
 		return fmt.Sprintf(`Try killing any processes using files in the
 		directory, for example using:
@@ -184,36 +374,108 @@ func getErrorSuggestions(err error) string {
 		Then re-run:
 
 		> fscrypt lock %q`, e.DirPath, e.DirPath)
+	case *ErrAfterLockFailed:
+		if e.UnderlyingError != unix.EBUSY {
+			return ""
+		}
+		command := fmt.Sprintf("umount %q", e.Path)
+		if e.Action == afterRemountNoexec {
+			command = fmt.Sprintf("mount -o remount,bind,noexec %q", e.Path)
+		}
+		return fmt.Sprintf(`The mount is still in use. Stop the processes
+		using it, which can be found with:
+
+		> fuser -vm %q
+
+		Then run:
+
+		> %s`, e.Path, command)
+	case *ErrDirSharesPolicy:
+		return fmt.Sprintf(`Make sure nothing is using the other
+		directories, then use %s to lock all of them.`, shortDisplay(forceFlag))
 	case *ErrDirNotEmpty:
-		dir := filepath.Clean(e.DirPath)
-		newDir := dir + ".new"
 		return fmt.Sprintf(`Files cannot be encrypted in-place. Instead,
-		encrypt a new directory, copy the files into it, and securely
-		delete the original directory. For example:
+		encrypt a new directory, copy the files into it, securely
+		delete the original directory, and give the new one its name.
+		%s does all of this:
 
-		> mkdir %q
-		> fscrypt encrypt %q
-		> cp -a -T %q %q
-		> find %q -type f -print0 | xargs -0 shred -n1 --remove=unlink
-		> rm -rf %q
-		> mv %q %q
+		> fscrypt encrypt %s %q
 
 		Caution: due to the nature of modern storage devices and filesystems,
 		the original data may still be recoverable from disk. It's much better
-		to encrypt your files from the start.`, newDir, newDir, dir, newDir, dir, dir, newDir, dir)
+		to encrypt your files from the start.`, shortDisplay(migrateFlag),
+			"--"+migrateFlag.GetName(), filepath.Clean(e.DirPath))
 	case *ErrDirUnlockedByOtherUsers:
-		return fmt.Sprintf(`If you want to force the directory to be
+		return fmt.Sprintf(`Run "fscrypt status" on the directory as
+		root to see which users have unlocked it. If you want to force
+		the directory to be locked, use:
+
+		> sudo fscrypt lock --all-users %[1]q
+
+		or, to only remove the claim of one user:
+
+		> sudo fscrypt lock --user=USER %[1]q`, e.DirPath)
+	case *ErrPolicyUnlockedByOtherUsers:
+		return fmt.Sprintf(`If you want to force the policy to be
 		locked, use:
 
-		> sudo fscrypt lock --all-users %q`, e.DirPath)
+		> sudo fscrypt lock --all-users %s=%s`,
+			"--"+policyFlag.GetName(), policyFlag.Value)
+	case *ErrPoliciesNotFullyLocked:
+		return fmt.Sprintf(`Close the files which are still open on %[1]q,
+		e.g. as listed by "lsof %[1]s", and run this command again. If
+		other users have unlocked some of the policies, use %[2]s as
+		root to lock them too.`, e.Mountpoint, shortDisplay(allUsersLockFlag))
+	case *ErrMigrateFailed:
+		return fmt.Sprintf(`Nothing was deleted from %q. %q is still
+		encrypted and may contain some of the copied files; remove them
+		before trying again.`, e.SrcDir, e.DstDir)
+	case *ErrRekeyFailed:
+		return fmt.Sprintf(`Nothing was deleted from %q. Run this command
+		again to resume rekeying it; the complete copies in %q are
+		kept.`, e.Dir, e.RekeyedDir)
+	case *ErrNoProtectorWithName:
+		return fmt.Sprintf(`Run "fscrypt status %s" to list the protectors
+		on this filesystem.`, e.Mountpoint)
 	case *actions.ErrBadConfigFile:
 		return `Either fix this file manually, or run "sudo fscrypt setup" to recreate it.`
 	case *actions.ErrLoginProtectorName:
 		return fmt.Sprintf("To fix this, don't specify the %s option.", shortDisplay(nameFlag))
 	case *actions.ErrMissingProtectorName:
 		return fmt.Sprintf("Use %s to specify a protector name.", shortDisplay(nameFlag))
+	case *actions.ErrFixedProtectors:
+		return `To use other protectors, encrypt a new directory and
+		move the files into it.`
+	case *actions.ErrNeedsMoreProtectors:
+		return `Use "fscrypt unlock", which prompts for each of the
+		protectors needed.`
+	case *actions.ErrProtectorAccessDenied:
+		return `Only the owner of this protector, root, and the users and
+		groups it allows can use it. Run "fscrypt protector list" on its
+		filesystem to see who they are.`
+	case *actions.ErrMetadataTampered:
+		return fmt.Sprintf(`Don't use this %s until you know how it was
+		changed. If you have a backup of the metadata made with "fscrypt
+		metadata dump", remove the %s and restore it with "fscrypt
+		metadata restore %s FILE".`, e.Kind, e.Kind, e.Mount.Path)
 	case *actions.ErrNoConfigFile:
 		return `Run "sudo fscrypt setup" to create this file.`
+	case *actions.ErrUnknownProfile:
+		if len(e.Available) == 0 {
+			return fmt.Sprintf(`No profiles are defined. They can be
+				added to the "profiles" section of %q.`,
+				actions.ConfigFileLocation)
+		}
+		return fmt.Sprintf("The available profiles are: %s.",
+			strings.Join(e.Available, ", "))
+	case *actions.ErrTangUnreachable:
+		return fmt.Sprintf(`A tang protector can only be created or used
+		while its Tang server is reachable, e.g. on the corporate
+		network. Until then, directories can be unlocked with another
+		protector using %s. To always have an offline fallback, add a
+		passphrase protector to each directory while the server is
+		reachable, with "fscrypt metadata add-protector-to-policy".`,
+			shortDisplay(unlockWithFlag))
 	case *filesystem.ErrEncryptionNotEnabled:
 		return suggestEnablingEncryption(e.Mount)
 	case *filesystem.ErrEncryptionNotSupported:
@@ -236,9 +498,36 @@ func getErrorSuggestions(err error) string {
 		return `For how to allow users to create fscrypt metadata on a
 			filesystem, refer to
 			https://github.com/google/fscrypt#setting-up-fscrypt-on-a-filesystem`
+	case *filesystem.ErrReservedDirectory:
+		return fmt.Sprintf(`The mountpoint and the fscrypt metadata
+		directory can't be encrypted, since fscrypt needs to read the
+		metadata before anything is unlocked. Instead, create a new
+		subdirectory of %q and encrypt that, for example:
+
+		> mkdir %q
+		> fscrypt encrypt %q`, e.Mount.Path,
+			filepath.Join(e.Mount.Path, "private"),
+			filepath.Join(e.Mount.Path, "private"))
+	case *filesystem.ErrMetadataLocked:
+		return `Another fscrypt command, or the fscrypt PAM module, is
+			changing the metadata on this filesystem. Try again once
+			it has finished.`
 	case *filesystem.ErrNotSetup:
 		return fmt.Sprintf(`Run "sudo fscrypt setup %s" to use fscrypt
 		        on this filesystem.`, e.Mount.Path)
+	case *filesystem.ErrMetadataTooNew:
+		return `This metadata was written by a newer version of fscrypt.
+			Upgrade fscrypt to use it.`
+	case *filesystem.ErrReadOnlyFilesystem:
+		return fmt.Sprintf(`Directories on a read-only filesystem can
+			still be unlocked and locked, but changing the fscrypt
+			metadata requires remounting it read-write, e.g. with
+			"sudo mount -o remount,rw %s".`, e.Mount.Path)
+	case *filesystem.ErrMetadataNotWritable:
+		return fmt.Sprintf(`Check that the filesystem isn't mounted
+			read-only. Unless the filesystem was set up with %s,
+			only root can change its fscrypt metadata.`,
+			shortDisplay(allUsersSetupFlag))
 	case *keyring.ErrAccessUserKeyring:
 		return fmt.Sprintf(`You can only use %s to access the user
 			keyring of another user if you are running as root.`,
@@ -247,14 +536,59 @@ func getErrorSuggestions(err error) string {
 		return `This is usually the result of a bad PAM configuration.
 			Either correct the problem in your PAM stack, enable
 			pam_keyinit.so, or run "keyctl link @u @s".`
+	case *keyring.ErrKeyQuotaExceeded:
+		sysctls := "kernel.keys.maxkeys and kernel.keys.maxbytes"
+		if e.UID == 0 {
+			sysctls = "kernel.keys.root_maxkeys and kernel.keys.root_maxbytes"
+		}
+		return fmt.Sprintf(`The kernel limits how many keys each user can
+			have, and their total size. Either lock encrypted
+			directories which aren't in use, or raise the limits by
+			setting the sysctls %s (as root, e.g. with "sysctl -w").
+			The usage of each user is shown in /proc/key-users.`, sysctls)
+	case *metadata.ErrDirectoryNotOwned:
+		return fmt.Sprintf(`The kernel only lets a directory's owner
+		enable encryption on it, so being a member of the directory's
+		group isn't enough, even if the group can write to it. Either
+		ask the owner to run this command, or run it as root with %s to
+		make the encrypted directory yours. For a directory shared by a
+		group, consider encrypting it with a protector whose passphrase
+		or key the group's members share.`, shortDisplay(ownerFlag))
+	case *metadata.ErrBadEncryptionOptions:
+		switch {
+		case e.Options.IvInoLblk_64:
+			return `The IV_INO_LBLK_64 flag requires kernel v5.5 or
+			later, and a filesystem with stable inode numbers whose
+			inode numbers and file block numbers fit in 32 bits. On
+			ext4, enable the stable_inodes feature with "tune2fs -O
+			stable_inodes" first.`
+		case e.Options.IvInoLblk_32:
+			return `The IV_INO_LBLK_32 flag requires kernel v5.9 or
+			later, and a filesystem with stable 32-bit inode
+			numbers. On ext4, enable the stable_inodes feature with
+			"tune2fs -O stable_inodes" first.`
+		case e.Options.UsesDirectKey():
+			return `Adiantum and the DIRECT_KEY flag require kernel v5.0
+			or later, built with CONFIG_CRYPTO_ADIANTUM.`
+		}
+		return ""
 	}
 	switch errors.Cause(err) {
+	case crypto.ErrBase64Key:
+		return fmt.Sprintf(`With %s, stdin must contain exactly %d
+			bytes encoded with standard base64 (with padding), e.g.
+			as output by "base64 -w0".`,
+			shortDisplay(fromStdinKeyBase64Flag), metadata.InternalKeyLen)
 	case crypto.ErrMlockUlimit:
 		return `Too much memory was requested to be locked in RAM. The
 			current limit for this user can be checked with "ulimit
 			-l". The limit can be modified by either changing the
 			"memlock" item in /etc/security/limits.conf or by
 			changing the "LimitMEMLOCK" value in systemd.`
+	case metadata.ErrDirectKeyUnsupported:
+		return fmt.Sprintf(`Either don't use %s, or set both "contents"
+		and "filenames" to "Adiantum" in the "options" section of
+		%s.`, shortDisplay(directKeyFlag), actions.ConfigFileLocation)
 	case keyring.ErrV2PoliciesUnsupported:
 		return fmt.Sprintf(`v2 encryption policies are only supported by kernel
 		version 5.4 and later. Either use a newer kernel, or change
@@ -262,6 +596,123 @@ func getErrorSuggestions(err error) string {
 	case ErrNoDestructiveOps:
 		return fmt.Sprintf("If desired, use %s to automatically run destructive operations.",
 			shortDisplay(forceFlag))
+	case ErrDirNotUnlocked:
+		return `Run "fscrypt unlock" on the directory first.`
+	case ErrNotLockedForSuspend:
+		return `Close the files which are still open on the filesystems
+		listed above, and run "fscrypt lock --for-suspend" again.`
+	case ErrNoFIDO2Tools:
+		return `Security keys are used with the fido2-token, fido2-cred,
+			and fido2-assert tools, which are usually in a package
+			called "fido2-tools" or "libfido2".`
+	case ErrWrongSecurityKey:
+		return `Insert the security key which the protector was
+			created with, and remove any other security keys.`
+	case ErrNoTPM2Tools:
+		return `TPMs are used with the tpm2_createprimary, tpm2_create,
+			tpm2_load, and tpm2_unseal programs, which are usually in
+			a package called "tpm2-tools".`
+	case ErrTPM2PCRMismatch:
+		return `The machine's firmware, boot loader, or other measured
+			boot state has changed since the protector was created.
+			Unlock the directory with another protector, then
+			replace this protector with a new one bound to the
+			current state.`
+	case ErrWrongTPM:
+		return `A tpm2 protector can only be used on the machine
+			whose TPM created it. If the TPM was cleared, the
+			protector can't be used any more.`
+	case ErrNoPKCS11Tool:
+		return `PKCS#11 tokens are used with the pkcs11-tool program,
+			which is usually in a package called "opensc".`
+	case ErrNoPKCS11Key, ErrPKCS11TokenAbsent:
+		return `Check that the token is inserted, and that
+			"pkcs11_module", "pkcs11_slot", and "pkcs11_key_id" in
+			the config file are right. "pkcs11-tool --module MODULE
+			--list-objects" lists the keys on the token.`
+	case ErrPKCS11PINLocked:
+		return `Too many incorrect PINs were entered. Unlock the PIN
+			with the token's PUK or administration tool.`
+	case actions.ErrNoPKCS11Module:
+		return fmt.Sprintf(`Set "pkcs11_module" in %s to the path of
+			the PKCS#11 module for the token, e.g.
+			"/usr/lib/x86_64-linux-gnu/opensc-pkcs11.so".`,
+			actions.ConfigFileLocation)
+	case ErrNoKMSTool:
+		return `Keys in AWS KMS, GCP Cloud KMS, and Azure Key Vault are
+			used with the aws, gcloud, and az programs respectively,
+			which must be installed and able to find this machine's
+			credentials.`
+	case ErrUnknownKMSKey:
+		return `"kms_key" in the config file must be an AWS KMS key ARN,
+			a GCP Cloud KMS key resource name, or an Azure Key Vault
+			key identifier.`
+	case ErrKMSAccessDenied:
+		return fmt.Sprintf(`The key may have been disabled, deleted, or
+			revoked, or this machine's credentials may not be
+			allowed to use it. Run with %s to see the cloud
+			provider's error.`, shortDisplay(verboseFlag))
+	case actions.ErrNoKMSKey:
+		return fmt.Sprintf(`Set "kms_key" in %s to the name of the cloud
+			KMS key which new kms protectors should use.`,
+			actions.ConfigFileLocation)
+	case actions.ErrNotExportedProtector:
+		return `To restore a backup made with "fscrypt metadata dump",
+			use "fscrypt metadata restore" instead.`
+	case actions.ErrNoTangURL:
+		return fmt.Sprintf(`Set "tang_url" in %s to the URL of the Tang
+			server which new tang protectors should use.`,
+			actions.ConfigFileLocation)
+	case actions.ErrTangUntrusted:
+		return fmt.Sprintf(`Set "tang_thumbprint" in %s to the SHA-256
+			thumbprint of the Tang server's signing key, as shown by
+			"tang-show-keys" on the server, or answer yes when asked
+			whether to trust its keys.`, actions.ConfigFileLocation)
+	case ErrNoYubiKeyTool:
+		return `YubiKeys are used with the ykchalresp program, which is
+			usually in a package called "yubikey-personalization".`
+	case ErrYubiKeyAbsent:
+		return `Insert the YubiKey which the protector was created with.
+			If it is inserted, check that this user may access it,
+			e.g. with "ykchalresp -2 test".`
+	case ErrYubiKeyTimeout:
+		return `If the YubiKey blinks, touch it. Otherwise, the slot may
+			not be configured for HMAC-SHA1 challenge-response; slot
+			2 can be configured with "ykman otp chalresp --generate
+			2".`
+	case ErrNoGPG:
+		return `GPG keys are used with the gpg program, which is usually
+			in a package called "gnupg".`
+	case ErrGPGNoPublicKey:
+		return `Import the public key given by "gpg_recipient" in the
+			config file with "gpg --import", and make sure it is
+			valid, not expired, and trusted, e.g. with "gpg --edit-key
+			RECIPIENT trust".`
+	case ErrGPGNoSecretKey:
+		return fmt.Sprintf(`Insert the smartcard holding the GPG key
+			which the protector's key is encrypted to, or import its
+			secret key. Run with %s to see gpg's error.`,
+			shortDisplay(verboseFlag))
+	case actions.ErrNoGPGRecipient:
+		return fmt.Sprintf(`Set "gpg_recipient" in %s to the key ID,
+			fingerprint, or user ID of the GPG key which new gpg
+			protectors should be encrypted to.`,
+			actions.ConfigFileLocation)
+	case actions.ErrNoSSHAgent:
+		return `Start ssh-agent and add a key with ssh-add, or log in with
+			agent forwarding (ssh -A). Note that sudo doesn't keep
+			SSH_AUTH_SOCK by default.`
+	case actions.ErrNoSSHKey:
+		return fmt.Sprintf(`Add an Ed25519 or RSA key to the ssh-agent
+			with ssh-add, and check that "ssh_key" in %s is empty
+			or is the fingerprint or comment of the key, as shown
+			by "ssh-add -l". ECDSA and security keys can't be used,
+			as their signatures differ each time.`,
+			actions.ConfigFileLocation)
+	case actions.ErrSSHAgentLacksKey:
+		return `Add the SSH key which the protector was created with to
+			the ssh-agent with ssh-add, or unlock with another
+			protector.`
 	case ErrSpecifyProtector:
 		return fmt.Sprintf("Use %s to specify a protector.", shortDisplay(protectorFlag))
 	case ErrSpecifyKeyFile:
@@ -271,6 +722,10 @@ func getErrorSuggestions(err error) string {
 			properly clear the inode cache, or it should be run with
 			%s=false (this may leave encrypted files and directories
 			in an accessible state).`, shortDisplay(dropCachesFlag))
+	case ErrAfterLockPerm:
+		return fmt.Sprintf(`Either run this command as root, or leave out
+			%s and unmount or remount the filesystem separately.`,
+			shortDisplay(afterFlag))
 	case ErrFsKeyringPerm:
 		return `Either this command should be run as root, or you should
 			set '"use_fs_keyring_for_v1_policies": false' in
@@ -297,15 +752,19 @@ func getErrorSuggestions(err error) string {
 // returned error prepends an error tag and the name of the relevant command,
 // and it will make fscrypt return a non-zero exit value.
 func newExitError(c *cli.Context, err error) error {
+	if jsonFlag.Value {
+		return cli.NewExitError(jsonErrorMessage(getFullName(c), err.Error(), err),
+			getExitCode(err))
+	}
 	// Prepend the error tag and full name, and append suggestions (if any)
-	prefix := "[ERROR] " + getFullName(c) + ": "
+	prefix := errorTag(err) + " " + getFullName(c) + ": "
 	message := prefix + wrapText(err.Error(), utf8.RuneCountInString(prefix))
 
 	if suggestion := getErrorSuggestions(err); suggestion != "" {
 		message += "\n\n" + wrapText(suggestion, 0)
 	}
 
-	return cli.NewExitError(message, failureExitCode)
+	return cli.NewExitError(message, getExitCode(err))
 }
 
 // usageError implements cli.ExitCoder to print the usage and return a non-zero
@@ -316,13 +775,24 @@ type usageError struct {
 }
 
 func (u *usageError) Error() string {
-	return fmt.Sprintf("%s: %s", getFullName(u.c), u.message)
+	if jsonFlag.Value {
+		return jsonErrorMessage(getFullName(u.c), u.message, u)
+	}
+	message := fmt.Sprintf("%s: %s", getFullName(u.c), u.message)
+	if errorIDsEnabled {
+		return errorTag(u) + " " + message
+	}
+	return message
 }
 
 // We get the help to print after the error by having it run right before the
 // application exits. This is very nasty, but there isn't a better way to do it
 // with the constraints of urfave/cli.
 func (u *usageError) ExitCode() int {
+	// The help would corrupt the JSON output.
+	if jsonFlag.Value {
+		return usageExitCode
+	}
 	// Redirect help output to a buffer, so we can customize it.
 	buf := new(bytes.Buffer)
 	oldWriter := u.c.App.Writer
@@ -339,7 +809,7 @@ func (u *usageError) ExitCode() int {
 	buf.ReadBytes('\n')
 	buf.WriteTo(oldWriter)
 	u.c.App.Writer = oldWriter
-	return failureExitCode
+	return usageExitCode
 }
 
 // expectedArgsErr creates a usage error for the incorrect number of arguments
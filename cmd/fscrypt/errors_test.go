@@ -0,0 +1,99 @@
+/*
+ * errors_test.go - tests for mapping errors to identifiers and exit codes
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+
+	"github.com/google/fscrypt/actions"
+	"github.com/google/fscrypt/crypto"
+	"github.com/google/fscrypt/filesystem"
+	"github.com/google/fscrypt/keyring"
+	"github.com/google/fscrypt/metadata"
+)
+
+func TestGetExitCode(t *testing.T) {
+	tests := []struct {
+		err      error
+		expected int
+	}{
+		{errors.New("something else"), failureExitCode},
+		{ErrWrongKey, wrongKeyExitCode},
+		{errors.Wrap(crypto.ErrBadAuth, "unwrapping"), wrongKeyExitCode},
+		{&filesystem.ErrEncryptionNotSupported{}, unsupportedExitCode},
+		{&filesystem.ErrNotSetup{}, notSetupExitCode},
+		{ErrMustBeRoot, permissionExitCode},
+		{&os.PathError{Op: "open", Path: "/x", Err: unix.EACCES}, permissionExitCode},
+		{&ErrDirFilesOpen{}, busyExitCode},
+		{keyring.ErrKeyFilesOpen, busyExitCode},
+		{&metadata.ErrNotEncrypted{}, notEncryptedExitCode},
+		{&metadata.ErrAlreadyEncrypted{}, alreadyDoneExitCode},
+		{ErrCanceled, canceledExitCode},
+		{&ErrProblemsFound{}, problemsExitCode},
+	}
+	for i, test := range tests {
+		if code := getExitCode(test.err); code != test.expected {
+			t.Errorf("test %d: exit code for %T is %d, expected %d", i, test.err, code, test.expected)
+		}
+	}
+}
+
+func TestGetErrorID(t *testing.T) {
+	tests := []struct {
+		err      error
+		expected string
+	}{
+		{errors.New("something else"), errIDFailed},
+		{&usageError{}, errIDUsage},
+		{errors.Wrap(actions.ErrIncorrectPIN, "unlocking"), errIDWrongPIN},
+		{&os.PathError{Op: "open", Path: "/x", Err: unix.ENOENT}, errIDNotFound},
+		{&ErrAccessFailures{}, errIDAccessFailures},
+		{ErrNoDestructiveOps, errIDNeedsConfirmation},
+	}
+	for i, test := range tests {
+		if id := getErrorID(test.err); id != test.expected {
+			t.Errorf("test %d: identifier for %T is %s, expected %s", i, test.err, id, test.expected)
+		}
+	}
+}
+
+// Tests that errors in JSON output mode are printed as a single JSON object.
+func TestJSONErrorMessage(t *testing.T) {
+	message := jsonErrorMessage("fscrypt lock", "some\n\tfiles are open", ErrDirAlreadyLocked)
+	var output struct {
+		Error errorJSON `json:"error"`
+	}
+	if err := json.Unmarshal([]byte(message), &output); err != nil {
+		t.Fatal(err)
+	}
+	expected := errorJSON{
+		ID:       errIDAlreadyLocked,
+		ExitCode: alreadyDoneExitCode,
+		Command:  "fscrypt lock",
+		Message:  "some files are open",
+	}
+	if output.Error != expected {
+		t.Errorf("got %+v, expected %+v", output.Error, expected)
+	}
+}
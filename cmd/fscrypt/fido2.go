@@ -0,0 +1,190 @@
+/*
+ * fido2.go - Getting the wrapping keys of fido2 protectors from FIDO2 security
+ * keys (e.g. YubiKeys) with the hmac-secret extension.
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/google/fscrypt/actions"
+	"github.com/google/fscrypt/crypto"
+	"github.com/google/fscrypt/metadata"
+	"github.com/google/fscrypt/util"
+)
+
+// The security keys are accessed with libfido2's command line tools, so
+// fscrypt doesn't depend on libfido2 itself.
+var (
+	fido2TokenCommand  = "fido2-token"
+	fido2CredCommand   = "fido2-cred"
+	fido2AssertCommand = "fido2-assert"
+)
+
+// The relying party of the credentials made for fscrypt
+const fido2RelyingParty = "fscrypt"
+
+// Errors reported by libfido2 when the user didn't touch the security key in
+// time, or declined the request
+var fido2CanceledErrors = []string{"FIDO_ERR_ACTION_TIMEOUT",
+	"FIDO_ERR_USER_ACTION_TIMEOUT", "FIDO_ERR_OPERATION_DENIED",
+	"FIDO_ERR_KEEPALIVE_CANCEL"}
+
+// fido2Tools is the actions.FIDO2Authenticator used by the fscrypt command. It
+// uses the first security key found. If there is none, or the user doesn't
+// touch it, ErrCanceled is returned.
+type fido2Tools struct{}
+
+func (fido2Tools) MakeCredential(name string) ([]byte, error) {
+	device, err := findFIDO2Device()
+	if err != nil {
+		return nil, err
+	}
+	userID, err := crypto.NewRandomBuffer(16)
+	if err != nil {
+		return nil, err
+	}
+	input, err := fido2Input(fido2RelyingParty, name,
+		base64.StdEncoding.EncodeToString(userID))
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("Touch your security key to create a credential for protector %q.\n", name)
+	output, err := runFIDO2Tool(fido2CredCommand, input, "-M", "-h", device)
+	if err != nil {
+		return nil, err
+	}
+	// The output is the client data hash, the relying party, the
+	// credential format, the authenticator data, and the credential ID,
+	// followed by the attestation.
+	return fido2OutputBlob(output, 4)
+}
+
+func (fido2Tools) HMACSecret(info actions.ProtectorInfo, retry bool) (*crypto.Key, error) {
+	// The security key holding the credential always gives the same
+	// output, so a wrong output can't be fixed by asking it again.
+	if retry {
+		return nil, ErrWrongKey
+	}
+	device, err := findFIDO2Device()
+	if err != nil {
+		return nil, err
+	}
+	input, err := fido2Input(fido2RelyingParty,
+		base64.StdEncoding.EncodeToString(info.FIDO2CredentialID()),
+		base64.StdEncoding.EncodeToString(info.FIDO2Salt()))
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("Touch your security key to use protector %q.\n", info.Name())
+	output, err := runFIDO2Tool(fido2AssertCommand, input, "-G", "-h", device)
+	if err != nil {
+		return nil, err
+	}
+	// The output is the client data hash, the relying party, the
+	// authenticator data, the signature, and the hmac-secret output.
+	secret, err := fido2OutputBlob(output, 4)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for i := range secret {
+			secret[i] = 0
+		}
+	}()
+	return crypto.NewFixedLengthKeyFromReader(bytes.NewReader(secret), metadata.InternalKeyLen)
+}
+
+// findFIDO2Device returns the path of the first security key, as listed by
+// "fido2-token -L", e.g. "/dev/hidraw0: vendor=0x1050, product=0x0407 (...)".
+func findFIDO2Device() (string, error) {
+	if _, err := exec.LookPath(fido2TokenCommand); err != nil {
+		util.Debug(err)
+		return "", ErrNoFIDO2Tools
+	}
+	output, err := runFIDO2Tool(fido2TokenCommand, "", "-L")
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(output, "\n") {
+		if i := strings.Index(line, ": "); i > 0 {
+			util.Debugf("using security key %s", line)
+			return line[:i], nil
+		}
+	}
+	fmt.Println("No FIDO2 security key was found.")
+	return "", ErrCanceled
+}
+
+// fido2Input returns the input of fido2-cred or fido2-assert: a random client
+// data hash (which fscrypt doesn't need), followed by the lines.
+func fido2Input(lines ...string) (string, error) {
+	clientDataHash, err := crypto.NewRandomBuffer(32)
+	if err != nil {
+		return "", err
+	}
+	lines = append([]string{base64.StdEncoding.EncodeToString(clientDataHash)}, lines...)
+	return strings.Join(lines, "\n") + "\n", nil
+}
+
+// runFIDO2Tool runs one of libfido2's tools with input on stdin, and returns its
+// output.
+func runFIDO2Tool(command, input string, args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(command, args...)
+	cmd.Stdin = strings.NewReader(input)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	util.Debugf("%s %s: %v", command, strings.Join(args, " "), err)
+	if err == nil {
+		return stdout.String(), nil
+	}
+	message := strings.TrimSpace(stderr.String())
+	for _, canceled := range fido2CanceledErrors {
+		if strings.Contains(message, canceled) {
+			util.Debug(message)
+			return "", ErrCanceled
+		}
+	}
+	if strings.Contains(message, "FIDO_ERR_NO_CREDENTIALS") {
+		return "", ErrWrongSecurityKey
+	}
+	if message == "" {
+		return "", errors.Wrap(err, command)
+	}
+	return "", errors.Errorf("%s: %s", command, message)
+}
+
+// fido2OutputBlob decodes the base64 data on the line of the output with the
+// given index.
+func fido2OutputBlob(output string, index int) ([]byte, error) {
+	lines := strings.Split(strings.TrimSuffix(output, "\n"), "\n")
+	if index >= len(lines) {
+		return nil, errors.Errorf("unexpected output from security key tool: %d lines",
+			len(lines))
+	}
+	blob, err := base64.StdEncoding.DecodeString(lines[index])
+	return blob, errors.Wrap(err, "unexpected output from security key tool")
+}
@@ -0,0 +1,93 @@
+/*
+ * fido2_test.go - Tests for using libfido2's tools to talk to security keys
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/fscrypt/actions"
+)
+
+var testHMACSecret = bytes.Repeat([]byte{7}, 32)
+
+// fakeFIDO2Tools replaces libfido2's tools with shell scripts running the
+// given commands.
+func fakeFIDO2Tools(t *testing.T, token, assert string) {
+	dir := t.TempDir()
+	write := func(name, script string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte("#!/bin/sh\n"+script+"\n"), 0700); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	oldToken, oldAssert := fido2TokenCommand, fido2AssertCommand
+	fido2TokenCommand = write("fido2-token", token)
+	fido2AssertCommand = write("fido2-assert", assert)
+	t.Cleanup(func() { fido2TokenCommand, fido2AssertCommand = oldToken, oldAssert })
+}
+
+const fakeDeviceList = "echo '/dev/hidraw3: vendor=0x1050, product=0x0407 (Yubico YubiKey)'"
+
+func TestFIDO2HMACSecret(t *testing.T) {
+	fakeFIDO2Tools(t, fakeDeviceList, `[ "$3" = /dev/hidraw3 ] || exit 1
+cat > /dev/null
+echo cdh; echo fscrypt; echo authdata; echo sig; echo `+
+		base64.StdEncoding.EncodeToString(testHMACSecret))
+
+	key, err := fido2Tools{}.HMACSecret(actions.ProtectorInfo{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer key.Wipe()
+	if !bytes.Equal(key.Data(), testHMACSecret) {
+		t.Errorf("got hmac-secret %x, expected %x", key.Data(), testHMACSecret)
+	}
+}
+
+// Tests that a missing or declining security key cancels the operation, and
+// that a security key without the credential is reported.
+func TestFIDO2Errors(t *testing.T) {
+	tests := []struct {
+		name          string
+		token, assert string
+		expected      error
+	}{
+		{"no security key", "true", "exit 1", ErrCanceled},
+		{"timeout", fakeDeviceList,
+			"echo 'fido2-assert: fido_dev_get_assert: FIDO_ERR_ACTION_TIMEOUT' >&2; exit 1",
+			ErrCanceled},
+		{"no credential", fakeDeviceList,
+			"echo 'fido2-assert: fido_dev_get_assert: FIDO_ERR_NO_CREDENTIALS' >&2; exit 1",
+			ErrWrongSecurityKey},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fakeFIDO2Tools(t, test.token, test.assert)
+			_, err := fido2Tools{}.HMACSecret(actions.ProtectorInfo{}, false)
+			if err != test.expected {
+				t.Errorf("got error %v, expected %v", err, test.expected)
+			}
+		})
+	}
+}
@@ -24,23 +24,26 @@ package main
 import (
 	"flag"
 	"fmt"
-	"log"
 	"os/user"
 	"regexp"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/pkg/errors"
 	"github.com/urfave/cli"
 
 	"github.com/google/fscrypt/actions"
+	"github.com/google/fscrypt/keyring"
+	"github.com/google/fscrypt/metadata"
 	"github.com/google/fscrypt/util"
 )
 
-// We define the types boolFlag, durationFlag, and stringFlag here instead of
-// using those present in urfave/cli because we need them to conform to the
-// prettyFlag interface (in format.go). The Getters just get the corresponding
-// variables, String() just uses longDisplay, and Apply just sets the
-// corresponding type of flag.
+// We define the types boolFlag, durationFlag, intFlag, and stringFlag here
+// instead of using those present in urfave/cli because we need them to conform
+// to the prettyFlag interface (in format.go). The Getters just get the
+// corresponding variables, String() just uses longDisplay, and Apply just sets
+// the corresponding type of flag.
 type boolFlag struct {
 	Name    string
 	Usage   string
@@ -86,6 +89,29 @@ func (d *durationFlag) Apply(set *flag.FlagSet) {
 	set.DurationVar(&d.Value, d.Name, d.Default, d.Usage)
 }
 
+type intFlag struct {
+	Name    string
+	ArgName string
+	Usage   string
+	Default int64
+	Value   int64
+}
+
+func (i *intFlag) GetName() string    { return i.Name }
+func (i *intFlag) GetArgName() string { return i.ArgName }
+func (i *intFlag) GetUsage() string   { return i.Usage }
+
+func (i *intFlag) String() string {
+	if i.Default == 0 {
+		return longDisplay(i)
+	}
+	return longDisplay(i, strconv.FormatInt(i.Default, 10))
+}
+
+func (i *intFlag) Apply(set *flag.FlagSet) {
+	set.Int64Var(&i.Value, i.Name, i.Default, i.Usage)
+}
+
 type stringFlag struct {
 	Name    string
 	ArgName string
@@ -117,9 +143,22 @@ var (
 		forceFlag, skipUnlockFlag, timeTargetFlag,
 		sourceFlag, nameFlag, keyFileFlag, protectorFlag,
 		unlockWithFlag, policyFlag, allUsersLockFlag, allUsersSetupFlag,
-		noRecoveryFlag}
+		noRecoveryFlag, continueOnErrorFlag, allFilesystemsFlag,
+		andRunFlag, ownerFlag, idempotentFlag, failOnHookErrorFlag,
+		dryRunFlag, filterFlag, dataUnitSizeFlag, convertToFlag,
+		promptTimeoutFlag, jsonFlag, migrateFlag, sampleFlag,
+		metadataStoreFlag, logLevelFlag, manifestFlag, keyringRetriesFlag,
+		thresholdFlag, skipKernelCheckFlag, labelFlag, orphanedKeysFlag,
+		removeFlag, directKeyFlag, secretServiceFlag,
+		fromStdinKeyBase64Flag, profileFlag, afterFlag, tpm2PCRsFlag,
+		kdfFlag, rehashFlag,
+		contentsFlag, filenamesFlag, ivInoLblkFlag, allUsersKeyFlag,
+		allPoliciesFlag, idleTimeoutFlag, forSuspendFlag, afterSuspendFlag, repairFlag,
+		metadataDirFlag, restrictAccessFlag, allowUsersFlag, allowGroupsFlag,
+		mineFlag, recursiveFlag, findFlag}
 	// universalFlags contains flags that should be on every command
-	universalFlags = []cli.Flag{verboseFlag, quietFlag, helpFlag}
+	universalFlags = []cli.Flag{verboseFlag, logLevelFlag, quietFlag,
+		promptTimeoutFlag, keyringRetriesFlag, helpFlag}
 )
 
 // Bool flags: used to switch some behavior on or off
@@ -133,8 +172,9 @@ var (
 		Usage: `Prints version information.`,
 	}
 	verboseFlag = &boolFlag{
-		Name:  "verbose",
-		Usage: `Prints additional debug messages to standard output.`,
+		Name: "verbose",
+		Usage: `Prints additional debug messages to standard error.
+			The same as --log-level=debug.`,
 	}
 	quietFlag = &boolFlag{
 		Name: "quiet",
@@ -155,6 +195,14 @@ var (
 			"fscrypt unlock" will need to be run in order to use the
 			directory.`,
 	}
+	skipKernelCheckFlag = &boolFlag{
+		Name: "skip-kernel-check",
+		Usage: `Don't check whether the kernel supports encryption on
+			the filesystem before setting up the directory, and rely
+			on the kernel rejecting the encryption policy instead.
+			Only for testing experimental kernels: the directory may
+			be impossible to decrypt on other kernels.`,
+	}
 	dropCachesFlag = &boolFlag{
 		Name: "drop-caches",
 		Usage: `After removing the key(s) from the keyring, drop the
@@ -173,6 +221,28 @@ var (
 			different from the one you're locking it as. This flag
 			is only implemented for v2 encryption policies.`,
 	}
+	allPoliciesFlag = &boolFlag{
+		Name: "all-policies",
+		Usage: `Lock all the unlocked policies on the filesystem given
+			instead of a directory.`,
+	}
+	forSuspendFlag = &boolFlag{
+		Name: "for-suspend",
+		Usage: `Lock the policies set with "suspend_lock_policies" in the
+			config file (or all unlocked policies) for all users,
+			before the system suspends. Requires root privileges.`,
+	}
+	afterSuspendFlag = &boolFlag{
+		Name: "after-suspend",
+		Usage: `Offer to unlock each of the policies which were locked
+			with "fscrypt lock --for-suspend", instead of a
+			directory.`,
+	}
+	allUsersKeyFlag = &boolFlag{
+		Name: "all-users",
+		Usage: `Remove the key no matter which user(s) have added it.
+			Requires root privileges.`,
+	}
 	allUsersSetupFlag = &boolFlag{
 		Name: "all-users",
 		Usage: `When setting up a filesystem for fscrypt, allow users
@@ -182,10 +252,107 @@ var (
 			users could use to fill up the entire filesystem. Hence,
 			this option may not be appropriate for some systems.`,
 	}
+	idempotentFlag = &boolFlag{
+		Name: "idempotent",
+		Usage: `If the config file or filesystem is already set up,
+			leave it unchanged and exit successfully instead of
+			prompting or failing.`,
+	}
+	failOnHookErrorFlag = &boolFlag{
+		Name: "fail-on-hook-error",
+		Usage: `Exit with an error if the post_unlock_hook or
+			post_lock_hook command from the config file fails.
+			Otherwise, only a warning is printed.`,
+	}
+	dryRunFlag = &boolFlag{
+		Name: "dry-run",
+		Usage: `Only print the changes that would be made, without
+			making them.`,
+	}
+	repairFlag = &boolFlag{
+		Name: "repair",
+		Usage: `Repair the problems which can be fixed safely, such as
+			protector links which can be pointed at the right
+			filesystem.`,
+	}
+	restrictAccessFlag = &boolFlag{
+		Name: "restrict-access",
+		Usage: `Only allow the owner of a new protector (the user whose
+			keys are being managed) to use it, along with root and
+			any users and groups given with --allow-users and
+			--allow-groups. Other users then can't unlock it, even
+			if they can read its metadata.`,
+	}
+	mineFlag = &boolFlag{
+		Name:  "mine",
+		Usage: `Only list the protectors which belong to the user.`,
+	}
+	jsonFlag = &boolFlag{
+		Name: "json",
+		Usage: `Print the output as JSON, for use by other programs.
+			If the command fails, the error is also printed as JSON
+			(to stderr).`,
+	}
+	recursiveFlag = &boolFlag{
+		Name: "recursive",
+		Usage: `Scan the whole directory tree and list every directory
+			whose encryption policy differs from that of its parent.`,
+	}
+	findFlag = &boolFlag{
+		Name: "find",
+		Usage: `Search the whole filesystem for encrypted directories
+			and list the policies and protectors they use.`,
+	}
 	noRecoveryFlag = &boolFlag{
 		Name:  "no-recovery",
 		Usage: `Don't generate a recovery passphrase.`,
 	}
+	orphanedKeysFlag = &boolFlag{
+		Name: "orphaned-keys",
+		Usage: `List the fscrypt keys in the user keyring which don't
+			belong to any policy on a filesystem set up for use
+			with fscrypt.`,
+	}
+	removeFlag = &boolFlag{
+		Name:  "remove",
+		Usage: `Remove the keys which were listed.`,
+	}
+	allFilesystemsFlag = &boolFlag{
+		Name: "all",
+		Usage: `Operate on every filesystem which is set up for use
+			with fscrypt.`,
+	}
+	andRunFlag = &boolFlag{
+		Name: "and-run",
+		Usage: `After unlocking the directory, run the command given by
+			the remaining arguments, then lock the directory again
+			once the command exits.`,
+	}
+	fromStdinKeyBase64Flag = &boolFlag{
+		Name: "from-stdin-key-base64",
+		Usage: `Read the wrapping key for raw_key protectors from
+			stdin, encoded with base64, instead of from a file. The
+			decoded key must be exactly 32 bytes long.`,
+	}
+	secretServiceFlag = &boolFlag{
+		Name: "secret-service",
+		Usage: `Get passphrases from the desktop's Secret Service
+			(e.g. the GNOME or KDE keyring) if they are stored there,
+			and offer to store the ones which are entered.`,
+	}
+	continueOnErrorFlag = &boolFlag{
+		Name: "continue-on-error",
+		Usage: `When operating on several protectors, skip any
+			protector that cannot be unlocked (e.g. because the
+			wrong passphrase was entered) instead of stopping.`,
+	}
+	rehashFlag = &boolFlag{
+		Name: "rehash",
+		Usage: fmt.Sprintf(`Also hash each passphrase with the KDF and
+			hashing costs currently set in %s, instead of those
+			the protector was created with.`,
+			actions.ConfigFileLocation),
+	}
 )
 
 // Option flags: used to specify options instead of being prompted for them
@@ -200,13 +367,69 @@ var (
 			units are "ms", "s", "m", and "h".`,
 		Default: 1 * time.Second,
 	}
+	promptTimeoutFlag = &durationFlag{
+		Name:    "prompt-timeout",
+		ArgName: "DURATION",
+		Usage: `Cancel the command if no input is given to a prompt
+			within DURATION, formatted like "30s" or "5m". By
+			default, prompts wait forever.`,
+	}
+	idleTimeoutFlag = &durationFlag{
+		Name:    "idle-timeout",
+		ArgName: "DURATION",
+		Usage: `Lock policies once none of their files have been used
+			for DURATION, formatted like "30s" or "5m".`,
+		Default: 15 * time.Minute,
+	}
+	dataUnitSizeFlag = &intFlag{
+		Name:    "data-unit-size",
+		ArgName: "SIZE",
+		Usage: fmt.Sprintf(`Encrypt file contents in units of SIZE bytes
+			instead of the data_unit_size from %s. SIZE must be a
+			power of 2 that is at least 512 and no larger than the
+			filesystem block size. Requires a v2 encryption policy
+			and kernel v6.7 or later.`, actions.ConfigFileLocation),
+	}
+	keyringRetriesFlag = &intFlag{
+		Name:    "keyring-retries",
+		ArgName: "N",
+		Usage: `Retry adding or removing a key up to N times, with
+			increasing delays, if the kernel fails with a transient
+			error such as ENOMEM or EAGAIN. 0 disables retrying.`,
+		Default: keyring.DefaultRetries,
+	}
+	thresholdFlag = &intFlag{
+		Name:    "threshold",
+		ArgName: "M",
+		Usage: `Split the key of the new policy so that any M of its
+			protectors are needed to unlock it. The protectors are
+			given as a comma-separated list with --protector, and
+			no more can be added later.`,
+	}
+	sampleFlag = &intFlag{
+		Name:    "sample",
+		ArgName: "COUNT",
+		Usage: `Read at most COUNT files, spread evenly over the
+			directory tree. 0 means to read every file.`,
+		Default: 100,
+	}
 	sourceFlag = &stringFlag{
 		Name:    "source",
 		ArgName: "SOURCE",
 		Usage: fmt.Sprintf(`New protectors will have type SOURCE. SOURCE
-			can be one of pam_passphrase, custom_passphrase, or
-			raw_key. If not specified, the user will be prompted for
-			the source, with a default pulled from %s.`,
+			can be one of pam_passphrase, custom_passphrase,
+			raw_key, fido2 (a FIDO2 security key with the
+			hmac-secret extension), tpm2 (a key sealed by this
+			machine's TPM 2.0 device), pkcs11 (a key pair on a
+			PKCS#11 token), kms (a key in AWS KMS, GCP Cloud KMS, or
+			Azure Key Vault), tang (a key recovered by a Tang
+			server), passphrase_and_raw_key (a custom passphrase and
+			a raw key file, both of which are needed), yubikey (a
+			custom passphrase and a YubiKey's HMAC-SHA1
+			challenge-response), gpg (a key encrypted to a GPG key),
+			or ssh_agent (a key derived from an ssh-agent signature).
+			If not specified, the user will be prompted for the
+			source, with a default pulled from %s.`,
 			actions.ConfigFileLocation),
 	}
 	nameFlag = &stringFlag{
@@ -222,7 +445,8 @@ var (
 		Usage: `Use the contents of FILE as the wrapping key when
 			creating or unlocking raw_key protectors. FILE should be
 			formatted as raw binary and should be exactly 32 bytes
-			long.`,
+			long. With "fscrypt key add", FILE holds the raw key to
+			add instead.`,
 	}
 	userFlag = &stringFlag{
 		Name:    "user",
@@ -230,23 +454,177 @@ var (
 		Usage: `Specify which user should be used for login passphrases
 			or to which user's keyring keys should be provisioned.`,
 	}
+	migrateFlag = &stringFlag{
+		Name:    "migrate",
+		ArgName: "SRCDIR",
+		Usage: `After encrypting the directory, move the contents of
+			the unencrypted directory SRCDIR into it. The files are
+			copied and verified, and only then are the originals
+			overwritten and SRCDIR removed. If no directory to
+			encrypt is given, SRCDIR itself is encrypted in place.
+			Cannot be used with --skip-unlock.`,
+	}
+	ownerFlag = &stringFlag{
+		Name:    "owner",
+		ArgName: "USERNAME",
+		Usage: `Make USERNAME the owner of the encrypted directory and
+			of any new fscrypt metadata, so that root can set up
+			encryption on the user's behalf. Unless specified
+			otherwise, new protectors will be login protectors for
+			USERNAME. Requires root privileges.`,
+	}
 	protectorFlag = &stringFlag{
 		Name:    "protector",
 		ArgName: "MOUNTPOINT:ID",
 		Usage: `Specify an existing protector on filesystem MOUNTPOINT
-			with protector descriptor ID which should be used in the
-			command.`,
+			which should be used in the command. ID is either the
+			protector's descriptor or its name.`,
 	}
 	unlockWithFlag = &stringFlag{
 		Name:    "unlock-with",
 		ArgName: "MOUNTPOINT:ID",
 		Usage: `Specify an existing protector on filesystem MOUNTPOINT
-			with protector descriptor ID which should be used to
-			unlock a policy (usually specified with --policy). This
+			(by descriptor or by name, as with --protector) which
+			should be used to unlock a policy (usually specified
+			with --policy). This
 			flag is only useful if a policy is protected with
 			multiple protectors. If not specified, the user will be
 			prompted for a protector.`,
 	}
+	convertToFlag = &stringFlag{
+		Name:    "to",
+		ArgName: "TYPE",
+		Usage: `Specify the type of protector to convert to. TYPE can be
+			either "login" or "custom".`,
+	}
+	filterFlag = &stringFlag{
+		Name:    "filter",
+		ArgName: "STATE",
+		Usage: `Only list the policies whose unlock state is STATE.
+			STATE can be either "locked" or "unlocked". Incompletely
+			locked policies count as unlocked.`,
+	}
+	profileFlag = &stringFlag{
+		Name:    "profile",
+		ArgName: "NAME",
+		Usage: `Use the encryption options and passphrase hashing costs
+			of the profile NAME from the "profiles" section of the
+			config file.`,
+	}
+	afterFlag = &stringFlag{
+		Name:    "after",
+		ArgName: "ACTION:PATH",
+		Usage: `After locking, unmount the filesystem mounted at PATH
+			(ACTION "unmount"), or remount it so that files on it
+			can't be executed (ACTION "remount-noexec"). Requires
+			root privileges.`,
+	}
+	tpm2PCRsFlag = &stringFlag{
+		Name:    "tpm2-pcrs",
+		ArgName: "PCRS",
+		Usage: `Bind new tpm2 protectors to the current values of PCRS,
+			a comma-separated list of PCRs in the SHA-256 bank
+			(e.g. "0,7"), so that they can only be unlocked while
+			the machine boots the same way. By default, they can
+			be unlocked whenever this machine's TPM is present.`,
+	}
+	directKeyFlag = &stringFlag{
+		Name:    "direct-key",
+		ArgName: "SETTING",
+		Usage: `Override whether the new policy uses the DIRECT_KEY flag,
+			which is normally used when both contents and filenames
+			are encrypted with Adiantum. SETTING can be "on" or
+			"off". Either one requires Adiantum for both.`,
+	}
+	metadataStoreFlag = &stringFlag{
+		Name:    "metadata-store",
+		ArgName: "STORE",
+		Usage: `When setting up a filesystem for fscrypt, choose how its
+			policies and protectors are stored. STORE can be
+			"per-file" (the default), which uses one file for each,
+			or "packed", which keeps all of them in a single file.
+			"packed" can't be used with --all-users.`,
+	}
+	metadataDirFlag = &stringFlag{
+		Name:    "metadata-dir",
+		ArgName: "DIR",
+		Usage: `When setting up a filesystem for fscrypt, create its
+			metadata directory at the absolute path DIR instead of
+			in the filesystem's root directory, and record this in
+			the global config file. DIR may be on another
+			filesystem, e.g. if this one is read-only.`,
+	}
+	allowUsersFlag = &stringFlag{
+		Name:    "allow-users",
+		ArgName: "USERS",
+		Usage: fmt.Sprintf(`Also allow USERS, a comma-separated list
+			of user names, to use the new protector. Implies %s.`,
+			shortDisplay(restrictAccessFlag)),
+	}
+	allowGroupsFlag = &stringFlag{
+		Name:    "allow-groups",
+		ArgName: "GROUPS",
+		Usage: fmt.Sprintf(`Also allow the members of GROUPS, a
+			comma-separated list of group names, to use the new
+			protector. Implies %s.`, shortDisplay(restrictAccessFlag)),
+	}
+	contentsFlag = &stringFlag{
+		Name:    "contents",
+		ArgName: "MODE",
+		Usage: fmt.Sprintf(`Encrypt file contents with MODE instead of the
+			"contents" mode from %s, e.g. "AES_128_CBC" (with
+			%s=AES_128_CTS) on devices without AES-256
+			acceleration.`, actions.ConfigFileLocation,
+			"--filenames"),
+	}
+	filenamesFlag = &stringFlag{
+		Name:    "filenames",
+		ArgName: "MODE",
+		Usage: fmt.Sprintf(`Encrypt filenames with MODE instead of the
+			"filenames" mode from %s.`, actions.ConfigFileLocation),
+	}
+	ivInoLblkFlag = &stringFlag{
+		Name:    "iv-ino-lblk",
+		ArgName: "BITS",
+		Usage: `Set the IV_INO_LBLK_BITS flag on the new policy, so that
+			its file contents can be encrypted by inline encryption
+			hardware (e.g. UFS or eMMC) which only supports a few
+			keys. BITS can be "64", or "32" for eMMC hardware
+			which only supports 32-bit IVs. Requires a v2
+			encryption policy, kernel v5.5 (or v5.9 for "32") or
+			later, and a filesystem with stable inode numbers
+			(e.g. ext4 with the stable_inodes feature, or f2fs).`,
+	}
+	kdfFlag = &stringFlag{
+		Name:    "kdf",
+		ArgName: "KDF",
+		Usage: `Hash passphrases with KDF, which can be "argon2id" (the
+			default) or "scrypt". The hashing costs are customized
+			for the chosen KDF.`,
+		Default: metadata.KDF_argon2id.String(),
+	}
+	logLevelFlag = &stringFlag{
+		Name:    "log-level",
+		ArgName: "LEVEL",
+		Usage: `Prints log messages at LEVEL or more severe to standard
+			error. LEVEL can be "error" (the default), "warn",
+			"info", or "debug". If this flag isn't given, the level
+			is taken from the FSCRYPT_LOG environment variable.`,
+	}
+	manifestFlag = &stringFlag{
+		Name:    "manifest",
+		ArgName: "FILE",
+		Usage: `After the directory has been encrypted, append a line of
+			JSON describing it (its path, policy, encryption
+			options, and protectors) to FILE.`,
+	}
+	labelFlag = &stringFlag{
+		Name:    "label",
+		ArgName: "LABEL",
+		Usage: `Use LABEL as the human-readable label of the policy, which
+			is shown by "fscrypt status". An empty LABEL removes the
+			existing label.`,
+	}
 	policyFlag = &stringFlag{
 		Name:    "policy",
 		ArgName: "MOUNTPOINT:ID",
@@ -265,7 +643,7 @@ func matchMetadataFlag(flagValue string) (mountpoint, descriptor string, err err
 		return "", "", fmt.Errorf("flag value %q does not have format %s",
 			flagValue, mountpointIDArg)
 	}
-	log.Printf("parsed flag: mountpoint=%q descriptor=%s", matches[1], matches[2])
+	util.Debugf("parsed flag: mountpoint=%q descriptor=%s", matches[1], matches[2])
 	return matches[1], matches[2], nil
 }
 
@@ -281,9 +659,57 @@ func parseMetadataFlag(flagValue string, targetUser *user.User) (*actions.Contex
 	return ctx, descriptor, err
 }
 
+// protectorDescriptorRegex matches the protector descriptors (as opposed to
+// protector names) which can be given as the ID in MOUNTPOINT:ID.
+var protectorDescriptorRegex = regexp.MustCompile(
+	fmt.Sprintf("^[[:xdigit:]]{%d}$", metadata.ProtectorDescriptorLen))
+
+// The first group is the mountpoint, which may not contain a colon. The second
+// group is the protector name, which may.
+var protectorNameFlagRegex = regexp.MustCompile("^([^:]+):(.+)$")
+
+// parseProtectorFlag takes the value of a flag which specifies a protector,
+// formatted as either MOUNTPOINT:DESCRIPTOR or MOUNTPOINT:NAME, and returns a
+// context for the mountpoint and a string for the protector's descriptor. An ID
+// which looks like a protector descriptor is always treated as one; otherwise
+// it is looked up as a name among the mountpoint's protectors.
+func parseProtectorFlag(flagValue string, targetUser *user.User) (*actions.Context, string, error) {
+	if matches := idFlagRegex.FindStringSubmatch(flagValue); matches != nil &&
+		protectorDescriptorRegex.MatchString(matches[2]) {
+		return parseMetadataFlag(flagValue, targetUser)
+	}
+	matches := protectorNameFlagRegex.FindStringSubmatch(flagValue)
+	if matches == nil {
+		return nil, "", fmt.Errorf("flag value %q does not have format %s",
+			flagValue, mountpointIDArg)
+	}
+	mountpoint, name := matches[1], matches[2]
+	util.Debugf("parsed flag: mountpoint=%q name=%q", mountpoint, name)
+
+	ctx, err := actions.NewContextFromMountpoint(mountpoint, targetUser)
+	if err != nil {
+		return nil, "", err
+	}
+	descriptors, err := ctx.ProtectorDescriptorsWithName(name)
+	if err != nil {
+		return nil, "", err
+	}
+	switch len(descriptors) {
+	case 0:
+		return nil, "", &ErrNoProtectorWithName{name, ctx.Mount.Path}
+	case 1:
+		util.Debugf("protector name %q resolved to %s", name, descriptors[0])
+		return ctx, descriptors[0], nil
+	default:
+		return nil, "", errors.Wrapf(ErrSpecifyProtector,
+			"protectors named %q on %q are %s", name, ctx.Mount.Path,
+			strings.Join(descriptors, ", "))
+	}
+}
+
 // getProtectorFromFlag gets an existing locked protector from protectorFlag.
 func getProtectorFromFlag(flagValue string, targetUser *user.User) (*actions.Protector, error) {
-	ctx, descriptor, err := parseMetadataFlag(flagValue, targetUser)
+	ctx, descriptor, err := parseProtectorFlag(flagValue, targetUser)
 	if err != nil {
 		return nil, err
 	}
@@ -299,6 +725,22 @@ func getPolicyFromFlag(flagValue string, targetUser *user.User) (*actions.Policy
 	return actions.GetPolicy(ctx, descriptor)
 }
 
+// parseOwnerFlag returns the user specified by ownerFlag, or nil if the flag
+// value is missing. Only root may give away directories to other users.
+func parseOwnerFlag() (*user.User, error) {
+	if ownerFlag.Value == "" {
+		return nil, nil
+	}
+	if !util.IsUserRoot() {
+		return nil, ErrMustBeRoot
+	}
+	owner, err := user.Lookup(ownerFlag.Value)
+	if err != nil {
+		return nil, errors.Wrapf(ErrUnknownUser, "%q", ownerFlag.Value)
+	}
+	return owner, nil
+}
+
 // parseUserFlag returns the user specified by userFlag or the current effective
 // user if the flag value is missing.
 func parseUserFlag() (targetUser *user.User, err error) {
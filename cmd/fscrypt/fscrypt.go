@@ -30,19 +30,39 @@ import (
 	"log"
 	"os"
 
+	"github.com/pkg/errors"
 	"github.com/urfave/cli"
 
 	"github.com/google/fscrypt/actions"
+	"github.com/google/fscrypt/crypto"
 	"github.com/google/fscrypt/filesystem"
+	"github.com/google/fscrypt/keyring"
+	"github.com/google/fscrypt/util"
 )
 
 // Current version of the program (set by Makefile)
 var version string
 
 func main() {
+	// If we panic, make sure no keys are left in memory.
+	defer func() {
+		if r := recover(); r != nil {
+			crypto.WipeAll()
+			panic(r)
+		}
+	}()
+
 	cli.AppHelpTemplate = appHelpTemplate
 	cli.CommandHelpTemplate = commandHelpTemplate
 	cli.SubcommandHelpTemplate = subcommandHelpTemplate
+	// Commands taking --profile also list the profiles which can be used.
+	printHelp := cli.HelpPrinter
+	cli.HelpPrinter = func(w io.Writer, templ string, data interface{}) {
+		printHelp(w, templ, data)
+		if command, ok := data.(cli.Command); ok {
+			writeProfiles(w, command)
+		}
+	}
 
 	if conffile := os.Getenv("FSCRYPT_CONF"); conffile != "" {
 		actions.ConfigFileLocation = conffile
@@ -53,6 +73,14 @@ func main() {
 	if consistent := os.Getenv("FSCRYPT_CONSISTENT_OUTPUT"); consistent == "1" {
 		filesystem.SortDescriptorsByLastMtime = true
 	}
+	errorIDsEnabled = os.Getenv("FSCRYPT_ERROR_IDS") == "1"
+	actions.SetFIDO2Authenticator(fido2Tools{})
+	actions.SetTPM2Sealer(tpm2Tools{})
+	actions.SetPKCS11Token(pkcs11Tool{})
+	actions.SetKMSClient(kmsTools{})
+	actions.SetTangTrustFunc(trustTangServer)
+	actions.SetYubiKey(ykchalrespTool{})
+	actions.SetGPG(gpgTool{})
 
 	// Create our command line application
 	app := cli.NewApp()
@@ -73,7 +101,7 @@ func main() {
 
 	// Initialize command list and setup all of the commands.
 	app.Action = defaultAction
-	app.Commands = []cli.Command{Setup, Encrypt, Unlock, Lock, Purge, Status, Metadata}
+	app.Commands = []cli.Command{Setup, Encrypt, Unlock, Lock, Purge, Status, VerifyAccess, Info, Doctor, Check, Agent, Key, Protector, Policy, Metadata, Completion}
 	for i := range app.Commands {
 		setupCommand(&app.Commands[i])
 	}
@@ -107,21 +135,49 @@ func setupCommand(command *cli.Command) {
 }
 
 // setupBefore makes sure our logs, errors, and output are going to the correct
-// io.Writers and that we haven't over-specified our flags. We only print the
-// logs when using verbose, and only print normal stuff when not using quiet.
+// io.Writers and that we haven't over-specified our flags. Logs go to stderr
+// at the level chosen by --log-level, --verbose, or $FSCRYPT_LOG (in that
+// order), and we only print normal stuff when not using quiet.
 func setupBefore(c *cli.Context) error {
-	log.SetOutput(io.Discard)
+	log.SetOutput(os.Stderr)
 	c.App.Writer = io.Discard
 
-	if verboseFlag.Value {
-		log.SetOutput(os.Stdout)
+	level, err := getLogLevel()
+	if err != nil {
+		return &usageError{c, err.Error()}
+	}
+	util.SetLogLevel(level)
+	if keyringRetriesFlag.Value < 0 {
+		return &usageError{c, fmt.Sprintf("%s must not be negative",
+			shortDisplay(keyringRetriesFlag))}
 	}
+	keyring.Retries = int(keyringRetriesFlag.Value)
 	if !quietFlag.Value {
 		c.App.Writer = os.Stdout
 	}
+	// A bad config file is reported by the commands which need it.
+	if err = actions.LoadMetadataDirs(); err != nil {
+		util.Debug(err)
+	}
 	return nil
 }
 
+// getLogLevel returns the log level requested on the command line or in the
+// environment.
+func getLogLevel() (util.LogLevel, error) {
+	if logLevelFlag.Value != "" {
+		return util.ParseLogLevel(logLevelFlag.Value)
+	}
+	if verboseFlag.Value {
+		return util.LogDebug, nil
+	}
+	if env := os.Getenv("FSCRYPT_LOG"); env != "" {
+		level, err := util.ParseLogLevel(env)
+		return level, errors.Wrap(err, "FSCRYPT_LOG")
+	}
+	return util.DefaultLogLevel, nil
+}
+
 // defaultAction will be run when no command is specified.
 func defaultAction(c *cli.Context) error {
 	// Always default to showing the help
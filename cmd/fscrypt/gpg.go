@@ -0,0 +1,118 @@
+/*
+ * gpg.go - Encrypting the wrapping keys of gpg protectors to GPG keys, and
+ * decrypting them with gpg-agent.
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/term"
+
+	"github.com/google/fscrypt/crypto"
+	"github.com/google/fscrypt/util"
+)
+
+// GPG is used with the gpg program, whose gpg-agent holds the secret keys (or
+// talks to the smartcard holding them) and asks for their passphrase or PIN.
+var gpgCommand = "gpg"
+
+// Messages in the errors of gpg for recipients without a usable public key
+// (which gpg reports as "RECIPIENT: skipped: REASON"), for ciphertexts whose
+// secret key isn't available (e.g. because the smartcard isn't inserted), for
+// passphrases or PINs which were wrong, and for the pinentry being canceled
+var (
+	gpgNoPublicKeyErrors = []string{"skipped:", "No public key", "Unusable public key"}
+	gpgNoSecretKeyErrors = []string{"No secret key", "Card not present",
+		"card removed"}
+	gpgWrongKeyErrors = []string{"Bad passphrase", "Bad PIN"}
+	gpgCanceledErrors = []string{"Operation cancelled"}
+)
+
+// gpgTool is the actions.GPG used by the fscrypt command.
+type gpgTool struct{}
+
+func (gpgTool) Encrypt(recipient string, key *crypto.Key) ([]byte, error) {
+	return runGPG(key.Data(), "--batch", "--quiet", "--encrypt",
+		"--recipient", recipient, "--output", "-")
+}
+
+func (gpgTool) Decrypt(ciphertext []byte) (*crypto.Key, error) {
+	// Not in batch mode, so gpg-agent may ask for a passphrase or PIN.
+	output, err := runGPG(ciphertext, "--quiet", "--decrypt", "--output", "-")
+	if err != nil {
+		return nil, err
+	}
+	defer wipeBytes(output)
+	return crypto.NewFixedLengthKeyFromReader(bytes.NewReader(output), len(output))
+}
+
+// runGPG runs gpg with input on stdin, and returns its output.
+func runGPG(input []byte, args ...string) ([]byte, error) {
+	if _, err := exec.LookPath(gpgCommand); err != nil {
+		util.Debug(err)
+		return nil, ErrNoGPG
+	}
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(gpgCommand, args...)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	// As gpg's stdin isn't the terminal, the terminal on which a text
+	// pinentry should ask for the passphrase or PIN is given by GPG_TTY.
+	if os.Getenv("GPG_TTY") == "" && term.IsTerminal(stdinFd) {
+		if tty, err := os.Readlink("/proc/self/fd/0"); err == nil {
+			cmd.Env = append(os.Environ(), "GPG_TTY="+tty)
+		}
+	}
+	err := cmd.Run()
+	util.Debugf("%s %s: %v", gpgCommand, strings.Join(args, " "), err)
+	if err == nil {
+		return stdout.Bytes(), nil
+	}
+	message := strings.TrimSpace(stderr.String())
+	util.Debug(message)
+	for _, noPublicKey := range gpgNoPublicKeyErrors {
+		if strings.Contains(message, noPublicKey) {
+			return nil, ErrGPGNoPublicKey
+		}
+	}
+	for _, noSecretKey := range gpgNoSecretKeyErrors {
+		if strings.Contains(message, noSecretKey) {
+			return nil, ErrGPGNoSecretKey
+		}
+	}
+	for _, wrongKey := range gpgWrongKeyErrors {
+		if strings.Contains(message, wrongKey) {
+			return nil, ErrWrongKey
+		}
+	}
+	for _, canceled := range gpgCanceledErrors {
+		if strings.Contains(message, canceled) {
+			return nil, ErrCanceled
+		}
+	}
+	if message == "" {
+		return nil, errors.Wrap(err, gpgCommand)
+	}
+	return nil, errors.Errorf("%s: %s", gpgCommand, message)
+}
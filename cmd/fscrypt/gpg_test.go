@@ -0,0 +1,84 @@
+/*
+ * gpg_test.go - tests for encrypting keys to GPG keys
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/google/fscrypt/crypto"
+	"github.com/google/fscrypt/metadata"
+)
+
+// Tests that keys are passed to and from gpg on stdin and stdout, rather than
+// on its command line. The fake gpg "encrypts" by reversing the key.
+func TestGPGEncryptDecrypt(t *testing.T) {
+	fakeCommand(t, &gpgCommand, `case "$*" in
+"--batch --quiet --encrypt --recipient alice@example.com --output -") rev;;
+"--quiet --decrypt --output -") rev;;
+*) exit 1;;
+esac`)
+
+	// rev works on lines, so use a key without newlines.
+	key, err := crypto.NewFixedLengthKeyFromReader(
+		bytes.NewReader(bytes.Repeat([]byte("0123456789abcdef"), 2)),
+		metadata.InternalKeyLen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer key.Wipe()
+	ciphertext, err := gpgTool{}.Encrypt("alice@example.com", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(ciphertext, key.Data()) {
+		t.Error("key wasn't encrypted")
+	}
+	decrypted, err := gpgTool{}.Decrypt(ciphertext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer decrypted.Wipe()
+	if !decrypted.Equals(key) {
+		t.Error("decrypted key differs from the encrypted key")
+	}
+}
+
+// Tests that missing keys, wrong PINs, and canceled pinentries are reported as
+// such.
+func TestGPGErrors(t *testing.T) {
+	tests := []struct {
+		name, message string
+		expected      error
+	}{
+		{"no public key", "gpg: bob@example.com: skipped: No public key", ErrGPGNoPublicKey},
+		{"no secret key", "gpg: decryption failed: No secret key", ErrGPGNoSecretKey},
+		{"bad PIN", "gpg: public key decryption failed: Bad PIN", ErrWrongKey},
+		{"canceled", "gpg: public key decryption failed: Operation cancelled", ErrCanceled},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fakeCommand(t, &gpgCommand, "echo '"+test.message+"' >&2; exit 2")
+			_, err := gpgTool{}.Decrypt([]byte("ciphertext"))
+			if err != test.expected {
+				t.Errorf("got error %v, expected %v", err, test.expected)
+			}
+		})
+	}
+}
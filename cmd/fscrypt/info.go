@@ -0,0 +1,261 @@
+/*
+ * info.go - File which contains the functions for reporting which encryption
+ * features the kernel supports.
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/google/fscrypt/filesystem"
+	"github.com/google/fscrypt/keyring"
+	"github.com/google/fscrypt/metadata"
+	"github.com/google/fscrypt/util"
+)
+
+// modePair is a combination of contents and filenames encryption modes.
+type modePair struct {
+	contents, filenames metadata.EncryptionOptions_Mode
+}
+
+// probedModePairs are the combinations of encryption modes which fscrypt knows
+// about, in the order they are listed by "fscrypt info".
+var probedModePairs = []modePair{
+	{metadata.EncryptionOptions_AES_256_XTS, metadata.EncryptionOptions_AES_256_CTS},
+	{metadata.EncryptionOptions_AES_256_XTS, metadata.EncryptionOptions_AES_256_HCTR2},
+	{metadata.EncryptionOptions_AES_128_CBC, metadata.EncryptionOptions_AES_128_CTS},
+	{metadata.EncryptionOptions_Adiantum, metadata.EncryptionOptions_Adiantum},
+	{metadata.EncryptionOptions_LEA_256_XTS, metadata.EncryptionOptions_LEA_256_CTS},
+}
+
+// modesInfo describes whether a combination of encryption modes is supported
+// with each policy version. A nil value means that support couldn't be
+// determined.
+type modesInfo struct {
+	Contents  string `json:"contents"`
+	Filenames string `json:"filenames"`
+	V1        *bool  `json:"v1"`
+	V2        *bool  `json:"v2"`
+}
+
+// filesystemInfo describes the encryption features supported on a filesystem.
+// Only the fields up to InlineCryptHardware are set when the filesystem isn't
+// probed.
+type filesystemInfo struct {
+	Mountpoint          string      `json:"mountpoint"`
+	Device              string      `json:"device"`
+	FilesystemType      string      `json:"filesystem_type"`
+	Encryption          string      `json:"encryption"`
+	PolicyV2            bool        `json:"policy_v2"`
+	InlineCryptMounted  bool        `json:"inlinecrypt_mounted"`
+	InlineCryptHardware *bool       `json:"inlinecrypt_hardware"`
+	IVInoLblk64         *bool       `json:"iv_ino_lblk_64,omitempty"`
+	IVInoLblk32         *bool       `json:"iv_ino_lblk_32,omitempty"`
+	Modes               []modesInfo `json:"modes,omitempty"`
+}
+
+// kernelInfo is the output of "fscrypt info".
+type kernelInfo struct {
+	Kernel      string            `json:"kernel"`
+	Filesystems []*filesystemInfo `json:"filesystems"`
+}
+
+// hasInlineCryptHardware returns whether the block device with the given number
+// supports inline encryption, or nil if this can't be determined. Partitions
+// don't have their own queue, so the parent device is checked for them.
+func hasInlineCryptHardware(deviceNumber filesystem.DeviceNumber) *bool {
+	devicePath := filepath.Join("/sys/dev/block", deviceNumber.String())
+	if _, err := os.Stat(devicePath); err != nil {
+		return nil
+	}
+	for _, queuePath := range []string{
+		filepath.Join(devicePath, "queue"),
+		filepath.Join(devicePath, "..", "queue"),
+	} {
+		if _, err := os.Stat(queuePath); err != nil {
+			continue
+		}
+		_, err := os.Stat(filepath.Join(queuePath, "crypto"))
+		supported := err == nil
+		return &supported
+	}
+	return nil
+}
+
+// probeResult converts the result of metadata.ProbeSupport to a tri-state.
+func probeResult(supported bool, err error) *bool {
+	if err != nil {
+		util.Debug(err)
+		return nil
+	}
+	return &supported
+}
+
+// getFilesystemInfo gathers the encryption features supported on mount. If
+// probe is true, the supported options are also probed for by trying to set
+// encryption policies on temporary directories in the mountpoint.
+func getFilesystemInfo(mount *filesystem.Mount, probe bool) *filesystemInfo {
+	info := &filesystemInfo{
+		Mountpoint:          mount.Path,
+		Device:              mount.Device,
+		FilesystemType:      mount.FilesystemType,
+		Encryption:          encryptionStatus(mount.CheckSupport()),
+		InlineCryptMounted:  mount.InlineCrypt,
+		InlineCryptHardware: hasInlineCryptHardware(mount.DeviceNumber),
+	}
+	if info.Encryption != encryptionStatus(nil) {
+		return info
+	}
+	info.PolicyV2 = keyring.IsFsKeyringSupported(mount)
+	if !probe {
+		return info
+	}
+
+	for _, pair := range probedModePairs {
+		modes := modesInfo{
+			Contents:  pair.contents.String(),
+			Filenames: pair.filenames.String(),
+			V1: probeResult(metadata.ProbeSupport(mount.Path, 1,
+				pair.contents, pair.filenames, 0)),
+		}
+		if info.PolicyV2 {
+			modes.V2 = probeResult(metadata.ProbeSupport(mount.Path, 2,
+				pair.contents, pair.filenames, 0))
+		} else {
+			modes.V2 = new(bool)
+		}
+		info.Modes = append(info.Modes, modes)
+	}
+
+	// The IV_INO_LBLK_* flags are only supported with v2 policies.
+	defaultModes := probedModePairs[0]
+	probeFlag := func(flag uint8) *bool {
+		if !info.PolicyV2 {
+			return new(bool)
+		}
+		return probeResult(metadata.ProbeSupport(mount.Path, 2,
+			defaultModes.contents, defaultModes.filenames, flag))
+	}
+	info.IVInoLblk64 = probeFlag(unix.FSCRYPT_POLICY_FLAG_IV_INO_LBLK_64)
+	info.IVInoLblk32 = probeFlag(unix.FSCRYPT_POLICY_FLAG_IV_INO_LBLK_32)
+	return info
+}
+
+// getKernelInfo gathers the encryption features supported on mount, or a
+// summary for all filesystems which support encryption if mount is nil.
+func getKernelInfo(mount *filesystem.Mount) (*kernelInfo, error) {
+	release, err := util.KernelRelease()
+	if err != nil {
+		return nil, err
+	}
+	info := &kernelInfo{Kernel: release, Filesystems: []*filesystemInfo{}}
+	if mount != nil {
+		info.Filesystems = append(info.Filesystems, getFilesystemInfo(mount, true))
+		return info, nil
+	}
+
+	mounts, err := filesystem.AllFilesystems()
+	if err != nil {
+		return nil, err
+	}
+	for _, mount := range mounts {
+		if mount.Device == "" {
+			continue
+		}
+		fsInfo := getFilesystemInfo(mount, false)
+		if fsInfo.Encryption == encryptionStatus(nil) {
+			info.Filesystems = append(info.Filesystems, fsInfo)
+		}
+	}
+	return info, nil
+}
+
+// supportString formats a tri-state for the tables of "fscrypt info".
+func supportString(b *bool) string {
+	if b == nil {
+		return "Unknown"
+	}
+	return yesNoString(*b)
+}
+
+// inlineCryptString describes whether a filesystem uses inline encryption.
+func inlineCryptString(info *filesystemInfo) string {
+	if info.InlineCryptMounted {
+		return "Yes"
+	}
+	if info.InlineCryptHardware != nil && *info.InlineCryptHardware {
+		return "Available (not mounted with inlinecrypt)"
+	}
+	return "No"
+}
+
+// writeKernelInfo prints the encryption features supported on mount (or on all
+// filesystems, if mount is nil), either as tables or as JSON.
+func writeKernelInfo(w io.Writer, mount *filesystem.Mount, asJSON bool) error {
+	info, err := getKernelInfo(mount)
+	if err != nil {
+		return err
+	}
+	if asJSON {
+		return writeJSON(w, info)
+	}
+
+	fmt.Fprintf(w, "Linux kernel %s\n\n", info.Kernel)
+	if mount == nil {
+		t := makeTableWriter(w, "MOUNTPOINT\tDEVICE\tFILESYSTEM\tV2 POLICIES\tINLINE CRYPTO")
+		for _, fsInfo := range info.Filesystems {
+			fmt.Fprintf(t, "%s\t%s\t%s\t%s\t%s\n",
+				filesystem.EscapeString(fsInfo.Mountpoint),
+				filesystem.EscapeString(fsInfo.Device),
+				filesystem.EscapeString(fsInfo.FilesystemType),
+				yesNoString(fsInfo.PolicyV2), inlineCryptString(fsInfo))
+		}
+		return t.Flush()
+	}
+
+	fsInfo := info.Filesystems[0]
+	fmt.Fprintf(w, "%s filesystem %q: encryption %s.\n", fsInfo.FilesystemType,
+		fsInfo.Mountpoint, fsInfo.Encryption)
+	if fsInfo.Encryption != encryptionStatus(nil) {
+		return nil
+	}
+	fmt.Fprintln(w)
+
+	t := makeTableWriter(w, "FEATURE\tSUPPORTED")
+	fmt.Fprintf(t, "v1 policies\tYes\n")
+	fmt.Fprintf(t, "v2 policies\t%s\n", yesNoString(fsInfo.PolicyV2))
+	fmt.Fprintf(t, "IV_INO_LBLK_64\t%s\n", supportString(fsInfo.IVInoLblk64))
+	fmt.Fprintf(t, "IV_INO_LBLK_32\t%s\n", supportString(fsInfo.IVInoLblk32))
+	fmt.Fprintf(t, "inline crypto\t%s\n", inlineCryptString(fsInfo))
+	if err := t.Flush(); err != nil {
+		return err
+	}
+	fmt.Fprintln(w)
+
+	t = makeTableWriter(w, "CONTENTS\tFILENAMES\tV1\tV2")
+	for _, modes := range fsInfo.Modes {
+		fmt.Fprintf(t, "%s\t%s\t%s\t%s\n", modes.Contents, modes.Filenames,
+			supportString(modes.V1), supportString(modes.V2))
+	}
+	return t.Flush()
+}
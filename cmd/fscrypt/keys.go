@@ -25,8 +25,8 @@ import (
 	"bufio"
 	"fmt"
 	"io"
-	"log"
 	"os"
+	"time"
 
 	"github.com/pkg/errors"
 	"golang.org/x/term"
@@ -35,6 +35,7 @@ import (
 	"github.com/google/fscrypt/crypto"
 	"github.com/google/fscrypt/metadata"
 	"github.com/google/fscrypt/pam"
+	"github.com/google/fscrypt/util"
 )
 
 // The file descriptor for standard input
@@ -104,10 +105,45 @@ func getPassphraseKey(prompt string) (*crypto.Key, error) {
 		fmt.Print(prompt)
 	}
 
-	return crypto.NewKeyFromReader(passphraseReader{})
+	return readPassphrase()
+}
+
+// readPassphrase reads a passphrase into a key. If the passphrase isn't entered
+// within the --prompt-timeout, ErrCanceled is returned. Reads from the terminal
+// can't be interrupted, so the read is abandoned in that case, and the key is
+// wiped if the passphrase still arrives later.
+func readPassphrase() (*crypto.Key, error) {
+	if promptTimeoutFlag.Value <= 0 {
+		return crypto.NewKeyFromReader(passphraseReader{})
+	}
+	type result struct {
+		key *crypto.Key
+		err error
+	}
+	results := make(chan result, 1)
+	go func() {
+		key, err := crypto.NewKeyFromReader(passphraseReader{})
+		results <- result{key, err}
+	}()
+	select {
+	case r := <-results:
+		return r.key, r.err
+	case <-time.After(promptTimeoutFlag.Value):
+		go func() { (<-results).key.Wipe() }()
+		util.Debugf("no passphrase entered within %v", promptTimeoutFlag.Value)
+		return nil, ErrCanceled
+	}
 }
 
 func makeRawKey(info actions.ProtectorInfo) (*crypto.Key, error) {
+	// The base64-encoded key is decoded without ever leaving locked memory.
+	if fromStdinKeyBase64Flag.Value {
+		if keyFileFlag.Value != "" {
+			return nil, ErrTwoKeySources
+		}
+		return crypto.NewFixedLengthKeyFromBase64Reader(os.Stdin,
+			metadata.InternalKeyLen)
+	}
 	// When running non-interactively and no key was provided,
 	// try to read it from stdin
 	if keyFileFlag.Value == "" && !term.IsTerminal(stdinFd) {
@@ -134,31 +170,71 @@ func makeRawKey(info actions.ProtectorInfo) (*crypto.Key, error) {
 	return crypto.NewFixedLengthKeyFromReader(file, metadata.InternalKeyLen)
 }
 
+// readRawKey reads a raw key of any length for "fscrypt key add" from the file
+// given by keyFileFlag, or else from stdin.
+func readRawKey() (*crypto.Key, error) {
+	if keyFileFlag.Value == "" {
+		if term.IsTerminal(stdinFd) {
+			return nil, ErrSpecifyKeyFile
+		}
+		return crypto.NewKeyFromReader(bufio.NewReader(os.Stdin))
+	}
+	file, err := os.Open(keyFileFlag.Value)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return crypto.NewKeyFromReader(file)
+}
+
 // makeKeyFunc creates an actions.KeyFunc. This function customizes the KeyFunc
 // to whether or not it supports retrying, whether it confirms the passphrase,
 // and custom prefix for printing (if any).
 func makeKeyFunc(supportRetry, shouldConfirm bool, prefix string) actions.KeyFunc {
 	return func(info actions.ProtectorInfo, retry bool) (*crypto.Key, error) {
-		log.Printf("KeyFunc(%s, %v)", formatInfo(info), retry)
+		util.Debugf("KeyFunc(%s, %v)", formatInfo(info), retry)
 		if retry {
 			if !supportRetry {
 				panic("this KeyFunc does not support retrying")
 			}
-			// Don't retry for non-interactive sessions
-			if quietFlag.Value {
+			// Don't retry for non-interactive sessions, unless the
+			// passphrase was stored instead of read. An existing
+			// protector named with --protector from a script isn't
+			// retried either, as the script can't answer again.
+			if retryingStoredPassphrase(info) {
+				util.Warnf("the stored passphrase for protector %s is incorrect",
+					info.Descriptor())
+			} else if quietFlag.Value {
+				return nil, ErrWrongKey
+			} else if protectorFlag.Value != "" && !term.IsTerminal(stdinFd) {
 				return nil, ErrWrongKey
+			} else if info.Source() == metadata.SourceType_pkcs11 {
+				fmt.Println("Incorrect PIN")
+			} else if info.Source() == metadata.SourceType_passphrase_and_raw_key {
+				// Either factor may have been wrong, so say so
+				// once, when the passphrase is asked for again.
+				if !info.KeyFileFactor() {
+					fmt.Println("Incorrect passphrase or key file")
+				}
+			} else if info.Source() == metadata.SourceType_yubikey {
+				fmt.Println("Incorrect passphrase or YubiKey")
+			} else {
+				fmt.Println("Incorrect Passphrase")
 			}
-			fmt.Println("Incorrect Passphrase")
 		}
 
 		switch info.Source() {
 		case metadata.SourceType_pam_passphrase:
+			if key := getSecretServicePassphrase(info, retry); key != nil {
+				return key, nil
+			}
 			prompt := fmt.Sprintf("Enter %slogin passphrase for %s: ",
 				prefix, formatUsername(info.UID()))
 			key, err := getPassphraseKey(prompt)
 			if err != nil {
 				return nil, err
 			}
+			rememberPassphrase(info, key)
 
 			// To confirm, check that the passphrase is the user's
 			// login passphrase.
@@ -178,12 +254,16 @@ func makeKeyFunc(supportRetry, shouldConfirm bool, prefix string) actions.KeyFun
 			return key, nil
 
 		case metadata.SourceType_custom_passphrase:
+			if key := getSecretServicePassphrase(info, retry); key != nil {
+				return key, nil
+			}
 			prompt := fmt.Sprintf("Enter %scustom passphrase for protector %q: ",
 				prefix, info.Name())
 			key, err := getPassphraseKey(prompt)
 			if err != nil {
 				return nil, err
 			}
+			rememberPassphrase(info, key)
 
 			// To confirm, make sure the user types the same
 			// passphrase in again.
@@ -202,6 +282,43 @@ func makeKeyFunc(supportRetry, shouldConfirm bool, prefix string) actions.KeyFun
 			}
 			return key, nil
 
+		case metadata.SourceType_pkcs11:
+			// The PIN belongs to the token, so it can't be
+			// changed here, and it is checked by the token rather
+			// than confirmed.
+			if prefix != "" {
+				return nil, ErrNotPassphrase
+			}
+			prompt := fmt.Sprintf("Enter the PIN of the PKCS#11 token for protector %q: ",
+				info.Name())
+			return getPassphraseKey(prompt)
+
+		case metadata.SourceType_passphrase_and_raw_key, metadata.SourceType_yubikey:
+			// The key file is the same for an old and a new
+			// passphrase.
+			if info.KeyFileFactor() {
+				return makeRawKey(info)
+			}
+			prompt := fmt.Sprintf("Enter %spassphrase for %s: ", prefix, formatInfo(info))
+			key, err := getPassphraseKey(prompt)
+			if err != nil {
+				return nil, err
+			}
+			if shouldConfirm && !quietFlag.Value {
+				key2, err := getPassphraseKey("Confirm passphrase: ")
+				if err != nil {
+					key.Wipe()
+					return nil, err
+				}
+				defer key2.Wipe()
+
+				if !key.Equals(key2) {
+					key.Wipe()
+					return nil, ErrPassphraseMismatch
+				}
+			}
+			return key, nil
+
 		case metadata.SourceType_raw_key:
 			// Only use prefixes with passphrase protectors.
 			if prefix != "" {
@@ -0,0 +1,231 @@
+/*
+ * kms.go - Encrypting the wrapping keys of kms protectors with keys in AWS KMS,
+ * GCP Cloud KMS, or Azure Key Vault.
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"os/exec"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/google/fscrypt/crypto"
+	"github.com/google/fscrypt/metadata"
+	"github.com/google/fscrypt/util"
+)
+
+// The KMSs are accessed with the command line tools of the cloud providers,
+// which find the machine's (e.g. instance) credentials on their own.
+var (
+	awsCommand    = "aws"
+	gcloudCommand = "gcloud"
+	azCommand     = "az"
+)
+
+// Messages in the errors of the cloud providers' tools for credentials which
+// may not use a key, and for keys which are disabled or deleted
+var kmsAccessDeniedErrors = []string{
+	"AccessDeniedException", "DisabledException", "KMSInvalidStateException",
+	"NotFoundException", "PERMISSION_DENIED", "FAILED_PRECONDITION",
+	"NOT_FOUND", "Forbidden", "KeyNotFound",
+}
+
+type kmsProvider int
+
+const (
+	awsKMS kmsProvider = iota
+	gcpKMS
+	azureKeyVault
+)
+
+// parseKMSKey returns the provider of the KMS key called name: an AWS KMS key
+// ARN ("arn:aws:kms:REGION:ACCOUNT:key/ID"), a GCP Cloud KMS key resource name
+// ("projects/PROJECT/locations/LOCATION/keyRings/RING/cryptoKeys/KEY"), or an
+// Azure Key Vault key identifier ("https://VAULT.vault.azure.net/keys/KEY").
+// For AWS, the key's region is also returned.
+func parseKMSKey(name string) (kmsProvider, string, error) {
+	switch {
+	case strings.HasPrefix(name, "arn:"):
+		fields := strings.SplitN(name, ":", 6)
+		if len(fields) == 6 && fields[2] == "kms" && fields[3] != "" {
+			return awsKMS, fields[3], nil
+		}
+	case strings.HasPrefix(name, "projects/"):
+		fields := strings.Split(name, "/")
+		if len(fields) == 8 && fields[2] == "locations" &&
+			fields[4] == "keyRings" && fields[6] == "cryptoKeys" {
+			return gcpKMS, "", nil
+		}
+	case strings.HasPrefix(name, "https://"):
+		if strings.Contains(name, "/keys/") {
+			return azureKeyVault, "", nil
+		}
+	}
+	return 0, "", errors.Wrapf(ErrUnknownKMSKey, "%q", name)
+}
+
+// kmsTools is the actions.KMSClient used by the fscrypt command.
+type kmsTools struct{}
+
+func (kmsTools) Encrypt(keyName string, key *crypto.Key) ([]byte, error) {
+	provider, region, err := parseKMSKey(keyName)
+	if err != nil {
+		return nil, err
+	}
+	switch provider {
+	case awsKMS:
+		output, err := runKMSCommand(awsCommand, key.Data(), "kms", "encrypt",
+			"--region", region, "--key-id", keyName,
+			"--plaintext", "fileb:///dev/stdin",
+			"--query", "CiphertextBlob", "--output", "text")
+		if err != nil {
+			return nil, err
+		}
+		return base64.StdEncoding.DecodeString(strings.TrimSpace(string(output)))
+	case gcpKMS:
+		return runKMSCommand(gcloudCommand, key.Data(), "kms", "encrypt",
+			"--key", keyName, "--plaintext-file", "-", "--ciphertext-file", "-")
+	default:
+		// Key Vault would need the key on the command line to encrypt
+		// it, so it is encrypted here with the vault key's public key.
+		publicKey, err := getAzurePublicKey(keyName)
+		if err != nil {
+			return nil, err
+		}
+		return rsa.EncryptOAEP(sha256.New(), rand.Reader, publicKey, key.Data(), nil)
+	}
+}
+
+func (kmsTools) Decrypt(keyName string, ciphertext []byte) (*crypto.Key, error) {
+	provider, region, err := parseKMSKey(keyName)
+	if err != nil {
+		return nil, err
+	}
+	var output []byte
+	switch provider {
+	case awsKMS:
+		output, err = runKMSCommand(awsCommand, ciphertext, "kms", "decrypt",
+			"--region", region, "--key-id", keyName,
+			"--ciphertext-blob", "fileb:///dev/stdin",
+			"--query", "Plaintext", "--output", "text")
+	case gcpKMS:
+		return runKMSDecryptCommand(gcloudCommand, ciphertext, "kms", "decrypt",
+			"--key", keyName, "--ciphertext-file", "-", "--plaintext-file", "-")
+	default:
+		output, err = runKMSCommand(azCommand, nil, "keyvault", "key", "decrypt",
+			"--id", keyName, "--algorithm", "RSA-OAEP-256",
+			"--data-type", "base64",
+			"--value", base64.StdEncoding.EncodeToString(ciphertext),
+			"--query", "result", "--output", "tsv")
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer wipeBytes(output)
+	return crypto.NewFixedLengthKeyFromBase64Reader(bytes.NewReader(output),
+		metadata.InternalKeyLen)
+}
+
+// getAzurePublicKey returns the public key of an RSA key in Key Vault.
+func getAzurePublicKey(keyName string) (*rsa.PublicKey, error) {
+	output, err := runKMSCommand(azCommand, nil, "keyvault", "key", "show",
+		"--id", keyName, "--query", "key", "--output", "json")
+	if err != nil {
+		return nil, err
+	}
+	// The key is a JSON Web Key, with unpadded base64url numbers.
+	var jwk struct {
+		Kty string `json:"kty"`
+		N   string `json:"n"`
+		E   string `json:"e"`
+	}
+	if err = json.Unmarshal(output, &jwk); err != nil {
+		return nil, errors.Wrap(err, "Key Vault key")
+	}
+	if jwk.Kty != "RSA" && jwk.Kty != "RSA-HSM" {
+		return nil, errors.Errorf("Key Vault key %q is a %s key, not an RSA key",
+			keyName, jwk.Kty)
+	}
+	n, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(jwk.N, "="))
+	if err != nil {
+		return nil, errors.Wrap(err, "Key Vault key modulus")
+	}
+	e, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(jwk.E, "="))
+	if err != nil {
+		return nil, errors.Wrap(err, "Key Vault key exponent")
+	}
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(n),
+		E: int(new(big.Int).SetBytes(e).Int64()),
+	}, nil
+}
+
+// runKMSDecryptCommand runs a command whose output is a decrypted key.
+func runKMSDecryptCommand(command string, input []byte, args ...string) (*crypto.Key, error) {
+	output, err := runKMSCommand(command, input, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer wipeBytes(output)
+	return crypto.NewFixedLengthKeyFromReader(bytes.NewReader(output), len(output))
+}
+
+// runKMSCommand runs one of the cloud providers' tools with input on stdin, and
+// returns its output.
+func runKMSCommand(command string, input []byte, args ...string) ([]byte, error) {
+	if _, err := exec.LookPath(command); err != nil {
+		util.Debug(err)
+		return nil, ErrNoKMSTool
+	}
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(command, args...)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	util.Debugf("%s %s: %v", command, strings.Join(args, " "), err)
+	if err == nil {
+		return stdout.Bytes(), nil
+	}
+	message := strings.TrimSpace(stderr.String())
+	util.Debug(message)
+	for _, accessDenied := range kmsAccessDeniedErrors {
+		if strings.Contains(message, accessDenied) {
+			return nil, ErrKMSAccessDenied
+		}
+	}
+	if message == "" {
+		return nil, errors.Wrap(err, command)
+	}
+	return nil, errors.Errorf("%s: %s", command, message)
+}
+
+// wipeBytes zeroes a buffer which held key material.
+func wipeBytes(buf []byte) {
+	for i := range buf {
+		buf[i] = 0
+	}
+}
@@ -0,0 +1,165 @@
+/*
+ * kms_test.go - tests for encrypting keys with cloud KMSs
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+
+	"github.com/google/fscrypt/crypto"
+	"github.com/google/fscrypt/metadata"
+)
+
+const (
+	testAWSKey   = "arn:aws:kms:eu-west-1:111122223333:key/1234abcd-12ab-34cd-56ef-1234567890ab"
+	testGCPKey   = "projects/p/locations/global/keyRings/r/cryptoKeys/k"
+	testAzureKey = "https://vault.vault.azure.net/keys/k/0123456789abcdef"
+)
+
+// fakeCommand replaces an external tool with a shell script.
+func fakeCommand(t *testing.T, command *string, script string) {
+	path := filepath.Join(t.TempDir(), filepath.Base(*command))
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+script+"\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	old := *command
+	*command = path
+	t.Cleanup(func() { *command = old })
+}
+
+func TestParseKMSKey(t *testing.T) {
+	tests := []struct {
+		name     string
+		provider kmsProvider
+		region   string
+	}{
+		{testAWSKey, awsKMS, "eu-west-1"},
+		{"arn:aws:kms:us-east-1:111122223333:alias/fscrypt", awsKMS, "us-east-1"},
+		{testGCPKey, gcpKMS, ""},
+		{testAzureKey, azureKeyVault, ""},
+	}
+	for _, test := range tests {
+		provider, region, err := parseKMSKey(test.name)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else if provider != test.provider || region != test.region {
+			t.Errorf("%s: got provider %d in %q", test.name, provider, region)
+		}
+	}
+	for _, name := range []string{"", "alias/fscrypt", "arn:aws:s3:::bucket",
+		"projects/p/locations/global/keyRings/r", "https://example.com/k"} {
+		if _, _, err := parseKMSKey(name); errors.Cause(err) != ErrUnknownKMSKey {
+			t.Errorf("%q: got error %v, expected %v", name, err, ErrUnknownKMSKey)
+		}
+	}
+}
+
+// Tests that keys encrypted with AWS KMS and GCP Cloud KMS are passed to and
+// from the tools on stdin and stdout, rather than on their command lines. The
+// fake tools "encrypt" by reversing the key.
+func TestKMSEncryptDecrypt(t *testing.T) {
+	fakeCommand(t, &awsCommand, `case "$*" in
+*"kms encrypt --region eu-west-1 --key-id `+testAWSKey+` --plaintext fileb:///dev/stdin"*)
+	rev | base64;;
+*"kms decrypt --region eu-west-1 --key-id `+testAWSKey+` --ciphertext-blob fileb:///dev/stdin"*)
+	rev | base64;;
+*) exit 1;;
+esac`)
+	fakeCommand(t, &gcloudCommand, `case "$*" in
+"kms encrypt --key `+testGCPKey+` --plaintext-file - --ciphertext-file -") rev;;
+"kms decrypt --key `+testGCPKey+` --ciphertext-file - --plaintext-file -") rev;;
+*) exit 1;;
+esac`)
+
+	// rev works on lines, so use a key without newlines.
+	key, err := crypto.NewFixedLengthKeyFromReader(
+		bytes.NewReader(bytes.Repeat([]byte("0123456789abcdef"), 2)),
+		metadata.InternalKeyLen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer key.Wipe()
+	for _, keyName := range []string{testAWSKey, testGCPKey} {
+		ciphertext, err := kmsTools{}.Encrypt(keyName, key)
+		if err != nil {
+			t.Fatalf("%s: %v", keyName, err)
+		}
+		if bytes.Contains(ciphertext, key.Data()) {
+			t.Errorf("%s: key wasn't encrypted", keyName)
+		}
+		decrypted, err := kmsTools{}.Decrypt(keyName, ciphertext)
+		if err != nil {
+			t.Fatalf("%s: %v", keyName, err)
+		}
+		if !decrypted.Equals(key) {
+			t.Errorf("%s: decrypted key differs from the encrypted key", keyName)
+		}
+		decrypted.Wipe()
+	}
+}
+
+// Tests that keys for Key Vault are encrypted with the public key of the vault
+// key.
+func TestKMSEncryptAzure(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fakeCommand(t, &azCommand, fmt.Sprintf(`[ "$*" = "keyvault key show --id %s --query key --output json" ] || exit 1
+echo '{"kty": "RSA-HSM", "n": "%s", "e": "%s"}'`, testAzureKey,
+		base64.RawURLEncoding.EncodeToString(privateKey.N.Bytes()),
+		base64.RawURLEncoding.EncodeToString(big.NewInt(int64(privateKey.E)).Bytes())))
+
+	key, err := crypto.NewRandomKey(metadata.InternalKeyLen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer key.Wipe()
+	ciphertext, err := kmsTools{}.Encrypt(testAzureKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decrypted, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, privateKey, ciphertext, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decrypted, key.Data()) {
+		t.Error("decrypted key differs from the encrypted key")
+	}
+}
+
+// Tests that disabled keys and missing permissions are reported as such.
+func TestKMSAccessDenied(t *testing.T) {
+	fakeCommand(t, &azCommand, `echo "ERROR: (Forbidden) The user, group or application does not have keys decrypt permission on key vault 'vault'" >&2
+exit 1`)
+	_, err := kmsTools{}.Decrypt(testAzureKey, []byte("ciphertext"))
+	if err != ErrKMSAccessDenied {
+		t.Errorf("got error %v, expected %v", err, ErrKMSAccessDenied)
+	}
+}
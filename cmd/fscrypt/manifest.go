@@ -0,0 +1,119 @@
+/*
+ * manifest.go - File which contains the functions for recording newly encrypted
+ * directories in a manifest file.
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/google/fscrypt/actions"
+)
+
+// manifestEntry is one line of the manifest written by "fscrypt encrypt
+// --manifest". It only describes the policy, so it contains nothing secret.
+type manifestEntry struct {
+	Path          string   `json:"path"`
+	Mountpoint    string   `json:"mountpoint"`
+	Policy        string   `json:"policy"`
+	PolicyVersion int64    `json:"policy_version"`
+	Contents      string   `json:"contents"`
+	Filenames     string   `json:"filenames"`
+	Padding       int64    `json:"padding"`
+	DataUnitSize  int64    `json:"data_unit_size,omitempty"`
+	NoDirectKey   bool     `json:"no_direct_key,omitempty"`
+	IVInoLblk64   bool     `json:"iv_ino_lblk_64,omitempty"`
+	IVInoLblk32   bool     `json:"iv_ino_lblk_32,omitempty"`
+	Protectors    []string `json:"protectors"`
+	Timestamp     string   `json:"timestamp"`
+}
+
+// newManifestEntry describes the policy of the encrypted directory at path,
+// which is given as an absolute path.
+func newManifestEntry(path string, policy *actions.Policy, now time.Time) *manifestEntry {
+	options := policy.Options()
+	return &manifestEntry{
+		Path:          path,
+		Mountpoint:    policy.Context.Mount.Path,
+		Policy:        policy.Descriptor(),
+		PolicyVersion: options.PolicyVersion,
+		Contents:      options.Contents.String(),
+		Filenames:     options.Filenames.String(),
+		Padding:       options.Padding,
+		DataUnitSize:  options.DataUnitSize,
+		NoDirectKey:   options.NoDirectKey,
+		IVInoLblk64:   options.IvInoLblk_64,
+		IVInoLblk32:   options.IvInoLblk_32,
+		Protectors:    policy.ProtectorDescriptors(),
+		Timestamp:     now.UTC().Format(time.RFC3339),
+	}
+}
+
+// appendManifestEntry appends entry to the manifest file as a single line of
+// JSON, creating the file if needed. The line is written with one write(), so
+// entries appended by several fscrypt processes don't get interleaved.
+func appendManifestEntry(manifestPath string, entry *manifestEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(manifestPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(append(line, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// describeEncryptedDir returns the manifest entry for the encrypted directory
+// at path. The policy is read back from the directory, so the entry describes
+// what was actually applied.
+func describeEncryptedDir(path string) (*manifestEntry, error) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	ctx, err := actions.NewContextFromPath(absPath, nil)
+	if err != nil {
+		return nil, err
+	}
+	policy, err := actions.GetPolicyFromPath(ctx, absPath)
+	if err != nil {
+		return nil, err
+	}
+	return newManifestEntry(absPath, policy, time.Now()), nil
+}
+
+// writeManifest records the newly encrypted directory at path in the manifest
+// file.
+func writeManifest(manifestPath string, path string) error {
+	entry, err := describeEncryptedDir(path)
+	if err == nil {
+		err = appendManifestEntry(manifestPath, entry)
+	}
+	return errors.Wrapf(err, "%q is encrypted, but it couldn't be recorded in %q",
+		path, manifestPath)
+}
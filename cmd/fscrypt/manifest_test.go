@@ -0,0 +1,66 @@
+/*
+ * manifest_test.go - tests for recording newly encrypted directories in a
+ * manifest file
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// Make sure each entry is appended to the manifest as its own line of JSON.
+func TestAppendManifestEntry(t *testing.T) {
+	manifestPath := filepath.Join(t.TempDir(), "manifest.jsonl")
+	entries := []*manifestEntry{
+		{Path: "/mnt/a", Mountpoint: "/mnt", Policy: "aaaa", PolicyVersion: 2,
+			Contents: "AES_256_XTS", Filenames: "AES_256_CTS", Padding: 32,
+			Protectors: []string{"1111"}, Timestamp: "2026-01-01T00:00:00Z"},
+		{Path: "/mnt/b", Mountpoint: "/mnt", Policy: "bbbb", PolicyVersion: 1,
+			Contents: "Adiantum", Filenames: "Adiantum", Padding: 16,
+			DataUnitSize: 4096, Protectors: []string{"2222", "3333"},
+			Timestamp: "2026-01-02T00:00:00Z"},
+	}
+	for _, entry := range entries {
+		if err := appendManifestEntry(manifestPath, entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	file, err := os.Open(manifestPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var read []*manifestEntry
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		entry := &manifestEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), entry); err != nil {
+			t.Fatalf("line %q isn't valid JSON: %v", scanner.Text(), err)
+		}
+		read = append(read, entry)
+	}
+	if !reflect.DeepEqual(read, entries) {
+		t.Errorf("read back %+v, expected %+v", read, entries)
+	}
+}
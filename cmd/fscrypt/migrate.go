@@ -0,0 +1,646 @@
+/*
+ * migrate.go - File which contains the functions for moving the contents of an
+ * unencrypted directory into a newly encrypted one.
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+	"golang.org/x/term"
+
+	"github.com/google/fscrypt/crypto"
+	"github.com/google/fscrypt/util"
+)
+
+// copyBufferSize is the size of the chunks in which files are compared and
+// overwritten.
+const copyBufferSize = 64 * 1024
+
+// checkMigrateSource returns an error if the contents of srcDir can't be
+// migrated into the directory dstDir (which need not exist yet).
+func checkMigrateSource(srcDir, dstDir string) error {
+	info, err := os.Stat(srcDir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return &ErrMigrateSource{srcDir, "it is not a directory"}
+	}
+
+	srcAbs, err := filepath.EvalSymlinks(srcDir)
+	if err != nil {
+		return err
+	}
+	if srcAbs, err = filepath.Abs(srcAbs); err != nil {
+		return err
+	}
+	// The destination may not exist yet, so resolve its parent instead.
+	dstParent, err := filepath.EvalSymlinks(filepath.Dir(dstDir))
+	if err != nil {
+		return err
+	}
+	dstAbs, err := filepath.Abs(filepath.Join(dstParent, filepath.Base(dstDir)))
+	if err != nil {
+		return err
+	}
+	if dstAbs == srcAbs || strings.HasPrefix(dstAbs, srcAbs+"/") {
+		return &ErrMigrateSource{srcDir, fmt.Sprintf("%q is inside it", dstDir)}
+	}
+	return nil
+}
+
+// migrateFiles copies the contents of srcDir into the encrypted and unlocked
+// directory dstDir, verifies the copy, and only then securely deletes srcDir.
+// If copying or verifying fails, nothing is deleted.
+func migrateFiles(srcDir, dstDir string) error {
+	if err := copyAndVerifyTree(srcDir, dstDir, false); err != nil {
+		return err
+	}
+	util.Debugf("securely deleting %q", srcDir)
+	return shredTree(srcDir)
+}
+
+// migrateInPlace copies the contents of dir into the encrypted and unlocked
+// directory encryptedDir (its sibling from migrationSibling), verifies the copy,
+// and then atomically exchanges the names of the two directories, so that dir
+// is encrypted from then on. Only then are the originals, now at encryptedDir,
+// securely deleted. If anything fails before the exchange, nothing is deleted.
+func migrateInPlace(dir, encryptedDir string) error {
+	if err := copyAndVerifyTree(dir, encryptedDir, false); err != nil {
+		return err
+	}
+	if err := exchangeDirs(dir, encryptedDir); err != nil {
+		return &ErrMigrateFailed{dir, encryptedDir, err}
+	}
+	util.Debugf("securely deleting %q", encryptedDir)
+	if err := shredTree(encryptedDir); err != nil {
+		return errors.Wrapf(err, "%q is now encrypted, but securely deleting the originals in %q failed",
+			dir, encryptedDir)
+	}
+	return nil
+}
+
+// migrationSibling returns the path of the hidden directory next to dir into
+// which its contents are copied when it is migrated in place.
+func migrationSibling(dir string) string {
+	dir = filepath.Clean(dir)
+	return filepath.Join(filepath.Dir(dir), "."+filepath.Base(dir)+".fscrypt-migrate")
+}
+
+// exchangeDirs atomically exchanges the names of two directories.
+func exchangeDirs(dir1, dir2 string) error {
+	util.Debugf("exchanging %q and %q", dir1, dir2)
+	err := unix.Renameat2(unix.AT_FDCWD, dir1, unix.AT_FDCWD, dir2, unix.RENAME_EXCHANGE)
+	if err != nil {
+		return &os.LinkError{Op: "exchange", Old: dir1, New: dir2, Err: err}
+	}
+	return nil
+}
+
+// copyOwner gives the directory dstDir the owner and group of srcDir.
+func copyOwner(srcDir, dstDir string) error {
+	info, err := os.Stat(srcDir)
+	if err != nil {
+		return err
+	}
+	stat := info.Sys().(*syscall.Stat_t)
+	return os.Chown(dstDir, int(stat.Uid), int(stat.Gid))
+}
+
+// copyAndVerifyTree copies the contents of srcDir into dstDir, reporting the
+// progress on a terminal, and verifies the copy. If resume is set, the copies
+// already in dstDir from an interrupted run are kept if they are complete.
+func copyAndVerifyTree(srcDir, dstDir string, resume bool) error {
+	progress, err := newCopyProgress(srcDir)
+	if err != nil {
+		return &ErrMigrateFailed{srcDir, dstDir, err}
+	}
+	util.Debugf("copying the contents of %q into %q", srcDir, dstDir)
+	err = copyTree(srcDir, dstDir, progress, resume)
+	progress.done()
+	if err != nil {
+		return &ErrMigrateFailed{srcDir, dstDir, err}
+	}
+	// Make sure the copy is on disk before the originals are gone.
+	unix.Sync()
+
+	util.Debugf("verifying the copy of %q in %q", srcDir, dstDir)
+	if err := verifyTree(srcDir, dstDir); err != nil {
+		return &ErrMigrateFailed{srcDir, dstDir, err}
+	}
+	return nil
+}
+
+// copyProgress reports how much of a directory tree has been copied on
+// standard error. A nil copyProgress reports nothing.
+type copyProgress struct {
+	totalFiles, totalBytes int64
+	files, bytes           int64
+	lastReport             time.Time
+}
+
+// progressInterval is how often the copy progress is updated.
+const progressInterval = 200 * time.Millisecond
+
+// newCopyProgress counts the files in dir, so that the progress of copying them
+// can be reported. It returns nil if standard error isn't a terminal, or if
+// quietFlag is set.
+func newCopyProgress(dir string) (*copyProgress, error) {
+	if quietFlag.Value || !term.IsTerminal(int(os.Stderr.Fd())) {
+		return nil, nil
+	}
+	progress := &copyProgress{}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path != dir {
+			progress.totalFiles++
+			if info.Mode().IsRegular() {
+				progress.totalBytes += info.Size()
+			}
+		}
+		return nil
+	})
+	return progress, err
+}
+
+// add records that a file of the given size has been copied.
+func (progress *copyProgress) add(size int64) {
+	if progress == nil {
+		return
+	}
+	progress.files++
+	progress.bytes += size
+	if now := time.Now(); now.Sub(progress.lastReport) >= progressInterval {
+		progress.lastReport = now
+		progress.report()
+	}
+}
+
+// done reports the final progress and ends the line.
+func (progress *copyProgress) done() {
+	if progress == nil {
+		return
+	}
+	progress.report()
+	fmt.Fprintln(os.Stderr)
+}
+
+func (progress *copyProgress) report() {
+	fmt.Fprintf(os.Stderr, "\rCopied %d of %d files (%s of %s)", progress.files,
+		progress.totalFiles, formatSize(progress.bytes), formatSize(progress.totalBytes))
+}
+
+// formatSize formats a number of bytes with a binary unit.
+func formatSize(bytes int64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%d B", bytes)
+	}
+	value := float64(bytes) / unit
+	for _, prefix := range []string{"Ki", "Mi", "Gi", "Ti"} {
+		if value < unit || prefix == "Ti" {
+			return fmt.Sprintf("%.1f %sB", value, prefix)
+		}
+		value /= unit
+	}
+	panic("unreachable")
+}
+
+// copyTree recursively copies the contents of srcDir into the existing
+// directory dstDir, preserving the type, mode, ownership, extended attributes
+// (including ACLs), and timestamps of each file, and the holes in sparse files.
+// Hard links are copied as separate files, and special files (such as device
+// nodes and sockets) aren't supported. If resume is set, dstDir may already
+// contain some of the copies, as left behind by an interrupted copyTree.
+func copyTree(srcDir, dstDir string, progress *copyProgress, resume bool) error {
+	type dirInfo struct {
+		srcPath, path string
+		info          os.FileInfo
+	}
+	var dirs []dirInfo
+
+	err := filepath.Walk(srcDir, func(srcPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(srcDir, srcPath)
+		if err != nil || relPath == "." {
+			return err
+		}
+		dstPath := filepath.Join(dstDir, relPath)
+		if resume {
+			if done, err := resumeCopy(dstPath, info); err != nil {
+				return err
+			} else if done && info.IsDir() {
+				dirs = append(dirs, dirInfo{srcPath, dstPath, info})
+				progress.add(0)
+				return nil
+			} else if done {
+				progress.add(info.Size())
+				return nil
+			}
+		}
+
+		switch mode := info.Mode(); {
+		case mode.IsDir():
+			// A directory's metadata is set once its contents have
+			// been copied, as they would change its mtime and could
+			// need it to be writable.
+			dirs = append(dirs, dirInfo{srcPath, dstPath, info})
+			progress.add(0)
+			return os.Mkdir(dstPath, 0700)
+		case mode.IsRegular():
+			err = copyFile(srcPath, dstPath, info.Size())
+		case mode&os.ModeSymlink != 0:
+			var target string
+			if target, err = os.Readlink(srcPath); err == nil {
+				err = os.Symlink(target, dstPath)
+			}
+		default:
+			return fmt.Errorf("%q is a special file, which can't be migrated", srcPath)
+		}
+		if err != nil {
+			return err
+		}
+		progress.add(info.Size())
+		return copyMetadata(srcPath, dstPath, info)
+	})
+	if err != nil {
+		return err
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := copyMetadata(dirs[i].srcPath, dirs[i].path, dirs[i].info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resumeCopy prepares dstPath for copying the file described by info into it,
+// when dstPath may hold a copy from an interrupted copyTree. It returns true if
+// nothing needs to be created: either dstPath is a complete copy (its
+// timestamps are set last), or it is a directory, which is made writable again
+// as its metadata is only set once its contents have been copied. Anything
+// else at dstPath is removed.
+func resumeCopy(dstPath string, info os.FileInfo) (bool, error) {
+	dstInfo, err := os.Lstat(dstPath)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if info.IsDir() && dstInfo.IsDir() {
+		return true, os.Chmod(dstPath, 0700)
+	}
+	if !info.IsDir() && dstInfo.Mode() == info.Mode() &&
+		dstInfo.Size() == info.Size() && dstInfo.ModTime().Equal(info.ModTime()) {
+		return true, nil
+	}
+	util.Debugf("removing incomplete copy %q", dstPath)
+	return false, os.RemoveAll(dstPath)
+}
+
+// copyFile copies the contents of the regular file srcPath, which has the given
+// size, to the new file dstPath. Only the data regions of a sparse file are
+// copied, so that its holes are preserved.
+func copyFile(srcPath, dstPath string, size int64) error {
+	srcFile, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+
+	dstFile, err := os.OpenFile(dstPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if err = copyData(dstFile, srcFile, size); err != nil {
+		dstFile.Close()
+		return err
+	}
+	return dstFile.Close()
+}
+
+// copyData copies size bytes from src to dst, skipping the holes in src.
+func copyData(dst, src *os.File, size int64) error {
+	for offset := int64(0); offset < size; {
+		start, end, err := nextDataRegion(src, offset, size)
+		if err != nil {
+			return err
+		}
+		if start == size {
+			break
+		}
+		if _, err = src.Seek(start, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err = dst.Seek(start, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err = io.CopyN(dst, src, end-start); err != nil {
+			return err
+		}
+		offset = end
+	}
+	// Extend the copy over any hole at the end.
+	return dst.Truncate(size)
+}
+
+// nextDataRegion returns the start and end of the first region of data at or
+// after offset in file, which has the given size. If only a hole remains, start
+// and end are size. If the filesystem can't report holes, the rest of the file
+// is treated as data.
+func nextDataRegion(file *os.File, offset, size int64) (start, end int64, err error) {
+	start, err = file.Seek(offset, unix.SEEK_DATA)
+	if errors.Is(err, unix.ENXIO) {
+		return size, size, nil
+	}
+	if errors.Is(err, unix.EINVAL) {
+		return offset, size, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	if end, err = file.Seek(start, unix.SEEK_HOLE); err != nil {
+		return 0, 0, err
+	}
+	return start, util.MinInt64(end, size), nil
+}
+
+// copyMetadata gives dstPath the ownership, mode, and timestamps from info, and
+// the extended attributes of srcPath.
+func copyMetadata(srcPath, dstPath string, info os.FileInfo) error {
+	stat := info.Sys().(*syscall.Stat_t)
+	if err := os.Lchown(dstPath, int(stat.Uid), int(stat.Gid)); err != nil {
+		return err
+	}
+	// Symlinks don't have a mode of their own. For everything else, the
+	// mode must be set after the owner, since chown clears setuid.
+	if info.Mode()&os.ModeSymlink == 0 {
+		if err := os.Chmod(dstPath, info.Mode()); err != nil {
+			return err
+		}
+	}
+	// ACLs are set after the mode, which would otherwise change them.
+	if err := copyXattrs(srcPath, dstPath); err != nil {
+		return err
+	}
+	times := []unix.Timespec{
+		unix.NsecToTimespec(syscall.TimespecToNsec(stat.Atim)),
+		unix.NsecToTimespec(syscall.TimespecToNsec(stat.Mtim)),
+	}
+	return unix.UtimesNanoAt(unix.AT_FDCWD, dstPath, times, unix.AT_SYMLINK_NOFOLLOW)
+}
+
+// skippedXattrs are the extended attributes which aren't copied, since the
+// system sets them on the copy itself.
+var skippedXattrs = map[string]bool{"security.selinux": true}
+
+// getXattrs returns the extended attributes of path (not following symlinks).
+func getXattrs(path string) (map[string][]byte, error) {
+	size, err := unix.Llistxattr(path, nil)
+	if err == unix.ENOTSUP {
+		return nil, nil
+	}
+	if err != nil || size == 0 {
+		return nil, err
+	}
+	list := make([]byte, size)
+	if size, err = unix.Llistxattr(path, list); err != nil {
+		return nil, err
+	}
+	xattrs := make(map[string][]byte)
+	for _, name := range strings.Split(string(list[:size]), "\x00") {
+		if name == "" || skippedXattrs[name] {
+			continue
+		}
+		valueSize, err := unix.Lgetxattr(path, name, nil)
+		if err != nil {
+			return nil, errors.Wrapf(err, "reading xattr %s of %q", name, path)
+		}
+		value := make([]byte, valueSize)
+		if valueSize, err = unix.Lgetxattr(path, name, value); err != nil {
+			return nil, errors.Wrapf(err, "reading xattr %s of %q", name, path)
+		}
+		xattrs[name] = value[:valueSize]
+	}
+	return xattrs, nil
+}
+
+// copyXattrs copies the extended attributes of srcPath to dstPath.
+func copyXattrs(srcPath, dstPath string) error {
+	xattrs, err := getXattrs(srcPath)
+	if err != nil {
+		return err
+	}
+	for name, value := range xattrs {
+		if err = unix.Lsetxattr(dstPath, name, value, 0); err != nil {
+			return errors.Wrapf(err, "setting xattr %s of %q", name, dstPath)
+		}
+	}
+	return nil
+}
+
+// verifyTree checks that every file in srcDir has an identical copy in dstDir,
+// with the same type, mode, and contents (or symlink target).
+func verifyTree(srcDir, dstDir string) error {
+	return filepath.Walk(srcDir, func(srcPath string, srcInfo os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(srcDir, srcPath)
+		if err != nil || relPath == "." {
+			return err
+		}
+		dstPath := filepath.Join(dstDir, relPath)
+		dstInfo, err := os.Lstat(dstPath)
+		if err != nil {
+			return err
+		}
+		if srcInfo.Mode() != dstInfo.Mode() {
+			return fmt.Errorf("%q has mode %v, but its copy has mode %v",
+				srcPath, srcInfo.Mode(), dstInfo.Mode())
+		}
+		if err = compareXattrs(srcPath, dstPath); err != nil {
+			return err
+		}
+
+		switch mode := srcInfo.Mode(); {
+		case mode.IsRegular():
+			if srcInfo.Size() != dstInfo.Size() {
+				return fmt.Errorf("%q has size %d, but its copy has size %d",
+					srcPath, srcInfo.Size(), dstInfo.Size())
+			}
+			return compareFiles(srcPath, dstPath)
+		case mode&os.ModeSymlink != 0:
+			srcTarget, err := os.Readlink(srcPath)
+			if err != nil {
+				return err
+			}
+			dstTarget, err := os.Readlink(dstPath)
+			if err != nil {
+				return err
+			}
+			if srcTarget != dstTarget {
+				return fmt.Errorf("symlink %q points to %q, but its copy points to %q",
+					srcPath, srcTarget, dstTarget)
+			}
+		}
+		return nil
+	})
+}
+
+// compareXattrs returns an error if two files have different extended
+// attributes.
+func compareXattrs(path1, path2 string) error {
+	xattrs1, err := getXattrs(path1)
+	if err != nil {
+		return err
+	}
+	xattrs2, err := getXattrs(path2)
+	if err != nil {
+		return err
+	}
+	if len(xattrs1) != len(xattrs2) {
+		return fmt.Errorf("%q has %d extended attributes, but its copy has %d",
+			path1, len(xattrs1), len(xattrs2))
+	}
+	for name, value := range xattrs1 {
+		if !bytes.Equal(value, xattrs2[name]) {
+			return fmt.Errorf("the copy of %q has a different %s attribute", path1, name)
+		}
+	}
+	return nil
+}
+
+// compareFiles returns an error if the contents of two regular files differ.
+func compareFiles(path1, path2 string) error {
+	file1, err := os.Open(path1)
+	if err != nil {
+		return err
+	}
+	defer file1.Close()
+	file2, err := os.Open(path2)
+	if err != nil {
+		return err
+	}
+	defer file2.Close()
+
+	buf1 := make([]byte, copyBufferSize)
+	buf2 := make([]byte, copyBufferSize)
+	for {
+		n1, err1 := io.ReadFull(file1, buf1)
+		n2, err2 := io.ReadFull(file2, buf2)
+		if !bytes.Equal(buf1[:n1], buf2[:n2]) {
+			return fmt.Errorf("the copy of %q has different contents", path1)
+		}
+		if err1 == io.EOF || err1 == io.ErrUnexpectedEOF {
+			if err2 != err1 {
+				return fmt.Errorf("the copy of %q has different contents", path1)
+			}
+			return nil
+		}
+		if err1 != nil {
+			return err1
+		}
+		if err2 != nil {
+			return err2
+		}
+	}
+}
+
+// shredTree overwrites every regular file in dir with random data and then
+// deletes dir. Files with other hard links are only unlinked, since
+// overwriting them would destroy data outside of dir.
+func shredTree(dir string) error {
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			// Read-only directories must be made writable so that
+			// their entries can be removed.
+			return os.Chmod(path, 0700)
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		if info.Sys().(*syscall.Stat_t).Nlink > 1 {
+			util.Debugf("not overwriting %q since it has other hard links", path)
+			return nil
+		}
+		return overwriteFile(path, info.Size())
+	})
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
+
+// overwriteFile replaces the first size bytes of the file at path with random
+// data and syncs it to disk. Holes in sparse files don't hold any data, so
+// they are left alone rather than filled.
+func overwriteFile(path string, size int64) error {
+	// The file is about to be deleted, so it doesn't matter if it wasn't
+	// writable before.
+	if err := os.Chmod(path, 0600); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	for offset := int64(0); offset < size; {
+		start, end, err := nextDataRegion(file, offset, size)
+		if err != nil {
+			return err
+		}
+		if start == size {
+			break
+		}
+		if _, err = file.Seek(start, io.SeekStart); err != nil {
+			return err
+		}
+		for offset = start; offset < end; {
+			chunk, err := crypto.NewRandomBuffer(int(util.MinInt64(end-offset, copyBufferSize)))
+			if err != nil {
+				return err
+			}
+			if _, err = file.Write(chunk); err != nil {
+				return err
+			}
+			offset += int64(len(chunk))
+		}
+	}
+	return file.Sync()
+}
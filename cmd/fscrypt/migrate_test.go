@@ -0,0 +1,261 @@
+/*
+ * migrate_test.go - tests for moving the contents of a directory into a newly
+ * encrypted one
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// makeSourceTree creates a directory tree to migrate in a new temporary
+// directory, and returns the paths of the tree and of an empty destination.
+func makeSourceTree(t *testing.T) (srcDir, dstDir string) {
+	tempDir := t.TempDir()
+	srcDir = filepath.Join(tempDir, "src")
+	dstDir = filepath.Join(tempDir, "dst")
+	for _, dir := range []string{srcDir, dstDir, filepath.Join(srcDir, "subdir")} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files := map[string][]byte{
+		"empty":          nil,
+		"small":          []byte("hello"),
+		"subdir/large":   bytes.Repeat([]byte("x"), 3*copyBufferSize+1),
+		"subdir/private": []byte("secret"),
+	}
+	for name, contents := range files {
+		if err := os.WriteFile(filepath.Join(srcDir, name), contents, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Chmod(filepath.Join(srcDir, "subdir/private"), 0400); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("subdir/large", filepath.Join(srcDir, "link")); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := os.Chtimes(filepath.Join(srcDir, "small"), mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filepath.Join(srcDir, "subdir"), 0500); err != nil {
+		t.Fatal(err)
+	}
+	return srcDir, dstDir
+}
+
+// Tests that the files are copied with their metadata, verified, and that the
+// originals are then removed.
+func TestMigrateFiles(t *testing.T) {
+	srcDir, dstDir := makeSourceTree(t)
+	defer os.Chmod(filepath.Join(srcDir, "subdir"), 0700)
+	defer os.Chmod(filepath.Join(dstDir, "subdir"), 0700)
+	if err := copyTree(srcDir, dstDir, nil, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyTree(srcDir, dstDir); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(filepath.Join(dstDir, "small"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if year := info.ModTime().UTC().Year(); year != 2020 {
+		t.Errorf("mtime was not preserved (year is %d)", year)
+	}
+	if info, err = os.Stat(filepath.Join(dstDir, "subdir")); err != nil {
+		t.Fatal(err)
+	} else if info.Mode().Perm() != 0500 {
+		t.Errorf("directory mode was not preserved (mode is %v)", info.Mode())
+	}
+
+	if err = shredTree(srcDir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Lstat(srcDir); !os.IsNotExist(err) {
+		t.Errorf("%q still exists after shredding", srcDir)
+	}
+	contents, err := os.ReadFile(filepath.Join(dstDir, "link"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(contents) != 3*copyBufferSize+1 {
+		t.Errorf("copy of large file has %d bytes", len(contents))
+	}
+}
+
+// Tests that verification catches a copy which differs from the original.
+func TestVerifyTreeMismatch(t *testing.T) {
+	srcDir, dstDir := makeSourceTree(t)
+	defer os.Chmod(filepath.Join(srcDir, "subdir"), 0700)
+	defer os.Chmod(filepath.Join(dstDir, "subdir"), 0700)
+	if err := copyTree(srcDir, dstDir, nil, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// Change a single byte without changing the size.
+	file, err := os.OpenFile(filepath.Join(dstDir, "small"), os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = file.WriteAt([]byte("J"), 0)
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = verifyTree(srcDir, dstDir); err == nil {
+		t.Error("verification should have failed")
+	}
+}
+
+// Tests that nothing is deleted if the copy fails partway through.
+func TestMigrateFilesCopyFailure(t *testing.T) {
+	srcDir, dstDir := makeSourceTree(t)
+	defer os.Chmod(filepath.Join(srcDir, "subdir"), 0700)
+	defer os.Chmod(filepath.Join(dstDir, "subdir"), 0700)
+	// Special files can't be migrated.
+	if err := unix.Mkfifo(filepath.Join(srcDir, "zz-fifo"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	err := migrateFiles(srcDir, dstDir)
+	if _, ok := err.(*ErrMigrateFailed); !ok {
+		t.Fatalf("expected ErrMigrateFailed, got %v", err)
+	}
+	contents, err := os.ReadFile(filepath.Join(srcDir, "small"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(contents) != "hello" {
+		t.Errorf("original file was modified: %q", contents)
+	}
+}
+
+// Tests that a directory can't be migrated into itself.
+func TestCheckMigrateSource(t *testing.T) {
+	srcDir, _ := makeSourceTree(t)
+	defer os.Chmod(filepath.Join(srcDir, "subdir"), 0700)
+
+	if err := checkMigrateSource(srcDir, filepath.Join(filepath.Dir(srcDir), "new")); err != nil {
+		t.Error(err)
+	}
+	if err := checkMigrateSource(srcDir, filepath.Join(srcDir, "new")); err == nil {
+		t.Error("migrating a directory into itself should fail")
+	}
+	if err := checkMigrateSource(srcDir, srcDir); err == nil {
+		t.Error("migrating a directory onto itself should fail")
+	}
+	if err := checkMigrateSource(filepath.Join(srcDir, "small"), filepath.Join(srcDir, "new")); err == nil {
+		t.Error("migrating a regular file should fail")
+	}
+}
+
+// Tests that the holes in sparse files and extended attributes are preserved.
+func TestCopyTreeSparseAndXattrs(t *testing.T) {
+	srcDir, dstDir := makeSourceTree(t)
+	defer os.Chmod(filepath.Join(srcDir, "subdir"), 0700)
+	defer os.Chmod(filepath.Join(dstDir, "subdir"), 0700)
+
+	sparsePath := filepath.Join(srcDir, "sparse")
+	file, err := os.Create(sparsePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = file.WriteAt([]byte("data"), 1<<24)
+	if err == nil {
+		err = file.Truncate(1 << 25)
+	}
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = unix.Lsetxattr(filepath.Join(srcDir, "small"), "user.test", []byte("value"), 0)
+	if err == unix.ENOTSUP {
+		t.Skip(err)
+	} else if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = copyTree(srcDir, dstDir, nil, false); err != nil {
+		t.Fatal(err)
+	}
+	if err = verifyTree(srcDir, dstDir); err != nil {
+		t.Fatal(err)
+	}
+	var stat unix.Stat_t
+	if err = unix.Stat(filepath.Join(dstDir, "sparse"), &stat); err != nil {
+		t.Fatal(err)
+	}
+	if stat.Blocks*512 >= stat.Size {
+		t.Errorf("copy of sparse file isn't sparse (%d blocks)", stat.Blocks)
+	}
+	value := make([]byte, 16)
+	size, err := unix.Lgetxattr(filepath.Join(dstDir, "small"), "user.test", value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value[:size]) != "value" {
+		t.Errorf("xattr was not preserved (value is %q)", value[:size])
+	}
+}
+
+// Tests that migrating in place swaps the copy into the directory's place and
+// removes the originals.
+func TestMigrateInPlace(t *testing.T) {
+	srcDir, _ := makeSourceTree(t)
+	defer os.Chmod(filepath.Join(srcDir, "subdir"), 0700)
+	sibling := migrationSibling(srcDir + "/")
+	if filepath.Dir(sibling) != filepath.Dir(srcDir) {
+		t.Fatalf("%q isn't next to %q", sibling, srcDir)
+	}
+	if err := os.Mkdir(sibling, 0700); err != nil {
+		t.Fatal(err)
+	}
+	marker := filepath.Join(sibling, "zz-marker")
+	if err := os.WriteFile(marker, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := migrateInPlace(srcDir, sibling); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(sibling); !os.IsNotExist(err) {
+		t.Errorf("%q still exists after migrating", sibling)
+	}
+	// The directory now is the one which the files were copied into.
+	if _, err := os.Lstat(filepath.Join(srcDir, "zz-marker")); err != nil {
+		t.Error(err)
+	}
+	contents, err := os.ReadFile(filepath.Join(srcDir, "small"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(contents) != "hello" {
+		t.Errorf("migrated file has contents %q", contents)
+	}
+}
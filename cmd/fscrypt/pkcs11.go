@@ -0,0 +1,161 @@
+/*
+ * pkcs11.go - Using the key pairs of pkcs11 protectors on PKCS#11 tokens, such
+ * as smartcards and HSMs.
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/google/fscrypt/actions"
+	"github.com/google/fscrypt/crypto"
+	"github.com/google/fscrypt/util"
+)
+
+// Tokens are accessed with OpenSC's pkcs11-tool, which loads the PKCS#11
+// module, so fscrypt doesn't link against it.
+var pkcs11ToolCommand = "pkcs11-tool"
+
+// pkcs11PINVariable is the environment variable through which the PIN is passed
+// to pkcs11-tool, so that it doesn't appear on its command line.
+const pkcs11PINVariable = "FSCRYPT_PKCS11_PIN"
+
+// pkcs11Tool is the actions.PKCS11Token used by the fscrypt command.
+type pkcs11Tool struct{}
+
+func (pkcs11Tool) FindKey(module, slot, keyID string) (*actions.PKCS11Key, error) {
+	key := &actions.PKCS11Key{Module: module, Slot: slot}
+	if keyID == "" {
+		output, err := runPKCS11Tool(key, nil, "--list-objects", "--type", "pubkey")
+		if err != nil {
+			return nil, err
+		}
+		if keyID = firstPKCS11KeyID(string(output)); keyID == "" {
+			return nil, ErrNoPKCS11Key
+		}
+	}
+	var err error
+	if key.ID, err = hex.DecodeString(keyID); err != nil {
+		return nil, errors.Wrapf(err, "invalid PKCS#11 key ID %q", keyID)
+	}
+	util.Debugf("using PKCS#11 key %x", key.ID)
+	key.PublicKey, err = runPKCS11Tool(key, nil, "--read-object",
+		"--type", "pubkey", "--id", keyID)
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func (pkcs11Tool) Decrypt(info actions.ProtectorInfo, pin *crypto.Key, data []byte) (*crypto.Key, error) {
+	return runPKCS11PrivateKeyOperation(info.PKCS11Key(), pin, data, "--decrypt",
+		"--mechanism", "RSA-PKCS-OAEP", "--hash-algorithm", "SHA256",
+		"--mgf", "MGF1-SHA256")
+}
+
+func (pkcs11Tool) Derive(info actions.ProtectorInfo, pin *crypto.Key, peer []byte) (*crypto.Key, error) {
+	return runPKCS11PrivateKeyOperation(info.PKCS11Key(), pin, peer, "--derive",
+		"--mechanism", "ECDH1-DERIVE")
+}
+
+// firstPKCS11KeyID returns the ID of the first object in the output of
+// "pkcs11-tool --list-objects", in which each object has a line like
+// "  ID:         01".
+func firstPKCS11KeyID(output string) string {
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "ID:" {
+			return fields[1]
+		}
+	}
+	return ""
+}
+
+// runPKCS11PrivateKeyOperation logs into the token with pin and uses the private
+// key to decrypt or derive from input, which is passed in a temporary file.
+func runPKCS11PrivateKeyOperation(key *actions.PKCS11Key, pin *crypto.Key,
+	input []byte, args ...string) (*crypto.Key, error) {
+	dir, err := os.MkdirTemp("", "fscrypt-pkcs11-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	inputFile := filepath.Join(dir, "input")
+	if err = os.WriteFile(inputFile, input, 0600); err != nil {
+		return nil, err
+	}
+
+	args = append(args, "--id", hex.EncodeToString(key.ID), "--input-file", inputFile)
+	output, err := runPKCS11Tool(key, pin, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for i := range output {
+			output[i] = 0
+		}
+	}()
+	return crypto.NewFixedLengthKeyFromReader(bytes.NewReader(output), len(output))
+}
+
+// runPKCS11Tool runs pkcs11-tool with the module and slot of key, logging in
+// with pin if it isn't nil, and returns its output.
+func runPKCS11Tool(key *actions.PKCS11Key, pin *crypto.Key, args ...string) ([]byte, error) {
+	if _, err := exec.LookPath(pkcs11ToolCommand); err != nil {
+		util.Debug(err)
+		return nil, ErrNoPKCS11Tool
+	}
+	args = append([]string{"--module", key.Module}, args...)
+	if key.Slot != "" {
+		args = append(args, "--slot", key.Slot)
+	}
+	cmd := exec.Command(pkcs11ToolCommand, args...)
+	if pin != nil {
+		cmd.Args = append(cmd.Args, "--login", "--pin", "env:"+pkcs11PINVariable)
+		cmd.Env = append(os.Environ(), pkcs11PINVariable+"="+string(pin.Data()))
+	}
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	util.Debugf("%s %s: %v", pkcs11ToolCommand, strings.Join(args, " "), err)
+	if err == nil {
+		return stdout.Bytes(), nil
+	}
+	message := strings.TrimSpace(stderr.String())
+	switch {
+	case strings.Contains(message, "CKR_PIN_INCORRECT"):
+		return nil, actions.ErrIncorrectPIN
+	case strings.Contains(message, "CKR_PIN_LOCKED"):
+		return nil, ErrPKCS11PINLocked
+	case strings.Contains(message, "No slot with a token"),
+		strings.Contains(message, "CKR_TOKEN_NOT_PRESENT"):
+		return nil, ErrPKCS11TokenAbsent
+	case message == "":
+		return nil, errors.Wrap(err, pkcs11ToolCommand)
+	default:
+		return nil, errors.Errorf("%s: %s", pkcs11ToolCommand, message)
+	}
+}
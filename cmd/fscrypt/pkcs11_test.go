@@ -0,0 +1,108 @@
+/*
+ * pkcs11_test.go - tests for using key pairs on PKCS#11 tokens
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/fscrypt/actions"
+	"github.com/google/fscrypt/crypto"
+)
+
+const testObjectList = `Public Key Object; RSA 2048 bits
+  label:      fscrypt
+  ID:         a1b2
+  Usage:      encrypt, verify, wrap
+  Access:     local
+Public Key Object; EC  EC_POINT 256 bits
+  label:      other
+  ID:         03
+`
+
+// fakePKCS11Tool replaces pkcs11-tool with a shell script.
+func fakePKCS11Tool(t *testing.T, script string) {
+	path := filepath.Join(t.TempDir(), "pkcs11-tool")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+script+"\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	old := pkcs11ToolCommand
+	pkcs11ToolCommand = path
+	t.Cleanup(func() { pkcs11ToolCommand = old })
+}
+
+// Tests that the first key pair on the token is used if no key ID is given.
+func TestPKCS11FindKey(t *testing.T) {
+	fakePKCS11Tool(t, `case "$*" in
+*--list-objects*) echo '`+testObjectList+`';;
+*"--read-object --type pubkey --id a1b2 --slot 2") printf DER;;
+*) exit 1;;
+esac`)
+	key, err := pkcs11Tool{}.FindKey("/usr/lib/opensc-pkcs11.so", "2", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(key.ID, []byte{0xa1, 0xb2}) || string(key.PublicKey) != "DER" {
+		t.Errorf("got key %x with public key %q", key.ID, key.PublicKey)
+	}
+
+	fakePKCS11Tool(t, "true")
+	if _, err = (pkcs11Tool{}).FindKey("/usr/lib/opensc-pkcs11.so", "", ""); err != ErrNoPKCS11Key {
+		t.Errorf("got error %v, expected %v", err, ErrNoPKCS11Key)
+	}
+}
+
+// Tests that the PIN is passed in the environment rather than on the command
+// line, and that an incorrect PIN is reported as such.
+func TestPKCS11Decrypt(t *testing.T) {
+	fakePKCS11Tool(t, `case "$*" in
+*--pin*1234*) exit 1;;
+*"--pin env:FSCRYPT_PKCS11_PIN"*) ;;
+*) exit 1;;
+esac
+[ "$FSCRYPT_PKCS11_PIN" = 1234 ] || {
+	echo 'error: PKCS11 function C_Login failed: rv = CKR_PIN_INCORRECT (0xa0)' >&2
+	exit 1
+}
+printf 0123456789abcdef0123456789abcdef`)
+	info := actions.ProtectorInfo{}
+	for _, test := range []struct {
+		pin      string
+		expected error
+	}{{"1234", nil}, {"0000", actions.ErrIncorrectPIN}} {
+		pin, err := crypto.NewFixedLengthKeyFromReader(bytes.NewReader([]byte(test.pin)), len(test.pin))
+		if err != nil {
+			t.Fatal(err)
+		}
+		key, err := pkcs11Tool{}.Decrypt(info, pin, []byte("ciphertext"))
+		pin.Wipe()
+		if err != test.expected {
+			t.Errorf("PIN %s: got error %v, expected %v", test.pin, err, test.expected)
+			continue
+		}
+		if err == nil {
+			if string(key.Data()) != "0123456789abcdef0123456789abcdef" {
+				t.Errorf("got key %q", key.Data())
+			}
+			key.Wipe()
+		}
+	}
+}
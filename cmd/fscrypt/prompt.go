@@ -21,11 +21,11 @@ package main
 
 import (
 	"fmt"
-	"log"
 	"os"
 	"os/user"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 
@@ -42,9 +42,44 @@ const (
 
 // Descriptions for each of the protector sources
 var sourceDescriptions = map[metadata.SourceType]string{
-	metadata.SourceType_pam_passphrase:    "Your login passphrase",
-	metadata.SourceType_custom_passphrase: "A custom passphrase",
-	metadata.SourceType_raw_key:           "A raw 256-bit key",
+	metadata.SourceType_pam_passphrase:         "Your login passphrase",
+	metadata.SourceType_custom_passphrase:      "A custom passphrase",
+	metadata.SourceType_raw_key:                "A raw 256-bit key",
+	metadata.SourceType_fido2:                  "A FIDO2 security key, e.g. a YubiKey",
+	metadata.SourceType_tpm2:                   "A key sealed by this machine's TPM",
+	metadata.SourceType_pkcs11:                 "A key pair on a PKCS#11 smartcard or HSM",
+	metadata.SourceType_kms:                    "A key in a cloud KMS (AWS, GCP, or Azure)",
+	metadata.SourceType_tang:                   "A key recovered by a Tang server on the network",
+	metadata.SourceType_passphrase_and_raw_key: "A custom passphrase and a raw key file, both needed",
+	metadata.SourceType_yubikey:                "A custom passphrase and a YubiKey's challenge-response",
+	metadata.SourceType_gpg:                    "A key encrypted to a GPG key, e.g. on a smartcard",
+	metadata.SourceType_ssh_agent:              "A key derived from an SSH key in your ssh-agent",
+}
+
+// readLine reads a line of input for a prompt using util.ReadLine. If no line
+// arrives within the --prompt-timeout, ErrCanceled is returned. Reads from the
+// terminal can't be interrupted, so the read is just abandoned in that case.
+func readLine() (string, error) {
+	if promptTimeoutFlag.Value <= 0 {
+		return util.ReadLine()
+	}
+	type result struct {
+		line string
+		err  error
+	}
+	results := make(chan result, 1)
+	go func() {
+		line, err := util.ReadLine()
+		results <- result{line, err}
+	}()
+	select {
+	case r := <-results:
+		return r.line, r.err
+	case <-time.After(promptTimeoutFlag.Value):
+		fmt.Println() // To align output
+		util.Debugf("no input within %v", promptTimeoutFlag.Value)
+		return "", ErrCanceled
+	}
 }
 
 // askQuestion asks the user a yes or no question. Returning a boolean on a
@@ -63,7 +98,7 @@ func askQuestion(question string, defaultChoice bool) (bool, error) {
 			fmt.Print(question + defaultNoSuffix)
 		}
 
-		input, err := util.ReadLine()
+		input, err := readLine()
 		if err != nil {
 			return false, err
 		}
@@ -130,13 +165,35 @@ func formatUsername(uid int64) string {
 
 // formatInfo gives a string description of metadata.ProtectorData.
 func formatInfo(data actions.ProtectorInfo) string {
+	name := fmt.Sprintf("%q", data.Name())
+	if data.Name() == "" && data.NameIsEncrypted() {
+		name = "[encrypted name]"
+	}
 	switch data.Source() {
 	case metadata.SourceType_pam_passphrase:
 		return "login protector for " + formatUsername(data.UID())
 	case metadata.SourceType_custom_passphrase:
-		return fmt.Sprintf("custom protector %q", data.Name())
+		return "custom protector " + name
 	case metadata.SourceType_raw_key:
-		return fmt.Sprintf("raw key protector %q", data.Name())
+		return "raw key protector " + name
+	case metadata.SourceType_fido2:
+		return "security key protector " + name
+	case metadata.SourceType_tpm2:
+		return "TPM protector " + name
+	case metadata.SourceType_pkcs11:
+		return "PKCS#11 protector " + name
+	case metadata.SourceType_kms:
+		return "cloud KMS protector " + name
+	case metadata.SourceType_tang:
+		return "Tang protector " + name
+	case metadata.SourceType_passphrase_and_raw_key:
+		return "two-factor protector " + name
+	case metadata.SourceType_yubikey:
+		return "YubiKey protector " + name
+	case metadata.SourceType_gpg:
+		return "GPG protector " + name
+	case metadata.SourceType_ssh_agent:
+		return "ssh-agent protector " + name
 	default:
 		panic(ErrInvalidSource)
 	}
@@ -156,7 +213,7 @@ func promptForName(ctx *actions.Context) (string, error) {
 
 	for {
 		fmt.Print("Enter a name for the new protector: ")
-		name, err := util.ReadLine()
+		name, err := readLine()
 		if err != nil {
 			return "", err
 		}
@@ -195,7 +252,7 @@ func promptForSource(ctx *actions.Context) error {
 	for {
 		fmt.Printf("Enter the source number for the new protector [%d - %s]: ",
 			ctx.Config.Source, ctx.Config.Source)
-		input, err := util.ReadLine()
+		input, err := readLine()
 		if err != nil {
 			return err
 		}
@@ -214,6 +271,21 @@ func promptForSource(ctx *actions.Context) error {
 	}
 }
 
+// trustTangServer is the actions.TangTrustFunc used by the fscrypt command. It
+// shows the thumbprints of the Tang server's signing keys, which the user
+// should compare with those shown by "tang-show-keys" on the server. In quiet
+// mode, the keys aren't trusted.
+func trustTangServer(url string, thumbprints []string) (bool, error) {
+	if quietFlag.Value {
+		return false, nil
+	}
+	fmt.Printf("The Tang server %s advertises keys signed by:\n", url)
+	for _, thumbprint := range thumbprints {
+		fmt.Printf("\t%s\n", thumbprint)
+	}
+	return askQuestion("Do you trust these keys?", false)
+}
+
 // promptForKeyFile returns an open file that should be used to create or unlock
 // a raw_key protector. Be sure to close the file when done.
 func promptForKeyFile(prompt string) (*os.File, error) {
@@ -228,7 +300,7 @@ func promptForKeyFile(prompt string) (*os.File, error) {
 	// Prompt for a valid path until we get a file we can open.
 	for {
 		fmt.Print(prompt)
-		filename, err := util.ReadLine()
+		filename, err := readLine()
 		if err != nil {
 			return nil, err
 		}
@@ -246,18 +318,27 @@ func promptForKeyFile(prompt string) (*os.File, error) {
 // from, that protector is automatically selected.
 func promptForProtector(options []*actions.ProtectorOption) (int, error) {
 	numOptions := len(options)
-	log.Printf("selecting from %s", pluralize(numOptions, "protector"))
+	util.Debugf("selecting from %s", pluralize(numOptions, "protector"))
 
 	// Get the number of load errors.
 	numLoadErrors := 0
+	var accessErr error
 	for _, option := range options {
 		if option.LoadError != nil {
-			log.Printf("when loading option: %v", option.LoadError)
+			util.Debugf("when loading option: %v", option.LoadError)
 			numLoadErrors++
+			if _, ok := option.LoadError.(*actions.ErrProtectorAccessDenied); ok {
+				accessErr = option.LoadError
+			}
 		}
 	}
 
 	if numLoadErrors == numOptions {
+		// Not being allowed to use a protector is more likely the
+		// problem than a missing linked filesystem.
+		if accessErr != nil {
+			return 0, accessErr
+		}
 		return 0, ErrAllLoadsFailed
 	}
 	if numOptions == 1 {
@@ -288,7 +369,7 @@ func promptForProtector(options []*actions.ProtectorOption) (int, error) {
 
 	for {
 		fmt.Print("Enter the number of protector to use: ")
-		input, err := util.ReadLine()
+		input, err := readLine()
 		if err != nil {
 			return 0, err
 		}
@@ -308,7 +389,7 @@ func optionFn(policyDescriptor string, options []*actions.ProtectorOption) (int,
 	// If we have an unlock-with flag, we directly select the specified
 	// protector to unlock the policy.
 	if unlockWithFlag.Value != "" {
-		log.Printf("optionFn(%s) w/ unlock flag", policyDescriptor)
+		util.Debugf("optionFn(%s) w/ unlock flag", policyDescriptor)
 		protector, err := getProtectorFromFlag(unlockWithFlag.Value, nil)
 		if err != nil {
 			return 0, err
@@ -323,6 +404,15 @@ func optionFn(policyDescriptor string, options []*actions.ProtectorOption) (int,
 			ProtectorDescriptor: protector.Descriptor()}
 	}
 
-	log.Printf("optionFn(%s)", policyDescriptor)
+	// A protector whose key file is in the keystore can be used without
+	// any prompting.
+	for idx, option := range options {
+		if option.LoadError == nil && option.InKeystore {
+			util.Debugf("optionFn(%s) w/ keystore key", policyDescriptor)
+			return idx, nil
+		}
+	}
+
+	util.Debugf("optionFn(%s)", policyDescriptor)
 	return promptForProtector(options)
 }
@@ -22,8 +22,12 @@ package main
 
 import (
 	"fmt"
-	"log"
+	"io"
 	"os/user"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
 
 	"github.com/google/fscrypt/actions"
 	"github.com/google/fscrypt/filesystem"
@@ -38,7 +42,7 @@ func createProtectorFromContext(ctx *actions.Context) (*actions.Protector, error
 	if err := promptForSource(ctx); err != nil {
 		return nil, err
 	}
-	log.Printf("using source: %s", ctx.Config.Source.String())
+	util.Debugf("using source: %s", ctx.Config.Source.String())
 	if ctx.Config.Source == metadata.SourceType_pam_passphrase {
 		if userFlag.Value == "" && util.IsUserRoot() {
 			return nil, ErrSpecifyUser
@@ -57,13 +61,13 @@ IMPORTANT: Before continuing, ensure you have properly set up your system for
 	if err != nil {
 		return nil, err
 	}
-	log.Printf("using name: %s", name)
+	util.Debugf("using name: %s", name)
 
 	// We only want to create new login protectors on the root filesystem.
 	// So we make a new context if necessary.
 	if ctx.Config.Source == metadata.SourceType_pam_passphrase &&
 		ctx.Mount.Path != actions.LoginProtectorMountpoint {
-		log.Printf("creating login protector on %q instead of %q",
+		util.Debugf("creating login protector on %q instead of %q",
 			actions.LoginProtectorMountpoint, ctx.Mount.Path)
 		if ctx, err = modifiedContext(ctx); err != nil {
 			return nil, err
@@ -73,8 +77,111 @@ IMPORTANT: Before continuing, ensure you have properly set up your system for
 	var owner *user.User
 	if ctx.Config.Source == metadata.SourceType_pam_passphrase && util.IsUserRoot() {
 		owner = ctx.TargetUser
+	} else if owner, err = parseOwnerFlag(); err != nil {
+		return nil, err
+	}
+	access, err := parseAccessFlags(ctx)
+	if err != nil {
+		return nil, err
+	}
+	protector, err := actions.CreateProtector(ctx, name, createKeyFn, owner)
+	if err != nil || access == nil {
+		return protector, err
+	}
+	if err = protector.SetAccess(access); err != nil {
+		protector.Revert()
+		protector.Lock()
+		return nil, err
+	}
+	return protector, nil
+}
+
+// parseAccessFlags returns the access list for a new protector given by
+// restrictAccessFlag, allowUsersFlag, and allowGroupsFlag, or nil if anyone
+// who can read the protector may use it.
+func parseAccessFlags(ctx *actions.Context) (*metadata.ProtectorAccess, error) {
+	if !restrictAccessFlag.Value && allowUsersFlag.Value == "" &&
+		allowGroupsFlag.Value == "" {
+		return nil, nil
+	}
+	var users []*user.User
+	for _, name := range splitList(allowUsersFlag.Value) {
+		u, err := user.Lookup(name)
+		if err != nil {
+			return nil, errors.Wrapf(ErrUnknownUser, "%q", name)
+		}
+		users = append(users, u)
+	}
+	var groups []*user.Group
+	for _, name := range splitList(allowGroupsFlag.Value) {
+		g, err := user.LookupGroup(name)
+		if err != nil {
+			return nil, errors.Wrapf(ErrUnknownGroup, "%q", name)
+		}
+		groups = append(groups, g)
+	}
+	return actions.NewProtectorAccess(ctx.TargetUser, users, groups), nil
+}
+
+// formatAccess describes who may use a protector with the given access list.
+func formatAccess(access *metadata.ProtectorAccess) string {
+	if access == nil {
+		return "anyone"
+	}
+	description := "owner " + formatUsername(access.OwnerUid)
+	if len(access.AllowedUids) > 0 {
+		usernames := make([]string, len(access.AllowedUids))
+		for i, uid := range access.AllowedUids {
+			usernames[i] = formatUsername(uid)
+		}
+		description += ", users " + strings.Join(usernames, ",")
+	}
+	if len(access.AllowedGids) > 0 {
+		groups := make([]string, len(access.AllowedGids))
+		for i, gid := range access.AllowedGids {
+			groups[i] = strconv.FormatInt(gid, 10)
+			if g, err := user.LookupGroupId(groups[i]); err == nil {
+				groups[i] = g.Name
+			}
+		}
+		description += ", groups " + strings.Join(groups, ",")
+	}
+	return description
+}
+
+// writeProtectorAccess writes a table of protector options and who may use
+// each of them.
+func writeProtectorAccess(w io.Writer, options []*actions.ProtectorOption) {
+	t := makeTableWriter(w, "PROTECTOR\tLINKED\tACCESS\tDESCRIPTION")
+	for _, option := range options {
+		access := formatAccess(option.Access())
+		if option.LoadError != nil {
+			if _, ok := option.LoadError.(*actions.ErrProtectorAccessDenied); ok {
+				fmt.Fprintf(t, "%s\t\t%s\t[not allowed]\n", option.Descriptor(), access)
+			} else {
+				fmt.Fprintf(t, "%s\t\t\t[%s]\n", option.Descriptor(), option.LoadError)
+			}
+			continue
+		}
+		linkedText := yesNoString(option.LinkedMount != nil)
+		if option.LinkedMount != nil {
+			linkedText += fmt.Sprintf(" (%s)", option.LinkedMount.Path)
+		}
+		fmt.Fprintf(t, "%s\t%s\t%s\t%s\n", option.Descriptor(), linkedText,
+			access, formatInfo(option.ProtectorInfo))
+	}
+	t.Flush()
+}
+
+// splitList splits a comma-separated list, ignoring empty elements.
+func splitList(list string) []string {
+	var elements []string
+	for _, element := range strings.Split(list, ",") {
+		if element = strings.TrimSpace(element); element != "" {
+			elements = append(elements, element)
+		}
 	}
-	return actions.CreateProtector(ctx, name, createKeyFn, owner)
+	return elements
 }
 
 // selectExistingProtector returns a locked Protector which corresponds to an
@@ -87,7 +194,7 @@ func selectExistingProtector(ctx *actions.Context, options []*actions.ProtectorO
 	}
 	option := options[idx]
 
-	log.Printf("using %s", formatInfo(option.ProtectorInfo))
+	util.Debugf("using %s", formatInfo(option.ProtectorInfo))
 	return actions.GetProtectorFromOption(ctx, option)
 }
 
@@ -104,15 +211,15 @@ func expandedProtectorOptions(ctx *actions.Context) ([]*actions.ProtectorOption,
 		return options, nil
 	}
 	if ctx, err = modifiedContext(ctx); err != nil {
-		log.Print(err)
+		util.Debug(err)
 		return options, nil
 	}
 	rootOptions, err := ctx.ProtectorOptions()
 	if err != nil {
-		log.Print(err)
+		util.Debug(err)
 		return options, nil
 	}
-	log.Print("adding additional ProtectorOptions")
+	util.Debug("adding additional ProtectorOptions")
 
 	// Keep track of what we have seen, so we don't have duplicates
 	seenOptions := make(map[string]bool)
@@ -0,0 +1,72 @@
+/*
+ * rawkey.go - Managing raw keys in the filesystem keyrings for "fscrypt key".
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/google/fscrypt/filesystem"
+	"github.com/google/fscrypt/keyring"
+)
+
+// getRawKeyOptions returns the keyring options for managing raw keys on the
+// filesystem mounted at mountpoint, for the user given by userFlag. The
+// filesystem doesn't need to be set up for fscrypt.
+func getRawKeyOptions(mountpoint string) (*keyring.Options, error) {
+	targetUser, err := parseUserFlag()
+	if err != nil {
+		return nil, err
+	}
+	mount, err := filesystem.GetMount(mountpoint)
+	if err != nil {
+		return nil, err
+	}
+	return &keyring.Options{Mount: mount, User: targetUser}, nil
+}
+
+// parseKeyIdentifier checks that identifier is the hex key identifier of a key
+// for v2 encryption policies, and returns it in lowercase.
+func parseKeyIdentifier(identifier string) (string, error) {
+	bytes, err := hex.DecodeString(identifier)
+	if err != nil || len(bytes) != unix.FSCRYPT_KEY_IDENTIFIER_SIZE {
+		return "", ErrBadKeyIdentifier
+	}
+	return hex.EncodeToString(bytes), nil
+}
+
+// rawKeyStatusString describes the status of a raw key, given the number of
+// users who have added it and whether the current user is one of them.
+func rawKeyStatusString(status keyring.KeyStatus, users int, addedBySelf bool) string {
+	switch status {
+	case keyring.KeyAbsent:
+		return "absent"
+	case keyring.KeyAbsentButFilesBusy:
+		return "incompletely removed (some files using it are still open)"
+	case keyring.KeyPresent, keyring.KeyPresentButOnlyOtherUsers:
+		if addedBySelf {
+			return fmt.Sprintf("present (added by %d user(s), including you)", users)
+		}
+		return fmt.Sprintf("present (added by %d other user(s))", users)
+	default:
+		return "unknown"
+	}
+}
@@ -0,0 +1,46 @@
+/*
+ * rawkey_test.go - tests for managing raw keys with "fscrypt key"
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package main
+
+import "testing"
+
+// Tests that only 16-byte hex key identifiers are accepted, in either case.
+func TestParseKeyIdentifier(t *testing.T) {
+	tests := []struct {
+		identifier, expected string
+	}{
+		{"077d470aa2f6bf5265f7f53bac010db0", "077d470aa2f6bf5265f7f53bac010db0"},
+		{"077D470AA2F6BF5265F7F53BAC010DB0", "077d470aa2f6bf5265f7f53bac010db0"},
+		{"0123456789abcdef", ""},
+		{"077d470aa2f6bf5265f7f53bac010dbz", ""},
+		{"", ""},
+	}
+	for _, test := range tests {
+		identifier, err := parseKeyIdentifier(test.identifier)
+		if test.expected == "" {
+			if err != ErrBadKeyIdentifier {
+				t.Errorf("%q: expected %v, got %v", test.identifier, ErrBadKeyIdentifier, err)
+			}
+			continue
+		}
+		if err != nil || identifier != test.expected {
+			t.Errorf("%q: got %q, %v, expected %q", test.identifier, identifier, err, test.expected)
+		}
+	}
+}
@@ -0,0 +1,335 @@
+/*
+ * rekey.go - Giving an encrypted directory a new policy with a fresh key.
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/google/fscrypt/actions"
+	"github.com/google/fscrypt/filesystem"
+	"github.com/google/fscrypt/keyring"
+	"github.com/google/fscrypt/metadata"
+	"github.com/google/fscrypt/util"
+)
+
+// rekeySibling returns the path of the hidden directory next to dir into which
+// its contents are copied when it is rekeyed.
+func rekeySibling(dir string) string {
+	dir = filepath.Clean(dir)
+	return filepath.Join(filepath.Dir(dir), "."+filepath.Base(dir)+".fscrypt-rekey")
+}
+
+// rekeyMarker returns the path of the file which records that dir is about to
+// be exchanged with its rekeyed copy, so that a rekey interrupted after the
+// exchange is finished rather than started over.
+func rekeyMarker(dir string) string {
+	return rekeySibling(dir) + ".done"
+}
+
+// writeRekeyMarker records the descriptors of the old and new policies of dir
+// in its rekey marker, and syncs it to disk.
+func writeRekeyMarker(dir string, oldPolicy, newPolicy *actions.Policy) error {
+	file, err := os.OpenFile(rekeyMarker(dir), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = fmt.Fprintf(file, "%s %s\n", oldPolicy.Descriptor(), newPolicy.Descriptor())
+	if err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+// readRekeyMarker returns the descriptors of the old and new policies from the
+// rekey marker of dir, or empty strings if there is none.
+func readRekeyMarker(dir string) (oldDescriptor, newDescriptor string, err error) {
+	data, err := os.ReadFile(rekeyMarker(dir))
+	if os.IsNotExist(err) {
+		return "", "", nil
+	}
+	if err != nil {
+		return "", "", err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) != 2 {
+		return "", "", errors.Errorf("%q is corrupt", rekeyMarker(dir))
+	}
+	return fields[0], fields[1], nil
+}
+
+// interruptedRekey returns the old policy of dir if dir was already exchanged
+// with its rekeyed copy, so that only finishRekey is left to do. Otherwise, nil
+// is returned, and any rekey marker is removed.
+func interruptedRekey(ctx *actions.Context, policy *actions.Policy, dir string) (*actions.Policy, error) {
+	oldDescriptor, newDescriptor, err := readRekeyMarker(dir)
+	if err != nil || oldDescriptor == "" {
+		return nil, err
+	}
+	if newDescriptor != policy.Descriptor() {
+		util.Debugf("%q wasn't exchanged with its rekeyed copy yet", dir)
+		return nil, os.Remove(rekeyMarker(dir))
+	}
+	util.Debugf("finishing the rekey of %q from policy %s", dir, oldDescriptor)
+	return actions.GetPolicy(ctx, oldDescriptor)
+}
+
+// resumeRekey returns the new policy of the directory rekeyedDir, which was
+// left behind by an interrupted rekey of dir, unlocked and provisioned. If
+// there is no such directory, nil is returned.
+func resumeRekey(ctx *actions.Context, oldPolicy *actions.Policy, dir, rekeyedDir string) (*actions.Policy, error) {
+	if _, err := os.Lstat(rekeyedDir); os.IsNotExist(err) {
+		return nil, nil
+	}
+	newPolicy, err := actions.GetPolicyFromPath(ctx, rekeyedDir)
+	if _, ok := errors.Cause(err).(*metadata.ErrNotEncrypted); ok {
+		// The rekey was interrupted before the new policy was applied.
+		if os.Remove(rekeyedDir) == nil {
+			return nil, nil
+		}
+		return nil, &ErrRekeySource{dir,
+			fmt.Sprintf("%q already exists and isn't encrypted", rekeyedDir)}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if newPolicy.Descriptor() == oldPolicy.Descriptor() {
+		return nil, &ErrRekeySource{dir,
+			fmt.Sprintf("%q already exists and uses the same policy", rekeyedDir)}
+	}
+	util.Debugf("resuming the rekey of %q into %q", dir, rekeyedDir)
+	if err = newPolicy.Unlock(optionFn, existingKeyFn); err != nil {
+		return nil, err
+	}
+	if err = validateKeyringPrereqs(ctx, newPolicy); err != nil {
+		newPolicy.Lock()
+		return nil, err
+	}
+	if err = newPolicy.Provision(); err != nil {
+		newPolicy.Lock()
+		return nil, err
+	}
+	return newPolicy, nil
+}
+
+// startRekey creates the directory rekeyedDir next to dir, and applies a new
+// policy to it which is protected like the policy of dir. All the protectors
+// of the old policy are unlocked for this. The new policy is returned unlocked
+// and provisioned. On failure, the new policy and rekeyedDir are removed again.
+func startRekey(ctx *actions.Context, oldPolicy *actions.Policy, dir, rekeyedDir string) (_ *actions.Policy, err error) {
+	var protectors []*actions.Protector
+	defer func() {
+		for _, protector := range protectors {
+			protector.Lock()
+		}
+	}()
+	for _, option := range oldPolicy.ProtectorOptions() {
+		protector, err := actions.GetProtectorFromOption(ctx, option)
+		if err != nil {
+			return nil, errors.Wrapf(err, "protector %s", option.Descriptor())
+		}
+		if err = protector.Unlock(existingKeyFn); err != nil {
+			return nil, err
+		}
+		protectors = append(protectors, protector)
+	}
+
+	rollback := &actions.Rollback{}
+	defer rollback.Run()
+	if err = rollback.Begin(ctx.Mount); err != nil {
+		return nil, err
+	}
+	newPolicy, err := actions.CreateRekeyedPolicy(oldPolicy, protectors)
+	if err != nil {
+		return nil, err
+	}
+	rollback.AddPolicy(newPolicy)
+	defer func() {
+		if err != nil {
+			newPolicy.Deprovision(false)
+			newPolicy.Lock()
+		}
+	}()
+	if err = validateKeyringPrereqs(ctx, newPolicy); err != nil {
+		return nil, err
+	}
+	if err = newPolicy.Provision(); err != nil {
+		return nil, err
+	}
+
+	if err = os.Mkdir(rekeyedDir, 0700); err != nil {
+		return nil, err
+	}
+	if err = rollback.Applying(newPolicy, rekeyedDir); err == nil {
+		err = newPolicy.Apply(rekeyedDir)
+	}
+	if err == nil {
+		err = copyOwner(dir, rekeyedDir)
+	}
+	if err != nil {
+		os.Remove(rekeyedDir)
+		return nil, err
+	}
+	rollback.Commit()
+	return newPolicy, nil
+}
+
+// rekeyFiles copies the contents of dir into rekeyedDir (which uses newPolicy
+// rather than oldPolicy), keeping the complete copies from an interrupted run if
+// resume is set, and verifies the copy. Then the two directories are exchanged,
+// so that dir uses the new policy from then on, and the originals are securely
+// deleted. If anything fails before the exchange, nothing is deleted from dir.
+func rekeyFiles(dir, rekeyedDir string, oldPolicy, newPolicy *actions.Policy, resume bool) error {
+	if resume {
+		if err := removeStaleCopies(dir, rekeyedDir); err != nil {
+			return &ErrRekeyFailed{dir, rekeyedDir, err}
+		}
+	}
+	if err := copyAndVerifyTree(dir, rekeyedDir, resume); err != nil {
+		if migrateErr, ok := err.(*ErrMigrateFailed); ok {
+			err = migrateErr.Err
+		}
+		return &ErrRekeyFailed{dir, rekeyedDir, err}
+	}
+	info, err := os.Lstat(dir)
+	if err == nil {
+		err = copyMetadata(dir, rekeyedDir, info)
+	}
+	if err == nil {
+		err = writeRekeyMarker(dir, oldPolicy, newPolicy)
+	}
+	if err == nil {
+		err = newPolicy.AddDirectory(dir)
+	}
+	if err == nil {
+		err = exchangeDirs(dir, rekeyedDir)
+	}
+	if err != nil {
+		return &ErrRekeyFailed{dir, rekeyedDir, err}
+	}
+	return finishRekey(dir, rekeyedDir)
+}
+
+// finishRekey securely deletes the original files of dir, which are in
+// rekeyedDir once the two have been exchanged, and then the rekey marker.
+func finishRekey(dir, rekeyedDir string) error {
+	if _, err := os.Lstat(rekeyedDir); err == nil {
+		util.Debugf("securely deleting %q", rekeyedDir)
+		if err = shredTree(rekeyedDir); err != nil {
+			return errors.Wrapf(err, "%q has been rekeyed, but securely deleting the originals in %q failed",
+				dir, rekeyedDir)
+		}
+	}
+	return os.Remove(rekeyMarker(dir))
+}
+
+// removeStaleCopies removes the files in dstDir, left behind by an interrupted
+// copy of srcDir, which no longer exist in srcDir. The directories in dstDir
+// are made writable, as an interrupted copyTree may have set their mode.
+func removeStaleCopies(srcDir, dstDir string) error {
+	return filepath.Walk(dstDir, func(dstPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(dstDir, dstPath)
+		if err != nil {
+			return err
+		}
+		if _, err = os.Lstat(filepath.Join(srcDir, relPath)); os.IsNotExist(err) {
+			util.Debugf("removing stale copy %q", dstPath)
+			if err = os.RemoveAll(dstPath); err != nil {
+				return err
+			}
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return os.Chmod(dstPath, 0700)
+		}
+		return nil
+	})
+}
+
+// removeOldPolicy removes the key of the policy which a directory used before
+// it was rekeyed from the keyring, and destroys the policy, unless another
+// directory may still use it. That is only known for policies created by
+// versions of fscrypt which record their directories, so older policies are
+// always kept. It returns whether the policy was destroyed.
+func removeOldPolicy(ctx *actions.Context, oldPolicy *actions.Policy) (bool, error) {
+	paths, complete, err := ctx.PathsForPolicy(oldPolicy.Descriptor())
+	if err != nil {
+		return false, err
+	}
+	if len(paths) > 0 || !complete {
+		util.Debugf("policy %s is still used by %v (all directories known: %v)",
+			oldPolicy.Descriptor(), paths, complete)
+		return false, nil
+	}
+	err = oldPolicy.Deprovision(false)
+	if err != nil && errors.Cause(err) != keyring.ErrKeyNotPresent {
+		return false, err
+	}
+	return true, oldPolicy.Destroy()
+}
+
+// checkNestedPolicies returns an error if a subdirectory of dir doesn't use the
+// policy with the given descriptor, like dir does. Its files would otherwise be
+// copied into the new policy of dir, which anyone with the protectors of that
+// policy could then read, and its original policy would be lost.
+func checkNestedPolicies(dir, descriptor string) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() || path == dir {
+			return nil
+		}
+		data, err := metadata.GetPolicy(path)
+		if err != nil {
+			return &ErrRekeySource{dir, fmt.Sprintf("the policy of %q can't be checked: %v", path, err)}
+		}
+		if data.KeyDescriptor != descriptor {
+			return &ErrRekeySource{dir, fmt.Sprintf("%q uses another policy (%s)",
+				path, data.KeyDescriptor)}
+		}
+		return nil
+	})
+}
+
+// checkRekeyable returns an error if dir can't be rekeyed, since it is the root
+// of its filesystem, so it can't be exchanged with another directory.
+func checkRekeyable(mount *filesystem.Mount, dir string) error {
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	if absDir == mount.Path {
+		return &ErrRekeySource{dir, "it is the root of a filesystem"}
+	}
+	return nil
+}
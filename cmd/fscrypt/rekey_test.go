@@ -0,0 +1,99 @@
+/*
+ * rekey_test.go - tests for copying a directory with a new policy
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRekeySibling(t *testing.T) {
+	if sibling := rekeySibling("/mnt/disk/dir/"); sibling != "/mnt/disk/.dir.fscrypt-rekey" {
+		t.Errorf("sibling of /mnt/disk/dir/ is %q", sibling)
+	}
+	if marker := rekeyMarker("dir"); marker != ".dir.fscrypt-rekey.done" {
+		t.Errorf("marker of dir is %q", marker)
+	}
+}
+
+// Tests that a directory with a subdirectory which doesn't use its policy isn't
+// rekeyed.
+func TestCheckNestedPolicies(t *testing.T) {
+	dir := t.TempDir()
+	if err := checkNestedPolicies(dir, "0123456789abcdef"); err != nil {
+		t.Errorf("directory without subdirectories: %v", err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "subdir"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	err := checkNestedPolicies(dir, "0123456789abcdef")
+	if _, ok := err.(*ErrRekeySource); !ok {
+		t.Errorf("unencrypted subdirectory: expected ErrRekeySource, got %v", err)
+	}
+}
+
+// Tests that an interrupted copy is resumed: complete copies are kept, partial
+// and stale ones are replaced or removed, and the result verifies.
+func TestCopyTreeResume(t *testing.T) {
+	srcDir, dstDir := makeSourceTree(t)
+	defer os.Chmod(filepath.Join(srcDir, "subdir"), 0700)
+	defer os.Chmod(filepath.Join(dstDir, "subdir"), 0700)
+	if err := copyTree(srcDir, dstDir, nil, false); err != nil {
+		t.Fatal(err)
+	}
+	small := filepath.Join(dstDir, "small")
+	smallInfo, err := os.Stat(small)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Truncate one copy as if copying it was interrupted, and leave behind
+	// a copy of a file which has been deleted since.
+	if err = os.Chmod(filepath.Join(dstDir, "subdir"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Truncate(filepath.Join(dstDir, "subdir", "large"), 10); err != nil {
+		t.Fatal(err)
+	}
+	stale := filepath.Join(dstDir, "subdir", "stale")
+	if err = os.WriteFile(stale, []byte("stale"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = removeStaleCopies(srcDir, dstDir); err != nil {
+		t.Fatal(err)
+	}
+	if err = copyTree(srcDir, dstDir, nil, true); err != nil {
+		t.Fatal(err)
+	}
+	if err = verifyTree(srcDir, dstDir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Lstat(stale); !os.IsNotExist(err) {
+		t.Error("stale copy wasn't removed")
+	}
+	info, err := os.Stat(small)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(info, smallInfo) {
+		t.Error("complete copy was copied again")
+	}
+}
@@ -0,0 +1,178 @@
+/*
+ * secret_service.go - Getting protector passphrases from, and storing them in,
+ * the desktop's Secret Service (e.g. the GNOME or KDE keyring).
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strings"
+
+	"golang.org/x/term"
+
+	"github.com/google/fscrypt/actions"
+	"github.com/google/fscrypt/crypto"
+	"github.com/google/fscrypt/util"
+)
+
+// The Secret Service (org.freedesktop.secrets on the session D-Bus) is accessed
+// with libsecret's secret-tool, so fscrypt doesn't depend on D-Bus libraries
+// and systems without a desktop session aren't affected.
+var secretToolCommand = "secret-tool"
+
+// The passphrases are stored under this attribute, with the protector
+// descriptor as its value.
+const secretServiceAttribute = "fscrypt-protector"
+
+// Passphrases which were entered while --secret-service was given, by protector
+// descriptor, so they can be stored once they turn out to be correct.
+var (
+	enteredPassphrases = make(map[string]*crypto.Key)
+	enteredNames       = make(map[string]string)
+)
+
+// Protectors for which a stored passphrase was tried, by descriptor
+var storedPassphraseTried = make(map[string]bool)
+
+// secretServiceAvailable returns true if the Secret Service can be used.
+func secretServiceAvailable() bool {
+	if _, err := exec.LookPath(secretToolCommand); err != nil {
+		util.Debugf("not using the secret service: %v", err)
+		return false
+	}
+	return true
+}
+
+// getSecretServicePassphrase returns the passphrase stored in the Secret
+// Service for the protector, or nil if --secret-service wasn't given, or the
+// passphrase couldn't be found. Retries always prompt, as the stored passphrase
+// must have been wrong.
+func getSecretServicePassphrase(info actions.ProtectorInfo, retry bool) *crypto.Key {
+	if !secretServiceFlag.Value || retry || !secretServiceAvailable() {
+		return nil
+	}
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(secretToolCommand, "lookup",
+		secretServiceAttribute, info.Descriptor())
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	// Wipe the passphrase once it has been copied into the key.
+	defer func() {
+		data := stdout.Bytes()
+		for i := range data {
+			data[i] = 0
+		}
+	}()
+	if err != nil || stdout.Len() == 0 {
+		if stderr.Len() > 0 {
+			util.Warnf("could not use the secret service: %s",
+				strings.TrimSpace(stderr.String()))
+		} else {
+			util.Debugf("no passphrase stored for protector %s", info.Descriptor())
+		}
+		return nil
+	}
+	key, err := crypto.NewKeyFromReader(bytes.NewReader(
+		bytes.TrimSuffix(stdout.Bytes(), []byte("\n"))))
+	if err != nil {
+		util.Warnf("could not read the stored passphrase: %v", err)
+		return nil
+	}
+	util.Debugf("using the stored passphrase for protector %s", info.Descriptor())
+	storedPassphraseTried[info.Descriptor()] = true
+	return key
+}
+
+// retryingStoredPassphrase returns true if the last passphrase tried for the
+// protector came from the Secret Service, in which case the passphrase can
+// still be read from a non-interactive input.
+func retryingStoredPassphrase(info actions.ProtectorInfo) bool {
+	tried := storedPassphraseTried[info.Descriptor()]
+	delete(storedPassphraseTried, info.Descriptor())
+	return tried
+}
+
+// rememberPassphrase keeps a copy of a passphrase entered for the protector if
+// --secret-service was given, so storeEnteredPassphrases can store it later.
+func rememberPassphrase(info actions.ProtectorInfo, key *crypto.Key) {
+	if !secretServiceFlag.Value {
+		return
+	}
+	clone, err := key.Clone()
+	if err != nil {
+		util.Debug(err)
+		return
+	}
+	if old, ok := enteredPassphrases[info.Descriptor()]; ok {
+		old.Wipe()
+	}
+	enteredPassphrases[info.Descriptor()] = clone
+	if name := info.Name(); name != "" {
+		enteredNames[info.Descriptor()] = name
+	} else {
+		enteredNames[info.Descriptor()] = info.Descriptor()
+	}
+}
+
+// storeEnteredPassphrases offers to store the passphrases which were entered,
+// once they have been used successfully. This is only offered interactively.
+// Failures are only warned about, as the passphrases can still be entered the
+// next time.
+func storeEnteredPassphrases() {
+	defer wipeEnteredPassphrases()
+	if quietFlag.Value || !term.IsTerminal(stdinFd) ||
+		len(enteredPassphrases) == 0 || !secretServiceAvailable() {
+		return
+	}
+	descriptors := make([]string, 0, len(enteredPassphrases))
+	for descriptor := range enteredPassphrases {
+		descriptors = append(descriptors, descriptor)
+	}
+	sort.Strings(descriptors)
+	for _, descriptor := range descriptors {
+		name := enteredNames[descriptor]
+		question := fmt.Sprintf("Store the passphrase for protector %q in the secret service?",
+			name)
+		if store, err := askQuestion(question, true); err != nil || !store {
+			continue
+		}
+		var stderr bytes.Buffer
+		cmd := exec.Command(secretToolCommand, "store",
+			"--label=fscrypt protector "+name,
+			secretServiceAttribute, descriptor)
+		cmd.Stdin = bytes.NewReader(enteredPassphrases[descriptor].Data())
+		cmd.Stderr = &stderr
+		if err := cmd.Run(); err != nil {
+			util.Warnf("could not store the passphrase: %v: %s", err,
+				strings.TrimSpace(stderr.String()))
+		}
+	}
+}
+
+// wipeEnteredPassphrases wipes the passphrases which were kept for storing.
+func wipeEnteredPassphrases() {
+	for descriptor, key := range enteredPassphrases {
+		key.Wipe()
+		delete(enteredPassphrases, descriptor)
+		delete(enteredNames, descriptor)
+	}
+}
@@ -24,9 +24,13 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
 
 	"github.com/google/fscrypt/actions"
 	"github.com/google/fscrypt/filesystem"
+	"github.com/google/fscrypt/metadata"
 	"github.com/google/fscrypt/util"
 )
 
@@ -39,6 +43,9 @@ func createGlobalConfig(w io.Writer, path string) error {
 	// If the config file already exists, ask to replace it
 	_, err := os.Stat(path)
 	switch {
+	case err == nil && idempotentFlag.Value:
+		fmt.Fprintf(w, "Global config file %q already configured.\n", path)
+		return nil
 	case err == nil:
 		err = askConfirmation(fmt.Sprintf("Replace %q?", path), false, "")
 		if err == nil {
@@ -66,7 +73,8 @@ func createGlobalConfig(w io.Writer, path string) error {
 		fmt.Fprintln(w, "Defaulting to policy_version 1 because kernel doesn't support v2.")
 	}
 	fmt.Fprintln(w, "Customizing passphrase hashing difficulty for this system...")
-	err = actions.CreateConfigFile(timeTargetFlag.Value, policyVersion)
+	kdf := metadata.KDF(metadata.KDF_value[kdfFlag.Value])
+	err = actions.CreateConfigFile(timeTargetFlag.Value, policyVersion, kdf)
 	if err != nil {
 		return err
 	}
@@ -75,6 +83,27 @@ func createGlobalConfig(w io.Writer, path string) error {
 	return nil
 }
 
+// useMetadataDirFlag makes the filesystem mounted at mountpoint keep its
+// metadata in the directory given with --metadata-dir, for setupFilesystem.
+// The directory is only recorded in the config file once it's set up.
+func useMetadataDirFlag(mountpoint string) (*filesystem.Mount, error) {
+	if !util.IsUserRoot() {
+		return nil, ErrMustBeRoot
+	}
+	mnt, err := filesystem.GetMount(mountpoint)
+	if err != nil {
+		return nil, err
+	}
+	if dir := filesystem.MetadataDir(mnt.Path); dir != "" && dir != filepath.Clean(metadataDirFlag.Value) {
+		return nil, errors.Errorf("the metadata of %q is already kept in %q according to %q",
+			mnt.Path, dir, actions.ConfigFileLocation)
+	}
+	if err = filesystem.SetMetadataDir(mnt.Path, metadataDirFlag.Value); err != nil {
+		return nil, err
+	}
+	return mnt, nil
+}
+
 // setupFilesystem creates the directories for a filesystem to use fscrypt.
 func setupFilesystem(w io.Writer, path string) error {
 	ctx, err := actions.NewContextFromMountpoint(path, nil)
@@ -91,8 +120,13 @@ func setupFilesystem(w io.Writer, path string) error {
 		return err
 	}
 
+	store := filesystem.PerFileStore
+	if metadataStoreFlag.Value == filesystem.PackedStore.String() {
+		store = filesystem.PackedStore
+	}
 	allUsers := allUsersSetupFlag.Value
-	if !allUsers {
+	// The packed store has a single owner, so there's nothing to ask.
+	if !allUsers && store != filesystem.PackedStore {
 		thisFilesystem := "this filesystem"
 		if ctx.Mount.Path == "/" {
 			thisFilesystem = "the root filesystem"
@@ -112,11 +146,19 @@ https://github.com/google/fscrypt#setting-up-fscrypt-on-a-filesystem)`,
 	} else {
 		setupMode = filesystem.SingleUserWritable
 	}
-	if err = ctx.Mount.Setup(setupMode); err != nil {
+	if err = ctx.Mount.SetupWithStore(setupMode, store); err != nil {
 		return err
 	}
+	if ctx.Config.GetEncryptProtectorNames() {
+		if err = actions.CreateNameKey(ctx); err != nil {
+			return err
+		}
+	}
 
-	if allUsers {
+	if store == filesystem.PackedStore {
+		fmt.Fprintf(w, "Packed metadata store created at %q, writable by %s only.\n",
+			ctx.Mount.BaseDir(), username)
+	} else if allUsers {
 		fmt.Fprintf(w, "Metadata directories created at %q, writable by everyone.\n",
 			ctx.Mount.BaseDir())
 	} else {
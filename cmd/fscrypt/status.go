@@ -23,13 +23,23 @@ package main
 import (
 	"fmt"
 	"io"
-	"log"
+	"io/fs"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
 	"strings"
 	"text/tabwriter"
+	"time"
+
+	"golang.org/x/sys/unix"
 
 	"github.com/google/fscrypt/actions"
+	"github.com/google/fscrypt/crypto"
 	"github.com/google/fscrypt/filesystem"
 	"github.com/google/fscrypt/keyring"
+	"github.com/google/fscrypt/metadata"
+	"github.com/google/fscrypt/util"
 )
 
 // Creates a writer which correctly aligns tabs with the specified header.
@@ -110,7 +120,7 @@ func writeGlobalStatus(w io.Writer) error {
 		supportErr := mount.CheckSupport()
 		supportString := encryptionStatus(supportErr)
 		if supportString == "" {
-			log.Print(supportErr)
+			util.Debug(supportErr)
 			continue
 		}
 
@@ -152,9 +162,86 @@ func writeOptions(w io.Writer, options []*actions.ProtectorOption) {
 			formatInfo(option.ProtectorInfo))
 	}
 	t.Flush()
+	if verboseFlag.Value {
+		writeUnlockCosts(w, options)
+	}
+}
+
+// hashTimeClass describes an estimated passphrase hashing time.
+func hashTimeClass(estimate time.Duration) string {
+	switch {
+	case estimate < 250*time.Millisecond:
+		return "fast"
+	case estimate < time.Second:
+		return "moderate"
+	case estimate < 5*time.Second:
+		return "slow"
+	default:
+		return "very slow"
+	}
+}
+
+// writeUnlockCosts writes a table of the passphrase hashing costs of the
+// passphrase protectors among options, with an estimate of how long unlocking
+// them takes on this system. The estimate comes from a model of the hash, not
+// from actually running it.
+func writeUnlockCosts(w io.Writer, options []*actions.ProtectorOption) {
+	var t *tabwriter.Writer
+	for _, option := range options {
+		if option.LoadError != nil {
+			continue
+		}
+		costs := option.HashingCosts()
+		if costs == nil {
+			continue
+		}
+		if t == nil {
+			fmt.Fprintln(w)
+			t = makeTableWriter(w, "PROTECTOR\tHASHING COSTS\tESTIMATED UNLOCK TIME")
+		}
+		estimate := crypto.EstimateHashTime(costs)
+		rounded := fmt.Sprintf("~%v", estimate.Round(10*time.Millisecond))
+		if estimate < 10*time.Millisecond {
+			rounded = "<10ms"
+		}
+		fmt.Fprintf(t, "%s\t%v time=%d memory=%dKiB parallelism=%d\t%s (%s)\n",
+			option.Descriptor(), costs.Kdf, costs.Time, costs.Memory,
+			costs.Parallelism, rounded, hashTimeClass(estimate))
+	}
+	if t != nil {
+		t.Flush()
+	}
+}
+
+// Values for the --filter flag of the status command
+const (
+	filterLocked   = "locked"
+	filterUnlocked = "unlocked"
+)
+
+// policyMatchesFilter returns true if the unlock state of the policy matches
+// filter (one of "", filterLocked, or filterUnlocked). Incompletely locked
+// policies count as unlocked, as they still need to be locked.
+func policyMatchesFilter(policy *actions.Policy, filter string) bool {
+	switch filter {
+	case filterLocked:
+		return policy.GetProvisioningStatus() == keyring.KeyAbsent
+	case filterUnlocked:
+		switch policy.GetProvisioningStatus() {
+		case keyring.KeyPresent, keyring.KeyPresentButOnlyOtherUsers,
+			keyring.KeyAbsentButFilesBusy:
+			return true
+		}
+		return false
+	default:
+		return true
+	}
 }
 
-func writeFilesystemStatus(w io.Writer, ctx *actions.Context) error {
+// writeFilesystemStatus prints the protectors and policies on the filesystem
+// of ctx. If filter is non-empty, only the policies whose unlock state matches
+// it are listed.
+func writeFilesystemStatus(w io.Writer, ctx *actions.Context, filter string) error {
 	options, err := ctx.ProtectorOptions()
 	if err != nil {
 		return err
@@ -180,38 +267,436 @@ func writeFilesystemStatus(w io.Writer, ctx *actions.Context) error {
 			fmt.Fprintf(w, "Only %s can create fscrypt metadata on this filesystem.\n", user.Username)
 		}
 	}
+	if ctx.Mount.MetadataStore() == filesystem.PackedStore {
+		fmt.Fprintf(w, "The metadata is stored in a single packed file.\n")
+	}
 	fmt.Fprintf(w, "\n")
 
 	if len(options) > 0 {
 		writeOptions(w, options)
 	}
 
-	if len(policyDescriptors) == 0 {
+	if len(policyDescriptors) == 0 && filter == "" {
 		return nil
 	}
 
 	fmt.Fprintln(w)
-	t := makeTableWriter(w, "POLICY\tUNLOCKED\tPROTECTORS")
+	var t *tabwriter.Writer
 	for _, descriptor := range policyDescriptors {
 		policy, err := actions.GetPolicy(ctx, descriptor)
+		if err != nil && filter != "" {
+			// The unlock state of the policy is unknown.
+			util.Debug(err)
+			continue
+		}
+		if err == nil && !policyMatchesFilter(policy, filter) {
+			continue
+		}
+		if t == nil {
+			t = makeTableWriter(w, "POLICY\tUNLOCKED\tPROTECTORS")
+		}
 		if err != nil {
 			fmt.Fprintf(t, "%s\t\t[%s]\n", descriptor, err)
 			continue
 		}
 
-		fmt.Fprintf(t, "%s\t%s\t%s\n", descriptor,
+		fmt.Fprintf(t, "%s\t%s\t%s\n", labeledDescriptor(policy),
 			policyUnlockedStatus(policy, ""),
 			strings.Join(policy.ProtectorDescriptors(), ", "))
 	}
+	if t == nil {
+		fmt.Fprintln(w, "no matching policies")
+		return nil
+	}
 	return t.Flush()
 }
 
+// findEncryptedDirectories returns the top-level encrypted directories on the
+// filesystem of ctx with their policies, sorted by path (which is used as the
+// name), and the descriptors of the policies in the filesystem's metadata for
+// which no directory was found.
+func findEncryptedDirectories(ctx *actions.Context) ([]subdirectoryPolicy, []string, error) {
+	dirs, err := ctx.EncryptedDirectories()
+	if err != nil {
+		return nil, nil, err
+	}
+	var found []subdirectoryPolicy
+	for descriptor, paths := range dirs {
+		policy, err := actions.GetPolicy(ctx, descriptor)
+		for _, path := range paths {
+			found = append(found, subdirectoryPolicy{
+				name: path, descriptor: descriptor, policy: policy, err: err})
+		}
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].name < found[j].name })
+
+	policyDescriptors, err := ctx.Mount.ListPolicies(ctx.TrustedUser)
+	if err != nil {
+		return nil, nil, err
+	}
+	var unused []string
+	for _, descriptor := range policyDescriptors {
+		if _, ok := dirs[descriptor]; !ok {
+			unused = append(unused, descriptor)
+		}
+	}
+	return found, unused, nil
+}
+
+// writeFindStatus lists the top-level encrypted directories on the filesystem
+// of ctx, with the policies and protectors they use, followed by the policies
+// which no directory was found for.
+func writeFindStatus(w io.Writer, ctx *actions.Context) error {
+	found, unused, err := findEncryptedDirectories(ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "%s filesystem %q has %s.\n", ctx.Mount.FilesystemType,
+		ctx.Mount.Path, pluralize(len(found), "encrypted directory"))
+	if len(found) > 0 {
+		fmt.Fprintln(w)
+		t := makeTableWriter(w, "DIRECTORY\tPOLICY\tUNLOCKED\tPROTECTORS")
+		for _, dir := range found {
+			if dir.err != nil {
+				fmt.Fprintf(t, "%s\t%s\t\t[%s]\n", dir.name, dir.descriptor, dir.err)
+				continue
+			}
+			fmt.Fprintf(t, "%s\t%s\t%s\t%s\n", dir.name, labeledDescriptor(dir.policy),
+				policyUnlockedStatus(dir.policy, dir.name),
+				strings.Join(dir.policy.ProtectorDescriptors(), ", "))
+		}
+		t.Flush()
+	}
+	if len(unused) > 0 {
+		fmt.Fprintln(w)
+		fmt.Fprintf(w, "No directory was found for %s: %s\n",
+			pluralize(len(unused), "policy"), strings.Join(unused, ", "))
+	}
+	return nil
+}
+
+// policyLabel returns the label of a policy, or the empty string if it has none
+// or it can't be read. Labels are only informational, so errors are ignored.
+func policyLabel(policy *actions.Policy) string {
+	label, err := policy.Label()
+	if err != nil {
+		util.Debug(err)
+		return ""
+	}
+	return label
+}
+
+// labeledDescriptor returns the policy's descriptor, followed by its label in
+// quotes if it has one.
+func labeledDescriptor(policy *actions.Policy) string {
+	if label := policyLabel(policy); label != "" {
+		return fmt.Sprintf("%s %q", policy.Descriptor(), label)
+	}
+	return policy.Descriptor()
+}
+
+// writeAllFilesystemsStatus prints the filesystem status of every filesystem
+// which is set up for use with fscrypt, only listing the policies which match
+// filter. Filesystems whose metadata can't be read are noted rather than
+// causing the whole command to fail.
+func writeAllFilesystemsStatus(w io.Writer, filter string) error {
+	mounts, err := filesystem.AllFilesystems()
+	if err != nil {
+		return err
+	}
+
+	useCount := 0
+	errorCount := 0
+	for _, mount := range mounts {
+		// A filesystem which is set up but whose status can't be read
+		// is reported with its error, rather than hiding the others.
+		ctx, err := actions.NewContextFromMountpoint(mount.Path, nil)
+		if err == nil {
+			err = ctx.Mount.CheckSetup(ctx.TrustedUser)
+		} else if _, ok := mount.CheckSetup(nil).(*filesystem.ErrNotSetup); ok {
+			continue
+		}
+		if _, ok := err.(*filesystem.ErrNotSetup); ok {
+			continue
+		}
+		if err == nil {
+			err = writeFilesystemStatus(w, ctx, filter)
+		}
+		if err != nil {
+			util.Debug(err)
+			fmt.Fprintf(w, "%s filesystem %q: [%s]\n", mount.FilesystemType,
+				mount.Path, err)
+			errorCount++
+		} else {
+			useCount++
+		}
+		fmt.Fprintln(w)
+	}
+
+	fmt.Fprintf(w, "filesystems with fscrypt metadata: %d\n", useCount)
+	if errorCount > 0 {
+		fmt.Fprintf(w, "filesystems with unreadable fscrypt metadata: %d\n", errorCount)
+	}
+	return nil
+}
+
+// writeOtherUsersNotice notes how many other users have unlocked the directory
+// at path (which uses a v2 policy), since it stays accessible to them until
+// they lock it too. Nothing is printed if there are no such users, or with
+// --quiet.
+func writeOtherUsersNotice(w io.Writer, policy *actions.Policy, path string) {
+	if quietFlag.Value {
+		return
+	}
+	count, err := policy.OtherUsersWithKey()
+	if err != nil {
+		util.Debug(err)
+		return
+	}
+	switch count {
+	case 0:
+		return
+	case 1:
+		fmt.Fprintf(w, "Note: 1 other user has unlocked %q too", path)
+	default:
+		fmt.Fprintf(w, "Note: %d other users have unlocked %q too", count, path)
+	}
+	fmt.Fprintln(w, ", so it stays accessible to them until they lock it.")
+}
+
+// policyKeyClaimants returns the names of the users who have unlocked a v2
+// policy, i.e. whose claims to its key keep it in the filesystem keyring. Only
+// root can find them, so it is nil for other users.
+func policyKeyClaimants(policy *actions.Policy) []string {
+	uids, err := policy.KeyClaimants()
+	if err != nil {
+		util.Debug(err)
+		return nil
+	}
+	names := make([]string, len(uids))
+	for i, uid := range uids {
+		names[i] = fmt.Sprintf("UID %d", uid)
+		if u, err := util.UserFromUID(int64(uid)); err == nil && u.Username != "" {
+			names[i] = u.Username
+		}
+	}
+	return names
+}
+
+// writeKeyClaims lists the users who have unlocked a v2 policy, if known and if
+// they include users other than the target user, as their claims keep the
+// policy's key from being removed when it is locked.
+func writeKeyClaims(w io.Writer, policy *actions.Policy) {
+	if count, err := policy.OtherUsersWithKey(); err != nil || count == 0 {
+		return
+	}
+	if names := policyKeyClaimants(policy); len(names) > 0 {
+		fmt.Fprintf(w, "Claims:   %s\n", strings.Join(names, ", "))
+	}
+}
+
+// writeInlineCryptStatus notes when inline encryption hardware can encrypt the
+// files of a policy with a single key for the whole policy (through the
+// kernel's blk-crypto), and whether the filesystem is mounted so that it does.
+func writeInlineCryptStatus(w io.Writer, policy *actions.Policy) {
+	if !policy.HasStableInodeFlags() {
+		return
+	}
+	if policy.Context.Mount.InlineCrypt {
+		fmt.Fprintln(w, "Inline:   compatible with blk-crypto offload (in use, as the filesystem is mounted with inlinecrypt)")
+	} else {
+		fmt.Fprintln(w, "Inline:   compatible with blk-crypto offload (not in use, as the filesystem isn't mounted with inlinecrypt)")
+	}
+}
+
+// writeStableInodeNotice notes that the files of a policy are tied to their
+// inode numbers, which rules out some ways of backing them up.
+func writeStableInodeNotice(w io.Writer, policy *actions.Policy) {
+	if !policy.HasStableInodeFlags() {
+		return
+	}
+	fmt.Fprint(w, "Note: this policy uses the IV_INO_LBLK_64 or IV_INO_LBLK_32 flag, ")
+	fmt.Fprintln(w, "so its files can't be moved to other inodes, e.g. by restoring a raw backup or shrinking the filesystem.")
+}
+
+// subdirectoryPolicy is an immediate subdirectory with its own policy, or the
+// error encountered getting that policy.
+type subdirectoryPolicy struct {
+	name       string
+	descriptor string
+	policy     *actions.Policy
+	err        error
+}
+
+// findSubdirectoryPolicies returns the immediate subdirectories of path which
+// are encrypted with a policy other than the one with parentDescriptor (which is
+// empty if path isn't encrypted). Such subdirectories are locked and unlocked
+// independently of path.
+func findSubdirectoryPolicies(path, parentDescriptor string) []subdirectoryPolicy {
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		util.Debug(err)
+		return nil
+	}
+	var subdirs []subdirectoryPolicy
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		subpath := filepath.Join(path, entry.Name())
+		data, err := metadata.GetPolicy(subpath)
+		if err != nil || data.KeyDescriptor == parentDescriptor {
+			continue
+		}
+		subdir := subdirectoryPolicy{name: entry.Name(), descriptor: data.KeyDescriptor}
+		// The subdirectory could be on another filesystem.
+		ctx, err := actions.NewContextFromPath(subpath, nil)
+		if err == nil {
+			subdir.policy, err = actions.GetPolicyFromPath(ctx, subpath)
+		}
+		subdir.err = err
+		subdirs = append(subdirs, subdir)
+	}
+	return subdirs
+}
+
+// writeSubdirectoryPolicies writes a table of the subdirectories of path found
+// by findSubdirectoryPolicies, with their unlock state.
+func writeSubdirectoryPolicies(w io.Writer, path string, subdirs []subdirectoryPolicy) {
+	t := makeTableWriter(w, "SUBDIRECTORY\tPOLICY\tUNLOCKED")
+	for _, subdir := range subdirs {
+		if subdir.err != nil {
+			fmt.Fprintf(t, "%s\t%s\t[%s]\n", subdir.name, subdir.descriptor, subdir.err)
+			continue
+		}
+		fmt.Fprintf(t, "%s\t%s\t%s\n", subdir.name, labeledDescriptor(subdir.policy),
+			policyUnlockedStatus(subdir.policy, filepath.Join(path, subdir.name)))
+	}
+	t.Flush()
+}
+
+// policyBoundary is a directory found by findPolicyBoundaries. Its name is
+// relative to the directory scanned, and its descriptor is empty if it isn't
+// encrypted.
+type policyBoundary struct {
+	subdirectoryPolicy
+	// mixed is set if the directory is inside a directory encrypted with
+	// another policy. The kernel refuses to access such directories.
+	mixed bool
+}
+
+// findPolicyBoundaries walks the tree at root and returns each directory whose
+// policy differs from that of its parent directory (including root itself if
+// it is encrypted), in walk order. Other filesystems mounted in the tree and
+// directories which can't be read are skipped.
+func findPolicyBoundaries(root string) ([]policyBoundary, error) {
+	var rootStat unix.Stat_t
+	if err := unix.Stat(root, &rootStat); err != nil {
+		return nil, err
+	}
+	descriptors := make(map[string]string)
+	var boundaries []policyBoundary
+	err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if path == root {
+				return err
+			}
+			util.Debug(err)
+			return nil
+		}
+		if !entry.IsDir() {
+			return nil
+		}
+		if path != root {
+			var stat unix.Stat_t
+			if err = unix.Lstat(path, &stat); err != nil || stat.Dev != rootStat.Dev {
+				return filepath.SkipDir
+			}
+		}
+		data, err := metadata.GetPolicy(path)
+		if err == nil {
+			descriptors[path] = data.KeyDescriptor
+		} else if _, ok := err.(*metadata.ErrNotEncrypted); !ok {
+			util.Debug(err)
+		}
+		parentDescriptor := ""
+		if path != root {
+			parentDescriptor = descriptors[filepath.Dir(path)]
+		}
+		if descriptors[path] == parentDescriptor {
+			return nil
+		}
+		name, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		boundary := policyBoundary{
+			subdirectoryPolicy: subdirectoryPolicy{name: name, descriptor: descriptors[path]},
+			mixed:              parentDescriptor != "",
+		}
+		if boundary.descriptor != "" {
+			var ctx *actions.Context
+			if ctx, boundary.err = actions.NewContextFromPath(path, nil); boundary.err == nil {
+				boundary.policy, boundary.err = actions.GetPolicyFromPath(ctx, path)
+			}
+		}
+		boundaries = append(boundaries, boundary)
+		return nil
+	})
+	return boundaries, err
+}
+
+// writeRecursiveStatus writes a table of the policy boundaries found beneath
+// root by findPolicyBoundaries, followed by a warning for each directory whose
+// policy differs from that of the encrypted directory containing it.
+func writeRecursiveStatus(w io.Writer, root string) error {
+	boundaries, err := findPolicyBoundaries(root)
+	if err != nil {
+		return err
+	}
+	if len(boundaries) == 0 {
+		return &metadata.ErrNotEncrypted{Path: root}
+	}
+	fmt.Fprintf(w, "Encryption policies found under %q:\n", root)
+	t := makeTableWriter(w, "PATH\tPOLICY\tUNLOCKED")
+	for _, boundary := range boundaries {
+		switch {
+		case boundary.descriptor == "":
+			fmt.Fprintf(t, "%s\t%s\t%s\n", boundary.name, "[not encrypted]", "-")
+		case boundary.err != nil:
+			fmt.Fprintf(t, "%s\t%s\t[%s]\n", boundary.name, boundary.descriptor, boundary.err)
+		default:
+			fmt.Fprintf(t, "%s\t%s\t%s\n", boundary.name, labeledDescriptor(boundary.policy),
+				policyUnlockedStatus(boundary.policy, filepath.Join(root, boundary.name)))
+		}
+	}
+	t.Flush()
+	for _, boundary := range boundaries {
+		if boundary.mixed {
+			fmt.Fprintln(w)
+			fmt.Fprintf(w, "WARNING: %q is not encrypted with the policy of the directory containing it. ", boundary.name)
+			fmt.Fprintln(w, "The kernel refuses to access such directories, so this usually means the files were corrupted or restored incorrectly.")
+		}
+	}
+	return nil
+}
+
 func writePathStatus(w io.Writer, path string) error {
 	ctx, err := actions.NewContextFromPath(path, nil)
 	if err != nil {
 		return err
 	}
 	policy, err := actions.GetPolicyFromPath(ctx, path)
+	if _, ok := err.(*metadata.ErrNotEncrypted); ok {
+		// The directory may still contain encrypted directories.
+		subdirs := findSubdirectoryPolicies(path, "")
+		if len(subdirs) == 0 {
+			return err
+		}
+		fmt.Fprintf(w, "%q is not encrypted, but it has encrypted subdirectories:\n", path)
+		writeSubdirectoryPolicies(w, path, subdirs)
+		return nil
+	}
 	if err != nil {
 		return err
 	}
@@ -219,12 +704,68 @@ func writePathStatus(w io.Writer, path string) error {
 	fmt.Fprintf(w, "%q is encrypted with fscrypt.\n", path)
 	fmt.Fprintln(w)
 	fmt.Fprintf(w, "Policy:   %s\n", policy.Descriptor())
+	if label := policyLabel(policy); label != "" {
+		fmt.Fprintf(w, "Label:    %s\n", label)
+	}
 	fmt.Fprintf(w, "Options:  %s\n", policy.Options())
 	fmt.Fprintf(w, "Unlocked: %s\n", policyUnlockedStatus(policy, path))
+	writeKeyClaims(w, policy)
+	writeInlineCryptStatus(w, policy)
+	writeOtherUsersNotice(w, policy, path)
+	writeStableInodeNotice(w, policy)
 	fmt.Fprintln(w)
 
 	options := policy.ProtectorOptions()
-	fmt.Fprintf(w, "Protected with %s:\n", pluralize(len(options), "protector"))
+	if threshold := policy.Threshold(); threshold > 1 {
+		fmt.Fprintf(w, "Protected with %s, any %d of which are needed to unlock it:\n",
+			pluralize(len(options), "protector"), threshold)
+	} else {
+		fmt.Fprintf(w, "Protected with %s:\n", pluralize(len(options), "protector"))
+	}
 	writeOptions(w, options)
+
+	if subdirs := findSubdirectoryPolicies(path, policy.Descriptor()); len(subdirs) > 0 {
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "Subdirectories with their own policies, which are locked and unlocked separately:")
+		writeSubdirectoryPolicies(w, path, subdirs)
+	}
+	return nil
+}
+
+// writeOrphanedKeys lists the fscrypt keys in the target user's user keyring
+// which don't belong to any known policy, and removes them if remove is true.
+func writeOrphanedKeys(w io.Writer, targetUser *user.User, remove bool) error {
+	keys, err := actions.FindOrphanedKeys(targetUser)
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		fmt.Fprintf(w, "The user keyring of %q has no orphaned fscrypt keys.\n",
+			targetUser.Username)
+		return nil
+	}
+
+	fmt.Fprintf(w, "The user keyring of %q has %s:\n", targetUser.Username,
+		pluralize(len(keys), "orphaned fscrypt key"))
+	t := makeTableWriter(w, "KEY ID\tDESCRIPTION\tPOLICY")
+	for _, key := range keys {
+		fmt.Fprintf(t, "%d\t%s\t%s\n", key.ID, key.Description, key.PolicyDescriptor)
+	}
+	if err = t.Flush(); err != nil || !remove {
+		return err
+	}
+
+	fmt.Fprintln(w)
+	prompt := fmt.Sprintf("Remove %s?", pluralize(len(keys), "key"))
+	warning := "If a filesystem with one of these policies is mounted without its fscrypt metadata, its directories will be locked."
+	if err = askConfirmation(prompt, false, warning); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err = keyring.RemoveUserKey(key, targetUser); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "Removed key %s.\n", key.Description)
+	}
 	return nil
 }
@@ -0,0 +1,497 @@
+/*
+ * status_json.go - File which contains the functions for outputting the status
+ * of fscrypt, a filesystem, or a directory as JSON.
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os/user"
+	"path/filepath"
+
+	"github.com/google/fscrypt/actions"
+	"github.com/google/fscrypt/filesystem"
+	"github.com/google/fscrypt/keyring"
+	"github.com/google/fscrypt/metadata"
+	"github.com/google/fscrypt/util"
+)
+
+// The values of the "unlocked" field of policies in JSON output
+const (
+	unlockedYes     = "yes"
+	unlockedNo      = "no"
+	unlockedPartial = "partial"
+	unlockedUnknown = "unknown"
+)
+
+// hashingCostsJSON is the passphrase hashing costs of a protector.
+type hashingCostsJSON struct {
+	KDF         string `json:"kdf"`
+	Time        int64  `json:"time"`
+	Memory      int64  `json:"memory_kib"`
+	Parallelism int64  `json:"parallelism"`
+}
+
+// protectorJSON describes a protector. Only the descriptor and the error are
+// set if the protector couldn't be read.
+type protectorJSON struct {
+	Descriptor    string            `json:"descriptor"`
+	Source        string            `json:"source,omitempty"`
+	Name          string            `json:"name,omitempty"`
+	NameEncrypted bool              `json:"name_encrypted,omitempty"`
+	UID           *int64            `json:"uid,omitempty"`
+	LinkedMount   string            `json:"linked_mountpoint,omitempty"`
+	HashingCosts  *hashingCostsJSON `json:"hashing_costs,omitempty"`
+	TPM2PCRs      []uint32          `json:"tpm2_pcrs,omitempty"`
+	KMSKey        string            `json:"kms_key,omitempty"`
+	TangURL       string            `json:"tang_url,omitempty"`
+	YubiKeySlot   uint32            `json:"yubikey_slot,omitempty"`
+	GPGRecipient  string            `json:"gpg_recipient,omitempty"`
+	SSHKey        string            `json:"ssh_key,omitempty"`
+	Error         string            `json:"error,omitempty"`
+}
+
+// optionsJSON is the encryption options of a policy.
+type optionsJSON struct {
+	PolicyVersion int64  `json:"policy_version"`
+	Contents      string `json:"contents"`
+	Filenames     string `json:"filenames"`
+	Padding       int64  `json:"padding"`
+	DataUnitSize  int64  `json:"data_unit_size,omitempty"`
+	NoDirectKey   bool   `json:"no_direct_key,omitempty"`
+	IVInoLblk64   bool   `json:"iv_ino_lblk_64,omitempty"`
+	IVInoLblk32   bool   `json:"iv_ino_lblk_32,omitempty"`
+}
+
+// policyJSON describes a policy. Only the descriptor and the error are set if
+// the policy couldn't be read.
+type policyJSON struct {
+	Descriptor string       `json:"descriptor"`
+	Label      string       `json:"label,omitempty"`
+	Options    *optionsJSON `json:"options,omitempty"`
+	Unlocked   string       `json:"unlocked,omitempty"`
+	Claims     []string     `json:"claims,omitempty"`
+	Protectors []string     `json:"protectors,omitempty"`
+	Threshold  int          `json:"threshold,omitempty"`
+	// Whether inline encryption hardware can encrypt the policy's files
+	// with a single key for the whole policy.
+	InlineCryptCompatible bool   `json:"inline_crypt_compatible,omitempty"`
+	Error                 string `json:"error,omitempty"`
+}
+
+// mountJSON is a filesystem in the global status.
+type mountJSON struct {
+	Mountpoint     string `json:"mountpoint"`
+	Device         string `json:"device"`
+	FilesystemType string `json:"filesystem_type"`
+	Encryption     string `json:"encryption"`
+	Fscrypt        bool   `json:"fscrypt"`
+}
+
+// filesystemStatusJSON is the status of a filesystem set up for fscrypt. Only
+// the fields up to Error are set if its metadata couldn't be read.
+type filesystemStatusJSON struct {
+	Mountpoint     string           `json:"mountpoint"`
+	FilesystemType string           `json:"filesystem_type"`
+	Error          string           `json:"error,omitempty"`
+	SetupMode      string           `json:"setup_mode,omitempty"`
+	PackedMetadata bool             `json:"packed_metadata,omitempty"`
+	Protectors     []*protectorJSON `json:"protectors,omitempty"`
+	Policies       []*policyJSON    `json:"policies,omitempty"`
+}
+
+// subdirectoryJSON is a subdirectory with its own policy.
+type subdirectoryJSON struct {
+	Name   string      `json:"name"`
+	Policy *policyJSON `json:"policy"`
+}
+
+// pathStatusJSON is the status of an encrypted file or directory, or of an
+// unencrypted directory with encrypted subdirectories.
+type pathStatusJSON struct {
+	Path           string              `json:"path"`
+	Encrypted      bool                `json:"encrypted"`
+	Policy         *policyJSON         `json:"policy,omitempty"`
+	Protectors     []*protectorJSON    `json:"protectors,omitempty"`
+	Subdirectories []*subdirectoryJSON `json:"subdirectories,omitempty"`
+}
+
+// policyBoundaryJSON is a directory found by "fscrypt status --recursive". Its
+// policy is omitted if it isn't encrypted.
+type policyBoundaryJSON struct {
+	Path        string      `json:"path"`
+	Policy      *policyJSON `json:"policy,omitempty"`
+	MixedPolicy bool        `json:"mixed_policy"`
+}
+
+// recursiveStatusJSON is the output of "fscrypt status --recursive".
+type recursiveStatusJSON struct {
+	Path        string                `json:"path"`
+	Directories []*policyBoundaryJSON `json:"directories"`
+}
+
+// encryptedDirectoryJSON is a top-level encrypted directory found by
+// "fscrypt status --find".
+type encryptedDirectoryJSON struct {
+	Path   string      `json:"path"`
+	Policy *policyJSON `json:"policy"`
+}
+
+// findStatusJSON is the output of "fscrypt status --find".
+type findStatusJSON struct {
+	Mountpoint     string                    `json:"mountpoint"`
+	FilesystemType string                    `json:"filesystem_type"`
+	Directories    []*encryptedDirectoryJSON `json:"directories"`
+	UnusedPolicies []string                  `json:"policies_without_directories"`
+}
+
+// orphanedKeyJSON is a key in a user keyring with no known policy.
+type orphanedKeyJSON struct {
+	ID               int    `json:"id"`
+	Description      string `json:"description"`
+	PolicyDescriptor string `json:"policy"`
+}
+
+// orphanedKeysJSON is the output of "fscrypt status --orphaned-keys".
+type orphanedKeysJSON struct {
+	User string             `json:"user"`
+	Keys []*orphanedKeyJSON `json:"keys"`
+}
+
+// writeJSON prints v as indented JSON.
+func writeJSON(w io.Writer, v interface{}) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "\t")
+	return encoder.Encode(v)
+}
+
+// policyUnlockedState is like policyUnlockedStatus, but returns one of the
+// unlocked* values for JSON output.
+func policyUnlockedState(policy *actions.Policy, path string) string {
+	status := policy.GetProvisioningStatus()
+	if status == keyring.KeyAbsent && policy.NeedsUserKeyring() &&
+		path != "" && isDirUnlockedHeuristic(path) {
+		return unlockedPartial
+	}
+	switch status {
+	case keyring.KeyPresent, keyring.KeyPresentButOnlyOtherUsers:
+		return unlockedYes
+	case keyring.KeyAbsent:
+		return unlockedNo
+	case keyring.KeyAbsentButFilesBusy:
+		return unlockedPartial
+	default:
+		return unlockedUnknown
+	}
+}
+
+func getProtectorJSON(option *actions.ProtectorOption) *protectorJSON {
+	info := &protectorJSON{Descriptor: option.Descriptor()}
+	if option.LoadError != nil {
+		info.Error = option.LoadError.Error()
+		return info
+	}
+	info.Source = option.Source().String()
+	info.Name = option.Name()
+	info.NameEncrypted = option.NameIsEncrypted()
+	if option.Source() == metadata.SourceType_pam_passphrase {
+		uid := option.UID()
+		info.UID = &uid
+	}
+	if option.LinkedMount != nil {
+		info.LinkedMount = option.LinkedMount.Path
+	}
+	if costs := option.HashingCosts(); costs != nil {
+		info.HashingCosts = &hashingCostsJSON{costs.Kdf.String(), costs.Time,
+			costs.Memory, costs.Parallelism}
+	}
+	if option.Source() == metadata.SourceType_tpm2 {
+		info.TPM2PCRs = option.TPM2SealedKey().PCRs
+	}
+	info.KMSKey = option.KMSKey()
+	info.TangURL = option.TangURL()
+	info.YubiKeySlot = option.YubiKeySlot()
+	info.GPGRecipient = option.GPGRecipient()
+	info.SSHKey = option.SSHKeyFingerprint()
+	return info
+}
+
+func getProtectorsJSON(options []*actions.ProtectorOption) []*protectorJSON {
+	protectors := make([]*protectorJSON, len(options))
+	for i, option := range options {
+		protectors[i] = getProtectorJSON(option)
+	}
+	return protectors
+}
+
+// getPolicyJSON describes policy. If path is non-empty, it is the directory
+// using the policy, for the unlock state heuristic.
+func getPolicyJSON(policy *actions.Policy, path string) *policyJSON {
+	options := policy.Options()
+	return &policyJSON{
+		Descriptor: policy.Descriptor(),
+		Label:      policyLabel(policy),
+		Options: &optionsJSON{
+			PolicyVersion: options.PolicyVersion,
+			Contents:      options.Contents.String(),
+			Filenames:     options.Filenames.String(),
+			Padding:       options.Padding,
+			DataUnitSize:  options.DataUnitSize,
+			NoDirectKey:   options.NoDirectKey,
+			IVInoLblk64:   options.IvInoLblk_64,
+			IVInoLblk32:   options.IvInoLblk_32,
+		},
+		Unlocked:   policyUnlockedState(policy, path),
+		Claims:     policyKeyClaimants(policy),
+		Protectors: policy.ProtectorDescriptors(),
+		Threshold:  policy.Threshold(),
+
+		InlineCryptCompatible: policy.HasStableInodeFlags(),
+	}
+}
+
+// writeGlobalStatusJSON is writeGlobalStatus with JSON output.
+func writeGlobalStatusJSON(w io.Writer) error {
+	mounts, err := filesystem.AllFilesystems()
+	if err != nil {
+		return err
+	}
+	infos := []*mountJSON{}
+	for _, mount := range mounts {
+		usingFscrypt := mount.CheckSetup(nil) == nil
+		if !usingFscrypt && mount.Device == "" {
+			continue
+		}
+		supportErr := mount.CheckSupport()
+		supportString := encryptionStatus(supportErr)
+		if supportString == "" {
+			util.Debug(supportErr)
+			continue
+		}
+		infos = append(infos, &mountJSON{
+			Mountpoint:     mount.Path,
+			Device:         mount.Device,
+			FilesystemType: mount.FilesystemType,
+			Encryption:     supportString,
+			Fscrypt:        usingFscrypt,
+		})
+	}
+	return writeJSON(w, struct {
+		Filesystems []*mountJSON `json:"filesystems"`
+	}{infos})
+}
+
+// getFilesystemStatusJSON is the JSON counterpart of writeFilesystemStatus.
+func getFilesystemStatusJSON(ctx *actions.Context, filter string) (*filesystemStatusJSON, error) {
+	options, err := ctx.ProtectorOptions()
+	if err != nil {
+		return nil, err
+	}
+	policyDescriptors, err := ctx.Mount.ListPolicies(ctx.TrustedUser)
+	if err != nil {
+		return nil, err
+	}
+
+	status := &filesystemStatusJSON{
+		Mountpoint:     ctx.Mount.Path,
+		FilesystemType: ctx.Mount.FilesystemType,
+		PackedMetadata: ctx.Mount.MetadataStore() == filesystem.PackedStore,
+		Protectors:     getProtectorsJSON(options),
+		Policies:       []*policyJSON{},
+	}
+	if setupMode, _, err := ctx.Mount.GetSetupMode(); err == nil {
+		switch setupMode {
+		case filesystem.WorldWritable:
+			status.SetupMode = "all_users"
+		case filesystem.SingleUserWritable:
+			status.SetupMode = "single_user"
+		}
+	}
+	for _, descriptor := range policyDescriptors {
+		policy, err := actions.GetPolicy(ctx, descriptor)
+		if err != nil {
+			if filter != "" {
+				util.Debug(err)
+				continue
+			}
+			status.Policies = append(status.Policies,
+				&policyJSON{Descriptor: descriptor, Error: err.Error()})
+			continue
+		}
+		if policyMatchesFilter(policy, filter) {
+			status.Policies = append(status.Policies, getPolicyJSON(policy, ""))
+		}
+	}
+	return status, nil
+}
+
+// writeFilesystemStatusJSON is writeFilesystemStatus with JSON output.
+func writeFilesystemStatusJSON(w io.Writer, ctx *actions.Context, filter string) error {
+	status, err := getFilesystemStatusJSON(ctx, filter)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, status)
+}
+
+// writeAllFilesystemsStatusJSON is writeAllFilesystemsStatus with JSON output.
+// Filesystems whose metadata can't be read are listed with an error.
+func writeAllFilesystemsStatusJSON(w io.Writer, filter string) error {
+	mounts, err := filesystem.AllFilesystems()
+	if err != nil {
+		return err
+	}
+	statuses := []*filesystemStatusJSON{}
+	for _, mount := range mounts {
+		// A filesystem which is set up but whose status can't be read
+		// is reported with its error, rather than hiding the others.
+		var status *filesystemStatusJSON
+		ctx, err := actions.NewContextFromMountpoint(mount.Path, nil)
+		if err == nil {
+			err = ctx.Mount.CheckSetup(ctx.TrustedUser)
+		} else if _, ok := mount.CheckSetup(nil).(*filesystem.ErrNotSetup); ok {
+			continue
+		}
+		if _, ok := err.(*filesystem.ErrNotSetup); ok {
+			continue
+		}
+		if err == nil {
+			status, err = getFilesystemStatusJSON(ctx, filter)
+		}
+		if err != nil {
+			util.Debug(err)
+			status = &filesystemStatusJSON{
+				Mountpoint:     mount.Path,
+				FilesystemType: mount.FilesystemType,
+				Error:          err.Error(),
+			}
+		}
+		statuses = append(statuses, status)
+	}
+	return writeJSON(w, struct {
+		Filesystems []*filesystemStatusJSON `json:"filesystems"`
+	}{statuses})
+}
+
+func getSubdirectoriesJSON(path string, subdirs []subdirectoryPolicy) []*subdirectoryJSON {
+	infos := make([]*subdirectoryJSON, len(subdirs))
+	for i, subdir := range subdirs {
+		info := &subdirectoryJSON{Name: subdir.name}
+		if subdir.err != nil {
+			info.Policy = &policyJSON{Descriptor: subdir.descriptor, Error: subdir.err.Error()}
+		} else {
+			info.Policy = getPolicyJSON(subdir.policy, filepath.Join(path, subdir.name))
+		}
+		infos[i] = info
+	}
+	return infos
+}
+
+// writePathStatusJSON is writePathStatus with JSON output.
+func writePathStatusJSON(w io.Writer, path string) error {
+	ctx, err := actions.NewContextFromPath(path, nil)
+	if err != nil {
+		return err
+	}
+	policy, err := actions.GetPolicyFromPath(ctx, path)
+	if _, ok := err.(*metadata.ErrNotEncrypted); ok {
+		subdirs := findSubdirectoryPolicies(path, "")
+		if len(subdirs) == 0 {
+			return err
+		}
+		return writeJSON(w, &pathStatusJSON{
+			Path:           path,
+			Subdirectories: getSubdirectoriesJSON(path, subdirs),
+		})
+	}
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, &pathStatusJSON{
+		Path:       path,
+		Encrypted:  true,
+		Policy:     getPolicyJSON(policy, path),
+		Protectors: getProtectorsJSON(policy.ProtectorOptions()),
+		Subdirectories: getSubdirectoriesJSON(path,
+			findSubdirectoryPolicies(path, policy.Descriptor())),
+	})
+}
+
+// writeRecursiveStatusJSON is writeRecursiveStatus with JSON output.
+func writeRecursiveStatusJSON(w io.Writer, root string) error {
+	boundaries, err := findPolicyBoundaries(root)
+	if err != nil {
+		return err
+	}
+	if len(boundaries) == 0 {
+		return &metadata.ErrNotEncrypted{Path: root}
+	}
+	status := &recursiveStatusJSON{Path: root}
+	for _, boundary := range boundaries {
+		info := &policyBoundaryJSON{Path: boundary.name, MixedPolicy: boundary.mixed}
+		switch {
+		case boundary.descriptor == "":
+		case boundary.err != nil:
+			info.Policy = &policyJSON{Descriptor: boundary.descriptor, Error: boundary.err.Error()}
+		default:
+			info.Policy = getPolicyJSON(boundary.policy, filepath.Join(root, boundary.name))
+		}
+		status.Directories = append(status.Directories, info)
+	}
+	return writeJSON(w, status)
+}
+
+// writeFindStatusJSON is writeFindStatus with JSON output.
+func writeFindStatusJSON(w io.Writer, ctx *actions.Context) error {
+	found, unused, err := findEncryptedDirectories(ctx)
+	if err != nil {
+		return err
+	}
+	status := &findStatusJSON{
+		Mountpoint:     ctx.Mount.Path,
+		FilesystemType: ctx.Mount.FilesystemType,
+		Directories:    []*encryptedDirectoryJSON{},
+		UnusedPolicies: []string{},
+	}
+	for _, dir := range found {
+		info := &encryptedDirectoryJSON{Path: dir.name}
+		if dir.err != nil {
+			info.Policy = &policyJSON{Descriptor: dir.descriptor, Error: dir.err.Error()}
+		} else {
+			info.Policy = getPolicyJSON(dir.policy, dir.name)
+		}
+		status.Directories = append(status.Directories, info)
+	}
+	status.UnusedPolicies = append(status.UnusedPolicies, unused...)
+	return writeJSON(w, status)
+}
+
+// writeOrphanedKeysJSON is writeOrphanedKeys with JSON output. The keys can't
+// be removed, as that needs confirmation.
+func writeOrphanedKeysJSON(w io.Writer, targetUser *user.User) error {
+	keys, err := actions.FindOrphanedKeys(targetUser)
+	if err != nil {
+		return err
+	}
+	infos := &orphanedKeysJSON{User: targetUser.Username, Keys: []*orphanedKeyJSON{}}
+	for _, key := range keys {
+		infos.Keys = append(infos.Keys, &orphanedKeyJSON{key.ID, key.Description, key.PolicyDescriptor})
+	}
+	return writeJSON(w, infos)
+}
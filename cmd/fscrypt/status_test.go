@@ -0,0 +1,54 @@
+/*
+ * status_test.go - tests for outputting the status of directories
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/fscrypt/metadata"
+)
+
+// Tests that scanning an unencrypted tree finds no policy boundaries, and that
+// the recursive status then fails like the status of an unencrypted directory.
+func TestFindPolicyBoundariesUnencrypted(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "a", "b"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "a", "file"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	boundaries, err := findPolicyBoundaries(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(boundaries) != 0 {
+		t.Errorf("unencrypted tree shouldn't have policy boundaries, got %v", boundaries)
+	}
+	err = writeRecursiveStatus(io.Discard, root)
+	if _, ok := err.(*metadata.ErrNotEncrypted); !ok {
+		t.Errorf("expected ErrNotEncrypted, got %v", err)
+	}
+	if _, err = findPolicyBoundaries(filepath.Join(root, "missing")); err == nil {
+		t.Error("scanning a missing directory should fail")
+	}
+}
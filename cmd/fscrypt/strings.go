@@ -29,10 +29,12 @@ const shortUsage = "A tool for managing Linux native filesystem encryption"
 
 // Argument usage strings
 const (
-	directoryArg    = "DIRECTORY"
-	mountpointArg   = "MOUNTPOINT"
-	pathArg         = "PATH"
-	mountpointIDArg = mountpointArg + ":ID"
+	directoryArg     = "DIRECTORY"
+	mountpointArg    = "MOUNTPOINT"
+	pathArg          = "PATH"
+	mountpointIDArg  = mountpointArg + ":ID"
+	keyIdentifierArg = "KEY_IDENTIFIER"
+	backupFileArg    = "FILE"
 )
 
 // Text Templates which format our command line output (using text/template)
@@ -90,10 +92,19 @@ Options:
 
 // Add words to this map to have pluralize support them.
 var plurals = map[string]string{
-	"argument":   "arguments",
-	"filesystem": "filesystems",
-	"protector":  "protectors",
-	"policy":     "policies",
+	"argument":             "arguments",
+	"directory":            "directories",
+	"encrypted directory":  "encrypted directories",
+	"file":                 "files",
+	"filesystem":           "filesystems",
+	"key":                  "keys",
+	"linked protector":     "linked protectors",
+	"orphaned fscrypt key": "orphaned fscrypt keys",
+	"protector":            "protectors",
+	"protector link":       "protector links",
+	"policy":               "policies",
+	"problem":              "problems",
+	"symlink":              "symlinks",
 }
 
 // pluralize prints out the correct pluralization of a word along with the
@@ -105,3 +116,12 @@ func pluralize(count int, word string) string {
 	}
 	return fmt.Sprintf("%d %s", count, word)
 }
+
+// quoteList prints out a comma-separated list of quoted strings.
+func quoteList(list []string) string {
+	quoted := make([]string, len(list))
+	for i, str := range list {
+		quoted[i] = fmt.Sprintf("%q", str)
+	}
+	return strings.Join(quoted, ", ")
+}
@@ -0,0 +1,276 @@
+/*
+ * suspend.go - Locking policies before the system suspends, and unlocking them
+ * again after it resumes.
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/urfave/cli"
+
+	"github.com/google/fscrypt/actions"
+	"github.com/google/fscrypt/filesystem"
+	"github.com/google/fscrypt/metadata"
+	"github.com/google/fscrypt/security"
+	"github.com/google/fscrypt/util"
+)
+
+// suspendStateFile is where "fscrypt lock --for-suspend" records the policies
+// it locked, one MOUNTPOINT:ID per line, for "fscrypt unlock --after-suspend".
+// It is under /run so that it doesn't outlive a reboot.
+var suspendStateFile = "/run/fscrypt/locked-for-suspend"
+
+// suspendTarget is a filesystem whose policies are locked before suspending. A
+// nil list of policies means all of them.
+type suspendTarget struct {
+	mountpoint string
+	policies   []string
+}
+
+// suspendLockTargets groups the policies (as MOUNTPOINT:ID) to lock before
+// suspending by filesystem. If there are none, all the filesystems are
+// returned, to lock all of their policies.
+func suspendLockTargets(policies []string) ([]*suspendTarget, error) {
+	var targets []*suspendTarget
+	if len(policies) == 0 {
+		mounts, err := filesystem.AllFilesystems()
+		if err != nil {
+			return nil, err
+		}
+		for _, mount := range mounts {
+			targets = append(targets, &suspendTarget{mountpoint: mount.Path})
+		}
+		return targets, nil
+	}
+
+	byMountpoint := make(map[string]*suspendTarget)
+	for _, policy := range policies {
+		mountpoint, descriptor, err := matchMetadataFlag(policy)
+		if err != nil {
+			return nil, err
+		}
+		target, ok := byMountpoint[mountpoint]
+		if !ok {
+			target = &suspendTarget{mountpoint: mountpoint}
+			byMountpoint[mountpoint] = target
+			targets = append(targets, target)
+		}
+		target.policies = append(target.policies, descriptor)
+	}
+	return targets, nil
+}
+
+// lockSuspendTarget locks the target's policies for all users, and lists what
+// happened to them. It returns the policies whose keys were removed, and
+// whether any of them were v1 policies in user keyrings, whose caches must be
+// dropped.
+func lockSuspendTarget(w io.Writer, target *suspendTarget) ([]string, bool, error) {
+	ctx, err := actions.NewContextFromMountpoint(target.mountpoint, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	var results []*actions.LockResult
+	if target.policies == nil {
+		results, err = actions.LockAllPolicies(ctx, true)
+	} else {
+		results, err = actions.LockPolicies(ctx, target.policies, true)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if len(results) == 0 {
+		return nil, false, nil
+	}
+
+	fmt.Fprintf(w, "Locking policies on %q:\n", ctx.Mount.Path)
+	notLocked, err := writeLockResults(w, results)
+	if err != nil {
+		return nil, false, err
+	}
+	if notLocked > 0 {
+		err = &ErrPoliciesNotFullyLocked{ctx.Mount.Path, notLocked}
+	}
+	var locked []string
+	needsDropCaches := false
+	for _, result := range results {
+		if result.Err != nil {
+			continue
+		}
+		locked = append(locked, ctx.Mount.Path+":"+result.PolicyDescriptor)
+		if len(result.PolicyDescriptor) == metadata.PolicyDescriptorLenV1 &&
+			!ctx.Config.GetUseFsKeyringForV1Policies() {
+			needsDropCaches = true
+		}
+	}
+	return locked, needsDropCaches, err
+}
+
+// writeSuspendState records the policies which were locked for suspend,
+// replacing those recorded before.
+func writeSuspendState(policies []string) error {
+	if err := os.MkdirAll(filepath.Dir(suspendStateFile), 0755); err != nil {
+		return err
+	}
+	var contents strings.Builder
+	for _, policy := range policies {
+		contents.WriteString(policy + "\n")
+	}
+	// Anyone may read which policies were locked, as the policies on each
+	// filesystem are listed in its metadata anyway.
+	return os.WriteFile(suspendStateFile, []byte(contents.String()), 0644)
+}
+
+// readSuspendState returns the policies which were locked for suspend, if any.
+func readSuspendState() ([]string, error) {
+	file, err := os.Open(suspendStateFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var policies []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			policies = append(policies, line)
+		}
+	}
+	return policies, scanner.Err()
+}
+
+// lockForSuspendAction locks the policies set with suspend_lock_policies in the
+// config file (or all of them) for all users, and records them for
+// unlockAfterSuspendAction.
+func lockForSuspendAction(c *cli.Context) error {
+	if policyFlag.Value != "" || allPoliciesFlag.Value || afterFlag.Value != "" {
+		return &usageError{c, fmt.Sprintf("%s cannot be used with %s, %s, or %s",
+			shortDisplay(forSuspendFlag), shortDisplay(policyFlag),
+			shortDisplay(allPoliciesFlag), shortDisplay(afterFlag))}
+	}
+	if c.NArg() != 0 {
+		return expectedArgsErr(c, 0, false)
+	}
+	if !util.IsUserRoot() {
+		return newExitError(c, ErrMustBeRoot)
+	}
+	configured, err := actions.SuspendLockPolicies()
+	if err != nil {
+		return newExitError(c, err)
+	}
+	targets, err := suspendLockTargets(configured)
+	if err != nil {
+		return newExitError(c, err)
+	}
+
+	// Lock as much as possible, as the system is about to suspend anyway.
+	var locked []string
+	needsDropCaches, failed := false, false
+	for _, target := range targets {
+		policies, dropCaches, err := lockSuspendTarget(c.App.Writer, target)
+		if _, ok := err.(*filesystem.ErrNotSetup); ok && configured == nil {
+			continue
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, newExitError(c, err))
+			failed = true
+		}
+		locked = append(locked, policies...)
+		needsDropCaches = needsDropCaches || dropCaches
+	}
+	if err = writeSuspendState(locked); err != nil {
+		return newExitError(c, err)
+	}
+	if needsDropCaches && dropCachesFlag.Value {
+		if err = security.DropFilesystemCache(); err != nil {
+			return newExitError(c, err)
+		}
+		fmt.Fprintf(c.App.Writer, "Encrypted data removed from filesystem cache.\n")
+	}
+	fmt.Fprintf(c.App.Writer, "Locked %s for suspend.\n", pluralize(len(locked), "policy"))
+	if failed {
+		return newExitError(c, ErrNotLockedForSuspend)
+	}
+	return nil
+}
+
+// unlockAfterSuspendAction offers to unlock each of the policies which were
+// locked for suspend, unless the target user has unlocked it again already.
+func unlockAfterSuspendAction(c *cli.Context) error {
+	if c.NArg() != 0 {
+		return expectedArgsErr(c, 0, false)
+	}
+	targetUser, err := parseUserFlag()
+	if err != nil {
+		return newExitError(c, err)
+	}
+	locked, err := readSuspendState()
+	if err != nil {
+		return newExitError(c, err)
+	}
+
+	unlocked := 0
+	defer wipeEnteredPassphrases()
+	for _, flagValue := range locked {
+		policy, err := getPolicyFromFlag(flagValue, targetUser)
+		if err != nil {
+			// e.g. the policy of another user, or the filesystem
+			// isn't mounted anymore
+			util.Debugf("skipping policy %s: %v", flagValue, err)
+			continue
+		}
+		if policy.IsProvisionedByTargetUser() {
+			util.Debugf("policy %s is already provisioned", flagValue)
+			continue
+		}
+		question := fmt.Sprintf("Unlock policy %s on %q, which was locked for suspend?",
+			policy.Descriptor(), policy.Context.Mount.Path)
+		if err = askConfirmation(question, true, ""); err != nil {
+			if err == ErrCanceled {
+				continue
+			}
+			return newExitError(c, err)
+		}
+		if err = validateKeyringPrereqs(policy.Context, policy); err != nil {
+			return newExitError(c, err)
+		}
+		if err = policy.Unlock(optionFn, existingKeyFn); err != nil {
+			return newExitError(c, err)
+		}
+		err = policy.Provision()
+		policy.Lock()
+		if err != nil {
+			return newExitError(c, err)
+		}
+		fmt.Fprintf(c.App.Writer, "Policy %s on %q is now unlocked.\n",
+			policy.Descriptor(), policy.Context.Mount.Path)
+		unlocked++
+	}
+	if unlocked == 0 {
+		fmt.Fprintln(c.App.Writer, "No policies locked for suspend are left to unlock.")
+	}
+	storeEnteredPassphrases()
+	return nil
+}
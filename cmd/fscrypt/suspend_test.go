@@ -0,0 +1,72 @@
+/*
+ * suspend_test.go - tests for locking policies before suspending
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// Tests that the configured policies are grouped by filesystem, in the order in
+// which the filesystems are first given.
+func TestSuspendLockTargets(t *testing.T) {
+	targets, err := suspendLockTargets([]string{
+		"/home:0123456789abcdef",
+		"/mnt/disk:16382f282d7b29ee27e6460151d03382",
+		"/home:fedcba9876543210",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []*suspendTarget{
+		{"/home", []string{"0123456789abcdef", "fedcba9876543210"}},
+		{"/mnt/disk", []string{"16382f282d7b29ee27e6460151d03382"}},
+	}
+	if !reflect.DeepEqual(targets, expected) {
+		t.Errorf("got %+v, expected %+v", targets, expected)
+	}
+
+	if _, err = suspendLockTargets([]string{"0123456789abcdef"}); err == nil {
+		t.Error("policy without a mountpoint should be rejected")
+	}
+}
+
+// Tests that the policies locked for suspend are read back, and that nothing
+// is read if nothing was locked.
+func TestSuspendState(t *testing.T) {
+	oldFile := suspendStateFile
+	suspendStateFile = filepath.Join(t.TempDir(), "fscrypt", "locked-for-suspend")
+	defer func() { suspendStateFile = oldFile }()
+
+	policies, err := readSuspendState()
+	if err != nil || policies != nil {
+		t.Fatalf("got %v, %v before locking for suspend", policies, err)
+	}
+	locked := []string{"/home:0123456789abcdef", "/mnt/disk:16382f282d7b29ee27e6460151d03382"}
+	if err = writeSuspendState(locked); err != nil {
+		t.Fatal(err)
+	}
+	if policies, err = readSuspendState(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(policies, locked) {
+		t.Errorf("got %v, expected %v", policies, locked)
+	}
+}
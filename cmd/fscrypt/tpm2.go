@@ -0,0 +1,244 @@
+/*
+ * tpm2.go - Sealing and unsealing the wrapping keys of tpm2 protectors with a
+ * TPM 2.0 device.
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/google/fscrypt/actions"
+	"github.com/google/fscrypt/crypto"
+	"github.com/google/fscrypt/metadata"
+	"github.com/google/fscrypt/util"
+)
+
+// The TPM is accessed with the tpm2-tools programs, so fscrypt doesn't depend
+// on the TPM2 Software Stack itself. They find the TPM (normally through the
+// /dev/tpmrm0 resource manager) on their own.
+var (
+	tpm2CreatePrimaryCommand = "tpm2_createprimary"
+	tpm2CreatePolicyCommand  = "tpm2_createpolicy"
+	tpm2CreateCommand        = "tpm2_create"
+	tpm2LoadCommand          = "tpm2_load"
+	tpm2UnsealCommand        = "tpm2_unseal"
+)
+
+// Messages in the errors of tpm2-tools for a policy session whose PCR values
+// don't match (TPM_RC_POLICY_FAIL), and for an object which wasn't made by
+// this TPM, or not under the same primary key (TPM_RC_INTEGRITY)
+var (
+	tpm2PolicyFailErrors = []string{"0x99D", "0x99d", "policy check failed"}
+	tpm2IntegrityErrors  = []string{"0x9A2", "0x9a2", "integrity check failed"}
+)
+
+// tpm2Tools is the actions.TPM2Sealer used by the fscrypt command. Keys are
+// sealed under the TPM's storage primary key, which the TPM derives again each
+// time from its storage seed, so nothing has to be persisted in the TPM.
+type tpm2Tools struct{}
+
+func (tpm2Tools) Seal(name string, key *crypto.Key) (*actions.TPM2SealedKey, error) {
+	pcrs, err := parseTPM2PCRs(tpm2PCRsFlag.Value)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := makeTPM2WorkDir()
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	primary, err := createTPM2Primary(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	public := filepath.Join(dir, "sealed.pub")
+	private := filepath.Join(dir, "sealed.priv")
+	args := []string{"-Q", "-C", primary, "-u", public, "-r", private, "-i", "-"}
+	if len(pcrs) > 0 {
+		policy := filepath.Join(dir, "policy.digest")
+		if _, err = runTPM2Tool(tpm2CreatePolicyCommand, nil, "-Q", "--policy-pcr",
+			"-l", tpm2PCRSelection(pcrs), "-L", policy); err != nil {
+			return nil, err
+		}
+		args = append(args, "-L", policy)
+	}
+	if _, err = runTPM2Tool(tpm2CreateCommand, key.Data(), args...); err != nil {
+		return nil, err
+	}
+
+	sealed := &actions.TPM2SealedKey{PCRs: pcrs}
+	if sealed.Public, err = os.ReadFile(public); err != nil {
+		return nil, err
+	}
+	if sealed.Private, err = os.ReadFile(private); err != nil {
+		return nil, err
+	}
+	if len(pcrs) > 0 {
+		fmt.Printf("Sealed the key of protector %q to the current values of PCRs %s.\n",
+			name, formatPCRs(pcrs))
+	}
+	return sealed, nil
+}
+
+func (tpm2Tools) Unseal(info actions.ProtectorInfo, retry bool) (*crypto.Key, error) {
+	// The TPM always unseals the same key, so a wrong key can't be fixed
+	// by asking it again.
+	if retry {
+		return nil, ErrWrongKey
+	}
+	return unsealTPM2Key(info.TPM2SealedKey())
+}
+
+// unsealTPM2Key has the TPM unseal a key which it sealed.
+func unsealTPM2Key(sealed *actions.TPM2SealedKey) (*crypto.Key, error) {
+	dir, err := makeTPM2WorkDir()
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	primary, err := createTPM2Primary(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	public := filepath.Join(dir, "sealed.pub")
+	private := filepath.Join(dir, "sealed.priv")
+	if err = os.WriteFile(public, sealed.Public, 0600); err != nil {
+		return nil, err
+	}
+	if err = os.WriteFile(private, sealed.Private, 0600); err != nil {
+		return nil, err
+	}
+	object := filepath.Join(dir, "sealed.ctx")
+	if _, err = runTPM2Tool(tpm2LoadCommand, nil, "-Q", "-C", primary,
+		"-u", public, "-r", private, "-c", object); err != nil {
+		return nil, err
+	}
+	args := []string{"-c", object}
+	if len(sealed.PCRs) > 0 {
+		args = append(args, "-p", "pcr:"+tpm2PCRSelection(sealed.PCRs))
+	}
+	output, err := runTPM2Tool(tpm2UnsealCommand, nil, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for i := range output {
+			output[i] = 0
+		}
+	}()
+	return crypto.NewFixedLengthKeyFromReader(bytes.NewReader(output), metadata.InternalKeyLen)
+}
+
+// parseTPM2PCRs parses a comma-separated list of PCRs, as given to tpm2PCRsFlag.
+// The returned PCRs are sorted and distinct.
+func parseTPM2PCRs(value string) ([]uint32, error) {
+	if value == "" {
+		return nil, nil
+	}
+	var selected [metadata.TPM2NumPCRs]bool
+	for _, field := range strings.Split(value, ",") {
+		pcr, err := strconv.ParseUint(strings.TrimSpace(field), 10, 32)
+		if err != nil || pcr >= metadata.TPM2NumPCRs {
+			return nil, errors.Errorf("invalid PCR %q in %s (must be 0 to %d)",
+				field, shortDisplay(tpm2PCRsFlag), metadata.TPM2NumPCRs-1)
+		}
+		selected[pcr] = true
+	}
+	var pcrs []uint32
+	for pcr, ok := range selected {
+		if ok {
+			pcrs = append(pcrs, uint32(pcr))
+		}
+	}
+	return pcrs, nil
+}
+
+// formatPCRs formats PCRs as a comma-separated list, e.g. "0,7".
+func formatPCRs(pcrs []uint32) string {
+	fields := make([]string, len(pcrs))
+	for i, pcr := range pcrs {
+		fields[i] = strconv.FormatUint(uint64(pcr), 10)
+	}
+	return strings.Join(fields, ",")
+}
+
+// tpm2PCRSelection formats PCRs of the SHA-256 bank for tpm2-tools, e.g.
+// "sha256:0,7".
+func tpm2PCRSelection(pcrs []uint32) string {
+	return "sha256:" + formatPCRs(pcrs)
+}
+
+// makeTPM2WorkDir makes a private directory for the files which tpm2-tools
+// reads and writes. None of them contain the unsealed key.
+func makeTPM2WorkDir() (string, error) {
+	if _, err := exec.LookPath(tpm2CreatePrimaryCommand); err != nil {
+		util.Debug(err)
+		return "", ErrNoTPM2Tools
+	}
+	return os.MkdirTemp("", "fscrypt-tpm2-")
+}
+
+// createTPM2Primary loads the storage primary key of the owner hierarchy into
+// the TPM, and returns the path of its context file.
+func createTPM2Primary(dir string) (string, error) {
+	primary := filepath.Join(dir, "primary.ctx")
+	_, err := runTPM2Tool(tpm2CreatePrimaryCommand, nil, "-Q", "-C", "o",
+		"-g", "sha256", "-G", "ecc", "-c", primary)
+	return primary, err
+}
+
+// runTPM2Tool runs one of the tpm2-tools programs with input on stdin, and
+// returns its output.
+func runTPM2Tool(command string, input []byte, args ...string) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(command, args...)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	util.Debugf("%s %s: %v", command, strings.Join(args, " "), err)
+	if err == nil {
+		return stdout.Bytes(), nil
+	}
+	message := strings.TrimSpace(stderr.String())
+	util.Debug(message)
+	for _, policyFail := range tpm2PolicyFailErrors {
+		if strings.Contains(message, policyFail) {
+			return nil, ErrTPM2PCRMismatch
+		}
+	}
+	for _, integrity := range tpm2IntegrityErrors {
+		if strings.Contains(message, integrity) {
+			return nil, ErrWrongTPM
+		}
+	}
+	if message == "" {
+		return nil, errors.Wrap(err, command)
+	}
+	return nil, errors.Errorf("%s: %s", command, message)
+}
@@ -0,0 +1,134 @@
+/*
+ * tpm2_test.go - tests for sealing keys with a TPM 2.0 device
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/google/fscrypt/actions"
+	"github.com/google/fscrypt/crypto"
+	"github.com/google/fscrypt/metadata"
+)
+
+// fakeTPM2Tools replaces the tpm2-tools programs with shell scripts which "seal"
+// data by storing it as is in the private part, and unseal it by printing it.
+// The unseal script runs extra before that.
+func fakeTPM2Tools(t *testing.T, unsealExtra string) {
+	dir := t.TempDir()
+	write := func(name, script string) string {
+		path := filepath.Join(dir, name)
+		script = "#!/bin/sh\n" + `while [ $# -gt 0 ]; do
+	case $1 in -c|-u|-r|-L) eval "opt_${1#-}=\$2"; shift;; esac
+	shift
+done
+` + script + "\n"
+		if err := os.WriteFile(path, []byte(script), 0700); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	old := []string{tpm2CreatePrimaryCommand, tpm2CreatePolicyCommand,
+		tpm2CreateCommand, tpm2LoadCommand, tpm2UnsealCommand}
+	tpm2CreatePrimaryCommand = write("tpm2_createprimary", `touch "$opt_c"`)
+	tpm2CreatePolicyCommand = write("tpm2_createpolicy", `echo policy > "$opt_L"`)
+	tpm2CreateCommand = write("tpm2_create", `echo public > "$opt_u"; cat > "$opt_r"`)
+	tpm2LoadCommand = write("tpm2_load", `cp "$opt_r" "$opt_c"`)
+	tpm2UnsealCommand = write("tpm2_unseal", unsealExtra+`
+cat "$opt_c"`)
+	t.Cleanup(func() {
+		tpm2CreatePrimaryCommand, tpm2CreatePolicyCommand = old[0], old[1]
+		tpm2CreateCommand, tpm2LoadCommand, tpm2UnsealCommand = old[2], old[3], old[4]
+	})
+}
+
+func TestParseTPM2PCRs(t *testing.T) {
+	pcrs, err := parseTPM2PCRs("7, 0,7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []uint32{0, 7}; !reflect.DeepEqual(pcrs, expected) {
+		t.Errorf("got PCRs %v, expected %v", pcrs, expected)
+	}
+	for _, value := range []string{"24", "-1", "0,,7", "seven"} {
+		if _, err := parseTPM2PCRs(value); err == nil {
+			t.Errorf("PCRs %q should be invalid", value)
+		}
+	}
+}
+
+// Tests that the key which was sealed is the one unsealed.
+func TestTPM2SealUnseal(t *testing.T) {
+	fakeTPM2Tools(t, "")
+	key, err := crypto.NewRandomKey(metadata.InternalKeyLen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer key.Wipe()
+	tpm2PCRsFlag.Value = "0,7"
+	defer func() { tpm2PCRsFlag.Value = "" }()
+
+	sealed, err := tpm2Tools{}.Seal("test", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(sealed.PCRs, []uint32{0, 7}) {
+		t.Errorf("got PCRs %v, expected [0 7]", sealed.PCRs)
+	}
+	unsealed, err := unsealTPM2Key(sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unsealed.Wipe()
+	if !bytes.Equal(unsealed.Data(), key.Data()) {
+		t.Error("unsealed key differs from the sealed key")
+	}
+}
+
+// Tests that changed PCR values and objects from another TPM are reported.
+func TestTPM2Errors(t *testing.T) {
+	tests := []struct {
+		name     string
+		unseal   string
+		expected error
+	}{
+		{"PCR mismatch",
+			"echo 'ERROR: Esys_Unseal(0x99D) - tpm:session(1):a policy check failed' >&2; exit 1",
+			ErrTPM2PCRMismatch},
+		{"another TPM",
+			"echo 'ERROR: Esys_Load(0x9A2) - tpm:parameter(1):integrity check failed' >&2; exit 1",
+			ErrWrongTPM},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fakeTPM2Tools(t, test.unseal)
+			_, err := unsealTPM2Key(&actions.TPM2SealedKey{
+				Public:  []byte("public"),
+				Private: make([]byte, metadata.InternalKeyLen),
+				PCRs:    []uint32{7},
+			})
+			if err != test.expected {
+				t.Errorf("got error %v, expected %v", err, test.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,207 @@
+/*
+ * verify.go - File which contains the functions for checking that the files in
+ * an unlocked directory can actually be read.
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+
+	"github.com/google/fscrypt/filesystem"
+	"github.com/google/fscrypt/metadata"
+	"github.com/google/fscrypt/util"
+)
+
+// verifyReadSize is how many bytes are read from the start of each sampled
+// file. This is enough to decrypt at least one data unit.
+const verifyReadSize = 4096
+
+// accessFailure is a file or directory in an unlocked directory which couldn't
+// be read.
+type accessFailure struct {
+	Path string
+	Err  error
+}
+
+// accessReport is the result of checking the files in an unlocked directory.
+type accessReport struct {
+	Files            int // regular files found
+	FilesRead        int // regular files which were sampled
+	Directories      int
+	Symlinks         int
+	SkippedDirs      []string // directories with a different encryption policy
+	Failures         []accessFailure
+	policyDescriptor string
+}
+
+func (report *accessReport) fail(path string, err error) {
+	util.Debugf("cannot access %q: %v", path, err)
+	report.Failures = append(report.Failures, accessFailure{path, err})
+}
+
+// sampleEvenly returns at most n of the paths, spread evenly over the list. If
+// n is zero, all of the paths are returned.
+func sampleEvenly(paths []string, n int) []string {
+	if n <= 0 || len(paths) <= n {
+		return paths
+	}
+	sample := make([]string, n)
+	for i := range sample {
+		sample[i] = paths[i*len(paths)/n]
+	}
+	return sample
+}
+
+// verifyAccess checks that the files in the unlocked directory dir decrypt.
+// Every directory is listed and every entry is looked up, which exercises
+// filenames decryption, symlink targets are read, and the first bytes of up to
+// sampleSize regular files (or of all of them, if sampleSize is zero) are read,
+// which exercises contents decryption. Subdirectories which use a different
+// encryption policy are skipped. Problems are collected in the report rather
+// than stopping the check.
+func verifyAccess(dir string, sampleSize int) (*accessReport, error) {
+	policy, err := metadata.GetPolicy(dir)
+	if err != nil {
+		return nil, err
+	}
+	report := &accessReport{policyDescriptor: policy.KeyDescriptor}
+
+	var files []string
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			// Either the entry couldn't be looked up by its name
+			// or the directory couldn't be listed.
+			report.fail(path, err)
+			return nil
+		}
+		switch mode := info.Mode(); {
+		case mode.IsDir():
+			return report.checkDirectory(path)
+		case mode.IsRegular():
+			report.Files++
+			files = append(files, path)
+		case mode&os.ModeSymlink != 0:
+			report.Symlinks++
+			if _, err := os.Readlink(path); err != nil {
+				report.fail(path, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, path := range sampleEvenly(files, sampleSize) {
+		report.FilesRead++
+		if err := readFilePrefix(path); err != nil {
+			report.fail(path, err)
+		}
+	}
+	return report, nil
+}
+
+// checkDirectory is called for each directory found by verifyAccess. It
+// returns filepath.SkipDir for directories with a different encryption policy.
+func (report *accessReport) checkDirectory(path string) error {
+	policy, err := metadata.GetPolicy(path)
+	if err != nil {
+		report.fail(path, err)
+		return filepath.SkipDir
+	}
+	if policy.KeyDescriptor != report.policyDescriptor {
+		util.Debugf("skipping %q, which uses policy %s", path, policy.KeyDescriptor)
+		report.SkippedDirs = append(report.SkippedDirs, path)
+		return filepath.SkipDir
+	}
+	report.Directories++
+
+	if showsNoKeyNames(path) {
+		report.fail(path, errors.New("its entries are listed by their encrypted names"))
+	}
+	return nil
+}
+
+// showsNoKeyNames returns true if the directory has entries and all of their
+// names look like the names shown for a locked directory. Listing errors are
+// left to be reported by the walk.
+func showsNoKeyNames(path string) bool {
+	dir, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer dir.Close()
+	names, err := dir.Readdirnames(-1)
+	if err != nil || len(names) == 0 {
+		return false
+	}
+	for _, name := range names {
+		if !isPossibleNoKeyName(name) {
+			return false
+		}
+	}
+	return true
+}
+
+// readFilePrefix reads the first verifyReadSize bytes of a regular file.
+func readFilePrefix(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.ReadFull(file, make([]byte, verifyReadSize))
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil
+	}
+	return err
+}
+
+// writeAccessReport prints the problems found by verifyAccess, followed by a
+// summary. It returns an ErrAccessFailures if there were any problems.
+func writeAccessReport(w io.Writer, dir string, report *accessReport) error {
+	if len(report.Failures) > 0 {
+		t := makeTableWriter(w, "PATH\tERROR")
+		for _, failure := range report.Failures {
+			fmt.Fprintf(t, "%s\t%v\n", filesystem.EscapeString(failure.Path), failure.Err)
+		}
+		if err := t.Flush(); err != nil {
+			return err
+		}
+		fmt.Fprintln(w)
+	}
+
+	fmt.Fprintf(w, "Read %d of %s, listed %s, and checked %s in %q.\n",
+		report.FilesRead, pluralize(report.Files, "file"),
+		pluralize(report.Directories, "directory"),
+		pluralize(report.Symlinks, "symlink"), dir)
+	if len(report.SkippedDirs) > 0 {
+		fmt.Fprintf(w, "Skipped %s, which use a different policy: %s\n",
+			pluralize(len(report.SkippedDirs), "directory"), quoteList(report.SkippedDirs))
+	}
+	if len(report.Failures) > 0 {
+		return &ErrAccessFailures{dir, len(report.Failures)}
+	}
+	fmt.Fprintln(w, "No problems found.")
+	return nil
+}
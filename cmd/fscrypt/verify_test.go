@@ -0,0 +1,62 @@
+/*
+ * verify_test.go - tests for checking that the files in an unlocked directory
+ * can be read
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSampleEvenly(t *testing.T) {
+	paths := []string{"a", "b", "c", "d", "e", "f"}
+	if sample := sampleEvenly(paths, 0); !reflect.DeepEqual(sample, paths) {
+		t.Errorf("a sample size of 0 should return all paths, got %v", sample)
+	}
+	if sample := sampleEvenly(paths, 10); !reflect.DeepEqual(sample, paths) {
+		t.Errorf("a large sample size should return all paths, got %v", sample)
+	}
+	if sample := sampleEvenly(paths, 3); !reflect.DeepEqual(sample, []string{"a", "c", "e"}) {
+		t.Errorf("unexpected sample %v", sample)
+	}
+}
+
+// Tests that a directory whose entries all look like no-key names is reported,
+// but that one with a normal name is not.
+func TestShowsNoKeyNames(t *testing.T) {
+	dir := t.TempDir()
+	if showsNoKeyNames(dir) {
+		t.Error("an empty directory shouldn't be reported")
+	}
+	noKeyName := "AbCdEfGhIjKlMnOpQrStUvWxYz0123"
+	if err := os.WriteFile(filepath.Join(dir, noKeyName), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if !showsNoKeyNames(dir) {
+		t.Error("a directory with only no-key names should be reported")
+	}
+	if err := os.WriteFile(filepath.Join(dir, "notes.txt"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if showsNoKeyNames(dir) {
+		t.Error("a directory with a plaintext name shouldn't be reported")
+	}
+}
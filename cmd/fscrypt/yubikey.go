@@ -0,0 +1,120 @@
+/*
+ * yubikey.go - Getting the challenge-responses of yubikey protectors from a
+ * YubiKey.
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/term"
+
+	"github.com/google/fscrypt/actions"
+	"github.com/google/fscrypt/crypto"
+	"github.com/google/fscrypt/metadata"
+	"github.com/google/fscrypt/util"
+)
+
+// The YubiKey is accessed with ykchalresp from yubikey-personalization, so
+// fscrypt doesn't depend on libykpers itself.
+var ykchalrespCommand = "ykchalresp"
+
+// Messages in the errors of ykchalresp when no YubiKey is inserted, and when
+// the slot didn't answer, because it isn't configured for challenge-response or
+// wasn't touched in time
+var (
+	yubiKeyAbsentErrors  = []string{"no yubikey present"}
+	yubiKeyTimeoutErrors = []string{"timeout"}
+)
+
+// ykchalrespTool is the actions.YubiKey used by the fscrypt command. It uses
+// the first YubiKey found. If there is none, the user is asked to insert one
+// (unless in quiet mode or not on a terminal).
+type ykchalrespTool struct{}
+
+func (ykchalrespTool) ChallengeResponse(info actions.ProtectorInfo) (*crypto.Key, error) {
+	if _, err := exec.LookPath(ykchalrespCommand); err != nil {
+		util.Debug(err)
+		return nil, ErrNoYubiKeyTool
+	}
+	for {
+		response, err := runYkchalresp(info.YubiKeySlot(), info.YubiKeyChallenge())
+		if err != ErrYubiKeyAbsent || quietFlag.Value || !term.IsTerminal(stdinFd) {
+			return response, err
+		}
+		fmt.Printf("Insert the YubiKey for %s, then press Enter: ", formatInfo(info))
+		if _, err = readLine(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// runYkchalresp has the YubiKey's slot answer challenge, and returns the
+// response.
+func runYkchalresp(slot uint32, challenge []byte) (*crypto.Key, error) {
+	args := []string{fmt.Sprintf("-%d", slot), "-H", "-x", hex.EncodeToString(challenge)}
+	if !quietFlag.Value {
+		fmt.Println("Touch your YubiKey if it blinks.")
+	}
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(ykchalrespCommand, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	util.Debugf("%s %s: %v", ykchalrespCommand, strings.Join(args, " "), err)
+	defer wipeBytes(stdout.Bytes())
+	if err == nil {
+		return decodeYubiKeyResponse(stdout.Bytes())
+	}
+	message := strings.TrimSpace(stderr.String())
+	util.Debug(message)
+	for _, absent := range yubiKeyAbsentErrors {
+		if strings.Contains(message, absent) {
+			return nil, ErrYubiKeyAbsent
+		}
+	}
+	for _, timeout := range yubiKeyTimeoutErrors {
+		if strings.Contains(message, timeout) {
+			return nil, ErrYubiKeyTimeout
+		}
+	}
+	if message == "" {
+		return nil, errors.Wrap(err, ykchalrespCommand)
+	}
+	return nil, errors.Errorf("%s: %s", ykchalrespCommand, message)
+}
+
+// decodeYubiKeyResponse decodes the hex response printed by ykchalresp.
+func decodeYubiKeyResponse(output []byte) (*crypto.Key, error) {
+	output = bytes.TrimSpace(output)
+	if len(output) != 2*metadata.YubiKeyResponseLen {
+		return nil, errors.Errorf("unexpected output from %s: %d characters",
+			ykchalrespCommand, len(output))
+	}
+	response := make([]byte, metadata.YubiKeyResponseLen)
+	defer wipeBytes(response)
+	if _, err := hex.Decode(response, output); err != nil {
+		return nil, errors.Wrapf(err, "unexpected output from %s", ykchalrespCommand)
+	}
+	return crypto.NewFixedLengthKeyFromReader(bytes.NewReader(response), len(response))
+}
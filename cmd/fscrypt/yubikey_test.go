@@ -0,0 +1,78 @@
+/*
+ * yubikey_test.go - tests for getting challenge-responses from a YubiKey
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/fscrypt/actions"
+)
+
+// fakeYkchalresp replaces ykchalresp with a shell script.
+func fakeYkchalresp(t *testing.T, script string) {
+	path := filepath.Join(t.TempDir(), "ykchalresp")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+script+"\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	old := ykchalrespCommand
+	ykchalrespCommand = path
+	t.Cleanup(func() { ykchalrespCommand = old })
+}
+
+func TestYubiKeyChallengeResponse(t *testing.T) {
+	// A protector without metadata has slot 0 and an empty challenge.
+	fakeYkchalresp(t, `[ "$*" = "-0 -H -x " ] || exit 1
+echo 000102030405060708090a0b0c0d0e0f10111213`)
+	response, err := ykchalrespTool{}.ChallengeResponse(actions.ProtectorInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Wipe()
+	expected := []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19}
+	if !bytes.Equal(response.Data(), expected) {
+		t.Errorf("got response %x, expected %x", response.Data(), expected)
+	}
+}
+
+// Tests that a missing YubiKey and a slot which doesn't answer are reported as
+// such.
+func TestYubiKeyErrors(t *testing.T) {
+	tests := []struct {
+		name, script string
+		expected     error
+	}{
+		{"no YubiKey", "echo 'Yubikey core error: no yubikey present' >&2; exit 1",
+			ErrYubiKeyAbsent},
+		{"timeout", "echo 'Yubikey core error: timeout' >&2; exit 1",
+			ErrYubiKeyTimeout},
+		{"bad output", "echo 0011", nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fakeYkchalresp(t, test.script)
+			_, err := ykchalrespTool{}.ChallengeResponse(actions.ProtectorInfo{})
+			if err == nil || (test.expected != nil && err != test.expected) {
+				t.Errorf("got error %v, expected %v", err, test.expected)
+			}
+		})
+	}
+}
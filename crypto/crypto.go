@@ -27,8 +27,9 @@
 //		- authentication (SHA256-based HMAC)
 //		- key stretching (SHA256-based HKDF)
 //		- key wrapping/unwrapping (Encrypt then MAC)
-//		- passphrase-based key derivation (Argon2id)
+//		- passphrase-based key derivation (Argon2id or scrypt)
 //		- key descriptor computation (double SHA512, or HKDF-SHA512)
+//	- Splitting keys into shares (shamir.go)
 package crypto
 
 import (
@@ -39,10 +40,13 @@ import (
 	"crypto/sha512"
 	"encoding/hex"
 	"io"
+	"runtime"
+	"time"
 
 	"github.com/pkg/errors"
 	"golang.org/x/crypto/argon2"
 	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/scrypt"
 
 	"github.com/google/fscrypt/metadata"
 	"github.com/google/fscrypt/util"
@@ -52,7 +56,9 @@ import (
 var (
 	ErrBadAuth      = errors.New("key authentication check failed")
 	ErrRecoveryCode = errors.New("invalid recovery code")
+	ErrBase64Key    = errors.New("invalid base64-encoded key")
 	ErrMlockUlimit  = errors.New("could not lock key in memory")
+	ErrMetadataHMAC = errors.New("metadata authentication check failed")
 )
 
 // panicInputLength panics if "name" has invalid length (expected != actual)
@@ -173,6 +179,44 @@ func Unwrap(wrappingKey *Key, data *metadata.WrappedKeyData) (*Key, error) {
 	return secretKey, nil
 }
 
+// metadataHMACInfo is the HKDF info string which separates the key used for
+// metadata HMACs from the other keys derived from the same key.
+var metadataHMACInfo = []byte("fscrypt metadata hmac")
+
+// MetadataHMAC returns the HMAC of the authenticated fields of a protector or
+// policy, keyed off its protector key or policy key (of any length).
+func MetadataHMAC(key *Key, data metadata.AuthenticatedMetadata) ([]byte, error) {
+	contents, err := data.AuthenticatedData()
+	if err != nil {
+		return nil, err
+	}
+	authKey, err := NewFixedLengthKeyFromReader(
+		hkdf.New(sha256.New, key.data, nil, metadataHMACInfo), metadata.InternalKeyLen)
+	if err != nil {
+		return nil, err
+	}
+	defer authKey.Wipe()
+	return getHMAC(authKey, contents), nil
+}
+
+// CheckMetadataHMAC returns ErrMetadataHMAC if the authenticated fields of a
+// protector or policy were changed by someone without its key. Metadata without
+// an HMAC is accepted here, as it's only read if its schema version predates
+// the HMAC (see metadata.HasRequiredHMAC).
+func CheckMetadataHMAC(key *Key, data metadata.AuthenticatedMetadata) error {
+	if len(data.GetMetadataHmac()) == 0 {
+		return nil
+	}
+	expected, err := MetadataHMAC(key, data)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(expected, data.GetMetadataHmac()) {
+		return ErrMetadataHMAC
+	}
+	return nil
+}
+
 func computeKeyDescriptorV1(key *Key) string {
 	h1 := sha512.Sum512(key.data)
 	h2 := sha512.Sum512(h1[:])
@@ -180,11 +224,22 @@ func computeKeyDescriptorV1(key *Key) string {
 	return hex.EncodeToString(h2[:length])
 }
 
+// hkdfContextKeyIdentifier is HKDF_CONTEXT_KEY_IDENTIFIER from the kernel.
+const hkdfContextKeyIdentifier = 1
+
 func computeKeyDescriptorV2(key *Key) (string, error) {
 	// This algorithm is specified by the kernel.  It uses unsalted
 	// HKDF-SHA512, where the application-information string is the prefix
 	// "fscrypt\0" followed by the HKDF_CONTEXT_KEY_IDENTIFIER byte.
-	hkdf := hkdf.New(sha512.New, key.data, nil, []byte("fscrypt\x00\x01"))
+	//
+	// Note that no multi-byte integers are involved anywhere: the key, the
+	// info string, and the resulting identifier are all plain byte strings,
+	// and the identifier is passed to the kernel as bytes as well.  So the
+	// result doesn't depend on the byte order of the host.  Keep it that
+	// way; anything added to the info string must be serialized with an
+	// explicit byte order, as the kernel does.
+	info := []byte{'f', 's', 'c', 'r', 'y', 'p', 't', 0, hkdfContextKeyIdentifier}
+	hkdf := hkdf.New(sha512.New, key.data, nil, info)
 	h := make([]byte, hex.DecodedLen(metadata.PolicyDescriptorLenV2))
 	if _, err := io.ReadFull(hkdf, h); err != nil {
 		return "", err
@@ -209,15 +264,29 @@ func ComputeKeyDescriptor(key *Key, policyVersion int64) (string, error) {
 	}
 }
 
-// PassphraseHash uses Argon2id to produce a Key given the passphrase, salt, and
-// hashing costs. This method is designed to take a long time and consume
-// considerable memory. For more information, see the documentation at
-// https://godoc.org/golang.org/x/crypto/argon2.
+// PassphraseHash uses Argon2id (or scrypt, if the costs select it) to produce a
+// Key given the passphrase, salt, and hashing costs. This method is designed to
+// take a long time and consume considerable memory. For more information, see
+// the documentation at https://godoc.org/golang.org/x/crypto/argon2 and
+// https://godoc.org/golang.org/x/crypto/scrypt.
 func PassphraseHash(passphrase *Key, salt []byte, costs *metadata.HashingCosts) (*Key, error) {
-	t := uint32(costs.Time)
-	m := uint32(costs.Memory)
-	p := uint8(costs.Parallelism)
-	key := argon2.IDKey(passphrase.data, salt, t, m, p, metadata.InternalKeyLen)
+	var key []byte
+	switch costs.GetKdf() {
+	case metadata.KDF_argon2id:
+		t := uint32(costs.Time)
+		m := uint32(costs.Memory)
+		p := uint8(costs.Parallelism)
+		key = argon2.IDKey(passphrase.data, salt, t, m, p, metadata.InternalKeyLen)
+	case metadata.KDF_scrypt:
+		var err error
+		key, err = scrypt.Key(passphrase.data, salt, int(costs.Memory),
+			metadata.ScryptBlockSize, int(costs.Time), metadata.InternalKeyLen)
+		if err != nil {
+			return nil, errors.Wrap(err, "scrypt")
+		}
+	default:
+		return nil, errors.Errorf("unknown KDF %v", costs.GetKdf())
+	}
 
 	hash, err := NewBlankKey(metadata.InternalKeyLen)
 	if err != nil {
@@ -226,3 +295,51 @@ func PassphraseHash(passphrase *Key, salt []byte, costs *metadata.HashingCosts)
 	copy(hash.data, key)
 	return hash, nil
 }
+
+// combinedKeyInfo is the HKDF application-information string for CombineKeys.
+var combinedKeyInfo = []byte("fscrypt combined key")
+
+// CombineKeys uses HKDF-SHA256 with the given salt to derive a Key of length
+// InternalKeyLen from the concatenation of keys, e.g. a passphrase hash and a
+// raw key. Every one of the keys is needed to derive the same Key again.
+func CombineKeys(salt []byte, keys ...*Key) (*Key, error) {
+	length := 0
+	for _, key := range keys {
+		length += key.Len()
+	}
+	secret, err := NewBlankKey(length)
+	if err != nil {
+		return nil, err
+	}
+	defer secret.Wipe()
+	offset := 0
+	for _, key := range keys {
+		offset += copy(secret.data[offset:], key.data)
+	}
+
+	hkdf := hkdf.New(sha256.New, secret.data, salt, combinedKeyInfo)
+	return NewFixedLengthKeyFromReader(hkdf, metadata.InternalKeyLen)
+}
+
+// hashTimePerKiBPass is roughly how long one pass of Argon2id takes over one
+// KiB of memory on a single core of a typical modern CPU.
+const hashTimePerKiBPass = time.Microsecond
+
+// EstimateHashTime returns a rough estimate of how long PassphraseHash would
+// take with the given costs on this system, without running the hash. It
+// assumes each pass over the memory takes a fixed time per KiB, and that the
+// lanes of the hash run in parallel on the available CPUs. Actual times vary
+// considerably with the CPU, memory bandwidth, and system load, so this should
+// only be presented as an estimate. scrypt is assumed to make two passes over
+// its memory for each unit of its time cost, sequentially.
+func EstimateHashTime(costs *metadata.HashingCosts) time.Duration {
+	if costs.GetKdf() == metadata.KDF_scrypt {
+		return time.Duration(2*costs.Time*costs.Memory) * hashTimePerKiBPass
+	}
+	parallelism := util.MinInt64(costs.Parallelism, int64(runtime.NumCPU()))
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	work := costs.Time * costs.Memory / parallelism
+	return time.Duration(work) * hashTimePerKiBPass
+}
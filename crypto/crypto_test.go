@@ -24,12 +24,17 @@ import (
 	"compress/zlib"
 	"crypto/aes"
 	"crypto/sha256"
+	"encoding/base64"
 	"encoding/hex"
 	"fmt"
 	"io"
 	"os"
+	"runtime"
+	"strings"
 	"testing"
 
+	"github.com/pkg/errors"
+
 	"github.com/google/fscrypt/metadata"
 )
 
@@ -62,7 +67,7 @@ func fakePassphraseKey() (*Key, error) {
 	return NewFixedLengthKeyFromReader(bytes.NewReader(fakePassword), len(fakePassword))
 }
 
-// Values for test cases pulled from argon2 command line tool.
+// Values for Argon2id test cases pulled from argon2 command line tool.
 // To generate run:
 //    echo "password" | argon2 "aaaaaaaaaaaaaaaa" -id -t <t> -m <m> -p <p> -l 32
 // where costs.Time = <t>, costs.Memory = 2^<m>, and costs.Parallelism = <p>.
@@ -103,6 +108,20 @@ var hashTestCases = []hashTestCase{
 		costs:   &metadata.HashingCosts{Time: 1, Memory: 1 << 11, Parallelism: 255, TruncationFixed: true},
 		hexHash: "d51af3775bbdd0cba31d96fd6d921d9de27f521ceffe667618cd7624f6643071",
 	},
+	// scrypt values pulled from Python's hashlib.scrypt(b"password",
+	// salt=b"a"*16, n=costs.Memory, r=8, p=costs.Time, dklen=32).
+	{
+		costs:   &metadata.HashingCosts{Time: 1, Memory: 1 << 10, Parallelism: 1, Kdf: metadata.KDF_scrypt},
+		hexHash: "575fa49d13fc8e116f02f939e8d779de4d3fc178779e7721e5b1b631a2aa4783",
+	},
+	{
+		costs:   &metadata.HashingCosts{Time: 3, Memory: 1 << 10, Parallelism: 1, Kdf: metadata.KDF_scrypt},
+		hexHash: "2ad6ab18668c8dab5cf62520fb9a4cc1511cb108a68e4326763346ebd42a938d",
+	},
+	{
+		costs:   &metadata.HashingCosts{Time: 1, Memory: 1 << 14, Parallelism: 1, Kdf: metadata.KDF_scrypt},
+		hexHash: "b547d78ac6b440c45da0dcd133533a25e753107edbef5f8c37d19a416336a83f",
+	},
 }
 
 // Checks that len(array) == expected
@@ -147,6 +166,73 @@ func TestWipe(t *testing.T) {
 	}
 }
 
+// useFreshKeyRegistry makes WipeAll only see the keys created by the calling
+// test, so that the keys used by the other tests are left alone.
+func useFreshKeyRegistry(t *testing.T) {
+	liveKeysMutex.Lock()
+	oldLiveKeys := liveKeys
+	liveKeys = make(map[uintptr][]byte)
+	liveKeysMutex.Unlock()
+	t.Cleanup(func() {
+		liveKeysMutex.Lock()
+		liveKeys = oldLiveKeys
+		liveKeysMutex.Unlock()
+	})
+}
+
+// Tests that the keys which are live when a panic happens get zeroed.
+func TestWipeAllOnPanic(t *testing.T) {
+	useFreshKeyRegistry(t)
+	key1, err := makeKey(1, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key2, err := makeKey(2, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer key1.Wipe()
+	defer key2.Wipe()
+
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				if count := WipeAll(); count != 2 {
+					t.Errorf("WipeAll wiped %d keys, expected 2", count)
+				}
+			}
+		}()
+		panic("simulated panic")
+	}()
+
+	for _, key := range []*Key{key1, key2} {
+		if !bytes.Equal(key.data, make([]byte, key.Len())) {
+			t.Error("key was not zeroed")
+		}
+	}
+}
+
+// Tests that keys stay usable after WipeAll, and are freed by Wipe.
+func TestWipeAll(t *testing.T) {
+	useFreshKeyRegistry(t)
+	key, err := makeKey(1, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	WipeAll()
+	// The buffer is still mapped, so this doesn't fault.
+	key.data[0] = 1
+	if err = key.Wipe(); err != nil {
+		t.Error(err)
+	}
+	if key.data != nil {
+		t.Error("key data was not cleared")
+	}
+	if count := WipeAll(); count != 0 {
+		t.Errorf("WipeAll wiped %d keys after they were wiped, expected 0", count)
+	}
+}
+
 // Making keys with negative length should fail
 func TestInvalidLength(t *testing.T) {
 	key, err := NewFixedLengthKeyFromReader(ConstReader(1), -1)
@@ -177,6 +263,20 @@ func TestZeroLength(t *testing.T) {
 	}
 }
 
+// Test that formatting a key never shows its contents
+func TestKeyFormatHidesData(t *testing.T) {
+	key, err := NewFixedLengthKeyFromReader(ConstReader(0xab), 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer key.Wipe()
+	for _, verb := range []string{"%v", "%+v", "%s", "%x", "%q"} {
+		if s := fmt.Sprintf(verb, key); s != "<4 byte key>" {
+			t.Errorf("Sprintf(%q, key) = %q", verb, s)
+		}
+	}
+}
+
 // Test that enabling then disabling memory locking succeeds even if a key is
 // active when the variable changes.
 func TestEnableDisableMemoryLocking(t *testing.T) {
@@ -248,6 +348,41 @@ func TestKeyLargeResize(t *testing.T) {
 	}
 }
 
+// Test reading a base64-encoded key, with a trailing newline as from echo
+func TestBase64Key(t *testing.T) {
+	encoded := base64.StdEncoding.EncodeToString(fakeWrappingKey.data) + "\n"
+	key, err := NewFixedLengthKeyFromBase64Reader(strings.NewReader(encoded),
+		metadata.InternalKeyLen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer key.Wipe()
+	if !key.Equals(fakeWrappingKey) {
+		t.Error("decoded key does not match the encoded one")
+	}
+}
+
+// Test that malformed base64 and keys of the wrong length are rejected
+func TestBadBase64Key(t *testing.T) {
+	badInputs := []string{
+		"",
+		"not base64!",
+		base64.StdEncoding.EncodeToString(fakeWrappingKey.data)[:40],
+		base64.StdEncoding.EncodeToString(fakeValidPolicyKey.data),
+		base64.StdEncoding.EncodeToString(fakeWrappingKey.data[1:]),
+	}
+	for _, input := range badInputs {
+		key, err := NewFixedLengthKeyFromBase64Reader(strings.NewReader(input),
+			metadata.InternalKeyLen)
+		if err == nil {
+			key.Wipe()
+			t.Errorf("input %q should be rejected", input)
+		} else if errors.Cause(err) != ErrBase64Key {
+			t.Errorf("input %q gave unexpected error %v", input, err)
+		}
+	}
+}
+
 // Check that we can create random keys. All this test does to test the
 // "randomness" is generate a page of random bytes and attempts compression.
 // If the data can be compressed it is probably not very random. This isn't
@@ -266,6 +401,51 @@ func TestRandomKeyGen(t *testing.T) {
 	}
 }
 
+// Check that an injected reader is used for all random generation, so that
+// wrapping the same key twice gives the same result, and that the system RNG is
+// used again after resetting it.
+func TestSetRandReader(t *testing.T) {
+	SetRandReader(ConstReader(7))
+	defer SetRandReader(nil)
+
+	buffer, err := NewRandomBuffer(16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buffer, bytes.Repeat([]byte{7}, 16)) {
+		t.Errorf("random buffer %x didn't come from the injected reader", buffer)
+	}
+	key, err := NewRandomKey(metadata.InternalKeyLen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer key.Wipe()
+	if !bytes.Equal(key.data, bytes.Repeat([]byte{7}, metadata.InternalKeyLen)) {
+		t.Errorf("random key %x didn't come from the injected reader", key.data)
+	}
+	data1, err := Wrap(key, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data2, err := Wrap(key, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data1.IV, data2.IV) || !bytes.Equal(data1.EncryptedKey, data2.EncryptedKey) {
+		t.Error("wrapping with an injected reader wasn't reproducible")
+	}
+
+	SetRandReader(nil)
+	key2, err := NewRandomKey(os.Getpagesize())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer key2.Wipe()
+	if didCompress(key2.data) {
+		t.Error("random key wasn't random after resetting the reader")
+	}
+}
+
 func TestBigKeyGen(t *testing.T) {
 	key, err := NewRandomKey(4096 * 4096)
 	switch err {
@@ -479,6 +659,41 @@ func TestUnwrapWrongData(t *testing.T) {
 	}
 }
 
+// Tests that the metadata HMAC detects changes to the authenticated fields of
+// a protector, but not to its name, and that metadata without one is accepted.
+func TestMetadataHMAC(t *testing.T) {
+	data := &metadata.ProtectorData{
+		ProtectorDescriptor: "fedcba9876543210",
+		Name:                "backups",
+		Source:              metadata.SourceType_custom_passphrase,
+		Salt:                make([]byte, metadata.SaltLen),
+	}
+	if err := CheckMetadataHMAC(fakeWrappingKey, data); err != nil {
+		t.Errorf("metadata without an HMAC was rejected: %v", err)
+	}
+	hmac, err := MetadataHMAC(fakeWrappingKey, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data.MetadataHmac = hmac
+	if err = CheckMetadataHMAC(fakeWrappingKey, data); err != nil {
+		t.Error(err)
+	}
+
+	data.Name = "renamed"
+	if err = CheckMetadataHMAC(fakeWrappingKey, data); err != nil {
+		t.Errorf("renaming the protector broke its HMAC: %v", err)
+	}
+	data.Source = metadata.SourceType_raw_key
+	if err = CheckMetadataHMAC(fakeWrappingKey, data); err != ErrMetadataHMAC {
+		t.Errorf("changing the source gave %v, expected ErrMetadataHMAC", err)
+	}
+	data.Source = metadata.SourceType_custom_passphrase
+	if err = CheckMetadataHMAC(fakeValidPolicyKey, data); err != ErrMetadataHMAC {
+		t.Errorf("checking with the wrong key gave %v, expected ErrMetadataHMAC", err)
+	}
+}
+
 func TestComputeKeyDescriptorV1(t *testing.T) {
 	descriptor, err := ComputeKeyDescriptor(fakeValidPolicyKey, 1)
 	if err != nil {
@@ -499,6 +714,77 @@ func TestComputeKeyDescriptorV2(t *testing.T) {
 	}
 }
 
+// Known-answer tests for key descriptors. The v2 identifiers were obtained from
+// the kernel by adding each key with FS_IOC_ADD_ENCRYPTION_KEY, and the v1
+// descriptors with:
+//    echo <key> | xxd -r -p | openssl dgst -sha512 -binary | openssl dgst -sha512
+// (taking the first 16 hex digits of the output).
+// Since these are all byte strings, they must match on hosts of any byte order.
+type descriptorTestCase struct {
+	hexKey        string
+	policyVersion int64
+	descriptor    string
+}
+
+var descriptorTestCases = []descriptorTestCase{
+	{
+		hexKey:        strings.Repeat("00", 64),
+		policyVersion: 1,
+		descriptor:    "f574a77464017311",
+	},
+	{
+		hexKey:        "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f202122232425262728292a2b2c2d2e2f303132333435363738393a3b3c3d3e3f",
+		policyVersion: 1,
+		descriptor:    "04334e23057a6e2d",
+	},
+	{
+		hexKey:        strings.Repeat("00", 64),
+		policyVersion: 2,
+		descriptor:    "69d7f347a3ca7bfa3e0c1d84e476d050",
+	},
+	{
+		hexKey:        "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f202122232425262728292a2b2c2d2e2f303132333435363738393a3b3c3d3e3f",
+		policyVersion: 2,
+		descriptor:    "8699c2c53707405da5aba5ae4d8583c0",
+	},
+	{
+		hexKey:        strings.Repeat("ff", 64),
+		policyVersion: 2,
+		descriptor:    "6cefb7ff6baef270952a430f889592dd",
+	},
+	{
+		hexKey:        "a0a1a2a3a4a5a6a7a8a9aaabacadaeaf",
+		policyVersion: 2,
+		descriptor:    "186a91a020bf219b873a1f69da4270df",
+	},
+	{
+		hexKey:        "fffefdfcfbfaf9f8f7f6f5f4f3f2f1f0efeeedecebeae9e8e7e6e5e4e3e2e1e0",
+		policyVersion: 2,
+		descriptor:    "455ce7ee1391bef20e215194c5f9e13e",
+	},
+}
+
+func TestComputeKeyDescriptorVectors(t *testing.T) {
+	for i, testCase := range descriptorTestCases {
+		data, err := hex.DecodeString(testCase.hexKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key, err := NewFixedLengthKeyFromReader(bytes.NewReader(data), len(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		descriptor, err := ComputeKeyDescriptor(key, testCase.policyVersion)
+		key.Wipe()
+		if err != nil {
+			t.Errorf("case %d: %v", i, err)
+		} else if descriptor != testCase.descriptor {
+			t.Errorf("case %d: got v%d descriptor %s, expected %s", i,
+				testCase.policyVersion, descriptor, testCase.descriptor)
+		}
+	}
+}
+
 func TestComputeKeyDescriptorBadVersion(t *testing.T) {
 	_, err := ComputeKeyDescriptor(fakeValidPolicyKey, 0)
 	if err == nil {
@@ -547,6 +833,13 @@ var badCosts = []*metadata.HashingCosts{
 	{Time: 1, Memory: 1 << 11, Parallelism: 256, TruncationFixed: false},
 	{Time: 1, Memory: 1 << 11, Parallelism: 256, TruncationFixed: true},
 	{Time: 1, Memory: 1 << 11, Parallelism: 257, TruncationFixed: true},
+	// Bad scrypt costs
+	{Time: 0, Memory: 1 << 11, Parallelism: 1, Kdf: metadata.KDF_scrypt},
+	{Time: 1 << 27, Memory: 1 << 11, Parallelism: 1, Kdf: metadata.KDF_scrypt},
+	{Time: 1, Memory: 1, Parallelism: 1, Kdf: metadata.KDF_scrypt},
+	{Time: 1, Memory: 3 << 10, Parallelism: 1, Kdf: metadata.KDF_scrypt},
+	{Time: 1, Memory: 1 << 11, Parallelism: 2, Kdf: metadata.KDF_scrypt},
+	{Time: 1, Memory: 1 << 11, Parallelism: 1, Kdf: 2},
 }
 
 func TestBadParameters(t *testing.T) {
@@ -557,6 +850,84 @@ func TestBadParameters(t *testing.T) {
 	}
 }
 
+// Tests that a combined key depends on each of the keys, their order, and the
+// salt, and on nothing else.
+func TestCombineKeys(t *testing.T) {
+	key1, _ := makeKey(1, metadata.InternalKeyLen)
+	key2, _ := makeKey(2, metadata.InternalKeyLen)
+	otherKey, _ := makeKey(3, metadata.InternalKeyLen)
+	otherSalt := bytes.Repeat([]byte{'b'}, metadata.SaltLen)
+	defer key1.Wipe()
+	defer key2.Wipe()
+	defer otherKey.Wipe()
+
+	combined, err := CombineKeys(fakeSalt, key1, key2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer combined.Wipe()
+	if combined.Len() != metadata.InternalKeyLen {
+		t.Fatalf("combined key has length %d", combined.Len())
+	}
+	again, err := CombineKeys(fakeSalt, key1, key2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer again.Wipe()
+	if !combined.Equals(again) {
+		t.Error("combining the same keys gave different results")
+	}
+
+	for i, test := range []struct {
+		salt []byte
+		keys []*Key
+	}{
+		{fakeSalt, []*Key{key2, key1}},
+		{fakeSalt, []*Key{otherKey, key2}},
+		{fakeSalt, []*Key{key1, otherKey}},
+		{otherSalt, []*Key{key1, key2}},
+	} {
+		other, err := CombineKeys(test.salt, test.keys...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if combined.Equals(other) {
+			t.Errorf("test %d: combined keys are equal", i)
+		}
+		other.Wipe()
+	}
+}
+
+// Tests that the estimated hashing time grows with the time and memory costs.
+func TestEstimateHashTime(t *testing.T) {
+	costs := &metadata.HashingCosts{Time: 1, Memory: 1 << 10, Parallelism: 1}
+	estimate := EstimateHashTime(costs)
+	if estimate <= 0 {
+		t.Fatalf("estimate of %v is not positive", estimate)
+	}
+	costs.Time *= 4
+	if got := EstimateHashTime(costs); got != 4*estimate {
+		t.Errorf("estimate for 4 passes is %v, expected %v", got, 4*estimate)
+	}
+	costs.Memory *= 2
+	if got := EstimateHashTime(costs); got != 8*estimate {
+		t.Errorf("estimate for 4 passes over twice the memory is %v, expected %v",
+			got, 8*estimate)
+	}
+	// More lanes than CPUs can't make the hash faster.
+	costs.Parallelism = int64(runtime.NumCPU())
+	fastest := EstimateHashTime(costs)
+	costs.Parallelism++
+	if got := EstimateHashTime(costs); got != fastest {
+		t.Errorf("estimate with %d lanes is %v, expected %v", costs.Parallelism, got, fastest)
+	}
+	// scrypt makes two passes, and doesn't use more CPUs.
+	costs = &metadata.HashingCosts{Time: 1, Memory: 1 << 10, Parallelism: 1, Kdf: metadata.KDF_scrypt}
+	if got := EstimateHashTime(costs); got != 2*estimate {
+		t.Errorf("scrypt estimate is %v, expected %v", got, 2*estimate)
+	}
+}
+
 func BenchmarkWrap(b *testing.B) {
 	for n := 0; n < b.N; n++ {
 		Wrap(fakeWrappingKey, fakeValidPolicyKey)
@@ -30,10 +30,12 @@ import (
 	"bytes"
 	"crypto/subtle"
 	"encoding/base32"
+	"encoding/base64"
+	"fmt"
 	"io"
-	"log"
 	"os"
 	"runtime"
+	"sync"
 	"unsafe"
 
 	"github.com/pkg/errors"
@@ -92,6 +94,31 @@ type Key struct {
 	data []byte
 }
 
+// liveKeys tracks the buffers of all keys which haven't been wiped yet, indexed
+// by the address of their data, so that WipeAll can wipe them in an emergency.
+// The buffers are mmapped, so tracking them here doesn't keep the Keys
+// themselves from being garbage collected.
+var (
+	liveKeys      = make(map[uintptr][]byte)
+	liveKeysMutex sync.Mutex
+)
+
+// WipeAll zeroes the buffers of all keys which haven't been wiped yet. It is
+// intended to be called when the program is about to exit abnormally (e.g. on a
+// panic). The buffers aren't freed, as other goroutines may still be using the
+// keys; they just see zeroes, and Wipe still frees them. It returns the number
+// of keys which were zeroed.
+func WipeAll() int {
+	liveKeysMutex.Lock()
+	defer liveKeysMutex.Unlock()
+	for _, data := range liveKeys {
+		for i := range data {
+			data[i] = 0
+		}
+	}
+	return len(liveKeys)
+}
+
 // NewBlankKey constructs a blank key of a specified length and returns an error
 // if we are unable to allocate or lock the necessary memory.
 func NewBlankKey(length int) (*Key, error) {
@@ -117,6 +144,9 @@ func NewBlankKey(length int) (*Key, error) {
 	}
 
 	key := &Key{data: data}
+	liveKeysMutex.Lock()
+	liveKeys[uintptr(util.Ptr(data))] = data
+	liveKeysMutex.Unlock()
 
 	// Backup finalizer in case user forgets to "defer key.Wipe()"
 	runtime.SetFinalizer(key, (*Key).Wipe)
@@ -133,12 +163,18 @@ func (key *Key) Wipe() error {
 		data := key.data
 		key.data = nil
 
+		// The buffer is freed with the lock held, so that WipeAll
+		// never zeroes a buffer which has been unmapped.
+		liveKeysMutex.Lock()
+		defer liveKeysMutex.Unlock()
+		delete(liveKeys, uintptr(util.Ptr(data)))
+
 		for i := range data {
 			data[i] = 0
 		}
 
 		if err := unix.Munmap(data); err != nil {
-			log.Printf("unix.Munmap() failed: %v", err)
+			util.Warnf("unix.Munmap() failed: %v", err)
 			return errors.Wrapf(err, "failed to free (munmap) key buffer")
 		}
 	}
@@ -150,6 +186,13 @@ func (key *Key) Len() int {
 	return len(key.data)
 }
 
+// Format implements fmt.Formatter so that printing a Key with any verb (for
+// example, when it is accidentally passed to a logging function) only shows
+// its length, never its contents.
+func (key *Key) Format(f fmt.State, verb rune) {
+	fmt.Fprintf(f, "<%d byte key>", key.Len())
+}
+
 // Equals compares the contents of two keys, returning true if they have the same
 // key data. This function runs in constant time.
 func (key *Key) Equals(key2 *Key) bool {
@@ -266,6 +309,33 @@ func NewFixedLengthKeyFromReader(reader io.Reader, length int) (*Key, error) {
 	return key, nil
 }
 
+// NewFixedLengthKeyFromBase64Reader constructs a key with a specified length by
+// reading base64 (with padding) from reader until hitting EOF. Newlines in the
+// input are ignored. Both the encoded and the decoded key are only stored in
+// locked memory.
+func NewFixedLengthKeyFromBase64Reader(reader io.Reader, length int) (*Key, error) {
+	encodedKey, err := NewKeyFromReader(reader)
+	if err != nil {
+		return nil, err
+	}
+	defer encodedKey.Wipe()
+
+	decodedKey, err := NewBlankKey(base64.StdEncoding.DecodedLen(encodedKey.Len()))
+	if err != nil {
+		return nil, err
+	}
+	decodedLength, err := base64.StdEncoding.Decode(decodedKey.data, encodedKey.data)
+	if err != nil {
+		decodedKey.Wipe()
+		return nil, errors.Wrap(ErrBase64Key, err.Error())
+	}
+	if err = util.CheckValidLength(length, decodedLength); err != nil {
+		decodedKey.Wipe()
+		return nil, errors.Wrapf(ErrBase64Key, "decoded key: %v", err)
+	}
+	return decodedKey.resize(length)
+}
+
 var (
 	// The recovery code is base32 with a dash between each block of 8 characters.
 	encoding      = base32.StdEncoding
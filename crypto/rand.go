@@ -37,7 +37,7 @@ import (
 // compatibility issues.
 func NewRandomBuffer(length int) ([]byte, error) {
 	buffer := make([]byte, length)
-	if _, err := io.ReadFull(randReader{}, buffer); err != nil {
+	if _, err := io.ReadFull(randSource, buffer); err != nil {
 		return nil, err
 	}
 	return buffer, nil
@@ -46,7 +46,7 @@ func NewRandomBuffer(length int) ([]byte, error) {
 // NewRandomKey creates a random key of the specified length. This function uses
 // the same random number generation process as NewRandomBuffer.
 func NewRandomKey(length int) (*Key, error) {
-	return NewFixedLengthKeyFromReader(randReader{}, length)
+	return NewFixedLengthKeyFromReader(randSource, length)
 }
 
 // NewRandomPassphrase creates a random passphrase of the specified length
@@ -81,6 +81,24 @@ func NewRandomPassphrase(length int) (*Key, error) {
 	return passphrase, nil
 }
 
+// randSource is where all of the random bytes generated by this package come
+// from. It is the system RNG unless a test has called SetRandReader.
+var randSource io.Reader = randReader{}
+
+// SetRandReader makes all of the random generation in this package (keys,
+// salts, IVs, and passphrases) read from reader instead of the system RNG, so
+// that tests can produce reproducible metadata. SetRandReader(nil) restores the
+// system RNG. This must only be used in tests, as every key generated from a
+// predictable reader is predictable too. It isn't safe to call this while
+// random data is being generated.
+func SetRandReader(reader io.Reader) {
+	if reader == nil {
+		randSource = randReader{}
+		return
+	}
+	randSource = reader
+}
+
 // randReader just calls into Getrandom, so no internal data is needed.
 type randReader struct{}
 
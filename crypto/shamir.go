@@ -0,0 +1,148 @@
+/*
+ * shamir.go - Splitting keys into shares with Shamir's Secret Sharing
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package crypto
+
+import (
+	"github.com/pkg/errors"
+)
+
+// MaxKeyShares is the largest number of shares a key can be split into, as each
+// share is identified by a distinct nonzero byte.
+const MaxKeyShares = 255
+
+// KeyShare is one of the shares made by SplitKey.
+type KeyShare struct {
+	// Index identifies the share, and is between 1 and MaxKeyShares.
+	Index int
+	// Key has the same length as the key which was split.
+	Key *Key
+}
+
+// gfMul multiplies two elements of GF(2^8), using the AES polynomial. It runs in
+// constant time, as the shares and key are secret.
+func gfMul(a, b byte) byte {
+	var product byte
+	for i := 0; i < 8; i++ {
+		product ^= -(b & 1) & a
+		a = (a << 1) ^ (0x1b & -(a >> 7))
+		b >>= 1
+	}
+	return product
+}
+
+// gfInv returns the multiplicative inverse of a nonzero element of GF(2^8),
+// which is a^254.
+func gfInv(a byte) byte {
+	result := byte(1)
+	for exponent := 254; exponent > 0; exponent >>= 1 {
+		if exponent&1 != 0 {
+			result = gfMul(result, a)
+		}
+		a = gfMul(a, a)
+	}
+	return result
+}
+
+// SplitKey splits secret into count shares with Shamir's Secret Sharing, such
+// that any threshold of the shares reconstruct it with CombineKeyShares and
+// fewer reveal nothing about it. Each byte of the key is shared independently
+// over GF(2^8). The shares have indices 1 through count, and must be wiped after
+// use. A threshold of 1 makes every share a copy of the secret.
+func SplitKey(secret *Key, threshold, count int) ([]KeyShare, error) {
+	if threshold < 1 || threshold > count || count > MaxKeyShares {
+		return nil, errors.Errorf("cannot split a key into %d shares with a threshold of %d",
+			count, threshold)
+	}
+	length := secret.Len()
+	// The coefficients of the polynomials, apart from the constant terms
+	// which are the bytes of the secret.
+	coefficients, err := NewRandomKey((threshold - 1) * length)
+	if err != nil {
+		return nil, err
+	}
+	defer coefficients.Wipe()
+
+	shares := make([]KeyShare, count)
+	for i := range shares {
+		share, err := NewBlankKey(length)
+		if err != nil {
+			WipeKeyShares(shares)
+			return nil, err
+		}
+		x := byte(i + 1)
+		for j := 0; j < length; j++ {
+			// Evaluate the polynomial with Horner's method.
+			var y byte
+			for k := threshold - 2; k >= 0; k-- {
+				y = gfMul(y, x) ^ coefficients.data[k*length+j]
+			}
+			share.data[j] = gfMul(y, x) ^ secret.data[j]
+		}
+		shares[i] = KeyShare{Index: i + 1, Key: share}
+	}
+	return shares, nil
+}
+
+// CombineKeyShares reconstructs a key from shares made by SplitKey, which must
+// have distinct indices. If fewer shares than the threshold are given, the
+// result is an unrelated key, so the caller must check it (e.g. against the
+// key's descriptor).
+func CombineKeyShares(shares []KeyShare) (*Key, error) {
+	if len(shares) == 0 {
+		return nil, errors.New("no key shares to combine")
+	}
+	length := shares[0].Key.Len()
+	seen := make(map[int]bool)
+	for _, share := range shares {
+		if share.Index < 1 || share.Index > MaxKeyShares || seen[share.Index] {
+			return nil, errors.Errorf("key share index %d is invalid or repeated", share.Index)
+		}
+		seen[share.Index] = true
+		if share.Key.Len() != length {
+			return nil, errors.New("key shares have different lengths")
+		}
+	}
+
+	secret, err := NewBlankKey(length)
+	if err != nil {
+		return nil, err
+	}
+	for i, share := range shares {
+		// The Lagrange basis polynomial of this share, evaluated at 0.
+		// The indices aren't secret.
+		weight := byte(1)
+		for j, other := range shares {
+			if i != j {
+				xi, xj := byte(share.Index), byte(other.Index)
+				weight = gfMul(weight, gfMul(xj, gfInv(xi^xj)))
+			}
+		}
+		for k := 0; k < length; k++ {
+			secret.data[k] ^= gfMul(weight, share.Key.data[k])
+		}
+	}
+	return secret, nil
+}
+
+// WipeKeyShares wipes the keys of all the shares.
+func WipeKeyShares(shares []KeyShare) {
+	for _, share := range shares {
+		share.Key.Wipe()
+	}
+}
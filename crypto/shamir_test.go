@@ -0,0 +1,133 @@
+/*
+ * shamir_test.go - tests for splitting keys into shares
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package crypto
+
+import (
+	"testing"
+
+	"github.com/google/fscrypt/metadata"
+)
+
+func TestGFInverse(t *testing.T) {
+	for a := 1; a < 256; a++ {
+		if product := gfMul(byte(a), gfInv(byte(a))); product != 1 {
+			t.Errorf("%#x * gfInv(%#x) = %#x", a, a, product)
+		}
+	}
+}
+
+func combineAndCompare(t *testing.T, secret *Key, shares []KeyShare) bool {
+	key, err := CombineKeyShares(shares)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer key.Wipe()
+	return key.Equals(secret)
+}
+
+// Tests that every pair of shares of a 2-of-3 split reconstructs the key, but
+// a single share doesn't.
+func TestSplitKeyTwoOfThree(t *testing.T) {
+	secret, err := NewRandomKey(metadata.PolicyKeyLen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer secret.Wipe()
+	shares, err := SplitKey(secret, 2, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer WipeKeyShares(shares)
+
+	for i := range shares {
+		if shares[i].Index != i+1 {
+			t.Errorf("share %d has index %d", i, shares[i].Index)
+		}
+		if combineAndCompare(t, secret, shares[i:i+1]) {
+			t.Errorf("share %d alone reconstructed the key", shares[i].Index)
+		}
+		for j := range shares {
+			if i != j && !combineAndCompare(t, secret, []KeyShare{shares[i], shares[j]}) {
+				t.Errorf("shares %d and %d didn't reconstruct the key",
+					shares[i].Index, shares[j].Index)
+			}
+		}
+	}
+	if !combineAndCompare(t, secret, shares) {
+		t.Error("all of the shares didn't reconstruct the key")
+	}
+}
+
+// Tests that a threshold of 1 makes each share a copy of the key.
+func TestSplitKeyThresholdOne(t *testing.T) {
+	secret, err := NewRandomKey(metadata.PolicyKeyLen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer secret.Wipe()
+	shares, err := SplitKey(secret, 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer WipeKeyShares(shares)
+	for _, share := range shares {
+		if !share.Key.Equals(secret) {
+			t.Errorf("share %d isn't the key", share.Index)
+		}
+	}
+}
+
+func TestSplitKeyInvalid(t *testing.T) {
+	secret, err := NewRandomKey(metadata.PolicyKeyLen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer secret.Wipe()
+	for _, c := range []struct{ threshold, count int }{
+		{0, 3}, {4, 3}, {2, MaxKeyShares + 1},
+	} {
+		if _, err := SplitKey(secret, c.threshold, c.count); err == nil {
+			t.Errorf("splitting into %d shares with threshold %d should fail",
+				c.count, c.threshold)
+		}
+	}
+}
+
+func TestCombineKeySharesInvalid(t *testing.T) {
+	secret, err := NewRandomKey(metadata.PolicyKeyLen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer secret.Wipe()
+	shares, err := SplitKey(secret, 2, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer WipeKeyShares(shares)
+
+	if _, err := CombineKeyShares(nil); err == nil {
+		t.Error("combining no shares should fail")
+	}
+	if _, err := CombineKeyShares([]KeyShare{shares[0], shares[0]}); err == nil {
+		t.Error("combining a repeated share should fail")
+	}
+	if _, err := CombineKeyShares([]KeyShare{{Index: 0, Key: shares[0].Key}, shares[1]}); err == nil {
+		t.Error("combining a share with index 0 should fail")
+	}
+}
@@ -0,0 +1,229 @@
+/*
+ * backup.go - Saving all the metadata of a filesystem, and restoring it
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package filesystem
+
+import (
+	"bytes"
+	"os"
+	"os/user"
+
+	"github.com/google/fscrypt/crypto"
+	"github.com/google/fscrypt/metadata"
+	"github.com/google/fscrypt/util"
+)
+
+// Backup returns all the metadata on this filesystem: its protectors and
+// policies along with their owners and labels, the links to protectors on
+// other filesystems, and the key encrypting the protector names (if it can be
+// read). If trustedUser is non-nil, only the metadata owned by the given user
+// or by root is included.
+func (m *Mount) Backup(trustedUser *user.User) (*metadata.MetadataBackup, error) {
+	backup := new(metadata.MetadataBackup)
+	linked, err := m.ListLinkedProtectors()
+	if err != nil {
+		return nil, err
+	}
+	isLinked := make(map[string]bool)
+	for _, descriptor := range linked {
+		isLinked[descriptor] = true
+	}
+	backup.LinkedProtectors = linked
+
+	protectors, err := m.ListProtectors(trustedUser)
+	if err != nil {
+		return nil, err
+	}
+	for _, descriptor := range protectors {
+		if isLinked[descriptor] {
+			continue
+		}
+		data := new(metadata.ProtectorData)
+		owner, err := m.getMetadata(protectorRecord, descriptor, trustedUser, data)
+		if err != nil {
+			return nil, err
+		}
+		backup.Protectors = append(backup.Protectors,
+			&metadata.BackupProtector{Data: data, OwnerUid: owner})
+	}
+
+	policies, err := m.ListPolicies(trustedUser)
+	if err != nil {
+		return nil, err
+	}
+	for _, descriptor := range policies {
+		data := new(metadata.PolicyData)
+		owner, err := m.getMetadata(policyRecord, descriptor, trustedUser, data)
+		if err != nil {
+			return nil, err
+		}
+		label, err := m.GetPolicyLabel(descriptor, trustedUser)
+		if err != nil {
+			return nil, err
+		}
+		backup.Policies = append(backup.Policies,
+			&metadata.BackupPolicy{Data: data, OwnerUid: owner, Label: label})
+	}
+
+	nameKey, err := m.GetNameKey(trustedUser)
+	switch {
+	case err == nil:
+		backup.NameKey = append([]byte(nil), nameKey.Data()...)
+		nameKey.Wipe()
+	case os.IsNotExist(err):
+	case os.IsPermission(err):
+		util.Debugf("not saving protector name key: %v", err)
+	default:
+		return nil, err
+	}
+	util.Debugf("saved %d protectors, %d policies, and %d linked protectors of %q",
+		len(backup.Protectors), len(backup.Policies), len(linked), m.Path)
+	return backup, nil
+}
+
+// RestoreResult describes what restoring a backup onto a filesystem did.
+type RestoreResult struct {
+	// Restored and Existing count the protectors, policies, and links
+	// which were added, or were already present and left alone.
+	Restored, Existing int
+	// UnresolvedLinks are the descriptors of the linked protectors which
+	// couldn't be found on a single mounted filesystem.
+	UnresolvedLinks []string
+}
+
+// backupOwner returns the user who should own metadata restored from a backup,
+// or nil to leave it owned by the current user. Only root can give metadata to
+// other users, and users which don't exist on this system are skipped.
+func backupOwner(uid int64) *user.User {
+	if !util.IsUserRoot() {
+		return nil
+	}
+	owner, err := util.UserFromUID(uid)
+	if err != nil {
+		util.Debug(err)
+		return nil
+	}
+	return owner
+}
+
+// findLinkedProtector returns the filesystem other than this one storing the
+// regular protector with the given descriptor, or nil if there isn't exactly
+// one.
+func (m *Mount) findLinkedProtector(descriptor string) (*Mount, error) {
+	mounts, err := AllFilesystems()
+	if err != nil {
+		return nil, err
+	}
+	var found *Mount
+	for _, mnt := range mounts {
+		if mnt == m {
+			continue
+		}
+		if _, err := mnt.GetRegularProtector(descriptor, nil); err != nil {
+			continue
+		}
+		if found != nil {
+			util.Debugf("protector %s is on both %q and %q", descriptor, found.Path, mnt.Path)
+			return nil, nil
+		}
+		found = mnt
+	}
+	return found, nil
+}
+
+// Restore adds the metadata in a backup to this filesystem, e.g. after its
+// metadata directory was lost and set up again. Metadata which is already
+// present is left alone. The links to protectors on other filesystems are
+// recreated if a single mounted filesystem has the protector, and the others
+// are reported. The protector name key is only restored if there is none yet.
+func (m *Mount) Restore(backup *metadata.MetadataBackup) (*RestoreResult, error) {
+	if err := m.CheckSetup(nil); err != nil {
+		return nil, err
+	}
+	result := new(RestoreResult)
+
+	if len(backup.NameKey) != 0 {
+		if _, err := os.Lstat(m.NameKeyPath()); os.IsNotExist(err) {
+			nameKey, err := crypto.NewFixedLengthKeyFromReader(
+				bytes.NewReader(backup.NameKey), len(backup.NameKey))
+			if err != nil {
+				return nil, err
+			}
+			err = m.AddNameKey(nameKey, nil)
+			nameKey.Wipe()
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			util.Debugf("keeping the existing protector name key of %q", m.Path)
+		}
+	}
+
+	for _, protector := range backup.Protectors {
+		descriptor := protector.Data.ProtectorDescriptor
+		if m.hasRecord(protectorRecord, descriptor) || m.hasRecord(linkRecord, descriptor) {
+			util.Debugf("protector %s already exists", descriptor)
+			result.Existing++
+			continue
+		}
+		if err := m.AddProtector(protector.Data, backupOwner(protector.OwnerUid)); err != nil {
+			return nil, err
+		}
+		result.Restored++
+	}
+
+	for _, policy := range backup.Policies {
+		descriptor := policy.Data.KeyDescriptor
+		if m.hasRecord(policyRecord, descriptor) {
+			util.Debugf("policy %s already exists", descriptor)
+			result.Existing++
+			continue
+		}
+		owner := backupOwner(policy.OwnerUid)
+		if err := m.AddPolicy(policy.Data, owner); err != nil {
+			return nil, err
+		}
+		if policy.Label != "" {
+			if err := m.SetPolicyLabel(descriptor, policy.Label, owner); err != nil {
+				return nil, err
+			}
+		}
+		result.Restored++
+	}
+
+	for _, descriptor := range backup.LinkedProtectors {
+		if m.hasRecord(protectorRecord, descriptor) || m.hasRecord(linkRecord, descriptor) {
+			util.Debugf("protector %s already exists", descriptor)
+			result.Existing++
+			continue
+		}
+		dest, err := m.findLinkedProtector(descriptor)
+		if err != nil {
+			return nil, err
+		}
+		if dest == nil {
+			result.UnresolvedLinks = append(result.UnresolvedLinks, descriptor)
+			continue
+		}
+		if _, err = m.AddLinkedProtector(descriptor, dest, nil, nil); err != nil {
+			return nil, err
+		}
+		result.Restored++
+	}
+	return result, nil
+}
@@ -0,0 +1,116 @@
+/*
+ * backup_test.go - tests for saving and restoring the metadata of a filesystem
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package filesystem
+
+import (
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// Tests that the metadata of a filesystem can be restored from a backup after
+// its metadata directory was set up again, and that restoring it again leaves
+// the existing metadata alone.
+func TestBackupRestore(t *testing.T) {
+	mnt, err := getSetupMount(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mnt.RemoveAllMetadata()
+	protector, policy := getFakeProtector(), getFakePolicy()
+	if err = mnt.AddProtector(protector, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err = mnt.AddPolicy(policy, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err = mnt.SetPolicyLabel(policy.KeyDescriptor, "photos", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	backup, err := mnt.Backup(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backup.Protectors) != 1 || len(backup.Policies) != 1 {
+		t.Fatalf("backup has %d protectors and %d policies, expected 1 each",
+			len(backup.Protectors), len(backup.Policies))
+	}
+
+	if err = mnt.RemoveAllMetadata(); err != nil {
+		t.Fatal(err)
+	}
+	if err = mnt.Setup(WorldWritable); err != nil {
+		t.Fatal(err)
+	}
+	result, err := mnt.Restore(backup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Restored != 2 || result.Existing != 0 {
+		t.Errorf("restore result %+v, expected 2 restored", result)
+	}
+
+	restoredProtector, err := mnt.GetRegularProtector(protector.ProtectorDescriptor, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !proto.Equal(restoredProtector, protector) {
+		t.Errorf("restored protector %v, expected %v", restoredProtector, protector)
+	}
+	restoredPolicy, err := mnt.GetPolicy(policy.KeyDescriptor, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !proto.Equal(restoredPolicy, policy) {
+		t.Errorf("restored policy %v, expected %v", restoredPolicy, policy)
+	}
+	if label, err := mnt.GetPolicyLabel(policy.KeyDescriptor, nil); err != nil || label != "photos" {
+		t.Errorf("restored label %q (err: %v), expected %q", label, err, "photos")
+	}
+
+	if result, err = mnt.Restore(backup); err != nil {
+		t.Fatal(err)
+	}
+	if result.Restored != 0 || result.Existing != 2 {
+		t.Errorf("restoring again gave %+v, expected 2 existing", result)
+	}
+}
+
+// Tests that links to protectors which aren't on any mounted filesystem are
+// reported instead of being restored.
+func TestRestoreUnresolvedLink(t *testing.T) {
+	mnt, err := getSetupMount(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mnt.RemoveAllMetadata()
+	backup, err := mnt.Backup(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backup.LinkedProtectors = []string{"00112233aabbccdd"}
+	result, err := mnt.Restore(backup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.UnresolvedLinks) != 1 || result.Restored != 0 {
+		t.Errorf("restore result %+v, expected one unresolved link", result)
+	}
+}
@@ -0,0 +1,210 @@
+/*
+ * dirs.go - Recording which directories use each policy, so that they can be
+ * found without searching the whole filesystem.
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package filesystem
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/google/fscrypt/metadata"
+	"github.com/google/fscrypt/util"
+)
+
+// The directories of each policy are kept in their own directory, like the
+// labels, so that older versions of fscrypt don't mistake them for policies.
+const policyDirsDirName = "directories"
+
+// PolicyDirsDir returns the directory containing the lists of the directories
+// which use each policy.
+func (m *Mount) PolicyDirsDir() string {
+	return filepath.Join(m.BaseDir(), policyDirsDirName)
+}
+
+// policyDirsPath returns the full path to the list of the directories which use
+// the policy with the specified descriptor.
+func (m *Mount) policyDirsPath(descriptor string) string {
+	return filepath.Join(m.PolicyDirsDir(), descriptor)
+}
+
+// usesPolicy returns true if the directory at path is encrypted with the policy
+// with the specified descriptor.
+func usesPolicy(path, descriptor string) bool {
+	data, err := metadata.GetPolicy(path)
+	return err == nil && data.KeyDescriptor == descriptor
+}
+
+// The first line of a list of directories is completeMarker if the list was
+// started when its policy was created, so it includes every directory which was
+// encrypted with the policy since. It can't be mistaken for a directory, since
+// those are stored relative to the root of the filesystem.
+const completeMarker = "/complete"
+
+// readPolicyDirectories returns the directories recorded for the policy with the
+// specified descriptor, whether or not they still use it, and whether the list
+// is complete. Paths which aren't within the filesystem are ignored.
+func (m *Mount) readPolicyDirectories(descriptor string) ([]string, bool, error) {
+	if !m.usesPackedStore() {
+		if err := checkOptionalDir(m.PolicyDirsDir()); err != nil {
+			if os.IsNotExist(err) {
+				return nil, false, nil
+			}
+			return nil, false, err
+		}
+	}
+	// The list is only a hint, as every directory in it is checked, so it
+	// may be owned by any user.
+	data, _, err := m.readRecord(policyDirsRecord, descriptor, nil)
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	lines := strings.Split(string(data), "\n")
+	complete := lines[0] == completeMarker
+	var dirs []string
+	for _, relPath := range lines {
+		if relPath == "" || filepath.IsAbs(relPath) {
+			continue
+		}
+		if dir := filepath.Join(m.Path, relPath); isPathWithin(dir, m.Path) {
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs, complete, nil
+}
+
+// writePolicyDirectories replaces the list of directories of the policy with
+// the specified descriptor.
+func (m *Mount) writePolicyDirectories(descriptor string, dirs []string, complete bool) error {
+	var lines []string
+	if complete {
+		lines = append(lines, completeMarker)
+	}
+	for _, dir := range dirs {
+		relPath, err := filepath.Rel(m.Path, dir)
+		if err != nil {
+			return err
+		}
+		lines = append(lines, relPath)
+	}
+	if !m.usesPackedStore() {
+		if err := m.makeOptionalDir(m.PolicyDirsDir()); err != nil {
+			return err
+		}
+		if err := checkOptionalDir(m.PolicyDirsDir()); err != nil {
+			return err
+		}
+	}
+	data := []byte(strings.Join(lines, "\n") + "\n")
+	return m.writeRecord(policyDirsRecord, descriptor, data, nil)
+}
+
+// StartPolicyDirectories starts the list of directories of a newly created
+// policy, so that the list is known to be complete. It does nothing if the
+// policy already has a list.
+func (m *Mount) StartPolicyDirectories(descriptor string) error {
+	if err := m.CheckSetup(nil); err != nil {
+		return err
+	}
+	if m.hasRecord(policyDirsRecord, descriptor) {
+		return nil
+	}
+	return m.writePolicyDirectories(descriptor, nil, true)
+}
+
+// AddPolicyDirectory records that the existing directory at path, which must be
+// on this filesystem, uses the policy with the specified descriptor. It should
+// be called before the policy is applied, so that the directory is never
+// missing from the list. The directories which no longer use the policy are
+// forgotten at the same time.
+func (m *Mount) AddPolicyDirectory(descriptor string, path string) error {
+	if err := m.CheckSetup(nil); err != nil {
+		return err
+	}
+	absPath, err := filepath.EvalSymlinks(path)
+	if err == nil {
+		absPath, err = filepath.Abs(absPath)
+	}
+	if err != nil {
+		return err
+	}
+	if !isPathWithin(absPath, m.Path) {
+		return errors.Errorf("%q is not on %s", absPath, m.Path)
+	}
+	dirs, complete, err := m.readPolicyDirectories(descriptor)
+	if err != nil {
+		return err
+	}
+	var kept []string
+	seen := make(map[string]bool)
+	for _, dir := range append(dirs, absPath) {
+		if seen[dir] {
+			continue
+		}
+		seen[dir] = true
+		if dir != absPath && !usesPolicy(dir, descriptor) {
+			util.Debugf("%q no longer uses policy %s", dir, descriptor)
+			continue
+		}
+		kept = append(kept, dir)
+	}
+	return m.writePolicyDirectories(descriptor, kept, complete)
+}
+
+// PolicyDirectories returns the directories which were recorded by
+// AddPolicyDirectory to use the policy with the specified descriptor, and still
+// do. The returned bool is true if no other directory can use the policy; it is
+// false for policies created by older versions of fscrypt, whose directories
+// weren't recorded.
+func (m *Mount) PolicyDirectories(descriptor string) ([]string, bool, error) {
+	if err := m.CheckSetup(nil); err != nil {
+		return nil, false, err
+	}
+	dirs, complete, err := m.readPolicyDirectories(descriptor)
+	if err != nil {
+		return nil, false, err
+	}
+	var found []string
+	for _, dir := range dirs {
+		if usesPolicy(dir, descriptor) {
+			found = append(found, dir)
+		}
+	}
+	return found, complete, nil
+}
+
+// removePolicyDirectoriesIfAny is called when a policy is removed. Failing to
+// remove its list of directories only leaves behind an unused file, so it's
+// just logged.
+func (m *Mount) removePolicyDirectoriesIfAny(descriptor string) {
+	if !m.usesPackedStore() {
+		if _, err := os.Lstat(m.policyDirsPath(descriptor)); os.IsNotExist(err) {
+			return
+		}
+	}
+	err := m.removeMetadata(policyDirsRecord, descriptor)
+	if err != nil && !os.IsNotExist(err) {
+		util.Warnf("could not remove the list of directories of policy %s: %v", descriptor, err)
+	}
+}
@@ -0,0 +1,135 @@
+/*
+ * dirs_test.go - Tests for the lists of the directories which use each policy.
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package filesystem
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+// Tests that the list of directories of a policy keeps the directory being
+// added, forgets the ones which don't use the policy, remembers whether it is
+// complete, and is removed along with its policy. The test directories aren't
+// encrypted, so they never actually use the policy.
+func testPolicyDirectories(t *testing.T, mnt *Mount) {
+	policy := getFakePolicy()
+	descriptor := policy.KeyDescriptor
+	if err := mnt.AddPolicy(policy, nil); err != nil {
+		t.Fatal(err)
+	}
+	dir1, err := os.MkdirTemp(mnt.Path, "policy-dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir1)
+	dir2, err := os.MkdirTemp(mnt.Path, "policy-dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir2)
+
+	if dirs, complete, err := mnt.readPolicyDirectories(descriptor); err != nil || dirs != nil || complete {
+		t.Errorf("policy without a list has directories %v (complete: %v, err: %v)", dirs, complete, err)
+	}
+	if err = mnt.StartPolicyDirectories(descriptor); err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range []string{dir1, dir2} {
+		if err = mnt.AddPolicyDirectory(descriptor, dir); err != nil {
+			t.Fatal(err)
+		}
+		dirs, complete, err := mnt.readPolicyDirectories(descriptor)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(dirs, []string{dir}) {
+			t.Errorf("recorded directories are %v, expected just %q", dirs, dir)
+		}
+		if !complete {
+			t.Error("adding a directory made the list incomplete")
+		}
+	}
+	// Starting the list again must not forget the directories.
+	if err = mnt.StartPolicyDirectories(descriptor); err != nil {
+		t.Fatal(err)
+	}
+	if dirs, _, err := mnt.readPolicyDirectories(descriptor); err != nil || len(dirs) != 1 {
+		t.Errorf("recorded directories are %v (err: %v), expected just %q", dirs, err, dir2)
+	}
+	if dirs, complete, err := mnt.PolicyDirectories(descriptor); err != nil || len(dirs) != 0 || !complete {
+		t.Errorf("found directories %v (complete: %v, err: %v) which don't use the policy",
+			dirs, complete, err)
+	}
+	if err = mnt.AddPolicyDirectory(descriptor, os.TempDir()); err == nil {
+		t.Error("recording a directory on another filesystem should fail")
+	}
+
+	if err = mnt.RemovePolicy(descriptor); err != nil {
+		t.Fatal(err)
+	}
+	if dirs, complete, err := mnt.readPolicyDirectories(descriptor); err != nil || dirs != nil || complete {
+		t.Errorf("directories %v (complete: %v, err: %v) were kept after their policy was removed",
+			dirs, complete, err)
+	}
+}
+
+func TestPolicyDirectories(t *testing.T) {
+	mnt, err := getSetupMount(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mnt.RemoveAllMetadata()
+	testPolicyDirectories(t, mnt)
+}
+
+func TestPackedPolicyDirectories(t *testing.T) {
+	mnt, err := getPackedSetupMount(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mnt.RemoveAllMetadata()
+	testPolicyDirectories(t, mnt)
+}
+
+// Tests that a directory added to a policy without a list makes an incomplete
+// list, as the policy may have been applied by an older version of fscrypt.
+func TestPolicyDirectoriesOfOlderPolicy(t *testing.T) {
+	mnt, err := getSetupMount(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mnt.RemoveAllMetadata()
+	if err = os.Remove(mnt.PolicyDirsDir()); err != nil {
+		t.Fatal(err)
+	}
+	descriptor := getFakePolicy().KeyDescriptor
+	dir, err := os.MkdirTemp(mnt.Path, "policy-dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err = mnt.AddPolicyDirectory(descriptor, dir); err != nil {
+		t.Fatal(err)
+	}
+	if dirs, complete, err := mnt.readPolicyDirectories(descriptor); err != nil || len(dirs) != 1 || complete {
+		t.Errorf("recorded directories %v (complete: %v, err: %v), expected just %q in an incomplete list",
+			dirs, complete, err, dir)
+	}
+}
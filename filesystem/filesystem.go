@@ -30,12 +30,22 @@
 //		- adding/querying/deleting metadata
 //		- making links to other filesystems' metadata
 //		- following links to get data from other filesystems
+//	- packed metadata storage (packed.go)
+//		- keeping all metadata in a single indexed file
+//	- metadata locking (lock.go)
+//		- serializing changes made by concurrent fscrypt processes
+//	- metadata journaling (journal.go)
+//		- rolling back changes interrupted by a crash
+//	- policy labels (label.go)
+//		- naming policies for display, without affecting unlocking
+//	- mount watching (watch.go)
+//		- reporting fscrypt filesystems being mounted or unmounted
 package filesystem
 
 import (
+	"bytes"
 	"fmt"
 	"io"
-	"log"
 	"os"
 	"os/user"
 	"path/filepath"
@@ -48,6 +58,7 @@ import (
 	"golang.org/x/sys/unix"
 	"google.golang.org/protobuf/proto"
 
+	"github.com/google/fscrypt/crypto"
 	"github.com/google/fscrypt/metadata"
 	"github.com/google/fscrypt/util"
 )
@@ -73,6 +84,31 @@ func (err *ErrCorruptMetadata) Error() string {
 		err.Path, err.UnderlyingError)
 }
 
+// ErrMetadataTooNew indicates that an fscrypt metadata file was written by a
+// newer version of fscrypt, with a schema version this version doesn't support.
+type ErrMetadataTooNew struct {
+	Path    string
+	Version int64
+}
+
+func (err *ErrMetadataTooNew) Error() string {
+	return fmt.Sprintf("fscrypt metadata file at %q has schema version %d, but this version of fscrypt only supports up to %d",
+		err.Path, err.Version, metadata.SchemaVersion)
+}
+
+// ErrMetadataDowngraded indicates that an fscrypt metadata file lacks the
+// metadata HMAC which its schema version requires, or has a schema version
+// older than the one all the metadata on the filesystem was upgraded to. Either
+// way, its integrity can't be checked, so it must have been tampered with.
+type ErrMetadataDowngraded struct {
+	Path   string
+	Reason string
+}
+
+func (err *ErrMetadataDowngraded) Error() string {
+	return fmt.Sprintf("fscrypt metadata file at %q has been downgraded: %s", err.Path, err.Reason)
+}
+
 // ErrFollowLink indicates that a protector link can't be followed.
 type ErrFollowLink struct {
 	Link            string
@@ -127,6 +163,29 @@ func (err *ErrNoCreatePermission) Error() string {
 	return fmt.Sprintf("user lacks permission to create fscrypt metadata on %s", err.Mount.Path)
 }
 
+// ErrMetadataNotWritable indicates that the current user can't modify the
+// fscrypt metadata on a filesystem.
+type ErrMetadataNotWritable struct {
+	Path            string
+	UnderlyingError error
+}
+
+func (err *ErrMetadataNotWritable) Error() string {
+	return fmt.Sprintf("cannot modify fscrypt metadata in %q: %s",
+		err.Path, err.UnderlyingError)
+}
+
+// ErrReadOnlyFilesystem indicates that the fscrypt metadata on a filesystem
+// can't be changed because it is on a read-only filesystem. The metadata can
+// still be read, so directories can still be unlocked.
+type ErrReadOnlyFilesystem struct {
+	Mount *Mount
+}
+
+func (err *ErrReadOnlyFilesystem) Error() string {
+	return fmt.Sprintf("cannot change fscrypt metadata on %s: read-only filesystem", err.Mount.Path)
+}
+
 // ErrNotAMountpoint indicates that a path is not a mountpoint.
 type ErrNotAMountpoint struct {
 	Path string
@@ -189,6 +248,19 @@ func (err *ErrProtectorNotFound) Error() string {
 		err.Descriptor, err.Mount.Path)
 }
 
+// ErrReservedDirectory indicates that a directory cannot be encrypted because
+// it is the filesystem's mountpoint, or it is, contains, or is contained in the
+// filesystem's fscrypt metadata directory.
+type ErrReservedDirectory struct {
+	Path  string
+	Mount *Mount
+}
+
+func (err *ErrReservedDirectory) Error() string {
+	return fmt.Sprintf("%q cannot be encrypted because it is the mountpoint of, or overlaps with the fscrypt metadata directory of, filesystem %s",
+		err.Path, err.Mount.Path)
+}
+
 // SortDescriptorsByLastMtime indicates whether descriptors are sorted by last
 // modification time when being listed.  This can be set to true to get
 // consistent output for testing.
@@ -210,6 +282,7 @@ var SortDescriptorsByLastMtime = false
 // setup first. Specifically, the directories created look like:
 // <mountpoint>
 // └── .fscrypt
+//     ├── lock
 //     ├── policies
 //     └── protectors
 //
@@ -232,6 +305,9 @@ type Mount struct {
 	DeviceNumber   DeviceNumber
 	Subtree        string
 	ReadOnly       bool
+	InlineCrypt    bool
+	// The transaction in progress on this filesystem, if any
+	transaction *Transaction
 }
 
 // PathSorter allows mounts to be sorted by Path.
@@ -248,6 +324,7 @@ const (
 	protectorDirName  = "protectors"
 	tempPrefix        = ".tmp"
 	linkFileExtension = ".link"
+	nameKeyFileName   = "name_key"
 
 	// The base directory should be read-only (except for the creator)
 	basePermissions = 0755
@@ -285,8 +362,37 @@ func (m *Mount) String() string {
 	Device:         %s`, m.Path, m.FilesystemType, m.Device)
 }
 
+// metadataDirs are the base fscrypt directories of the filesystems (by
+// mountpoint) whose metadata is kept somewhere other than MOUNTPOINT/.fscrypt,
+// e.g. because the filesystem is read-only.
+var metadataDirs = make(map[string]string)
+
+// SetMetadataDir makes the metadata of the filesystem mounted at mountpoint be
+// kept in dir instead of MOUNTPOINT/.fscrypt. dir must be an absolute path; it
+// may be on another filesystem. An empty dir restores the default.
+func SetMetadataDir(mountpoint, dir string) error {
+	if dir == "" {
+		delete(metadataDirs, mountpoint)
+		return nil
+	}
+	if !filepath.IsAbs(dir) {
+		return errors.Errorf("metadata directory %q of %q is not an absolute path", dir, mountpoint)
+	}
+	metadataDirs[mountpoint] = filepath.Clean(dir)
+	return nil
+}
+
+// MetadataDir returns the directory set with SetMetadataDir for the filesystem
+// mounted at mountpoint, or the empty string if it uses MOUNTPOINT/.fscrypt.
+func MetadataDir(mountpoint string) string {
+	return metadataDirs[mountpoint]
+}
+
 // BaseDir returns the path to the base fscrypt directory for this filesystem.
 func (m *Mount) BaseDir() string {
+	if dir, ok := metadataDirs[m.Path]; ok {
+		return dir
+	}
 	rawBaseDir := filepath.Join(m.Path, baseDirName)
 	// We allow the base directory to be a symlink, but some callers need
 	// the real path, so dereference the symlink here if needed. Since the
@@ -330,6 +436,81 @@ func (m *Mount) PolicyPath(descriptor string) string {
 	return filepath.Join(m.PolicyDir(), descriptor)
 }
 
+// recordPath returns the full path to the file which holds a record in the
+// per-file metadata store.
+func (m *Mount) recordPath(kind recordKind, descriptor string) string {
+	switch kind {
+	case policyRecord:
+		return m.PolicyPath(descriptor)
+	case linkRecord:
+		return m.linkedProtectorPath(descriptor)
+	case labelRecord:
+		return m.labelPath(descriptor)
+	case backupRecord:
+		return m.backupPath(descriptor)
+	case policyDirsRecord:
+		return m.policyDirsPath(descriptor)
+	default:
+		return m.protectorPath(descriptor)
+	}
+}
+
+// recordName describes where a record is stored, for log and error messages.
+func (m *Mount) recordName(kind recordKind, descriptor string) string {
+	if m.usesPackedStore() {
+		return m.packedRecordName(kind, descriptor)
+	}
+	return m.recordPath(kind, descriptor)
+}
+
+// PolicyLocation describes where the metadata of the policy with the given
+// descriptor is stored, for messages such as those of --dry-run. For a new
+// policy, whose descriptor isn't known yet, "*" can be used.
+func (m *Mount) PolicyLocation(descriptor string) string {
+	return m.recordName(policyRecord, descriptor)
+}
+
+// ProtectorLocation describes where the protector (or the link to the
+// protector) with the given descriptor is stored, for messages such as those
+// of --dry-run. For a new protector, whose descriptor isn't known yet, "*" can
+// be used.
+func (m *Mount) ProtectorLocation(descriptor string) string {
+	if linked, err := m.ListLinkedProtectors(); err == nil {
+		for _, linkedDescriptor := range linked {
+			if linkedDescriptor == descriptor {
+				return m.recordName(linkRecord, descriptor)
+			}
+		}
+	}
+	return m.recordName(protectorRecord, descriptor)
+}
+
+// CheckNotReserved returns an ErrReservedDirectory if path must never be
+// encrypted: i.e. if it is the mountpoint itself, or if it is the metadata
+// directory, a directory inside it, or an ancestor of it. Symlinks are resolved
+// before comparing paths.
+func (m *Mount) CheckNotReserved(path string) error {
+	realPath, err := canonicalizePath(path)
+	if err != nil {
+		return err
+	}
+	mountPath, err := canonicalizePath(m.Path)
+	if err != nil {
+		return err
+	}
+	// The metadata directory may not exist (yet), in which case we
+	// compare against its uncanonicalized location.
+	baseDir, err := canonicalizePath(m.BaseDir())
+	if err != nil {
+		baseDir = filepath.Clean(m.BaseDir())
+	}
+	if realPath == mountPath || isPathWithin(realPath, baseDir) ||
+		isPathWithin(baseDir, realPath) {
+		return &ErrReservedDirectory{path, m}
+	}
+	return nil
+}
+
 // tempMount creates a temporary directory alongside this Mount's base fscrypt
 // directory and returns a temporary Mount which represents this temporary
 // directory. The caller is responsible for removing this temporary directory.
@@ -414,7 +595,7 @@ func checkOwnership(path string, info os.FileInfo, trustedUser *user.User) bool
 	trustedUID := uint32(util.AtoiOrPanic(trustedUser.Uid))
 	actualUID := info.Sys().(*syscall.Stat_t).Uid
 	if actualUID != 0 && actualUID != trustedUID {
-		log.Printf("WARNING: %q is owned by uid %d, but expected %d or 0",
+		util.Warnf("%q is owned by uid %d, but expected %d or 0",
 			path, actualUID, trustedUID)
 		return false
 	}
@@ -434,11 +615,11 @@ func (m *Mount) CheckSetup(trustedUser *user.User) error {
 		return &ErrNotSetup{m}
 	}
 	if (info.Mode() & os.ModeSymlink) != 0 {
-		log.Printf("mountpoint directory %q cannot be a symlink", m.Path)
+		util.Debugf("mountpoint directory %q cannot be a symlink", m.Path)
 		return &ErrNotSetup{m}
 	}
 	if !info.IsDir() {
-		log.Printf("mountpoint %q is not a directory", m.Path)
+		util.Debugf("mountpoint %q is not a directory", m.Path)
 		return &ErrNotSetup{m}
 	}
 	if !checkOwnership(m.Path, info, trustedUser) {
@@ -453,7 +634,7 @@ func (m *Mount) CheckSetup(trustedUser *user.User) error {
 		return &ErrNotSetup{m}
 	}
 	if !info.IsDir() {
-		log.Printf("%q is not a directory", m.BaseDir())
+		util.Debugf("%q is not a directory", m.BaseDir())
 		return &ErrNotSetup{m}
 	}
 	if !checkOwnership(m.Path, info, trustedUser) {
@@ -469,11 +650,11 @@ func (m *Mount) CheckSetup(trustedUser *user.User) error {
 			return &ErrNotSetup{m}
 		}
 		if (info.Mode() & os.ModeSymlink) != 0 {
-			log.Printf("directory %q cannot be a symlink", path)
+			util.Debugf("directory %q cannot be a symlink", path)
 			return &ErrNotSetup{m}
 		}
 		if !info.IsDir() {
-			log.Printf("%q is not a directory", path)
+			util.Debugf("%q is not a directory", path)
 			return &ErrNotSetup{m}
 		}
 		// We are no longer too picky about the mode, given that
@@ -482,7 +663,7 @@ func (m *Mount) CheckSetup(trustedUser *user.User) error {
 		// However, we can at least verify that if the directory is
 		// world-writable, then the sticky bit is also set.
 		if info.Mode()&(os.ModeSticky|0002) == 0002 {
-			log.Printf("%q is world-writable but doesn't have sticky bit set", path)
+			util.Debugf("%q is world-writable but doesn't have sticky bit set", path)
 			return &ErrInsecurePermissions{path}
 		}
 		if !checkOwnership(path, info, trustedUser) {
@@ -492,7 +673,45 @@ func (m *Mount) CheckSetup(trustedUser *user.User) error {
 	return nil
 }
 
-// makeDirectories creates the three metadata directories with the correct
+// CheckWritable returns an error if the current user can't add or remove
+// fscrypt metadata on this filesystem, e.g. because the filesystem is mounted
+// read-only. It assumes that CheckSetup succeeded.
+func (m *Mount) CheckWritable() error {
+	if m.isMetadataReadOnly() {
+		return &ErrReadOnlyFilesystem{m}
+	}
+	dirs := []string{m.PolicyDir(), m.ProtectorDir()}
+	if m.usesPackedStore() {
+		// The packed file is replaced as a whole.
+		dirs = []string{m.BaseDir()}
+	}
+	for _, dir := range dirs {
+		if err := unix.Access(dir, unix.W_OK|unix.X_OK); err != nil {
+			util.Debugf("access(%q, W_OK|X_OK) = %v", dir, err)
+			return &ErrMetadataNotWritable{dir, err}
+		}
+	}
+	return nil
+}
+
+// isMetadataReadOnly returns true if the fscrypt metadata of this filesystem is
+// on a read-only filesystem. This isn't necessarily m.ReadOnly, since the
+// metadata may be kept in another directory. If the metadata directory doesn't
+// exist yet, the filesystem it would be created on is checked.
+func (m *Mount) isMetadataReadOnly() bool {
+	var stat unix.Statfs_t
+	err := unix.Statfs(m.BaseDir(), &stat)
+	if os.IsNotExist(err) {
+		err = unix.Statfs(filepath.Dir(m.BaseDir()), &stat)
+	}
+	if err != nil {
+		util.Debugf("statfs(%q) = %v", m.BaseDir(), err)
+		return false
+	}
+	return stat.Flags&unix.ST_RDONLY != 0
+}
+
+// makeDirectories creates the metadata directories with the correct
 // permissions. Note that this function overrides the umask.
 func (m *Mount) makeDirectories(setupMode SetupMode) error {
 	// Zero the umask so we get the permissions we want
@@ -515,7 +734,52 @@ func (m *Mount) makeDirectories(setupMode SetupMode) error {
 	if err := os.Mkdir(m.PolicyDir(), dirMode); err != nil {
 		return err
 	}
-	return os.Mkdir(m.ProtectorDir(), dirMode)
+	if err := os.Mkdir(m.ProtectorDir(), dirMode); err != nil {
+		return err
+	}
+	if err := os.Mkdir(m.LabelDir(), dirMode); err != nil {
+		return err
+	}
+	if err := os.Mkdir(m.PolicyDirsDir(), dirMode); err != nil {
+		return err
+	}
+	return os.Mkdir(m.JournalDir(), dirMode)
+}
+
+// makeOptionalDir creates a metadata directory which filesystems set up by older
+// versions of fscrypt don't have, if it doesn't exist yet. It gets the same
+// permissions as the policies directory. Note that this function overrides the
+// umask.
+func (m *Mount) makeOptionalDir(dir string) error {
+	info, err := os.Stat(m.PolicyDir())
+	if err != nil {
+		return err
+	}
+	oldMask := unix.Umask(0)
+	defer func() {
+		unix.Umask(oldMask)
+	}()
+	err = os.Mkdir(dir, info.Mode()&(os.ModeSticky|0777))
+	if os.IsPermission(err) {
+		return &ErrNoCreatePermission{m}
+	}
+	if err != nil && !os.IsExist(err) {
+		return err
+	}
+	return nil
+}
+
+// checkOptionalDir returns an error if a directory made by makeOptionalDir
+// exists but isn't a real directory, as then the files in it can't be trusted.
+func checkOptionalDir(dir string) error {
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return &ErrCorruptMetadata{dir, errors.New("not a directory")}
+	}
+	return nil
 }
 
 // GetSetupMode returns the current mode for fscrypt metadata creation on this
@@ -539,7 +803,7 @@ func (m *Mount) GetSetupMode() (SetupMode, *user.User, error) {
 				return SingleUserWritable, user, nil
 			}
 		}
-		log.Printf("filesystem %s uses custom permissions on metadata directories", m.Path)
+		util.Debugf("filesystem %s uses custom permissions on metadata directories", m.Path)
 	}
 	return -1, nil, errors.New("unable to determine setup mode")
 }
@@ -549,12 +813,25 @@ func (m *Mount) GetSetupMode() (SetupMode, *user.User, error) {
 // the filesystem's feature flags. This operation is atomic; it either succeeds
 // or no files in the baseDir are created.
 func (m *Mount) Setup(mode SetupMode) error {
+	return m.SetupWithStore(mode, PerFileStore)
+}
+
+// SetupWithStore is like Setup, but it also selects how the metadata will be
+// stored. PackedStore can only be used with SingleUserWritable, since all of
+// the metadata is in one file with a single owner.
+func (m *Mount) SetupWithStore(mode SetupMode, store MetadataStore) error {
+	if store == PackedStore && mode != SingleUserWritable {
+		return errors.New("the packed metadata store can only be writable by a single user")
+	}
 	if m.CheckSetup(nil) == nil {
 		return &ErrAlreadySetup{m}
 	}
 	if !m.isFscryptSetupAllowed() {
 		return &ErrSetupNotSupported{m}
 	}
+	if m.isMetadataReadOnly() {
+		return &ErrReadOnlyFilesystem{m}
+	}
 	// We build the directories under a temp Mount and then move into place.
 	temp, err := m.tempMount()
 	if err != nil {
@@ -565,6 +842,18 @@ func (m *Mount) Setup(mode SetupMode) error {
 	if err = temp.makeDirectories(mode); err != nil {
 		return err
 	}
+	if err = temp.createLockFile(); err != nil {
+		return err
+	}
+	// There is no metadata yet which may predate the current schema.
+	if err = temp.writeSchemaFloor(metadata.SchemaVersion); err != nil {
+		return err
+	}
+	if store == PackedStore {
+		if err = createPackedFile(temp.packedPath()); err != nil {
+			return err
+		}
+	}
 
 	// Atomically move directory into place.
 	return os.Rename(temp.BaseDir(), m.BaseDir())
@@ -579,6 +868,11 @@ func (m *Mount) RemoveAllMetadata() error {
 	if err := m.CheckSetup(nil); err != nil {
 		return err
 	}
+	lock, err := m.LockMetadata()
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
 	// temp will hold the old metadata temporarily
 	temp, err := m.tempMount()
 	if err != nil {
@@ -608,7 +902,7 @@ func (m *Mount) overwriteDataNonAtomic(path string, data []byte) error {
 		return err
 	}
 	if _, err = file.Write(data); err != nil {
-		log.Printf("WARNING: overwrite of %q failed; file will be corrupted!", path)
+		util.Errorf("overwrite of %q failed; file will be corrupted!", path)
 		file.Close()
 		return err
 	}
@@ -619,7 +913,7 @@ func (m *Mount) overwriteDataNonAtomic(path string, data []byte) error {
 	if err = file.Close(); err != nil {
 		return err
 	}
-	log.Printf("successfully overwrote %q non-atomically", path)
+	util.Debugf("successfully overwrote %q non-atomically", path)
 	return nil
 }
 
@@ -636,10 +930,10 @@ func (m *Mount) writeData(path string, data []byte, owner *user.User, mode os.Fi
 	dirPath := filepath.Dir(path)
 	tempFile, err := os.CreateTemp(dirPath, tempPrefix)
 	if err != nil {
-		log.Print(err)
+		util.Debug(err)
 		if os.IsPermission(err) {
 			if _, err = os.Lstat(path); err == nil {
-				log.Printf("trying non-atomic overwrite of %q", path)
+				util.Debugf("trying non-atomic overwrite of %q", path)
 				return m.overwriteDataNonAtomic(path, data)
 			}
 			return &ErrNoCreatePermission{m}
@@ -657,7 +951,7 @@ func (m *Mount) writeData(path string, data []byte, owner *user.User, mode os.Fi
 	// needs to create files owned by a particular user.
 	if owner != nil {
 		if err = util.Chown(tempFile, owner); err != nil {
-			log.Printf("could not set owner of %q to %v: %v",
+			util.Debugf("could not set owner of %q to %v: %v",
 				path, owner.Username, err)
 			tempFile.Close()
 			return err
@@ -682,17 +976,46 @@ func (m *Mount) writeData(path string, data []byte, owner *user.User, mode os.Fi
 	return syncDirectory(dirPath)
 }
 
-// addMetadata writes the metadata structure to the file with the specified
-// path. This will overwrite any existing data. The operation is atomic.
-func (m *Mount) addMetadata(path string, md metadata.Metadata, owner *user.User) error {
+// addMetadata writes the metadata structure to the record with the specified
+// kind and descriptor. This will overwrite any existing data, after backing it
+// up if it has an older schema version. md is written with the current schema
+// version, unless it lacks the metadata HMAC which that version requires (see
+// metadata.MigrateForWriting). The operation is atomic.
+func (m *Mount) addMetadata(kind recordKind, descriptor string, md metadata.VersionedMetadata,
+	owner *user.User) (err error) {
 	if err := md.CheckValidity(); err != nil {
 		return errors.Wrap(err, "provided metadata is invalid")
 	}
+	version := metadata.MigrateForWriting(md)
+	defer func() {
+		// Within a transaction, this is done once it's committed.
+		if err == nil && version == metadata.SchemaVersion && m.transaction == nil {
+			m.raiseSchemaFloor()
+		}
+	}()
+	floor, err := m.schemaFloor()
+	if err != nil {
+		return err
+	}
+	if version < floor {
+		return errors.Errorf("metadata without an HMAC can't be written to %s, as all of its metadata has schema version %d",
+			m.Path, floor)
+	}
+	if err = m.journalRecord(kind, descriptor); err != nil {
+		return err
+	}
+	if err = m.backupOldSchema(kind, descriptor, md, version, owner); err != nil {
+		return err
+	}
 
 	data, err := proto.Marshal(md)
 	if err != nil {
 		return err
 	}
+	if m.usesPackedStore() {
+		return m.putPackedRecord(kind, descriptor, data)
+	}
+	path := m.recordPath(kind, descriptor)
 
 	mode := filePermissions
 	// If the file already exists, then preserve its owner and mode if
@@ -703,18 +1026,18 @@ func (m *Mount) addMetadata(path string, md metadata.Metadata, owner *user.User)
 		if owner == nil && util.IsUserRoot() {
 			uid := info.Sys().(*syscall.Stat_t).Uid
 			if owner, err = util.UserFromUID(int64(uid)); err != nil {
-				log.Print(err)
+				util.Debug(err)
 			}
 		}
 		mode = info.Mode() & 0777
 	} else if !os.IsNotExist(err) {
-		log.Print(err)
+		util.Debug(err)
 	}
 
 	if owner != nil {
-		log.Printf("writing metadata to %q and setting owner to %s", path, owner.Username)
+		util.Infof("writing metadata to %q and setting owner to %s", path, owner.Username)
 	} else {
-		log.Printf("writing metadata to %q", path)
+		util.Infof("writing metadata to %q", path)
 	}
 	return m.writeData(path, data, owner, mode)
 }
@@ -776,12 +1099,49 @@ func readMetadataFileSafe(path string, trustedUser *user.User) ([]byte, int64, e
 	return data, int64(info.Sys().(*syscall.Stat_t).Uid), nil
 }
 
-// getMetadata reads the metadata structure from the file with the specified
-// path. Only reads normal metadata files, not linked metadata.
-func (m *Mount) getMetadata(path string, trustedUser *user.User, md metadata.Metadata) (int64, error) {
-	data, owner, err := readMetadataFileSafe(path, trustedUser)
+// readRecord reads the raw data of a record, along with the UID of the user who
+// owns it. If there is no such record, the returned error satisfies
+// os.IsNotExist.
+func (m *Mount) readRecord(kind recordKind, descriptor string,
+	trustedUser *user.User) ([]byte, int64, error) {
+	if m.usesPackedStore() {
+		return m.getPackedRecord(kind, descriptor, trustedUser)
+	}
+	return readMetadataFileSafe(m.recordPath(kind, descriptor), trustedUser)
+}
+
+// hasRecord returns true if a record with the specified kind and descriptor
+// exists.
+func (m *Mount) hasRecord(kind recordKind, descriptor string) bool {
+	if m.usesPackedStore() {
+		_, _, err := m.getPackedRecord(kind, descriptor, nil)
+		return err == nil
+	}
+	return isRegularFile(m.recordPath(kind, descriptor))
+}
+
+// writeRecord writes raw data (such as a link) to the record with the specified
+// kind and descriptor, replacing any existing record.
+func (m *Mount) writeRecord(kind recordKind, descriptor string, data []byte, owner *user.User) error {
+	if err := m.journalRecord(kind, descriptor); err != nil {
+		return err
+	}
+	if m.usesPackedStore() {
+		return m.putPackedRecord(kind, descriptor, data)
+	}
+	return m.writeData(m.recordPath(kind, descriptor), data, owner, filePermissions)
+}
+
+// getMetadata reads the metadata structure from the record with the specified
+// kind and descriptor. Only reads normal metadata, not linked metadata. Metadata
+// with an older schema version is upgraded in memory; it's only rewritten
+// (see addMetadata) when it's next changed.
+func (m *Mount) getMetadata(kind recordKind, descriptor string, trustedUser *user.User,
+	md metadata.VersionedMetadata) (int64, error) {
+	path := m.recordName(kind, descriptor)
+	data, owner, err := m.readRecord(kind, descriptor, trustedUser)
 	if err != nil {
-		log.Printf("could not read metadata from %q: %v", path, err)
+		util.Debugf("could not read metadata from %q: %v", path, err)
 		return -1, err
 	}
 
@@ -789,23 +1149,55 @@ func (m *Mount) getMetadata(path string, trustedUser *user.User, md metadata.Met
 		return -1, &ErrCorruptMetadata{path, err}
 	}
 
+	if err := metadata.CheckSchemaVersion(md); err != nil {
+		return -1, &ErrCorruptMetadata{path, err}
+	}
+	if metadata.SchemaIsTooNew(md) {
+		return -1, &ErrMetadataTooNew{path, md.GetSchemaVersion()}
+	}
+	if !metadata.HasRequiredHMAC(md) {
+		return -1, &ErrMetadataDowngraded{path, fmt.Sprintf("schema version %d requires a metadata HMAC, but it has none",
+			md.GetSchemaVersion())}
+	}
+	floor, err := m.schemaFloor()
+	if err != nil {
+		return -1, err
+	}
+	if md.GetSchemaVersion() < floor {
+		return -1, &ErrMetadataDowngraded{path, fmt.Sprintf("schema version %d is older than version %d, which all the metadata on %s was upgraded to",
+			md.GetSchemaVersion(), floor, m.Path)}
+	}
+	if version := md.GetSchemaVersion(); metadata.MigrateSchema(md) {
+		util.Debugf("upgraded %q from schema version %d in memory", path, version)
+	}
+
 	if err := md.CheckValidity(); err != nil {
 		return -1, &ErrCorruptMetadata{path, err}
 	}
 
-	log.Printf("successfully read metadata from %q", path)
+	util.Debugf("successfully read metadata from %q", path)
 	return owner, nil
 }
 
-// removeMetadata deletes the metadata struct from the file with the specified
-// path. Works with regular or linked metadata.
-func (m *Mount) removeMetadata(path string) error {
-	if err := os.Remove(path); err != nil {
-		log.Printf("could not remove metadata file at %q: %v", path, err)
+// removeMetadata deletes the record with the specified kind and descriptor.
+// Works with regular or linked metadata.
+func (m *Mount) removeMetadata(kind recordKind, descriptor string) error {
+	path := m.recordName(kind, descriptor)
+	err := m.journalRecord(kind, descriptor)
+	if err != nil {
+		return err
+	}
+	if m.usesPackedStore() {
+		err = m.removePackedRecord(kind, descriptor)
+	} else {
+		err = os.Remove(path)
+	}
+	if err != nil {
+		util.Debugf("could not remove metadata at %q: %v", path, err)
 		return err
 	}
 
-	log.Printf("successfully removed metadata file at %q", path)
+	util.Infof("successfully removed metadata at %q", path)
 	return nil
 }
 
@@ -818,12 +1210,11 @@ func (m *Mount) AddProtector(data *metadata.ProtectorData, owner *user.User) err
 	if err = m.CheckSetup(nil); err != nil {
 		return err
 	}
-	if isRegularFile(m.linkedProtectorPath(data.ProtectorDescriptor)) {
+	if m.hasRecord(linkRecord, data.ProtectorDescriptor) {
 		return errors.Errorf("cannot modify linked protector %s on filesystem %s",
 			data.ProtectorDescriptor, m.Path)
 	}
-	path := m.protectorPath(data.ProtectorDescriptor)
-	return m.addMetadata(path, data, owner)
+	return m.addMetadata(protectorRecord, data.ProtectorDescriptor, data, owner)
 }
 
 // AddLinkedProtector adds a link in this filesystem to the protector metadata
@@ -839,10 +1230,10 @@ func (m *Mount) AddLinkedProtector(descriptor string, dest *Mount, trustedUser *
 		return false, err
 	}
 
-	linkPath := m.linkedProtectorPath(descriptor)
+	linkPath := m.recordName(linkRecord, descriptor)
 
 	// Check whether the link already exists.
-	existingLink, _, err := readMetadataFileSafe(linkPath, trustedUser)
+	existingLink, _, err := m.readRecord(linkRecord, descriptor, trustedUser)
 	if err == nil {
 		existingLinkedMnt, err := getMountFromLink(string(existingLink))
 		if err != nil {
@@ -863,7 +1254,72 @@ func (m *Mount) AddLinkedProtector(descriptor string, dest *Mount, trustedUser *
 	if err != nil {
 		return false, err
 	}
-	return true, m.writeData(linkPath, []byte(newLink), ownerIfCreating, filePermissions)
+	return true, m.writeRecord(linkRecord, descriptor, []byte(newLink), ownerIfCreating)
+}
+
+// RelinkProtector makes the link in this filesystem for the given protector
+// descriptor point to the protector metadata in the dest filesystem. Unlike
+// AddLinkedProtector, this replaces any existing link, so it can be used to
+// repair links that no longer resolve. A replaced link keeps its owner.
+func (m *Mount) RelinkProtector(descriptor string, dest *Mount, trustedUser *user.User) error {
+	if err := m.CheckSetup(trustedUser); err != nil {
+		return err
+	}
+	lock, err := m.LockMetadata()
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+	if _, err := dest.GetRegularProtector(descriptor, trustedUser); err != nil {
+		return err
+	}
+	if m.hasRecord(protectorRecord, descriptor) {
+		return errors.Errorf("protector %s is not a link on filesystem %s",
+			descriptor, m.Path)
+	}
+
+	linkPath := m.recordName(linkRecord, descriptor)
+	var owner *user.User
+	_, ownerUID, err := m.readRecord(linkRecord, descriptor, trustedUser)
+	switch {
+	case err == nil:
+		if util.IsUserRoot() {
+			if owner, err = util.UserFromUID(ownerUID); err != nil {
+				return err
+			}
+		}
+	case !os.IsNotExist(err):
+		return err
+	}
+
+	newLink, err := makeLink(dest)
+	if err != nil {
+		return err
+	}
+	util.Infof("pointing protector link %q to %q", linkPath, dest.Path)
+	return m.writeRecord(linkRecord, descriptor, []byte(newLink), owner)
+}
+
+// ListLinkedProtectors lists the descriptors of the protectors on this
+// filesystem which are links to other filesystems' metadata.
+func (m *Mount) ListLinkedProtectors() ([]string, error) {
+	if err := m.CheckSetup(nil); err != nil {
+		return nil, err
+	}
+	if m.usesPackedStore() {
+		return m.listPackedRecords(nil, linkRecord)
+	}
+	descriptors, err := m.listDirectory(m.ProtectorDir())
+	if err != nil {
+		return nil, err
+	}
+	linked := make([]string, 0, len(descriptors))
+	for _, descriptor := range descriptors {
+		if isRegularFile(m.linkedProtectorPath(descriptor)) {
+			linked = append(linked, descriptor)
+		}
+	}
+	return linked, nil
 }
 
 // GetRegularProtector looks up the protector metadata by descriptor. This will
@@ -873,8 +1329,8 @@ func (m *Mount) GetRegularProtector(descriptor string, trustedUser *user.User) (
 		return nil, err
 	}
 	data := new(metadata.ProtectorData)
-	path := m.protectorPath(descriptor)
-	owner, err := m.getMetadata(path, trustedUser, data)
+	path := m.recordName(protectorRecord, descriptor)
+	owner, err := m.getMetadata(protectorRecord, descriptor, trustedUser, data)
 	if os.IsNotExist(err) {
 		err = &ErrProtectorNotFound{descriptor, m}
 	}
@@ -888,7 +1344,7 @@ func (m *Mount) GetRegularProtector(descriptor string, trustedUser *user.User) (
 	// login protectors owned by the user, but previous versions could
 	// create them owned by root -- that is the main reason we allow root.
 	if data.Source == metadata.SourceType_pam_passphrase && owner != 0 && owner != data.Uid {
-		log.Printf("WARNING: %q claims to be the login protector for uid %d, but it is owned by uid %d.  Needs to be %d or 0.",
+		util.Warnf("%q claims to be the login protector for uid %d, but it is owned by uid %d.  Needs to be %d or 0.",
 			path, data.Uid, owner, data.Uid)
 		return nil, &ErrCorruptMetadata{path, errors.New("login protector belongs to wrong user")}
 	}
@@ -903,8 +1359,8 @@ func (m *Mount) GetProtector(descriptor string, trustedUser *user.User) (*Mount,
 		return nil, nil, err
 	}
 	// Get the link data from the link file
-	path := m.linkedProtectorPath(descriptor)
-	link, _, err := readMetadataFileSafe(path, trustedUser)
+	path := m.recordName(linkRecord, descriptor)
+	link, _, err := m.readRecord(linkRecord, descriptor, trustedUser)
 	if err != nil {
 		// If the link doesn't exist, try for a regular protector.
 		if os.IsNotExist(err) {
@@ -913,7 +1369,7 @@ func (m *Mount) GetProtector(descriptor string, trustedUser *user.User) (*Mount,
 		}
 		return nil, nil, err
 	}
-	log.Printf("following protector link %s", path)
+	util.Debugf("following protector link %s", path)
 	linkedMnt, err := getMountFromLink(string(link))
 	if err != nil {
 		return nil, nil, errors.Wrap(err, path)
@@ -933,9 +1389,9 @@ func (m *Mount) RemoveProtector(descriptor string) error {
 	}
 	// We first try to remove the linkedProtector. If that metadata does not
 	// exist, we try to remove the normal protector.
-	err := m.removeMetadata(m.linkedProtectorPath(descriptor))
+	err := m.removeMetadata(linkRecord, descriptor)
 	if os.IsNotExist(err) {
-		err = m.removeMetadata(m.protectorPath(descriptor))
+		err = m.removeMetadata(protectorRecord, descriptor)
 		if os.IsNotExist(err) {
 			err = &ErrProtectorNotFound{descriptor, m}
 		}
@@ -947,7 +1403,7 @@ func (m *Mount) RemoveProtector(descriptor string) error {
 // This does not include linked protectors.  If trustedUser is non-nil, then
 // the protectors are restricted to those owned by the given user or by root.
 func (m *Mount) ListProtectors(trustedUser *user.User) ([]string, error) {
-	return m.listMetadata(m.ProtectorDir(), "protectors", trustedUser)
+	return m.listMetadata(protectorRecord, trustedUser)
 }
 
 // AddPolicy adds the policy metadata to the filesystem storage.
@@ -956,7 +1412,7 @@ func (m *Mount) AddPolicy(data *metadata.PolicyData, owner *user.User) error {
 		return err
 	}
 
-	return m.addMetadata(m.PolicyPath(data.KeyDescriptor), data, owner)
+	return m.addMetadata(policyRecord, data.KeyDescriptor, data, owner)
 }
 
 // GetPolicy looks up the policy metadata by descriptor.
@@ -965,7 +1421,7 @@ func (m *Mount) GetPolicy(descriptor string, trustedUser *user.User) (*metadata.
 		return nil, err
 	}
 	data := new(metadata.PolicyData)
-	_, err := m.getMetadata(m.PolicyPath(descriptor), trustedUser, data)
+	_, err := m.getMetadata(policyRecord, descriptor, trustedUser, data)
 	if os.IsNotExist(err) {
 		err = &ErrPolicyNotFound{descriptor, m}
 	}
@@ -977,9 +1433,13 @@ func (m *Mount) RemovePolicy(descriptor string) error {
 	if err := m.CheckSetup(nil); err != nil {
 		return err
 	}
-	err := m.removeMetadata(m.PolicyPath(descriptor))
+	err := m.removeMetadata(policyRecord, descriptor)
 	if os.IsNotExist(err) {
-		err = &ErrPolicyNotFound{descriptor, m}
+		return &ErrPolicyNotFound{descriptor, m}
+	}
+	if err == nil {
+		m.removePolicyLabelIfAny(descriptor)
+		m.removePolicyDirectoriesIfAny(descriptor)
 	}
 	return err
 }
@@ -988,7 +1448,48 @@ func (m *Mount) RemovePolicy(descriptor string) error {
 // trustedUser is non-nil, then the policies are restricted to those owned by
 // the given user or by root.
 func (m *Mount) ListPolicies(trustedUser *user.User) ([]string, error) {
-	return m.listMetadata(m.PolicyDir(), "policies", trustedUser)
+	return m.listMetadata(policyRecord, trustedUser)
+}
+
+// NameKeyPath returns the path to the filesystem-wide key which is used to
+// encrypt protector names, if that feature is enabled.
+func (m *Mount) NameKeyPath() string {
+	return filepath.Join(m.BaseDir(), nameKeyFileName)
+}
+
+// AddNameKey stores the key used to encrypt protector names on this
+// filesystem. The key file is only readable by its owner, so only that user
+// (and root) will be able to see the encrypted names.
+func (m *Mount) AddNameKey(key *crypto.Key, owner *user.User) error {
+	if err := m.CheckSetup(nil); err != nil {
+		return err
+	}
+	if err := util.CheckValidLength(metadata.InternalKeyLen, key.Len()); err != nil {
+		return errors.Wrap(err, "protector name key")
+	}
+	util.Debugf("writing protector name key to %q", m.NameKeyPath())
+	return m.writeData(m.NameKeyPath(), key.Data(), owner, filePermissions)
+}
+
+// GetNameKey reads the key used to encrypt protector names on this filesystem.
+// If the key hasn't been created, the returned error satisfies os.IsNotExist.
+func (m *Mount) GetNameKey(trustedUser *user.User) (*crypto.Key, error) {
+	if err := m.CheckSetup(trustedUser); err != nil {
+		return nil, err
+	}
+	data, _, err := readMetadataFileSafe(m.NameKeyPath(), trustedUser)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for i := range data {
+			data[i] = 0
+		}
+	}()
+	if err = util.CheckValidLength(metadata.InternalKeyLen, len(data)); err != nil {
+		return nil, &ErrCorruptMetadata{m.NameKeyPath(), err}
+	}
+	return crypto.NewFixedLengthKeyFromReader(bytes.NewReader(data), len(data))
 }
 
 type namesAndTimes struct {
@@ -1050,11 +1551,32 @@ func (m *Mount) listDirectory(directoryPath string) ([]string, error) {
 	return descriptors, nil
 }
 
-func (m *Mount) listMetadata(dirPath string, metadataType string, owner *user.User) ([]string, error) {
-	log.Printf("listing %s in %q", metadataType, dirPath)
+// listMetadata lists the descriptors of the records of the given kind. Listing
+// the protectors includes the linked protectors.
+func (m *Mount) listMetadata(kind recordKind, owner *user.User) ([]string, error) {
+	metadataType := kind.String()
 	if err := m.CheckSetup(owner); err != nil {
 		return nil, err
 	}
+	if m.usesPackedStore() {
+		util.Debugf("listing %s in %q", metadataType, m.packedPath())
+		kinds := []recordKind{kind}
+		if kind == protectorRecord {
+			kinds = append(kinds, linkRecord)
+		}
+		names, err := m.listPackedRecords(owner, kinds...)
+		if err != nil {
+			return nil, err
+		}
+		util.Debugf("found %d %s", len(names), metadataType)
+		return names, nil
+	}
+
+	dirPath := m.ProtectorDir()
+	if kind == policyRecord {
+		dirPath = m.PolicyDir()
+	}
+	util.Debugf("listing %s in %q", metadataType, dirPath)
 	names, err := m.listDirectory(dirPath)
 	if err != nil {
 		return nil, err
@@ -1082,6 +1604,6 @@ func (m *Mount) listMetadata(dirPath string, metadataType string, owner *user.Us
 		}
 		names = filteredNames
 	}
-	log.Printf("found %d %s%s", len(names), metadataType, filesIgnoredDescription)
+	util.Debugf("found %d %s%s", len(names), metadataType, filesIgnoredDescription)
 	return names, nil
 }
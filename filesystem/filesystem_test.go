@@ -39,6 +39,8 @@ var (
 	fakePolicyKey, _       = crypto.NewRandomKey(metadata.PolicyKeyLen)
 	wrappedProtectorKey, _ = crypto.Wrap(fakeProtectorKey, fakeProtectorKey)
 	wrappedPolicyKey, _    = crypto.Wrap(fakeProtectorKey, fakePolicyKey)
+	// The filesystem only checks that the metadata HMAC is there.
+	fakeMetadataHMAC = make([]byte, metadata.HMACLen)
 )
 
 // Gets the mount corresponding to the integration test path.
@@ -56,6 +58,7 @@ func getFakeProtector() *metadata.ProtectorData {
 		Name:                "goodProtector",
 		Source:              metadata.SourceType_raw_key,
 		WrappedKey:          wrappedProtectorKey,
+		MetadataHmac:        fakeMetadataHMAC,
 	}
 }
 
@@ -82,6 +85,7 @@ func getFakePolicy() *metadata.PolicyData {
 				WrappedKey:          wrappedPolicyKey,
 			},
 		},
+		MetadataHmac: fakeMetadataHMAC,
 	}
 }
 
@@ -192,6 +196,49 @@ func TestSetupWithRelativeSymlink(t *testing.T) {
 	testSetupWithSymlink(t, mnt, ".fscrypt-real", realDir)
 }
 
+// Tests that the metadata can be kept in a directory set with SetMetadataDir,
+// e.g. on another filesystem.
+func TestSetupWithMetadataDir(t *testing.T) {
+	mnt, err := getTestMount(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tempDir, err := os.MkdirTemp("", "fscrypt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	metadataDir := filepath.Join(tempDir, "metadata")
+
+	if err = SetMetadataDir(mnt.Path, "relative"); err == nil {
+		t.Error("relative metadata directory should be rejected")
+	}
+	if err = SetMetadataDir(mnt.Path, metadataDir); err != nil {
+		t.Fatal(err)
+	}
+	defer SetMetadataDir(mnt.Path, "")
+	if mnt.BaseDir() != metadataDir {
+		t.Fatalf("base dir is %q, expected %q", mnt.BaseDir(), metadataDir)
+	}
+	if err = mnt.Setup(WorldWritable); err != nil {
+		t.Fatal(err)
+	}
+	if err = mnt.AddProtector(getFakeProtector(), nil); err != nil {
+		t.Fatal(err)
+	}
+	if !isRegularFile(filepath.Join(metadataDir, "protectors", getFakeProtector().ProtectorDescriptor)) {
+		t.Error("protector wasn't stored in the metadata directory")
+	}
+	if _, err = os.Lstat(filepath.Join(mnt.Path, baseDirName)); !os.IsNotExist(err) {
+		t.Errorf("%s was created in the filesystem itself", baseDirName)
+	}
+
+	SetMetadataDir(mnt.Path, "")
+	if mnt.CheckSetup(nil) == nil {
+		t.Error("filesystem should no longer be set up without its metadata directory")
+	}
+}
+
 func testSetupMode(t *testing.T, mnt *Mount, setupMode SetupMode, expectedPerms os.FileMode) {
 	mnt.RemoveAllMetadata()
 	if err := mnt.Setup(setupMode); err != nil {
@@ -517,6 +564,53 @@ func TestLinkedProtector(t *testing.T) {
 	}
 }
 
+// Tests that a broken protector link can be repaired.
+func TestRelinkProtector(t *testing.T) {
+	realMnt, fakeMnt, err := getTwoSetupMounts(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanupTwoMounts(realMnt, fakeMnt)
+
+	protector := getFakeProtector()
+	if err = realMnt.AddProtector(protector, nil); err != nil {
+		t.Fatal(err)
+	}
+	descriptor := protector.ProtectorDescriptor
+
+	// A link to a filesystem that doesn't exist
+	linkPath := fakeMnt.linkedProtectorPath(descriptor)
+	if err = os.WriteFile(linkPath, []byte("PATH=/nonexistent\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = fakeMnt.GetProtector(descriptor, nil); err == nil {
+		t.Fatal("following broken link should fail")
+	}
+	linked, err := fakeMnt.ListLinkedProtectors()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(linked) != 1 || linked[0] != descriptor {
+		t.Errorf("linked protectors were %v, expected [%s]", linked, descriptor)
+	}
+
+	if err = fakeMnt.RelinkProtector(descriptor, realMnt, nil); err != nil {
+		t.Fatal(err)
+	}
+	retMnt, _, err := fakeMnt.GetProtector(descriptor, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if retMnt != realMnt {
+		t.Error("mount returned was incorrect")
+	}
+
+	// Regular protectors can't be replaced with links.
+	if err = realMnt.RelinkProtector(descriptor, realMnt, nil); err == nil {
+		t.Error("relinking a regular protector should fail")
+	}
+}
+
 func createFile(path string, size int64) error {
 	if err := os.WriteFile(path, []byte{}, 0600); err != nil {
 		return err
@@ -608,3 +702,40 @@ func TestReadMetadataFileSafe(t *testing.T) {
 		t.Fatal("trying to read very large file didn't fail with expected error")
 	}
 }
+
+// Tests that the mountpoint and the metadata directories are reserved, but that
+// other directories on the filesystem are not.
+func TestCheckNotReserved(t *testing.T) {
+	mnt, err := getSetupMount(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mnt.RemoveAllMetadata()
+
+	for _, path := range []string{mnt.Path, mnt.BaseDir(), mnt.PolicyDir(),
+		mnt.ProtectorDir(), filepath.Join(mnt.PolicyDir(), "..", ".")} {
+		err := mnt.CheckNotReserved(path)
+		if _, ok := err.(*ErrReservedDirectory); !ok {
+			t.Errorf("expected %q to be reserved, got error %v", path, err)
+		}
+	}
+
+	dir := filepath.Join(mnt.Path, "not-reserved")
+	if err = os.Mkdir(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(dir)
+	if err = mnt.CheckNotReserved(dir); err != nil {
+		t.Error(err)
+	}
+
+	// A symlink to the metadata directory is still reserved.
+	link := filepath.Join(dir, "link")
+	if err = os.Symlink(mnt.PolicyDir(), link); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(link)
+	if _, ok := mnt.CheckNotReserved(link).(*ErrReservedDirectory); !ok {
+		t.Errorf("expected symlink %q to be reserved", link)
+	}
+}
@@ -0,0 +1,474 @@
+/*
+ * journal.go - Write-ahead journal of the metadata changed by an operation, so
+ * that an operation which was interrupted by a crash can be rolled back.
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package filesystem
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+
+	"github.com/google/fscrypt/metadata"
+	"github.com/google/fscrypt/util"
+)
+
+// Each record is replaced atomically (see writeData), but an operation such as
+// encrypting a directory writes several records. While a Transaction is in
+// progress, the old contents of each record are appended to a journal file
+// before the record is first changed. If the process dies before committing,
+// the next process to lock the metadata rolls the changes back, unless the
+// operation got as far as applying its policy to a directory, in which case the
+// changes are kept (rolled forward).
+//
+// A journal file starts with journalMagic. Each entry is the entry type, the
+// length of the payload, the payload, and the CRC-32 of all of these. The
+// payload of a record entry is the record kind, the descriptor length, the
+// descriptor, whether the record existed, the UID of its owner, and its old
+// contents. The payload of an apply entry is the descriptor length, the policy
+// descriptor, and the path of the directory.
+const (
+	journalDirName = "journal"
+	journalPrefix  = "txn"
+	journalMagic   = "FSCJRNL1"
+
+	recordEntry = 'R'
+	applyEntry  = 'A'
+
+	// Maximum size of a journal file, to stop denial-of-service attempts.
+	maxJournalFileSize = maxPackedFileSize
+)
+
+// journalKey identifies a record in a journal.
+type journalKey struct {
+	kind       recordKind
+	descriptor string
+}
+
+// journalEntry is a single entry read from a journal file.
+type journalEntry struct {
+	entryType byte
+	journalKey
+	existed bool
+	owner   int64
+	data    []byte
+	path    string
+}
+
+// Transaction is an operation in progress which changes several metadata
+// records on a filesystem. The typical usage is:
+//
+//	txn, err := mnt.BeginTransaction()
+//	... change metadata, calling txn.Applying() before applying a policy ...
+//	err = txn.Commit() // or txn.Abort() if the operation failed
+//
+// Only a single transaction per filesystem can be in progress in a process.
+type Transaction struct {
+	mount     *Mount
+	file      *os.File
+	journaled map[journalKey]bool
+}
+
+// ErrTransactionInProgress indicates that a transaction was begun on a
+// filesystem which already has one in progress.
+type ErrTransactionInProgress struct {
+	Mount *Mount
+}
+
+func (err *ErrTransactionInProgress) Error() string {
+	return "a metadata transaction is already in progress on " + err.Mount.Path
+}
+
+// JournalDir returns the directory containing the journals of the transactions
+// in progress.
+func (m *Mount) JournalDir() string {
+	return filepath.Join(m.BaseDir(), journalDirName)
+}
+
+// BeginTransaction starts journaling the changes to the metadata on this
+// filesystem made by this process. If the journal can't be created because the
+// user isn't allowed to, the changes are made without journaling them (though
+// usually the user can't change the metadata then either). If the metadata is on
+// a read-only filesystem, ErrReadOnlyFilesystem is returned.
+func (m *Mount) BeginTransaction() (*Transaction, error) {
+	if m.transaction != nil {
+		return nil, &ErrTransactionInProgress{m}
+	}
+	if m.isMetadataReadOnly() {
+		return nil, &ErrReadOnlyFilesystem{m}
+	}
+	txn := &Transaction{mount: m, journaled: make(map[journalKey]bool)}
+	err := m.makeOptionalDir(m.JournalDir())
+	if err == nil {
+		if err = checkOptionalDir(m.JournalDir()); err != nil {
+			return nil, err
+		}
+		txn.file, err = os.CreateTemp(m.JournalDir(), journalPrefix)
+	}
+	if _, ok := err.(*ErrNoCreatePermission); ok || os.IsPermission(err) {
+		util.Debugf("cannot create a journal in %q, so changes to the metadata on %s aren't journaled",
+			m.JournalDir(), m.Path)
+		m.transaction = txn
+		return txn, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	// The lock shows other processes that the transaction isn't abandoned.
+	err = unix.Flock(int(txn.file.Fd()), unix.LOCK_EX)
+	if err != nil {
+		err = &os.PathError{Op: "locking", Path: txn.file.Name(), Err: err}
+	} else if err = txn.append([]byte(journalMagic)); err == nil {
+		err = syncDirectory(m.JournalDir())
+	}
+	if err != nil {
+		txn.file.Close()
+		os.Remove(txn.file.Name())
+		return nil, err
+	}
+	util.Debugf("began metadata transaction %q", txn.file.Name())
+	m.transaction = txn
+	return txn, nil
+}
+
+// append writes data to the end of the journal and syncs it, so that it is on
+// stable storage before the metadata it describes is changed.
+func (txn *Transaction) append(data []byte) error {
+	if _, err := txn.file.Write(data); err != nil {
+		return err
+	}
+	return txn.file.Sync()
+}
+
+// appendEntry writes an entry with the given type and payload to the journal.
+func (txn *Transaction) appendEntry(entryType byte, payload []byte) error {
+	var entry bytes.Buffer
+	entry.WriteByte(entryType)
+	binary.Write(&entry, binary.BigEndian, uint32(len(payload)))
+	entry.Write(payload)
+	binary.Write(&entry, binary.BigEndian, crc32.ChecksumIEEE(entry.Bytes()))
+	return txn.append(entry.Bytes())
+}
+
+// journalRecord saves the current contents of a record to the journal of the
+// transaction in progress (if any) before the record is first changed by it.
+func (m *Mount) journalRecord(kind recordKind, descriptor string) error {
+	txn := m.transaction
+	key := journalKey{kind, descriptor}
+	if txn == nil || txn.file == nil || txn.journaled[key] {
+		return nil
+	}
+	data, owner, err := m.readRecord(kind, descriptor, nil)
+	existed := err == nil
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	var payload bytes.Buffer
+	payload.WriteByte(byte(kind))
+	payload.WriteByte(byte(len(descriptor)))
+	payload.WriteString(descriptor)
+	if existed {
+		payload.WriteByte(1)
+	} else {
+		payload.WriteByte(0)
+	}
+	binary.Write(&payload, binary.BigEndian, owner)
+	payload.Write(data)
+	if err = txn.appendEntry(recordEntry, payload.Bytes()); err != nil {
+		return errors.Wrapf(err, "journaling %s", m.recordName(kind, descriptor))
+	}
+	txn.journaled[key] = true
+	return nil
+}
+
+// Applying records that the policy with the given descriptor is about to be
+// applied to the directory at path. If the process dies after that, the
+// transaction is rolled forward if the directory uses the policy.
+func (txn *Transaction) Applying(path, descriptor string) error {
+	if txn.file == nil {
+		return nil
+	}
+	var payload bytes.Buffer
+	payload.WriteByte(byte(len(descriptor)))
+	payload.WriteString(descriptor)
+	payload.WriteString(path)
+	return txn.appendEntry(applyEntry, payload.Bytes())
+}
+
+// close ends the transaction, and releases the journal without removing it.
+func (txn *Transaction) close() {
+	if txn.mount.transaction == txn {
+		txn.mount.transaction = nil
+	}
+	if txn.file != nil {
+		txn.file.Close()
+	}
+}
+
+// Commit ends the transaction, keeping all of its changes. This does nothing if
+// the transaction has ended already.
+func (txn *Transaction) Commit() error {
+	if txn.mount.transaction != txn {
+		return nil
+	}
+	defer txn.close()
+	if txn.file != nil {
+		util.Debugf("committing metadata transaction %q", txn.file.Name())
+		if err := removeJournal(txn.file.Name()); err != nil {
+			return err
+		}
+	}
+	txn.mount.raiseSchemaFloor()
+	return nil
+}
+
+// Abort ends the transaction, restoring the records it changed to their old
+// contents. If that fails, the journal is kept so that it's tried again later.
+// This does nothing if the transaction has ended already.
+func (txn *Transaction) Abort() error {
+	if txn.mount.transaction != txn {
+		return nil
+	}
+	defer txn.close()
+	if txn.file == nil {
+		return nil
+	}
+	util.Debugf("aborting metadata transaction %q", txn.file.Name())
+	// Reread the journal, as this also covers the entries which were
+	// written before an error.
+	entries, err := readJournal(txn.file)
+	if err != nil {
+		return err
+	}
+	txn.mount.transaction = nil
+	if err = txn.mount.undoJournal(entries); err != nil {
+		return err
+	}
+	return removeJournal(txn.file.Name())
+}
+
+// removeJournal removes a journal, making its transaction complete.
+func removeJournal(path string) error {
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	return syncDirectory(filepath.Dir(path))
+}
+
+// readJournal parses the journal file. An incomplete or corrupt entry ends the
+// journal, as the metadata is only changed once its entry has been synced.
+func readJournal(file *os.File) ([]*journalEntry, error) {
+	contents, err := io.ReadAll(io.NewSectionReader(file, 0, maxJournalFileSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(contents) > maxJournalFileSize {
+		return nil, &ErrCorruptMetadata{file.Name(), errors.New("journal size limit exceeded")}
+	}
+	if !bytes.HasPrefix(contents, []byte(journalMagic)) {
+		return nil, &ErrCorruptMetadata{file.Name(), errors.New("not a journal file")}
+	}
+	contents = contents[len(journalMagic):]
+
+	var entries []*journalEntry
+	for len(contents) >= 1+4+4 {
+		length := binary.BigEndian.Uint32(contents[1:5])
+		if uint64(len(contents)) < 1+4+uint64(length)+4 {
+			break
+		}
+		end := 1 + 4 + int(length)
+		if crc32.ChecksumIEEE(contents[:end]) != binary.BigEndian.Uint32(contents[end:end+4]) {
+			break
+		}
+		entry, err := parseJournalEntry(contents[0], contents[5:end])
+		if err != nil {
+			return nil, &ErrCorruptMetadata{file.Name(), err}
+		}
+		entries = append(entries, entry)
+		contents = contents[end+4:]
+	}
+	if len(contents) != 0 {
+		util.Debugf("ignoring incomplete entry at the end of %q", file.Name())
+	}
+	return entries, nil
+}
+
+// parseJournalDescriptor splits the descriptor off the start of an entry's
+// payload. As it's used to name files, it must be in hex.
+func parseJournalDescriptor(payload []byte) (string, []byte, error) {
+	if len(payload) < 1 || len(payload) < 1+int(payload[0]) {
+		return "", nil, errors.New("truncated journal entry")
+	}
+	descriptor := string(payload[1 : 1+payload[0]])
+	if _, err := hex.DecodeString(descriptor); err != nil || descriptor == "" {
+		return "", nil, errors.Errorf("descriptor %q is not in hex", descriptor)
+	}
+	return descriptor, payload[1+payload[0]:], nil
+}
+
+// parseJournalEntry decodes the payload of a journal entry.
+func parseJournalEntry(entryType byte, payload []byte) (*journalEntry, error) {
+	entry := &journalEntry{entryType: entryType}
+	var err error
+	switch entryType {
+	case recordEntry:
+		if len(payload) < 1 {
+			return nil, errors.New("truncated journal entry")
+		}
+		entry.kind = recordKind(payload[0])
+		if entry.kind < policyRecord || entry.kind > policyDirsRecord {
+			return nil, errors.Errorf("unknown record kind %d", payload[0])
+		}
+		if entry.descriptor, payload, err = parseJournalDescriptor(payload[1:]); err != nil {
+			return nil, err
+		}
+		if len(payload) < 1+8 {
+			return nil, errors.New("truncated journal entry")
+		}
+		entry.existed = payload[0] != 0
+		entry.owner = int64(binary.BigEndian.Uint64(payload[1:9]))
+		entry.data = payload[9:]
+	case applyEntry:
+		if entry.descriptor, payload, err = parseJournalDescriptor(payload); err != nil {
+			return nil, err
+		}
+		entry.path = string(payload)
+	default:
+		return nil, errors.Errorf("unknown journal entry type %q", entryType)
+	}
+	return entry, nil
+}
+
+// undoJournal restores the records in the journal entries to their old
+// contents, in the reverse order of the changes.
+func (m *Mount) undoJournal(entries []*journalEntry) error {
+	for i := len(entries) - 1; i >= 0; i-- {
+		entry := entries[i]
+		if entry.entryType != recordEntry {
+			continue
+		}
+		name := m.recordName(entry.kind, entry.descriptor)
+		if !entry.existed {
+			err := m.removeMetadata(entry.kind, entry.descriptor)
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			continue
+		}
+		owner, err := util.UserFromUID(entry.owner)
+		if err != nil || !util.IsUserRoot() {
+			owner = nil
+		}
+		util.Infof("restoring the old contents of %q", name)
+		if err = m.writeRecord(entry.kind, entry.descriptor, entry.data, owner); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isRolledForward returns true if a journal entry shows that the policy was
+// applied to a directory, so the transaction must be kept.
+func isRolledForward(entries []*journalEntry) bool {
+	for _, entry := range entries {
+		if entry.entryType != applyEntry {
+			continue
+		}
+		data, err := metadata.GetPolicy(entry.path)
+		if err == nil && data.KeyDescriptor == entry.descriptor {
+			return true
+		}
+	}
+	return false
+}
+
+// recoverJournal completes the abandoned transaction with the journal at path,
+// by rolling it forward or back. Journals in use by a transaction which is in
+// progress (in any process) are left alone.
+func (m *Mount) recoverJournal(path string) error {
+	file, err := os.OpenFile(path, os.O_RDONLY|unix.O_NOFOLLOW|unix.O_NONBLOCK, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	// Only recover our own transactions, as otherwise a journal could be
+	// used to make another user (e.g. root) change metadata on its behalf.
+	if !info.Mode().IsRegular() || info.Sys().(*syscall.Stat_t).Uid != uint32(os.Geteuid()) {
+		util.Debugf("not recovering %q, which isn't our own journal", path)
+		return nil
+	}
+	if err = unix.Flock(int(file.Fd()), unix.LOCK_EX|unix.LOCK_NB); err != nil {
+		if err == unix.EWOULDBLOCK {
+			return nil
+		}
+		return &os.PathError{Op: "locking", Path: path, Err: err}
+	}
+
+	entries, err := readJournal(file)
+	if err != nil {
+		return err
+	}
+	if isRolledForward(entries) {
+		util.Infof("rolling forward interrupted metadata transaction %q", path)
+	} else {
+		util.Infof("rolling back interrupted metadata transaction %q", path)
+		if err = m.undoJournal(entries); err != nil {
+			return err
+		}
+	}
+	return removeJournal(path)
+}
+
+// recoverTransactions completes the transactions on this filesystem which were
+// abandoned by processes that died. It's called with the metadata locked.
+func (m *Mount) recoverTransactions() {
+	names, err := os.ReadDir(m.JournalDir())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			util.Debug(err)
+		}
+		return
+	}
+	// Journaling must not be applied to the recovery itself.
+	txn := m.transaction
+	m.transaction = nil
+	defer func() { m.transaction = txn }()
+	for _, name := range names {
+		if !strings.HasPrefix(name.Name(), journalPrefix) {
+			continue
+		}
+		path := filepath.Join(m.JournalDir(), name.Name())
+		if err = m.recoverJournal(path); err != nil {
+			util.Warnf("cannot recover interrupted metadata transaction %q: %v", path, err)
+		}
+	}
+}
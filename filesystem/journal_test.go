@@ -0,0 +1,185 @@
+/*
+ * journal_test.go - Tests for journaling changes to the fscrypt metadata.
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package filesystem
+
+import (
+	"os"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/google/fscrypt/metadata"
+)
+
+// abandonTransaction simulates the process dying during the transaction: the
+// journal is left behind and its lock is released.
+func abandonTransaction(txn *Transaction) {
+	txn.close()
+}
+
+// countJournals returns the number of journal files on the filesystem.
+func countJournals(t *testing.T, mnt *Mount) int {
+	entries, err := os.ReadDir(mnt.JournalDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(entries)
+}
+
+// lockAndUnlock takes the metadata lock, which recovers abandoned transactions.
+func lockAndUnlock(t *testing.T, mnt *Mount) {
+	lock, err := mnt.LockMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lock.Unlock()
+}
+
+// Tests that aborting a transaction restores the records it changed and removes
+// those it created.
+func TestTransactionAbort(t *testing.T) {
+	mnt, err := getSetupMount(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mnt.RemoveAllMetadata()
+
+	policy := getFakePolicy()
+	if err = mnt.AddPolicy(policy, nil); err != nil {
+		t.Fatal(err)
+	}
+	txn, err := mnt.BeginTransaction()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = mnt.BeginTransaction(); err == nil {
+		t.Error("a second transaction shouldn't be allowed")
+	}
+	if err = mnt.AddProtector(getFakeProtector(), nil); err != nil {
+		t.Fatal(err)
+	}
+	changed := proto.Clone(policy).(*metadata.PolicyData)
+	changed.WrappedPolicyKeys = append(changed.WrappedPolicyKeys, &metadata.WrappedPolicyKey{
+		ProtectorDescriptor: "0000000000000000",
+		WrappedKey:          wrappedPolicyKey,
+	})
+	if err = mnt.AddPolicy(changed, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err = mnt.SetPolicyLabel(policy.KeyDescriptor, "label", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err = txn.Abort(); err != nil {
+		t.Fatal(err)
+	}
+
+	if mnt.hasRecord(protectorRecord, getFakeProtector().ProtectorDescriptor) {
+		t.Error("protector created by the transaction wasn't removed")
+	}
+	restored, err := mnt.GetPolicy(policy.KeyDescriptor, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !proto.Equal(restored, policy) {
+		t.Errorf("policy wasn't restored: got %v, expected %v", restored, policy)
+	}
+	if label, _ := mnt.GetPolicyLabel(policy.KeyDescriptor, nil); label != "" {
+		t.Errorf("label %q created by the transaction wasn't removed", label)
+	}
+	if n := countJournals(t, mnt); n != 0 {
+		t.Errorf("%d journals left after aborting", n)
+	}
+}
+
+// Tests that committing a transaction keeps its changes and removes the journal.
+func TestTransactionCommit(t *testing.T) {
+	mnt, err := getSetupMount(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mnt.RemoveAllMetadata()
+
+	txn, err := mnt.BeginTransaction()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = mnt.AddProtector(getFakeProtector(), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err = txn.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	// Aborting after committing does nothing.
+	if err = txn.Abort(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = mnt.GetRegularProtector(getFakeProtector().ProtectorDescriptor, nil); err != nil {
+		t.Error(err)
+	}
+	if n := countJournals(t, mnt); n != 0 {
+		t.Errorf("%d journals left after committing", n)
+	}
+}
+
+// Tests that a transaction abandoned by a process which died is rolled back the
+// next time the metadata is locked, while one in progress is left alone.
+func TestRecoverAbandonedTransaction(t *testing.T) {
+	mnt, err := getSetupMount(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mnt.RemoveAllMetadata()
+
+	txn, err := mnt.BeginTransaction()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = mnt.AddProtector(getFakeProtector(), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err = mnt.AddPolicy(getFakePolicy(), nil); err != nil {
+		t.Fatal(err)
+	}
+	// The policy wasn't applied, so this doesn't roll the transaction
+	// forward.
+	if err = txn.Applying(mnt.Path, getFakePolicy().KeyDescriptor); err != nil {
+		t.Fatal(err)
+	}
+
+	lockAndUnlock(t, mnt)
+	if !mnt.hasRecord(protectorRecord, getFakeProtector().ProtectorDescriptor) {
+		t.Fatal("transaction in progress was rolled back")
+	}
+
+	// A torn entry at the end of the journal is ignored.
+	if _, err = txn.file.Write([]byte{recordEntry, 0, 0}); err != nil {
+		t.Fatal(err)
+	}
+	abandonTransaction(txn)
+	lockAndUnlock(t, mnt)
+	if mnt.hasRecord(protectorRecord, getFakeProtector().ProtectorDescriptor) {
+		t.Error("protector created by the abandoned transaction wasn't removed")
+	}
+	if mnt.hasRecord(policyRecord, getFakePolicy().KeyDescriptor) {
+		t.Error("policy created by the abandoned transaction wasn't removed")
+	}
+	if n := countJournals(t, mnt); n != 0 {
+		t.Errorf("%d journals left after recovery", n)
+	}
+}
@@ -0,0 +1,147 @@
+/*
+ * label.go - Human-readable labels for policies, which are shown alongside the
+ * policy descriptors but are never used to unlock anything.
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package filesystem
+
+import (
+	"os"
+	"os/user"
+	"path/filepath"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+
+	"github.com/google/fscrypt/util"
+)
+
+// The labels are kept in their own directory rather than next to the policies,
+// so that older versions of fscrypt don't mistake them for policies.
+const labelDirName = "labels"
+
+// MaxPolicyLabelLength is the maximum length of a policy label in bytes.
+const MaxPolicyLabelLength = 128
+
+// LabelDir returns the directory containing the policy labels.
+func (m *Mount) LabelDir() string {
+	return filepath.Join(m.BaseDir(), labelDirName)
+}
+
+// labelPath returns the full path to the label of the policy with the
+// specified descriptor.
+func (m *Mount) labelPath(descriptor string) string {
+	return filepath.Join(m.LabelDir(), descriptor)
+}
+
+// checkPolicyLabel returns an error if label is not valid UTF-8, is too long,
+// or contains control characters (which could garble the status output).
+func checkPolicyLabel(label string) error {
+	if len(label) > MaxPolicyLabelLength {
+		return errors.Errorf("policy label is longer than %d bytes", MaxPolicyLabelLength)
+	}
+	if !utf8.ValidString(label) {
+		return errors.New("policy label is not valid UTF-8")
+	}
+	for _, r := range label {
+		if unicode.IsControl(r) {
+			return errors.New("policy label contains control characters")
+		}
+	}
+	return nil
+}
+
+// SetPolicyLabel records a human-readable label for the policy with the
+// specified descriptor, replacing any existing label. An empty label removes
+// the existing label, if any. The label is purely informational.
+func (m *Mount) SetPolicyLabel(descriptor string, label string, owner *user.User) error {
+	if err := m.CheckSetup(nil); err != nil {
+		return err
+	}
+	if !m.hasRecord(policyRecord, descriptor) {
+		return &ErrPolicyNotFound{descriptor, m}
+	}
+	if label == "" {
+		return m.removePolicyLabel(descriptor)
+	}
+	if err := checkPolicyLabel(label); err != nil {
+		return err
+	}
+	if !m.usesPackedStore() {
+		if err := m.makeOptionalDir(m.LabelDir()); err != nil {
+			return err
+		}
+		if err := checkOptionalDir(m.LabelDir()); err != nil {
+			return err
+		}
+	}
+	return m.writeRecord(labelRecord, descriptor, []byte(label), owner)
+}
+
+// GetPolicyLabel returns the label of the policy with the specified descriptor,
+// or the empty string if the policy has no label. If trustedUser is non-nil,
+// labels owned by other users (except root) are rejected.
+func (m *Mount) GetPolicyLabel(descriptor string, trustedUser *user.User) (string, error) {
+	if err := m.CheckSetup(trustedUser); err != nil {
+		return "", err
+	}
+	if !m.usesPackedStore() {
+		if err := checkOptionalDir(m.LabelDir()); err != nil {
+			if os.IsNotExist(err) {
+				return "", nil
+			}
+			return "", err
+		}
+	}
+	path := m.recordName(labelRecord, descriptor)
+	data, _, err := m.readRecord(labelRecord, descriptor, trustedUser)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	label := string(data)
+	if err = checkPolicyLabel(label); err != nil {
+		return "", &ErrCorruptMetadata{path, err}
+	}
+	return label, nil
+}
+
+// removePolicyLabel deletes the label of the policy with the specified
+// descriptor. It isn't an error if the policy has no label.
+func (m *Mount) removePolicyLabel(descriptor string) error {
+	if !m.usesPackedStore() {
+		if _, err := os.Lstat(m.labelPath(descriptor)); os.IsNotExist(err) {
+			return nil
+		}
+	}
+	err := m.removeMetadata(labelRecord, descriptor)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// removePolicyLabelIfAny is called when a policy is removed. Failing to remove
+// a label only leaves behind an unused file, so it's just logged.
+func (m *Mount) removePolicyLabelIfAny(descriptor string) {
+	if err := m.removePolicyLabel(descriptor); err != nil {
+		util.Warnf("could not remove the label of policy %s: %v", descriptor, err)
+	}
+}
@@ -0,0 +1,152 @@
+/*
+ * label_test.go - Tests for the human-readable labels of policies.
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package filesystem
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+// Tests that a label can be set, replaced, read back, and removed, and that it
+// is removed along with its policy.
+func testPolicyLabel(t *testing.T, mnt *Mount) {
+	policy := getFakePolicy()
+	descriptor := policy.KeyDescriptor
+	if err := mnt.SetPolicyLabel(descriptor, "home backups", nil); err == nil {
+		t.Error("labeling a nonexistent policy should fail")
+	}
+	if err := mnt.AddPolicy(policy, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if label, err := mnt.GetPolicyLabel(descriptor, nil); err != nil || label != "" {
+		t.Errorf("unlabeled policy has label %q (err: %v)", label, err)
+	}
+	for _, expected := range []string{"home backups", "photos"} {
+		if err := mnt.SetPolicyLabel(descriptor, expected, nil); err != nil {
+			t.Fatal(err)
+		}
+		if label, err := mnt.GetPolicyLabel(descriptor, nil); err != nil || label != expected {
+			t.Errorf("label is %q (err: %v), expected %q", label, err, expected)
+		}
+	}
+	// Labels must not show up as policies.
+	if policies, err := mnt.ListPolicies(nil); err != nil || len(policies) != 1 {
+		t.Errorf("listed policies %v (err: %v), expected just %s", policies, err, descriptor)
+	}
+
+	if err := mnt.SetPolicyLabel(descriptor, "", nil); err != nil {
+		t.Fatal(err)
+	}
+	if label, err := mnt.GetPolicyLabel(descriptor, nil); err != nil || label != "" {
+		t.Errorf("removed label is still %q (err: %v)", label, err)
+	}
+	if err := mnt.SetPolicyLabel(descriptor, "", nil); err != nil {
+		t.Errorf("removing a missing label should succeed: %v", err)
+	}
+
+	if err := mnt.SetPolicyLabel(descriptor, "home backups", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := mnt.RemovePolicy(descriptor); err != nil {
+		t.Fatal(err)
+	}
+	if err := mnt.AddPolicy(policy, nil); err != nil {
+		t.Fatal(err)
+	}
+	if label, err := mnt.GetPolicyLabel(descriptor, nil); err != nil || label != "" {
+		t.Errorf("label %q (err: %v) was kept after its policy was removed", label, err)
+	}
+}
+
+func TestPolicyLabel(t *testing.T) {
+	mnt, err := getSetupMount(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mnt.RemoveAllMetadata()
+	testPolicyLabel(t, mnt)
+}
+
+func TestPackedPolicyLabel(t *testing.T) {
+	mnt, err := getPackedSetupMount(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mnt.RemoveAllMetadata()
+	testPolicyLabel(t, mnt)
+}
+
+// Tests that labels can be added to filesystems which were set up before the
+// labels directory existed.
+func TestPolicyLabelWithoutLabelDir(t *testing.T) {
+	mnt, err := getSetupMount(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mnt.RemoveAllMetadata()
+	if err = os.Remove(mnt.LabelDir()); err != nil {
+		t.Fatal(err)
+	}
+	policy := getFakePolicy()
+	if err = mnt.AddPolicy(policy, nil); err != nil {
+		t.Fatal(err)
+	}
+	if label, err := mnt.GetPolicyLabel(policy.KeyDescriptor, nil); err != nil || label != "" {
+		t.Errorf("label is %q (err: %v), expected none", label, err)
+	}
+	if err = mnt.SetPolicyLabel(policy.KeyDescriptor, "home backups", nil); err != nil {
+		t.Fatal(err)
+	}
+	policyInfo, err := os.Stat(mnt.PolicyDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	labelInfo, err := os.Stat(mnt.LabelDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if labelInfo.Mode() != policyInfo.Mode() {
+		t.Errorf("labels directory has mode %v, expected %v", labelInfo.Mode(), policyInfo.Mode())
+	}
+}
+
+func TestBadPolicyLabels(t *testing.T) {
+	mnt, err := getSetupMount(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mnt.RemoveAllMetadata()
+	policy := getFakePolicy()
+	if err = mnt.AddPolicy(policy, nil); err != nil {
+		t.Fatal(err)
+	}
+	badLabels := []string{
+		strings.Repeat("a", MaxPolicyLabelLength+1),
+		"two\nlines",
+		"escape\x1b[31m",
+		"\xff",
+	}
+	for _, label := range badLabels {
+		if err = mnt.SetPolicyLabel(policy.KeyDescriptor, label, nil); err == nil {
+			t.Errorf("label %q should be rejected", label)
+		}
+	}
+}
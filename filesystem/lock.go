@@ -0,0 +1,178 @@
+/*
+ * lock.go - Serializing changes to the fscrypt metadata of a filesystem
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package filesystem
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/google/fscrypt/util"
+)
+
+const (
+	lockFileName = "lock"
+	// The lock file is empty, and every user who can change the metadata
+	// must be able to open it. Anyone who can open it can also hold the
+	// lock forever, so it is only readable by others if they can change
+	// the metadata too.
+	lockFilePermissions       = 0600
+	sharedLockFilePermissions = 0644
+	// How often a contended lock is retried.
+	lockPollInterval = 10 * time.Millisecond
+)
+
+// MetadataLockTimeout is how long LockMetadata waits for another process to
+// release the lock before giving up.
+var MetadataLockTimeout = 10 * time.Second
+
+// ErrMetadataLocked indicates that the metadata lock of a filesystem couldn't
+// be acquired because another process held it for too long.
+type ErrMetadataLocked struct {
+	Mount   *Mount
+	Timeout time.Duration
+}
+
+func (err *ErrMetadataLocked) Error() string {
+	return fmt.Sprintf("timed out after %v waiting for another fscrypt process to finish changing the metadata on %s",
+		err.Timeout, err.Mount.Path)
+}
+
+// MetadataLock is a held lock on the fscrypt metadata of a filesystem.
+type MetadataLock struct {
+	file *os.File
+}
+
+// LockPath returns the path of the file which is locked while the metadata on
+// this filesystem is changed.
+func (m *Mount) LockPath() string {
+	return filepath.Join(m.BaseDir(), lockFileName)
+}
+
+// lockFileMode returns the permissions for a new lock file on this filesystem.
+// Only if the policies directory is writable by other users than its owner
+// (e.g. in WorldWritable mode) can they open the lock file.
+func (m *Mount) lockFileMode() (os.FileMode, error) {
+	info, err := os.Stat(m.PolicyDir())
+	if err != nil {
+		return 0, err
+	}
+	if info.Mode()&0022 != 0 {
+		return sharedLockFilePermissions, nil
+	}
+	return lockFilePermissions, nil
+}
+
+// createLockFile creates the lock file on this filesystem, regardless of the
+// umask.
+func (m *Mount) createLockFile() error {
+	mode, err := m.lockFileMode()
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(m.LockPath(), os.O_RDONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+	if err = file.Chmod(mode); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// openLockFile opens the lock file, creating it if the filesystem was set up by
+// an older version of fscrypt which didn't create one. If that isn't permitted,
+// nil is returned and the metadata isn't locked. If the lock file exists but
+// can't be opened, the user isn't allowed to change the metadata.
+func (m *Mount) openLockFile() (*os.File, error) {
+	path := m.LockPath()
+	file, err := os.OpenFile(path, os.O_RDONLY|unix.O_NOFOLLOW, 0)
+	if os.IsPermission(err) {
+		return nil, &ErrNoCreatePermission{m}
+	}
+	if os.IsNotExist(err) {
+		if err = m.createLockFile(); err == nil || os.IsExist(err) {
+			file, err = os.OpenFile(path, os.O_RDONLY|unix.O_NOFOLLOW, 0)
+		} else if os.IsPermission(err) {
+			util.Warnf("cannot create %q, so changes to the metadata on %s aren't serialized: %v",
+				path, m.Path, err)
+			return nil, nil
+		}
+	}
+	return file, err
+}
+
+// LockMetadata takes an exclusive advisory lock (flock) on the fscrypt metadata
+// of this filesystem, so that changes made by concurrent fscrypt processes
+// (e.g. the PAM module and an admin) are serialized. Operations which read,
+// modify, and write back metadata should hold it throughout. Read-only
+// operations don't need it, since the metadata files are replaced atomically.
+// Once the lock is held, the transactions abandoned by processes which died are
+// recovered. If another process holds the lock for MetadataLockTimeout,
+// ErrMetadataLocked is returned. If the metadata is on a read-only filesystem,
+// it can't be changed, so ErrReadOnlyFilesystem is returned instead. Locks are
+// not reentrant, even within a process.
+func (m *Mount) LockMetadata() (*MetadataLock, error) {
+	if m.isMetadataReadOnly() {
+		return nil, &ErrReadOnlyFilesystem{m}
+	}
+	file, err := m.openLockFile()
+	if err != nil {
+		return nil, err
+	}
+	if file == nil {
+		return &MetadataLock{}, nil
+	}
+
+	deadline := time.Now().Add(MetadataLockTimeout)
+	for waiting := false; ; waiting = true {
+		err = unix.Flock(int(file.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+		if err == nil {
+			util.Debugf("locked metadata on %s", m.Path)
+			m.recoverTransactions()
+			return &MetadataLock{file}, nil
+		}
+		if err != unix.EWOULDBLOCK && err != unix.EINTR {
+			file.Close()
+			return nil, &os.PathError{Op: "locking", Path: file.Name(), Err: err}
+		}
+		if time.Now().After(deadline) {
+			file.Close()
+			return nil, &ErrMetadataLocked{m, MetadataLockTimeout}
+		}
+		if !waiting {
+			util.Debugf("waiting for the metadata lock on %s", m.Path)
+		}
+		time.Sleep(lockPollInterval)
+	}
+}
+
+// Unlock releases the lock. It does nothing if called more than once.
+func (lock *MetadataLock) Unlock() {
+	if lock.file == nil {
+		return
+	}
+	// Closing the file releases the lock.
+	lock.file.Close()
+	lock.file = nil
+}
@@ -0,0 +1,190 @@
+/*
+ * lock_test.go - Tests for serializing changes to the fscrypt metadata.
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package filesystem
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/fscrypt/metadata"
+)
+
+func checkLockFileMode(t *testing.T, mnt *Mount, expectedMode os.FileMode) {
+	info, err := os.Lstat(mnt.LockPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode(); mode != expectedMode {
+		t.Errorf("lock file has mode %v, expected %v", mode, expectedMode)
+	}
+}
+
+// Tests that setup creates a lock file which only the users who can change the
+// metadata can open.
+func TestSetupCreatesLockFile(t *testing.T) {
+	mnt, err := getTestMount(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mnt.RemoveAllMetadata()
+
+	if err = mnt.Setup(WorldWritable); err != nil {
+		t.Fatal(err)
+	}
+	checkLockFileMode(t, mnt, sharedLockFilePermissions)
+
+	if err = mnt.RemoveAllMetadata(); err != nil {
+		t.Fatal(err)
+	}
+	if err = mnt.Setup(SingleUserWritable); err != nil {
+		t.Fatal(err)
+	}
+	checkLockFileMode(t, mnt, lockFilePermissions)
+}
+
+// Tests that a filesystem set up without a lock file gets one when it's locked,
+// with the permissions of the setup mode.
+func TestLockMetadataCreatesMissingLockFile(t *testing.T) {
+	mnt, err := getTestMount(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mnt.RemoveAllMetadata()
+
+	for _, test := range []struct {
+		setupMode    SetupMode
+		expectedMode os.FileMode
+	}{
+		{WorldWritable, sharedLockFilePermissions},
+		{SingleUserWritable, lockFilePermissions},
+	} {
+		mnt.RemoveAllMetadata()
+		if err = mnt.Setup(test.setupMode); err != nil {
+			t.Fatal(err)
+		}
+		if err = os.Remove(mnt.LockPath()); err != nil {
+			t.Fatal(err)
+		}
+		lock, err := mnt.LockMetadata()
+		if err != nil {
+			t.Fatal(err)
+		}
+		lock.Unlock()
+		checkLockFileMode(t, mnt, test.expectedMode)
+	}
+}
+
+// Tests that the lock can't be taken while it's held, and that it can be taken
+// once it has been released.
+func TestLockMetadataTimeout(t *testing.T) {
+	mnt, err := getSetupMount(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(mnt.BaseDir())
+	defer func(timeout time.Duration) { MetadataLockTimeout = timeout }(MetadataLockTimeout)
+	MetadataLockTimeout = 50 * time.Millisecond
+
+	lock, err := mnt.LockMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = mnt.LockMetadata(); err == nil {
+		t.Fatal("lock was taken twice")
+	} else if _, ok := err.(*ErrMetadataLocked); !ok {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	lock.Unlock()
+	lock.Unlock()
+
+	if lock, err = mnt.LockMetadata(); err != nil {
+		t.Fatal(err)
+	}
+	lock.Unlock()
+}
+
+// Tests that goroutines updating the same metadata while holding the lock don't
+// overlap, so none of their updates are lost.
+func TestLockMetadataSerializes(t *testing.T) {
+	mnt, err := getSetupMount(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(mnt.BaseDir())
+
+	data := getFakePolicy()
+	if err = mnt.AddPolicy(data, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	const workers, iterations = 4, 10
+	var holders int32
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for j := 0; j < iterations; j++ {
+				lock, err := mnt.LockMetadata()
+				if err != nil {
+					errs <- err
+					return
+				}
+				if atomic.AddInt32(&holders, 1) != 1 {
+					t.Error("lock is held by two goroutines at once")
+				}
+				// Read, modify, and write back the policy.
+				policy, err := mnt.GetPolicy(data.KeyDescriptor, nil)
+				if err == nil {
+					policy.WrappedPolicyKeys = append(policy.WrappedPolicyKeys,
+						&metadata.WrappedPolicyKey{
+							ProtectorDescriptor: fmt.Sprintf("%08x%08x", worker, j),
+							WrappedKey:          wrappedPolicyKey,
+						})
+					err = mnt.AddPolicy(policy, nil)
+				}
+				atomic.AddInt32(&holders, -1)
+				lock.Unlock()
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	policy, err := mnt.GetPolicy(data.KeyDescriptor, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(policy.WrappedPolicyKeys); n != 1+workers*iterations {
+		t.Errorf("policy has %d wrapped keys, expected %d, so some updates were lost",
+			n, 1+workers*iterations)
+	}
+}
@@ -25,7 +25,6 @@ import (
 	"bufio"
 	"fmt"
 	"io"
-	"log"
 	"os"
 	"path/filepath"
 	"sort"
@@ -34,6 +33,8 @@ import (
 	"sync"
 
 	"github.com/pkg/errors"
+
+	"github.com/google/fscrypt/util"
 )
 
 var (
@@ -153,6 +154,12 @@ func parseMountInfoLine(line string) *Mount {
 	}
 	mnt.FilesystemType = unescapeString(fields[n+1])
 	mnt.Device = getDeviceName(mnt.DeviceNumber)
+	// inlinecrypt is a filesystem-wide option, so it's in the super options.
+	for _, opt := range strings.Split(fields[n+3], ",") {
+		if opt == "inlinecrypt" {
+			mnt.InlineCrypt = true
+		}
+	}
 	return mnt
 }
 
@@ -262,7 +269,7 @@ func findMainMount(filesystemMounts []*Mount) *Mount {
 		// If there's more than one eligible mount, they should have the
 		// same Subtree.  Otherwise it's ambiguous which one to use.
 		if mainMount != nil && mainMount.Subtree != mnt.Subtree {
-			log.Printf("Unsupported case: %q (%v) has multiple non-overlapping mounts. This filesystem will be ignored!",
+			util.Warnf("Unsupported case: %q (%v) has multiple non-overlapping mounts. This filesystem will be ignored!",
 				mnt.Device, mnt.DeviceNumber)
 			return nil
 		}
@@ -286,13 +293,13 @@ func readMountInfo(r io.Reader) error {
 		line := scanner.Text()
 		mnt := parseMountInfoLine(line)
 		if mnt == nil {
-			log.Printf("ignoring invalid mountinfo line %q", line)
+			util.Debugf("ignoring invalid mountinfo line %q", line)
 			continue
 		}
 
 		// We can only use mountpoints that are directories for fscrypt.
 		if !isDir(mnt.Path) {
-			log.Printf("ignoring mountpoint %q because it is not a directory", mnt.Path)
+			util.Debugf("ignoring mountpoint %q because it is not a directory", mnt.Path)
 			continue
 		}
 
@@ -448,7 +455,7 @@ func deviceNumberToMount(deviceNumber DeviceNumber) (*Mount, bool) {
 	mountMutex.Lock()
 	defer mountMutex.Unlock()
 	if err := loadMountInfo(); err != nil {
-		log.Print(err)
+		util.Debug(err)
 		return nil, false
 	}
 	mnt, ok := mountsByDevice[deviceNumber]
@@ -476,7 +483,7 @@ func getMountFromLink(link string) (*Mount, error) {
 		}
 		pair := strings.Split(line, "=")
 		if len(pair) != 2 {
-			log.Printf("ignoring invalid line in filesystem link file: %q", line)
+			util.Debugf("ignoring invalid line in filesystem link file: %q", line)
 			continue
 		}
 		token := pair[0]
@@ -487,7 +494,7 @@ func getMountFromLink(link string) (*Mount, error) {
 		case pathToken:
 			path = value
 		default:
-			log.Printf("ignoring unknown link token %q", token)
+			util.Debugf("ignoring unknown link token %q", token)
 		}
 	}
 	// At least one of UUID and PATH must be present.
@@ -502,29 +509,29 @@ func getMountFromLink(link string) (*Mount, error) {
 		if err == nil {
 			mnt, ok := deviceNumberToMount(deviceNumber)
 			if mnt != nil {
-				log.Printf("resolved filesystem link using UUID %q", uuid)
+				util.Debugf("resolved filesystem link using UUID %q", uuid)
 				return mnt, nil
 			}
 			if ok {
 				return nil, &ErrFollowLink{link, filesystemLacksMainMountError(deviceNumber)}
 			}
-			log.Printf("cannot find filesystem with UUID %q", uuid)
+			util.Debugf("cannot find filesystem with UUID %q", uuid)
 		} else {
-			log.Printf("cannot find filesystem with UUID %q: %v", uuid, err)
+			util.Debugf("cannot find filesystem with UUID %q: %v", uuid, err)
 		}
 		errMsg += fmt.Sprintf("cannot find filesystem with UUID %q", uuid)
 		if path != "" {
-			log.Printf("falling back to using mountpoint path instead of UUID")
+			util.Debugf("falling back to using mountpoint path instead of UUID")
 		}
 	}
 	// UUID didn't work.  As a fallback, try the mountpoint path.
 	if path != "" {
 		mnt, err := GetMount(path)
 		if mnt != nil {
-			log.Printf("resolved filesystem link using mountpoint path %q", path)
+			util.Debugf("resolved filesystem link using mountpoint path %q", path)
 			return mnt, nil
 		}
-		log.Print(err)
+		util.Debug(err)
 		if errMsg == "" {
 			errMsg = fmt.Sprintf("cannot find filesystem with main mountpoint %q", path)
 		} else {
@@ -551,7 +558,7 @@ func (mnt *Mount) getFilesystemUUID() (string, error) {
 		uuid := fileInfo.Name()
 		deviceNumber, err := uuidToDeviceNumber(uuid)
 		if err != nil {
-			log.Print(err)
+			util.Debug(err)
 			continue
 		}
 		if mnt.DeviceNumber == deviceNumber {
@@ -574,7 +581,7 @@ func makeLink(mnt *Mount) (string, error) {
 		// /dev/disk/by-uuid/* for btrfs filesystems differs from the
 		// actual device number of the mounted filesystem.  Just rely
 		// entirely on the fallback to mountpoint path.
-		log.Print(err)
+		util.Debug(err)
 		return fmt.Sprintf("%s=%s\n", pathToken, mnt.Path), nil
 	}
 	return fmt.Sprintf("%s=%s\n%s=%s\n", uuidToken, uuid, pathToken, mnt.Path), nil
@@ -224,6 +224,23 @@ func TestLoadReadOnlyMount(t *testing.T) {
 	}
 }
 
+// Test that the InlineCrypt flag is set from the filesystem's super options.
+func TestLoadInlineCryptMount(t *testing.T) {
+	mountinfo := `
+15 0 259:3 / / rw,relatime shared:1 - ext4 /dev/root rw,inlinecrypt,data=ordered
+222 15 259:4 / /mnt rw,relatime shared:1 - ext4 /dev/foo rw,data=ordered
+`
+	beginLoadMountInfoTest()
+	defer endLoadMountInfoTest()
+	loadMountInfoFromString(mountinfo)
+	if mnt := mountForDevice("259:3"); !mnt.InlineCrypt {
+		t.Error("Wrong inlinecrypt flag")
+	}
+	if mnt := mountForDevice("259:4"); mnt.InlineCrypt {
+		t.Error("Wrong inlinecrypt flag")
+	}
+}
+
 // Test that a read-write mount is preferred over a read-only mount.
 func TestReadWriteMountIsPreferredOverReadOnlyMount(t *testing.T) {
 	mountinfo := `
@@ -0,0 +1,431 @@
+/*
+ * packed.go - Storage of all of a filesystem's fscrypt metadata in a single
+ * packed file, as an alternative to one file per policy and protector.
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package filesystem
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"path/filepath"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+
+	"github.com/google/fscrypt/util"
+)
+
+// MetadataStore is a way of storing the policies and protectors on a
+// filesystem.
+type MetadataStore int
+
+const (
+	// PerFileStore stores each policy, protector, and protector link in a
+	// file of its own. This is the default.
+	PerFileStore MetadataStore = iota
+	// PackedStore stores all of the policies, protectors, and protector
+	// links in a single file, which begins with an index of its records.
+	// Since the file has a single owner, this requires SingleUserWritable.
+	PackedStore
+)
+
+func (store MetadataStore) String() string {
+	switch store {
+	case PerFileStore:
+		return "per-file"
+	case PackedStore:
+		return "packed"
+	default:
+		return fmt.Sprintf("MetadataStore(%d)", int(store))
+	}
+}
+
+// recordKind is the type of a record in the packed metadata file. Each kind
+// corresponds to one type of file in the per-file store.
+type recordKind uint8
+
+const (
+	policyRecord recordKind = iota + 1
+	protectorRecord
+	linkRecord
+	labelRecord
+	backupRecord
+	policyDirsRecord
+)
+
+func (kind recordKind) String() string {
+	switch kind {
+	case policyRecord:
+		return policyDirName
+	case protectorRecord:
+		return protectorDirName
+	case linkRecord:
+		return "links"
+	case labelRecord:
+		return labelDirName
+	case backupRecord:
+		return backupDirName
+	case policyDirsRecord:
+		return policyDirsDirName
+	default:
+		return fmt.Sprintf("recordKind(%d)", uint8(kind))
+	}
+}
+
+const (
+	packedFileName = "metadata.pack"
+	// The packed file starts with packedMagic and the number of records,
+	// followed by the index and then the records themselves.
+	packedMagic = "FSCPACK1"
+	// An index entry is the kind, the descriptor length, the descriptor,
+	// and the offset and length of the record.
+	packedEntryFixedSize = 1 + 1 + 4 + 4
+	// Maximum size of the packed file. Like maxMetadataFileSize, this is
+	// only meant to stop denial-of-service attempts.
+	maxPackedFileSize = 1024 * maxMetadataFileSize
+)
+
+// packedRecord is a single policy, protector, or protector link.
+type packedRecord struct {
+	kind       recordKind
+	descriptor string
+	data       []byte
+}
+
+// packedIndexEntry describes where a record is stored in the packed file. The
+// offset is relative to the end of the index.
+type packedIndexEntry struct {
+	kind       recordKind
+	descriptor string
+	offset     uint32
+	length     uint32
+}
+
+// packedFile is the contents of the packed metadata file. The records are kept
+// in the order in which they were last written.
+type packedFile struct {
+	records []*packedRecord
+	owner   int64
+	mode    os.FileMode
+}
+
+// packedPath returns the path to the packed metadata file.
+func (m *Mount) packedPath() string {
+	return filepath.Join(m.BaseDir(), packedFileName)
+}
+
+// MetadataStore returns how the metadata on this filesystem is stored.
+func (m *Mount) MetadataStore() MetadataStore {
+	if _, err := os.Lstat(m.packedPath()); err == nil {
+		return PackedStore
+	}
+	return PerFileStore
+}
+
+// usesPackedStore returns true if this filesystem's metadata is stored in the
+// packed file.
+func (m *Mount) usesPackedStore() bool {
+	return m.MetadataStore() == PackedStore
+}
+
+// packedRecordName describes a record in the packed file for log and error
+// messages, similar to the path of the corresponding per-file metadata.
+func (m *Mount) packedRecordName(kind recordKind, descriptor string) string {
+	return fmt.Sprintf("%s[%s/%s]", m.packedPath(), kind, descriptor)
+}
+
+// openPackedFileSafe opens the packed metadata file with the same precautions
+// as readMetadataFileSafe, and returns it along with its size and owner.
+func openPackedFileSafe(path string, trustedUser *user.User) (*os.File, os.FileInfo, error) {
+	file, err := os.OpenFile(path, os.O_RDONLY|unix.O_NOFOLLOW|unix.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	info, err := file.Stat()
+	if err == nil {
+		switch {
+		case !info.Mode().IsRegular():
+			err = &ErrCorruptMetadata{path, errors.New("not a regular file")}
+		case !checkOwnership(path, info, trustedUser):
+			err = &ErrCorruptMetadata{path, errors.New("metadata file belongs to another user")}
+		case info.Size() > maxPackedFileSize:
+			err = &ErrCorruptMetadata{path, errors.New("metadata file size limit exceeded")}
+		}
+	}
+	if err == nil {
+		if _, err = unix.FcntlInt(file.Fd(), unix.F_SETFL, 0); err != nil {
+			err = &os.PathError{Op: "clearing O_NONBLOCK", Path: path, Err: err}
+		}
+	}
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	return file, info, nil
+}
+
+// readPackedIndex reads the index at the start of the packed file, which has
+// the given size. It returns the entries and the offset at which the records
+// start.
+func readPackedIndex(file *os.File, size int64) ([]packedIndexEntry, int64, error) {
+	reader := bufio.NewReader(io.NewSectionReader(file, 0, size))
+	magic := make([]byte, len(packedMagic))
+	var count uint32
+	if _, err := io.ReadFull(reader, magic); err != nil {
+		return nil, 0, err
+	}
+	if string(magic) != packedMagic {
+		return nil, 0, errors.New("not a packed metadata file")
+	}
+	if err := binary.Read(reader, binary.BigEndian, &count); err != nil {
+		return nil, 0, err
+	}
+	if int64(count)*packedEntryFixedSize > size {
+		return nil, 0, errors.New("index is truncated")
+	}
+
+	entries := make([]packedIndexEntry, count)
+	indexEnd := int64(len(packedMagic) + 4)
+	for i := range entries {
+		var header [2]byte
+		if _, err := io.ReadFull(reader, header[:]); err != nil {
+			return nil, 0, err
+		}
+		descriptor := make([]byte, header[1])
+		if _, err := io.ReadFull(reader, descriptor); err != nil {
+			return nil, 0, err
+		}
+		entry := &entries[i]
+		entry.kind = recordKind(header[0])
+		entry.descriptor = string(descriptor)
+		if err := binary.Read(reader, binary.BigEndian, &entry.offset); err != nil {
+			return nil, 0, err
+		}
+		if err := binary.Read(reader, binary.BigEndian, &entry.length); err != nil {
+			return nil, 0, err
+		}
+		indexEnd += packedEntryFixedSize + int64(len(descriptor))
+	}
+
+	for _, entry := range entries {
+		if entry.length > maxMetadataFileSize {
+			return nil, 0, errors.Errorf("record %s/%s is too large",
+				entry.kind, entry.descriptor)
+		}
+		if indexEnd+int64(entry.offset)+int64(entry.length) > size {
+			return nil, 0, errors.Errorf("record %s/%s is truncated",
+				entry.kind, entry.descriptor)
+		}
+	}
+	return entries, indexEnd, nil
+}
+
+// readPackedIndexFile reads only the index of the packed file at path.
+func readPackedIndexFile(path string, trustedUser *user.User) ([]packedIndexEntry, error) {
+	file, info, err := openPackedFileSafe(path, trustedUser)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	entries, _, err := readPackedIndex(file, info.Size())
+	if err != nil {
+		return nil, &ErrCorruptMetadata{path, err}
+	}
+	return entries, nil
+}
+
+// loadPackedFile reads the whole packed file at path.
+func loadPackedFile(path string, trustedUser *user.User) (*packedFile, error) {
+	file, info, err := openPackedFileSafe(path, trustedUser)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	entries, recordsStart, err := readPackedIndex(file, info.Size())
+	if err != nil {
+		return nil, &ErrCorruptMetadata{path, err}
+	}
+
+	pack := &packedFile{
+		records: make([]*packedRecord, len(entries)),
+		owner:   int64(info.Sys().(*syscall.Stat_t).Uid),
+		mode:    info.Mode() & 0777,
+	}
+	for i, entry := range entries {
+		data := make([]byte, entry.length)
+		if _, err = file.ReadAt(data, recordsStart+int64(entry.offset)); err != nil {
+			return nil, &ErrCorruptMetadata{path, err}
+		}
+		pack.records[i] = &packedRecord{entry.kind, entry.descriptor, data}
+	}
+	return pack, nil
+}
+
+// marshal serializes the packed file: the header, then an index entry for each
+// record, then the records in the same order.
+func (pack *packedFile) marshal() []byte {
+	var index, records bytes.Buffer
+	index.WriteString(packedMagic)
+	binary.Write(&index, binary.BigEndian, uint32(len(pack.records)))
+	for _, record := range pack.records {
+		index.WriteByte(byte(record.kind))
+		index.WriteByte(byte(len(record.descriptor)))
+		index.WriteString(record.descriptor)
+		binary.Write(&index, binary.BigEndian, uint32(records.Len()))
+		binary.Write(&index, binary.BigEndian, uint32(len(record.data)))
+		records.Write(record.data)
+	}
+	return append(index.Bytes(), records.Bytes()...)
+}
+
+// find returns the position of the record with the given kind and descriptor,
+// or -1 if there is none.
+func (pack *packedFile) find(kind recordKind, descriptor string) int {
+	for i, record := range pack.records {
+		if record.kind == kind && record.descriptor == descriptor {
+			return i
+		}
+	}
+	return -1
+}
+
+// createPackedFile creates an empty packed metadata file at path.
+func createPackedFile(path string) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, filePermissions)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(new(packedFile).marshal()); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// updatePackedFile reads the packed file, applies update to its contents, and
+// atomically replaces the file. The base directory is locked meanwhile, so that
+// concurrent updates aren't lost. The file keeps its owner and mode.
+func (m *Mount) updatePackedFile(update func(pack *packedFile) error) error {
+	dir, err := os.Open(m.BaseDir())
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	if err = unix.Flock(int(dir.Fd()), unix.LOCK_EX); err != nil {
+		return &os.PathError{Op: "locking", Path: m.BaseDir(), Err: err}
+	}
+	defer unix.Flock(int(dir.Fd()), unix.LOCK_UN)
+
+	pack, err := loadPackedFile(m.packedPath(), nil)
+	if err != nil {
+		return err
+	}
+	if err = update(pack); err != nil {
+		return err
+	}
+	var owner *user.User
+	if util.IsUserRoot() {
+		if owner, err = util.UserFromUID(pack.owner); err != nil {
+			util.Debug(err)
+		}
+	}
+	return m.writeData(m.packedPath(), pack.marshal(), owner, pack.mode)
+}
+
+// getPackedRecord reads a single record from the packed file, along with the
+// UID of the file's owner. If there is no such record, the returned error
+// satisfies os.IsNotExist.
+func (m *Mount) getPackedRecord(kind recordKind, descriptor string,
+	trustedUser *user.User) ([]byte, int64, error) {
+	path := m.packedPath()
+	file, info, err := openPackedFileSafe(path, trustedUser)
+	if err != nil {
+		return nil, -1, err
+	}
+	defer file.Close()
+	entries, recordsStart, err := readPackedIndex(file, info.Size())
+	if err != nil {
+		return nil, -1, &ErrCorruptMetadata{path, err}
+	}
+	for _, entry := range entries {
+		if entry.kind != kind || entry.descriptor != descriptor {
+			continue
+		}
+		data := make([]byte, entry.length)
+		if _, err = file.ReadAt(data, recordsStart+int64(entry.offset)); err != nil {
+			return nil, -1, &ErrCorruptMetadata{path, err}
+		}
+		return data, int64(info.Sys().(*syscall.Stat_t).Uid), nil
+	}
+	return nil, -1, &os.PathError{Op: "open",
+		Path: m.packedRecordName(kind, descriptor), Err: os.ErrNotExist}
+}
+
+// putPackedRecord adds or replaces a record in the packed file. A replaced
+// record moves to the end, so that records stay ordered by last write.
+func (m *Mount) putPackedRecord(kind recordKind, descriptor string, data []byte) error {
+	if len(descriptor) > 255 {
+		return errors.Errorf("descriptor %q is too long", descriptor)
+	}
+	util.Infof("writing metadata to %q", m.packedRecordName(kind, descriptor))
+	return m.updatePackedFile(func(pack *packedFile) error {
+		if i := pack.find(kind, descriptor); i >= 0 {
+			pack.records = append(pack.records[:i], pack.records[i+1:]...)
+		}
+		pack.records = append(pack.records, &packedRecord{kind, descriptor, data})
+		return nil
+	})
+}
+
+// removePackedRecord deletes a record from the packed file. If there is no
+// such record, the returned error satisfies os.IsNotExist.
+func (m *Mount) removePackedRecord(kind recordKind, descriptor string) error {
+	return m.updatePackedFile(func(pack *packedFile) error {
+		i := pack.find(kind, descriptor)
+		if i < 0 {
+			return &os.PathError{Op: "remove",
+				Path: m.packedRecordName(kind, descriptor), Err: os.ErrNotExist}
+		}
+		pack.records = append(pack.records[:i], pack.records[i+1:]...)
+		return nil
+	})
+}
+
+// listPackedRecords returns the descriptors of the records of the given kinds,
+// in the order in which they were last written. Only the index is read.
+func (m *Mount) listPackedRecords(trustedUser *user.User, kinds ...recordKind) ([]string, error) {
+	entries, err := readPackedIndexFile(m.packedPath(), trustedUser)
+	if err != nil {
+		return nil, err
+	}
+	var descriptors []string
+	for _, entry := range entries {
+		for _, kind := range kinds {
+			if entry.kind == kind {
+				descriptors = append(descriptors, entry.descriptor)
+			}
+		}
+	}
+	return descriptors, nil
+}
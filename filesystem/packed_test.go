@@ -0,0 +1,221 @@
+/*
+ * packed_test.go - Tests for storing metadata in a single packed file.
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package filesystem
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// Gets the test mount and sets it up with the packed store.
+func getPackedSetupMount(t *testing.T) (*Mount, error) {
+	mnt, err := getTestMount(t)
+	if err != nil {
+		return nil, err
+	}
+	return mnt, mnt.SetupWithStore(SingleUserWritable, PackedStore)
+}
+
+// Tests that a packed file can be written and read back, and that truncated
+// files are detected.
+func TestPackedFileRoundTrip(t *testing.T) {
+	pack := &packedFile{records: []*packedRecord{
+		{policyRecord, "0123456789abcdef", []byte("policy")},
+		{protectorRecord, "fedcba9876543210", []byte("protector")},
+		{linkRecord, "1111111111111111", nil},
+	}}
+	path := filepath.Join(t.TempDir(), packedFileName)
+	data := pack.marshal()
+	if err := os.WriteFile(path, data, filePermissions); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := loadPackedFile(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.records) != len(pack.records) {
+		t.Fatalf("read %d records, expected %d", len(loaded.records), len(pack.records))
+	}
+	for i, record := range loaded.records {
+		expected := pack.records[i]
+		if record.kind != expected.kind || record.descriptor != expected.descriptor ||
+			string(record.data) != string(expected.data) {
+			t.Errorf("record %d is %+v, expected %+v", i, record, expected)
+		}
+	}
+
+	if err = os.WriteFile(path, data[:len(data)-1], filePermissions); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = loadPackedFile(path, nil); err == nil {
+		t.Error("truncated packed file should be rejected")
+	}
+	if err = os.WriteFile(path, []byte("not packed"), filePermissions); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = readPackedIndexFile(path, nil); err == nil {
+		t.Error("file without the packed magic should be rejected")
+	}
+}
+
+// Tests that the packed store can only be set up as single-user writable.
+func TestSetupPackedStoreMode(t *testing.T) {
+	mnt, err := getTestMount(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = mnt.SetupWithStore(WorldWritable, PackedStore); err == nil {
+		mnt.RemoveAllMetadata()
+		t.Fatal("packed store should require a single-user writable setup")
+	}
+
+	if mnt, err = getPackedSetupMount(t); err != nil {
+		t.Fatal(err)
+	}
+	defer mnt.RemoveAllMetadata()
+	if err = mnt.CheckSetup(nil); err != nil {
+		t.Error(err)
+	}
+	if store := mnt.MetadataStore(); store != PackedStore {
+		t.Errorf("metadata store is %v, expected %v", store, PackedStore)
+	}
+}
+
+// Tests that policies and protectors are stored in the packed file, and can be
+// read back, listed, and removed.
+func TestPackedStore(t *testing.T) {
+	mnt, err := getPackedSetupMount(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mnt.RemoveAllMetadata()
+
+	protector := getFakeProtector()
+	policy := getFakePolicy()
+	if err = mnt.AddProtector(protector, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err = mnt.AddPolicy(policy, nil); err != nil {
+		t.Fatal(err)
+	}
+	if isRegularFile(mnt.protectorPath(protector.ProtectorDescriptor)) ||
+		isRegularFile(mnt.PolicyPath(policy.KeyDescriptor)) {
+		t.Error("metadata was written to individual files")
+	}
+
+	retProtector, err := mnt.GetRegularProtector(protector.ProtectorDescriptor, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !proto.Equal(retProtector, protector) {
+		t.Errorf("protector %+v does not equal expected protector %+v", retProtector, protector)
+	}
+	retPolicy, err := mnt.GetPolicy(policy.KeyDescriptor, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !proto.Equal(retPolicy, policy) {
+		t.Errorf("policy %+v does not equal expected policy %+v", retPolicy, policy)
+	}
+
+	protectors, err := mnt.ListProtectors(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(protectors, []string{protector.ProtectorDescriptor}) {
+		t.Errorf("protectors were %v", protectors)
+	}
+	policies, err := mnt.ListPolicies(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(policies, []string{policy.KeyDescriptor}) {
+		t.Errorf("policies were %v", policies)
+	}
+
+	if err = mnt.RemovePolicy(policy.KeyDescriptor); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = mnt.GetPolicy(policy.KeyDescriptor, nil); err == nil {
+		t.Error("removed policy could still be read")
+	} else if _, ok := err.(*ErrPolicyNotFound); !ok {
+		t.Errorf("expected ErrPolicyNotFound, got %v", err)
+	}
+	if err = mnt.RemovePolicy(policy.KeyDescriptor); err == nil {
+		t.Error("removing a nonexistent policy should fail")
+	}
+	if _, err = mnt.GetRegularProtector(protector.ProtectorDescriptor, nil); err != nil {
+		t.Errorf("removing the policy affected the protector: %v", err)
+	}
+}
+
+// Tests that a packed store can hold a link to a protector on a filesystem
+// which uses the per-file store.
+func TestPackedStoreLinkedProtector(t *testing.T) {
+	realMnt, err := getSetupMount(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fakeMountpoint := filepath.Join(realMnt.Path, "fake")
+	if err = os.MkdirAll(fakeMountpoint, basePermissions); err != nil {
+		t.Fatal(err)
+	}
+	fakeMnt := &Mount{Path: fakeMountpoint, FilesystemType: realMnt.FilesystemType}
+	defer cleanupTwoMounts(realMnt, fakeMnt)
+	if err = fakeMnt.SetupWithStore(SingleUserWritable, PackedStore); err != nil {
+		t.Fatal(err)
+	}
+
+	protector := getFakeProtector()
+	if err = realMnt.AddProtector(protector, nil); err != nil {
+		t.Fatal(err)
+	}
+	descriptor := protector.ProtectorDescriptor
+	if _, err = fakeMnt.AddLinkedProtector(descriptor, realMnt, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	retMnt, retProtector, err := fakeMnt.GetProtector(descriptor, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if retMnt != realMnt || !proto.Equal(retProtector, protector) {
+		t.Error("linked protector was not followed")
+	}
+	linked, err := fakeMnt.ListLinkedProtectors()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(linked, []string{descriptor}) {
+		t.Errorf("linked protectors were %v", linked)
+	}
+	if err = fakeMnt.AddProtector(protector, nil); err == nil {
+		t.Error("linked protector shouldn't be replaceable with a regular one")
+	}
+	if err = fakeMnt.RemoveProtector(descriptor); err != nil {
+		t.Fatal(err)
+	}
+	if linked, _ = fakeMnt.ListLinkedProtectors(); len(linked) != 0 {
+		t.Errorf("link wasn't removed: %v", linked)
+	}
+}
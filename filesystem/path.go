@@ -21,13 +21,15 @@ package filesystem
 
 import (
 	"fmt"
-	"log"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"golang.org/x/sys/unix"
 
 	"github.com/pkg/errors"
+
+	"github.com/google/fscrypt/util"
 )
 
 // OpenFileOverridingUmask calls os.OpenFile but with the umask overridden so
@@ -54,12 +56,22 @@ func canonicalizePath(path string) (string, error) {
 	return path, err
 }
 
+// isPathWithin returns true if path is dir or is located somewhere under dir.
+// Both paths should already be absolute and canonical.
+func isPathWithin(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, "../")
+}
+
 // loggedStat runs os.Stat, but it logs the error if stat returns any error
 // other than nil or IsNotExist.
 func loggedStat(name string) (os.FileInfo, error) {
 	info, err := os.Stat(name)
 	if err != nil && !os.IsNotExist(err) {
-		log.Print(err)
+		util.Debug(err)
 	}
 	return info, err
 }
@@ -69,7 +81,7 @@ func loggedStat(name string) (os.FileInfo, error) {
 func loggedLstat(name string) (os.FileInfo, error) {
 	info, err := os.Lstat(name)
 	if err != nil && !os.IsNotExist(err) {
-		log.Print(err)
+		util.Debug(err)
 	}
 	return info, err
 }
@@ -83,3 +83,23 @@ func TestHaveReadAccessTo(t *testing.T) {
 		}
 	}
 }
+
+func TestIsPathWithin(t *testing.T) {
+	cases := []struct {
+		path, dir string
+		within    bool
+	}{
+		{"/a/b", "/a", true},
+		{"/a", "/a", true},
+		{"/a", "/a/b", false},
+		{"/ab", "/a", false},
+		{"/a/..b", "/a", true},
+		{"/", "/a", false},
+		{"/a", "/", true},
+	}
+	for _, c := range cases {
+		if got := isPathWithin(c.path, c.dir); got != c.within {
+			t.Errorf("isPathWithin(%q, %q) = %v, want %v", c.path, c.dir, got, c.within)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+/*
+ * schema.go - Backing up metadata before upgrading its schema version
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package filesystem
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/google/fscrypt/metadata"
+	"github.com/google/fscrypt/util"
+)
+
+// The backups are kept in their own directory, so that older versions of
+// fscrypt don't mistake them for policies or protectors.
+const backupDirName = "backups"
+
+// BackupDir returns the directory containing the copies of metadata made before
+// upgrading its schema version.
+func (m *Mount) BackupDir() string {
+	return filepath.Join(m.BaseDir(), backupDirName)
+}
+
+// The schema floor is the oldest schema version which the protectors and
+// policies on the filesystem may have. It's raised once all of them have been
+// upgraded, so that none of them can be replaced by a copy with an older schema
+// version, e.g. to get around the metadata HMAC. It's kept in the base
+// directory, so only the owner of the filesystem's metadata can change it.
+const (
+	schemaFloorFileName    = "schema_version"
+	schemaFloorPermissions = 0644
+)
+
+// SchemaFloorPath returns the path to the file recording the schema floor.
+func (m *Mount) SchemaFloorPath() string {
+	return filepath.Join(m.BaseDir(), schemaFloorFileName)
+}
+
+// schemaFloor returns the schema floor of the filesystem, which is 0 if it was
+// set up before the floor was recorded and hasn't been raised since.
+func (m *Mount) schemaFloor() (int64, error) {
+	data, err := os.ReadFile(m.SchemaFloorPath())
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	floor, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil || floor < 0 {
+		return 0, &ErrCorruptMetadata{m.SchemaFloorPath(), errors.New("invalid schema version")}
+	}
+	return floor, nil
+}
+
+// writeSchemaFloor records the schema floor of the filesystem.
+func (m *Mount) writeSchemaFloor(version int64) error {
+	data := []byte(strconv.FormatInt(version, 10) + "\n")
+	return m.writeData(m.SchemaFloorPath(), data, nil, schemaFloorPermissions)
+}
+
+// raiseSchemaFloor raises the schema floor to metadata.SchemaVersion if all the
+// protectors and policies on the filesystem have that version now. It isn't
+// raised while the journal of a transaction may still restore older records.
+// Failures are only logged, as the floor can be raised by a later change.
+func (m *Mount) raiseSchemaFloor() {
+	if floor, err := m.schemaFloor(); err != nil || floor >= metadata.SchemaVersion {
+		return
+	}
+	if journals, err := os.ReadDir(m.JournalDir()); err != nil && !os.IsNotExist(err) ||
+		len(journals) > 0 {
+		return
+	}
+	for _, kind := range []recordKind{protectorRecord, policyRecord} {
+		descriptors, err := m.listMetadata(kind, nil)
+		if err != nil {
+			return
+		}
+		for _, descriptor := range descriptors {
+			if version, ok := m.recordSchemaVersion(kind, descriptor); !ok ||
+				version < metadata.SchemaVersion {
+				return
+			}
+		}
+	}
+	if err := m.writeSchemaFloor(metadata.SchemaVersion); err != nil {
+		util.Debugf("cannot raise the schema floor of %s: %v", m.Path, err)
+		return
+	}
+	util.Infof("all the metadata on %s has schema version %d now", m.Path, metadata.SchemaVersion)
+}
+
+// recordSchemaVersion returns the schema version of the record with the given
+// kind and descriptor. Links, and records which have been removed or are
+// corrupt, don't hold back the schema floor, so the maximum version is
+// returned for them. ok is false if the record can't be read.
+func (m *Mount) recordSchemaVersion(kind recordKind, descriptor string) (version int64, ok bool) {
+	data, _, err := m.readRecord(kind, descriptor, nil)
+	if os.IsNotExist(err) {
+		return metadata.SchemaVersion, true
+	}
+	if err != nil {
+		return 0, false
+	}
+	var md metadata.VersionedMetadata = new(metadata.PolicyData)
+	if kind == protectorRecord {
+		md = new(metadata.ProtectorData)
+	}
+	if proto.Unmarshal(data, md) != nil || metadata.CheckSchemaVersion(md) != nil {
+		return metadata.SchemaVersion, true
+	}
+	return md.GetSchemaVersion(), true
+}
+
+// backupPath returns the full path to the backup with the specified name.
+func (m *Mount) backupPath(name string) string {
+	return filepath.Join(m.BackupDir(), name)
+}
+
+// backupName returns the name of the backup of a record with the specified
+// kind and descriptor, written with the specified schema version.
+func backupName(kind recordKind, descriptor string, version int64) string {
+	return fmt.Sprintf("%s.%s.v%d", kind, descriptor, version)
+}
+
+// backupOldSchema is called before replacing the record with the specified
+// kind and descriptor by md, which is written with the given schema version.
+// If the existing record has an older schema version, a copy of it is kept
+// (once per version), from which the metadata can be restored for older
+// versions of fscrypt. If it has a newer schema version than this version of
+// fscrypt supports, an ErrMetadataTooNew is returned, as replacing it would
+// lose what this version of fscrypt doesn't understand.
+func (m *Mount) backupOldSchema(kind recordKind, descriptor string,
+	md metadata.VersionedMetadata, newVersion int64, owner *user.User) error {
+	data, _, err := m.readRecord(kind, descriptor, nil)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			util.Debugf("not backing up unreadable %q: %v", m.recordName(kind, descriptor), err)
+		}
+		return nil
+	}
+	old := md.ProtoReflect().New().Interface().(metadata.VersionedMetadata)
+	if err = proto.Unmarshal(data, old); err != nil {
+		util.Debugf("not backing up corrupt %q: %v", m.recordName(kind, descriptor), err)
+		return nil
+	}
+	if err = metadata.CheckSchemaVersion(old); err != nil {
+		util.Debugf("not backing up corrupt %q: %v", m.recordName(kind, descriptor), err)
+		return nil
+	}
+	version := old.GetSchemaVersion()
+	if metadata.SchemaIsTooNew(old) {
+		return &ErrMetadataTooNew{m.recordName(kind, descriptor), version}
+	}
+	if version >= newVersion {
+		return nil
+	}
+
+	name := backupName(kind, descriptor, version)
+	if m.hasRecord(backupRecord, name) {
+		return nil
+	}
+	if !m.usesPackedStore() {
+		if err = m.makeOptionalDir(m.BackupDir()); err != nil {
+			return err
+		}
+		if err = checkOptionalDir(m.BackupDir()); err != nil {
+			return err
+		}
+	}
+	util.Infof("backing up %q (schema version %d) to %q before upgrading it",
+		m.recordName(kind, descriptor), version, m.recordName(backupRecord, name))
+	return m.writeRecord(backupRecord, name, data, owner)
+}
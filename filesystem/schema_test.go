@@ -0,0 +1,176 @@
+/*
+ * schema_test.go - Tests for upgrading the schema version of metadata
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package filesystem
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/google/fscrypt/metadata"
+)
+
+// writeRawPolicy writes a policy as-is, the way an older or newer version of
+// fscrypt might have.
+func writeRawPolicy(t *testing.T, mnt *Mount, policy *metadata.PolicyData) []byte {
+	data, err := proto.Marshal(policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = mnt.writeRecord(policyRecord, policy.KeyDescriptor, data, nil); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// Tests that a policy written before schema versions were recorded is upgraded
+// when read, and backed up when first rewritten, and that the backup is neither
+// listed as a policy nor replaced by later writes.
+func testSchemaMigration(t *testing.T, mnt *Mount) {
+	// Only filesystems set up by older versions can have such policies.
+	if err := os.Remove(mnt.SchemaFloorPath()); err != nil {
+		t.Fatal(err)
+	}
+	policy := getFakePolicy()
+	policy.Options.PolicyVersion = 0
+	descriptor := policy.KeyDescriptor
+	original := writeRawPolicy(t, mnt, policy)
+
+	read, err := mnt.GetPolicy(descriptor, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read.SchemaVersion != metadata.SchemaVersion || read.Options.PolicyVersion != 1 {
+		t.Errorf("policy wasn't upgraded: %v", read)
+	}
+	if mnt.hasRecord(backupRecord, backupName(policyRecord, descriptor, 0)) {
+		t.Error("reading the policy made a backup")
+	}
+
+	for i := 0; i < 2; i++ {
+		if err = mnt.AddPolicy(read, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	backup, _, err := mnt.readRecord(backupRecord, backupName(policyRecord, descriptor, 0), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(backup, original) {
+		t.Error("backup doesn't match the original policy")
+	}
+	if policies, err := mnt.ListPolicies(nil); err != nil || len(policies) != 1 {
+		t.Errorf("listed policies %v (err: %v), expected just %s", policies, err, descriptor)
+	}
+	if read, err = mnt.GetPolicy(descriptor, nil); err != nil || read.SchemaVersion != metadata.SchemaVersion {
+		t.Errorf("rewritten policy has schema version %d (err: %v)", read.GetSchemaVersion(), err)
+	}
+
+	// All the metadata has been upgraded now, so the original can't be
+	// put back.
+	if floor, err := mnt.schemaFloor(); err != nil || floor != metadata.SchemaVersion {
+		t.Errorf("schema floor is %d (err: %v) after upgrading all the metadata", floor, err)
+	}
+	writeRawPolicy(t, mnt, policy)
+	if _, err = mnt.GetPolicy(descriptor, nil); err == nil {
+		t.Error("reading a downgraded policy should fail")
+	} else if _, ok := err.(*ErrMetadataDowngraded); !ok {
+		t.Errorf("unexpected error reading a downgraded policy: %v", err)
+	}
+}
+
+// Tests that a policy without the metadata HMAC, which was changed without its
+// key, is written with the schema version before the HMAC was required, and
+// that this holds back the schema floor.
+func TestSchemaWithoutHMAC(t *testing.T) {
+	mnt, err := getSetupMount(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mnt.RemoveAllMetadata()
+	if err = os.Remove(mnt.SchemaFloorPath()); err != nil {
+		t.Fatal(err)
+	}
+	policy := getFakePolicy()
+	policy.MetadataHmac = nil
+	if err = mnt.AddPolicy(policy, nil); err != nil {
+		t.Fatal(err)
+	}
+	read, err := mnt.GetPolicy(policy.KeyDescriptor, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version := read.SchemaVersion; version != metadata.SchemaVersion {
+		t.Errorf("policy read with schema version %d", version)
+	}
+	if data, _, err := mnt.readRecord(policyRecord, policy.KeyDescriptor, nil); err != nil {
+		t.Fatal(err)
+	} else if err = proto.Unmarshal(data, read); err != nil || read.SchemaVersion != metadata.HMACSchemaVersion-1 {
+		t.Errorf("policy without an HMAC written with schema version %d", read.SchemaVersion)
+	}
+	if floor, err := mnt.schemaFloor(); err != nil || floor != 0 {
+		t.Errorf("schema floor raised to %d (err: %v) by a policy without an HMAC", floor, err)
+	}
+}
+
+// Tests that a policy written by a newer version of fscrypt is neither read nor
+// overwritten.
+func testSchemaTooNew(t *testing.T, mnt *Mount) {
+	policy := getFakePolicy()
+	policy.SchemaVersion = metadata.SchemaVersion + 1
+	writeRawPolicy(t, mnt, policy)
+
+	if _, err := mnt.GetPolicy(policy.KeyDescriptor, nil); err == nil {
+		t.Error("reading a policy with a newer schema should fail")
+	} else if _, ok := err.(*ErrMetadataTooNew); !ok {
+		t.Errorf("unexpected error reading a policy with a newer schema: %v", err)
+	}
+	if _, ok := mnt.AddPolicy(getFakePolicy(), nil).(*ErrMetadataTooNew); !ok {
+		t.Error("replacing a policy with a newer schema should fail")
+	}
+}
+
+func TestSchemaMigration(t *testing.T) {
+	mnt, err := getSetupMount(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mnt.RemoveAllMetadata()
+	testSchemaMigration(t, mnt)
+}
+
+func TestPackedSchemaMigration(t *testing.T) {
+	mnt, err := getPackedSetupMount(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mnt.RemoveAllMetadata()
+	testSchemaMigration(t, mnt)
+}
+
+func TestSchemaTooNew(t *testing.T) {
+	mnt, err := getSetupMount(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mnt.RemoveAllMetadata()
+	testSchemaTooNew(t, mnt)
+}
@@ -0,0 +1,42 @@
+/*
+ * testmount_test.go - Tests for throwaway ext4 filesystems
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package filesystem
+
+import (
+	"testing"
+
+	"github.com/google/fscrypt/metadata"
+)
+
+// Tests that the loopback filesystem supports encryption and can be set up.
+func TestLoopbackTestMount(t *testing.T) {
+	mnt := NewLoopbackTestMount(t)
+	if mnt.FilesystemType != "ext4" {
+		t.Errorf("loopback test mount has type %q, expected ext4", mnt.FilesystemType)
+	}
+	if err := metadata.CheckSupport(mnt.Path); err != nil {
+		t.Fatal(err)
+	}
+	if err := mnt.Setup(WorldWritable); err != nil {
+		t.Fatal(err)
+	}
+	if err := mnt.CheckSetup(nil); err != nil {
+		t.Error(err)
+	}
+}
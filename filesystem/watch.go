@@ -0,0 +1,239 @@
+/*
+ * watch.go - Watching for filesystems which are set up for fscrypt being
+ * mounted or unmounted.
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package filesystem
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/google/fscrypt/util"
+)
+
+// MountEventType is the kind of change described by a MountEvent.
+type MountEventType int
+
+// The possible values of MountEventType.
+const (
+	// Mounted means a filesystem set up for fscrypt was mounted.
+	Mounted MountEventType = iota
+	// Unmounted means a filesystem set up for fscrypt was unmounted.
+	Unmounted
+)
+
+func (t MountEventType) String() string {
+	switch t {
+	case Mounted:
+		return "mounted"
+	case Unmounted:
+		return "unmounted"
+	default:
+		return fmt.Sprintf("MountEventType(%d)", int(t))
+	}
+}
+
+// MountEvent describes a filesystem which is set up for fscrypt being mounted
+// or unmounted. For Unmounted events, Mount describes the filesystem as it was
+// last seen, so its Path may no longer exist.
+type MountEvent struct {
+	Type  MountEventType
+	Mount *Mount
+}
+
+var (
+	// MountWatchDebounce is how long the mounts must stay unchanged before
+	// WatchMounts reports the changes. This way, a burst of mount changes
+	// (e.g. a filesystem being remounted) is reported at most once, and not
+	// at all if the burst leaves the filesystem as it was.
+	MountWatchDebounce = 250 * time.Millisecond
+	// Location of the file whose changes are watched
+	mountInfoPath = "/proc/self/mountinfo"
+)
+
+// WatchMounts reports the filesystems which are set up for use with fscrypt
+// being mounted or unmounted, as found by watching /proc/self/mountinfo. The
+// filesystems mounted when this is called aren't reported; use AllFilesystems
+// to find them. A filesystem which is set up for fscrypt while it is mounted
+// isn't reported until it is mounted again. The mount information used by the
+// other functions of this package is kept up to date. The returned channel is
+// closed once ctx is canceled.
+func WatchMounts(ctx context.Context) (<-chan MountEvent, error) {
+	// The file is opened directly, as an *os.File would be registered with
+	// the runtime's poller, which would then consume the change events.
+	fd, err := unix.Open(mountInfoPath, unix.O_RDONLY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: mountInfoPath, Err: err}
+	}
+	// The pipe wakes up poll() once ctx is canceled.
+	var cancelPipe [2]int
+	if err = unix.Pipe2(cancelPipe[:], unix.O_CLOEXEC); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	if err = UpdateMountInfo(); err != nil {
+		unix.Close(fd)
+		unix.Close(cancelPipe[0])
+		unix.Close(cancelPipe[1])
+		return nil, err
+	}
+	known := setupMounts()
+
+	events := make(chan MountEvent)
+	stopped := make(chan struct{})
+	go func() {
+		defer unix.Close(cancelPipe[1])
+		select {
+		case <-ctx.Done():
+			unix.Write(cancelPipe[1], []byte{0})
+		case <-stopped:
+		}
+	}()
+	go func() {
+		defer close(events)
+		defer unix.Close(fd)
+		defer unix.Close(cancelPipe[0])
+		defer close(stopped)
+
+		for waitForMountChanges(fd, cancelPipe[0]) {
+			if err := UpdateMountInfo(); err != nil {
+				util.Warnf("could not reread the mounts: %v", err)
+				continue
+			}
+			current := setupMounts()
+			for _, event := range diffMounts(known, current) {
+				util.Debugf("%s %s", event.Mount.Path, event.Type)
+				select {
+				case events <- event:
+				case <-ctx.Done():
+					return
+				}
+			}
+			known = current
+		}
+	}()
+	return events, nil
+}
+
+// waitForMountChanges blocks until the mounts have changed and then stayed
+// unchanged for MountWatchDebounce. It returns false if cancelFd became
+// readable or the mounts can't be watched any longer.
+func waitForMountChanges(mountInfoFd, cancelFd int) bool {
+	fds := []unix.PollFd{
+		{Fd: int32(mountInfoFd), Events: unix.POLLPRI},
+		{Fd: int32(cancelFd), Events: unix.POLLIN},
+	}
+	changed := false
+	for {
+		// Wait indefinitely for the first change, then until no further
+		// change has happened for the debounce period.
+		timeout := -1
+		if changed {
+			timeout = int(MountWatchDebounce / time.Millisecond)
+		}
+		n, err := unix.Poll(fds, timeout)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			util.Warnf("could not watch %q: %v", mountInfoPath, err)
+			return false
+		}
+		if fds[1].Revents != 0 {
+			return false
+		}
+		if n == 0 {
+			return true
+		}
+		// The kernel reports a change as POLLERR|POLLPRI. Older kernels
+		// only acknowledge it once the file has been read again.
+		if err = drainFile(mountInfoFd); err != nil {
+			util.Warnf("could not read %q: %v", mountInfoPath, err)
+			return false
+		}
+		changed = true
+	}
+}
+
+// drainFile reads the file from its start to its end.
+func drainFile(fd int) error {
+	if _, err := unix.Seek(fd, 0, io.SeekStart); err != nil {
+		return err
+	}
+	buf := make([]byte, 4096)
+	for {
+		n, err := unix.Read(fd, buf)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil || n == 0 {
+			return err
+		}
+	}
+}
+
+// setupMounts returns the main Mounts of the filesystems which are set up for
+// fscrypt, by path.
+func setupMounts() map[string]*Mount {
+	mounts, err := AllFilesystems()
+	if err != nil {
+		util.Debug(err)
+		return nil
+	}
+	setup := make(map[string]*Mount)
+	for _, mount := range mounts {
+		if mount.CheckSetup(nil) == nil {
+			setup[mount.Path] = mount
+		}
+	}
+	return setup
+}
+
+// diffMounts returns the events which turn the old mounts into the new ones,
+// first the unmounts and then the mounts, each ordered by path. A different
+// filesystem mounted at the same path is reported as an unmount and a mount.
+func diffMounts(old, new map[string]*Mount) []MountEvent {
+	var unmounted, mounted []*Mount
+	for path, oldMount := range old {
+		if newMount, ok := new[path]; !ok || newMount.DeviceNumber != oldMount.DeviceNumber {
+			unmounted = append(unmounted, oldMount)
+		}
+	}
+	for path, newMount := range new {
+		if oldMount, ok := old[path]; !ok || newMount.DeviceNumber != oldMount.DeviceNumber {
+			mounted = append(mounted, newMount)
+		}
+	}
+	sort.Sort(PathSorter(unmounted))
+	sort.Sort(PathSorter(mounted))
+
+	events := make([]MountEvent, 0, len(unmounted)+len(mounted))
+	for _, mount := range unmounted {
+		events = append(events, MountEvent{Unmounted, mount})
+	}
+	for _, mount := range mounted {
+		events = append(events, MountEvent{Mounted, mount})
+	}
+	return events
+}
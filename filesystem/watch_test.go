@@ -0,0 +1,85 @@
+/*
+ * watch_test.go - Tests for watching fscrypt filesystems being mounted or
+ * unmounted.
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package filesystem
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDiffMounts(t *testing.T) {
+	a := &Mount{Path: "/a", DeviceNumber: 1}
+	b := &Mount{Path: "/b", DeviceNumber: 2}
+	c := &Mount{Path: "/c", DeviceNumber: 3}
+	remountedB := &Mount{Path: "/b", DeviceNumber: 2, ReadOnly: true}
+	replacedB := &Mount{Path: "/b", DeviceNumber: 4}
+
+	tests := []struct {
+		name     string
+		old, new []*Mount
+		expected []MountEvent
+	}{
+		{"unchanged", []*Mount{a, b}, []*Mount{a, b}, []MountEvent{}},
+		{"remounted", []*Mount{a, b}, []*Mount{a, remountedB}, []MountEvent{}},
+		{"mounted", []*Mount{b}, []*Mount{c, b, a}, []MountEvent{
+			{Mounted, a}, {Mounted, c},
+		}},
+		{"unmounted", []*Mount{a, b, c}, []*Mount{b}, []MountEvent{
+			{Unmounted, a}, {Unmounted, c},
+		}},
+		{"replaced", []*Mount{a, b}, []*Mount{replacedB, c}, []MountEvent{
+			{Unmounted, a}, {Unmounted, b}, {Mounted, replacedB}, {Mounted, c},
+		}},
+	}
+	toMap := func(mounts []*Mount) map[string]*Mount {
+		m := make(map[string]*Mount)
+		for _, mount := range mounts {
+			m[mount.Path] = mount
+		}
+		return m
+	}
+	for _, test := range tests {
+		events := diffMounts(toMap(test.old), toMap(test.new))
+		if !reflect.DeepEqual(events, test.expected) {
+			t.Errorf("%s: got events %v, expected %v", test.name, events, test.expected)
+		}
+	}
+}
+
+// Tests that the channel returned by WatchMounts is closed once the context is
+// canceled, without any events for the filesystems which are already mounted.
+func TestWatchMountsCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	events, err := WatchMounts(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	select {
+	case event, ok := <-events:
+		if ok {
+			t.Errorf("unexpected event %v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("channel was not closed after cancellation")
+	}
+}
@@ -26,7 +26,6 @@ import "C"
 
 import (
 	"encoding/hex"
-	"log"
 	"os"
 	"os/user"
 	"sync"
@@ -50,7 +49,7 @@ var (
 func checkForFsKeyringSupport(mount *filesystem.Mount) bool {
 	dir, err := os.Open(mount.Path)
 	if err != nil {
-		log.Printf("Unexpected error opening %q. Assuming filesystem keyring is unsupported.",
+		util.Warnf("Unexpected error opening %q. Assuming filesystem keyring is unsupported.",
 			mount.Path)
 		return false
 	}
@@ -66,15 +65,15 @@ func checkForFsKeyringSupport(mount *filesystem.Mount) bool {
 	// supports the ioctls on all fscrypt-capable filesystems or it doesn't.
 	_, _, errno := unix.Syscall(unix.SYS_IOCTL, dir.Fd(), unix.FS_IOC_ADD_ENCRYPTION_KEY, 0)
 	if errno == unix.ENOTTY {
-		log.Printf("Kernel doesn't support filesystem keyring. Falling back to user keyring.")
+		util.Debugf("Kernel doesn't support filesystem keyring. Falling back to user keyring.")
 		return false
 	}
 	if errno == unix.EFAULT {
-		log.Printf("Detected support for filesystem keyring")
+		util.Debugf("Detected support for filesystem keyring")
 	} else {
 		// EFAULT is expected, but as long as we didn't get ENOTTY the
 		// ioctl should be available.
-		log.Printf("Unexpected error from FS_IOC_ADD_ENCRYPTION_KEY(%q, NULL): %v", mount.Path, errno)
+		util.Warnf("Unexpected error from FS_IOC_ADD_ENCRYPTION_KEY(%q, NULL): %v", mount.Path, errno)
 	}
 	return true
 }
@@ -172,6 +171,40 @@ func validateKeyDescriptor(spec *unix.FscryptKeySpecifier, descriptor string) (s
 func fsAddEncryptionKey(key *crypto.Key, descriptor string,
 	mount *filesystem.Mount, user *user.User) error {
 
+	var spec unix.FscryptKeySpecifier
+	if err := buildKeySpecifier(&spec, descriptor); err != nil {
+		return err
+	}
+	if err := fsAddKey(key, &spec, descriptor, mount, user); err != nil {
+		return err
+	}
+	descriptor, err := validateKeyDescriptor(&spec, descriptor)
+	if err != nil {
+		fsRemoveEncryptionKey(descriptor, mount, user)
+		return err
+	}
+	return nil
+}
+
+// fsAddRawEncryptionKey adds the specified raw key for v2 encryption policies
+// to the specified filesystem, and returns the identifier that the kernel
+// calculated for it.
+func fsAddRawEncryptionKey(key *crypto.Key, mount *filesystem.Mount,
+	user *user.User) (string, error) {
+
+	spec := unix.FscryptKeySpecifier{Type: unix.FSCRYPT_KEY_SPEC_TYPE_IDENTIFIER}
+	if err := fsAddKey(key, &spec, "<raw>", mount, user); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(spec.U[:unix.FSCRYPT_KEY_IDENTIFIER_SIZE]), nil
+}
+
+// fsAddKey runs FS_IOC_ADD_ENCRYPTION_KEY to add key with the key specifier
+// spec to the specified filesystem, and updates spec with the one the kernel
+// returned. The descriptor is only used in messages.
+func fsAddKey(key *crypto.Key, spec *unix.FscryptKeySpecifier, descriptor string,
+	mount *filesystem.Mount, user *user.User) error {
+
 	dir, err := os.Open(mount.Path)
 	if err != nil {
 		return err
@@ -184,10 +217,7 @@ func fsAddEncryptionKey(key *crypto.Key, descriptor string,
 	}
 	defer argKey.Wipe()
 	arg := (*unix.FscryptAddKeyArg)(argKey.UnsafePtr())
-
-	if err = buildKeySpecifier(&arg.Key_spec, descriptor); err != nil {
-		return err
-	}
+	arg.Key_spec = *spec
 
 	raw := unsafe.Pointer(uintptr(argKey.UnsafePtr()) + unsafe.Sizeof(*arg))
 	arg.Raw_size = uint32(key.Len())
@@ -201,16 +231,21 @@ func fsAddEncryptionKey(key *crypto.Key, descriptor string,
 		unix.FS_IOC_ADD_ENCRYPTION_KEY, uintptr(argKey.UnsafePtr()))
 	restorePrivs(savedPrivs)
 
-	log.Printf("FS_IOC_ADD_ENCRYPTION_KEY(%q, %s, <raw>) = %v", mount.Path, descriptor, errno)
+	util.Debugf("FS_IOC_ADD_ENCRYPTION_KEY(%q, %s, <raw>) = %v", mount.Path, descriptor, errno)
+	if errno == unix.EDQUOT {
+		// The key is charged to the user the ioctl was run as.
+		uid := os.Geteuid()
+		if savedPrivs != nil {
+			uid = util.AtoiOrPanic(user.Uid)
+		}
+		return newErrKeyQuotaExceeded(uid)
+	}
 	if errno != 0 {
 		return errors.Wrapf(errno,
 			"error adding key with descriptor %s to filesystem %s",
 			descriptor, mount.Path)
 	}
-	if descriptor, err = validateKeyDescriptor(&arg.Key_spec, descriptor); err != nil {
-		fsRemoveEncryptionKey(descriptor, mount, user)
-		return err
-	}
+	*spec = arg.Key_spec
 	return nil
 }
 
@@ -245,7 +280,7 @@ func fsRemoveEncryptionKey(descriptor string, mount *filesystem.Mount,
 	_, _, errno := unix.Syscall(unix.SYS_IOCTL, dir.Fd(), ioc, uintptr(unsafe.Pointer(&arg)))
 	restorePrivs(savedPrivs)
 
-	log.Printf("%s(%q, %s) = %v, removal_status_flags=0x%x",
+	util.Debugf("%s(%q, %s) = %v, removal_status_flags=0x%x",
 		iocName, mount.Path, descriptor, errno, arg.Removal_status_flags)
 	switch errno {
 	case 0:
@@ -274,38 +309,49 @@ func fsRemoveEncryptionKey(descriptor string, mount *filesystem.Mount,
 	}
 }
 
-// fsGetEncryptionKeyStatus gets the status of the specified encryption key on
-// the specified filesystem.
-func fsGetEncryptionKeyStatus(descriptor string, mount *filesystem.Mount,
-	user *user.User) (KeyStatus, error) {
+// fsGetEncryptionKeyStatusArg runs FS_IOC_GET_ENCRYPTION_KEY_STATUS for the
+// specified encryption key on the specified filesystem.
+func fsGetEncryptionKeyStatusArg(descriptor string, mount *filesystem.Mount,
+	user *user.User) (*unix.FscryptGetKeyStatusArg, error) {
 
 	dir, err := os.Open(mount.Path)
 	if err != nil {
-		return KeyStatusUnknown, err
+		return nil, err
 	}
 	defer dir.Close()
 
 	var arg unix.FscryptGetKeyStatusArg
 	err = buildKeySpecifier(&arg.Key_spec, descriptor)
 	if err != nil {
-		return KeyStatusUnknown, err
+		return nil, err
 	}
 
 	savedPrivs, err := dropPrivsIfNeeded(user, &arg.Key_spec)
 	if err != nil {
-		return KeyStatusUnknown, err
+		return nil, err
 	}
 	_, _, errno := unix.Syscall(unix.SYS_IOCTL, dir.Fd(),
 		unix.FS_IOC_GET_ENCRYPTION_KEY_STATUS, uintptr(unsafe.Pointer(&arg)))
 	restorePrivs(savedPrivs)
 
-	log.Printf("FS_IOC_GET_ENCRYPTION_KEY_STATUS(%q, %s) = %v, status=%d, status_flags=0x%x",
-		mount.Path, descriptor, errno, arg.Status, arg.Status_flags)
+	util.Debugf("FS_IOC_GET_ENCRYPTION_KEY_STATUS(%q, %s) = %v, status=%d, status_flags=0x%x, user_count=%d",
+		mount.Path, descriptor, errno, arg.Status, arg.Status_flags, arg.User_count)
 	if errno != 0 {
-		return KeyStatusUnknown,
-			errors.Wrapf(errno,
-				"error getting status of key with descriptor %s on filesystem %s",
-				descriptor, mount.Path)
+		return nil, errors.Wrapf(errno,
+			"error getting status of key with descriptor %s on filesystem %s",
+			descriptor, mount.Path)
+	}
+	return &arg, nil
+}
+
+// fsGetEncryptionKeyStatus gets the status of the specified encryption key on
+// the specified filesystem.
+func fsGetEncryptionKeyStatus(descriptor string, mount *filesystem.Mount,
+	user *user.User) (KeyStatus, error) {
+
+	arg, err := fsGetEncryptionKeyStatusArg(descriptor, mount, user)
+	if err != nil {
+		return KeyStatusUnknown, err
 	}
 	switch arg.Status {
 	case unix.FSCRYPT_KEY_STATUS_ABSENT:
@@ -324,3 +370,19 @@ func fsGetEncryptionKeyStatus(descriptor string, mount *filesystem.Mount,
 				arg.Status, descriptor, mount.Path)
 	}
 }
+
+// fsGetEncryptionKeyUsers gets the number of users who have added the specified
+// v2 policy key to the specified filesystem, and whether user is one of them.
+func fsGetEncryptionKeyUsers(descriptor string, mount *filesystem.Mount,
+	user *user.User) (int, bool, error) {
+
+	arg, err := fsGetEncryptionKeyStatusArg(descriptor, mount, user)
+	if err != nil {
+		return 0, false, err
+	}
+	if arg.Status != unix.FSCRYPT_KEY_STATUS_PRESENT {
+		return 0, false, nil
+	}
+	addedBySelf := arg.Status_flags&unix.FSCRYPT_KEY_STATUS_FLAG_ADDED_BY_SELF != 0
+	return int(arg.User_count), addedBySelf, nil
+}
@@ -30,6 +30,7 @@ package keyring
 import (
 	"encoding/hex"
 	"os/user"
+	"sort"
 	"strconv"
 
 	"github.com/pkg/errors"
@@ -47,6 +48,7 @@ var (
 	ErrKeyFilesOpen          = errors.New("some files using the key are still open")
 	ErrKeyNotPresent         = errors.New("key not present or already removed")
 	ErrV2PoliciesUnsupported = errors.New("kernel is too old to support v2 encryption policies")
+	ErrKeyClaimantsNeedRoot  = errors.New("only root can see which users have added a key")
 )
 
 // Options are the options which specify *which* keyring the key should be
@@ -94,7 +96,7 @@ func buildKeyDescription(options *Options, descriptor string) string {
 
 // AddEncryptionKey adds an encryption policy key to a kernel keyring.  It uses
 // either the filesystem keyring for the target Mount or the user keyring for
-// the target User.
+// the target User. Transient failures are retried; see Retries.
 func AddEncryptionKey(key *crypto.Key, descriptor string, options *Options) error {
 	if err := util.CheckValidLength(metadata.PolicyKeyLen, key.Len()); err != nil {
 		return errors.Wrap(err, "policy key")
@@ -103,28 +105,59 @@ func AddEncryptionKey(key *crypto.Key, descriptor string, options *Options) erro
 	if err != nil {
 		return err
 	}
-	if useFsKeyring {
-		return fsAddEncryptionKey(key, descriptor, options.Mount, options.User)
+	return withRetries("adding key "+descriptor, func() error {
+		if useFsKeyring {
+			return fsAddEncryptionKey(key, descriptor, options.Mount, options.User)
+		}
+		return userAddKey(key, buildKeyDescription(options, descriptor), options.User)
+	})
+}
+
+// Raw keys for v2 encryption policies which aren't managed by fscrypt can have
+// any length the kernel accepts.
+const (
+	MinRawKeyLen = 16
+	MaxRawKeyLen = unix.FSCRYPT_MAX_KEY_SIZE
+)
+
+// AddRawEncryptionKey adds a raw key for v2 encryption policies, which needn't
+// belong to any fscrypt policy, to the filesystem keyring for the target Mount
+// on behalf of the target User. It returns the key's identifier, which the
+// kernel calculates from the key. Transient failures are retried; see Retries.
+func AddRawEncryptionKey(key *crypto.Key, options *Options) (string, error) {
+	if key.Len() < MinRawKeyLen || key.Len() > MaxRawKeyLen {
+		return "", errors.Errorf("raw key must be %d to %d bytes long, not %d",
+			MinRawKeyLen, MaxRawKeyLen, key.Len())
 	}
-	return userAddKey(key, buildKeyDescription(options, descriptor), options.User)
+	if !IsFsKeyringSupported(options.Mount) {
+		return "", ErrV2PoliciesUnsupported
+	}
+	var identifier string
+	err := withRetries("adding raw key", func() (err error) {
+		identifier, err = fsAddRawEncryptionKey(key, options.Mount, options.User)
+		return err
+	})
+	return identifier, err
 }
 
 // RemoveEncryptionKey removes an encryption policy key from a kernel keyring.
 // It uses either the filesystem keyring for the target Mount or the user
-// keyring for the target User.
+// keyring for the target User. Transient failures are retried; see Retries.
 func RemoveEncryptionKey(descriptor string, options *Options, allUsers bool) error {
 	useFsKeyring, err := shouldUseFsKeyring(descriptor, options)
 	if err != nil {
 		return err
 	}
-	if useFsKeyring {
-		user := options.User
-		if allUsers {
-			user = nil
+	return withRetries("removing key "+descriptor, func() error {
+		if useFsKeyring {
+			user := options.User
+			if allUsers {
+				user = nil
+			}
+			return fsRemoveEncryptionKey(descriptor, options.Mount, user)
 		}
-		return fsRemoveEncryptionKey(descriptor, options.Mount, user)
-	}
-	return userRemoveKey(buildKeyDescription(options, descriptor), options.User)
+		return userRemoveKey(buildKeyDescription(options, descriptor), options.User)
+	})
 }
 
 // KeyStatus is an enum that represents the status of a key in a kernel keyring.
@@ -173,3 +206,52 @@ func GetEncryptionKeyStatus(descriptor string, options *Options) (KeyStatus, err
 	}
 	return KeyPresent, nil
 }
+
+// GetEncryptionKeyUsers gets the number of users who have added a v2 policy key
+// to the filesystem keyring for the target Mount, and whether the target User is
+// one of them. The kernel only tracks this for v2 policy keys.
+func GetEncryptionKeyUsers(descriptor string, options *Options) (int, bool, error) {
+	if len(descriptor) != hex.EncodedLen(unix.FSCRYPT_KEY_IDENTIFIER_SIZE) {
+		return 0, false, errors.Errorf("key with descriptor %s isn't a v2 policy key",
+			descriptor)
+	}
+	if !IsFsKeyringSupported(options.Mount) {
+		return 0, false, ErrV2PoliciesUnsupported
+	}
+	return fsGetEncryptionKeyUsers(descriptor, options.Mount, options.User)
+}
+
+// GetEncryptionKeyClaimants returns the UIDs of the users who have added a v2
+// policy key to the filesystem keyring for the target Mount, in increasing
+// order. The kernel only tells a user whether they have added the key
+// themselves, so this asks on behalf of each user who has keys charged to them
+// in /proc/key-users, which requires root.
+func GetEncryptionKeyClaimants(descriptor string, options *Options) ([]int, error) {
+	count, _, err := GetEncryptionKeyUsers(descriptor, options)
+	if err != nil || count == 0 {
+		return nil, err
+	}
+	if !util.IsUserRoot() {
+		return nil, ErrKeyClaimantsNeedRoot
+	}
+	uids, err := keyUserUIDs()
+	if err != nil {
+		return nil, err
+	}
+	sort.Ints(uids)
+	var claimants []int
+	for _, uid := range uids {
+		_, addedBySelf, err := fsGetEncryptionKeyUsers(descriptor, options.Mount,
+			&user.User{Uid: strconv.Itoa(uid)})
+		if err != nil {
+			return nil, err
+		}
+		if addedBySelf {
+			claimants = append(claimants, uid)
+			if len(claimants) == count {
+				break
+			}
+		}
+	}
+	return claimants, nil
+}
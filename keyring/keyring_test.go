@@ -20,6 +20,7 @@ package keyring
 
 import (
 	"os/user"
+	"reflect"
 	"strconv"
 	"testing"
 
@@ -63,6 +64,18 @@ func assertKeyStatus(t *testing.T, descriptor string, options *Options,
 	}
 }
 
+func assertKeyUsers(t *testing.T, descriptor string, options *Options,
+	expectedCount int, expectedAddedBySelf bool) {
+	count, addedBySelf, err := GetEncryptionKeyUsers(descriptor, options)
+	if err != nil {
+		t.Error(err)
+	}
+	if count != expectedCount || addedBySelf != expectedAddedBySelf {
+		t.Errorf("Expected %d key users (added by self: %v) but got %d (added by self: %v)",
+			expectedCount, expectedAddedBySelf, count, addedBySelf)
+	}
+}
+
 // getTestMount retrieves the Mount for a test filesystem, or skips the test if
 // no test filesystem is available.
 func getTestMount(t *testing.T) *filesystem.Mount {
@@ -193,6 +206,20 @@ func TestV2PolicyKey(t *testing.T) {
 	testAddAndRemoveKey(t, fakeV2Descriptor, options)
 }
 
+// Tests adding and removing a key on a throwaway filesystem, so that the
+// filesystem keyring is exercised even without TEST_FILESYSTEM_ROOT.
+func TestV2PolicyKeyOnLoopbackMount(t *testing.T) {
+	mount := filesystem.NewLoopbackTestMount(t)
+	if !IsFsKeyringSupported(mount) {
+		t.Skip("No support for fs keyring, skipping test.")
+	}
+	options := &Options{
+		Mount: mount,
+		User:  testUser,
+	}
+	testAddAndRemoveKey(t, fakeV2Descriptor, options)
+}
+
 func TestV2PolicyKeyCannotBeRemovedByAnotherUser(t *testing.T) {
 	rootOptions, userOptions := getOptionsForFsKeyringUsers(t, 2)
 	user1Options := userOptions[0]
@@ -245,6 +272,8 @@ func TestV2PolicyKeyMultipleUsers(t *testing.T) {
 	assertKeyStatus(t, fakeV2Descriptor, user1Options, KeyPresent)
 	assertKeyStatus(t, fakeV2Descriptor, user2Options, KeyPresent)
 	assertKeyStatus(t, fakeV2Descriptor, rootOptions, KeyPresentButOnlyOtherUsers)
+	assertKeyUsers(t, fakeV2Descriptor, user1Options, 2, true)
+	assertKeyUsers(t, fakeV2Descriptor, rootOptions, 2, false)
 
 	// Remove key as one user.
 	err := RemoveEncryptionKey(fakeV2Descriptor, user1Options, false)
@@ -254,6 +283,8 @@ func TestV2PolicyKeyMultipleUsers(t *testing.T) {
 	assertKeyStatus(t, fakeV2Descriptor, user1Options, KeyPresentButOnlyOtherUsers)
 	assertKeyStatus(t, fakeV2Descriptor, user2Options, KeyPresent)
 	assertKeyStatus(t, fakeV2Descriptor, rootOptions, KeyPresentButOnlyOtherUsers)
+	assertKeyUsers(t, fakeV2Descriptor, user1Options, 1, false)
+	assertKeyUsers(t, fakeV2Descriptor, user2Options, 1, true)
 
 	// Remove key as the other user.
 	err = RemoveEncryptionKey(fakeV2Descriptor, user2Options, false)
@@ -263,6 +294,28 @@ func TestV2PolicyKeyMultipleUsers(t *testing.T) {
 	assertKeyStatus(t, fakeV2Descriptor, user1Options, KeyAbsent)
 	assertKeyStatus(t, fakeV2Descriptor, user2Options, KeyAbsent)
 	assertKeyStatus(t, fakeV2Descriptor, rootOptions, KeyAbsent)
+	assertKeyUsers(t, fakeV2Descriptor, rootOptions, 0, false)
+}
+
+// Tests that the users who have added a v2 policy key are listed.
+func TestV2PolicyKeyClaimants(t *testing.T) {
+	rootOptions, userOptions := getOptionsForFsKeyringUsers(t, 1)
+	if err := AddEncryptionKey(fakeValidPolicyKey, fakeV2Descriptor, userOptions[0]); err != nil {
+		t.Fatal(err)
+	}
+	defer RemoveEncryptionKey(fakeV2Descriptor, rootOptions, true)
+	if err := AddEncryptionKey(fakeValidPolicyKey, fakeV2Descriptor, rootOptions); err != nil {
+		t.Fatal(err)
+	}
+
+	claimants, err := GetEncryptionKeyClaimants(fakeV2Descriptor, rootOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []int{util.AtoiOrPanic(testUser.Uid), util.AtoiOrPanic(userOptions[0].User.Uid)}
+	if !reflect.DeepEqual(claimants, expected) {
+		t.Errorf("got claimants %v, expected %v", claimants, expected)
+	}
 }
 
 func TestV2PolicyKeyWrongDescriptor(t *testing.T) {
@@ -282,6 +335,40 @@ func TestV2PolicyKeyWrongDescriptor(t *testing.T) {
 	}
 }
 
+// Tests that a raw key added without a descriptor gets the identifier computed
+// from it, and that keys of lengths the kernel doesn't accept are rejected.
+func TestRawV2Key(t *testing.T) {
+	mount := getTestMountV2(t)
+	options := &Options{
+		Mount: mount,
+		User:  testUser,
+	}
+	identifier, err := AddRawEncryptionKey(fakeValidPolicyKey, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identifier != fakeV2Descriptor {
+		t.Errorf("got identifier %s, expected %s", identifier, fakeV2Descriptor)
+	}
+	assertKeyStatus(t, identifier, options, KeyPresent)
+	if err = RemoveEncryptionKey(identifier, options, false); err != nil {
+		t.Error(err)
+	}
+	assertKeyStatus(t, identifier, options, KeyAbsent)
+
+	for _, length := range []int{MinRawKeyLen - 1, MaxRawKeyLen + 1} {
+		key, err := makeKey(42, length)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if identifier, err = AddRawEncryptionKey(key, options); err == nil {
+			RemoveEncryptionKey(identifier, options, false)
+			t.Errorf("a raw key of %d bytes should have been rejected", length)
+		}
+		key.Wipe()
+	}
+}
+
 func TestV2PolicyKeyBadMount(t *testing.T) {
 	options := &Options{
 		Mount: &filesystem.Mount{Path: "/NONEXISTENT_MOUNT"},
@@ -328,3 +415,62 @@ func TestV2PolicyKeyRemoveForAllUsers(t *testing.T) {
 	assertKeyStatus(t, fakeV2Descriptor, user2Options, KeyAbsent)
 	assertKeyStatus(t, fakeV2Descriptor, rootOptions, KeyAbsent)
 }
+
+// findUserKey returns the key with the given description in the list returned
+// by ListUserKeys, or nil if it isn't listed.
+func findUserKey(t *testing.T, description string) *UserKey {
+	keys, err := ListUserKeys(testUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range keys {
+		if keys[i].Description == description {
+			return &keys[i]
+		}
+	}
+	return nil
+}
+
+func TestListAndRemoveUserKeys(t *testing.T) {
+	mount := getTestMount(t)
+	options := &Options{
+		Mount:                     mount,
+		User:                      testUser,
+		UseFsKeyringForV1Policies: false,
+	}
+	description := buildKeyDescription(options, fakeV1Descriptor)
+	if err := AddEncryptionKey(fakeValidPolicyKey, fakeV1Descriptor, options); err != nil {
+		t.Skip(err)
+	}
+	key := findUserKey(t, description)
+	if key == nil {
+		RemoveEncryptionKey(fakeV1Descriptor, options, false)
+		t.Fatalf("key %s was not listed", description)
+	}
+	if key.PolicyDescriptor != fakeV1Descriptor {
+		t.Errorf("key has policy descriptor %s, expected %s",
+			key.PolicyDescriptor, fakeV1Descriptor)
+	}
+	if err := RemoveUserKey(*key, testUser); err != nil {
+		t.Fatal(err)
+	}
+	assertKeyStatus(t, fakeV1Descriptor, options, KeyAbsent)
+	if findUserKey(t, description) != nil {
+		t.Errorf("key %s is still listed after being removed", description)
+	}
+}
+
+func TestUserKeyDescriptionRegex(t *testing.T) {
+	for _, description := range []string{"ext4:0123456789abcdef",
+		"f2fs:0123456789abcdef", "fscrypt:0123456789ABCDEF"} {
+		if !userKeyDescriptionRegex.MatchString(description) {
+			t.Errorf("%q should be recognized as an fscrypt key", description)
+		}
+	}
+	for _, description := range []string{"ext4:0123456789abcde",
+		"xfs:0123456789abcdef", "fscrypt:0123456789abcdef0", "_uid.0"} {
+		if userKeyDescriptionRegex.MatchString(description) {
+			t.Errorf("%q shouldn't be recognized as an fscrypt key", description)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+/*
+ * quota.go - Reporting that a user's kernel key quota is exhausted
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package keyring
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/google/fscrypt/util"
+)
+
+// KeyQuota is a user's usage and limits of the kernel's key quota. Keys added
+// to user keyrings, and keys for v2 policies added to filesystem keyrings, are
+// charged to it.
+type KeyQuota struct {
+	Keys     int
+	MaxKeys  int
+	Bytes    int
+	MaxBytes int
+}
+
+// ErrKeyQuotaExceeded indicates that a key couldn't be added because the key
+// quota of the user it is charged to is exhausted.
+type ErrKeyQuotaExceeded struct {
+	UID int
+	// Quota is nil if it couldn't be read.
+	Quota *KeyQuota
+}
+
+func (err *ErrKeyQuotaExceeded) Error() string {
+	msg := fmt.Sprintf("could not add key: the key quota of UID %d is exhausted",
+		err.UID)
+	if err.Quota != nil {
+		msg += fmt.Sprintf(" (%d/%d keys, %d/%d bytes in use)", err.Quota.Keys,
+			err.Quota.MaxKeys, err.Quota.Bytes, err.Quota.MaxBytes)
+	}
+	return msg
+}
+
+// Location of the file listing the key quota of each user
+var keyUsersPath = "/proc/key-users"
+
+// newErrKeyQuotaExceeded returns an ErrKeyQuotaExceeded with the current quota
+// of the user, if it can be read.
+func newErrKeyQuotaExceeded(uid int) error {
+	quota, err := readKeyQuota(uid)
+	if err != nil {
+		util.Debugf("could not read the key quota of UID %d: %v", uid, err)
+	}
+	return &ErrKeyQuotaExceeded{uid, quota}
+}
+
+// readKeyQuota returns the key quota of the user from /proc/key-users.
+func readKeyQuota(uid int) (*KeyQuota, error) {
+	file, err := os.Open(keyUsersPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return parseKeyQuota(file, uid)
+}
+
+// parseKeyQuota finds the user's line in the format of /proc/key-users, e.g.
+//
+//	1000:     5 5/5 5/200 180/20000
+//
+// which gives the UID, the usage count, the number of keys in total and
+// instantiated, and then the keys and bytes charged to the quota along with
+// their limits.
+func parseKeyQuota(reader io.Reader, uid int) (*KeyQuota, error) {
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 5 || fields[0] != strconv.Itoa(uid)+":" {
+			continue
+		}
+		var quota KeyQuota
+		if _, err := fmt.Sscanf(fields[3]+" "+fields[4], "%d/%d %d/%d",
+			&quota.Keys, &quota.MaxKeys, &quota.Bytes, &quota.MaxBytes); err != nil {
+			return nil, errors.Errorf("malformed line %q in %s", scanner.Text(), keyUsersPath)
+		}
+		return &quota, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, errors.Errorf("UID %d not found in %s", uid, keyUsersPath)
+}
+
+// keyUserUIDs returns the UIDs of the users which have keys charged to them,
+// from /proc/key-users.
+func keyUserUIDs() ([]int, error) {
+	file, err := os.Open(keyUsersPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return parseKeyUserUIDs(file)
+}
+
+// parseKeyUserUIDs returns the UIDs listed in the format of /proc/key-users.
+func parseKeyUserUIDs(reader io.Reader) ([]int, error) {
+	var uids []int
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		uid, err := strconv.Atoi(strings.TrimSuffix(fields[0], ":"))
+		if err != nil || !strings.HasSuffix(fields[0], ":") {
+			return nil, errors.Errorf("malformed line %q in %s", scanner.Text(), keyUsersPath)
+		}
+		uids = append(uids, uid)
+	}
+	return uids, scanner.Err()
+}
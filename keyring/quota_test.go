@@ -0,0 +1,81 @@
+/*
+ * quota_test.go - Tests for reporting exhausted key quotas
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package keyring
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testKeyUsers = `    0:    22 21/21 16/1000000 1379/25000000
+ 1000:     5 5/5 200/200 180/20000
+10000:     1 1/1 1/200 9/20000
+`
+
+func TestParseKeyQuota(t *testing.T) {
+	quota, err := parseKeyQuota(strings.NewReader(testKeyUsers), 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &KeyQuota{Keys: 200, MaxKeys: 200, Bytes: 180, MaxBytes: 20000}
+	if !reflect.DeepEqual(quota, expected) {
+		t.Errorf("got quota %+v, expected %+v", quota, expected)
+	}
+}
+
+func TestParseKeyQuotaMissingUser(t *testing.T) {
+	if _, err := parseKeyQuota(strings.NewReader(testKeyUsers), 100); err == nil {
+		t.Error("should have failed to find UID 100")
+	}
+}
+
+func TestParseKeyQuotaMalformed(t *testing.T) {
+	malformed := " 1000:     5 5/5 lots/200 180/20000\n"
+	if _, err := parseKeyQuota(strings.NewReader(malformed), 1000); err == nil {
+		t.Error("should have failed to parse the line")
+	}
+}
+
+func TestParseKeyUserUIDs(t *testing.T) {
+	uids, err := parseKeyUserUIDs(strings.NewReader(testKeyUsers))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []int{0, 1000, 10000}; !reflect.DeepEqual(uids, expected) {
+		t.Errorf("got UIDs %v, expected %v", uids, expected)
+	}
+	if _, err = parseKeyUserUIDs(strings.NewReader("root: 1 1/1 1/200 9/20000\n")); err == nil {
+		t.Error("should have failed to parse the line")
+	}
+}
+
+// Tests that the quota is only included in the message if it is known.
+func TestErrKeyQuotaExceededMessage(t *testing.T) {
+	err := &ErrKeyQuotaExceeded{1000, &KeyQuota{200, 200, 180, 20000}}
+	expected := "could not add key: the key quota of UID 1000 is exhausted " +
+		"(200/200 keys, 180/20000 bytes in use)"
+	if err.Error() != expected {
+		t.Errorf("got message %q, expected %q", err.Error(), expected)
+	}
+	err.Quota = nil
+	if strings.Contains(err.Error(), "in use") {
+		t.Errorf("message %q mentions an unknown quota", err.Error())
+	}
+}
@@ -0,0 +1,69 @@
+/*
+ * retry.go - Retrying keyring operations which fail transiently
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package keyring
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+
+	"github.com/google/fscrypt/util"
+)
+
+// DefaultRetries is the default value of Retries.
+const DefaultRetries = 3
+
+// Retries is how many times AddEncryptionKey and RemoveEncryptionKey retry an
+// operation which failed with an error that is likely to be transient, such as
+// ENOMEM or EAGAIN on a heavily loaded system. 0 disables retrying.
+var Retries = DefaultRetries
+
+// The delay before the first retry, which doubles for each further retry.
+const retryInitialDelay = 50 * time.Millisecond
+
+// sleep is replaced in tests so they don't have to wait.
+var sleep = time.Sleep
+
+// isRetriable returns true if err is an error from the kernel which may not
+// happen again if the same operation is retried.
+func isRetriable(err error) bool {
+	switch errors.Cause(err) {
+	case unix.ENOMEM, unix.EAGAIN:
+		return true
+	default:
+		return false
+	}
+}
+
+// withRetries runs op, and runs it again with exponential backoff while it
+// fails with a retriable error, up to Retries more times. Any other error is
+// returned immediately. The description of op is used for logging.
+func withRetries(description string, op func() error) error {
+	delay := retryInitialDelay
+	for retry := 0; ; retry++ {
+		err := op()
+		if err == nil || retry >= Retries || !isRetriable(err) {
+			return err
+		}
+		util.Warnf("%s failed (%v), retrying in %v", description, err, delay)
+		sleep(delay)
+		delay *= 2
+	}
+}
@@ -0,0 +1,116 @@
+/*
+ * retry_test.go - tests for retrying keyring operations
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package keyring
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// fakeKeyring fails with each of its errors in turn, then succeeds.
+type fakeKeyring struct {
+	errs  []error
+	calls int
+}
+
+func (k *fakeKeyring) addKey() error {
+	k.calls++
+	if k.calls <= len(k.errs) {
+		return k.errs[k.calls-1]
+	}
+	return nil
+}
+
+// fakeSleep records the delays instead of sleeping, until the test ends.
+func fakeSleep(t *testing.T) *[]time.Duration {
+	var delays []time.Duration
+	sleep = func(d time.Duration) { delays = append(delays, d) }
+	t.Cleanup(func() { sleep = time.Sleep })
+	return &delays
+}
+
+func TestRetriesTransientErrors(t *testing.T) {
+	delays := fakeSleep(t)
+	wrapped := errors.Wrap(unix.EAGAIN, "error adding key")
+	k := &fakeKeyring{errs: []error{unix.ENOMEM, wrapped}}
+
+	if err := withRetries("adding key", k.addKey); err != nil {
+		t.Fatal(err)
+	}
+	if k.calls != 3 {
+		t.Errorf("key was added %d times, expected 3", k.calls)
+	}
+	expected := []time.Duration{retryInitialDelay, 2 * retryInitialDelay}
+	if !reflect.DeepEqual(*delays, expected) {
+		t.Errorf("slept for %v, expected %v", *delays, expected)
+	}
+}
+
+func TestRetriesGiveUp(t *testing.T) {
+	fakeSleep(t)
+	k := &fakeKeyring{errs: make([]error, Retries+1)}
+	for i := range k.errs {
+		k.errs[i] = unix.ENOMEM
+	}
+
+	if err := withRetries("adding key", k.addKey); err != unix.ENOMEM {
+		t.Errorf("got error %v, expected ENOMEM", err)
+	}
+	if k.calls != Retries+1 {
+		t.Errorf("key was added %d times, expected %d", k.calls, Retries+1)
+	}
+}
+
+func TestRetriesDisabled(t *testing.T) {
+	fakeSleep(t)
+	defer func(retries int) { Retries = retries }(Retries)
+	Retries = 0
+	k := &fakeKeyring{errs: []error{unix.EAGAIN}}
+
+	if err := withRetries("adding key", k.addKey); err != unix.EAGAIN {
+		t.Errorf("got error %v, expected EAGAIN", err)
+	}
+	if k.calls != 1 {
+		t.Errorf("key was added %d times, expected 1", k.calls)
+	}
+}
+
+func TestNonRetriableErrorsFailImmediately(t *testing.T) {
+	delays := fakeSleep(t)
+	for _, err := range []error{
+		unix.EACCES,
+		errors.Wrap(unix.EINVAL, "error adding key"),
+		ErrKeyNotPresent,
+	} {
+		k := &fakeKeyring{errs: []error{err}}
+		if got := withRetries("adding key", k.addKey); got != err {
+			t.Errorf("got error %v, expected %v", got, err)
+		}
+		if k.calls != 1 {
+			t.Errorf("%v: key was added %d times, expected 1", err, k.calls)
+		}
+	}
+	if len(*delays) != 0 {
+		t.Errorf("slept for %v, expected no retries", *delays)
+	}
+}
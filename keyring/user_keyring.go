@@ -21,15 +21,18 @@
 package keyring
 
 import (
+	"encoding/hex"
+	"os"
 	"os/user"
+	"regexp"
 	"runtime"
+	"strings"
 	"unsafe"
 
 	"github.com/pkg/errors"
 	"golang.org/x/sys/unix"
 
 	"fmt"
-	"log"
 
 	"github.com/google/fscrypt/crypto"
 	"github.com/google/fscrypt/security"
@@ -62,6 +65,22 @@ func (err *ErrSessionUserKeyring) Error() string {
 // KeyType is always logon as required by filesystem encryption.
 const KeyType = "logon"
 
+// userKeyDescriptionRegex matches the descriptions which buildKeyDescription
+// gives to keys in user keyrings. The group is the policy descriptor.
+var userKeyDescriptionRegex = regexp.MustCompile(fmt.Sprintf(
+	"^(?:ext4:|f2fs:|%s)([[:xdigit:]]{%d})$", unix.FSCRYPT_KEY_DESC_PREFIX,
+	hex.EncodedLen(unix.FSCRYPT_KEY_DESCRIPTOR_SIZE)))
+
+// UserKey is an fscrypt policy key which was found in a user keyring.
+type UserKey struct {
+	// ID is the kernel's serial number for the key.
+	ID int
+	// Description is the key's description, e.g. "ext4:0123456789abcdef".
+	Description string
+	// PolicyDescriptor is the descriptor of the v1 policy the key is for.
+	PolicyDescriptor string
+}
+
 // userAddKey puts the provided policy key into the user keyring for the
 // specified user with the provided description, and type logon.
 func userAddKey(key *crypto.Key, description string, targetUser *user.User) error {
@@ -87,8 +106,13 @@ func userAddKey(key *crypto.Key, description string, targetUser *user.User) erro
 		return err
 	}
 	keyID, err := unix.AddKey(KeyType, description, payload.Data(), keyringID)
-	log.Printf("KeyctlAddKey(%s, %s, <data>, %d) = %d, %v",
+	util.Debugf("KeyctlAddKey(%s, %s, <data>, %d) = %d, %v",
 		KeyType, description, keyringID, keyID, err)
+	if err == unix.EDQUOT {
+		// The key is charged to the user adding it, not to the owner of
+		// the keyring.
+		return newErrKeyQuotaExceeded(os.Geteuid())
+	}
 	if err != nil {
 		return errors.Wrapf(err,
 			"error adding key with description %s to user keyring for %q",
@@ -109,7 +133,7 @@ func userRemoveKey(description string, targetUser *user.User) error {
 	}
 
 	_, err = unix.KeyctlInt(unix.KEYCTL_UNLINK, keyID, keyringID, 0, 0)
-	log.Printf("KeyctlUnlink(%d, %d) = %v", keyID, keyringID, err)
+	util.Debugf("KeyctlUnlink(%d, %d) = %v", keyID, keyringID, err)
 	if err != nil {
 		return errors.Wrapf(err,
 			"error removing key with description %s from user keyring for %q",
@@ -131,7 +155,7 @@ func userFindKey(description string, targetUser *user.User) (int, int, error) {
 	}
 
 	keyID, err := unix.KeyctlSearch(keyringID, KeyType, description, 0)
-	log.Printf("KeyctlSearch(%d, %s, %s) = %d, %v", keyringID, KeyType, description, keyID, err)
+	util.Debugf("KeyctlSearch(%d, %s, %s) = %d, %v", keyringID, KeyType, description, keyID, err)
 	if err != nil {
 		return 0, 0, errors.Wrapf(err,
 			"error searching for key %s in user keyring for %q",
@@ -140,6 +164,79 @@ func userFindKey(description string, targetUser *user.User) (int, int, error) {
 	return keyID, keyringID, err
 }
 
+// ListUserKeys returns the fscrypt policy keys directly in the user keyring for
+// the target user, as recognized by their type and description. Only keys for
+// v1 policies can be in a user keyring; keys in filesystem keyrings can't be
+// enumerated.
+func ListUserKeys(targetUser *user.User) ([]UserKey, error) {
+	runtime.LockOSThread() // ensure target user keyring remains possessed in thread keyring
+	defer runtime.UnlockOSThread()
+
+	keyringID, err := UserKeyringID(targetUser, false)
+	if err != nil {
+		return nil, err
+	}
+	keyIDs, err := readKeyring(keyringID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error reading user keyring for %q",
+			targetUser.Username)
+	}
+
+	var keys []UserKey
+	for _, keyID := range keyIDs {
+		// The description is formatted as "type;uid;gid;perm;description".
+		info, err := unix.KeyctlString(unix.KEYCTL_DESCRIBE, keyID)
+		util.Debugf("KeyctlDescribe(%d) = %q, %v", keyID, info, err)
+		if err != nil {
+			// The key may have been removed in the meantime.
+			continue
+		}
+		fields := strings.SplitN(info, ";", 5)
+		if len(fields) != 5 || fields[0] != KeyType {
+			continue
+		}
+		matches := userKeyDescriptionRegex.FindStringSubmatch(fields[4])
+		if matches == nil {
+			continue
+		}
+		keys = append(keys, UserKey{keyID, fields[4], matches[1]})
+	}
+	return keys, nil
+}
+
+// readKeyring returns the IDs of the keys which are linked into a keyring.
+func readKeyring(keyringID int) ([]int, error) {
+	var buf []byte
+	for {
+		size, err := unix.KeyctlBuffer(unix.KEYCTL_READ, keyringID, buf, 0)
+		if err != nil {
+			return nil, err
+		}
+		// Keys may be added between calls, so retry until the buffer
+		// is large enough.
+		if size <= len(buf) {
+			buf = buf[:size]
+			break
+		}
+		buf = make([]byte, size)
+	}
+
+	const idSize = int(unsafe.Sizeof(int32(0)))
+	keyIDs := make([]int, 0, len(buf)/idSize)
+	for i := 0; i+idSize <= len(buf); i += idSize {
+		keyIDs = append(keyIDs, int(*(*int32)(unsafe.Pointer(&buf[i]))))
+	}
+	return keyIDs, nil
+}
+
+// RemoveUserKey removes a key found by ListUserKeys from the user keyring for
+// the target user. Transient failures are retried; see Retries.
+func RemoveUserKey(key UserKey, targetUser *user.User) error {
+	return withRetries("removing key "+key.Description, func() error {
+		return userRemoveKey(key.Description, targetUser)
+	})
+}
+
 // UserKeyringID returns the key id of the target user's user keyring. We also
 // ensure that the keyring will be accessible by linking it into the thread
 // keyring and linking it into the root user keyring (permissions allowing). If
@@ -208,7 +305,7 @@ func userKeyringIDLookup(uid int) (keyringID int, err error) {
 	// We get the value of KEY_SPEC_USER_KEYRING. Note that this will also
 	// trigger the creation of the uid keyring if it does not yet exist.
 	keyringID, err = unix.KeyctlGetKeyringID(unix.KEY_SPEC_USER_KEYRING, true)
-	log.Printf("keyringID(_uid.%d) = %d, %v", uid, keyringID, err)
+	util.Debugf("keyringID(_uid.%d) = %d, %v", uid, keyringID, err)
 	if err != nil {
 		return 0, err
 	}
@@ -233,19 +330,19 @@ func isUserKeyringInSession(uid int) bool {
 	// We cannot use unix.KEY_SPEC_SESSION_KEYRING directly as that might
 	// create a session keyring if one does not exist.
 	sessionKeyring, err := unix.KeyctlGetKeyringID(unix.KEY_SPEC_SESSION_KEYRING, false)
-	log.Printf("keyringID(session) = %d, %v", sessionKeyring, err)
+	util.Debugf("keyringID(session) = %d, %v", sessionKeyring, err)
 	if err != nil {
 		return false
 	}
 
 	description := fmt.Sprintf("_uid.%d", uid)
 	id, err := unix.KeyctlSearch(sessionKeyring, "keyring", description, 0)
-	log.Printf("KeyctlSearch(%d, keyring, %s) = %d, %v", sessionKeyring, description, id, err)
+	util.Debugf("KeyctlSearch(%d, keyring, %s) = %d, %v", sessionKeyring, description, id, err)
 	return err == nil
 }
 
 func keyringLink(keyID int, keyringID int) error {
 	_, err := unix.KeyctlInt(unix.KEYCTL_LINK, keyID, keyringID, 0, 0)
-	log.Printf("KeyctlLink(%d, %d) = %v", keyID, keyringID, err)
+	util.Debugf("KeyctlLink(%d, %d) = %v", keyID, keyringID, err)
 	return err
 }
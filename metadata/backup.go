@@ -0,0 +1,116 @@
+/*
+ * backup.go - Serializing all the metadata of a filesystem into a single file
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package metadata
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/pkg/errors"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/google/fscrypt/util"
+)
+
+// ErrBackupChecksum indicates that a backup file was modified or truncated.
+var ErrBackupChecksum = errors.New("backup file is corrupted (its SHA-256 hash doesn't match)")
+
+// checkHexDescriptor ensures that a descriptor is made of hex digits, as it is
+// used in the names of files.
+func checkHexDescriptor(descriptor string) error {
+	if _, err := hex.DecodeString(descriptor); err != nil {
+		return errors.Errorf("descriptor %q is not in hex", descriptor)
+	}
+	return nil
+}
+
+// CheckValidity ensures each protector and policy in the backup is valid, and
+// that the descriptors can't be used to write outside the metadata directory.
+func (b *MetadataBackup) CheckValidity() error {
+	if b == nil {
+		return errNotInitialized
+	}
+	for _, protector := range b.Protectors {
+		if err := protector.GetData().CheckValidity(); err != nil {
+			return errors.Wrap(err, "protector")
+		}
+		if err := checkHexDescriptor(protector.Data.ProtectorDescriptor); err != nil {
+			return err
+		}
+	}
+	for _, policy := range b.Policies {
+		if err := policy.GetData().CheckValidity(); err != nil {
+			return errors.Wrap(err, "policy")
+		}
+		if err := checkHexDescriptor(policy.Data.KeyDescriptor); err != nil {
+			return err
+		}
+	}
+	for _, descriptor := range b.LinkedProtectors {
+		if err := util.CheckValidLength(ProtectorDescriptorLen, len(descriptor)); err != nil {
+			return errors.Wrap(err, "linked protector descriptor")
+		}
+		if err := checkHexDescriptor(descriptor); err != nil {
+			return err
+		}
+	}
+	if len(b.NameKey) != 0 {
+		if err := util.CheckValidLength(InternalKeyLen, len(b.NameKey)); err != nil {
+			return errors.Wrap(err, "protector name key")
+		}
+	}
+	return nil
+}
+
+// MarshalBackup serializes the backup into the contents of a backup file,
+// along with its hash.
+func MarshalBackup(backup *MetadataBackup) ([]byte, error) {
+	if err := backup.CheckValidity(); err != nil {
+		return nil, errors.Wrap(err, "invalid backup")
+	}
+	data, err := proto.Marshal(backup)
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256(data)
+	return proto.Marshal(&MetadataBackupFile{Backup: data, Sha256: hash[:]})
+}
+
+// UnmarshalBackup parses the contents of a backup file written by
+// MarshalBackup, after checking its hash. The metadata in it is checked for
+// validity too.
+func UnmarshalBackup(contents []byte) (*MetadataBackup, error) {
+	file := new(MetadataBackupFile)
+	if err := proto.Unmarshal(contents, file); err != nil {
+		return nil, errors.Wrap(err, "not an fscrypt metadata backup")
+	}
+	hash := sha256.Sum256(file.Backup)
+	if !bytes.Equal(hash[:], file.Sha256) {
+		return nil, ErrBackupChecksum
+	}
+	backup := new(MetadataBackup)
+	if err := proto.Unmarshal(file.Backup, backup); err != nil {
+		return nil, errors.Wrap(err, "not an fscrypt metadata backup")
+	}
+	if err := backup.CheckValidity(); err != nil {
+		return nil, errors.Wrap(err, "invalid backup")
+	}
+	return backup, nil
+}
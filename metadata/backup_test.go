@@ -0,0 +1,78 @@
+/*
+ * backup_test.go - tests for serializing the metadata of a filesystem
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package metadata
+
+import (
+	"bytes"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+)
+
+var testBackup = &MetadataBackup{
+	Policies: []*BackupPolicy{
+		{Data: goodV1Policy, OwnerUid: 0, Label: "home"},
+		{Data: goodV2Policy, OwnerUid: 1000},
+	},
+	LinkedProtectors: []string{"0123456789abcdef"},
+	NameKey:          bytes.Repeat([]byte{0x42}, InternalKeyLen),
+}
+
+// Tests that a backup is read back unchanged.
+func TestBackupRoundTrip(t *testing.T) {
+	contents, err := MarshalBackup(testBackup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backup, err := UnmarshalBackup(contents)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !proto.Equal(backup, testBackup) {
+		t.Errorf("got %v, expected %v", backup, testBackup)
+	}
+}
+
+// Tests that modified backups are rejected.
+func TestBackupChecksum(t *testing.T) {
+	contents, err := MarshalBackup(testBackup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Change the label, which is near the start of the serialized backup.
+	corrupted := bytes.Replace(contents, []byte("home"), []byte("hone"), 1)
+	if bytes.Equal(corrupted, contents) {
+		t.Fatal("label not found in backup")
+	}
+	if _, err = UnmarshalBackup(corrupted); err != ErrBackupChecksum {
+		t.Errorf("expected %v, got %v", ErrBackupChecksum, err)
+	}
+	if _, err = UnmarshalBackup(contents[:len(contents)-1]); err == nil {
+		t.Error("truncated backup was accepted")
+	}
+}
+
+// Tests that descriptors which aren't in hex are rejected, so that restoring a
+// backup can't write outside of the metadata directory.
+func TestBackupBadDescriptor(t *testing.T) {
+	backup := &MetadataBackup{LinkedProtectors: []string{"../../etc/passwd"}}
+	if _, err := MarshalBackup(backup); err == nil {
+		t.Error("backup with a bad descriptor was accepted")
+	}
+}
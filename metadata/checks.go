@@ -20,8 +20,8 @@
 package metadata
 
 import (
-	"log"
 	"math"
+	"path/filepath"
 
 	"github.com/pkg/errors"
 	"google.golang.org/protobuf/proto"
@@ -63,11 +63,22 @@ func (s SourceType) CheckValidity() error {
 // MaxParallelism is the maximum allowed value for HashingCosts.Parallelism.
 const MaxParallelism = math.MaxUint8
 
-// CheckValidity ensures the hash costs will be accepted by Argon2.
+// MaxScryptParallelization is the maximum allowed time cost of scrypt, which is
+// its parallelization p. scrypt requires r*p < 2^30.
+const MaxScryptParallelization = (1<<30 - 1) / ScryptBlockSize
+
+// CheckValidity ensures the hash costs will be accepted by Argon2 (or scrypt).
 func (h *HashingCosts) CheckValidity() error {
 	if h == nil {
 		return errNotInitialized
 	}
+	switch h.Kdf {
+	case KDF_argon2id:
+	case KDF_scrypt:
+		return h.checkScryptValidity()
+	default:
+		return errors.Errorf("unknown KDF %d", h.Kdf)
+	}
 
 	minP := int64(1)
 	p := uint8(h.Parallelism)
@@ -78,7 +89,7 @@ func (h *HashingCosts) CheckValidity() error {
 		}
 		// Previously we unconditionally casted costs.Parallelism to a uint8,
 		// so we replicate this behavior for backwards compatibility.
-		log.Printf("WARNING: Truncating parallelism cost of %d to %d", h.Parallelism, p)
+		util.Warnf("Truncating parallelism cost of %d to %d", h.Parallelism, p)
 	}
 
 	minT := int64(1)
@@ -95,6 +106,23 @@ func (h *HashingCosts) CheckValidity() error {
 	return nil
 }
 
+// checkScryptValidity ensures the hash costs will be accepted by scrypt.
+func (h *HashingCosts) checkScryptValidity() error {
+	if h.Parallelism != 1 {
+		return errors.Errorf("parallelism cost %d must be 1 for scrypt", h.Parallelism)
+	}
+	if h.Time < 1 || h.Time > MaxScryptParallelization {
+		return errors.Errorf("time cost %d is not in range [1, %d]",
+			h.Time, MaxScryptParallelization)
+	}
+	// N must be a power of 2 greater than 1.
+	if h.Memory < 2 || h.Memory > math.MaxUint32 || h.Memory&(h.Memory-1) != 0 {
+		return errors.Errorf("memory cost %d KiB is not a power of 2 in range [2, %d]",
+			h.Memory, int64(math.MaxUint32))
+	}
+	return nil
+}
+
 // CheckValidity ensures our buffers are the correct length.
 func (w *WrappedKeyData) CheckValidity() error {
 	if w == nil {
@@ -126,12 +154,67 @@ func (p *ProtectorData) CheckValidity() error {
 			return errors.Errorf("UID=%d is negative", p.Uid)
 		}
 		fallthrough
-	case SourceType_custom_passphrase:
-		if err := p.Costs.CheckValidity(); err != nil {
-			return errors.Wrap(err, "passphrase hashing costs")
+	case SourceType_custom_passphrase, SourceType_passphrase_and_raw_key:
+		if err := p.checkPassphraseHashing(); err != nil {
+			return err
+		}
+	case SourceType_yubikey:
+		if p.YubikeySlot != 1 && p.YubikeySlot != 2 {
+			return errors.Errorf("YubiKey slot %d is not 1 or 2", p.YubikeySlot)
+		}
+		if err := util.CheckValidLength(YubiKeyChallengeLen, len(p.YubikeyChallenge)); err != nil {
+			return errors.Wrap(err, "YubiKey challenge")
+		}
+		if err := p.checkPassphraseHashing(); err != nil {
+			return err
+		}
+	case SourceType_fido2:
+		if len(p.Fido2CredentialId) == 0 {
+			return errors.Wrap(errNotInitialized, "FIDO2 credential ID")
+		}
+		if err := util.CheckValidLength(FIDO2SaltLen, len(p.Fido2Salt)); err != nil {
+			return errors.Wrap(err, "FIDO2 salt")
+		}
+	case SourceType_tpm2:
+		if len(p.Tpm2Public) == 0 || len(p.Tpm2Private) == 0 {
+			return errors.Wrap(errNotInitialized, "TPM sealed object")
+		}
+		for _, pcr := range p.Tpm2Pcrs {
+			if pcr >= TPM2NumPCRs {
+				return errors.Errorf("PCR %d is out of range", pcr)
+			}
 		}
-		if err := util.CheckValidLength(SaltLen, len(p.Salt)); err != nil {
-			return errors.Wrap(err, "passphrase hashing salt")
+	case SourceType_pkcs11:
+		if p.Pkcs11Module == "" || len(p.Pkcs11KeyId) == 0 {
+			return errors.Wrap(errNotInitialized, "PKCS#11 key")
+		}
+		if len(p.Pkcs11PublicKey) == 0 || len(p.Pkcs11WrappedKey) == 0 {
+			return errors.Wrap(errNotInitialized, "PKCS#11 wrapped key")
+		}
+	case SourceType_kms:
+		if p.KmsKey == "" {
+			return errors.Wrap(errNotInitialized, "KMS key name")
+		}
+		if len(p.KmsWrappedKey) == 0 {
+			return errors.Wrap(errNotInitialized, "KMS wrapped key")
+		}
+	case SourceType_tang:
+		if p.TangUrl == "" || p.TangServerKey == "" {
+			return errors.Wrap(errNotInitialized, "Tang server")
+		}
+		if len(p.TangClientKey) == 0 {
+			return errors.Wrap(errNotInitialized, "Tang client key")
+		}
+	case SourceType_gpg:
+		if len(p.GpgWrappedKey) == 0 {
+			return errors.Wrap(errNotInitialized, "GPG wrapped key")
+		}
+	case SourceType_ssh_agent:
+		if len(p.SshPublicKey) == 0 {
+			return errors.Wrap(errNotInitialized, "SSH public key")
+		}
+		if err := util.CheckValidLength(SSHChallengeLen, len(p.SshChallenge)); err != nil {
+			return errors.Wrap(err, "SSH challenge")
 		}
 	}
 
@@ -139,14 +222,57 @@ func (p *ProtectorData) CheckValidity() error {
 	if err := p.WrappedKey.CheckValidity(); err != nil {
 		return errors.Wrap(err, "wrapped protector key")
 	}
+	if p.EncryptedName != nil {
+		if err := p.EncryptedName.CheckValidity(); err != nil {
+			return errors.Wrap(err, "encrypted protector name")
+		}
+	}
 	if err := util.CheckValidLength(ProtectorDescriptorLen, len(p.ProtectorDescriptor)); err != nil {
 		return errors.Wrap(err, "protector descriptor")
 
 	}
+	if err := checkMetadataHMAC(p.MetadataHmac); err != nil {
+		return err
+	}
+	if p.Access != nil {
+		if err := p.Access.CheckValidity(); err != nil {
+			return errors.Wrap(err, "protector access")
+		}
+	}
 	err := util.CheckValidLength(InternalKeyLen, len(p.WrappedKey.EncryptedKey))
 	return errors.Wrap(err, "encrypted protector key")
 }
 
+// CheckValidity ensures the user and group IDs are valid.
+func (a *ProtectorAccess) CheckValidity() error {
+	if a == nil {
+		return errNotInitialized
+	}
+	if a.OwnerUid < 0 {
+		return errors.Errorf("owner UID of %d is invalid", a.OwnerUid)
+	}
+	for _, uid := range a.AllowedUids {
+		if uid < 0 {
+			return errors.Errorf("allowed UID of %d is invalid", uid)
+		}
+	}
+	for _, gid := range a.AllowedGids {
+		if gid < 0 {
+			return errors.Errorf("allowed GID of %d is invalid", gid)
+		}
+	}
+	return nil
+}
+
+// checkPassphraseHashing checks the costs and salt of a passphrase source.
+func (p *ProtectorData) checkPassphraseHashing() error {
+	if err := p.Costs.CheckValidity(); err != nil {
+		return errors.Wrap(err, "passphrase hashing costs")
+	}
+	err := util.CheckValidLength(SaltLen, len(p.Salt))
+	return errors.Wrap(err, "passphrase hashing salt")
+}
+
 // CheckValidity ensures each of the options is valid.
 func (e *EncryptionOptions) CheckValidity() error {
 	if e == nil {
@@ -168,7 +294,21 @@ func (e *EncryptionOptions) CheckValidity() error {
 	if e.PolicyVersion != 1 && e.PolicyVersion != 2 {
 		return errors.Errorf("policy version of %d is invalid", e.PolicyVersion)
 	}
-	return nil
+	if err := e.checkModes(); err != nil {
+		return err
+	}
+	if e.DataUnitSize != 0 {
+		if e.DataUnitSize < minDataUnitSize || e.DataUnitSize&(e.DataUnitSize-1) != 0 {
+			return errors.Errorf("data unit size of %d is invalid", e.DataUnitSize)
+		}
+		if e.PolicyVersion != 2 {
+			return errors.New("data unit size requires policy version 2")
+		}
+	}
+	if e.NoDirectKey && !e.SupportsDirectKey() {
+		return ErrDirectKeyUnsupported
+	}
+	return e.checkStableInodeFlags()
 }
 
 // CheckValidity ensures the fields are valid and have the correct lengths.
@@ -176,10 +316,23 @@ func (w *WrappedPolicyKey) CheckValidity() error {
 	if w == nil {
 		return errNotInitialized
 	}
-	if err := w.WrappedKey.CheckValidity(); err != nil {
-		return errors.Wrap(err, "wrapped key")
+	// Exactly one of the key and a share of it is wrapped.
+	wrapped, name := w.WrappedKey, "wrapped key"
+	if w.WrappedShare != nil {
+		if w.WrappedKey != nil {
+			return errors.New("both a key and a key share are wrapped")
+		}
+		if w.ShareIndex < 1 || w.ShareIndex > maxShareIndex {
+			return errors.Errorf("key share index of %d is invalid", w.ShareIndex)
+		}
+		wrapped, name = w.WrappedShare, "wrapped key share"
+	} else if w.ShareIndex != 0 {
+		return errors.New("key share index is set without a key share")
 	}
-	if err := util.CheckValidLength(PolicyKeyLen, len(w.WrappedKey.EncryptedKey)); err != nil {
+	if err := wrapped.CheckValidity(); err != nil {
+		return errors.Wrap(err, name)
+	}
+	if err := util.CheckValidLength(PolicyKeyLen, len(wrapped.EncryptedKey)); err != nil {
 		return errors.Wrap(err, "encrypted key")
 	}
 	err := util.CheckValidLength(ProtectorDescriptorLen, len(w.ProtectorDescriptor))
@@ -197,6 +350,9 @@ func (p *PolicyData) CheckValidity() error {
 			return errors.Wrapf(err, "policy key slot %d", i)
 		}
 	}
+	if err := p.checkThreshold(); err != nil {
+		return err
+	}
 
 	if err := p.Options.CheckValidity(); err != nil {
 		return errors.Wrap(err, "policy options")
@@ -216,6 +372,35 @@ func (p *PolicyData) CheckValidity() error {
 		return errors.Wrap(err, "policy key descriptor")
 	}
 
+	return checkMetadataHMAC(p.MetadataHmac)
+}
+
+// Key shares are identified by a nonzero byte (see crypto.SplitKey), which
+// also limits the threshold.
+const maxShareIndex = 255
+
+// checkThreshold ensures that the policy key is wrapped whole if the threshold is
+// 1, and otherwise that there are enough distinct shares of it to unlock it.
+func (p *PolicyData) checkThreshold() error {
+	if p.Threshold < 0 || p.Threshold > maxShareIndex {
+		return errors.Errorf("threshold of %d is invalid", p.Threshold)
+	}
+	useShares := p.Threshold > 1
+	seen := make(map[int64]bool)
+	for i, w := range p.WrappedPolicyKeys {
+		if (w.WrappedShare != nil) != useShares {
+			return errors.Errorf("policy key slot %d doesn't match the threshold of %d",
+				i, p.Threshold)
+		}
+		if useShares && seen[w.ShareIndex] {
+			return errors.Errorf("key share index %d is repeated", w.ShareIndex)
+		}
+		seen[w.ShareIndex] = true
+	}
+	if useShares && int64(len(p.WrappedPolicyKeys)) < p.Threshold {
+		return errors.Errorf("policy has %d key shares, but a threshold of %d",
+			len(p.WrappedPolicyKeys), p.Threshold)
+	}
 	return nil
 }
 
@@ -231,11 +416,21 @@ func (c *Config) CheckValidity() error {
 
 	// Source specific checks
 	switch c.Source {
-	case SourceType_pam_passphrase, SourceType_custom_passphrase:
+	case SourceType_pam_passphrase, SourceType_custom_passphrase,
+		SourceType_passphrase_and_raw_key, SourceType_yubikey:
 		if err := c.HashCosts.CheckValidity(); err != nil {
 			return errors.Wrap(err, "config hashing costs")
 		}
 	}
+	if c.YubikeySlot > 2 {
+		return errors.Errorf("YubiKey slot %d is not 1 or 2", c.YubikeySlot)
+	}
+	for mountpoint, dir := range c.MetadataDirs {
+		if !filepath.IsAbs(mountpoint) || !filepath.IsAbs(dir) {
+			return errors.Errorf("metadata directory %q of %q is not an absolute path",
+				dir, mountpoint)
+		}
+	}
 
 	return errors.Wrap(c.Options.CheckValidity(), "config options")
 }
@@ -44,16 +44,38 @@ var testConfigString = `{
 		"time": "10",
 		"memory": "4096",
 		"parallelism": "8",
-		"truncation_fixed": true
+		"truncation_fixed": true,
+		"kdf": "argon2id"
 	},
 	"options": {
 		"padding": "32",
 		"contents": "AES_256_XTS",
 		"filenames": "AES_256_CTS",
-		"policy_version": "1"
+		"policy_version": "1",
+		"data_unit_size": "0",
+		"no_direct_key": false,
+		"iv_ino_lblk_64": false,
+		"iv_ino_lblk_32": false
 	},
 	"use_fs_keyring_for_v1_policies": false,
-	"allow_cross_user_metadata": false
+	"allow_cross_user_metadata": false,
+	"encrypt_protector_names": false,
+	"post_unlock_hook": "",
+	"post_lock_hook": "",
+	"keystore_dir": "",
+	"profiles": {},
+	"pkcs11_module": "",
+	"pkcs11_slot": "",
+	"pkcs11_key_id": "",
+	"kms_key": "",
+	"tang_url": "",
+	"tang_thumbprint": "",
+	"yubikey_slot": 0,
+	"gpg_recipient": "",
+	"ssh_key": "",
+	"suspend_lock_policies": [],
+	"store_policies_in_xattrs": false,
+	"metadata_dirs": {}
 }
 `
 
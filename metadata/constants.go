@@ -37,6 +37,19 @@ const (
 	InternalKeyLen = 32
 	IVLen          = 16
 	SaltLen        = 16
+	// The FIDO2 hmac-secret extension takes 32-byte salts.
+	FIDO2SaltLen = 32
+	// TPM 2.0 PC Client platforms have PCRs 0 through 23.
+	TPM2NumPCRs = 24
+	// YubiKey HMAC-SHA1 challenge-response takes challenges of up to 64
+	// bytes, and gives 20-byte responses.
+	YubiKeyChallengeLen = 32
+	YubiKeyResponseLen  = 20
+	// ssh-agent signs 32-byte random challenges.
+	SSHChallengeLen = 32
+	// scrypt hashes passphrases with the usual block size r = 8, so that its
+	// cost N is the memory used in KiB.
+	ScryptBlockSize = 8
 	// We use SHA256 for the HMAC, and len(HMAC) == len(hash size).
 	HMACLen = sha256.Size
 	// PolicyKeyLen is the length of all keys passed directly to the Keyring
@@ -0,0 +1,71 @@
+/*
+ * integrity.go - The fields of protectors and policies which are authenticated
+ * by their metadata HMAC
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package metadata
+
+import (
+	"github.com/pkg/errors"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/google/fscrypt/util"
+)
+
+// AuthenticatedMetadata is a protector or policy whose fields are authenticated
+// by an HMAC keyed off its key (see crypto.MetadataHMAC).
+type AuthenticatedMetadata interface {
+	// AuthenticatedData serializes the fields covered by the HMAC.
+	AuthenticatedData() ([]byte, error)
+	// GetMetadataHmac returns the stored HMAC, which is empty for metadata
+	// written before the HMAC was added.
+	GetMetadataHmac() []byte
+}
+
+// The serialization of the authenticated fields must not change between runs.
+var authenticatedMarshalOptions = proto.MarshalOptions{Deterministic: true}
+
+// AuthenticatedData serializes all the fields of the protector except for its
+// name (which can be changed without the protector key, and may be encrypted
+// separately), its schema version, and the HMAC itself.
+func (p *ProtectorData) AuthenticatedData() ([]byte, error) {
+	authenticated := proto.Clone(p).(*ProtectorData)
+	authenticated.Name = ""
+	authenticated.EncryptedName = nil
+	authenticated.SchemaVersion = 0
+	authenticated.MetadataHmac = nil
+	return authenticatedMarshalOptions.Marshal(authenticated)
+}
+
+// AuthenticatedData serializes the key descriptor, options, and threshold of
+// the policy. The wrapped keys aren't included, as protectors can be removed
+// without the policy key, and each of them is authenticated on its own.
+func (p *PolicyData) AuthenticatedData() ([]byte, error) {
+	return authenticatedMarshalOptions.Marshal(&PolicyData{
+		KeyDescriptor: p.KeyDescriptor,
+		Options:       p.Options,
+		Threshold:     p.Threshold,
+	})
+}
+
+// checkMetadataHMAC checks the length of a stored metadata HMAC, if any.
+func checkMetadataHMAC(hmac []byte) error {
+	if len(hmac) == 0 {
+		return nil
+	}
+	return errors.Wrap(util.CheckValidLength(HMACLen, len(hmac)), "metadata HMAC")
+}
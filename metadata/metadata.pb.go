@@ -43,29 +43,105 @@ const (
 	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
 )
 
+// The key derivation functions used to hash passphrases.
+type KDF int32
+
+const (
+	KDF_argon2id KDF = 0
+	// For scrypt, memory is the cost N (which, with r = 8, is also the memory
+	// used in KiB), time is the parallelization p, and parallelism must be 1.
+	KDF_scrypt KDF = 1
+)
+
+// Enum value maps for KDF.
+var (
+	KDF_name = map[int32]string{
+		0: "argon2id",
+		1: "scrypt",
+	}
+	KDF_value = map[string]int32{
+		"argon2id": 0,
+		"scrypt":   1,
+	}
+)
+
+func (x KDF) Enum() *KDF {
+	p := new(KDF)
+	*p = x
+	return p
+}
+
+func (x KDF) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (KDF) Descriptor() protoreflect.EnumDescriptor {
+	return file_metadata_metadata_proto_enumTypes[0].Descriptor()
+}
+
+func (KDF) Type() protoreflect.EnumType {
+	return &file_metadata_metadata_proto_enumTypes[0]
+}
+
+func (x KDF) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use KDF.Descriptor instead.
+func (KDF) EnumDescriptor() ([]byte, []int) {
+	return file_metadata_metadata_proto_rawDescGZIP(), []int{0}
+}
+
 // Specifies the method in which an outside secret is obtained for a Protector
 type SourceType int32
 
 const (
-	SourceType_default           SourceType = 0
-	SourceType_pam_passphrase    SourceType = 1
-	SourceType_custom_passphrase SourceType = 2
-	SourceType_raw_key           SourceType = 3
+	SourceType_default                SourceType = 0
+	SourceType_pam_passphrase         SourceType = 1
+	SourceType_custom_passphrase      SourceType = 2
+	SourceType_raw_key                SourceType = 3
+	SourceType_fido2                  SourceType = 4
+	SourceType_tpm2                   SourceType = 5
+	SourceType_pkcs11                 SourceType = 6
+	SourceType_kms                    SourceType = 7
+	SourceType_tang                   SourceType = 8
+	SourceType_passphrase_and_raw_key SourceType = 9
+	SourceType_yubikey                SourceType = 10
+	SourceType_gpg                    SourceType = 11
+	SourceType_ssh_agent              SourceType = 12
 )
 
 // Enum value maps for SourceType.
 var (
 	SourceType_name = map[int32]string{
-		0: "default",
-		1: "pam_passphrase",
-		2: "custom_passphrase",
-		3: "raw_key",
+		0:  "default",
+		1:  "pam_passphrase",
+		2:  "custom_passphrase",
+		3:  "raw_key",
+		4:  "fido2",
+		5:  "tpm2",
+		6:  "pkcs11",
+		7:  "kms",
+		8:  "tang",
+		9:  "passphrase_and_raw_key",
+		10: "yubikey",
+		11: "gpg",
+		12: "ssh_agent",
 	}
 	SourceType_value = map[string]int32{
-		"default":           0,
-		"pam_passphrase":    1,
-		"custom_passphrase": 2,
-		"raw_key":           3,
+		"default":                0,
+		"pam_passphrase":         1,
+		"custom_passphrase":      2,
+		"raw_key":                3,
+		"fido2":                  4,
+		"tpm2":                   5,
+		"pkcs11":                 6,
+		"kms":                    7,
+		"tang":                   8,
+		"passphrase_and_raw_key": 9,
+		"yubikey":                10,
+		"gpg":                    11,
+		"ssh_agent":              12,
 	}
 )
 
@@ -80,11 +156,11 @@ func (x SourceType) String() string {
 }
 
 func (SourceType) Descriptor() protoreflect.EnumDescriptor {
-	return file_metadata_metadata_proto_enumTypes[0].Descriptor()
+	return file_metadata_metadata_proto_enumTypes[1].Descriptor()
 }
 
 func (SourceType) Type() protoreflect.EnumType {
-	return &file_metadata_metadata_proto_enumTypes[0]
+	return &file_metadata_metadata_proto_enumTypes[1]
 }
 
 func (x SourceType) Number() protoreflect.EnumNumber {
@@ -93,7 +169,7 @@ func (x SourceType) Number() protoreflect.EnumNumber {
 
 // Deprecated: Use SourceType.Descriptor instead.
 func (SourceType) EnumDescriptor() ([]byte, []int) {
-	return file_metadata_metadata_proto_rawDescGZIP(), []int{0}
+	return file_metadata_metadata_proto_rawDescGZIP(), []int{1}
 }
 
 // Type of encryption; should match declarations of unix.FSCRYPT_MODE
@@ -154,11 +230,11 @@ func (x EncryptionOptions_Mode) String() string {
 }
 
 func (EncryptionOptions_Mode) Descriptor() protoreflect.EnumDescriptor {
-	return file_metadata_metadata_proto_enumTypes[1].Descriptor()
+	return file_metadata_metadata_proto_enumTypes[2].Descriptor()
 }
 
 func (EncryptionOptions_Mode) Type() protoreflect.EnumType {
-	return &file_metadata_metadata_proto_enumTypes[1]
+	return &file_metadata_metadata_proto_enumTypes[2]
 }
 
 func (x EncryptionOptions_Mode) Number() protoreflect.EnumNumber {
@@ -167,7 +243,7 @@ func (x EncryptionOptions_Mode) Number() protoreflect.EnumNumber {
 
 // Deprecated: Use EncryptionOptions_Mode.Descriptor instead.
 func (EncryptionOptions_Mode) EnumDescriptor() ([]byte, []int) {
-	return file_metadata_metadata_proto_rawDescGZIP(), []int{3, 0}
+	return file_metadata_metadata_proto_rawDescGZIP(), []int{4, 0}
 }
 
 // Cost parameters to be used in our hashing functions.
@@ -181,6 +257,7 @@ type HashingCosts struct {
 	Parallelism int64 `protobuf:"varint,4,opt,name=parallelism,proto3" json:"parallelism,omitempty"`
 	// If true, parallelism should no longer be truncated to 8 bits.
 	TruncationFixed bool `protobuf:"varint,5,opt,name=truncation_fixed,json=truncationFixed,proto3" json:"truncation_fixed,omitempty"`
+	Kdf             KDF  `protobuf:"varint,6,opt,name=kdf,proto3,enum=metadata.KDF" json:"kdf,omitempty"`
 }
 
 func (x *HashingCosts) Reset() {
@@ -243,6 +320,13 @@ func (x *HashingCosts) GetTruncationFixed() bool {
 	return false
 }
 
+func (x *HashingCosts) GetKdf() KDF {
+	if x != nil {
+		return x.Kdf
+	}
+	return KDF_argon2id
+}
+
 // This structure is used for our authenticated wrapping/unwrapping of keys.
 type WrappedKeyData struct {
 	state         protoimpl.MessageState
@@ -321,6 +405,64 @@ type ProtectorData struct {
 	Salt       []byte          `protobuf:"bytes,5,opt,name=salt,proto3" json:"salt,omitempty"`
 	Uid        int64           `protobuf:"varint,6,opt,name=uid,proto3" json:"uid,omitempty"`
 	WrappedKey *WrappedKeyData `protobuf:"bytes,7,opt,name=wrapped_key,json=wrappedKey,proto3" json:"wrapped_key,omitempty"`
+	// If set, the name is stored encrypted with the filesystem's name key
+	// instead of in the name field.
+	EncryptedName *WrappedKeyData `protobuf:"bytes,8,opt,name=encrypted_name,json=encryptedName,proto3" json:"encrypted_name,omitempty"`
+	// For fido2 protectors, the security key credential whose hmac-secret
+	// output for the salt is the wrapping key
+	Fido2CredentialId []byte `protobuf:"bytes,9,opt,name=fido2_credential_id,json=fido2CredentialId,proto3" json:"fido2_credential_id,omitempty"`
+	Fido2Salt         []byte `protobuf:"bytes,10,opt,name=fido2_salt,json=fido2Salt,proto3" json:"fido2_salt,omitempty"`
+	// Version of the metadata schema (see SchemaVersion). 0 means the
+	// metadata was written before versions were recorded.
+	SchemaVersion int64 `protobuf:"varint,11,opt,name=schema_version,json=schemaVersion,proto3" json:"schema_version,omitempty"`
+	// For tpm2 protectors, the object sealed by the TPM which holds the
+	// wrapping key, and the PCRs (in the SHA-256 bank) whose values it is
+	// bound to, if any
+	Tpm2Public  []byte   `protobuf:"bytes,12,opt,name=tpm2_public,json=tpm2Public,proto3" json:"tpm2_public,omitempty"`
+	Tpm2Private []byte   `protobuf:"bytes,13,opt,name=tpm2_private,json=tpm2Private,proto3" json:"tpm2_private,omitempty"`
+	Tpm2Pcrs    []uint32 `protobuf:"varint,14,rep,packed,name=tpm2_pcrs,json=tpm2Pcrs,proto3" json:"tpm2_pcrs,omitempty"`
+	// For pkcs11 protectors, the PKCS#11 module and slot of the token, the
+	// ID and DER-encoded public key of the key pair on it, and the wrapping
+	// key encrypted with the RSA public key, or the ephemeral EC public key
+	// from whose ECDH shared secret the wrapping key is derived
+	Pkcs11Module     string `protobuf:"bytes,15,opt,name=pkcs11_module,json=pkcs11Module,proto3" json:"pkcs11_module,omitempty"`
+	Pkcs11Slot       string `protobuf:"bytes,16,opt,name=pkcs11_slot,json=pkcs11Slot,proto3" json:"pkcs11_slot,omitempty"`
+	Pkcs11KeyId      []byte `protobuf:"bytes,17,opt,name=pkcs11_key_id,json=pkcs11KeyId,proto3" json:"pkcs11_key_id,omitempty"`
+	Pkcs11PublicKey  []byte `protobuf:"bytes,18,opt,name=pkcs11_public_key,json=pkcs11PublicKey,proto3" json:"pkcs11_public_key,omitempty"`
+	Pkcs11WrappedKey []byte `protobuf:"bytes,19,opt,name=pkcs11_wrapped_key,json=pkcs11WrappedKey,proto3" json:"pkcs11_wrapped_key,omitempty"`
+	// For kms protectors, the name of the cloud KMS key (an AWS KMS key ARN, a
+	// GCP Cloud KMS key resource name, or an Azure Key Vault key identifier),
+	// and the wrapping key encrypted with it
+	KmsKey        string `protobuf:"bytes,20,opt,name=kms_key,json=kmsKey,proto3" json:"kms_key,omitempty"`
+	KmsWrappedKey []byte `protobuf:"bytes,21,opt,name=kms_wrapped_key,json=kmsWrappedKey,proto3" json:"kms_wrapped_key,omitempty"`
+	// For tang protectors, the URL of the Tang server, its exchange key (a
+	// JWK), and the client's public key (an uncompressed EC point) from which
+	// the server's exchange recovers the wrapping key
+	TangUrl       string `protobuf:"bytes,22,opt,name=tang_url,json=tangUrl,proto3" json:"tang_url,omitempty"`
+	TangServerKey string `protobuf:"bytes,23,opt,name=tang_server_key,json=tangServerKey,proto3" json:"tang_server_key,omitempty"`
+	TangClientKey []byte `protobuf:"bytes,24,opt,name=tang_client_key,json=tangClientKey,proto3" json:"tang_client_key,omitempty"`
+	// For yubikey protectors, the YubiKey slot configured for HMAC-SHA1
+	// challenge-response, and the random challenge whose response is
+	// combined with the passphrase hash
+	YubikeySlot      uint32 `protobuf:"varint,25,opt,name=yubikey_slot,json=yubikeySlot,proto3" json:"yubikey_slot,omitempty"`
+	YubikeyChallenge []byte `protobuf:"bytes,26,opt,name=yubikey_challenge,json=yubikeyChallenge,proto3" json:"yubikey_challenge,omitempty"`
+	// For gpg protectors, the GPG key which the wrapping key is encrypted to
+	// (as given in the config), and the encrypted wrapping key
+	GpgRecipient  string `protobuf:"bytes,27,opt,name=gpg_recipient,json=gpgRecipient,proto3" json:"gpg_recipient,omitempty"`
+	GpgWrappedKey []byte `protobuf:"bytes,28,opt,name=gpg_wrapped_key,json=gpgWrappedKey,proto3" json:"gpg_wrapped_key,omitempty"`
+	// For ssh_agent protectors, the SSH public key (in the SSH wire format)
+	// whose ssh-agent signature of the random challenge the wrapping key is
+	// derived from
+	SshPublicKey []byte `protobuf:"bytes,29,opt,name=ssh_public_key,json=sshPublicKey,proto3" json:"ssh_public_key,omitempty"`
+	SshChallenge []byte `protobuf:"bytes,30,opt,name=ssh_challenge,json=sshChallenge,proto3" json:"ssh_challenge,omitempty"`
+	// HMAC of the other fields (except the name and schema version), keyed off
+	// the protector key, so that changes made without the key are detected
+	// when the protector is unlocked. Empty in older metadata.
+	MetadataHmac []byte `protobuf:"bytes,31,opt,name=metadata_hmac,json=metadataHmac,proto3" json:"metadata_hmac,omitempty"`
+	// The owner of the protector and the other users and groups allowed to
+	// use it. Unset for protectors which anyone who can read their metadata
+	// may use, including all protectors in older metadata.
+	Access *ProtectorAccess `protobuf:"bytes,32,opt,name=access,proto3" json:"access,omitempty"`
 }
 
 func (x *ProtectorData) Reset() {
@@ -404,6 +546,245 @@ func (x *ProtectorData) GetWrappedKey() *WrappedKeyData {
 	return nil
 }
 
+func (x *ProtectorData) GetEncryptedName() *WrappedKeyData {
+	if x != nil {
+		return x.EncryptedName
+	}
+	return nil
+}
+
+func (x *ProtectorData) GetFido2CredentialId() []byte {
+	if x != nil {
+		return x.Fido2CredentialId
+	}
+	return nil
+}
+
+func (x *ProtectorData) GetFido2Salt() []byte {
+	if x != nil {
+		return x.Fido2Salt
+	}
+	return nil
+}
+
+func (x *ProtectorData) GetSchemaVersion() int64 {
+	if x != nil {
+		return x.SchemaVersion
+	}
+	return 0
+}
+
+func (x *ProtectorData) GetTpm2Public() []byte {
+	if x != nil {
+		return x.Tpm2Public
+	}
+	return nil
+}
+
+func (x *ProtectorData) GetTpm2Private() []byte {
+	if x != nil {
+		return x.Tpm2Private
+	}
+	return nil
+}
+
+func (x *ProtectorData) GetTpm2Pcrs() []uint32 {
+	if x != nil {
+		return x.Tpm2Pcrs
+	}
+	return nil
+}
+
+func (x *ProtectorData) GetPkcs11Module() string {
+	if x != nil {
+		return x.Pkcs11Module
+	}
+	return ""
+}
+
+func (x *ProtectorData) GetPkcs11Slot() string {
+	if x != nil {
+		return x.Pkcs11Slot
+	}
+	return ""
+}
+
+func (x *ProtectorData) GetPkcs11KeyId() []byte {
+	if x != nil {
+		return x.Pkcs11KeyId
+	}
+	return nil
+}
+
+func (x *ProtectorData) GetPkcs11PublicKey() []byte {
+	if x != nil {
+		return x.Pkcs11PublicKey
+	}
+	return nil
+}
+
+func (x *ProtectorData) GetPkcs11WrappedKey() []byte {
+	if x != nil {
+		return x.Pkcs11WrappedKey
+	}
+	return nil
+}
+
+func (x *ProtectorData) GetKmsKey() string {
+	if x != nil {
+		return x.KmsKey
+	}
+	return ""
+}
+
+func (x *ProtectorData) GetKmsWrappedKey() []byte {
+	if x != nil {
+		return x.KmsWrappedKey
+	}
+	return nil
+}
+
+func (x *ProtectorData) GetTangUrl() string {
+	if x != nil {
+		return x.TangUrl
+	}
+	return ""
+}
+
+func (x *ProtectorData) GetTangServerKey() string {
+	if x != nil {
+		return x.TangServerKey
+	}
+	return ""
+}
+
+func (x *ProtectorData) GetTangClientKey() []byte {
+	if x != nil {
+		return x.TangClientKey
+	}
+	return nil
+}
+
+func (x *ProtectorData) GetYubikeySlot() uint32 {
+	if x != nil {
+		return x.YubikeySlot
+	}
+	return 0
+}
+
+func (x *ProtectorData) GetYubikeyChallenge() []byte {
+	if x != nil {
+		return x.YubikeyChallenge
+	}
+	return nil
+}
+
+func (x *ProtectorData) GetGpgRecipient() string {
+	if x != nil {
+		return x.GpgRecipient
+	}
+	return ""
+}
+
+func (x *ProtectorData) GetGpgWrappedKey() []byte {
+	if x != nil {
+		return x.GpgWrappedKey
+	}
+	return nil
+}
+
+func (x *ProtectorData) GetSshPublicKey() []byte {
+	if x != nil {
+		return x.SshPublicKey
+	}
+	return nil
+}
+
+func (x *ProtectorData) GetSshChallenge() []byte {
+	if x != nil {
+		return x.SshChallenge
+	}
+	return nil
+}
+
+func (x *ProtectorData) GetMetadataHmac() []byte {
+	if x != nil {
+		return x.MetadataHmac
+	}
+	return nil
+}
+
+func (x *ProtectorData) GetAccess() *ProtectorAccess {
+	if x != nil {
+		return x.Access
+	}
+	return nil
+}
+
+// Which users may use a protector. Root may always use it.
+type ProtectorAccess struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	OwnerUid    int64   `protobuf:"varint,1,opt,name=owner_uid,json=ownerUid,proto3" json:"owner_uid,omitempty"`
+	AllowedUids []int64 `protobuf:"varint,2,rep,packed,name=allowed_uids,json=allowedUids,proto3" json:"allowed_uids,omitempty"`
+	AllowedGids []int64 `protobuf:"varint,3,rep,packed,name=allowed_gids,json=allowedGids,proto3" json:"allowed_gids,omitempty"`
+}
+
+func (x *ProtectorAccess) Reset() {
+	*x = ProtectorAccess{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_metadata_metadata_proto_msgTypes[3]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *ProtectorAccess) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ProtectorAccess) ProtoMessage() {}
+
+func (x *ProtectorAccess) ProtoReflect() protoreflect.Message {
+	mi := &file_metadata_metadata_proto_msgTypes[3]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ProtectorAccess.ProtoReflect.Descriptor instead.
+func (*ProtectorAccess) Descriptor() ([]byte, []int) {
+	return file_metadata_metadata_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *ProtectorAccess) GetOwnerUid() int64 {
+	if x != nil {
+		return x.OwnerUid
+	}
+	return 0
+}
+
+func (x *ProtectorAccess) GetAllowedUids() []int64 {
+	if x != nil {
+		return x.AllowedUids
+	}
+	return nil
+}
+
+func (x *ProtectorAccess) GetAllowedGids() []int64 {
+	if x != nil {
+		return x.AllowedGids
+	}
+	return nil
+}
+
 // Encryption policy specifics, corresponds to the fscrypt_policy struct
 type EncryptionOptions struct {
 	state         protoimpl.MessageState
@@ -414,12 +795,28 @@ type EncryptionOptions struct {
 	Contents      EncryptionOptions_Mode `protobuf:"varint,2,opt,name=contents,proto3,enum=metadata.EncryptionOptions_Mode" json:"contents,omitempty"`
 	Filenames     EncryptionOptions_Mode `protobuf:"varint,3,opt,name=filenames,proto3,enum=metadata.EncryptionOptions_Mode" json:"filenames,omitempty"`
 	PolicyVersion int64                  `protobuf:"varint,4,opt,name=policy_version,json=policyVersion,proto3" json:"policy_version,omitempty"`
+	// Size in bytes of the units in which file contents are encrypted. If
+	// unset, the filesystem block size is used.
+	DataUnitSize int64 `protobuf:"varint,5,opt,name=data_unit_size,json=dataUnitSize,proto3" json:"data_unit_size,omitempty"`
+	// If true, don't set the DIRECT_KEY flag even though the encryption modes
+	// support it, so that each file gets its own key as with other modes.
+	NoDirectKey bool `protobuf:"varint,6,opt,name=no_direct_key,json=noDirectKey,proto3" json:"no_direct_key,omitempty"`
+	// If true, set the IV_INO_LBLK_64 flag, which derives the IVs of file
+	// contents from the inode number and the logical block number, so that
+	// inline encryption hardware (e.g. UFS or eMMC) can use a single key for
+	// the whole policy. Requires policy version 2 and stable inode numbers.
+	IvInoLblk_64 bool `protobuf:"varint,7,opt,name=iv_ino_lblk_64,json=ivInoLblk64,proto3" json:"iv_ino_lblk_64,omitempty"`
+	// If true, set the IV_INO_LBLK_32 flag, which is like IV_INO_LBLK_64 but
+	// hashes the inode number into 32-bit IVs, for eMMC inline encryption
+	// hardware which only supports 32-bit data unit numbers. Requires policy
+	// version 2 and stable 32-bit inode numbers.
+	IvInoLblk_32 bool `protobuf:"varint,8,opt,name=iv_ino_lblk_32,json=ivInoLblk32,proto3" json:"iv_ino_lblk_32,omitempty"`
 }
 
 func (x *EncryptionOptions) Reset() {
 	*x = EncryptionOptions{}
 	if protoimpl.UnsafeEnabled {
-		mi := &file_metadata_metadata_proto_msgTypes[3]
+		mi := &file_metadata_metadata_proto_msgTypes[4]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		ms.StoreMessageInfo(mi)
 	}
@@ -432,7 +829,7 @@ func (x *EncryptionOptions) String() string {
 func (*EncryptionOptions) ProtoMessage() {}
 
 func (x *EncryptionOptions) ProtoReflect() protoreflect.Message {
-	mi := &file_metadata_metadata_proto_msgTypes[3]
+	mi := &file_metadata_metadata_proto_msgTypes[4]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -445,7 +842,7 @@ func (x *EncryptionOptions) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use EncryptionOptions.ProtoReflect.Descriptor instead.
 func (*EncryptionOptions) Descriptor() ([]byte, []int) {
-	return file_metadata_metadata_proto_rawDescGZIP(), []int{3}
+	return file_metadata_metadata_proto_rawDescGZIP(), []int{4}
 }
 
 func (x *EncryptionOptions) GetPadding() int64 {
@@ -476,6 +873,34 @@ func (x *EncryptionOptions) GetPolicyVersion() int64 {
 	return 0
 }
 
+func (x *EncryptionOptions) GetDataUnitSize() int64 {
+	if x != nil {
+		return x.DataUnitSize
+	}
+	return 0
+}
+
+func (x *EncryptionOptions) GetNoDirectKey() bool {
+	if x != nil {
+		return x.NoDirectKey
+	}
+	return false
+}
+
+func (x *EncryptionOptions) GetIvInoLblk_64() bool {
+	if x != nil {
+		return x.IvInoLblk_64
+	}
+	return false
+}
+
+func (x *EncryptionOptions) GetIvInoLblk_32() bool {
+	if x != nil {
+		return x.IvInoLblk_32
+	}
+	return false
+}
+
 type WrappedPolicyKey struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
@@ -483,12 +908,17 @@ type WrappedPolicyKey struct {
 
 	ProtectorDescriptor string          `protobuf:"bytes,1,opt,name=protector_descriptor,json=protectorDescriptor,proto3" json:"protector_descriptor,omitempty"`
 	WrappedKey          *WrappedKeyData `protobuf:"bytes,2,opt,name=wrapped_key,json=wrappedKey,proto3" json:"wrapped_key,omitempty"`
+	// For policies with a threshold above 1, the protector wraps a Shamir
+	// share of the policy key (with the given index) instead of the key
+	// itself. wrapped_key is unset, so older versions reject such policies.
+	WrappedShare *WrappedKeyData `protobuf:"bytes,3,opt,name=wrapped_share,json=wrappedShare,proto3" json:"wrapped_share,omitempty"`
+	ShareIndex   int64           `protobuf:"varint,4,opt,name=share_index,json=shareIndex,proto3" json:"share_index,omitempty"`
 }
 
 func (x *WrappedPolicyKey) Reset() {
 	*x = WrappedPolicyKey{}
 	if protoimpl.UnsafeEnabled {
-		mi := &file_metadata_metadata_proto_msgTypes[4]
+		mi := &file_metadata_metadata_proto_msgTypes[5]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		ms.StoreMessageInfo(mi)
 	}
@@ -501,7 +931,7 @@ func (x *WrappedPolicyKey) String() string {
 func (*WrappedPolicyKey) ProtoMessage() {}
 
 func (x *WrappedPolicyKey) ProtoReflect() protoreflect.Message {
-	mi := &file_metadata_metadata_proto_msgTypes[4]
+	mi := &file_metadata_metadata_proto_msgTypes[5]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -514,7 +944,7 @@ func (x *WrappedPolicyKey) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use WrappedPolicyKey.ProtoReflect.Descriptor instead.
 func (*WrappedPolicyKey) Descriptor() ([]byte, []int) {
-	return file_metadata_metadata_proto_rawDescGZIP(), []int{4}
+	return file_metadata_metadata_proto_rawDescGZIP(), []int{5}
 }
 
 func (x *WrappedPolicyKey) GetProtectorDescriptor() string {
@@ -531,6 +961,20 @@ func (x *WrappedPolicyKey) GetWrappedKey() *WrappedKeyData {
 	return nil
 }
 
+func (x *WrappedPolicyKey) GetWrappedShare() *WrappedKeyData {
+	if x != nil {
+		return x.WrappedShare
+	}
+	return nil
+}
+
+func (x *WrappedPolicyKey) GetShareIndex() int64 {
+	if x != nil {
+		return x.ShareIndex
+	}
+	return 0
+}
+
 // The associated data for each policy
 type PolicyData struct {
 	state         protoimpl.MessageState
@@ -540,12 +984,19 @@ type PolicyData struct {
 	KeyDescriptor     string              `protobuf:"bytes,1,opt,name=key_descriptor,json=keyDescriptor,proto3" json:"key_descriptor,omitempty"`
 	Options           *EncryptionOptions  `protobuf:"bytes,2,opt,name=options,proto3" json:"options,omitempty"`
 	WrappedPolicyKeys []*WrappedPolicyKey `protobuf:"bytes,3,rep,name=wrapped_policy_keys,json=wrappedPolicyKeys,proto3" json:"wrapped_policy_keys,omitempty"`
+	// Number of protectors needed to unlock the policy. 0 is the same as 1.
+	Threshold int64 `protobuf:"varint,4,opt,name=threshold,proto3" json:"threshold,omitempty"`
+	// Version of the metadata schema, as in ProtectorData
+	SchemaVersion int64 `protobuf:"varint,5,opt,name=schema_version,json=schemaVersion,proto3" json:"schema_version,omitempty"`
+	// HMAC of the key descriptor, options, and threshold, keyed off the policy
+	// key, as in ProtectorData
+	MetadataHmac []byte `protobuf:"bytes,6,opt,name=metadata_hmac,json=metadataHmac,proto3" json:"metadata_hmac,omitempty"`
 }
 
 func (x *PolicyData) Reset() {
 	*x = PolicyData{}
 	if protoimpl.UnsafeEnabled {
-		mi := &file_metadata_metadata_proto_msgTypes[5]
+		mi := &file_metadata_metadata_proto_msgTypes[6]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		ms.StoreMessageInfo(mi)
 	}
@@ -558,7 +1009,7 @@ func (x *PolicyData) String() string {
 func (*PolicyData) ProtoMessage() {}
 
 func (x *PolicyData) ProtoReflect() protoreflect.Message {
-	mi := &file_metadata_metadata_proto_msgTypes[5]
+	mi := &file_metadata_metadata_proto_msgTypes[6]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -571,7 +1022,7 @@ func (x *PolicyData) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use PolicyData.ProtoReflect.Descriptor instead.
 func (*PolicyData) Descriptor() ([]byte, []int) {
-	return file_metadata_metadata_proto_rawDescGZIP(), []int{5}
+	return file_metadata_metadata_proto_rawDescGZIP(), []int{6}
 }
 
 func (x *PolicyData) GetKeyDescriptor() string {
@@ -595,6 +1046,335 @@ func (x *PolicyData) GetWrappedPolicyKeys() []*WrappedPolicyKey {
 	return nil
 }
 
+func (x *PolicyData) GetThreshold() int64 {
+	if x != nil {
+		return x.Threshold
+	}
+	return 0
+}
+
+func (x *PolicyData) GetSchemaVersion() int64 {
+	if x != nil {
+		return x.SchemaVersion
+	}
+	return 0
+}
+
+func (x *PolicyData) GetMetadataHmac() []byte {
+	if x != nil {
+		return x.MetadataHmac
+	}
+	return nil
+}
+
+// A protector or policy in a MetadataBackup, with the UID of the user who owns
+// its metadata
+type BackupProtector struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Data     *ProtectorData `protobuf:"bytes,1,opt,name=data,proto3" json:"data,omitempty"`
+	OwnerUid int64          `protobuf:"varint,2,opt,name=owner_uid,json=ownerUid,proto3" json:"owner_uid,omitempty"`
+}
+
+func (x *BackupProtector) Reset() {
+	*x = BackupProtector{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_metadata_metadata_proto_msgTypes[7]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *BackupProtector) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*BackupProtector) ProtoMessage() {}
+
+func (x *BackupProtector) ProtoReflect() protoreflect.Message {
+	mi := &file_metadata_metadata_proto_msgTypes[7]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use BackupProtector.ProtoReflect.Descriptor instead.
+func (*BackupProtector) Descriptor() ([]byte, []int) {
+	return file_metadata_metadata_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *BackupProtector) GetData() *ProtectorData {
+	if x != nil {
+		return x.Data
+	}
+	return nil
+}
+
+func (x *BackupProtector) GetOwnerUid() int64 {
+	if x != nil {
+		return x.OwnerUid
+	}
+	return 0
+}
+
+type BackupPolicy struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Data     *PolicyData `protobuf:"bytes,1,opt,name=data,proto3" json:"data,omitempty"`
+	OwnerUid int64       `protobuf:"varint,2,opt,name=owner_uid,json=ownerUid,proto3" json:"owner_uid,omitempty"`
+	Label    string      `protobuf:"bytes,3,opt,name=label,proto3" json:"label,omitempty"`
+}
+
+func (x *BackupPolicy) Reset() {
+	*x = BackupPolicy{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_metadata_metadata_proto_msgTypes[8]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *BackupPolicy) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*BackupPolicy) ProtoMessage() {}
+
+func (x *BackupPolicy) ProtoReflect() protoreflect.Message {
+	mi := &file_metadata_metadata_proto_msgTypes[8]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use BackupPolicy.ProtoReflect.Descriptor instead.
+func (*BackupPolicy) Descriptor() ([]byte, []int) {
+	return file_metadata_metadata_proto_rawDescGZIP(), []int{8}
+}
+
+func (x *BackupPolicy) GetData() *PolicyData {
+	if x != nil {
+		return x.Data
+	}
+	return nil
+}
+
+func (x *BackupPolicy) GetOwnerUid() int64 {
+	if x != nil {
+		return x.OwnerUid
+	}
+	return 0
+}
+
+func (x *BackupPolicy) GetLabel() string {
+	if x != nil {
+		return x.Label
+	}
+	return ""
+}
+
+// All the metadata of a filesystem, as saved by "fscrypt metadata dump"
+type MetadataBackup struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Protectors []*BackupProtector `protobuf:"bytes,1,rep,name=protectors,proto3" json:"protectors,omitempty"`
+	Policies   []*BackupPolicy    `protobuf:"bytes,2,rep,name=policies,proto3" json:"policies,omitempty"`
+	// Descriptors of the protectors which are links to other filesystems
+	LinkedProtectors []string `protobuf:"bytes,3,rep,name=linked_protectors,json=linkedProtectors,proto3" json:"linked_protectors,omitempty"`
+	// Key which encrypts the protector names, if they are encrypted
+	NameKey []byte `protobuf:"bytes,4,opt,name=name_key,json=nameKey,proto3" json:"name_key,omitempty"`
+}
+
+func (x *MetadataBackup) Reset() {
+	*x = MetadataBackup{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_metadata_metadata_proto_msgTypes[9]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *MetadataBackup) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*MetadataBackup) ProtoMessage() {}
+
+func (x *MetadataBackup) ProtoReflect() protoreflect.Message {
+	mi := &file_metadata_metadata_proto_msgTypes[9]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use MetadataBackup.ProtoReflect.Descriptor instead.
+func (*MetadataBackup) Descriptor() ([]byte, []int) {
+	return file_metadata_metadata_proto_rawDescGZIP(), []int{9}
+}
+
+func (x *MetadataBackup) GetProtectors() []*BackupProtector {
+	if x != nil {
+		return x.Protectors
+	}
+	return nil
+}
+
+func (x *MetadataBackup) GetPolicies() []*BackupPolicy {
+	if x != nil {
+		return x.Policies
+	}
+	return nil
+}
+
+func (x *MetadataBackup) GetLinkedProtectors() []string {
+	if x != nil {
+		return x.LinkedProtectors
+	}
+	return nil
+}
+
+func (x *MetadataBackup) GetNameKey() []byte {
+	if x != nil {
+		return x.NameKey
+	}
+	return nil
+}
+
+// The file written by "fscrypt metadata dump", holding a serialized
+// MetadataBackup and its SHA-256 hash, which is checked before restoring it.
+type MetadataBackupFile struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Backup []byte `protobuf:"bytes,1,opt,name=backup,proto3" json:"backup,omitempty"`
+	Sha256 []byte `protobuf:"bytes,2,opt,name=sha256,proto3" json:"sha256,omitempty"`
+}
+
+func (x *MetadataBackupFile) Reset() {
+	*x = MetadataBackupFile{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_metadata_metadata_proto_msgTypes[10]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *MetadataBackupFile) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*MetadataBackupFile) ProtoMessage() {}
+
+func (x *MetadataBackupFile) ProtoReflect() protoreflect.Message {
+	mi := &file_metadata_metadata_proto_msgTypes[10]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use MetadataBackupFile.ProtoReflect.Descriptor instead.
+func (*MetadataBackupFile) Descriptor() ([]byte, []int) {
+	return file_metadata_metadata_proto_rawDescGZIP(), []int{10}
+}
+
+func (x *MetadataBackupFile) GetBackup() []byte {
+	if x != nil {
+		return x.Backup
+	}
+	return nil
+}
+
+func (x *MetadataBackupFile) GetSha256() []byte {
+	if x != nil {
+		return x.Sha256
+	}
+	return nil
+}
+
+// Named encryption settings in the config file, selected with
+// "fscrypt encrypt --profile". Unset fields keep the values from the config.
+type Profile struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Options   *EncryptionOptions `protobuf:"bytes,1,opt,name=options,proto3" json:"options,omitempty"`
+	HashCosts *HashingCosts      `protobuf:"bytes,2,opt,name=hash_costs,json=hashCosts,proto3" json:"hash_costs,omitempty"`
+}
+
+func (x *Profile) Reset() {
+	*x = Profile{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_metadata_metadata_proto_msgTypes[11]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *Profile) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Profile) ProtoMessage() {}
+
+func (x *Profile) ProtoReflect() protoreflect.Message {
+	mi := &file_metadata_metadata_proto_msgTypes[11]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Profile.ProtoReflect.Descriptor instead.
+func (*Profile) Descriptor() ([]byte, []int) {
+	return file_metadata_metadata_proto_rawDescGZIP(), []int{11}
+}
+
+func (x *Profile) GetOptions() *EncryptionOptions {
+	if x != nil {
+		return x.Options
+	}
+	return nil
+}
+
+func (x *Profile) GetHashCosts() *HashingCosts {
+	if x != nil {
+		return x.HashCosts
+	}
+	return nil
+}
+
 // Data stored in the config file
 type Config struct {
 	state         protoimpl.MessageState
@@ -606,12 +1386,47 @@ type Config struct {
 	Options                   *EncryptionOptions `protobuf:"bytes,4,opt,name=options,proto3" json:"options,omitempty"`
 	UseFsKeyringForV1Policies bool               `protobuf:"varint,5,opt,name=use_fs_keyring_for_v1_policies,json=useFsKeyringForV1Policies,proto3" json:"use_fs_keyring_for_v1_policies,omitempty"`
 	AllowCrossUserMetadata    bool               `protobuf:"varint,6,opt,name=allow_cross_user_metadata,json=allowCrossUserMetadata,proto3" json:"allow_cross_user_metadata,omitempty"`
+	EncryptProtectorNames     bool               `protobuf:"varint,7,opt,name=encrypt_protector_names,json=encryptProtectorNames,proto3" json:"encrypt_protector_names,omitempty"`
+	// Commands run (with /bin/sh -c) after a directory is unlocked or locked.
+	PostUnlockHook string `protobuf:"bytes,8,opt,name=post_unlock_hook,json=postUnlockHook,proto3" json:"post_unlock_hook,omitempty"`
+	PostLockHook   string `protobuf:"bytes,9,opt,name=post_lock_hook,json=postLockHook,proto3" json:"post_lock_hook,omitempty"`
+	// Directory searched for <descriptor>.key files for raw_key protectors.
+	KeystoreDir string              `protobuf:"bytes,10,opt,name=keystore_dir,json=keystoreDir,proto3" json:"keystore_dir,omitempty"`
+	Profiles    map[string]*Profile `protobuf:"bytes,11,rep,name=profiles,proto3" json:"profiles,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
+	// PKCS#11 module, slot (empty for the first one with a token), and key
+	// ID in hex (empty for the first key) used by new pkcs11 protectors.
+	Pkcs11Module string `protobuf:"bytes,12,opt,name=pkcs11_module,json=pkcs11Module,proto3" json:"pkcs11_module,omitempty"`
+	Pkcs11Slot   string `protobuf:"bytes,13,opt,name=pkcs11_slot,json=pkcs11Slot,proto3" json:"pkcs11_slot,omitempty"`
+	Pkcs11KeyId  string `protobuf:"bytes,14,opt,name=pkcs11_key_id,json=pkcs11KeyId,proto3" json:"pkcs11_key_id,omitempty"`
+	// Cloud KMS key used by new kms protectors.
+	KmsKey string `protobuf:"bytes,15,opt,name=kms_key,json=kmsKey,proto3" json:"kms_key,omitempty"`
+	// Tang server used by new tang protectors, and the thumbprint of its
+	// signing key (empty to ask whether to trust the advertised keys).
+	TangUrl        string `protobuf:"bytes,16,opt,name=tang_url,json=tangUrl,proto3" json:"tang_url,omitempty"`
+	TangThumbprint string `protobuf:"bytes,17,opt,name=tang_thumbprint,json=tangThumbprint,proto3" json:"tang_thumbprint,omitempty"`
+	// YubiKey slot (1 or 2, or 0 for slot 2) used by new yubikey protectors.
+	YubikeySlot uint32 `protobuf:"varint,18,opt,name=yubikey_slot,json=yubikeySlot,proto3" json:"yubikey_slot,omitempty"`
+	// GPG key (a key ID, fingerprint, or user ID) used by new gpg protectors.
+	GpgRecipient string `protobuf:"bytes,19,opt,name=gpg_recipient,json=gpgRecipient,proto3" json:"gpg_recipient,omitempty"`
+	// SSH key (a SHA256 fingerprint or comment, or empty for the first
+	// suitable key in the agent) used by new ssh_agent protectors.
+	SshKey string `protobuf:"bytes,20,opt,name=ssh_key,json=sshKey,proto3" json:"ssh_key,omitempty"`
+	// Policies (as MOUNTPOINT:ID) locked by "fscrypt lock --for-suspend".
+	// If empty, all the policies which are unlocked on the filesystems set
+	// up for fscrypt are locked.
+	SuspendLockPolicies []string `protobuf:"bytes,21,rep,name=suspend_lock_policies,json=suspendLockPolicies,proto3" json:"suspend_lock_policies,omitempty"`
+	// Whether "fscrypt encrypt" also stores a copy of the policy metadata
+	// in the security.fscrypt.policy xattr of the directory.
+	StorePoliciesInXattrs bool `protobuf:"varint,22,opt,name=store_policies_in_xattrs,json=storePoliciesInXattrs,proto3" json:"store_policies_in_xattrs,omitempty"`
+	// Directories holding the fscrypt metadata of filesystems (by
+	// mountpoint) instead of MOUNTPOINT/.fscrypt, e.g. for read-only ones.
+	MetadataDirs map[string]string `protobuf:"bytes,23,rep,name=metadata_dirs,json=metadataDirs,proto3" json:"metadata_dirs,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
 }
 
 func (x *Config) Reset() {
 	*x = Config{}
 	if protoimpl.UnsafeEnabled {
-		mi := &file_metadata_metadata_proto_msgTypes[6]
+		mi := &file_metadata_metadata_proto_msgTypes[12]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		ms.StoreMessageInfo(mi)
 	}
@@ -624,7 +1439,7 @@ func (x *Config) String() string {
 func (*Config) ProtoMessage() {}
 
 func (x *Config) ProtoReflect() protoreflect.Message {
-	mi := &file_metadata_metadata_proto_msgTypes[6]
+	mi := &file_metadata_metadata_proto_msgTypes[12]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -637,7 +1452,7 @@ func (x *Config) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use Config.ProtoReflect.Descriptor instead.
 func (*Config) Descriptor() ([]byte, []int) {
-	return file_metadata_metadata_proto_rawDescGZIP(), []int{6}
+	return file_metadata_metadata_proto_rawDescGZIP(), []int{12}
 }
 
 func (x *Config) GetSource() SourceType {
@@ -675,12 +1490,131 @@ func (x *Config) GetAllowCrossUserMetadata() bool {
 	return false
 }
 
+func (x *Config) GetEncryptProtectorNames() bool {
+	if x != nil {
+		return x.EncryptProtectorNames
+	}
+	return false
+}
+
+func (x *Config) GetPostUnlockHook() string {
+	if x != nil {
+		return x.PostUnlockHook
+	}
+	return ""
+}
+
+func (x *Config) GetPostLockHook() string {
+	if x != nil {
+		return x.PostLockHook
+	}
+	return ""
+}
+
+func (x *Config) GetKeystoreDir() string {
+	if x != nil {
+		return x.KeystoreDir
+	}
+	return ""
+}
+
+func (x *Config) GetProfiles() map[string]*Profile {
+	if x != nil {
+		return x.Profiles
+	}
+	return nil
+}
+
+func (x *Config) GetPkcs11Module() string {
+	if x != nil {
+		return x.Pkcs11Module
+	}
+	return ""
+}
+
+func (x *Config) GetPkcs11Slot() string {
+	if x != nil {
+		return x.Pkcs11Slot
+	}
+	return ""
+}
+
+func (x *Config) GetPkcs11KeyId() string {
+	if x != nil {
+		return x.Pkcs11KeyId
+	}
+	return ""
+}
+
+func (x *Config) GetKmsKey() string {
+	if x != nil {
+		return x.KmsKey
+	}
+	return ""
+}
+
+func (x *Config) GetTangUrl() string {
+	if x != nil {
+		return x.TangUrl
+	}
+	return ""
+}
+
+func (x *Config) GetTangThumbprint() string {
+	if x != nil {
+		return x.TangThumbprint
+	}
+	return ""
+}
+
+func (x *Config) GetYubikeySlot() uint32 {
+	if x != nil {
+		return x.YubikeySlot
+	}
+	return 0
+}
+
+func (x *Config) GetGpgRecipient() string {
+	if x != nil {
+		return x.GpgRecipient
+	}
+	return ""
+}
+
+func (x *Config) GetSshKey() string {
+	if x != nil {
+		return x.SshKey
+	}
+	return ""
+}
+
+func (x *Config) GetSuspendLockPolicies() []string {
+	if x != nil {
+		return x.SuspendLockPolicies
+	}
+	return nil
+}
+
+func (x *Config) GetStorePoliciesInXattrs() bool {
+	if x != nil {
+		return x.StorePoliciesInXattrs
+	}
+	return false
+}
+
+func (x *Config) GetMetadataDirs() map[string]string {
+	if x != nil {
+		return x.MetadataDirs
+	}
+	return nil
+}
+
 var File_metadata_metadata_proto protoreflect.FileDescriptor
 
 var file_metadata_metadata_proto_rawDesc = []byte{
 	0x0a, 0x17, 0x6d, 0x65, 0x74, 0x61, 0x64, 0x61, 0x74, 0x61, 0x2f, 0x6d, 0x65, 0x74, 0x61, 0x64,
 	0x61, 0x74, 0x61, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x12, 0x08, 0x6d, 0x65, 0x74, 0x61, 0x64,
-	0x61, 0x74, 0x61, 0x22, 0x87, 0x01, 0x0a, 0x0c, 0x48, 0x61, 0x73, 0x68, 0x69, 0x6e, 0x67, 0x43,
+	0x61, 0x74, 0x61, 0x22, 0xa8, 0x01, 0x0a, 0x0c, 0x48, 0x61, 0x73, 0x68, 0x69, 0x6e, 0x67, 0x43,
 	0x6f, 0x73, 0x74, 0x73, 0x12, 0x12, 0x0a, 0x04, 0x74, 0x69, 0x6d, 0x65, 0x18, 0x02, 0x20, 0x01,
 	0x28, 0x03, 0x52, 0x04, 0x74, 0x69, 0x6d, 0x65, 0x12, 0x16, 0x0a, 0x06, 0x6d, 0x65, 0x6d, 0x6f,
 	0x72, 0x79, 0x18, 0x03, 0x20, 0x01, 0x28, 0x03, 0x52, 0x06, 0x6d, 0x65, 0x6d, 0x6f, 0x72, 0x79,
@@ -688,76 +1622,205 @@ var file_metadata_metadata_proto_rawDesc = []byte{
 	0x04, 0x20, 0x01, 0x28, 0x03, 0x52, 0x0b, 0x70, 0x61, 0x72, 0x61, 0x6c, 0x6c, 0x65, 0x6c, 0x69,
 	0x73, 0x6d, 0x12, 0x29, 0x0a, 0x10, 0x74, 0x72, 0x75, 0x6e, 0x63, 0x61, 0x74, 0x69, 0x6f, 0x6e,
 	0x5f, 0x66, 0x69, 0x78, 0x65, 0x64, 0x18, 0x05, 0x20, 0x01, 0x28, 0x08, 0x52, 0x0f, 0x74, 0x72,
-	0x75, 0x6e, 0x63, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x46, 0x69, 0x78, 0x65, 0x64, 0x22, 0x59, 0x0a,
-	0x0e, 0x57, 0x72, 0x61, 0x70, 0x70, 0x65, 0x64, 0x4b, 0x65, 0x79, 0x44, 0x61, 0x74, 0x61, 0x12,
-	0x0e, 0x0a, 0x02, 0x49, 0x56, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x02, 0x49, 0x56, 0x12,
-	0x23, 0x0a, 0x0d, 0x65, 0x6e, 0x63, 0x72, 0x79, 0x70, 0x74, 0x65, 0x64, 0x5f, 0x6b, 0x65, 0x79,
-	0x18, 0x02, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x0c, 0x65, 0x6e, 0x63, 0x72, 0x79, 0x70, 0x74, 0x65,
-	0x64, 0x4b, 0x65, 0x79, 0x12, 0x12, 0x0a, 0x04, 0x68, 0x6d, 0x61, 0x63, 0x18, 0x03, 0x20, 0x01,
-	0x28, 0x0c, 0x52, 0x04, 0x68, 0x6d, 0x61, 0x63, 0x22, 0x93, 0x02, 0x0a, 0x0d, 0x50, 0x72, 0x6f,
-	0x74, 0x65, 0x63, 0x74, 0x6f, 0x72, 0x44, 0x61, 0x74, 0x61, 0x12, 0x31, 0x0a, 0x14, 0x70, 0x72,
-	0x6f, 0x74, 0x65, 0x63, 0x74, 0x6f, 0x72, 0x5f, 0x64, 0x65, 0x73, 0x63, 0x72, 0x69, 0x70, 0x74,
-	0x6f, 0x72, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x13, 0x70, 0x72, 0x6f, 0x74, 0x65, 0x63,
-	0x74, 0x6f, 0x72, 0x44, 0x65, 0x73, 0x63, 0x72, 0x69, 0x70, 0x74, 0x6f, 0x72, 0x12, 0x2c, 0x0a,
-	0x06, 0x73, 0x6f, 0x75, 0x72, 0x63, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0e, 0x32, 0x14, 0x2e,
-	0x6d, 0x65, 0x74, 0x61, 0x64, 0x61, 0x74, 0x61, 0x2e, 0x53, 0x6f, 0x75, 0x72, 0x63, 0x65, 0x54,
-	0x79, 0x70, 0x65, 0x52, 0x06, 0x73, 0x6f, 0x75, 0x72, 0x63, 0x65, 0x12, 0x12, 0x0a, 0x04, 0x6e,
-	0x61, 0x6d, 0x65, 0x18, 0x03, 0x20, 0x01, 0x28, 0x09, 0x52, 0x04, 0x6e, 0x61, 0x6d, 0x65, 0x12,
-	0x2c, 0x0a, 0x05, 0x63, 0x6f, 0x73, 0x74, 0x73, 0x18, 0x04, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x16,
-	0x2e, 0x6d, 0x65, 0x74, 0x61, 0x64, 0x61, 0x74, 0x61, 0x2e, 0x48, 0x61, 0x73, 0x68, 0x69, 0x6e,
-	0x67, 0x43, 0x6f, 0x73, 0x74, 0x73, 0x52, 0x05, 0x63, 0x6f, 0x73, 0x74, 0x73, 0x12, 0x12, 0x0a,
-	0x04, 0x73, 0x61, 0x6c, 0x74, 0x18, 0x05, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x04, 0x73, 0x61, 0x6c,
-	0x74, 0x12, 0x10, 0x0a, 0x03, 0x75, 0x69, 0x64, 0x18, 0x06, 0x20, 0x01, 0x28, 0x03, 0x52, 0x03,
-	0x75, 0x69, 0x64, 0x12, 0x39, 0x0a, 0x0b, 0x77, 0x72, 0x61, 0x70, 0x70, 0x65, 0x64, 0x5f, 0x6b,
-	0x65, 0x79, 0x18, 0x07, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x18, 0x2e, 0x6d, 0x65, 0x74, 0x61, 0x64,
-	0x61, 0x74, 0x61, 0x2e, 0x57, 0x72, 0x61, 0x70, 0x70, 0x65, 0x64, 0x4b, 0x65, 0x79, 0x44, 0x61,
-	0x74, 0x61, 0x52, 0x0a, 0x77, 0x72, 0x61, 0x70, 0x70, 0x65, 0x64, 0x4b, 0x65, 0x79, 0x22, 0x91,
-	0x03, 0x0a, 0x11, 0x45, 0x6e, 0x63, 0x72, 0x79, 0x70, 0x74, 0x69, 0x6f, 0x6e, 0x4f, 0x70, 0x74,
-	0x69, 0x6f, 0x6e, 0x73, 0x12, 0x18, 0x0a, 0x07, 0x70, 0x61, 0x64, 0x64, 0x69, 0x6e, 0x67, 0x18,
-	0x01, 0x20, 0x01, 0x28, 0x03, 0x52, 0x07, 0x70, 0x61, 0x64, 0x64, 0x69, 0x6e, 0x67, 0x12, 0x3c,
-	0x0a, 0x08, 0x63, 0x6f, 0x6e, 0x74, 0x65, 0x6e, 0x74, 0x73, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0e,
-	0x32, 0x20, 0x2e, 0x6d, 0x65, 0x74, 0x61, 0x64, 0x61, 0x74, 0x61, 0x2e, 0x45, 0x6e, 0x63, 0x72,
-	0x79, 0x70, 0x74, 0x69, 0x6f, 0x6e, 0x4f, 0x70, 0x74, 0x69, 0x6f, 0x6e, 0x73, 0x2e, 0x4d, 0x6f,
-	0x64, 0x65, 0x52, 0x08, 0x63, 0x6f, 0x6e, 0x74, 0x65, 0x6e, 0x74, 0x73, 0x12, 0x3e, 0x0a, 0x09,
-	0x66, 0x69, 0x6c, 0x65, 0x6e, 0x61, 0x6d, 0x65, 0x73, 0x18, 0x03, 0x20, 0x01, 0x28, 0x0e, 0x32,
+	0x75, 0x6e, 0x63, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x46, 0x69, 0x78, 0x65, 0x64, 0x12, 0x1f, 0x0a,
+	0x03, 0x6b, 0x64, 0x66, 0x18, 0x06, 0x20, 0x01, 0x28, 0x0e, 0x32, 0x0d, 0x2e, 0x6d, 0x65, 0x74,
+	0x61, 0x64, 0x61, 0x74, 0x61, 0x2e, 0x4b, 0x44, 0x46, 0x52, 0x03, 0x6b, 0x64, 0x66, 0x22, 0x59,
+	0x0a, 0x0e, 0x57, 0x72, 0x61, 0x70, 0x70, 0x65, 0x64, 0x4b, 0x65, 0x79, 0x44, 0x61, 0x74, 0x61,
+	0x12, 0x0e, 0x0a, 0x02, 0x49, 0x56, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x02, 0x49, 0x56,
+	0x12, 0x23, 0x0a, 0x0d, 0x65, 0x6e, 0x63, 0x72, 0x79, 0x70, 0x74, 0x65, 0x64, 0x5f, 0x6b, 0x65,
+	0x79, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x0c, 0x65, 0x6e, 0x63, 0x72, 0x79, 0x70, 0x74,
+	0x65, 0x64, 0x4b, 0x65, 0x79, 0x12, 0x12, 0x0a, 0x04, 0x68, 0x6d, 0x61, 0x63, 0x18, 0x03, 0x20,
+	0x01, 0x28, 0x0c, 0x52, 0x04, 0x68, 0x6d, 0x61, 0x63, 0x22, 0xdb, 0x09, 0x0a, 0x0d, 0x50, 0x72,
+	0x6f, 0x74, 0x65, 0x63, 0x74, 0x6f, 0x72, 0x44, 0x61, 0x74, 0x61, 0x12, 0x31, 0x0a, 0x14, 0x70,
+	0x72, 0x6f, 0x74, 0x65, 0x63, 0x74, 0x6f, 0x72, 0x5f, 0x64, 0x65, 0x73, 0x63, 0x72, 0x69, 0x70,
+	0x74, 0x6f, 0x72, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x13, 0x70, 0x72, 0x6f, 0x74, 0x65,
+	0x63, 0x74, 0x6f, 0x72, 0x44, 0x65, 0x73, 0x63, 0x72, 0x69, 0x70, 0x74, 0x6f, 0x72, 0x12, 0x2c,
+	0x0a, 0x06, 0x73, 0x6f, 0x75, 0x72, 0x63, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0e, 0x32, 0x14,
+	0x2e, 0x6d, 0x65, 0x74, 0x61, 0x64, 0x61, 0x74, 0x61, 0x2e, 0x53, 0x6f, 0x75, 0x72, 0x63, 0x65,
+	0x54, 0x79, 0x70, 0x65, 0x52, 0x06, 0x73, 0x6f, 0x75, 0x72, 0x63, 0x65, 0x12, 0x12, 0x0a, 0x04,
+	0x6e, 0x61, 0x6d, 0x65, 0x18, 0x03, 0x20, 0x01, 0x28, 0x09, 0x52, 0x04, 0x6e, 0x61, 0x6d, 0x65,
+	0x12, 0x2c, 0x0a, 0x05, 0x63, 0x6f, 0x73, 0x74, 0x73, 0x18, 0x04, 0x20, 0x01, 0x28, 0x0b, 0x32,
+	0x16, 0x2e, 0x6d, 0x65, 0x74, 0x61, 0x64, 0x61, 0x74, 0x61, 0x2e, 0x48, 0x61, 0x73, 0x68, 0x69,
+	0x6e, 0x67, 0x43, 0x6f, 0x73, 0x74, 0x73, 0x52, 0x05, 0x63, 0x6f, 0x73, 0x74, 0x73, 0x12, 0x12,
+	0x0a, 0x04, 0x73, 0x61, 0x6c, 0x74, 0x18, 0x05, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x04, 0x73, 0x61,
+	0x6c, 0x74, 0x12, 0x10, 0x0a, 0x03, 0x75, 0x69, 0x64, 0x18, 0x06, 0x20, 0x01, 0x28, 0x03, 0x52,
+	0x03, 0x75, 0x69, 0x64, 0x12, 0x39, 0x0a, 0x0b, 0x77, 0x72, 0x61, 0x70, 0x70, 0x65, 0x64, 0x5f,
+	0x6b, 0x65, 0x79, 0x18, 0x07, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x18, 0x2e, 0x6d, 0x65, 0x74, 0x61,
+	0x64, 0x61, 0x74, 0x61, 0x2e, 0x57, 0x72, 0x61, 0x70, 0x70, 0x65, 0x64, 0x4b, 0x65, 0x79, 0x44,
+	0x61, 0x74, 0x61, 0x52, 0x0a, 0x77, 0x72, 0x61, 0x70, 0x70, 0x65, 0x64, 0x4b, 0x65, 0x79, 0x12,
+	0x3f, 0x0a, 0x0e, 0x65, 0x6e, 0x63, 0x72, 0x79, 0x70, 0x74, 0x65, 0x64, 0x5f, 0x6e, 0x61, 0x6d,
+	0x65, 0x18, 0x08, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x18, 0x2e, 0x6d, 0x65, 0x74, 0x61, 0x64, 0x61,
+	0x74, 0x61, 0x2e, 0x57, 0x72, 0x61, 0x70, 0x70, 0x65, 0x64, 0x4b, 0x65, 0x79, 0x44, 0x61, 0x74,
+	0x61, 0x52, 0x0d, 0x65, 0x6e, 0x63, 0x72, 0x79, 0x70, 0x74, 0x65, 0x64, 0x4e, 0x61, 0x6d, 0x65,
+	0x12, 0x2e, 0x0a, 0x13, 0x66, 0x69, 0x64, 0x6f, 0x32, 0x5f, 0x63, 0x72, 0x65, 0x64, 0x65, 0x6e,
+	0x74, 0x69, 0x61, 0x6c, 0x5f, 0x69, 0x64, 0x18, 0x09, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x11, 0x66,
+	0x69, 0x64, 0x6f, 0x32, 0x43, 0x72, 0x65, 0x64, 0x65, 0x6e, 0x74, 0x69, 0x61, 0x6c, 0x49, 0x64,
+	0x12, 0x1d, 0x0a, 0x0a, 0x66, 0x69, 0x64, 0x6f, 0x32, 0x5f, 0x73, 0x61, 0x6c, 0x74, 0x18, 0x0a,
+	0x20, 0x01, 0x28, 0x0c, 0x52, 0x09, 0x66, 0x69, 0x64, 0x6f, 0x32, 0x53, 0x61, 0x6c, 0x74, 0x12,
+	0x25, 0x0a, 0x0e, 0x73, 0x63, 0x68, 0x65, 0x6d, 0x61, 0x5f, 0x76, 0x65, 0x72, 0x73, 0x69, 0x6f,
+	0x6e, 0x18, 0x0b, 0x20, 0x01, 0x28, 0x03, 0x52, 0x0d, 0x73, 0x63, 0x68, 0x65, 0x6d, 0x61, 0x56,
+	0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x12, 0x1f, 0x0a, 0x0b, 0x74, 0x70, 0x6d, 0x32, 0x5f, 0x70,
+	0x75, 0x62, 0x6c, 0x69, 0x63, 0x18, 0x0c, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x0a, 0x74, 0x70, 0x6d,
+	0x32, 0x50, 0x75, 0x62, 0x6c, 0x69, 0x63, 0x12, 0x21, 0x0a, 0x0c, 0x74, 0x70, 0x6d, 0x32, 0x5f,
+	0x70, 0x72, 0x69, 0x76, 0x61, 0x74, 0x65, 0x18, 0x0d, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x0b, 0x74,
+	0x70, 0x6d, 0x32, 0x50, 0x72, 0x69, 0x76, 0x61, 0x74, 0x65, 0x12, 0x1b, 0x0a, 0x09, 0x74, 0x70,
+	0x6d, 0x32, 0x5f, 0x70, 0x63, 0x72, 0x73, 0x18, 0x0e, 0x20, 0x03, 0x28, 0x0d, 0x52, 0x08, 0x74,
+	0x70, 0x6d, 0x32, 0x50, 0x63, 0x72, 0x73, 0x12, 0x23, 0x0a, 0x0d, 0x70, 0x6b, 0x63, 0x73, 0x31,
+	0x31, 0x5f, 0x6d, 0x6f, 0x64, 0x75, 0x6c, 0x65, 0x18, 0x0f, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0c,
+	0x70, 0x6b, 0x63, 0x73, 0x31, 0x31, 0x4d, 0x6f, 0x64, 0x75, 0x6c, 0x65, 0x12, 0x1f, 0x0a, 0x0b,
+	0x70, 0x6b, 0x63, 0x73, 0x31, 0x31, 0x5f, 0x73, 0x6c, 0x6f, 0x74, 0x18, 0x10, 0x20, 0x01, 0x28,
+	0x09, 0x52, 0x0a, 0x70, 0x6b, 0x63, 0x73, 0x31, 0x31, 0x53, 0x6c, 0x6f, 0x74, 0x12, 0x22, 0x0a,
+	0x0d, 0x70, 0x6b, 0x63, 0x73, 0x31, 0x31, 0x5f, 0x6b, 0x65, 0x79, 0x5f, 0x69, 0x64, 0x18, 0x11,
+	0x20, 0x01, 0x28, 0x0c, 0x52, 0x0b, 0x70, 0x6b, 0x63, 0x73, 0x31, 0x31, 0x4b, 0x65, 0x79, 0x49,
+	0x64, 0x12, 0x2a, 0x0a, 0x11, 0x70, 0x6b, 0x63, 0x73, 0x31, 0x31, 0x5f, 0x70, 0x75, 0x62, 0x6c,
+	0x69, 0x63, 0x5f, 0x6b, 0x65, 0x79, 0x18, 0x12, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x0f, 0x70, 0x6b,
+	0x63, 0x73, 0x31, 0x31, 0x50, 0x75, 0x62, 0x6c, 0x69, 0x63, 0x4b, 0x65, 0x79, 0x12, 0x2c, 0x0a,
+	0x12, 0x70, 0x6b, 0x63, 0x73, 0x31, 0x31, 0x5f, 0x77, 0x72, 0x61, 0x70, 0x70, 0x65, 0x64, 0x5f,
+	0x6b, 0x65, 0x79, 0x18, 0x13, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x10, 0x70, 0x6b, 0x63, 0x73, 0x31,
+	0x31, 0x57, 0x72, 0x61, 0x70, 0x70, 0x65, 0x64, 0x4b, 0x65, 0x79, 0x12, 0x17, 0x0a, 0x07, 0x6b,
+	0x6d, 0x73, 0x5f, 0x6b, 0x65, 0x79, 0x18, 0x14, 0x20, 0x01, 0x28, 0x09, 0x52, 0x06, 0x6b, 0x6d,
+	0x73, 0x4b, 0x65, 0x79, 0x12, 0x26, 0x0a, 0x0f, 0x6b, 0x6d, 0x73, 0x5f, 0x77, 0x72, 0x61, 0x70,
+	0x70, 0x65, 0x64, 0x5f, 0x6b, 0x65, 0x79, 0x18, 0x15, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x0d, 0x6b,
+	0x6d, 0x73, 0x57, 0x72, 0x61, 0x70, 0x70, 0x65, 0x64, 0x4b, 0x65, 0x79, 0x12, 0x19, 0x0a, 0x08,
+	0x74, 0x61, 0x6e, 0x67, 0x5f, 0x75, 0x72, 0x6c, 0x18, 0x16, 0x20, 0x01, 0x28, 0x09, 0x52, 0x07,
+	0x74, 0x61, 0x6e, 0x67, 0x55, 0x72, 0x6c, 0x12, 0x26, 0x0a, 0x0f, 0x74, 0x61, 0x6e, 0x67, 0x5f,
+	0x73, 0x65, 0x72, 0x76, 0x65, 0x72, 0x5f, 0x6b, 0x65, 0x79, 0x18, 0x17, 0x20, 0x01, 0x28, 0x09,
+	0x52, 0x0d, 0x74, 0x61, 0x6e, 0x67, 0x53, 0x65, 0x72, 0x76, 0x65, 0x72, 0x4b, 0x65, 0x79, 0x12,
+	0x26, 0x0a, 0x0f, 0x74, 0x61, 0x6e, 0x67, 0x5f, 0x63, 0x6c, 0x69, 0x65, 0x6e, 0x74, 0x5f, 0x6b,
+	0x65, 0x79, 0x18, 0x18, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x0d, 0x74, 0x61, 0x6e, 0x67, 0x43, 0x6c,
+	0x69, 0x65, 0x6e, 0x74, 0x4b, 0x65, 0x79, 0x12, 0x21, 0x0a, 0x0c, 0x79, 0x75, 0x62, 0x69, 0x6b,
+	0x65, 0x79, 0x5f, 0x73, 0x6c, 0x6f, 0x74, 0x18, 0x19, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x0b, 0x79,
+	0x75, 0x62, 0x69, 0x6b, 0x65, 0x79, 0x53, 0x6c, 0x6f, 0x74, 0x12, 0x2b, 0x0a, 0x11, 0x79, 0x75,
+	0x62, 0x69, 0x6b, 0x65, 0x79, 0x5f, 0x63, 0x68, 0x61, 0x6c, 0x6c, 0x65, 0x6e, 0x67, 0x65, 0x18,
+	0x1a, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x10, 0x79, 0x75, 0x62, 0x69, 0x6b, 0x65, 0x79, 0x43, 0x68,
+	0x61, 0x6c, 0x6c, 0x65, 0x6e, 0x67, 0x65, 0x12, 0x23, 0x0a, 0x0d, 0x67, 0x70, 0x67, 0x5f, 0x72,
+	0x65, 0x63, 0x69, 0x70, 0x69, 0x65, 0x6e, 0x74, 0x18, 0x1b, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0c,
+	0x67, 0x70, 0x67, 0x52, 0x65, 0x63, 0x69, 0x70, 0x69, 0x65, 0x6e, 0x74, 0x12, 0x26, 0x0a, 0x0f,
+	0x67, 0x70, 0x67, 0x5f, 0x77, 0x72, 0x61, 0x70, 0x70, 0x65, 0x64, 0x5f, 0x6b, 0x65, 0x79, 0x18,
+	0x1c, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x0d, 0x67, 0x70, 0x67, 0x57, 0x72, 0x61, 0x70, 0x70, 0x65,
+	0x64, 0x4b, 0x65, 0x79, 0x12, 0x24, 0x0a, 0x0e, 0x73, 0x73, 0x68, 0x5f, 0x70, 0x75, 0x62, 0x6c,
+	0x69, 0x63, 0x5f, 0x6b, 0x65, 0x79, 0x18, 0x1d, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x0c, 0x73, 0x73,
+	0x68, 0x50, 0x75, 0x62, 0x6c, 0x69, 0x63, 0x4b, 0x65, 0x79, 0x12, 0x23, 0x0a, 0x0d, 0x73, 0x73,
+	0x68, 0x5f, 0x63, 0x68, 0x61, 0x6c, 0x6c, 0x65, 0x6e, 0x67, 0x65, 0x18, 0x1e, 0x20, 0x01, 0x28,
+	0x0c, 0x52, 0x0c, 0x73, 0x73, 0x68, 0x43, 0x68, 0x61, 0x6c, 0x6c, 0x65, 0x6e, 0x67, 0x65, 0x12,
+	0x23, 0x0a, 0x0d, 0x6d, 0x65, 0x74, 0x61, 0x64, 0x61, 0x74, 0x61, 0x5f, 0x68, 0x6d, 0x61, 0x63,
+	0x18, 0x1f, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x0c, 0x6d, 0x65, 0x74, 0x61, 0x64, 0x61, 0x74, 0x61,
+	0x48, 0x6d, 0x61, 0x63, 0x12, 0x31, 0x0a, 0x06, 0x61, 0x63, 0x63, 0x65, 0x73, 0x73, 0x18, 0x20,
+	0x20, 0x01, 0x28, 0x0b, 0x32, 0x19, 0x2e, 0x6d, 0x65, 0x74, 0x61, 0x64, 0x61, 0x74, 0x61, 0x2e,
+	0x50, 0x72, 0x6f, 0x74, 0x65, 0x63, 0x74, 0x6f, 0x72, 0x41, 0x63, 0x63, 0x65, 0x73, 0x73, 0x52,
+	0x06, 0x61, 0x63, 0x63, 0x65, 0x73, 0x73, 0x22, 0x74, 0x0a, 0x0f, 0x50, 0x72, 0x6f, 0x74, 0x65,
+	0x63, 0x74, 0x6f, 0x72, 0x41, 0x63, 0x63, 0x65, 0x73, 0x73, 0x12, 0x1b, 0x0a, 0x09, 0x6f, 0x77,
+	0x6e, 0x65, 0x72, 0x5f, 0x75, 0x69, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28, 0x03, 0x52, 0x08, 0x6f,
+	0x77, 0x6e, 0x65, 0x72, 0x55, 0x69, 0x64, 0x12, 0x21, 0x0a, 0x0c, 0x61, 0x6c, 0x6c, 0x6f, 0x77,
+	0x65, 0x64, 0x5f, 0x75, 0x69, 0x64, 0x73, 0x18, 0x02, 0x20, 0x03, 0x28, 0x03, 0x52, 0x0b, 0x61,
+	0x6c, 0x6c, 0x6f, 0x77, 0x65, 0x64, 0x55, 0x69, 0x64, 0x73, 0x12, 0x21, 0x0a, 0x0c, 0x61, 0x6c,
+	0x6c, 0x6f, 0x77, 0x65, 0x64, 0x5f, 0x67, 0x69, 0x64, 0x73, 0x18, 0x03, 0x20, 0x03, 0x28, 0x03,
+	0x52, 0x0b, 0x61, 0x6c, 0x6c, 0x6f, 0x77, 0x65, 0x64, 0x47, 0x69, 0x64, 0x73, 0x22, 0xa5, 0x04,
+	0x0a, 0x11, 0x45, 0x6e, 0x63, 0x72, 0x79, 0x70, 0x74, 0x69, 0x6f, 0x6e, 0x4f, 0x70, 0x74, 0x69,
+	0x6f, 0x6e, 0x73, 0x12, 0x18, 0x0a, 0x07, 0x70, 0x61, 0x64, 0x64, 0x69, 0x6e, 0x67, 0x18, 0x01,
+	0x20, 0x01, 0x28, 0x03, 0x52, 0x07, 0x70, 0x61, 0x64, 0x64, 0x69, 0x6e, 0x67, 0x12, 0x3c, 0x0a,
+	0x08, 0x63, 0x6f, 0x6e, 0x74, 0x65, 0x6e, 0x74, 0x73, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0e, 0x32,
 	0x20, 0x2e, 0x6d, 0x65, 0x74, 0x61, 0x64, 0x61, 0x74, 0x61, 0x2e, 0x45, 0x6e, 0x63, 0x72, 0x79,
 	0x70, 0x74, 0x69, 0x6f, 0x6e, 0x4f, 0x70, 0x74, 0x69, 0x6f, 0x6e, 0x73, 0x2e, 0x4d, 0x6f, 0x64,
-	0x65, 0x52, 0x09, 0x66, 0x69, 0x6c, 0x65, 0x6e, 0x61, 0x6d, 0x65, 0x73, 0x12, 0x25, 0x0a, 0x0e,
-	0x70, 0x6f, 0x6c, 0x69, 0x63, 0x79, 0x5f, 0x76, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x18, 0x04,
-	0x20, 0x01, 0x28, 0x03, 0x52, 0x0d, 0x70, 0x6f, 0x6c, 0x69, 0x63, 0x79, 0x56, 0x65, 0x72, 0x73,
-	0x69, 0x6f, 0x6e, 0x22, 0xbc, 0x01, 0x0a, 0x04, 0x4d, 0x6f, 0x64, 0x65, 0x12, 0x0b, 0x0a, 0x07,
-	0x64, 0x65, 0x66, 0x61, 0x75, 0x6c, 0x74, 0x10, 0x00, 0x12, 0x0f, 0x0a, 0x0b, 0x41, 0x45, 0x53,
-	0x5f, 0x32, 0x35, 0x36, 0x5f, 0x58, 0x54, 0x53, 0x10, 0x01, 0x12, 0x0f, 0x0a, 0x0b, 0x41, 0x45,
-	0x53, 0x5f, 0x32, 0x35, 0x36, 0x5f, 0x47, 0x43, 0x4d, 0x10, 0x02, 0x12, 0x0f, 0x0a, 0x0b, 0x41,
-	0x45, 0x53, 0x5f, 0x32, 0x35, 0x36, 0x5f, 0x43, 0x42, 0x43, 0x10, 0x03, 0x12, 0x0f, 0x0a, 0x0b,
-	0x41, 0x45, 0x53, 0x5f, 0x32, 0x35, 0x36, 0x5f, 0x43, 0x54, 0x53, 0x10, 0x04, 0x12, 0x0f, 0x0a,
-	0x0b, 0x41, 0x45, 0x53, 0x5f, 0x31, 0x32, 0x38, 0x5f, 0x43, 0x42, 0x43, 0x10, 0x05, 0x12, 0x0f,
-	0x0a, 0x0b, 0x41, 0x45, 0x53, 0x5f, 0x31, 0x32, 0x38, 0x5f, 0x43, 0x54, 0x53, 0x10, 0x06, 0x12,
-	0x0c, 0x0a, 0x08, 0x41, 0x64, 0x69, 0x61, 0x6e, 0x74, 0x75, 0x6d, 0x10, 0x09, 0x12, 0x11, 0x0a,
-	0x0d, 0x41, 0x45, 0x53, 0x5f, 0x32, 0x35, 0x36, 0x5f, 0x48, 0x43, 0x54, 0x52, 0x32, 0x10, 0x0a,
-	0x12, 0x0f, 0x0a, 0x0b, 0x4c, 0x45, 0x41, 0x5f, 0x32, 0x35, 0x36, 0x5f, 0x58, 0x54, 0x53, 0x10,
-	0x0b, 0x12, 0x0f, 0x0a, 0x0b, 0x4c, 0x45, 0x41, 0x5f, 0x32, 0x35, 0x36, 0x5f, 0x43, 0x54, 0x53,
-	0x10, 0x0c, 0x22, 0x80, 0x01, 0x0a, 0x10, 0x57, 0x72, 0x61, 0x70, 0x70, 0x65, 0x64, 0x50, 0x6f,
-	0x6c, 0x69, 0x63, 0x79, 0x4b, 0x65, 0x79, 0x12, 0x31, 0x0a, 0x14, 0x70, 0x72, 0x6f, 0x74, 0x65,
-	0x63, 0x74, 0x6f, 0x72, 0x5f, 0x64, 0x65, 0x73, 0x63, 0x72, 0x69, 0x70, 0x74, 0x6f, 0x72, 0x18,
-	0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x13, 0x70, 0x72, 0x6f, 0x74, 0x65, 0x63, 0x74, 0x6f, 0x72,
-	0x44, 0x65, 0x73, 0x63, 0x72, 0x69, 0x70, 0x74, 0x6f, 0x72, 0x12, 0x39, 0x0a, 0x0b, 0x77, 0x72,
-	0x61, 0x70, 0x70, 0x65, 0x64, 0x5f, 0x6b, 0x65, 0x79, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0b, 0x32,
+	0x65, 0x52, 0x08, 0x63, 0x6f, 0x6e, 0x74, 0x65, 0x6e, 0x74, 0x73, 0x12, 0x3e, 0x0a, 0x09, 0x66,
+	0x69, 0x6c, 0x65, 0x6e, 0x61, 0x6d, 0x65, 0x73, 0x18, 0x03, 0x20, 0x01, 0x28, 0x0e, 0x32, 0x20,
+	0x2e, 0x6d, 0x65, 0x74, 0x61, 0x64, 0x61, 0x74, 0x61, 0x2e, 0x45, 0x6e, 0x63, 0x72, 0x79, 0x70,
+	0x74, 0x69, 0x6f, 0x6e, 0x4f, 0x70, 0x74, 0x69, 0x6f, 0x6e, 0x73, 0x2e, 0x4d, 0x6f, 0x64, 0x65,
+	0x52, 0x09, 0x66, 0x69, 0x6c, 0x65, 0x6e, 0x61, 0x6d, 0x65, 0x73, 0x12, 0x25, 0x0a, 0x0e, 0x70,
+	0x6f, 0x6c, 0x69, 0x63, 0x79, 0x5f, 0x76, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x18, 0x04, 0x20,
+	0x01, 0x28, 0x03, 0x52, 0x0d, 0x70, 0x6f, 0x6c, 0x69, 0x63, 0x79, 0x56, 0x65, 0x72, 0x73, 0x69,
+	0x6f, 0x6e, 0x12, 0x24, 0x0a, 0x0e, 0x64, 0x61, 0x74, 0x61, 0x5f, 0x75, 0x6e, 0x69, 0x74, 0x5f,
+	0x73, 0x69, 0x7a, 0x65, 0x18, 0x05, 0x20, 0x01, 0x28, 0x03, 0x52, 0x0c, 0x64, 0x61, 0x74, 0x61,
+	0x55, 0x6e, 0x69, 0x74, 0x53, 0x69, 0x7a, 0x65, 0x12, 0x22, 0x0a, 0x0d, 0x6e, 0x6f, 0x5f, 0x64,
+	0x69, 0x72, 0x65, 0x63, 0x74, 0x5f, 0x6b, 0x65, 0x79, 0x18, 0x06, 0x20, 0x01, 0x28, 0x08, 0x52,
+	0x0b, 0x6e, 0x6f, 0x44, 0x69, 0x72, 0x65, 0x63, 0x74, 0x4b, 0x65, 0x79, 0x12, 0x23, 0x0a, 0x0e,
+	0x69, 0x76, 0x5f, 0x69, 0x6e, 0x6f, 0x5f, 0x6c, 0x62, 0x6c, 0x6b, 0x5f, 0x36, 0x34, 0x18, 0x07,
+	0x20, 0x01, 0x28, 0x08, 0x52, 0x0b, 0x69, 0x76, 0x49, 0x6e, 0x6f, 0x4c, 0x62, 0x6c, 0x6b, 0x36,
+	0x34, 0x12, 0x23, 0x0a, 0x0e, 0x69, 0x76, 0x5f, 0x69, 0x6e, 0x6f, 0x5f, 0x6c, 0x62, 0x6c, 0x6b,
+	0x5f, 0x33, 0x32, 0x18, 0x08, 0x20, 0x01, 0x28, 0x08, 0x52, 0x0b, 0x69, 0x76, 0x49, 0x6e, 0x6f,
+	0x4c, 0x62, 0x6c, 0x6b, 0x33, 0x32, 0x22, 0xbc, 0x01, 0x0a, 0x04, 0x4d, 0x6f, 0x64, 0x65, 0x12,
+	0x0b, 0x0a, 0x07, 0x64, 0x65, 0x66, 0x61, 0x75, 0x6c, 0x74, 0x10, 0x00, 0x12, 0x0f, 0x0a, 0x0b,
+	0x41, 0x45, 0x53, 0x5f, 0x32, 0x35, 0x36, 0x5f, 0x58, 0x54, 0x53, 0x10, 0x01, 0x12, 0x0f, 0x0a,
+	0x0b, 0x41, 0x45, 0x53, 0x5f, 0x32, 0x35, 0x36, 0x5f, 0x47, 0x43, 0x4d, 0x10, 0x02, 0x12, 0x0f,
+	0x0a, 0x0b, 0x41, 0x45, 0x53, 0x5f, 0x32, 0x35, 0x36, 0x5f, 0x43, 0x42, 0x43, 0x10, 0x03, 0x12,
+	0x0f, 0x0a, 0x0b, 0x41, 0x45, 0x53, 0x5f, 0x32, 0x35, 0x36, 0x5f, 0x43, 0x54, 0x53, 0x10, 0x04,
+	0x12, 0x0f, 0x0a, 0x0b, 0x41, 0x45, 0x53, 0x5f, 0x31, 0x32, 0x38, 0x5f, 0x43, 0x42, 0x43, 0x10,
+	0x05, 0x12, 0x0f, 0x0a, 0x0b, 0x41, 0x45, 0x53, 0x5f, 0x31, 0x32, 0x38, 0x5f, 0x43, 0x54, 0x53,
+	0x10, 0x06, 0x12, 0x0c, 0x0a, 0x08, 0x41, 0x64, 0x69, 0x61, 0x6e, 0x74, 0x75, 0x6d, 0x10, 0x09,
+	0x12, 0x11, 0x0a, 0x0d, 0x41, 0x45, 0x53, 0x5f, 0x32, 0x35, 0x36, 0x5f, 0x48, 0x43, 0x54, 0x52,
+	0x32, 0x10, 0x0a, 0x12, 0x0f, 0x0a, 0x0b, 0x4c, 0x45, 0x41, 0x5f, 0x32, 0x35, 0x36, 0x5f, 0x58,
+	0x54, 0x53, 0x10, 0x0b, 0x12, 0x0f, 0x0a, 0x0b, 0x4c, 0x45, 0x41, 0x5f, 0x32, 0x35, 0x36, 0x5f,
+	0x43, 0x54, 0x53, 0x10, 0x0c, 0x22, 0xe0, 0x01, 0x0a, 0x10, 0x57, 0x72, 0x61, 0x70, 0x70, 0x65,
+	0x64, 0x50, 0x6f, 0x6c, 0x69, 0x63, 0x79, 0x4b, 0x65, 0x79, 0x12, 0x31, 0x0a, 0x14, 0x70, 0x72,
+	0x6f, 0x74, 0x65, 0x63, 0x74, 0x6f, 0x72, 0x5f, 0x64, 0x65, 0x73, 0x63, 0x72, 0x69, 0x70, 0x74,
+	0x6f, 0x72, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x13, 0x70, 0x72, 0x6f, 0x74, 0x65, 0x63,
+	0x74, 0x6f, 0x72, 0x44, 0x65, 0x73, 0x63, 0x72, 0x69, 0x70, 0x74, 0x6f, 0x72, 0x12, 0x39, 0x0a,
+	0x0b, 0x77, 0x72, 0x61, 0x70, 0x70, 0x65, 0x64, 0x5f, 0x6b, 0x65, 0x79, 0x18, 0x02, 0x20, 0x01,
+	0x28, 0x0b, 0x32, 0x18, 0x2e, 0x6d, 0x65, 0x74, 0x61, 0x64, 0x61, 0x74, 0x61, 0x2e, 0x57, 0x72,
+	0x61, 0x70, 0x70, 0x65, 0x64, 0x4b, 0x65, 0x79, 0x44, 0x61, 0x74, 0x61, 0x52, 0x0a, 0x77, 0x72,
+	0x61, 0x70, 0x70, 0x65, 0x64, 0x4b, 0x65, 0x79, 0x12, 0x3d, 0x0a, 0x0d, 0x77, 0x72, 0x61, 0x70,
+	0x70, 0x65, 0x64, 0x5f, 0x73, 0x68, 0x61, 0x72, 0x65, 0x18, 0x03, 0x20, 0x01, 0x28, 0x0b, 0x32,
 	0x18, 0x2e, 0x6d, 0x65, 0x74, 0x61, 0x64, 0x61, 0x74, 0x61, 0x2e, 0x57, 0x72, 0x61, 0x70, 0x70,
-	0x65, 0x64, 0x4b, 0x65, 0x79, 0x44, 0x61, 0x74, 0x61, 0x52, 0x0a, 0x77, 0x72, 0x61, 0x70, 0x70,
-	0x65, 0x64, 0x4b, 0x65, 0x79, 0x22, 0xb6, 0x01, 0x0a, 0x0a, 0x50, 0x6f, 0x6c, 0x69, 0x63, 0x79,
-	0x44, 0x61, 0x74, 0x61, 0x12, 0x25, 0x0a, 0x0e, 0x6b, 0x65, 0x79, 0x5f, 0x64, 0x65, 0x73, 0x63,
-	0x72, 0x69, 0x70, 0x74, 0x6f, 0x72, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0d, 0x6b, 0x65,
-	0x79, 0x44, 0x65, 0x73, 0x63, 0x72, 0x69, 0x70, 0x74, 0x6f, 0x72, 0x12, 0x35, 0x0a, 0x07, 0x6f,
-	0x70, 0x74, 0x69, 0x6f, 0x6e, 0x73, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x1b, 0x2e, 0x6d,
-	0x65, 0x74, 0x61, 0x64, 0x61, 0x74, 0x61, 0x2e, 0x45, 0x6e, 0x63, 0x72, 0x79, 0x70, 0x74, 0x69,
-	0x6f, 0x6e, 0x4f, 0x70, 0x74, 0x69, 0x6f, 0x6e, 0x73, 0x52, 0x07, 0x6f, 0x70, 0x74, 0x69, 0x6f,
-	0x6e, 0x73, 0x12, 0x4a, 0x0a, 0x13, 0x77, 0x72, 0x61, 0x70, 0x70, 0x65, 0x64, 0x5f, 0x70, 0x6f,
-	0x6c, 0x69, 0x63, 0x79, 0x5f, 0x6b, 0x65, 0x79, 0x73, 0x18, 0x03, 0x20, 0x03, 0x28, 0x0b, 0x32,
-	0x1a, 0x2e, 0x6d, 0x65, 0x74, 0x61, 0x64, 0x61, 0x74, 0x61, 0x2e, 0x57, 0x72, 0x61, 0x70, 0x70,
-	0x65, 0x64, 0x50, 0x6f, 0x6c, 0x69, 0x63, 0x79, 0x4b, 0x65, 0x79, 0x52, 0x11, 0x77, 0x72, 0x61,
-	0x70, 0x70, 0x65, 0x64, 0x50, 0x6f, 0x6c, 0x69, 0x63, 0x79, 0x4b, 0x65, 0x79, 0x73, 0x22, 0xb7,
-	0x02, 0x0a, 0x06, 0x43, 0x6f, 0x6e, 0x66, 0x69, 0x67, 0x12, 0x2c, 0x0a, 0x06, 0x73, 0x6f, 0x75,
+	0x65, 0x64, 0x4b, 0x65, 0x79, 0x44, 0x61, 0x74, 0x61, 0x52, 0x0c, 0x77, 0x72, 0x61, 0x70, 0x70,
+	0x65, 0x64, 0x53, 0x68, 0x61, 0x72, 0x65, 0x12, 0x1f, 0x0a, 0x0b, 0x73, 0x68, 0x61, 0x72, 0x65,
+	0x5f, 0x69, 0x6e, 0x64, 0x65, 0x78, 0x18, 0x04, 0x20, 0x01, 0x28, 0x03, 0x52, 0x0a, 0x73, 0x68,
+	0x61, 0x72, 0x65, 0x49, 0x6e, 0x64, 0x65, 0x78, 0x22, 0xa0, 0x02, 0x0a, 0x0a, 0x50, 0x6f, 0x6c,
+	0x69, 0x63, 0x79, 0x44, 0x61, 0x74, 0x61, 0x12, 0x25, 0x0a, 0x0e, 0x6b, 0x65, 0x79, 0x5f, 0x64,
+	0x65, 0x73, 0x63, 0x72, 0x69, 0x70, 0x74, 0x6f, 0x72, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52,
+	0x0d, 0x6b, 0x65, 0x79, 0x44, 0x65, 0x73, 0x63, 0x72, 0x69, 0x70, 0x74, 0x6f, 0x72, 0x12, 0x35,
+	0x0a, 0x07, 0x6f, 0x70, 0x74, 0x69, 0x6f, 0x6e, 0x73, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0b, 0x32,
+	0x1b, 0x2e, 0x6d, 0x65, 0x74, 0x61, 0x64, 0x61, 0x74, 0x61, 0x2e, 0x45, 0x6e, 0x63, 0x72, 0x79,
+	0x70, 0x74, 0x69, 0x6f, 0x6e, 0x4f, 0x70, 0x74, 0x69, 0x6f, 0x6e, 0x73, 0x52, 0x07, 0x6f, 0x70,
+	0x74, 0x69, 0x6f, 0x6e, 0x73, 0x12, 0x4a, 0x0a, 0x13, 0x77, 0x72, 0x61, 0x70, 0x70, 0x65, 0x64,
+	0x5f, 0x70, 0x6f, 0x6c, 0x69, 0x63, 0x79, 0x5f, 0x6b, 0x65, 0x79, 0x73, 0x18, 0x03, 0x20, 0x03,
+	0x28, 0x0b, 0x32, 0x1a, 0x2e, 0x6d, 0x65, 0x74, 0x61, 0x64, 0x61, 0x74, 0x61, 0x2e, 0x57, 0x72,
+	0x61, 0x70, 0x70, 0x65, 0x64, 0x50, 0x6f, 0x6c, 0x69, 0x63, 0x79, 0x4b, 0x65, 0x79, 0x52, 0x11,
+	0x77, 0x72, 0x61, 0x70, 0x70, 0x65, 0x64, 0x50, 0x6f, 0x6c, 0x69, 0x63, 0x79, 0x4b, 0x65, 0x79,
+	0x73, 0x12, 0x1c, 0x0a, 0x09, 0x74, 0x68, 0x72, 0x65, 0x73, 0x68, 0x6f, 0x6c, 0x64, 0x18, 0x04,
+	0x20, 0x01, 0x28, 0x03, 0x52, 0x09, 0x74, 0x68, 0x72, 0x65, 0x73, 0x68, 0x6f, 0x6c, 0x64, 0x12,
+	0x25, 0x0a, 0x0e, 0x73, 0x63, 0x68, 0x65, 0x6d, 0x61, 0x5f, 0x76, 0x65, 0x72, 0x73, 0x69, 0x6f,
+	0x6e, 0x18, 0x05, 0x20, 0x01, 0x28, 0x03, 0x52, 0x0d, 0x73, 0x63, 0x68, 0x65, 0x6d, 0x61, 0x56,
+	0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x12, 0x23, 0x0a, 0x0d, 0x6d, 0x65, 0x74, 0x61, 0x64, 0x61,
+	0x74, 0x61, 0x5f, 0x68, 0x6d, 0x61, 0x63, 0x18, 0x06, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x0c, 0x6d,
+	0x65, 0x74, 0x61, 0x64, 0x61, 0x74, 0x61, 0x48, 0x6d, 0x61, 0x63, 0x22, 0x5b, 0x0a, 0x0f, 0x42,
+	0x61, 0x63, 0x6b, 0x75, 0x70, 0x50, 0x72, 0x6f, 0x74, 0x65, 0x63, 0x74, 0x6f, 0x72, 0x12, 0x2b,
+	0x0a, 0x04, 0x64, 0x61, 0x74, 0x61, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x17, 0x2e, 0x6d,
+	0x65, 0x74, 0x61, 0x64, 0x61, 0x74, 0x61, 0x2e, 0x50, 0x72, 0x6f, 0x74, 0x65, 0x63, 0x74, 0x6f,
+	0x72, 0x44, 0x61, 0x74, 0x61, 0x52, 0x04, 0x64, 0x61, 0x74, 0x61, 0x12, 0x1b, 0x0a, 0x09, 0x6f,
+	0x77, 0x6e, 0x65, 0x72, 0x5f, 0x75, 0x69, 0x64, 0x18, 0x02, 0x20, 0x01, 0x28, 0x03, 0x52, 0x08,
+	0x6f, 0x77, 0x6e, 0x65, 0x72, 0x55, 0x69, 0x64, 0x22, 0x6b, 0x0a, 0x0c, 0x42, 0x61, 0x63, 0x6b,
+	0x75, 0x70, 0x50, 0x6f, 0x6c, 0x69, 0x63, 0x79, 0x12, 0x28, 0x0a, 0x04, 0x64, 0x61, 0x74, 0x61,
+	0x18, 0x01, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x14, 0x2e, 0x6d, 0x65, 0x74, 0x61, 0x64, 0x61, 0x74,
+	0x61, 0x2e, 0x50, 0x6f, 0x6c, 0x69, 0x63, 0x79, 0x44, 0x61, 0x74, 0x61, 0x52, 0x04, 0x64, 0x61,
+	0x74, 0x61, 0x12, 0x1b, 0x0a, 0x09, 0x6f, 0x77, 0x6e, 0x65, 0x72, 0x5f, 0x75, 0x69, 0x64, 0x18,
+	0x02, 0x20, 0x01, 0x28, 0x03, 0x52, 0x08, 0x6f, 0x77, 0x6e, 0x65, 0x72, 0x55, 0x69, 0x64, 0x12,
+	0x14, 0x0a, 0x05, 0x6c, 0x61, 0x62, 0x65, 0x6c, 0x18, 0x03, 0x20, 0x01, 0x28, 0x09, 0x52, 0x05,
+	0x6c, 0x61, 0x62, 0x65, 0x6c, 0x22, 0xc7, 0x01, 0x0a, 0x0e, 0x4d, 0x65, 0x74, 0x61, 0x64, 0x61,
+	0x74, 0x61, 0x42, 0x61, 0x63, 0x6b, 0x75, 0x70, 0x12, 0x39, 0x0a, 0x0a, 0x70, 0x72, 0x6f, 0x74,
+	0x65, 0x63, 0x74, 0x6f, 0x72, 0x73, 0x18, 0x01, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x19, 0x2e, 0x6d,
+	0x65, 0x74, 0x61, 0x64, 0x61, 0x74, 0x61, 0x2e, 0x42, 0x61, 0x63, 0x6b, 0x75, 0x70, 0x50, 0x72,
+	0x6f, 0x74, 0x65, 0x63, 0x74, 0x6f, 0x72, 0x52, 0x0a, 0x70, 0x72, 0x6f, 0x74, 0x65, 0x63, 0x74,
+	0x6f, 0x72, 0x73, 0x12, 0x32, 0x0a, 0x08, 0x70, 0x6f, 0x6c, 0x69, 0x63, 0x69, 0x65, 0x73, 0x18,
+	0x02, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x16, 0x2e, 0x6d, 0x65, 0x74, 0x61, 0x64, 0x61, 0x74, 0x61,
+	0x2e, 0x42, 0x61, 0x63, 0x6b, 0x75, 0x70, 0x50, 0x6f, 0x6c, 0x69, 0x63, 0x79, 0x52, 0x08, 0x70,
+	0x6f, 0x6c, 0x69, 0x63, 0x69, 0x65, 0x73, 0x12, 0x2b, 0x0a, 0x11, 0x6c, 0x69, 0x6e, 0x6b, 0x65,
+	0x64, 0x5f, 0x70, 0x72, 0x6f, 0x74, 0x65, 0x63, 0x74, 0x6f, 0x72, 0x73, 0x18, 0x03, 0x20, 0x03,
+	0x28, 0x09, 0x52, 0x10, 0x6c, 0x69, 0x6e, 0x6b, 0x65, 0x64, 0x50, 0x72, 0x6f, 0x74, 0x65, 0x63,
+	0x74, 0x6f, 0x72, 0x73, 0x12, 0x19, 0x0a, 0x08, 0x6e, 0x61, 0x6d, 0x65, 0x5f, 0x6b, 0x65, 0x79,
+	0x18, 0x04, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x07, 0x6e, 0x61, 0x6d, 0x65, 0x4b, 0x65, 0x79, 0x22,
+	0x44, 0x0a, 0x12, 0x4d, 0x65, 0x74, 0x61, 0x64, 0x61, 0x74, 0x61, 0x42, 0x61, 0x63, 0x6b, 0x75,
+	0x70, 0x46, 0x69, 0x6c, 0x65, 0x12, 0x16, 0x0a, 0x06, 0x62, 0x61, 0x63, 0x6b, 0x75, 0x70, 0x18,
+	0x01, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x06, 0x62, 0x61, 0x63, 0x6b, 0x75, 0x70, 0x12, 0x16, 0x0a,
+	0x06, 0x73, 0x68, 0x61, 0x32, 0x35, 0x36, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x06, 0x73,
+	0x68, 0x61, 0x32, 0x35, 0x36, 0x22, 0x77, 0x0a, 0x07, 0x50, 0x72, 0x6f, 0x66, 0x69, 0x6c, 0x65,
+	0x12, 0x35, 0x0a, 0x07, 0x6f, 0x70, 0x74, 0x69, 0x6f, 0x6e, 0x73, 0x18, 0x01, 0x20, 0x01, 0x28,
+	0x0b, 0x32, 0x1b, 0x2e, 0x6d, 0x65, 0x74, 0x61, 0x64, 0x61, 0x74, 0x61, 0x2e, 0x45, 0x6e, 0x63,
+	0x72, 0x79, 0x70, 0x74, 0x69, 0x6f, 0x6e, 0x4f, 0x70, 0x74, 0x69, 0x6f, 0x6e, 0x73, 0x52, 0x07,
+	0x6f, 0x70, 0x74, 0x69, 0x6f, 0x6e, 0x73, 0x12, 0x35, 0x0a, 0x0a, 0x68, 0x61, 0x73, 0x68, 0x5f,
+	0x63, 0x6f, 0x73, 0x74, 0x73, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x16, 0x2e, 0x6d, 0x65,
+	0x74, 0x61, 0x64, 0x61, 0x74, 0x61, 0x2e, 0x48, 0x61, 0x73, 0x68, 0x69, 0x6e, 0x67, 0x43, 0x6f,
+	0x73, 0x74, 0x73, 0x52, 0x09, 0x68, 0x61, 0x73, 0x68, 0x43, 0x6f, 0x73, 0x74, 0x73, 0x22, 0x8d,
+	0x09, 0x0a, 0x06, 0x43, 0x6f, 0x6e, 0x66, 0x69, 0x67, 0x12, 0x2c, 0x0a, 0x06, 0x73, 0x6f, 0x75,
 	0x72, 0x63, 0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0e, 0x32, 0x14, 0x2e, 0x6d, 0x65, 0x74, 0x61,
 	0x64, 0x61, 0x74, 0x61, 0x2e, 0x53, 0x6f, 0x75, 0x72, 0x63, 0x65, 0x54, 0x79, 0x70, 0x65, 0x52,
 	0x06, 0x73, 0x6f, 0x75, 0x72, 0x63, 0x65, 0x12, 0x35, 0x0a, 0x0a, 0x68, 0x61, 0x73, 0x68, 0x5f,
@@ -775,16 +1838,79 @@ var file_metadata_metadata_proto_rawDesc = []byte{
 	0x77, 0x5f, 0x63, 0x72, 0x6f, 0x73, 0x73, 0x5f, 0x75, 0x73, 0x65, 0x72, 0x5f, 0x6d, 0x65, 0x74,
 	0x61, 0x64, 0x61, 0x74, 0x61, 0x18, 0x06, 0x20, 0x01, 0x28, 0x08, 0x52, 0x16, 0x61, 0x6c, 0x6c,
 	0x6f, 0x77, 0x43, 0x72, 0x6f, 0x73, 0x73, 0x55, 0x73, 0x65, 0x72, 0x4d, 0x65, 0x74, 0x61, 0x64,
-	0x61, 0x74, 0x61, 0x4a, 0x04, 0x08, 0x03, 0x10, 0x04, 0x52, 0x0d, 0x63, 0x6f, 0x6d, 0x70, 0x61,
-	0x74, 0x69, 0x62, 0x69, 0x6c, 0x69, 0x74, 0x79, 0x2a, 0x51, 0x0a, 0x0a, 0x53, 0x6f, 0x75, 0x72,
-	0x63, 0x65, 0x54, 0x79, 0x70, 0x65, 0x12, 0x0b, 0x0a, 0x07, 0x64, 0x65, 0x66, 0x61, 0x75, 0x6c,
-	0x74, 0x10, 0x00, 0x12, 0x12, 0x0a, 0x0e, 0x70, 0x61, 0x6d, 0x5f, 0x70, 0x61, 0x73, 0x73, 0x70,
-	0x68, 0x72, 0x61, 0x73, 0x65, 0x10, 0x01, 0x12, 0x15, 0x0a, 0x11, 0x63, 0x75, 0x73, 0x74, 0x6f,
-	0x6d, 0x5f, 0x70, 0x61, 0x73, 0x73, 0x70, 0x68, 0x72, 0x61, 0x73, 0x65, 0x10, 0x02, 0x12, 0x0b,
-	0x0a, 0x07, 0x72, 0x61, 0x77, 0x5f, 0x6b, 0x65, 0x79, 0x10, 0x03, 0x42, 0x24, 0x5a, 0x22, 0x67,
-	0x69, 0x74, 0x68, 0x75, 0x62, 0x2e, 0x63, 0x6f, 0x6d, 0x2f, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65,
-	0x2f, 0x66, 0x73, 0x63, 0x72, 0x79, 0x70, 0x74, 0x2f, 0x6d, 0x65, 0x74, 0x61, 0x64, 0x61, 0x74,
-	0x61, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
+	0x61, 0x74, 0x61, 0x12, 0x36, 0x0a, 0x17, 0x65, 0x6e, 0x63, 0x72, 0x79, 0x70, 0x74, 0x5f, 0x70,
+	0x72, 0x6f, 0x74, 0x65, 0x63, 0x74, 0x6f, 0x72, 0x5f, 0x6e, 0x61, 0x6d, 0x65, 0x73, 0x18, 0x07,
+	0x20, 0x01, 0x28, 0x08, 0x52, 0x15, 0x65, 0x6e, 0x63, 0x72, 0x79, 0x70, 0x74, 0x50, 0x72, 0x6f,
+	0x74, 0x65, 0x63, 0x74, 0x6f, 0x72, 0x4e, 0x61, 0x6d, 0x65, 0x73, 0x12, 0x28, 0x0a, 0x10, 0x70,
+	0x6f, 0x73, 0x74, 0x5f, 0x75, 0x6e, 0x6c, 0x6f, 0x63, 0x6b, 0x5f, 0x68, 0x6f, 0x6f, 0x6b, 0x18,
+	0x08, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0e, 0x70, 0x6f, 0x73, 0x74, 0x55, 0x6e, 0x6c, 0x6f, 0x63,
+	0x6b, 0x48, 0x6f, 0x6f, 0x6b, 0x12, 0x24, 0x0a, 0x0e, 0x70, 0x6f, 0x73, 0x74, 0x5f, 0x6c, 0x6f,
+	0x63, 0x6b, 0x5f, 0x68, 0x6f, 0x6f, 0x6b, 0x18, 0x09, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0c, 0x70,
+	0x6f, 0x73, 0x74, 0x4c, 0x6f, 0x63, 0x6b, 0x48, 0x6f, 0x6f, 0x6b, 0x12, 0x21, 0x0a, 0x0c, 0x6b,
+	0x65, 0x79, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x5f, 0x64, 0x69, 0x72, 0x18, 0x0a, 0x20, 0x01, 0x28,
+	0x09, 0x52, 0x0b, 0x6b, 0x65, 0x79, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x44, 0x69, 0x72, 0x12, 0x3a,
+	0x0a, 0x08, 0x70, 0x72, 0x6f, 0x66, 0x69, 0x6c, 0x65, 0x73, 0x18, 0x0b, 0x20, 0x03, 0x28, 0x0b,
+	0x32, 0x1e, 0x2e, 0x6d, 0x65, 0x74, 0x61, 0x64, 0x61, 0x74, 0x61, 0x2e, 0x43, 0x6f, 0x6e, 0x66,
+	0x69, 0x67, 0x2e, 0x50, 0x72, 0x6f, 0x66, 0x69, 0x6c, 0x65, 0x73, 0x45, 0x6e, 0x74, 0x72, 0x79,
+	0x52, 0x08, 0x70, 0x72, 0x6f, 0x66, 0x69, 0x6c, 0x65, 0x73, 0x12, 0x23, 0x0a, 0x0d, 0x70, 0x6b,
+	0x63, 0x73, 0x31, 0x31, 0x5f, 0x6d, 0x6f, 0x64, 0x75, 0x6c, 0x65, 0x18, 0x0c, 0x20, 0x01, 0x28,
+	0x09, 0x52, 0x0c, 0x70, 0x6b, 0x63, 0x73, 0x31, 0x31, 0x4d, 0x6f, 0x64, 0x75, 0x6c, 0x65, 0x12,
+	0x1f, 0x0a, 0x0b, 0x70, 0x6b, 0x63, 0x73, 0x31, 0x31, 0x5f, 0x73, 0x6c, 0x6f, 0x74, 0x18, 0x0d,
+	0x20, 0x01, 0x28, 0x09, 0x52, 0x0a, 0x70, 0x6b, 0x63, 0x73, 0x31, 0x31, 0x53, 0x6c, 0x6f, 0x74,
+	0x12, 0x22, 0x0a, 0x0d, 0x70, 0x6b, 0x63, 0x73, 0x31, 0x31, 0x5f, 0x6b, 0x65, 0x79, 0x5f, 0x69,
+	0x64, 0x18, 0x0e, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0b, 0x70, 0x6b, 0x63, 0x73, 0x31, 0x31, 0x4b,
+	0x65, 0x79, 0x49, 0x64, 0x12, 0x17, 0x0a, 0x07, 0x6b, 0x6d, 0x73, 0x5f, 0x6b, 0x65, 0x79, 0x18,
+	0x0f, 0x20, 0x01, 0x28, 0x09, 0x52, 0x06, 0x6b, 0x6d, 0x73, 0x4b, 0x65, 0x79, 0x12, 0x19, 0x0a,
+	0x08, 0x74, 0x61, 0x6e, 0x67, 0x5f, 0x75, 0x72, 0x6c, 0x18, 0x10, 0x20, 0x01, 0x28, 0x09, 0x52,
+	0x07, 0x74, 0x61, 0x6e, 0x67, 0x55, 0x72, 0x6c, 0x12, 0x27, 0x0a, 0x0f, 0x74, 0x61, 0x6e, 0x67,
+	0x5f, 0x74, 0x68, 0x75, 0x6d, 0x62, 0x70, 0x72, 0x69, 0x6e, 0x74, 0x18, 0x11, 0x20, 0x01, 0x28,
+	0x09, 0x52, 0x0e, 0x74, 0x61, 0x6e, 0x67, 0x54, 0x68, 0x75, 0x6d, 0x62, 0x70, 0x72, 0x69, 0x6e,
+	0x74, 0x12, 0x21, 0x0a, 0x0c, 0x79, 0x75, 0x62, 0x69, 0x6b, 0x65, 0x79, 0x5f, 0x73, 0x6c, 0x6f,
+	0x74, 0x18, 0x12, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x0b, 0x79, 0x75, 0x62, 0x69, 0x6b, 0x65, 0x79,
+	0x53, 0x6c, 0x6f, 0x74, 0x12, 0x23, 0x0a, 0x0d, 0x67, 0x70, 0x67, 0x5f, 0x72, 0x65, 0x63, 0x69,
+	0x70, 0x69, 0x65, 0x6e, 0x74, 0x18, 0x13, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0c, 0x67, 0x70, 0x67,
+	0x52, 0x65, 0x63, 0x69, 0x70, 0x69, 0x65, 0x6e, 0x74, 0x12, 0x17, 0x0a, 0x07, 0x73, 0x73, 0x68,
+	0x5f, 0x6b, 0x65, 0x79, 0x18, 0x14, 0x20, 0x01, 0x28, 0x09, 0x52, 0x06, 0x73, 0x73, 0x68, 0x4b,
+	0x65, 0x79, 0x12, 0x32, 0x0a, 0x15, 0x73, 0x75, 0x73, 0x70, 0x65, 0x6e, 0x64, 0x5f, 0x6c, 0x6f,
+	0x63, 0x6b, 0x5f, 0x70, 0x6f, 0x6c, 0x69, 0x63, 0x69, 0x65, 0x73, 0x18, 0x15, 0x20, 0x03, 0x28,
+	0x09, 0x52, 0x13, 0x73, 0x75, 0x73, 0x70, 0x65, 0x6e, 0x64, 0x4c, 0x6f, 0x63, 0x6b, 0x50, 0x6f,
+	0x6c, 0x69, 0x63, 0x69, 0x65, 0x73, 0x12, 0x37, 0x0a, 0x18, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x5f,
+	0x70, 0x6f, 0x6c, 0x69, 0x63, 0x69, 0x65, 0x73, 0x5f, 0x69, 0x6e, 0x5f, 0x78, 0x61, 0x74, 0x74,
+	0x72, 0x73, 0x18, 0x16, 0x20, 0x01, 0x28, 0x08, 0x52, 0x15, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x50,
+	0x6f, 0x6c, 0x69, 0x63, 0x69, 0x65, 0x73, 0x49, 0x6e, 0x58, 0x61, 0x74, 0x74, 0x72, 0x73, 0x12,
+	0x47, 0x0a, 0x0d, 0x6d, 0x65, 0x74, 0x61, 0x64, 0x61, 0x74, 0x61, 0x5f, 0x64, 0x69, 0x72, 0x73,
+	0x18, 0x17, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x22, 0x2e, 0x6d, 0x65, 0x74, 0x61, 0x64, 0x61, 0x74,
+	0x61, 0x2e, 0x43, 0x6f, 0x6e, 0x66, 0x69, 0x67, 0x2e, 0x4d, 0x65, 0x74, 0x61, 0x64, 0x61, 0x74,
+	0x61, 0x44, 0x69, 0x72, 0x73, 0x45, 0x6e, 0x74, 0x72, 0x79, 0x52, 0x0c, 0x6d, 0x65, 0x74, 0x61,
+	0x64, 0x61, 0x74, 0x61, 0x44, 0x69, 0x72, 0x73, 0x1a, 0x4e, 0x0a, 0x0d, 0x50, 0x72, 0x6f, 0x66,
+	0x69, 0x6c, 0x65, 0x73, 0x45, 0x6e, 0x74, 0x72, 0x79, 0x12, 0x10, 0x0a, 0x03, 0x6b, 0x65, 0x79,
+	0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x03, 0x6b, 0x65, 0x79, 0x12, 0x27, 0x0a, 0x05, 0x76,
+	0x61, 0x6c, 0x75, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x11, 0x2e, 0x6d, 0x65, 0x74,
+	0x61, 0x64, 0x61, 0x74, 0x61, 0x2e, 0x50, 0x72, 0x6f, 0x66, 0x69, 0x6c, 0x65, 0x52, 0x05, 0x76,
+	0x61, 0x6c, 0x75, 0x65, 0x3a, 0x02, 0x38, 0x01, 0x1a, 0x3f, 0x0a, 0x11, 0x4d, 0x65, 0x74, 0x61,
+	0x64, 0x61, 0x74, 0x61, 0x44, 0x69, 0x72, 0x73, 0x45, 0x6e, 0x74, 0x72, 0x79, 0x12, 0x10, 0x0a,
+	0x03, 0x6b, 0x65, 0x79, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x03, 0x6b, 0x65, 0x79, 0x12,
+	0x14, 0x0a, 0x05, 0x76, 0x61, 0x6c, 0x75, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x05,
+	0x76, 0x61, 0x6c, 0x75, 0x65, 0x3a, 0x02, 0x38, 0x01, 0x4a, 0x04, 0x08, 0x03, 0x10, 0x04, 0x52,
+	0x0d, 0x63, 0x6f, 0x6d, 0x70, 0x61, 0x74, 0x69, 0x62, 0x69, 0x6c, 0x69, 0x74, 0x79, 0x2a, 0x1f,
+	0x0a, 0x03, 0x4b, 0x44, 0x46, 0x12, 0x0c, 0x0a, 0x08, 0x61, 0x72, 0x67, 0x6f, 0x6e, 0x32, 0x69,
+	0x64, 0x10, 0x00, 0x12, 0x0a, 0x0a, 0x06, 0x73, 0x63, 0x72, 0x79, 0x70, 0x74, 0x10, 0x01, 0x2a,
+	0xc6, 0x01, 0x0a, 0x0a, 0x53, 0x6f, 0x75, 0x72, 0x63, 0x65, 0x54, 0x79, 0x70, 0x65, 0x12, 0x0b,
+	0x0a, 0x07, 0x64, 0x65, 0x66, 0x61, 0x75, 0x6c, 0x74, 0x10, 0x00, 0x12, 0x12, 0x0a, 0x0e, 0x70,
+	0x61, 0x6d, 0x5f, 0x70, 0x61, 0x73, 0x73, 0x70, 0x68, 0x72, 0x61, 0x73, 0x65, 0x10, 0x01, 0x12,
+	0x15, 0x0a, 0x11, 0x63, 0x75, 0x73, 0x74, 0x6f, 0x6d, 0x5f, 0x70, 0x61, 0x73, 0x73, 0x70, 0x68,
+	0x72, 0x61, 0x73, 0x65, 0x10, 0x02, 0x12, 0x0b, 0x0a, 0x07, 0x72, 0x61, 0x77, 0x5f, 0x6b, 0x65,
+	0x79, 0x10, 0x03, 0x12, 0x09, 0x0a, 0x05, 0x66, 0x69, 0x64, 0x6f, 0x32, 0x10, 0x04, 0x12, 0x08,
+	0x0a, 0x04, 0x74, 0x70, 0x6d, 0x32, 0x10, 0x05, 0x12, 0x0a, 0x0a, 0x06, 0x70, 0x6b, 0x63, 0x73,
+	0x31, 0x31, 0x10, 0x06, 0x12, 0x07, 0x0a, 0x03, 0x6b, 0x6d, 0x73, 0x10, 0x07, 0x12, 0x08, 0x0a,
+	0x04, 0x74, 0x61, 0x6e, 0x67, 0x10, 0x08, 0x12, 0x1a, 0x0a, 0x16, 0x70, 0x61, 0x73, 0x73, 0x70,
+	0x68, 0x72, 0x61, 0x73, 0x65, 0x5f, 0x61, 0x6e, 0x64, 0x5f, 0x72, 0x61, 0x77, 0x5f, 0x6b, 0x65,
+	0x79, 0x10, 0x09, 0x12, 0x0b, 0x0a, 0x07, 0x79, 0x75, 0x62, 0x69, 0x6b, 0x65, 0x79, 0x10, 0x0a,
+	0x12, 0x07, 0x0a, 0x03, 0x67, 0x70, 0x67, 0x10, 0x0b, 0x12, 0x0d, 0x0a, 0x09, 0x73, 0x73, 0x68,
+	0x5f, 0x61, 0x67, 0x65, 0x6e, 0x74, 0x10, 0x0c, 0x42, 0x24, 0x5a, 0x22, 0x67, 0x69, 0x74, 0x68,
+	0x75, 0x62, 0x2e, 0x63, 0x6f, 0x6d, 0x2f, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2f, 0x66, 0x73,
+	0x63, 0x72, 0x79, 0x70, 0x74, 0x2f, 0x6d, 0x65, 0x74, 0x61, 0x64, 0x61, 0x74, 0x61, 0x62, 0x06,
+	0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
 }
 
 var (
@@ -799,36 +1925,58 @@ func file_metadata_metadata_proto_rawDescGZIP() []byte {
 	return file_metadata_metadata_proto_rawDescData
 }
 
-var file_metadata_metadata_proto_enumTypes = make([]protoimpl.EnumInfo, 2)
-var file_metadata_metadata_proto_msgTypes = make([]protoimpl.MessageInfo, 7)
+var file_metadata_metadata_proto_enumTypes = make([]protoimpl.EnumInfo, 3)
+var file_metadata_metadata_proto_msgTypes = make([]protoimpl.MessageInfo, 15)
 var file_metadata_metadata_proto_goTypes = []interface{}{
-	(SourceType)(0),             // 0: metadata.SourceType
-	(EncryptionOptions_Mode)(0), // 1: metadata.EncryptionOptions.Mode
-	(*HashingCosts)(nil),        // 2: metadata.HashingCosts
-	(*WrappedKeyData)(nil),      // 3: metadata.WrappedKeyData
-	(*ProtectorData)(nil),       // 4: metadata.ProtectorData
-	(*EncryptionOptions)(nil),   // 5: metadata.EncryptionOptions
-	(*WrappedPolicyKey)(nil),    // 6: metadata.WrappedPolicyKey
-	(*PolicyData)(nil),          // 7: metadata.PolicyData
-	(*Config)(nil),              // 8: metadata.Config
+	(KDF)(0),                    // 0: metadata.KDF
+	(SourceType)(0),             // 1: metadata.SourceType
+	(EncryptionOptions_Mode)(0), // 2: metadata.EncryptionOptions.Mode
+	(*HashingCosts)(nil),        // 3: metadata.HashingCosts
+	(*WrappedKeyData)(nil),      // 4: metadata.WrappedKeyData
+	(*ProtectorData)(nil),       // 5: metadata.ProtectorData
+	(*ProtectorAccess)(nil),     // 6: metadata.ProtectorAccess
+	(*EncryptionOptions)(nil),   // 7: metadata.EncryptionOptions
+	(*WrappedPolicyKey)(nil),    // 8: metadata.WrappedPolicyKey
+	(*PolicyData)(nil),          // 9: metadata.PolicyData
+	(*BackupProtector)(nil),     // 10: metadata.BackupProtector
+	(*BackupPolicy)(nil),        // 11: metadata.BackupPolicy
+	(*MetadataBackup)(nil),      // 12: metadata.MetadataBackup
+	(*MetadataBackupFile)(nil),  // 13: metadata.MetadataBackupFile
+	(*Profile)(nil),             // 14: metadata.Profile
+	(*Config)(nil),              // 15: metadata.Config
+	nil,                         // 16: metadata.Config.ProfilesEntry
+	nil,                         // 17: metadata.Config.MetadataDirsEntry
 }
 var file_metadata_metadata_proto_depIdxs = []int32{
-	0,  // 0: metadata.ProtectorData.source:type_name -> metadata.SourceType
-	2,  // 1: metadata.ProtectorData.costs:type_name -> metadata.HashingCosts
-	3,  // 2: metadata.ProtectorData.wrapped_key:type_name -> metadata.WrappedKeyData
-	1,  // 3: metadata.EncryptionOptions.contents:type_name -> metadata.EncryptionOptions.Mode
-	1,  // 4: metadata.EncryptionOptions.filenames:type_name -> metadata.EncryptionOptions.Mode
-	3,  // 5: metadata.WrappedPolicyKey.wrapped_key:type_name -> metadata.WrappedKeyData
-	5,  // 6: metadata.PolicyData.options:type_name -> metadata.EncryptionOptions
-	6,  // 7: metadata.PolicyData.wrapped_policy_keys:type_name -> metadata.WrappedPolicyKey
-	0,  // 8: metadata.Config.source:type_name -> metadata.SourceType
-	2,  // 9: metadata.Config.hash_costs:type_name -> metadata.HashingCosts
-	5,  // 10: metadata.Config.options:type_name -> metadata.EncryptionOptions
-	11, // [11:11] is the sub-list for method output_type
-	11, // [11:11] is the sub-list for method input_type
-	11, // [11:11] is the sub-list for extension type_name
-	11, // [11:11] is the sub-list for extension extendee
-	0,  // [0:11] is the sub-list for field type_name
+	0,  // 0: metadata.HashingCosts.kdf:type_name -> metadata.KDF
+	1,  // 1: metadata.ProtectorData.source:type_name -> metadata.SourceType
+	3,  // 2: metadata.ProtectorData.costs:type_name -> metadata.HashingCosts
+	4,  // 3: metadata.ProtectorData.wrapped_key:type_name -> metadata.WrappedKeyData
+	4,  // 4: metadata.ProtectorData.encrypted_name:type_name -> metadata.WrappedKeyData
+	6,  // 5: metadata.ProtectorData.access:type_name -> metadata.ProtectorAccess
+	2,  // 6: metadata.EncryptionOptions.contents:type_name -> metadata.EncryptionOptions.Mode
+	2,  // 7: metadata.EncryptionOptions.filenames:type_name -> metadata.EncryptionOptions.Mode
+	4,  // 8: metadata.WrappedPolicyKey.wrapped_key:type_name -> metadata.WrappedKeyData
+	4,  // 9: metadata.WrappedPolicyKey.wrapped_share:type_name -> metadata.WrappedKeyData
+	7,  // 10: metadata.PolicyData.options:type_name -> metadata.EncryptionOptions
+	8,  // 11: metadata.PolicyData.wrapped_policy_keys:type_name -> metadata.WrappedPolicyKey
+	5,  // 12: metadata.BackupProtector.data:type_name -> metadata.ProtectorData
+	9,  // 13: metadata.BackupPolicy.data:type_name -> metadata.PolicyData
+	10, // 14: metadata.MetadataBackup.protectors:type_name -> metadata.BackupProtector
+	11, // 15: metadata.MetadataBackup.policies:type_name -> metadata.BackupPolicy
+	7,  // 16: metadata.Profile.options:type_name -> metadata.EncryptionOptions
+	3,  // 17: metadata.Profile.hash_costs:type_name -> metadata.HashingCosts
+	1,  // 18: metadata.Config.source:type_name -> metadata.SourceType
+	3,  // 19: metadata.Config.hash_costs:type_name -> metadata.HashingCosts
+	7,  // 20: metadata.Config.options:type_name -> metadata.EncryptionOptions
+	16, // 21: metadata.Config.profiles:type_name -> metadata.Config.ProfilesEntry
+	17, // 22: metadata.Config.metadata_dirs:type_name -> metadata.Config.MetadataDirsEntry
+	14, // 23: metadata.Config.ProfilesEntry.value:type_name -> metadata.Profile
+	24, // [24:24] is the sub-list for method output_type
+	24, // [24:24] is the sub-list for method input_type
+	24, // [24:24] is the sub-list for extension type_name
+	24, // [24:24] is the sub-list for extension extendee
+	0,  // [0:24] is the sub-list for field type_name
 }
 
 func init() { file_metadata_metadata_proto_init() }
@@ -874,7 +2022,7 @@ func file_metadata_metadata_proto_init() {
 			}
 		}
 		file_metadata_metadata_proto_msgTypes[3].Exporter = func(v interface{}, i int) interface{} {
-			switch v := v.(*EncryptionOptions); i {
+			switch v := v.(*ProtectorAccess); i {
 			case 0:
 				return &v.state
 			case 1:
@@ -886,7 +2034,7 @@ func file_metadata_metadata_proto_init() {
 			}
 		}
 		file_metadata_metadata_proto_msgTypes[4].Exporter = func(v interface{}, i int) interface{} {
-			switch v := v.(*WrappedPolicyKey); i {
+			switch v := v.(*EncryptionOptions); i {
 			case 0:
 				return &v.state
 			case 1:
@@ -898,7 +2046,7 @@ func file_metadata_metadata_proto_init() {
 			}
 		}
 		file_metadata_metadata_proto_msgTypes[5].Exporter = func(v interface{}, i int) interface{} {
-			switch v := v.(*PolicyData); i {
+			switch v := v.(*WrappedPolicyKey); i {
 			case 0:
 				return &v.state
 			case 1:
@@ -910,6 +2058,78 @@ func file_metadata_metadata_proto_init() {
 			}
 		}
 		file_metadata_metadata_proto_msgTypes[6].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*PolicyData); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_metadata_metadata_proto_msgTypes[7].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*BackupProtector); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_metadata_metadata_proto_msgTypes[8].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*BackupPolicy); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_metadata_metadata_proto_msgTypes[9].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*MetadataBackup); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_metadata_metadata_proto_msgTypes[10].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*MetadataBackupFile); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_metadata_metadata_proto_msgTypes[11].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*Profile); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_metadata_metadata_proto_msgTypes[12].Exporter = func(v interface{}, i int) interface{} {
 			switch v := v.(*Config); i {
 			case 0:
 				return &v.state
@@ -927,8 +2147,8 @@ func file_metadata_metadata_proto_init() {
 		File: protoimpl.DescBuilder{
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: file_metadata_metadata_proto_rawDesc,
-			NumEnums:      2,
-			NumMessages:   7,
+			NumEnums:      3,
+			NumMessages:   15,
 			NumExtensions: 0,
 			NumServices:   0,
 		},
@@ -25,6 +25,7 @@ import (
 	"fmt"
 	"log"
 	"math"
+	"math/bits"
 	"os"
 	"os/user"
 	"strconv"
@@ -44,6 +45,10 @@ var (
 	// ErrEncryptionNotEnabled indicates that encryption is not supported on
 	// the given filesystem, but there is a way to enable it.
 	ErrEncryptionNotEnabled = errors.New("encryption not enabled")
+
+	// ErrDirectKeyUnsupported indicates that the DIRECT_KEY flag was
+	// requested or disabled for encryption modes which don't support it.
+	ErrDirectKeyUnsupported = errors.New("the DIRECT_KEY flag can only be used if both contents and filenames are encrypted with Adiantum")
 )
 
 // ErrAlreadyEncrypted indicates that the path is already encrypted.
@@ -67,6 +72,20 @@ func (err *ErrBadEncryptionOptions) Error() string {
 	The options are %s`, err.Path, err.Options)
 }
 
+// ErrDataUnitSizeTooLarge indicates that the requested data unit size is larger
+// than the block size of the filesystem, which the kernel doesn't support.
+type ErrDataUnitSizeTooLarge struct {
+	Path         string
+	DataUnitSize int64
+	BlockSize    int64
+}
+
+func (err *ErrDataUnitSizeTooLarge) Error() string {
+	return fmt.Sprintf(`cannot encrypt %q with a data unit size of %d bytes
+	because it is larger than the filesystem block size (%d bytes)`,
+		err.Path, err.DataUnitSize, err.BlockSize)
+}
+
 // ErrDirectoryNotOwned indicates a directory can't be encrypted because it's
 // owned by another user.
 type ErrDirectoryNotOwned struct {
@@ -122,6 +141,72 @@ var (
 		unix.FSCRYPT_POLICY_FLAGS_PAD_16, unix.FSCRYPT_POLICY_FLAGS_PAD_32}
 )
 
+// fscryptPolicyV2 is struct fscrypt_policy_v2 from the kernel. It's the same as
+// unix.FscryptPolicyV2, except that it includes the log2_data_unit_size field
+// which was added in Linux v6.7.
+type fscryptPolicyV2 struct {
+	Version                   uint8
+	Contents_encryption_mode  uint8
+	Filenames_encryption_mode uint8
+	Flags                     uint8
+	Log2_data_unit_size       uint8
+	_                         [3]uint8
+	Master_key_identifier     [unix.FSCRYPT_KEY_IDENTIFIER_SIZE]uint8
+}
+
+// minDataUnitSize is the smallest data unit size the kernel supports (one
+// sector).
+const minDataUnitSize = 512
+
+// minEncryptedFilenameLen is the minimum length of an encrypted filename, as
+// the kernel always pads filenames to at least one AES block.
+const minEncryptedFilenameLen = 16
+
+// encryptedFilenameLength returns the length of the ciphertext that the kernel
+// stores for a filename of length nameLen, given the filenames encryption
+// options and the filesystem's maximum filename length maxLen. All supported
+// filenames encryption modes are length-preserving, so the only expansion
+// comes from padding the name to a multiple of opts.Padding (and to at least
+// one AES block). This mirrors fscrypt_fname_encrypted_size() in the kernel,
+// which never pads beyond maxLen. If the name doesn't fit at all, ok is false.
+func encryptedFilenameLength(opts *EncryptionOptions, nameLen, maxLen int) (length int, ok bool) {
+	if nameLen > maxLen {
+		return 0, false
+	}
+	padding := int(opts.GetPadding())
+	if padding <= 0 {
+		padding = 1
+	}
+	length = (nameLen + padding - 1) / padding * padding
+	if length < minEncryptedFilenameLen {
+		length = minEncryptedFilenameLen
+	}
+	if length > maxLen {
+		length = maxLen
+	}
+	return length, length >= nameLen
+}
+
+// MaxFilenameLength returns the length of the longest plaintext filename (in
+// bytes) that can be created in a directory encrypted with opts, taking into
+// account the padding and the ciphertext expansion of the filenames encryption
+// mode. Filesystems which support encryption have a NAME_MAX of 255, and as
+// the kernel caps the padding at that limit, this is currently NAME_MAX for all
+// supported options. Library users should still check against this value
+// rather than hardcoding NAME_MAX.
+func MaxFilenameLength(opts *EncryptionOptions) int {
+	return maxFilenameLength(opts, unix.NAME_MAX)
+}
+
+func maxFilenameLength(opts *EncryptionOptions, maxLen int) int {
+	for nameLen := maxLen; nameLen > 0; nameLen-- {
+		if _, ok := encryptedFilenameLength(opts, nameLen, maxLen); ok {
+			return nameLen
+		}
+	}
+	return 0
+}
+
 // flagsToPadding returns the amount of padding specified in the policy flags.
 func flagsToPadding(flags uint8) int64 {
 	paddingFlag := int64(flags & unix.FS_POLICY_FLAGS_PAD_MASK)
@@ -135,44 +220,87 @@ func flagsToPadding(flags uint8) int64 {
 }
 
 func buildV1PolicyData(policy *unix.FscryptPolicyV1) *PolicyData {
+	options := &EncryptionOptions{
+		Padding:       flagsToPadding(policy.Flags),
+		Contents:      EncryptionOptions_Mode(policy.Contents_encryption_mode),
+		Filenames:     EncryptionOptions_Mode(policy.Filenames_encryption_mode),
+		PolicyVersion: 1,
+	}
+	setNoDirectKey(options, policy.Flags)
 	return &PolicyData{
 		KeyDescriptor: hex.EncodeToString(policy.Master_key_descriptor[:]),
-		Options: &EncryptionOptions{
-			Padding:       flagsToPadding(policy.Flags),
-			Contents:      EncryptionOptions_Mode(policy.Contents_encryption_mode),
-			Filenames:     EncryptionOptions_Mode(policy.Filenames_encryption_mode),
-			PolicyVersion: 1,
-		},
+		Options:       options,
 	}
 }
 
-func buildV2PolicyData(policy *unix.FscryptPolicyV2) *PolicyData {
+func buildV2PolicyData(policy *fscryptPolicyV2) *PolicyData {
+	var dataUnitSize int64
+	if policy.Log2_data_unit_size != 0 {
+		dataUnitSize = 1 << policy.Log2_data_unit_size
+	}
+	options := &EncryptionOptions{
+		Padding:       flagsToPadding(policy.Flags),
+		Contents:      EncryptionOptions_Mode(policy.Contents_encryption_mode),
+		Filenames:     EncryptionOptions_Mode(policy.Filenames_encryption_mode),
+		PolicyVersion: 2,
+		DataUnitSize:  dataUnitSize,
+		IvInoLblk_64:  policy.Flags&unix.FSCRYPT_POLICY_FLAG_IV_INO_LBLK_64 != 0,
+		IvInoLblk_32:  policy.Flags&unix.FSCRYPT_POLICY_FLAG_IV_INO_LBLK_32 != 0,
+	}
+	setNoDirectKey(options, policy.Flags)
 	return &PolicyData{
 		KeyDescriptor: hex.EncodeToString(policy.Master_key_identifier[:]),
-		Options: &EncryptionOptions{
-			Padding:       flagsToPadding(policy.Flags),
-			Contents:      EncryptionOptions_Mode(policy.Contents_encryption_mode),
-			Filenames:     EncryptionOptions_Mode(policy.Filenames_encryption_mode),
-			PolicyVersion: 2,
-		},
+		Options:       options,
 	}
 }
 
+// setNoDirectKey sets NoDirectKey if the DIRECT_KEY flag is missing from the
+// flags of a policy whose encryption modes support it, so that the options
+// match those in the policy's metadata.
+func setNoDirectKey(options *EncryptionOptions, flags uint8) {
+	options.NoDirectKey = options.SupportsDirectKey() &&
+		flags&unix.FSCRYPT_POLICY_FLAG_DIRECT_KEY == 0
+}
+
+// StableInodeFlags are the FSCRYPT_POLICY_FLAG_* flags which make the
+// encryption of a file depend on its inode number, as used with inline
+// encryption hardware (e.g. UFS or eMMC) that supports few keys or short IVs.
+// fscrypt sets them if the options ask for it, and it may also find them on
+// directories set up by other tools.
+const StableInodeFlags = unix.FSCRYPT_POLICY_FLAG_IV_INO_LBLK_64 |
+	unix.FSCRYPT_POLICY_FLAG_IV_INO_LBLK_32
+
 // GetPolicy returns the Policy data for the given directory or file (includes
 // the KeyDescriptor and the encryption options). Returns an error if the
 // path is not encrypted or the policy couldn't be retrieved.
 func GetPolicy(path string) (*PolicyData, error) {
+	data, _, err := GetPolicyWithFlags(path)
+	return data, err
+}
+
+// GetPolicyWithFlags is like GetPolicy, but it also returns the policy's
+// FSCRYPT_POLICY_FLAG_* flags. The padding is decoded from them into the
+// encryption options, but the other flags (such as StableInodeFlags) can't be
+// represented there.
+func GetPolicyWithFlags(path string) (*PolicyData, uint8, error) {
 	file, err := os.Open(path)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 	defer file.Close()
+	return GetPolicyFromFile(file)
+}
 
+// GetPolicyFromFile is like GetPolicyWithFlags, but for a file which is
+// already open, e.g. one passed to us by the kernel. The file's name is used in
+// the errors.
+func GetPolicyFromFile(file *os.File) (*PolicyData, uint8, error) {
+	path := file.Name()
 	// First try the new version of the ioctl. This works for both v1 and v2 policies.
 	var arg unix.FscryptGetPolicyExArg
 	arg.Size = uint64(unsafe.Sizeof(arg.Policy))
 	policyPtr := util.Ptr(arg.Policy[:])
-	err = getPolicyIoctl(file, unix.FS_IOC_GET_ENCRYPTION_POLICY_EX, unsafe.Pointer(&arg))
+	err := getPolicyIoctl(file, unix.FS_IOC_GET_ENCRYPTION_POLICY_EX, unsafe.Pointer(&arg))
 	if err == unix.ENOTTY {
 		// Fall back to the old version of the ioctl. This works for v1 policies only.
 		err = getPolicyIoctl(file, unix.FS_IOC_GET_ENCRYPTION_POLICY, policyPtr)
@@ -182,44 +310,102 @@ func GetPolicy(path string) (*PolicyData, error) {
 	case nil:
 		break
 	case unix.ENOTTY:
-		return nil, ErrEncryptionNotSupported
+		return nil, 0, ErrEncryptionNotSupported
 	case unix.EOPNOTSUPP:
-		return nil, ErrEncryptionNotEnabled
+		return nil, 0, ErrEncryptionNotEnabled
 	case unix.ENODATA, unix.ENOENT:
 		// ENOENT was returned instead of ENODATA on some filesystems before v4.11.
-		return nil, &ErrNotEncrypted{path}
+		return nil, 0, &ErrNotEncrypted{path}
 	default:
-		return nil, errors.Wrapf(err, "failed to get encryption policy of %q", path)
+		return nil, 0, errors.Wrapf(err, "failed to get encryption policy of %q", path)
 	}
 	switch arg.Policy[0] { // arg.policy.version
 	case unix.FSCRYPT_POLICY_V1:
 		if arg.Size != uint64(unsafe.Sizeof(unix.FscryptPolicyV1{})) {
 			// should never happen
-			return nil, errors.New("unexpected size for v1 policy")
+			return nil, 0, errors.New("unexpected size for v1 policy")
 		}
-		return buildV1PolicyData((*unix.FscryptPolicyV1)(policyPtr)), nil
+		policy := (*unix.FscryptPolicyV1)(policyPtr)
+		return buildV1PolicyData(policy), policy.Flags, nil
 	case unix.FSCRYPT_POLICY_V2:
-		if arg.Size != uint64(unsafe.Sizeof(unix.FscryptPolicyV2{})) {
+		if arg.Size != uint64(unsafe.Sizeof(fscryptPolicyV2{})) {
 			// should never happen
-			return nil, errors.New("unexpected size for v2 policy")
+			return nil, 0, errors.New("unexpected size for v2 policy")
 		}
-		return buildV2PolicyData((*unix.FscryptPolicyV2)(policyPtr)), nil
+		policy := (*fscryptPolicyV2)(policyPtr)
+		return buildV2PolicyData(policy), policy.Flags, nil
 	default:
-		return nil, errors.Errorf("unsupported encryption policy version [%d]",
+		return nil, 0, errors.Errorf("unsupported encryption policy version [%d]",
 			arg.Policy[0])
 	}
 }
 
-// For improved performance, use the DIRECT_KEY flag when using ciphers that
-// support it, e.g. Adiantum.  It is safe because fscrypt won't reuse the key
-// for any other policy.  (Multiple directories with same policy are okay.)
-func shouldUseDirectKeyFlag(options *EncryptionOptions) bool {
-	// Contents and filenames encryption modes must be the same
-	if options.Contents != options.Filenames {
-		return false
+// SupportsDirectKey returns true if the DIRECT_KEY flag can be used with the
+// encryption modes of these options. The kernel requires the contents and
+// filenames modes to be the same, and currently only Adiantum supports it.
+func (e *EncryptionOptions) SupportsDirectKey() bool {
+	return e.Contents == e.Filenames && e.Contents == EncryptionOptions_Adiantum
+}
+
+// modesMinPolicyVersion gives the lowest policy version with which the kernel
+// accepts each combination of contents and filenames encryption modes. Other
+// combinations are never accepted.
+var modesMinPolicyVersion = map[[2]EncryptionOptions_Mode]int64{
+	{EncryptionOptions_AES_256_XTS, EncryptionOptions_AES_256_CTS}:   1,
+	{EncryptionOptions_AES_128_CBC, EncryptionOptions_AES_128_CTS}:   1,
+	{EncryptionOptions_Adiantum, EncryptionOptions_Adiantum}:         1,
+	{EncryptionOptions_AES_256_XTS, EncryptionOptions_AES_256_HCTR2}: 2,
+	{EncryptionOptions_LEA_256_XTS, EncryptionOptions_LEA_256_CTS}:   2,
+}
+
+// checkModes ensures the kernel accepts the combination of encryption modes of
+// these options with their policy version. For example, AES_128_CBC contents
+// (which the kernel encrypts with ESSIV) must be paired with AES_128_CTS
+// filenames.
+func (e *EncryptionOptions) checkModes() error {
+	minVersion, ok := modesMinPolicyVersion[[2]EncryptionOptions_Mode{e.Contents, e.Filenames}]
+	if !ok {
+		return errors.Errorf("contents encryption mode %v can't be used with filenames encryption mode %v",
+			e.Contents, e.Filenames)
 	}
-	// Currently only Adiantum supports DIRECT_KEY.
-	return options.Contents == EncryptionOptions_Adiantum
+	if e.PolicyVersion < minVersion {
+		return errors.Errorf("encryption modes %v and %v require policy version %d",
+			e.Contents, e.Filenames, minVersion)
+	}
+	return nil
+}
+
+// checkStableInodeFlags ensures the kernel accepts the IV_INO_LBLK_64 or
+// IV_INO_LBLK_32 flag set by these options. Both require v2 policies, and the
+// kernel allows at most one of them and DIRECT_KEY.
+func (e *EncryptionOptions) checkStableInodeFlags() error {
+	var name string
+	switch {
+	case e.IvInoLblk_64 && e.IvInoLblk_32:
+		return errors.New("the IV_INO_LBLK_64 and IV_INO_LBLK_32 flags can't be used together")
+	case e.IvInoLblk_64:
+		name = "IV_INO_LBLK_64"
+	case e.IvInoLblk_32:
+		name = "IV_INO_LBLK_32"
+	default:
+		return nil
+	}
+	if e.PolicyVersion != 2 {
+		return errors.Errorf("the %s flag requires policy version 2", name)
+	}
+	if e.UsesDirectKey() {
+		return errors.Errorf("the %s flag can't be used with the DIRECT_KEY flag", name)
+	}
+	return nil
+}
+
+// UsesDirectKey returns true if policies with these options have the DIRECT_KEY
+// flag set. For improved performance, it is used whenever the encryption modes
+// support it, unless NoDirectKey is set.  It is safe because fscrypt won't
+// reuse the key for any other policy.  (Multiple directories with same policy
+// are okay.)
+func (e *EncryptionOptions) UsesDirectKey() bool {
+	return e.SupportsDirectKey() && !e.NoDirectKey
 }
 
 func buildPolicyFlags(options *EncryptionOptions) uint8 {
@@ -228,9 +414,15 @@ func buildPolicyFlags(options *EncryptionOptions) uint8 {
 	if !ok {
 		log.Panicf("padding of %d was not found", options.Padding)
 	}
-	if shouldUseDirectKeyFlag(options) {
+	if options.UsesDirectKey() {
 		flags |= unix.FSCRYPT_POLICY_FLAG_DIRECT_KEY
 	}
+	if options.IvInoLblk_64 {
+		flags |= unix.FSCRYPT_POLICY_FLAG_IV_INO_LBLK_64
+	}
+	if options.IvInoLblk_32 {
+		flags |= unix.FSCRYPT_POLICY_FLAG_IV_INO_LBLK_32
+	}
 	return uint8(flags)
 }
 
@@ -252,12 +444,15 @@ func setV1Policy(file *os.File, options *EncryptionOptions, descriptorBytes []by
 }
 
 func setV2Policy(file *os.File, options *EncryptionOptions, descriptorBytes []byte) error {
-	policy := unix.FscryptPolicyV2{
+	policy := fscryptPolicyV2{
 		Version:                   unix.FSCRYPT_POLICY_V2,
 		Contents_encryption_mode:  uint8(options.Contents),
 		Filenames_encryption_mode: uint8(options.Filenames),
 		Flags:                     uint8(buildPolicyFlags(options)),
 	}
+	if options.DataUnitSize != 0 {
+		policy.Log2_data_unit_size = uint8(bits.TrailingZeros64(uint64(options.DataUnitSize)))
+	}
 
 	// The descriptor should always be the correct length (as policy is valid)
 	if len(descriptorBytes) != unix.FSCRYPT_KEY_IDENTIFIER_SIZE {
@@ -287,6 +482,16 @@ func SetPolicy(path string, data *PolicyData) error {
 		return errors.New("invalid key descriptor: " + data.KeyDescriptor)
 	}
 
+	if dataUnitSize := data.Options.DataUnitSize; dataUnitSize != 0 {
+		var statfs unix.Statfs_t
+		if err = unix.Fstatfs(int(file.Fd()), &statfs); err != nil {
+			return errors.Wrapf(err, "failed to get block size of %q", path)
+		}
+		if blockSize := int64(statfs.Bsize); dataUnitSize > blockSize {
+			return &ErrDataUnitSizeTooLarge{path, dataUnitSize, blockSize}
+		}
+	}
+
 	switch data.Options.PolicyVersion {
 	case 1:
 		err = setV1Policy(file, data.Options, descriptorBytes)
@@ -359,3 +564,69 @@ func CheckSupport(path string) error {
 	}
 	return errors.Wrapf(err, "unexpected error checking for encryption support on filesystem %q", path)
 }
+
+// ProbeSupport checks whether the kernel accepts encryption policies with the
+// given version, encryption modes, and FSCRYPT_POLICY_FLAG_* flags for
+// directories on the filesystem containing dir. It does this by setting such a
+// policy on a new temporary subdirectory of dir, which is then removed, so dir
+// must be writable. The result is only meaningful if the returned error is nil.
+// Setting a v2 policy without its key being present requires CAP_FOWNER, so
+// probing v2 policies normally requires root. Without it, the kernel rejects
+// the policy with ENOKEY only after it has accepted its options, so ENOKEY also
+// means that the options are supported.
+//
+// Note that the kernel only checks whether it knows about the options here;
+// the crypto algorithms themselves are only needed once the key is added.
+func ProbeSupport(dir string, version int64, contents, filenames EncryptionOptions_Mode,
+	flags uint8) (bool, error) {
+	probeDir, err := os.MkdirTemp(dir, ".fscrypt-probe-")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(probeDir)
+	file, err := os.Open(probeDir)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	switch version {
+	case 1:
+		policy := unix.FscryptPolicyV1{
+			Version:                   unix.FSCRYPT_POLICY_V1,
+			Contents_encryption_mode:  uint8(contents),
+			Filenames_encryption_mode: uint8(filenames),
+			Flags:                     flags,
+		}
+		err = setPolicy(file, unsafe.Pointer(&policy))
+	case 2:
+		policy := fscryptPolicyV2{
+			Version:                   unix.FSCRYPT_POLICY_V2,
+			Contents_encryption_mode:  uint8(contents),
+			Filenames_encryption_mode: uint8(filenames),
+			Flags:                     flags,
+		}
+		err = setPolicy(file, unsafe.Pointer(&policy))
+	default:
+		return false, errors.Errorf("policy version of %d is invalid", version)
+	}
+	switch err {
+	case nil, unix.ENOKEY:
+		return true, nil
+	case unix.EINVAL:
+		return false, nil
+	case unix.ENOTTY:
+		return false, ErrEncryptionNotSupported
+	case unix.EOPNOTSUPP:
+		return false, ErrEncryptionNotEnabled
+	}
+	return false, errors.Wrapf(err, "failed to probe encryption support on %q", dir)
+}
+
+// ProbeOptions checks, like ProbeSupport, whether the kernel accepts encryption
+// policies with the given options for directories on the filesystem containing
+// dir.
+func ProbeOptions(dir string, options *EncryptionOptions) (bool, error) {
+	return ProbeSupport(dir, options.PolicyVersion, options.Contents, options.Filenames,
+		buildPolicyFlags(options))
+}
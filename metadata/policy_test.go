@@ -24,6 +24,7 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+	"unsafe"
 
 	"golang.org/x/sys/unix"
 	"google.golang.org/protobuf/proto"
@@ -166,6 +167,123 @@ func TestGetPolicyEmptyDirectory(t *testing.T) {
 	}
 }
 
+// Tests that GetPolicyWithFlags returns the flags which encode the options.
+func TestGetPolicyWithFlags(t *testing.T) {
+	directory, err := createTestDirectory(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	if err = SetPolicy(directory, goodV1Policy); err != nil {
+		t.Fatal(err)
+	}
+	_, flags, err := GetPolicyWithFlags(directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := buildPolicyFlags(goodV1Policy.Options); flags != expected {
+		t.Errorf("got flags %#x, expected %#x", flags, expected)
+	}
+	if flags&StableInodeFlags != 0 {
+		t.Error("policy shouldn't have the stable inode flags")
+	}
+}
+
+// Tests that the IV_INO_LBLK_64 flag is returned by GetPolicyWithFlags, on
+// filesystems which support it.
+func TestGetPolicyStableInodeFlags(t *testing.T) {
+	if !util.IsUserRoot() {
+		t.Skip("This test must be run as root to set a v2 policy without its key")
+	}
+	directory, err := createTestDirectory(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	requireV2PolicySupport(t, directory)
+
+	file, err := os.Open(directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	policy := fscryptPolicyV2{
+		Version:                   unix.FSCRYPT_POLICY_V2,
+		Contents_encryption_mode:  unix.FSCRYPT_MODE_AES_256_XTS,
+		Filenames_encryption_mode: unix.FSCRYPT_MODE_AES_256_CTS,
+		Flags:                     unix.FSCRYPT_POLICY_FLAG_IV_INO_LBLK_64,
+	}
+	if err = setPolicy(file, unsafe.Pointer(&policy)); err == unix.EINVAL {
+		t.Skip("IV_INO_LBLK_64 isn't supported, skipping test")
+	} else if err != nil {
+		t.Fatal(err)
+	}
+
+	data, flags, err := GetPolicyWithFlags(directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flags&StableInodeFlags != unix.FSCRYPT_POLICY_FLAG_IV_INO_LBLK_64 {
+		t.Errorf("got flags %#x, expected IV_INO_LBLK_64", flags)
+	}
+	if data.Options.PolicyVersion != 2 {
+		t.Errorf("got policy version %d, expected 2", data.Options.PolicyVersion)
+	}
+	if !data.Options.IvInoLblk_64 {
+		t.Error("IV_INO_LBLK_64 wasn't read back into the options")
+	}
+}
+
+// Tests that the IV_INO_LBLK_64 and IV_INO_LBLK_32 flags are only valid with v2
+// policies without DIRECT_KEY, and that they are set in the policy flags.
+func TestIVInoLblkValidity(t *testing.T) {
+	adiantum := EncryptionOptions_Adiantum
+	testCases := []struct {
+		contents, filenames EncryptionOptions_Mode
+		policyVersion       int64
+		noDirectKey         bool
+		valid               bool
+	}{
+		{EncryptionOptions_AES_256_XTS, EncryptionOptions_AES_256_CTS, 2, false, true},
+		{EncryptionOptions_AES_256_XTS, EncryptionOptions_AES_256_CTS, 1, false, false},
+		{adiantum, adiantum, 2, true, true},
+		{adiantum, adiantum, 2, false, false},
+	}
+	for _, flag := range []uint8{unix.FSCRYPT_POLICY_FLAG_IV_INO_LBLK_64,
+		unix.FSCRYPT_POLICY_FLAG_IV_INO_LBLK_32} {
+		for _, testCase := range testCases {
+			options := proto.Clone(goodV2EncryptionOptions).(*EncryptionOptions)
+			options.Contents = testCase.contents
+			options.Filenames = testCase.filenames
+			options.PolicyVersion = testCase.policyVersion
+			options.NoDirectKey = testCase.noDirectKey
+			options.IvInoLblk_64 = flag == unix.FSCRYPT_POLICY_FLAG_IV_INO_LBLK_64
+			options.IvInoLblk_32 = flag == unix.FSCRYPT_POLICY_FLAG_IV_INO_LBLK_32
+			err := options.CheckValidity()
+			if !testCase.valid {
+				if err == nil {
+					t.Errorf("options %v should be invalid", options)
+				}
+				continue
+			}
+			if err != nil {
+				t.Errorf("options %v should be valid: %v", options, err)
+			}
+			if flags := buildPolicyFlags(options); flags&StableInodeFlags != flag {
+				t.Errorf("options %v: got flags %#x, expected %#x", options, flags, flag)
+			}
+		}
+	}
+
+	options := proto.Clone(goodV2EncryptionOptions).(*EncryptionOptions)
+	options.IvInoLblk_64 = true
+	options.IvInoLblk_32 = true
+	if options.CheckValidity() == nil {
+		t.Error("IV_INO_LBLK_64 and IV_INO_LBLK_32 shouldn't be valid together")
+	}
+}
+
 // Tests that we cannot get a policy on an unencrypted directory
 func TestGetPolicyUnencrypted(t *testing.T) {
 	directory, err := createTestDirectory(t)
@@ -210,3 +328,299 @@ func TestSetV2PolicyNoKey(t *testing.T) {
 		t.Error("shouldn't have been able to set v2 policy without key added")
 	}
 }
+
+// Tests that only valid data unit sizes are accepted.
+func TestDataUnitSizeValidity(t *testing.T) {
+	testCases := []struct {
+		dataUnitSize  int64
+		policyVersion int64
+		valid         bool
+	}{
+		{0, 1, true},
+		{0, 2, true},
+		{512, 2, true},
+		{16384, 2, true},
+		{256, 2, false},
+		{3000, 2, false},
+		{-4096, 2, false},
+		{4096, 1, false},
+	}
+	for _, testCase := range testCases {
+		options := proto.Clone(goodV2EncryptionOptions).(*EncryptionOptions)
+		options.DataUnitSize = testCase.dataUnitSize
+		options.PolicyVersion = testCase.policyVersion
+		err := options.CheckValidity()
+		if testCase.valid && err != nil {
+			t.Errorf("data unit size %d (policy version %d) should be valid: %v",
+				testCase.dataUnitSize, testCase.policyVersion, err)
+		} else if !testCase.valid && err == nil {
+			t.Errorf("data unit size %d (policy version %d) should be invalid",
+				testCase.dataUnitSize, testCase.policyVersion)
+		}
+	}
+}
+
+// Tests that only the combinations of encryption modes which the kernel accepts
+// are valid, and only with the policy versions which support them.
+func TestEncryptionModesValidity(t *testing.T) {
+	testCases := []struct {
+		contents, filenames EncryptionOptions_Mode
+		policyVersion       int64
+		valid               bool
+	}{
+		{EncryptionOptions_AES_256_XTS, EncryptionOptions_AES_256_CTS, 1, true},
+		{EncryptionOptions_AES_128_CBC, EncryptionOptions_AES_128_CTS, 1, true},
+		{EncryptionOptions_AES_128_CBC, EncryptionOptions_AES_128_CTS, 2, true},
+		{EncryptionOptions_Adiantum, EncryptionOptions_Adiantum, 1, true},
+		{EncryptionOptions_AES_256_XTS, EncryptionOptions_AES_256_HCTR2, 2, true},
+		{EncryptionOptions_AES_256_XTS, EncryptionOptions_AES_256_HCTR2, 1, false},
+		{EncryptionOptions_AES_128_CBC, EncryptionOptions_AES_256_CTS, 2, false},
+		{EncryptionOptions_AES_256_XTS, EncryptionOptions_AES_128_CTS, 2, false},
+		{EncryptionOptions_Adiantum, EncryptionOptions_AES_256_CTS, 2, false},
+		{EncryptionOptions_AES_256_GCM, EncryptionOptions_AES_256_CTS, 2, false},
+	}
+	for _, testCase := range testCases {
+		options := proto.Clone(goodV2EncryptionOptions).(*EncryptionOptions)
+		options.Contents = testCase.contents
+		options.Filenames = testCase.filenames
+		options.PolicyVersion = testCase.policyVersion
+		err := options.CheckValidity()
+		if testCase.valid && err != nil {
+			t.Errorf("options %v should be valid: %v", options, err)
+		} else if !testCase.valid && err == nil {
+			t.Errorf("options %v should be invalid", options)
+		}
+	}
+}
+
+// Tests that a data unit size larger than the filesystem block size is rejected.
+func TestSetPolicyDataUnitSizeTooLarge(t *testing.T) {
+	directory, err := createTestDirectory(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	policy := proto.Clone(goodV2Policy).(*PolicyData)
+	policy.Options.DataUnitSize = 1 << 30
+	err = SetPolicy(directory, policy)
+	if _, ok := err.(*ErrDataUnitSizeTooLarge); !ok {
+		t.Errorf("expected ErrDataUnitSizeTooLarge, got %v", err)
+	}
+}
+
+// Tests that the data unit size of a policy is read back correctly. Root is
+// needed to set a v2 policy without adding its key.
+func TestGetPolicyDataUnitSize(t *testing.T) {
+	if !util.IsUserRoot() {
+		t.Skip("This test must be run as root")
+	}
+	directory, err := createTestDirectory(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	requireV2PolicySupport(t, directory)
+
+	policy := proto.Clone(goodV2Policy).(*PolicyData)
+	policy.Options.DataUnitSize = minDataUnitSize
+	err = SetPolicy(directory, policy)
+	if _, ok := err.(*ErrBadEncryptionOptions); ok {
+		t.Skip("No kernel support for data unit sizes, skipping test")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	actualPolicy, err := GetPolicy(directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !proto.Equal(actualPolicy, policy) {
+		t.Errorf("policy %+v does not equal expected policy %+v", actualPolicy, policy)
+	}
+}
+
+// Tests that DIRECT_KEY is used exactly for Adiantum, unless disabled, and that
+// disabling it is only valid for Adiantum.
+func TestDirectKeyFlag(t *testing.T) {
+	adiantum := EncryptionOptions_Adiantum
+	testCases := []struct {
+		contents, filenames EncryptionOptions_Mode
+		noDirectKey         bool
+		valid, directKey    bool
+	}{
+		{adiantum, adiantum, false, true, true},
+		{adiantum, adiantum, true, true, false},
+		{EncryptionOptions_AES_256_XTS, EncryptionOptions_AES_256_CTS, false, true, false},
+		{EncryptionOptions_AES_256_XTS, EncryptionOptions_AES_256_CTS, true, false, false},
+		{EncryptionOptions_AES_128_CBC, EncryptionOptions_AES_128_CTS, false, true, false},
+		{EncryptionOptions_AES_128_CBC, EncryptionOptions_AES_128_CTS, true, false, false},
+	}
+	for _, testCase := range testCases {
+		options := proto.Clone(goodV2EncryptionOptions).(*EncryptionOptions)
+		options.Contents = testCase.contents
+		options.Filenames = testCase.filenames
+		options.NoDirectKey = testCase.noDirectKey
+		if err := options.CheckValidity(); testCase.valid && err != nil {
+			t.Errorf("options %v should be valid: %v", options, err)
+		} else if !testCase.valid && err != ErrDirectKeyUnsupported {
+			t.Errorf("options %v: expected ErrDirectKeyUnsupported, got %v", options, err)
+		}
+		if !testCase.valid {
+			continue
+		}
+		flags := buildPolicyFlags(options)
+		if (flags&unix.FSCRYPT_POLICY_FLAG_DIRECT_KEY != 0) != testCase.directKey {
+			t.Errorf("options %v: got flags %#x, expected DIRECT_KEY to be %v",
+				options, flags, testCase.directKey)
+		}
+		// The options read back from the kernel must match.
+		readBack := &EncryptionOptions{Contents: options.Contents, Filenames: options.Filenames}
+		setNoDirectKey(readBack, flags)
+		if readBack.NoDirectKey != options.NoDirectKey {
+			t.Errorf("options %v: flags %#x were read back with NoDirectKey=%v",
+				options, flags, readBack.NoDirectKey)
+		}
+	}
+}
+
+// Tests the computation of encrypted filename lengths against the kernel's
+// padding rules.
+func TestEncryptedFilenameLength(t *testing.T) {
+	testCases := []struct {
+		padding int64
+		nameLen int
+		length  int
+	}{
+		{4, 1, 16},
+		{32, 1, 32},
+		{4, 17, 20},
+		{16, 17, 32},
+		{32, 33, 64},
+		{32, 224, 224},
+		{32, 225, 255},
+		{4, 253, 255},
+		{32, 255, 255},
+	}
+	for _, testCase := range testCases {
+		opts := &EncryptionOptions{Padding: testCase.padding}
+		length, ok := encryptedFilenameLength(opts, testCase.nameLen, unix.NAME_MAX)
+		if !ok || length != testCase.length {
+			t.Errorf("padding %d, length %d: got %d (ok=%v), expected %d",
+				testCase.padding, testCase.nameLen, length, ok, testCase.length)
+		}
+	}
+	if _, ok := encryptedFilenameLength(DefaultOptions, unix.NAME_MAX+1, unix.NAME_MAX); ok {
+		t.Error("name longer than NAME_MAX should not fit")
+	}
+}
+
+func TestMaxFilenameLength(t *testing.T) {
+	for _, padding := range paddingArray {
+		opts := &EncryptionOptions{Padding: padding}
+		if max := MaxFilenameLength(opts); max != unix.NAME_MAX {
+			t.Errorf("padding %d: max filename length is %d", padding, max)
+		}
+	}
+	if max := maxFilenameLength(DefaultOptions, 10); max != 10 {
+		t.Errorf("max filename length with small limit is %d", max)
+	}
+}
+
+// Tests that probing for support of encryption options gives the expected
+// results for options which every kernel with v1 policies supports or rejects,
+// and that the probe directory is cleaned up.
+func TestProbeSupport(t *testing.T) {
+	directory, err := createTestDirectory(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	supported, err := ProbeSupport(directory, 1, EncryptionOptions_AES_256_XTS,
+		EncryptionOptions_AES_256_CTS, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !supported {
+		t.Error("AES_256_XTS/AES_256_CTS should be supported")
+	}
+	supported, err = ProbeSupport(directory, 1, EncryptionOptions_AES_256_CTS,
+		EncryptionOptions_AES_256_XTS, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if supported {
+		t.Error("AES_256_CTS/AES_256_XTS should not be supported")
+	}
+	// The kernel checks v2 policies' options before whether their key has
+	// been added, so they can be probed without a key.
+	supported, err = ProbeOptions(directory, goodV2EncryptionOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !supported {
+		t.Errorf("options %v should be supported", goodV2EncryptionOptions)
+	}
+
+	entries, err := os.ReadDir(directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("probe left %d entries behind", len(entries))
+	}
+}
+
+func fakeWrappedPolicyKey(shareIndex int64) *WrappedPolicyKey {
+	wrapped := &WrappedKeyData{
+		IV:           make([]byte, IVLen),
+		EncryptedKey: make([]byte, PolicyKeyLen),
+		Hmac:         make([]byte, HMACLen),
+	}
+	w := &WrappedPolicyKey{ProtectorDescriptor: "0123456789abcdef"}
+	if shareIndex == 0 {
+		w.WrappedKey = wrapped
+	} else {
+		w.WrappedShare = wrapped
+		w.ShareIndex = shareIndex
+	}
+	return w
+}
+
+// Tests that policies whose key is split into shares are only valid if there
+// are enough distinct shares, and that shares and whole keys aren't mixed.
+func TestPolicyThresholdValidity(t *testing.T) {
+	testCases := []struct {
+		threshold    int64
+		shareIndices []int64 // 0 means the whole key
+		valid        bool
+	}{
+		{0, []int64{0, 0}, true},
+		{1, []int64{0}, true},
+		{2, []int64{1, 2, 3}, true},
+		{2, []int64{5, 255}, true},
+		{2, []int64{1}, false},
+		{2, []int64{1, 1}, false},
+		{2, []int64{1, 0}, false},
+		{0, []int64{1}, false},
+		{2, []int64{1, 256}, false},
+		{-1, []int64{0}, false},
+	}
+	for _, testCase := range testCases {
+		policy := proto.Clone(goodV1Policy).(*PolicyData)
+		policy.Threshold = testCase.threshold
+		for _, shareIndex := range testCase.shareIndices {
+			policy.WrappedPolicyKeys = append(policy.WrappedPolicyKeys,
+				fakeWrappedPolicyKey(shareIndex))
+		}
+		err := policy.CheckValidity()
+		if testCase.valid && err != nil {
+			t.Errorf("threshold %d with shares %v should be valid: %v",
+				testCase.threshold, testCase.shareIndices, err)
+		} else if !testCase.valid && err == nil {
+			t.Errorf("threshold %d with shares %v should be invalid",
+				testCase.threshold, testCase.shareIndices)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+/*
+ * schema.go - Versioning and migration of the on-disk metadata
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package metadata
+
+import (
+	"github.com/pkg/errors"
+)
+
+// SchemaVersion is the version of the schema of the ProtectorData and
+// PolicyData written by this version of fscrypt. It must be incremented, and a
+// migration added to schemaMigrations, whenever newer code would misinterpret
+// metadata lacking a new field. Fields which older code can safely ignore
+// don't need a new version.
+const SchemaVersion = 2
+
+// HMACSchemaVersion is the first schema version whose protectors and policies
+// must have a metadata HMAC (see AuthenticatedMetadata). Metadata with an older
+// version was written before the HMAC existed, so it is accepted without one.
+const HMACSchemaVersion = 2
+
+// VersionedMetadata is metadata which records the version of its schema.
+type VersionedMetadata interface {
+	Metadata
+	GetSchemaVersion() int64
+}
+
+// schemaMigrations[v] upgrades metadata in place from schema version v to v+1.
+var schemaMigrations = []func(md VersionedMetadata){
+	migrateToVersion1,
+	migrateToVersion2,
+}
+
+// migrateToVersion1 upgrades metadata written before schema versions were
+// recorded. An unset policy version meant version 1, so it is made explicit.
+func migrateToVersion1(md VersionedMetadata) {
+	if policy, ok := md.(*PolicyData); ok && policy.Options != nil &&
+		policy.Options.PolicyVersion == 0 {
+		policy.Options.PolicyVersion = 1
+	}
+}
+
+// migrateToVersion2 upgrades metadata written before the metadata HMAC was
+// required. The HMAC can only be added once the key is known, so nothing
+// changes here; until then, the metadata is written with the older version
+// (see MigrateForWriting).
+func migrateToVersion2(md VersionedMetadata) {}
+
+// SchemaIsTooNew returns true if md was written by a newer version of fscrypt
+// with a schema this version doesn't understand.
+func SchemaIsTooNew(md VersionedMetadata) bool {
+	return md.GetSchemaVersion() > SchemaVersion
+}
+
+// CheckSchemaVersion returns an error if the schema version recorded in md is
+// negative, which no version of fscrypt writes.
+func CheckSchemaVersion(md VersionedMetadata) error {
+	if version := md.GetSchemaVersion(); version < 0 {
+		return errors.Errorf("invalid schema version %d", version)
+	}
+	return nil
+}
+
+// MigrateSchema upgrades md in place to SchemaVersion, and returns true if it
+// had an older version. md must have a valid schema version (see
+// CheckSchemaVersion) which isn't too new (see SchemaIsTooNew).
+func MigrateSchema(md VersionedMetadata) bool {
+	version := md.GetSchemaVersion()
+	if version >= SchemaVersion {
+		return false
+	}
+	for ; version < SchemaVersion; version++ {
+		schemaMigrations[version](md)
+	}
+	setSchemaVersion(md, SchemaVersion)
+	return true
+}
+
+// HasRequiredHMAC returns false if md is a protector or policy whose schema
+// version requires a metadata HMAC, but which has none.
+func HasRequiredHMAC(md VersionedMetadata) bool {
+	authenticated, ok := md.(AuthenticatedMetadata)
+	return !ok || md.GetSchemaVersion() < HMACSchemaVersion ||
+		len(authenticated.GetMetadataHmac()) > 0
+}
+
+// MigrateForWriting upgrades md like MigrateSchema, and then sets the schema
+// version it is written with, which is returned. This is SchemaVersion, unless
+// md lacks the metadata HMAC which that version requires, as it was changed
+// without its key. Then it keeps the last version before HMACs were required,
+// so that it's still accepted until its key is available to add one.
+func MigrateForWriting(md VersionedMetadata) int64 {
+	MigrateSchema(md)
+	if !HasRequiredHMAC(md) {
+		setSchemaVersion(md, HMACSchemaVersion-1)
+	}
+	return md.GetSchemaVersion()
+}
+
+func setSchemaVersion(md VersionedMetadata, version int64) {
+	switch md := md.(type) {
+	case *ProtectorData:
+		md.SchemaVersion = version
+	case *PolicyData:
+		md.SchemaVersion = version
+	}
+}
@@ -0,0 +1,117 @@
+/*
+ * schema_test.go - Tests for versioning the metadata schema
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package metadata
+
+import (
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// Each schema version needs a migration from the previous one.
+func TestSchemaMigrationsComplete(t *testing.T) {
+	if len(schemaMigrations) != SchemaVersion {
+		t.Errorf("%d migrations for schema version %d", len(schemaMigrations), SchemaVersion)
+	}
+}
+
+// Tests that metadata without a schema version survives a round trip through
+// the wire format and migration, and that migrating it again is a no-op.
+func TestMigrateSchema(t *testing.T) {
+	policy := &PolicyData{
+		KeyDescriptor: "0123456789abcdef",
+		Options: &EncryptionOptions{
+			Padding:   32,
+			Contents:  EncryptionOptions_AES_256_XTS,
+			Filenames: EncryptionOptions_AES_256_CTS,
+		},
+	}
+	data, err := proto.Marshal(policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	read := new(PolicyData)
+	if err = proto.Unmarshal(data, read); err != nil {
+		t.Fatal(err)
+	}
+	if read.SchemaVersion != 0 || SchemaIsTooNew(read) {
+		t.Fatalf("unversioned policy read with schema version %d", read.SchemaVersion)
+	}
+
+	if !MigrateSchema(read) {
+		t.Error("unversioned policy wasn't migrated")
+	}
+	if read.SchemaVersion != SchemaVersion || read.Options.PolicyVersion != 1 {
+		t.Errorf("migrated policy is %v", read)
+	}
+	migrated := proto.Clone(read)
+	if MigrateSchema(read) || !proto.Equal(read, migrated) {
+		t.Error("migrating a current policy changed it")
+	}
+
+	read.SchemaVersion = SchemaVersion + 1
+	if !SchemaIsTooNew(read) {
+		t.Error("newer schema version not detected")
+	}
+	if MigrateSchema(read) {
+		t.Error("policy with a newer schema was migrated")
+	}
+}
+
+func TestMigrateProtectorSchema(t *testing.T) {
+	protector := &ProtectorData{Source: SourceType_raw_key}
+	if !MigrateSchema(protector) || protector.SchemaVersion != SchemaVersion {
+		t.Errorf("protector has schema version %d after migration", protector.SchemaVersion)
+	}
+}
+
+// Tests that a negative schema version, which would index the migrations out of
+// range, is rejected.
+func TestCheckSchemaVersion(t *testing.T) {
+	policy := &PolicyData{SchemaVersion: -1}
+	if CheckSchemaVersion(policy) == nil {
+		t.Error("negative schema version wasn't rejected")
+	}
+	for _, version := range []int64{0, SchemaVersion, SchemaVersion + 1} {
+		policy.SchemaVersion = version
+		if err := CheckSchemaVersion(policy); err != nil {
+			t.Errorf("schema version %d rejected: %v", version, err)
+		}
+	}
+}
+
+// Tests that metadata lacking the HMAC which the current schema version requires
+// is written with the version before it, and is rejected with the current one.
+func TestMigrateForWriting(t *testing.T) {
+	policy := &PolicyData{KeyDescriptor: "0123456789abcdef"}
+	if version := MigrateForWriting(policy); version != HMACSchemaVersion-1 {
+		t.Errorf("policy without an HMAC written with schema version %d", version)
+	}
+	policy.SchemaVersion = HMACSchemaVersion
+	if HasRequiredHMAC(policy) {
+		t.Error("missing HMAC not detected")
+	}
+	policy.MetadataHmac = make([]byte, HMACLen)
+	if version := MigrateForWriting(policy); version != SchemaVersion {
+		t.Errorf("policy with an HMAC written with schema version %d", version)
+	}
+	if !HasRequiredHMAC(policy) {
+		t.Error("policy with an HMAC rejected")
+	}
+}
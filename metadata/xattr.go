@@ -0,0 +1,96 @@
+/*
+ * xattr.go - Storing a copy of a directory's policy metadata in an extended
+ * attribute of the directory itself.
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package metadata
+
+import (
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+	"google.golang.org/protobuf/proto"
+)
+
+// PolicyXattrName is the extended attribute which holds a copy of the policy
+// metadata of an encrypted directory. Only root can set attributes in the
+// security namespace, so other users can't plant a copy.
+const PolicyXattrName = "security.fscrypt.policy"
+
+// maxPolicyXattrSize is the largest value the kernel allows for an xattr.
+const maxPolicyXattrSize = 65536
+
+// ErrNoPolicyXattr indicates that a directory has no copy of its policy
+// metadata in PolicyXattrName.
+type ErrNoPolicyXattr struct {
+	Path string
+}
+
+func (err *ErrNoPolicyXattr) Error() string {
+	return "no copy of the policy metadata is stored in " + PolicyXattrName + " of " + err.Path
+}
+
+// SetPolicyXattr stores a copy of the policy metadata in PolicyXattrName of the
+// directory at path, replacing any existing copy.
+func SetPolicyXattr(path string, data *PolicyData) error {
+	if err := data.CheckValidity(); err != nil {
+		return errors.Wrap(err, "invalid policy")
+	}
+	value, err := proto.Marshal(data)
+	if err != nil {
+		return err
+	}
+	if err = unix.Lsetxattr(path, PolicyXattrName, value, 0); err != nil {
+		return errors.Wrapf(err, "failed to set %s of %q", PolicyXattrName, path)
+	}
+	return nil
+}
+
+// GetPolicyXattr returns the copy of the policy metadata stored in
+// PolicyXattrName of the directory at path. If there is none, the error is an
+// ErrNoPolicyXattr.
+func GetPolicyXattr(path string) (*PolicyData, error) {
+	value := make([]byte, maxPolicyXattrSize)
+	size, err := unix.Lgetxattr(path, PolicyXattrName, value)
+	switch err {
+	case nil:
+	case unix.ENODATA, unix.ENOTSUP:
+		return nil, &ErrNoPolicyXattr{path}
+	default:
+		return nil, errors.Wrapf(err, "failed to get %s of %q", PolicyXattrName, path)
+	}
+	data := new(PolicyData)
+	if err = proto.Unmarshal(value[:size], data); err != nil {
+		return nil, errors.Wrapf(err, "%s of %q is corrupted", PolicyXattrName, path)
+	}
+	if err = data.CheckValidity(); err != nil {
+		return nil, errors.Wrapf(err, "%s of %q is invalid", PolicyXattrName, path)
+	}
+	return data, nil
+}
+
+// RemovePolicyXattr removes the copy of the policy metadata from the directory
+// at path, if it has one.
+func RemovePolicyXattr(path string) error {
+	err := unix.Lremovexattr(path, PolicyXattrName)
+	if err == unix.ENODATA || err == unix.ENOTSUP {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to remove %s of %q", PolicyXattrName, path)
+	}
+	return nil
+}
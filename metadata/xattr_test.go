@@ -0,0 +1,90 @@
+/*
+ * xattr_test.go - Tests for storing policy metadata in extended attributes.
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package metadata
+
+import (
+	"os"
+	"testing"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+	"google.golang.org/protobuf/proto"
+)
+
+// Tests that a copy of the policy metadata can be stored in a directory's xattr,
+// read back, and removed.
+func TestPolicyXattr(t *testing.T) {
+	directory, err := createTestDirectory(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	if _, err = GetPolicyXattr(directory); err == nil {
+		t.Fatal("directory shouldn't have a copy of the policy metadata yet")
+	} else if _, ok := err.(*ErrNoPolicyXattr); !ok {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if err = SetPolicyXattr(directory, goodV2Policy); err != nil {
+		if cause := errors.Cause(err); cause == unix.ENOTSUP || cause == unix.EPERM {
+			t.Skip(err)
+		}
+		t.Fatal(err)
+	}
+	data, err := GetPolicyXattr(directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !proto.Equal(data, goodV2Policy) {
+		t.Errorf("got policy %v, expected %v", data, goodV2Policy)
+	}
+
+	if err = RemovePolicyXattr(directory); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = GetPolicyXattr(directory); err == nil {
+		t.Error("copy of the policy metadata wasn't removed")
+	}
+	// Removing it again does nothing.
+	if err = RemovePolicyXattr(directory); err != nil {
+		t.Error(err)
+	}
+}
+
+// Tests that invalid policy metadata isn't stored or read from an xattr.
+func TestPolicyXattrInvalid(t *testing.T) {
+	directory, err := createTestDirectory(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	if err = SetPolicyXattr(directory, &PolicyData{KeyDescriptor: "abc"}); err == nil {
+		t.Error("invalid policy metadata shouldn't be stored")
+	}
+	err = unix.Setxattr(directory, PolicyXattrName, []byte("not a policy"), 0)
+	if err == unix.ENOTSUP || err == unix.EPERM {
+		t.Skip(err)
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = GetPolicyXattr(directory); err == nil {
+		t.Error("corrupted copy of the policy metadata shouldn't be returned")
+	}
+}
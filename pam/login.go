@@ -27,7 +27,6 @@ import "C"
 
 import (
 	"fmt"
-	"log"
 	"sync"
 
 	"github.com/pkg/errors"
@@ -56,7 +55,7 @@ func userInput(prompt *C.char) *C.char {
 	fmt.Print(C.GoString(prompt))
 	input, err := util.ReadLine()
 	if err != nil {
-		log.Printf("getting input for PAM: %s", err)
+		util.Debugf("getting input for PAM: %s", err)
 		return nil
 	}
 	return C.CString(input)
@@ -67,9 +66,9 @@ func userInput(prompt *C.char) *C.char {
 // indicates an error occurred.
 //export passphraseInput
 func passphraseInput(prompt *C.char) *C.char {
-	log.Printf("getting secret data for PAM: %q", C.GoString(prompt))
+	util.Debugf("getting secret data for PAM: %q", C.GoString(prompt))
 	if tokenToCheck == nil {
-		log.Print("secret data requested multiple times")
+		util.Debug("secret data requested multiple times")
 		return nil
 	}
 
@@ -83,7 +82,7 @@ func passphraseInput(prompt *C.char) *C.char {
 // and returns an error otherwise. Note that unless we are currently running as
 // root, this check will only work for the user running this process.
 func IsUserLoginToken(username string, token *crypto.Key, quiet bool) error {
-	log.Printf("Checking login token for %s", username)
+	util.Debugf("Checking login token for %s", username)
 
 	// We require global state for the function. This function never takes
 	// ownership of the token, so it is not responsible for wiping it.
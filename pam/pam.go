@@ -30,11 +30,11 @@ package pam
 import "C"
 import (
 	"errors"
-	"log"
 	"os/user"
 	"unsafe"
 
 	"github.com/google/fscrypt/security"
+	"github.com/google/fscrypt/util"
 )
 
 // Handle wraps the C pam_handle_t type. This is used from within modules.
@@ -162,7 +162,7 @@ func (h *Handle) StopAsPamUser() error {
 	err := security.SetProcessPrivileges(h.origPrivs)
 	h.origPrivs = nil
 	if err != nil {
-		log.Print(err)
+		util.Debug(err)
 	}
 	return err
 }
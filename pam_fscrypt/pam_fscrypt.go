@@ -30,7 +30,6 @@ package main
 import "C"
 import (
 	"fmt"
-	"log"
 	"log/syslog"
 	"os"
 	"strconv"
@@ -43,6 +42,7 @@ import (
 	"github.com/google/fscrypt/keyring"
 	"github.com/google/fscrypt/pam"
 	"github.com/google/fscrypt/security"
+	"github.com/google/fscrypt/util"
 )
 
 const (
@@ -92,11 +92,11 @@ func Authenticate(handle *pam.Handle, _ map[string]bool) error {
 
 	// If this user doesn't have a login protector, no unlocking is needed.
 	if _, err := loginProtector(handle); err != nil {
-		log.Printf("no protector, no need for AUTHTOK: %s", err)
+		util.Debugf("no protector, no need for AUTHTOK: %s", err)
 		return nil
 	}
 
-	log.Print("copying AUTHTOK for use in the session open")
+	util.Debug("copying AUTHTOK for use in the session open")
 	authtok, err := handle.GetItem(pam.Authtok)
 	if err != nil {
 		return errors.Wrap(err, "could not get AUTHTOK")
@@ -137,7 +137,7 @@ func setupUserKeyringIfNeeded(handle *pam.Handle, policies []*actions.Policy) er
 	}
 	_, err = keyring.UserKeyringID(handle.PamUser, true)
 	if err != nil {
-		log.Printf("Setting up keyrings in PAM: %v", err)
+		util.Debugf("Setting up keyrings in PAM: %v", err)
 	}
 	return handle.StartAsPamUser()
 }
@@ -157,7 +157,7 @@ func isUnsupportedFork(handle *pam.Handle) bool {
 	}
 	expectedPid, err := strconv.Atoi(pidString)
 	if err != nil {
-		log.Printf("%s parse error: %v", pidLabel, err)
+		util.Debugf("%s parse error: %v", pidLabel, err)
 		return false
 	}
 	if os.Getpid() == expectedPid {
@@ -190,12 +190,12 @@ func OpenSession(handle *pam.Handle, _ map[string]bool) error {
 	// If there are no polices for the login protector, no unlocking needed.
 	protector, err := loginProtector(handle)
 	if err != nil {
-		log.Printf("no protector to unlock: %s", err)
+		util.Debugf("no protector to unlock: %s", err)
 		return nil
 	}
 	policies := policiesUsingProtector(protector, false)
 	if len(policies) == 0 {
-		log.Print("no policies to unlock")
+		util.Debug("no policies to unlock")
 		return nil
 	}
 
@@ -207,7 +207,7 @@ func OpenSession(handle *pam.Handle, _ map[string]bool) error {
 		return errors.Wrapf(err, "setting up user keyring")
 	}
 
-	log.Printf("unlocking %d policies protected with AUTHTOK", len(policies))
+	util.Debugf("unlocking %d policies protected with AUTHTOK", len(policies))
 	keyFn := func(_ actions.ProtectorInfo, retry bool) (*crypto.Key, error) {
 		if retry {
 			// Login passphrase and login protector have diverged.
@@ -235,7 +235,7 @@ func OpenSession(handle *pam.Handle, _ map[string]bool) error {
 	// We don't stop provisioning polices on error, we try all of them.
 	for _, policy := range policies {
 		if err := policy.UnlockWithProtector(protector); err != nil {
-			log.Printf("unlocking policy %s: %s", policy.Descriptor(), err)
+			util.Debugf("unlocking policy %s: %s", policy.Descriptor(), err)
 			continue
 		}
 		defer policy.Lock()
@@ -248,10 +248,10 @@ func OpenSession(handle *pam.Handle, _ map[string]bool) error {
 			return err
 		}
 		if provisionErr != nil {
-			log.Printf("provisioning policy %s: %s", policy.Descriptor(), provisionErr)
+			util.Debugf("provisioning policy %s: %s", policy.Descriptor(), provisionErr)
 			continue
 		}
-		log.Printf("policy %s provisioned by %v", policy.Descriptor(),
+		util.Debugf("policy %s provisioned by %v", policy.Descriptor(),
 			handle.PamUser.Username)
 	}
 	return nil
@@ -262,28 +262,28 @@ func OpenSession(handle *pam.Handle, _ map[string]bool) error {
 func CloseSession(handle *pam.Handle, args map[string]bool) error {
 	// Only do stuff on session close when we are the last session
 	if count, err := AdjustCount(handle, -1); err != nil || count != 0 {
-		log.Printf("count is %d and we are not locking", count)
+		util.Debugf("count is %d and we are not locking", count)
 		return err
 	}
 
 	if args[lockPoliciesFlag] {
-		log.Print("ignoring deprecated 'lock_policies' option (now the default)")
+		util.Debug("ignoring deprecated 'lock_policies' option (now the default)")
 	}
 
 	if args[dropCachesFlag] {
-		log.Print("ignoring deprecated 'drop_caches' option (now auto-detected)")
+		util.Debug("ignoring deprecated 'drop_caches' option (now auto-detected)")
 	}
 
 	// Don't automatically drop privileges, since we may need them to
 	// deprovision policies or to drop caches.
 
 	if !args[unlockOnlyFlag] {
-		log.Print("locking policies protected with login protector")
+		util.Debug("locking policies protected with login protector")
 		needDropCaches, errLock := lockLoginPolicies(handle)
 
 		var errCache error
 		if needDropCaches {
-			log.Print("dropping appropriate filesystem caches at session close")
+			util.Debug("dropping appropriate filesystem caches at session close")
 			errCache = security.DropFilesystemCache()
 		}
 		if errLock != nil {
@@ -308,12 +308,12 @@ func lockLoginPolicies(handle *pam.Handle) (bool, error) {
 	// If there are no polices for the login protector, no locking needed.
 	protector, err := loginProtector(handle)
 	if err != nil {
-		log.Printf("nothing to lock: %s", err)
+		util.Debugf("nothing to lock: %s", err)
 		return needDropCaches, nil
 	}
 	policies := policiesUsingProtector(protector, true)
 	if len(policies) == 0 {
-		log.Print("no policies to lock")
+		util.Debug("no policies to lock")
 		return needDropCaches, nil
 	}
 
@@ -334,10 +334,10 @@ func lockLoginPolicies(handle *pam.Handle) (bool, error) {
 			return needDropCaches, err
 		}
 		if deprovisionErr != nil {
-			log.Printf("deprovisioning policy %s: %s", policy.Descriptor(), deprovisionErr)
+			util.Debugf("deprovisioning policy %s: %s", policy.Descriptor(), deprovisionErr)
 			continue
 		}
-		log.Printf("policy %s deprovisioned by %v", policy.Descriptor(), handle.PamUser.Username)
+		util.Debugf("policy %s deprovisioned by %v", policy.Descriptor(), handle.PamUser.Username)
 	}
 	return needDropCaches, nil
 }
@@ -359,7 +359,7 @@ func Chauthtok(handle *pam.Handle, _ map[string]bool) error {
 
 	protector, err := loginProtector(handle)
 	if err != nil {
-		log.Printf("no login protector to rewrap: %s", err)
+		util.Debugf("no login protector to rewrap: %s", err)
 		return nil
 	}
 
@@ -388,7 +388,7 @@ func Chauthtok(handle *pam.Handle, _ map[string]bool) error {
 		return crypto.NewKeyFromCString(authtok)
 	}
 
-	log.Print("rewrapping login protector")
+	util.Debug("rewrapping login protector")
 	if err = protector.Unlock(oldKeyFn); err != nil {
 		return err
 	}
@@ -94,11 +94,11 @@ func (f *PamFunc) Run(pamh unsafe.Pointer, argc C.int, argv **C.char) (ret C.int
 		}
 	}()
 
-	log.Printf("%s(%v) starting", f.name, args)
+	util.Debugf("%s(%v) starting", f.name, args)
 	handle, err := pam.NewHandle(pamh)
 	if err == nil {
 		if isSystemUser(handle.PamUser) {
-			log.Printf("invoked for system user %q (%s), doing nothing",
+			util.Debugf("invoked for system user %q (%s), doing nothing",
 				handle.PamUser.Username, handle.PamUser.Uid)
 			err = nil
 		} else {
@@ -109,7 +109,7 @@ func (f *PamFunc) Run(pamh unsafe.Pointer, argc C.int, argv **C.char) (ret C.int
 		fmt.Fprintf(errorWriter, "%s(%v) failed: %s", f.name, args, err)
 		return C.PAM_SERVICE_ERR
 	}
-	log.Printf("%s(%v) succeeded", f.name, args)
+	util.Debugf("%s(%v) succeeded", f.name, args)
 	return C.PAM_SUCCESS
 }
 
@@ -136,6 +136,7 @@ func setupLogging(args map[string]bool) io.Writer {
 		debugWriter, err := syslog.New(syslog.LOG_DEBUG, moduleName)
 		if err == nil {
 			log.SetOutput(debugWriter)
+			util.SetLogLevel(util.LogDebug)
 		}
 	}
 
@@ -184,7 +185,7 @@ func loginProtector(handle *pam.Handle) (*actions.Protector, error) {
 func policiesUsingProtector(protector *actions.Protector, provisioned bool) []*actions.Policy {
 	mounts, err := filesystem.AllFilesystems()
 	if err != nil {
-		log.Print(err)
+		util.Debug(err)
 		return nil
 	}
 
@@ -194,13 +195,13 @@ func policiesUsingProtector(protector *actions.Protector, provisioned bool) []*a
 		if _, _, err := mount.GetProtector(protector.Descriptor(),
 			protector.Context.TrustedUser); err != nil {
 			if _, ok := err.(*filesystem.ErrNotSetup); !ok {
-				log.Print(err)
+				util.Debug(err)
 			}
 			continue
 		}
 		policyDescriptors, err := mount.ListPolicies(protector.Context.TrustedUser)
 		if err != nil {
-			log.Printf("listing policies: %s", err)
+			util.Debugf("listing policies: %s", err)
 			continue
 		}
 
@@ -210,7 +211,7 @@ func policiesUsingProtector(protector *actions.Protector, provisioned bool) []*a
 		for _, policyDescriptor := range policyDescriptors {
 			policy, err := actions.GetPolicy(&ctx, policyDescriptor)
 			if err != nil {
-				log.Printf("reading policy: %s", err)
+				util.Debugf("reading policy: %s", err)
 				continue
 			}
 
@@ -219,13 +220,13 @@ func policiesUsingProtector(protector *actions.Protector, provisioned bool) []*a
 			}
 			if provisioned {
 				if !policy.IsProvisionedByTargetUser() {
-					log.Printf("policy %s not provisioned by %v",
+					util.Debugf("policy %s not provisioned by %v",
 						policy.Descriptor(), ctx.TargetUser.Username)
 					continue
 				}
 			} else {
 				if policy.IsProvisionedByTargetUser() {
-					log.Printf("policy %s already provisioned by %v",
+					util.Debugf("policy %s already provisioned by %v",
 						policy.Descriptor(), ctx.TargetUser.Username)
 					continue
 				}
@@ -264,7 +265,7 @@ func AdjustCount(handle *pam.Handle, delta int) (int, error) {
 		return 0, err
 	}
 
-	log.Printf("Session count for UID=%s updated to %d", handle.PamUser.Uid, newCount)
+	util.Debugf("Session count for UID=%s updated to %d", handle.PamUser.Uid, newCount)
 	return newCount, nil
 }
 
@@ -20,10 +20,11 @@
 package security
 
 import (
-	"log"
 	"os"
 
 	"golang.org/x/sys/unix"
+
+	"github.com/google/fscrypt/util"
 )
 
 // DropFilesystemCache instructs the kernel to free the reclaimable inodes and
@@ -31,11 +32,33 @@ import (
 // not present no longer accessible. Requires root privileges.
 func DropFilesystemCache() error {
 	// Dirty reclaimable inodes must be synced so that they will be freed.
-	log.Print("syncing changes to filesystem")
+	util.Debug("syncing changes to filesystem")
 	unix.Sync()
+	return dropReclaimable()
+}
+
+// DropFilesystemCacheOf is like DropFilesystemCache, but only syncs the
+// filesystem containing path, rather than all of them, so that purging a
+// single policy disturbs the rest of the system less. The reclaimable inodes
+// and dentries are still freed on all filesystems, as the kernel offers no way
+// to limit that. Requires root privileges.
+func DropFilesystemCacheOf(path string) error {
+	util.Debugf("syncing changes to the filesystem containing %q", path)
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	err = unix.Syncfs(int(file.Fd()))
+	file.Close()
+	if err != nil {
+		return err
+	}
+	return dropReclaimable()
+}
 
+func dropReclaimable() error {
 	// See: https://www.kernel.org/doc/Documentation/sysctl/vm.txt
-	log.Print("freeing reclaimable inodes and dentries")
+	util.Debug("freeing reclaimable inodes and dentries")
 	file, err := os.OpenFile("/proc/sys/vm/drop_caches", os.O_WRONLY|os.O_SYNC, 0)
 	if err != nil {
 		return err
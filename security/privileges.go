@@ -42,7 +42,6 @@ package security
 import "C"
 
 import (
-	"log"
 	"os/user"
 	"syscall"
 
@@ -79,7 +78,7 @@ func ProcessPrivileges() (*Privileges, error) {
 		}
 		groups = groups[:n]
 	}
-	log.Printf("Current privs (real, effective): uid=(%d,%d) gid=(%d,%d) groups=%v",
+	util.Debugf("Current privs (real, effective): uid=(%d,%d) gid=(%d,%d) groups=%v",
 		ruid, euid, rgid, egid, groups)
 	return &Privileges{euid, egid, groups}, nil
 }
@@ -106,7 +105,7 @@ func UserPrivileges(user *user.User) (*Privileges, error) {
 // the output of ProcessPrivileges, calling SetProcessPrivileges with the
 // desired privs, then calling SetProcessPrivileges with the saved privs.
 func SetProcessPrivileges(privs *Privileges) error {
-	log.Printf("Setting euid=%d egid=%d groups=%v", privs.euid, privs.egid, privs.groups)
+	util.Debugf("Setting euid=%d egid=%d groups=%v", privs.euid, privs.egid, privs.groups)
 
 	// If setting privs as root, we need to set the euid to 0 first, so that
 	// we will have the necessary permissions to make the other changes to
@@ -135,7 +134,7 @@ func SetProcessPrivileges(privs *Privileges) error {
 
 // SetUids sets the process's real, effective, and saved UIDs.
 func SetUids(ruid, euid, suid int) error {
-	log.Printf("Setting ruid=%d euid=%d suid=%d", ruid, euid, suid)
+	util.Debugf("Setting ruid=%d euid=%d suid=%d", ruid, euid, suid)
 	// We elevate all the privs before setting them. This prevents issues
 	// with (ruid=1000,euid=1000,suid=0), where just a single call to
 	// setresuid might fail with permission denied.
@@ -0,0 +1,108 @@
+/*
+ * log.go - Leveled logging used throughout fscrypt
+ *
+ * Copyright 2026 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy of
+ * the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+ * License for the specific language governing permissions and limitations under
+ * the License.
+ */
+
+package util
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+)
+
+// LogLevel is the minimum severity of the messages which are logged. Messages
+// are written to the standard logger from the "log" package, so the program
+// decides where they go (e.g. stderr or syslog) by calling log.SetOutput.
+//
+// Nothing logged at any level may contain secret material: keys, passphrases,
+// and PINs must never be passed to these functions, even at LogDebug.
+type LogLevel int32
+
+// The levels are in increasing order of detail.
+const (
+	LogError LogLevel = iota
+	LogWarn
+	LogInfo
+	LogDebug
+)
+
+var logLevelNames = []string{"error", "warn", "info", "debug"}
+
+// DefaultLogLevel is the level used when none is given.
+const DefaultLogLevel = LogError
+
+var logLevel = int32(DefaultLogLevel)
+
+func (level LogLevel) String() string {
+	if level < 0 || int(level) >= len(logLevelNames) {
+		return fmt.Sprintf("LogLevel(%d)", level)
+	}
+	return logLevelNames[level]
+}
+
+// ParseLogLevel returns the level with the given name (case insensitive).
+func ParseLogLevel(name string) (LogLevel, error) {
+	for i, levelName := range logLevelNames {
+		if strings.EqualFold(name, levelName) {
+			return LogLevel(i), nil
+		}
+	}
+	return 0, fmt.Errorf("log level %q is not one of %s", name,
+		strings.Join(logLevelNames, ", "))
+}
+
+// SetLogLevel sets the most detailed level which will be logged.
+func SetLogLevel(level LogLevel) {
+	atomic.StoreInt32(&logLevel, int32(level))
+}
+
+// GetLogLevel returns the most detailed level which will be logged.
+func GetLogLevel() LogLevel {
+	return LogLevel(atomic.LoadInt32(&logLevel))
+}
+
+// formatLogLine formats a message as a line of space separated key=value
+// pairs, so the logs can be filtered by level and parsed by other tools.
+func formatLogLine(level LogLevel, msg string) string {
+	return fmt.Sprintf("level=%s msg=%q", level, strings.TrimSuffix(msg, "\n"))
+}
+
+func output(level LogLevel, msg string) {
+	if level > GetLogLevel() {
+		return
+	}
+	// Skip output and the exported function calling it, so the caller's
+	// location is used if the logger has log.Lshortfile set.
+	log.Output(3, formatLogLine(level, msg))
+}
+
+// Errorf logs a failure which isn't reported to the caller in some other way.
+func Errorf(format string, v ...interface{}) { output(LogError, fmt.Sprintf(format, v...)) }
+
+// Warnf logs something which is likely to be a problem.
+func Warnf(format string, v ...interface{}) { output(LogWarn, fmt.Sprintf(format, v...)) }
+
+// Infof logs a notable event, such as a change made to the system.
+func Infof(format string, v ...interface{}) { output(LogInfo, fmt.Sprintf(format, v...)) }
+
+// Debugf logs details of what fscrypt is doing, such as the ioctls and system
+// calls made and the metadata files read.
+func Debugf(format string, v ...interface{}) { output(LogDebug, fmt.Sprintf(format, v...)) }
+
+// Debug logs its arguments at LogDebug, formatted in the manner of fmt.Sprint.
+func Debug(v ...interface{}) { output(LogDebug, fmt.Sprint(v...)) }
@@ -25,8 +25,8 @@ package util
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
-	"log"
 	"os"
 	"os/user"
 	"strconv"
@@ -143,19 +143,28 @@ func Chown(file *os.File, user *user.User) error {
 	return file.Chown(uid, gid)
 }
 
+// KernelRelease returns the release of the running Linux kernel, as given by
+// "uname -r".
+func KernelRelease() (string, error) {
+	var uname unix.Utsname
+	if err := unix.Uname(&uname); err != nil {
+		return "", err
+	}
+	return string(bytes.TrimRight(uname.Release[:], "\x00")), nil
+}
+
 // IsKernelVersionAtLeast returns true if the Linux kernel version is at least
 // major.minor. If something goes wrong it assumes false.
 func IsKernelVersionAtLeast(major, minor int) bool {
-	var uname unix.Utsname
-	if err := unix.Uname(&uname); err != nil {
-		log.Printf("Uname failed [%v], assuming old kernel", err)
+	release, err := KernelRelease()
+	if err != nil {
+		Debugf("Uname failed [%v], assuming old kernel", err)
 		return false
 	}
-	release := string(uname.Release[:])
-	log.Printf("Kernel version is %s", release)
+	Debugf("Kernel version is %s", release)
 	var actualMajor, actualMinor int
 	if n, _ := fmt.Sscanf(release, "%d.%d", &actualMajor, &actualMinor); n != 2 {
-		log.Printf("Unrecognized uname format %q, assuming old kernel", release)
+		Debugf("Unrecognized uname format %q, assuming old kernel", release)
 		return false
 	}
 	return actualMajor > major ||
@@ -21,6 +21,9 @@ package util
 
 import (
 	"bytes"
+	"log"
+	"os"
+	"strings"
 	"testing"
 	"unsafe"
 )
@@ -98,3 +101,38 @@ func TestIsKernelVersionAtLeast(t *testing.T) {
 		t.Error("IsKernelVersionAtLeast() is broken")
 	}
 }
+
+func TestParseLogLevel(t *testing.T) {
+	for _, level := range []LogLevel{LogError, LogWarn, LogInfo, LogDebug} {
+		parsed, err := ParseLogLevel(strings.ToUpper(level.String()))
+		if err != nil || parsed != level {
+			t.Errorf("ParseLogLevel(%q) = %v, %v", level, parsed, err)
+		}
+	}
+	if _, err := ParseLogLevel("verbose"); err == nil {
+		t.Error("unknown log level should fail to parse")
+	}
+}
+
+// Make sure only messages at or below the log level are written, one per line.
+func TestLogLevelFiltering(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	log.SetFlags(0)
+	defer func() {
+		log.SetOutput(os.Stderr)
+		log.SetFlags(log.LstdFlags)
+		SetLogLevel(DefaultLogLevel)
+	}()
+
+	SetLogLevel(LogWarn)
+	Errorf("first %d", 1)
+	Warnf("second")
+	Infof("third")
+	Debug("fourth")
+
+	expected := "level=error msg=\"first 1\"\nlevel=warn msg=\"second\"\n"
+	if buf.String() != expected {
+		t.Errorf("logged %q, expected %q", buf.String(), expected)
+	}
+}